@@ -0,0 +1,47 @@
+package amp
+
+// ReceiptsTopic is default topic of the delivery receipts. Producer can
+// set other topic in ReplyTo of the message which requires ack.
+const ReceiptsTopic = "system.receipts"
+
+// Delivery statuses of the receipt.
+const (
+	Delivered   = "delivered"   // client acknowledged message
+	Undelivered = "undelivered" // all delivery attempts failed or client disconnected
+)
+
+// Receipt is body of the delivery receipt message, sent to the producer
+// for each client which got message with RequiresAck.
+type Receipt struct {
+	URI      string            `json:"uri"`
+	Ts       int64             `json:"ts"`
+	Status   string            `json:"status"`
+	Attempts int               `json:"attempts"`       // number of writes to the client
+	Meta     map[string]string `json:"meta,omitempty"` // client session meta
+}
+
+// NewAck creates client acknowledgment of the received message.
+func NewAck(m *Msg) *Msg {
+	return &Msg{
+		Type: Ack,
+		URI:  m.URI,
+		Ts:   m.Ts,
+	}
+}
+
+// IsAck returns true if message is Ack type.
+func (m *Msg) IsAck() bool {
+	return m.Type == Ack
+}
+
+// NewReceipt creates receipt of the message which requires ack. Receipt
+// is published to the ReplyTo topic of the message or to ReceiptsTopic.
+func (m *Msg) NewReceipt(r Receipt) *Msg {
+	topic := m.ReplyTo
+	if topic == "" {
+		topic = ReceiptsTopic
+	}
+	r.URI = m.URI
+	r.Ts = m.Ts
+	return NewPublish(topic, "", TS(), Append, r)
+}
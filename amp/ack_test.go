@@ -0,0 +1,30 @@
+package amp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAck(t *testing.T) {
+	m := Build().Type(Publish).URI("notify/u1").Ts(42).RequireAck().MustMsg()
+	m = Parse(m.Marshal())
+	assert.True(t, m.RequiresAck)
+
+	a := Parse(NewAck(m).Marshal())
+	assert.True(t, a.IsAck())
+	assert.Equal(t, "notify/u1", a.URI)
+	assert.Equal(t, int64(42), a.Ts)
+	assert.Equal(t, PriorityHigh, a.Lane())
+	_, err := ParseStrict(a.Marshal(), Limits{})
+	assert.Nil(t, err)
+
+	r := Parse(m.NewReceipt(Receipt{Status: Delivered, Attempts: 1}).Marshal())
+	assert.Equal(t, ReceiptsTopic, r.URI)
+	var rb Receipt
+	assert.Nil(t, r.Unmarshal(&rb))
+	assert.Equal(t, Receipt{URI: "notify/u1", Ts: 42, Status: Delivered, Attempts: 1}, rb)
+
+	m.ReplyTo = "notify.receipts"
+	assert.Equal(t, "notify.receipts", m.NewReceipt(Receipt{}).URI)
+}
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/minus5/svckit/log"
+	"github.com/pkg/errors"
 )
 
 // Message types
@@ -24,6 +25,9 @@ const (
 	Alive                  // signal that server side is still alive
 	Current                // request for current state of a stream
 	Event                  // TODO unused yet, just thinking
+	Status                 // topic status (stale/online), sent to subscribers by broker
+	Connect                // connection handshake, Hello from the client and Welcome reply (see hello.go)
+	Ack                    // client acknowledgment of the message which requires it (see ack.go)
 )
 
 // Topic update types
@@ -35,6 +39,9 @@ const (
 	Close                   // last message for the topic, topic is closed after this
 	BurstStart              // indicate that there will be burst of messages for the topic ...
 	BurstEnd                // so we can stop updating UI until we get BurstEnd message
+	FullStart               // first part of the chunked full (see ChunkFull)
+	FullPart                // middle part of the chunked full
+	FullEnd                 // last part of the chunked full, with checksum
 )
 
 // Error sources
@@ -55,14 +62,27 @@ const (
 	CompressionDeflate
 )
 
+// Message priorities
+const (
+	PriorityNormal uint8 = iota
+	PriorityHigh         // control messages, never stuck behind diffs
+	PriorityLow          // can wait during congestion
+)
+
 const (
 	CompatibilityVersionDefault uint8 = iota
 	CompatibilityVersion1
+	CompatibilityVersionProtocol1 // legacy format without meta and binary bodies for ProtocolVersion1 clients
+	CompatibilityVersionLegacy    // legacy format for clients without protocol version
 )
 
+// ContentTypeBinary is default content type of the binary body.
+const ContentTypeBinary = "application/octet-stream"
+
 var (
-	compressionLenLimit = 8 * 1024 // do not compress messages smaller than
-	separtor            = []byte{10}
+	separtor = []byte{10}
+	// ErrBinaryBody is returned when unmarshaling binary body as json.
+	ErrBinaryBody = errors.New("binary body")
 )
 
 // Subscriber is the interface for subscribing to the topics
@@ -86,24 +106,42 @@ type Msg struct {
 	UpdateType    uint8             `json:"p,omitempty"` // explains how to handle publish message
 	Replay        uint8             `json:"l,omitempty"` // is this a re-play message (repeated)
 	Subscriptions map[string]int64  `json:"b,omitempty"` // topics to subscribe to
+	Filters       map[string]string `json:"f,omitempty"` // subscription filter expressions by uri (see amp/filter)
+	Chunk         *Chunk            `json:"k,omitempty"` // part of the chunked full
+	Checksum      uint32            `json:"h,omitempty"` // body checksum, see StampChecksum
 	CacheDepth    int               `json:"d,omitempty"` // cache depth for append update type messages
 	Meta          map[string]string `json:"m,omitempty"` // client session metadata
-
-	body          []byte
-	noCompression bool
-	payloads      map[uint8][]byte
-	src           BodyMarshaler
-	topic         string
-	path          string
+	Priority      uint8             `json:"y,omitempty"` // delivery lane during congestion
+	Origin        string            `json:"o,omitempty"` // datacenter of the original publisher, set by bridge
+	KeyID         string            `json:"x,omitempty"` // id of the key body is encrypted with (see TopicKeys)
+	DictID        string            `json:"z,omitempty"` // id of the dictionary body is compressed with (see Dicts)
+	ContentType   string            `json:"c,omitempty"` // content type of the binary body, json body if empty
+	Offset        int64             `json:"n,omitempty"` // position in the append topic log, set by broker
+	Timeout       int64             `json:"a,omitempty"` // request timeout milli, relative to the receipt, negative if expired, set by requester
+	Version       uint8             `json:"v,omitempty"` // client protocol version, see NegotiateVersion
+	RequiresAck   bool              `json:"q,omitempty"` // client should acknowledge delivery, see NewAck
+
+	body     []byte
+	payloads map[uint8][]byte
+	policy   *CompressionPolicy // resolved topic compression policy
+	src      BodyMarshaler
+	topic    string
+	path     string
+	params   map[string]string          // path parameters set by Router
+	deadline time.Time                  // local request deadline, set from Timeout on receipt
+	fields   map[string]json.RawMessage // cache of BodyField
 
 	sync.Mutex
 }
 
-// Error related attributes in the message
+// Error related attributes in the message.
+// Error implements error interface so handlers could return it (see Errf).
 type Error struct {
-	Source  uint8  `json:"s,omitempty"`
-	Message string `json:"m,omitempty"`
-	Code    int    `json:"c,omitempty"`
+	Source    uint8  `json:"s,omitempty"`
+	Message   string `json:"m,omitempty"` // user-facing message
+	Code      int    `json:"c,omitempty"`
+	Retryable bool   `json:"r,omitempty"` // request could be repeated
+	Internal  string `json:"-"`           // internal message, not sent to the client
 }
 
 // Parse decodes Msg from []byte
@@ -111,14 +149,22 @@ func Parse(buf []byte) *Msg {
 	if buf == nil {
 		return nil
 	}
-	parts := bytes.SplitN(buf, separtor, 2)
-	m := &Msg{}
-	if err := json.Unmarshal(parts[0], m); err != nil {
-		log.S("header", string(parts[0])).Error(err)
+	header, body := buf, []byte(nil)
+	if i := bytes.IndexByte(buf, separtor[0]); i >= 0 {
+		header, body = buf[:i], buf[i+1:]
+	}
+	m := acquireMsg()
+	if err := json.Unmarshal(header, m); err != nil {
+		log.S("header", string(header)).Error(err)
+		m.Release()
 		return nil
 	}
-	if len(parts) > 1 {
-		m.body = parts[1]
+	if body != nil {
+		m.body = body
+	}
+	if m.Timeout != 0 {
+		// timeout is relative, clocks of the hosts could differ
+		m.deadline = time.Now().Add(time.Duration(m.Timeout) * time.Millisecond)
 	}
 	return m
 }
@@ -153,63 +199,91 @@ func Undeflate(data []byte) []byte {
 
 // Marshal packs message for sending on the wire
 func (m *Msg) Marshal() []byte {
-	buf, _ := m.marshal(CompressionNone, CompatibilityVersionDefault)
+	buf, _ := m.marshal(CompressionNone, CompatibilityVersionDefault, nil)
 	return buf
 }
 
 // MarshalDeflate packs and compress message
+// if the topic compression policy allows.
 func (m *Msg) MarshalDeflate() ([]byte, bool) {
-	return m.marshal(CompressionDeflate, CompatibilityVersionDefault)
+	return m.marshal(CompressionDeflate, CompatibilityVersionDefault, nil)
+}
+
+// MarshalPolicy packs and compress message by the policy p
+// instead of the topic policy (used for per connection policies).
+func (m *Msg) MarshalPolicy(version uint8, p CompressionPolicy) ([]byte, bool) {
+	return m.marshal(CompressionDeflate, version, &p)
 }
 
 // marshal encodes message into []byte
-func (m *Msg) marshal(supportedCompression, version uint8) ([]byte, bool) {
+func (m *Msg) marshal(supportedCompression, version uint8, p *CompressionPolicy) ([]byte, bool) {
 	if version == CompatibilityVersion1 {
-		if m.UpdateType == BurstStart || m.UpdateType == BurstEnd {
+		if m.UpdateType == BurstStart || m.UpdateType == BurstEnd || m.IsChunk() || m.Type == Status || m.IsBinary() {
 			// unsuported mesage types in this version
 			return nil, false
 		}
 	}
+	if version == CompatibilityVersionProtocol1 || version == CompatibilityVersionLegacy {
+		if !m.isLegacy() || (version == CompatibilityVersionProtocol1 && m.IsBinary()) {
+			// unsupported message types in this version
+			return nil, false
+		}
+	}
 	m.Lock()
 	defer m.Unlock()
-	compression := supportedCompression
-	if m.noCompression {
-		compression = CompressionNone
+	if p == nil {
+		p = m.topicPolicy()
 	}
-	// check if we already have payload
-	key := payloadKey(compression, version)
-	if payload, ok := m.payloads[key]; ok {
-		return payload, compression != CompressionNone
+	if m.payloads == nil {
+		m.payloads = make(map[uint8][]byte)
 	}
-
-	payload := m.payload(version)
-	// decide wather we need compression
-	if len(payload) < compressionLenLimit {
-		m.noCompression = true
-		compression = CompressionNone
+	// uncompressed payload
+	key := payloadKey(CompressionNone, version)
+	payload, ok := m.payloads[key]
+	if !ok {
+		payload = m.payload(version)
+		m.payloads[key] = payload
 	}
-	// compress
-	if compression == CompressionDeflate {
-		payload = deflate(payload)
+	// decide wather we need compression
+	compression := p.compression(supportedCompression, len(payload))
+	if compression == CompressionNone {
+		return payload, false
 	}
-	// store payload
-	if m.payloads == nil {
-		m.payloads = make(map[uint8][]byte)
+	key = payloadKey(compression, version)
+	if compressed, ok := m.payloads[key]; ok {
+		return compressed, true
 	}
+	payload = deflate(payload)
 	m.payloads[key] = payload
+	return payload, true
+}
 
-	return payload, compression != CompressionNone
+// topicPolicy resolves topic compression policy once per message,
+// it is used for every subscriber.
+// Should be called during m.Lock.
+func (m *Msg) topicPolicy() *CompressionPolicy {
+	if m.policy == nil {
+		p := TopicCompression(m.Topic())
+		if p.Threshold == 0 {
+			p.Threshold = compressionLimit()
+		}
+		m.policy = &p
+	}
+	return m.policy
 }
 
 func (m *Msg) payload(version uint8) []byte {
-	var header []byte
+	buf := acquireBuf()
+	defer releaseBuf(buf)
 	if version == CompatibilityVersion1 {
-		header = m.marshalV1header()
+		buf.Write(m.marshalV1header())
+		buf.Write(separtor)
+	} else if version == CompatibilityVersionProtocol1 || version == CompatibilityVersionLegacy {
+		_ = json.NewEncoder(buf).Encode(legacyHeaderOf(m, version == CompatibilityVersionLegacy))
 	} else {
-		header, _ = json.Marshal(m)
+		// encoder writes header followed by separator (new line)
+		_ = json.NewEncoder(buf).Encode(m)
 	}
-	buf := bytes.NewBuffer(header)
-	buf.Write(separtor)
 	if m.body != nil {
 		buf.Write(m.body)
 	}
@@ -217,32 +291,54 @@ func (m *Msg) payload(version uint8) []byte {
 		body, _ := m.src.MarshalJSON()
 		buf.Write(body)
 	}
-	return buf.Bytes()
+	// copy out of the pooled buffer, payload is cached in the message
+	payload := make([]byte, buf.Len())
+	copy(payload, buf.Bytes())
+	return payload
 }
 
 func payloadKey(compression, version uint8) uint8 {
 	return version*4 + compression
 }
 
+// deflate compresses src for websocket permessage-deflate:
+// stream is sync flushed and the trailing 0x00 0x00 0xff 0xff is removed.
+// Close is not used, final block it writes is not the same in all Go versions.
+// Output buffer is pre-sized from the compression ratio of the previous payloads.
 func deflate(src []byte) []byte {
-	dest := bytes.NewBuffer(nil)
-	c, _ := flate.NewWriter(dest, flate.DefaultCompression)
+	dest := bytes.NewBuffer(make([]byte, 0, deflateRatio.size(len(src))))
+	c := acquireFlate(dest)
+	defer releaseFlate(c)
 	c.Write(src)
-	c.Close()
-	buf := dest.Bytes()
-	if len(buf) > 4 {
-		return buf[0 : len(buf)-4]
-	}
-	return buf
+	c.Flush()
+	deflateRatio.update(len(src), dest.Len())
+	return bytes.TrimSuffix(dest.Bytes(), []byte{0x00, 0x00, 0xff, 0xff})
 }
 
 // BodyTo unmarshals message body to the v
 func (m *Msg) BodyTo(v interface{}) error {
-	return json.Unmarshal(m.body, v)
+	return m.Unmarshal(v)
+}
+
+// BodyBytes returns message body.
+// For the messages created localy body is marshaled from the source object.
+func (m *Msg) BodyBytes() []byte {
+	if m.body != nil || m.src == nil {
+		return m.body
+	}
+	body, err := m.src.MarshalJSON()
+	if err != nil {
+		log.S("uri", m.URI).Error(err)
+		return nil
+	}
+	return body
 }
 
 // Unmarshal unmarshals message body to the v
 func (m *Msg) Unmarshal(v interface{}) error {
+	if m.IsBinary() {
+		return ErrBinaryBody
+	}
 	return json.Unmarshal(m.body, v)
 }
 
@@ -287,14 +383,19 @@ func (m *Msg) ResponseTransportError(err error) *Msg {
 	}
 }
 
+// ResponseError creates response message with application error.
+// If err is (or wraps) *Error its code, retryable flag and user-facing
+// message are used. Message is localized to the language in the request
+// metadata (see LangKey).
 func (m *Msg) ResponseError(err error) *Msg {
+	e := toError(err)
+	if lang := m.Meta[LangKey]; lang != "" {
+		e = e.Localize(lang)
+	}
 	return &Msg{
 		Type:          Response,
 		CorrelationID: m.CorrelationID,
-		Error: &Error{
-			Source:  ApplicationError,
-			Message: err.Error(),
-		},
+		Error:         e,
 	}
 }
 
@@ -305,6 +406,8 @@ func (m *Msg) Request() *Msg {
 		CorrelationID: m.CorrelationID,
 		URI:           m.URI,
 		Meta:          m.Meta,
+		Timeout:       m.remaining(),
+		deadline:      m.deadline,
 		src:           m.src,
 		body:          m.body,
 	}
@@ -319,6 +422,16 @@ func (m *Msg) Pong() *Msg {
 	}
 }
 
+// NewRequest creates new request type message for the uri.
+// Uri has structure topic/method.
+func NewRequest(uri string, o interface{}) *Msg {
+	return &Msg{
+		Type: Request,
+		URI:  uri,
+		src:  toBodyMarshaler(o),
+	}
+}
+
 // NewAlive creates new alive type message
 func NewAlive() *Msg {
 	return &Msg{Type: Alive}
@@ -366,6 +479,25 @@ func NewPublish(topic, path string, ts int64, updateType uint8, o interface{}) *
 	}
 }
 
+// NewPublishBinary creates publish message with the raw binary body.
+// Body is written after the header as is, without json encoding.
+// Content type defaults to ContentTypeBinary.
+func NewPublishBinary(topic, path string, ts int64, updateType uint8, body []byte, contentType string) *Msg {
+	m := NewPublish(topic, path, ts, updateType, nil)
+	m.src = nil
+	m.body = body
+	m.ContentType = contentType
+	if m.ContentType == "" {
+		m.ContentType = ContentTypeBinary
+	}
+	return m
+}
+
+// IsBinary returns true if message body is not json.
+func (m *Msg) IsBinary() bool {
+	return m.ContentType != ""
+}
+
 func toBodyMarshaler(o interface{}) BodyMarshaler {
 	if t, ok := o.(BodyMarshaler); ok {
 		return t
@@ -400,8 +532,8 @@ func (m *Msg) IsFull() bool {
 func (m *Msg) Topic() string {
 	if m.topic == "" {
 		m.topic = m.URI
-		if strings.Contains(m.URI, "/") {
-			m.topic = strings.Split(m.URI, "/")[0]
+		if i := strings.IndexByte(m.URI, '/'); i >= 0 {
+			m.topic = m.URI[:i]
 		}
 	}
 	return m.topic
@@ -409,11 +541,8 @@ func (m *Msg) Topic() string {
 
 // Path returns path part of the URI
 func (m *Msg) Path() string {
-	if strings.Contains(m.URI, "/") {
-		p := strings.SplitN(m.URI, "/", 2)
-		if len(p) > 1 {
-			return p[1]
-		}
+	if i := strings.IndexByte(m.URI, '/'); i >= 0 {
+		return m.URI[i+1:]
 	}
 	return ""
 }
@@ -421,14 +550,72 @@ func (m *Msg) Path() string {
 // AsReplay marks message as replay
 func (m *Msg) AsReplay() *Msg {
 	return &Msg{
-		Type:       m.Type,
-		URI:        m.URI,
-		UpdateType: m.UpdateType,
-		Replay:     Replay,
-		Ts:         m.Ts,
-		body:       m.body,
-		src:        m.src,
+		Type:        m.Type,
+		URI:         m.URI,
+		UpdateType:  m.UpdateType,
+		Replay:      Replay,
+		Ts:          m.Ts,
+		Priority:    m.Priority,
+		Origin:      m.Origin,
+		KeyID:       m.KeyID,
+		DictID:      m.DictID,
+		ContentType: m.ContentType,
+		Offset:      m.Offset,
+		body:        m.body,
+		src:         m.src,
+	}
+}
+
+// Rename returns copy of the message with different uri.
+// Used to deliver message of the renamed topic under the old name.
+func (m *Msg) Rename(uri string) *Msg {
+	return &Msg{
+		Type:        m.Type,
+		URI:         uri,
+		UpdateType:  m.UpdateType,
+		Replay:      m.Replay,
+		Ts:          m.Ts,
+		Error:       m.Error,
+		Chunk:       m.Chunk,
+		Checksum:    m.Checksum,
+		CacheDepth:  m.CacheDepth,
+		Priority:    m.Priority,
+		RequiresAck: m.RequiresAck,
+		Origin:      m.Origin,
+		KeyID:       m.KeyID,
+		DictID:      m.DictID,
+		ContentType: m.ContentType,
+		Offset:      m.Offset,
+		body:        m.body,
+		src:         m.src,
+	}
+}
+
+// SetOffset sets position of the message in the append topic log.
+func (m *Msg) SetOffset(offset int64) {
+	m.Lock()
+	defer m.Unlock()
+	m.Offset = offset
+	m.payloads = nil // header is changed
+}
+
+// Lane returns priority lane for the message.
+// Control messages (Full, Close, Ping, Pong, Alive) are in the high lane
+// unless priority is explicitly set.
+func (m *Msg) Lane() uint8 {
+	switch m.Priority {
+	case PriorityHigh, PriorityLow:
+		return m.Priority
+	}
+	switch m.Type {
+	case Ping, Pong, Alive, Status, Connect, Ack:
+		return PriorityHigh
+	case Publish:
+		if m.UpdateType == Full || m.UpdateType == Close {
+			return PriorityHigh
+		}
 	}
+	return PriorityNormal
 }
 
 type jsonMarshaler struct {
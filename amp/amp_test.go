@@ -1,8 +1,19 @@
 package amp
 
 import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/minus5/svckit/metric"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -89,6 +100,34 @@ func TestMarshalV1(t *testing.T) {
 
 }
 
+func TestMarshalLegacy(t *testing.T) {
+	m := &Msg{
+		Type:          Response,
+		CorrelationID: 7,
+		Error:         &Error{Message: "failed", Retryable: true},
+		URI:           "sportsbook/m",
+		Ts:            123,
+		Meta:          map[string]string{"client": "web"},
+		Priority:      PriorityHigh,
+		Offset:        3,
+		Timeout:       456,
+		body:          []byte(`{}`),
+	}
+	// header keys known before protocol versions, in the same order
+	buf := m.MarshalCompatiblity(CompatibilityVersionLegacy)
+	assert.Equal(t, `{"t":3,"i":7,"e":{"m":"failed"},"u":"sportsbook/m","s":123,"m":{"client":"web"}}
+{}`, string(buf))
+	buf = m.MarshalCompatiblity(CompatibilityVersionProtocol1)
+	assert.Equal(t, `{"t":3,"i":7,"e":{"m":"failed"},"u":"sportsbook/m","s":123}
+{}`, string(buf))
+
+	// new message and update types are not sent
+	for _, c := range ChunkFull(NewPublish("big", "m", 1, Full, strings.Repeat("x", 64)), 16) {
+		assert.Nil(t, c.MarshalCompatiblity(CompatibilityVersionLegacy))
+	}
+	assert.Nil(t, (&Msg{Type: Ack, URI: "big"}).MarshalCompatiblity(CompatibilityVersionLegacy))
+}
+
 func TestParseV1Subscriptions(t *testing.T) {
 	buf := []byte(`[{"s":"m","n":94067395},{"s":"s_4","n":1},{"s":"s_5","n":2}]`)
 	m := ParseV1Subscriptions(buf)
@@ -99,3 +138,609 @@ func TestParseV1Subscriptions(t *testing.T) {
 	assert.Equal(t, m.Subscriptions["sportsbook/s_4"], int64(1))
 	assert.Equal(t, m.Subscriptions["sportsbook/s_5"], int64(2))
 }
+
+func TestLane(t *testing.T) {
+	assert.Equal(t, PriorityNormal, (&Msg{Type: Publish, UpdateType: Diff}).Lane())
+	assert.Equal(t, PriorityHigh, (&Msg{Type: Publish, UpdateType: Full}).Lane())
+	assert.Equal(t, PriorityHigh, (&Msg{Type: Publish, UpdateType: Close}).Lane())
+	assert.Equal(t, PriorityHigh, (&Msg{Type: Pong}).Lane())
+	assert.Equal(t, PriorityLow, (&Msg{Type: Publish, UpdateType: Full, Priority: PriorityLow}).Lane())
+	assert.Equal(t, PriorityHigh, (&Msg{Type: Publish, Priority: PriorityHigh}).Lane())
+	assert.Equal(t, PriorityNormal, (&Msg{Type: Publish, Priority: 42}).Lane())
+}
+
+func TestLanesKeepURIOrder(t *testing.T) {
+	l := NewLanes()
+	diff := &Msg{Type: Publish, URI: "a", UpdateType: Diff}
+	low := &Msg{Type: Publish, URI: "b", UpdateType: Diff, Priority: PriorityLow}
+	assert.Equal(t, PriorityNormal, l.Put(diff))
+	assert.Equal(t, PriorityLow, l.Put(low))
+	// full can't overtake waiting diff of the same uri
+	assert.Equal(t, PriorityNormal, l.Put(&Msg{Type: Publish, URI: "a", UpdateType: Full}))
+	assert.Equal(t, PriorityLow, l.Put(&Msg{Type: Publish, URI: "b", UpdateType: Close}))
+	assert.Equal(t, PriorityHigh, l.Put(&Msg{Type: Publish, URI: "c", UpdateType: Full}))
+
+	l.Done(diff, PriorityNormal)
+	l.Done(diff, PriorityNormal)
+	assert.Equal(t, PriorityHigh, l.Put(&Msg{Type: Publish, URI: "a", UpdateType: Full}))
+	l.Done(low, PriorityLow)
+	l.Done(low, PriorityLow)
+	_, ok := l.waiting["b"]
+	assert.False(t, ok)
+}
+
+func TestParseStrict(t *testing.T) {
+	m, err := ParseStrict([]byte(`{"t":2,"i":1,"u":"math.req/add"}`+"\n"+`{"x":1}`), DefaultLimits)
+	assert.Nil(t, err)
+	assert.Equal(t, Request, m.Type)
+	assert.Equal(t, "math.req/add", m.URI)
+	assert.Equal(t, `{"x":1}`, string(m.body))
+
+	m, err = ParseStrict([]byte(`{"t":1,"b":{"sportsbook/m":12}}`), DefaultLimits)
+	assert.Nil(t, err)
+	assert.Len(t, m.Subscriptions, 1)
+
+	cases := []struct {
+		buf string
+		err error
+	}{
+		{``, ErrMalformedHeader},
+		{`{"t":2,"u":"math.req/add"`, ErrMalformedHeader},
+		{`{"t":2,"u":"math.req/add","x":1}`, ErrMalformedHeader},
+		{`{"t":2,"u":"math.req/add"}{}`, ErrMalformedHeader},
+		{`{"t":42,"u":"math.req/add"}`, ErrUnknownType},
+		{`{"t":0,"p":42,"u":"math.v1"}`, ErrUnknownType},
+		{`{"t":2,"u":"/add"}`, ErrInvalidURI},
+		{`{"t":2,"u":"math req"}`, ErrInvalidURI},
+		{`{"t":1,"b":{"":1}}`, ErrInvalidURI},
+	}
+	for _, c := range cases {
+		_, err := ParseStrict([]byte(c.buf), DefaultLimits)
+		assert.Equal(t, c.err, errors.Cause(err), c.buf)
+	}
+
+	l := Limits{MaxHeader: 16, MaxBody: 4}
+	_, err = ParseStrict([]byte(`{"t":2,"u":"math.req/add"}`), l)
+	assert.Equal(t, ErrHeaderTooLarge, errors.Cause(err))
+	_, err = ParseStrict([]byte(`{"t":4}`+"\n"+`{"x":1}`), l)
+	assert.Equal(t, ErrBodyTooLarge, errors.Cause(err))
+}
+
+type addReq struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type addRsp struct {
+	Z int `json:"z"`
+}
+
+func TestTyped(t *testing.T) {
+	h := Typed(func(ctx context.Context, r *addReq) (*addRsp, error) {
+		assert.Equal(t, "math.req/add", FromContext(ctx).URI)
+		if r.X == 42 {
+			return nil, fmt.Errorf("the answer")
+		}
+		return &addRsp{Z: r.X + r.Y}, nil
+	})
+
+	req := Parse(NewRequest("math.req/add", addReq{X: 1, Y: 2}).Marshal())
+	rsp, err := h(context.Background(), req)
+	assert.NoError(t, err)
+	var r addRsp
+	assert.NoError(t, Parse(rsp.Marshal()).Unmarshal(&r))
+	assert.Equal(t, 3, r.Z)
+
+	_, err = h(context.Background(), Parse(NewRequest("math.req/add", addReq{X: 42}).Marshal()))
+	assert.Error(t, err)
+	_, err = h(context.Background(), Parse([]byte("{\"t\":2,\"u\":\"math.req/add\"}\n[1]")))
+	assert.True(t, IsPermanent(err))
+	e := toError(err)
+	assert.Equal(t, ErrorCodeBadRequest, e.Code)
+	assert.Equal(t, "bad request", e.Message)
+
+	assert.Panics(t, func() { Typed(func(r *addReq) (*addRsp, error) { return nil, nil }) })
+}
+
+func TestNewContext(t *testing.T) {
+	m := NewRequest("math.req/add", nil)
+	m.Meta = map[string]string{"user": "1"}
+	ctx, cancel := NewContext(context.Background(), m)
+	_, ok := ctx.Deadline()
+	assert.False(t, ok)
+	assert.Equal(t, "1", MetaFromContext(ctx, "user"))
+	cancel()
+	assert.Error(t, ctx.Err())
+
+	m.SetDeadline(time.Minute)
+	m.SetDeadline(time.Hour) // later deadline is ignored
+	buf := m.Request().Marshal()
+	// timeout is relative, deadline is set on receipt
+	assert.Contains(t, string(buf), `"a":`)
+	assert.InDelta(t, int64(60000), m.Timeout, 1000)
+	rm := Parse(buf)
+	ctx, cancel = NewContext(context.Background(), rm)
+	defer cancel()
+	d, ok := ctx.Deadline()
+	assert.True(t, ok)
+	assert.InDelta(t, time.Minute, time.Until(d), float64(time.Second))
+	assert.False(t, rm.Expired())
+
+	rm.SetDeadline(-time.Millisecond)
+	assert.True(t, rm.Expired())
+	rm.ClearDeadline()
+	assert.False(t, rm.Expired())
+
+	// trace id is kept, meta is not changed
+	meta := map[string]string{"user": "1"}
+	m = NewRequest("math.req/add", nil)
+	m.Meta = meta
+	m.StartTrace()
+	trace := m.Meta[TraceKey]
+	assert.NotEmpty(t, trace)
+	assert.Len(t, meta, 1)
+	rm = Parse(m.Request().Marshal())
+	rm.StartTrace()
+	ctx, cancel = NewContext(context.Background(), rm)
+	defer cancel()
+	assert.Equal(t, trace, TraceFromContext(ctx))
+}
+
+func TestRouter(t *testing.T) {
+	var calls []string
+	h := func(name string) Handler {
+		return func(ctx context.Context, m *Msg) (*Msg, error) {
+			calls = append(calls, name+":"+m.Param("id"))
+			return nil, nil
+		}
+	}
+	mw := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, m *Msg) (*Msg, error) {
+				calls = append(calls, name)
+				return next(ctx, m)
+			}
+		}
+	}
+	r := NewRouter()
+	r.Use(mw("global"))
+	r.Handle("add", h("add"))
+	r.Handle("match/:id/odds", h("odds"), mw("route"))
+	r.Handle("match/live/odds", h("live"))
+
+	r.Handler(context.Background(), NewRequest("sport.req/add", nil))
+	r.Handler(context.Background(), NewRequest("sport.req/match/123/odds", nil))
+	r.Handler(context.Background(), NewRequest("sport.req/match/live/odds", nil))
+	assert.Equal(t, []string{"global", "add:", "global", "route", "odds:123", "global", "live:"}, calls)
+
+	_, err := r.Handler(context.Background(), NewRequest("sport.req/match/123", nil))
+	assert.Error(t, err)
+	r.NotFound(h("notFound"))
+	_, err = r.Handler(context.Background(), NewRequest("sport.req/match/123", nil))
+	assert.NoError(t, err)
+}
+
+func TestErrors(t *testing.T) {
+	RegisterError(ErrorDef{
+		Code:      1001,
+		Retryable: true,
+		Messages:  map[string]string{"": "service unavailable", "hr": "servis nije dostupan"},
+	})
+	assert.Panics(t, func() { RegisterError(ErrorDef{Code: 1001}) })
+
+	err := Errf(1001, "db %s timeout", "main")
+	assert.Equal(t, "db main timeout", err.Error())
+	assert.Equal(t, "service unavailable", err.Message)
+	assert.True(t, err.Retryable)
+	assert.Equal(t, "servis nije dostupan", err.Localize("hr").Message)
+	assert.Equal(t, "service unavailable", err.Localize("de").Message)
+
+	req := NewRequest("math.req/add", nil)
+	rsp := Parse(req.ResponseError(errors.Wrap(err, "add")).Marshal())
+	assert.Equal(t, 1001, rsp.Error.Code)
+	assert.True(t, rsp.Error.Retryable)
+	assert.Equal(t, "service unavailable", rsp.Error.Message)
+	assert.Equal(t, "", rsp.Error.Internal)
+	assert.Error(t, rsp.Err())
+
+	// localized to the session language
+	req.Meta = map[string]string{LangKey: "hr"}
+	assert.Equal(t, "servis nije dostupan", req.ResponseError(err).Error.Message)
+	req.Meta = nil
+
+	rsp = req.ResponseError(fmt.Errorf("plain"))
+	assert.Equal(t, 0, rsp.Error.Code)
+	assert.Equal(t, "plain", rsp.Error.Message)
+
+	assert.Equal(t, "unregistered 1", Errf(1002, "unregistered %d", 1).Message)
+	assert.Nil(t, req.Err())
+}
+
+func TestErrorClassification(t *testing.T) {
+	plain := fmt.Errorf("plain")
+	assert.False(t, IsRetryable(plain))
+	assert.False(t, IsPermanent(plain))
+
+	err := errors.Wrap(Retryable(plain), "add")
+	assert.True(t, IsRetryable(err))
+	assert.False(t, IsPermanent(err))
+	assert.Equal(t, plain, errors.Cause(err))
+	assert.True(t, NewRequest("math.req/add", nil).ResponseError(err).Error.Retryable)
+
+	err = Permanent(errors.Wrap(Retryable(plain), "add")) // outermost wins
+	assert.True(t, IsPermanent(err))
+	assert.False(t, IsRetryable(err))
+
+	assert.True(t, IsRetryable(errors.WithStack(&Error{Code: 1, Retryable: true})))
+	assert.False(t, IsRetryable(&Error{Code: 1}))
+	assert.Nil(t, Retryable(nil))
+}
+
+func TestRecover(t *testing.T) {
+	h := Recover(func(ctx context.Context, m *Msg) (*Msg, error) {
+		panic("boom")
+	})
+	req := NewRequest("math.req/add", nil)
+	rm, err := h(context.Background(), req)
+	assert.Nil(t, rm)
+	rsp := req.ResponseError(err)
+	assert.Equal(t, ErrorCodePanic, rsp.Error.Code)
+	assert.Equal(t, "internal error", rsp.Error.Message)
+}
+
+func TestChunkFull(t *testing.T) {
+	body := `{"a":"0123456789","b":"0123456789"}`
+	m := Parse([]byte("{\"u\":\"sport/i\",\"s\":5,\"p\":1}\n" + body))
+	parts := ChunkFull(m, 10)
+	assert.Len(t, parts, 4)
+	assert.Equal(t, FullStart, parts[0].UpdateType)
+	assert.Equal(t, FullPart, parts[1].UpdateType)
+	assert.Equal(t, FullEnd, parts[3].UpdateType)
+	assert.Len(t, ChunkFull(m, 100), 1)
+
+	a := NewAssembler()
+	var full *Msg
+	for _, p := range parts {
+		// over the wire
+		full = a.Add(Parse(p.Marshal()))
+	}
+	assert.NotNil(t, full)
+	assert.True(t, full.IsFull())
+	assert.Equal(t, int64(5), full.Ts)
+	assert.Equal(t, body, string(full.BodyBytes()))
+
+	// missing part
+	a.Add(parts[0])
+	a.Add(parts[1])
+	assert.Nil(t, a.Add(parts[3]))
+	// part without start
+	assert.Nil(t, a.Add(parts[3]))
+	// corrupted part
+	bad := &Msg{URI: "sport/i", Ts: 5, UpdateType: FullPart, Chunk: parts[2].Chunk, body: []byte("xxxxxxxxxx")}
+	a.Add(parts[0])
+	a.Add(parts[1])
+	a.Add(bad)
+	assert.Nil(t, a.Add(parts[3]))
+}
+
+func TestChecksum(t *testing.T) {
+	m := NewPublish("sport", "i", 1, Full, map[string]int{"a": 1})
+	assert.True(t, m.VerifyChecksum())
+	m.StampChecksum()
+	assert.NotZero(t, m.Checksum)
+
+	buf := m.Marshal()
+	assert.True(t, Parse(buf).VerifyChecksum())
+	buf[len(buf)-2] = '2' // corrupt body
+	assert.False(t, Parse(buf).VerifyChecksum())
+}
+
+func TestEncrypt(t *testing.T) {
+	keys := NewTopicKeys()
+	id, err := keys.Rotate("user.v1")
+	assert.Nil(t, err)
+
+	m := NewPublish("user.v1", "1", 1, Full, map[string]string{"name": "secret"})
+	assert.Nil(t, keys.Encrypt(m))
+	assert.Equal(t, id, m.KeyID)
+	buf := m.Marshal()
+	assert.NotContains(t, string(buf), "secret")
+
+	// relayed message decrypted by the client with the key from key request
+	kp, err := NewKeyPair()
+	assert.Nil(t, err)
+	req := NewKeyRequest("user.req", "user.v1", "", kp.Public)
+	req.Meta = map[string]string{"user": "1"}
+	handler := keys.Handler(func(m *Msg, topic string) bool { return m.Meta["user"] == "1" })
+	rsp, err := handler(context.Background(), Parse(req.Marshal()))
+	assert.Nil(t, err)
+	var key TopicKey
+	assert.Nil(t, json.Unmarshal(rsp.BodyBytes(), &key))
+	assert.Equal(t, id, key.ID)
+
+	// gateway relaying the response can't unwrap the key
+	other, _ := NewKeyPair()
+	_, err = other.Unwrap(key)
+	assert.NotNil(t, err)
+	// request without client public key
+	_, err = handler(context.Background(), &Msg{Type: Request, Meta: map[string]string{"user": "1"}, body: []byte(`{"topic":"user.v1"}`)})
+	assert.NotNil(t, err)
+
+	client := NewTopicKeys()
+	assert.Nil(t, client.Add(kp, key))
+	r := Parse(buf)
+	assert.Nil(t, client.Decrypt(r))
+	assert.Equal(t, "", r.KeyID)
+	var body map[string]string
+	assert.Nil(t, r.Unmarshal(&body))
+	assert.Equal(t, "secret", body["name"])
+
+	// unauthorized
+	_, err = keys.Handler(func(m *Msg, topic string) bool { return false })(
+		context.Background(), &Msg{Type: Request, body: []byte(`{"topic":"user.v1"}`)})
+	assert.NotNil(t, err)
+
+	// old key is kept after rotation
+	keys.Rotate("user.v1")
+	assert.Nil(t, keys.Decrypt(Parse(buf)))
+	keys.Remove("user.v1", id)
+	assert.Equal(t, ErrUnknownKey, errors.Cause(keys.Decrypt(Parse(buf))))
+}
+
+type testMetric struct {
+	metric.Noop
+	names []string
+}
+
+func (t *testMetric) Counter(name string, values ...int) { t.names = append(t.names, name) }
+func (t *testMetric) Time(name string, duration int)     { t.names = append(t.names, name) }
+
+func TestMetrics(t *testing.T) {
+	tm := &testMetric{}
+	metric.Set(tm)
+	defer metric.Set(metric.NewNoop())
+
+	CountMsg("publish", NewPublish("math.v1", "i", 1, Full, nil))
+	assert.Len(t, tm.names, 0)
+
+	EnableMetrics(true)
+	defer DisableMetrics()
+	CountMsg("publish", NewPublish("math.v1", "i", 1, Full, nil))
+	CountURI("subscribe", "math.v1")
+	h := Instrument(func(ctx context.Context, m *Msg) (*Msg, error) {
+		if m.Path() == "div" {
+			return nil, Errf(1001, "division by zero")
+		}
+		return m.Response(nil), nil
+	})
+	h(context.Background(), NewRequest("math.req/add", nil))
+	h(context.Background(), NewRequest("math.req/div", nil))
+	assert.Equal(t, []string{
+		"amp.publish.math.v1.i",
+		"amp.subscribe.math.v1",
+		"amp.handle.math.req.add.ok",
+		"amp.handle.math.req.div.error.1001",
+	}, tm.names)
+}
+
+func TestDicts(t *testing.T) {
+	d := NewDicts()
+	body := func(i int) map[string]interface{} {
+		return map[string]interface{}{"id": i, "home": "Dinamo", "away": "Hajduk", "odds": []float64{1.85, 3.2, 4.1}, "status": "live"}
+	}
+	m := NewPublish("match", "1", 1, Diff, body(0))
+	assert.Nil(t, d.Compress(m))
+	assert.Equal(t, "", m.DictID) // no dictionary yet
+
+	for i := 0; i < 10; i++ {
+		d.Sample(NewPublish("match", "1", int64(i), Diff, body(i)))
+	}
+	id, ok := d.Train("match")
+	assert.True(t, ok)
+	assert.Len(t, id, 8)
+
+	m = NewPublish("match", "1", 11, Diff, body(11))
+	plain := m.BodyBytes()
+	assert.Nil(t, d.Compress(m))
+	assert.Equal(t, id, m.DictID)
+	assert.True(t, len(m.BodyBytes()) < len(plain))
+
+	// client without dictionary gets it from the producer
+	r := Parse(m.Marshal())
+	c := NewDicts()
+	assert.Equal(t, ErrUnknownDict, errors.Cause(c.Decompress(r)))
+	rsp, err := d.Handler()(context.Background(), Parse(NewDictRequest("match.req", "match", r.DictID).Marshal()))
+	assert.Nil(t, err)
+	var td TopicDict
+	assert.Nil(t, json.Unmarshal(rsp.BodyBytes(), &td))
+	assert.NotNil(t, c.Set(td.Topic, "other", td.Data))
+	assert.Nil(t, c.Set(td.Topic, td.ID, td.Data))
+	assert.Nil(t, c.Decompress(r))
+	assert.Equal(t, "", r.DictID)
+	assert.Equal(t, string(plain), string(r.BodyBytes()))
+
+	// message compressed with the older dictionary, received after the
+	// client got the newer one
+	m = NewPublish("match", "1", 12, Diff, body(12))
+	plain = m.BodyBytes()
+	assert.Nil(t, d.Compress(m))
+	for i := 20; i < 30; i++ {
+		d.Sample(NewPublish("match", "1", int64(i), Diff, body(i)))
+	}
+	id2, _ := d.Train("match")
+	assert.NotEqual(t, id, id2)
+	td, _ = d.Dict("match", "")
+	assert.Equal(t, id2, td.ID)
+	assert.Nil(t, c.Set(td.Topic, td.ID, td.Data))
+	r = Parse(m.Marshal())
+	assert.Equal(t, id, r.DictID)
+	assert.Nil(t, c.Decompress(r))
+	assert.Equal(t, string(plain), string(r.BodyBytes()))
+}
+
+func TestCompressionPolicy(t *testing.T) {
+	small := NewPublish("small", "", 1, Full, map[string]string{"a": "b"})
+	_, deflated := small.MarshalDeflate()
+	assert.False(t, deflated)
+
+	SetTopicCompression("small", CompressionPolicy{Mode: CompressAlways})
+	defer RemoveTopicCompression("small")
+	small = NewPublish("small", "", 1, Full, map[string]string{"a": "b"})
+	buf, deflated := small.MarshalDeflate()
+	assert.True(t, deflated)
+	assert.NotEqual(t, small.Marshal(), buf)
+
+	big := NewPublish("big", "", 1, Full, strings.Repeat("x", 10*1024))
+	_, deflated = big.MarshalDeflate()
+	assert.True(t, deflated)
+	_, deflated = big.MarshalPolicy(CompatibilityVersionDefault, CompressionPolicy{Mode: CompressNever})
+	assert.False(t, deflated)
+	_, deflated = big.MarshalPolicy(CompatibilityVersionDefault, CompressionPolicy{Threshold: 20 * 1024})
+	assert.False(t, deflated)
+
+	SetCompressionLimit(100 * 1024)
+	defer SetCompressionLimit(8 * 1024)
+	big = NewPublish("big", "", 1, Full, strings.Repeat("x", 10*1024))
+	_, deflated = big.MarshalDeflate()
+	assert.False(t, deflated)
+}
+
+// TestDeflate payload is permessage-deflate message: sync flushed stream
+// without the 0x00 0x00 0xff 0xff tail, which the receiver appends.
+// Each payload is independent, deflate writer is reset between payloads.
+func TestDeflate(t *testing.T) {
+	inflate := func(payload []byte) []byte {
+		r := flate.NewReader(io.MultiReader(bytes.NewReader(payload), bytes.NewReader([]byte{0x00, 0x00, 0xff, 0xff})))
+		defer r.Close()
+		buf, err := ioutil.ReadAll(r)
+		assert.Equal(t, io.ErrUnexpectedEOF, err) // stream is not closed
+		return buf
+	}
+	for _, src := range [][]byte{
+		[]byte(`{"a":1}`),
+		[]byte(strings.Repeat(`{"event":"goal","minute":42}`, 500)),
+		{},
+	} {
+		p1 := deflate(src)
+		assert.False(t, bytes.HasSuffix(p1, []byte{0x00, 0x00, 0xff, 0xff}))
+		assert.Equal(t, src, inflate(p1))
+		p2 := deflate(src)
+		assert.Equal(t, p1, p2)
+	}
+}
+
+func TestBinaryBody(t *testing.T) {
+	body := []byte{0, 1, 10, 255, 10, 10, 3}
+	m := NewPublishBinary("img", "1", 1, Full, body, "")
+	assert.True(t, m.IsBinary())
+	assert.Equal(t, ContentTypeBinary, m.ContentType)
+
+	r := Parse(m.Marshal())
+	assert.Equal(t, body, r.BodyBytes())
+	assert.Equal(t, ContentTypeBinary, r.ContentType)
+	var v interface{}
+	assert.Equal(t, ErrBinaryBody, r.Unmarshal(&v))
+	assert.Nil(t, m.MarshalV1()) // not supported in v1
+
+	ch := ChunkFull(NewPublishBinary("img", "1", 1, Full, bytes.Repeat(body, 10), "image/png"), 16)
+	a := NewAssembler()
+	var full *Msg
+	for _, c := range ch {
+		full = a.Add(Parse(c.Marshal()))
+	}
+	assert.Equal(t, "image/png", full.ContentType)
+	assert.Equal(t, bytes.Repeat(body, 10), full.BodyBytes())
+}
+
+func TestBodyField(t *testing.T) {
+	m := NewPublish("match", "1", 1, Full, map[string]interface{}{
+		"event": map[string]interface{}{"id": "e1", "teams": []string{"Dinamo", "Hajduk"}},
+		"odds":  []interface{}{map[string]interface{}{"home": 1.85}, map[string]interface{}{"home": 2.1}},
+		"live":  true,
+	})
+	m = Parse(m.Marshal())
+	assert.Equal(t, "e1", m.BodyFieldString("event.id"))
+	assert.Equal(t, "Hajduk", m.BodyFieldString("event.teams.1"))
+	v, ok := m.BodyField("odds.1.home")
+	assert.True(t, ok)
+	assert.Equal(t, "2.1", string(v))
+	v, ok = m.BodyField("live")
+	assert.True(t, ok)
+	assert.Equal(t, "true", string(v))
+	_, ok = m.BodyField("event.name")
+	assert.False(t, ok)
+	_, ok = m.BodyField("odds.5")
+	assert.False(t, ok)
+	_, ok = m.BodyField("live.x")
+	assert.False(t, ok)
+	// cached
+	assert.Len(t, m.fields, 7)
+}
+
+func TestBuilder(t *testing.T) {
+	m, err := Build().Topic("math").Path("add").UpdateType(Diff).Body(map[string]int{"x": 1}).Msg()
+	assert.Nil(t, err)
+	assert.Equal(t, "math/add", m.URI)
+	assert.Equal(t, "math", m.Topic())
+	assert.Equal(t, "add", m.Path())
+	assert.Equal(t, Publish, m.Type)
+	assert.True(t, m.Ts > 0)
+	assert.Equal(t, `{"x":1}`, string(m.BodyBytes()))
+
+	m = Build().Type(Request).URI("math.req/add").ReplyTo("rsp").MustMsg()
+	assert.Equal(t, "math.req", m.Topic())
+	assert.Equal(t, int64(0), m.Ts)
+
+	_, err = Build().Topic("math").URI("math/add").Msg()
+	assert.NotNil(t, err)
+	_, err = Build().Topic("math/add").Msg()
+	assert.NotNil(t, err)
+	_, err = Build().UpdateType(Diff).Msg()
+	assert.NotNil(t, err)
+	_, err = Build().Type(Response).Msg()
+	assert.NotNil(t, err)
+	_, err = Build().Topic("img").BinaryBody([]byte{1}, "").Body(1).Msg()
+	assert.NotNil(t, err)
+}
+
+func TestDemand(t *testing.T) {
+	var started, stopped []string
+	d := NewDemand(10*time.Millisecond,
+		func(topic string) { started = append(started, topic) },
+		func(topic string) { stopped = append(stopped, topic) })
+
+	d.Add(Parse(NewDemandAnnounce("gw1", []string{"a", "b"}).Marshal()))
+	d.Add(Parse(NewDemandAnnounce("gw2", []string{"b", "c"}).Marshal()))
+	assert.Len(t, started, 3)
+	assert.True(t, d.Watched("b"))
+	assert.Len(t, d.Topics(), 3)
+
+	d.Add(NewDemandAnnounce("gw1", []string{"b"}))
+	assert.Equal(t, []string{"a"}, stopped)
+	assert.False(t, d.Watched("a"))
+
+	time.Sleep(20 * time.Millisecond)
+	d.Add(NewDemandAnnounce("gw2", []string{"b", "c"}))
+	d.Expire() // gw1 expired, b is still watched by gw2
+	assert.Equal(t, []string{"a"}, stopped)
+	assert.True(t, d.Watched("b"))
+	assert.Len(t, started, 3)
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	v, err := NegotiateVersion(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, ProtocolVersionNone, v)
+	assert.Equal(t, CompatibilityVersionLegacy, Compatibility(v))
+	v, err = NegotiateVersion(map[string]string{VersionKey: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, ProtocolVersion1, v)
+	assert.Equal(t, CompatibilityVersionProtocol1, Compatibility(v))
+	v, err = NegotiateVersion(map[string]string{VersionKey: "2"})
+	assert.NoError(t, err)
+	assert.Equal(t, ProtocolVersion2, v)
+	for _, s := range []string{"0", "3", "x", "256"} {
+		_, err = NegotiateVersion(map[string]string{VersionKey: s})
+		assert.Equal(t, ErrUnsupportedVersion, errors.Cause(err), s)
+	}
+}
@@ -0,0 +1,543 @@
+// Package archive stores amp messages into the object storage (S3, MinIO)
+// for audits and reprocessing.
+//
+// Archiver subscribes to the topics and writes messages received within
+// the period (hour by default) into gzip compressed segment in
+// replayfile format. Index of all segments is kept in index.json under
+// the archive prefix. Only one archiver should write into the prefix.
+// Segments which fail to upload are kept in memory and retried, up to
+// MaxPending bytes; the oldest ones are dropped above that.
+//
+//	a := archive.MustNew(ctx, archive.NewS3(endpoint, region, bucket, key, secret),
+//		archive.Prefix("odds"), archive.Topics("odds", "events"))
+//	go a.Consume(ctx, nsq.Subscribe(ctx, []string{"odds", "events"}))
+//
+// Retention bounds archive by age, size and number of messages, globally
+// or per topic. Compactor evicts the oldest segments out of the retention:
+//
+//	a := archive.MustNew(ctx, store, archive.Prefix("odds"),
+//		archive.Retain(archive.Retention{MaxAge: 30 * 24 * time.Hour}),
+//		archive.TopicRetention("events", archive.Retention{MaxBytes: 1 << 30}))
+//	a.StartCompactor(ctx, time.Hour)
+//
+// Purge removes messages matching predicate from all segments (e.g. for
+// the data erasure request) and writes audit record under purges/:
+//
+//	a.Purge(ctx, "erasure request 42", func(m *amp.Msg) bool {
+//		return m.Path() == "user-42"
+//	})
+//
+// Reader feeds archived segments back through the replay pipeline:
+//
+//	r := archive.NewReader(store, "odds")
+//	out := broker.NewWithReplay().Pipe(r.Stream(ctx, from, to, 0))
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/replayfile"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+	"github.com/pkg/errors"
+)
+
+const (
+	indexKey = "index.json"
+	// defaultMaxPending bounds memory held by segments waiting for upload
+	defaultMaxPending = 256 << 20
+	// flushTimeout bounds upload of the remaining segments on exit
+	flushTimeout = 30 * time.Second
+)
+
+// Segment describes archived file of messages.
+type Segment struct {
+	Key    string    `json:"key"`
+	From   time.Time `json:"from"` // receive time of the first message
+	To     time.Time `json:"to"`   // receive time of the last message
+	Count  int       `json:"count"`
+	Size   int       `json:"size"` // compressed size in bytes
+	Topics []string  `json:"topics"`
+}
+
+type options struct {
+	prefix string
+	topics []string
+	period time.Duration
+	// max size of the segments waiting for upload in bytes
+	maxPending int
+
+	retention      Retention
+	topicRetention map[string]Retention
+}
+
+// Prefix sets prefix of the keys in the store.
+func Prefix(p string) func(*options) {
+	return func(o *options) {
+		o.prefix = p
+	}
+}
+
+// Topics selects topics to archive, all messages are archived by default.
+func Topics(topics ...string) func(*options) {
+	return func(o *options) {
+		o.topics = topics
+	}
+}
+
+// Period sets segment duration, default is one hour.
+func Period(d time.Duration) func(*options) {
+	return func(o *options) {
+		o.period = d
+	}
+}
+
+// MaxPending sets how many bytes of the segments which failed to upload
+// are kept for retry, default is 256MB. When store is unavailable longer,
+// the oldest segments are dropped.
+func MaxPending(bytes int) func(*options) {
+	return func(o *options) {
+		if bytes > 0 {
+			o.maxPending = bytes
+		}
+	}
+}
+
+// Archiver writes messages into segments.
+type Archiver struct {
+	store  Store
+	opts   options
+	topics map[string]struct{}
+	index  []Segment
+
+	// current segment
+	seg        Segment
+	start      time.Time // start of the period
+	buf        *bytes.Buffer
+	gz         *gzip.Writer
+	rec        *replayfile.Recorder
+	topicsSeen map[string]struct{}
+
+	pending      []pendingSegment // closed segments waiting for upload
+	pendingBytes int              // size of the pending segments
+	indexDirty   bool             // index changed, not written to the store
+	retryAt      time.Time        // next upload attempt after failure
+	uploading    bool             // upload is in progress
+	sync.Mutex
+
+	// io serializes uploads and index writes, it is held during the
+	// store I/O instead of the archiver lock, so Add is not blocked
+	io    sync.Mutex
+	maint sync.Mutex // serializes Compact and Purge
+}
+
+// pendingSegment is closed segment with its compressed content
+type pendingSegment struct {
+	seg  Segment
+	data []byte
+}
+
+// New creates archiver and loads existing index from the store.
+func New(ctx context.Context, store Store, opts ...func(*options)) (*Archiver, error) {
+	o := options{period: time.Hour, maxPending: defaultMaxPending}
+	for _, f := range opts {
+		f(&o)
+	}
+	if _, ok := store.(Deleter); !ok && o.hasRetention() {
+		return nil, errors.New("archive retention requires store with delete")
+	}
+	a := &Archiver{
+		store:  store,
+		opts:   o,
+		topics: make(map[string]struct{}),
+	}
+	for _, t := range o.topics {
+		a.topics[t] = struct{}{}
+	}
+	index, err := readIndex(ctx, store, o.prefix)
+	if err != nil {
+		return nil, err
+	}
+	a.index = index
+	return a, nil
+}
+
+// MustNew creates archiver, raises fatal on error.
+func MustNew(ctx context.Context, store Store, opts ...func(*options)) *Archiver {
+	a, err := New(ctx, store, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return a
+}
+
+// Consume archives messages from in until in is closed or ctx is done.
+// Current segment is uploaded when period ends and on exit.
+func (a *Archiver) Consume(ctx context.Context, in <-chan *amp.Msg) error {
+	t := time.NewTicker(a.opts.period / 10)
+	defer t.Stop()
+	for {
+		select {
+		case m, ok := <-in:
+			if !ok {
+				return a.flushOnExit()
+			}
+			if err := a.Add(ctx, m); err != nil {
+				log.Error(err)
+			}
+		case <-t.C:
+			if err := a.rotate(ctx, time.Now()); err != nil {
+				log.Error(err)
+			}
+		case <-ctx.Done():
+			return a.flushOnExit()
+		}
+	}
+}
+
+// flushOnExit uploads what is left when consume ends, ctx is already done
+// so it waits for the store at most flushTimeout.
+func (a *Archiver) flushOnExit() error {
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+	return a.Flush(ctx)
+}
+
+// Add writes message into current segment.
+func (a *Archiver) Add(ctx context.Context, m *amp.Msg) error {
+	if len(a.topics) > 0 {
+		if _, ok := a.topics[m.Topic()]; !ok {
+			return nil
+		}
+	}
+	now := time.Now()
+	if err := a.rotate(ctx, now); err != nil {
+		return err
+	}
+	a.Lock()
+	defer a.Unlock()
+	if a.rec == nil {
+		a.open(now)
+	}
+	a.rec.Record(m)
+	a.seg.Count++
+	a.seg.To = now
+	a.topicsSeen[m.Topic()] = struct{}{}
+	return nil
+}
+
+// Index returns all uploaded segments.
+func (a *Archiver) Index() []Segment {
+	a.Lock()
+	defer a.Unlock()
+	return append([]Segment(nil), a.index...)
+}
+
+// Flush uploads current segment and segments waiting for retry.
+func (a *Archiver) Flush(ctx context.Context) error {
+	a.Lock()
+	err := a.close()
+	a.Unlock()
+	if err != nil {
+		return err
+	}
+	return a.uploadPending(ctx, time.Now())
+}
+
+// rotate uploads current segment when it's period is over, retries
+// failed uploads
+func (a *Archiver) rotate(ctx context.Context, now time.Time) error {
+	a.Lock()
+	if a.rec != nil && !now.Truncate(a.opts.period).Equal(a.start) {
+		if err := a.close(); err != nil {
+			a.Unlock()
+			return err
+		}
+	}
+	// in progress upload takes the closed segment, Add doesn't wait for it
+	idle := (len(a.pending) == 0 && !a.indexDirty) || now.Before(a.retryAt) || a.uploading
+	a.Unlock()
+	if idle {
+		return nil
+	}
+	return a.uploadPending(ctx, now)
+}
+
+func (a *Archiver) open(now time.Time) {
+	a.start = now.Truncate(a.opts.period)
+	a.buf = bytes.NewBuffer(nil)
+	a.gz = gzip.NewWriter(a.buf)
+	a.rec = replayfile.NewRecorder(a.gz)
+	a.topicsSeen = make(map[string]struct{})
+	a.seg = Segment{
+		Key:  key(a.opts.prefix, a.start.UTC().Format("2006/01/02/15")+"-"+strconv.FormatInt(now.UnixNano(), 10)+".amp.gz"),
+		From: now,
+	}
+}
+
+// close finishes current segment and queues it for upload, should be
+// called during a.Lock
+func (a *Archiver) close() error {
+	if a.rec == nil {
+		return nil
+	}
+	rec := a.rec
+	a.rec = nil
+	if err := rec.Flush(); err != nil {
+		return err
+	}
+	if err := a.gz.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	seg := a.seg
+	seg.Size = a.buf.Len()
+	for t := range a.topicsSeen {
+		seg.Topics = append(seg.Topics, t)
+	}
+	sort.Strings(seg.Topics)
+	a.pending = append(a.pending, pendingSegment{seg: seg, data: a.buf.Bytes()})
+	a.pendingBytes += seg.Size
+	a.buf, a.gz = nil, nil
+	a.trimPending()
+	return nil
+}
+
+// trimPending drops the oldest pending segments above the max pending
+// size, the newest one is always kept. Segment being uploaded is not
+// dropped, uploader removes it.
+// Should be called during a.Lock.
+func (a *Archiver) trimPending() {
+	first := 0
+	if a.uploading {
+		first = 1
+	}
+	for a.pendingBytes > a.opts.maxPending && len(a.pending) > first+1 {
+		p := a.pending[first]
+		a.pending = append(a.pending[:first], a.pending[first+1:]...)
+		a.pendingBytes -= p.seg.Size
+		metric.Counter("archive.dropped")
+		metric.Counter("archive.dropped_msgs", p.seg.Count)
+		log.S("key", p.seg.Key).I("count", p.seg.Count).I("size", p.seg.Size).ErrorS("pending segment dropped")
+	}
+	a.pendingMetric()
+}
+
+// pendingMetric reports segments waiting for upload.
+// Should be called during a.Lock.
+func (a *Archiver) pendingMetric() {
+	metric.Gauge("archive.pending", len(a.pending))
+	metric.Gauge("archive.pending_bytes", a.pendingBytes)
+}
+
+// uploadPending writes pending segments in order and then index.
+// Segment which fails to upload is kept with the following ones, and
+// retried after tenth of the period.
+// Store is written during a.io, a.Lock is held only to take the
+// pending segment and to update the index.
+func (a *Archiver) uploadPending(ctx context.Context, now time.Time) error {
+	a.io.Lock()
+	defer a.io.Unlock()
+	a.setUploading(true)
+	defer a.setUploading(false)
+	for {
+		a.Lock()
+		if len(a.pending) == 0 {
+			a.Unlock()
+			break
+		}
+		p := a.pending[0] // only uploader removes pending segments
+		a.Unlock()
+
+		if err := a.store.Put(ctx, p.seg.Key, p.data); err != nil {
+			metric.Counter("archive.failed")
+			a.Lock()
+			a.retryAt = now.Add(a.opts.period / 10)
+			waiting := len(a.pending)
+			a.Unlock()
+			return errors.Wrapf(err, "segment %s with %d messages not uploaded, %d segments waiting for retry", p.seg.Key, p.seg.Count, waiting)
+		}
+		a.Lock()
+		a.pending = a.pending[1:]
+		a.pendingBytes -= p.seg.Size
+		a.pendingMetric()
+		a.index = append(a.index, p.seg)
+		a.indexDirty = true
+		a.Unlock()
+		metric.Counter("archive.segment")
+		metric.Counter("archive.msgs", p.seg.Count)
+		log.S("key", p.seg.Key).I("count", p.seg.Count).I("size", p.seg.Size).Info("segment archived")
+	}
+
+	a.Lock()
+	dirty := a.indexDirty
+	index := append([]Segment(nil), a.index...)
+	a.indexDirty = false
+	a.Unlock()
+	var err error
+	if dirty {
+		err = a.writeIndex(ctx, index)
+	}
+	a.Lock()
+	defer a.Unlock()
+	if err != nil {
+		a.indexDirty = true
+		a.retryAt = now.Add(a.opts.period / 10)
+		return err
+	}
+	a.retryAt = time.Time{}
+	return nil
+}
+
+func (a *Archiver) setUploading(v bool) {
+	a.Lock()
+	defer a.Unlock()
+	a.uploading = v
+}
+
+// writeIndex stores index of the segments.
+// Should be called during a.io, index is not changed by others while it
+// is written.
+func (a *Archiver) writeIndex(ctx context.Context, index []Segment) error {
+	buf, err := json.Marshal(index)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return a.store.Put(ctx, key(a.opts.prefix, indexKey), buf)
+}
+
+// Reader replays archived segments.
+type Reader struct {
+	store  Store
+	prefix string
+}
+
+// NewReader creates reader of the archive with prefix.
+func NewReader(store Store, prefix string) *Reader {
+	return &Reader{store: store, prefix: prefix}
+}
+
+// Segments returns segments with messages received between from and to,
+// containing any of the topics (all segments if topics are not specified).
+func (r *Reader) Segments(ctx context.Context, from, to time.Time, topics ...string) ([]Segment, error) {
+	index, err := readIndex(ctx, r.store, r.prefix)
+	if err != nil {
+		return nil, err
+	}
+	var segs []Segment
+	for _, s := range index {
+		if s.To.Before(from) || s.From.After(to) || !s.contains(topics) {
+			continue
+		}
+		segs = append(segs, s)
+	}
+	return segs, nil
+}
+
+// Play calls publish for each message of the segments between from and to.
+// Messages are replayed speed times faster than they were received,
+// speed 0 replays as fast as possible (see replayfile.Player).
+func (r *Reader) Play(ctx context.Context, from, to time.Time, speed float64, publish func(*amp.Msg), topics ...string) error {
+	segs, err := r.Segments(ctx, from, to, topics...)
+	if err != nil {
+		return err
+	}
+	filter := publish
+	if len(topics) > 0 {
+		filter = func(m *amp.Msg) {
+			for _, t := range topics {
+				if m.Topic() == t {
+					publish(m)
+					return
+				}
+			}
+		}
+	}
+	for _, s := range segs {
+		if err := r.play(ctx, s, speed, filter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stream returns chan with archived messages, suitable as input of the
+// replay pipeline. Chan is closed after all messages are replayed.
+func (r *Reader) Stream(ctx context.Context, from, to time.Time, speed float64, topics ...string) <-chan *amp.Msg {
+	out := make(chan *amp.Msg)
+	go func() {
+		defer close(out)
+		err := r.Play(ctx, from, to, speed, func(m *amp.Msg) {
+			select {
+			case out <- m:
+			case <-ctx.Done():
+			}
+		}, topics...)
+		if err != nil {
+			log.Error(err)
+		}
+	}()
+	return out
+}
+
+func (r *Reader) play(ctx context.Context, s Segment, speed float64, publish func(*amp.Msg)) error {
+	rc, err := r.store.Get(ctx, s.Key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	gz, err := gzip.NewReader(rc)
+	if err != nil {
+		return errors.Wrap(err, s.Key)
+	}
+	defer gz.Close()
+	return replayfile.NewPlayer(gz, speed).Play(ctx, publish)
+}
+
+func (s Segment) contains(topics []string) bool {
+	if len(topics) == 0 {
+		return true
+	}
+	for _, t := range topics {
+		i := sort.SearchStrings(s.Topics, t)
+		if i < len(s.Topics) && s.Topics[i] == t {
+			return true
+		}
+	}
+	return false
+}
+
+func readIndex(ctx context.Context, store Store, prefix string) ([]Segment, error) {
+	rc, err := store.Get(ctx, key(prefix, indexKey))
+	if errors.Cause(err) == ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	buf, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var index []Segment
+	if err := json.Unmarshal(buf, &index); err != nil {
+		return nil, errors.Wrap(err, "archive index")
+	}
+	return index, nil
+}
+
+func key(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "/" + name
+}
@@ -0,0 +1,231 @@
+package archive
+
+import (
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func testArchive(t *testing.T, store Store) {
+	ctx := context.Background()
+	a, err := New(ctx, store, Prefix("audit"), Topics("odds", "events"))
+	assert.Nil(t, err)
+	in := make(chan *amp.Msg)
+	done := make(chan struct{})
+	go func() {
+		assert.Nil(t, a.Consume(ctx, in))
+		close(done)
+	}()
+	in <- amp.NewPublish("odds", "1", 1, amp.Diff, nil)
+	in <- amp.NewPublish("other", "1", 2, amp.Diff, nil) // not archived
+	in <- amp.NewPublish("events", "2", 3, amp.Diff, nil)
+	close(in)
+	<-done
+
+	index := a.Index()
+	assert.Len(t, index, 1)
+	assert.Equal(t, 2, index[0].Count)
+	assert.Equal(t, []string{"events", "odds"}, index[0].Topics)
+	assert.True(t, strings.HasPrefix(index[0].Key, "audit/"))
+
+	// index is loaded by the new archiver
+	a, err = New(ctx, store, Prefix("audit"))
+	assert.Nil(t, err)
+	assert.Len(t, a.Index(), 1)
+
+	r := NewReader(store, "audit")
+	var uris []string
+	for m := range r.Stream(ctx, time.Now().Add(-time.Hour), time.Now(), 0) {
+		uris = append(uris, m.URI)
+	}
+	assert.Equal(t, []string{"odds/1", "events/2"}, uris)
+
+	uris = nil
+	err = r.Play(ctx, time.Now().Add(-time.Hour), time.Now(), 0, func(m *amp.Msg) { uris = append(uris, m.URI) }, "events")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"events/2"}, uris)
+
+	segs, err := r.Segments(ctx, time.Now().Add(-time.Hour), time.Now(), "other")
+	assert.Nil(t, err)
+	assert.Len(t, segs, 0)
+}
+
+func TestDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	testArchive(t, Dir(dir))
+}
+
+func TestS3(t *testing.T) {
+	objects := make(map[string][]byte)
+	var lock sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		k := strings.TrimPrefix(r.URL.Path, "/bucket/")
+		switch {
+		case r.Method == "PUT":
+			objects[k], _ = ioutil.ReadAll(r.Body)
+		case r.URL.Query().Get("list-type") == "2":
+			var res struct {
+				XMLName  xml.Name `xml:"ListBucketResult"`
+				Contents []struct{ Key string }
+			}
+			for k := range objects {
+				if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+					res.Contents = append(res.Contents, struct{ Key string }{k})
+				}
+			}
+			xml.NewEncoder(w).Encode(res)
+		default:
+			b, ok := objects[k]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(b)
+		}
+	}))
+	defer srv.Close()
+
+	s := NewS3(srv.URL, "eu-central-1", "bucket", "key", "secret")
+	testArchive(t, s)
+	keys, err := s.List(context.Background(), "audit/")
+	assert.Nil(t, err)
+	assert.Len(t, keys, 2)
+}
+
+// failingStore fails Put while fail is set
+type failingStore struct {
+	Dir
+	fail bool
+}
+
+func (s *failingStore) Put(ctx context.Context, key string, body []byte) error {
+	if s.fail {
+		return errors.New("store unavailable")
+	}
+	return s.Dir.Put(ctx, key, body)
+}
+
+func TestUploadRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	store := &failingStore{Dir: Dir(dir), fail: true}
+	ctx := context.Background()
+	a, err := New(ctx, store, Period(time.Minute))
+	assert.Nil(t, err)
+
+	// failed segment is kept
+	assert.Nil(t, a.Add(ctx, amp.NewPublish("odds", "1", 1, amp.Diff, nil)))
+	assert.Error(t, a.Flush(ctx))
+	assert.Len(t, a.Index(), 0)
+	assert.Len(t, a.pending, 1)
+
+	// retried with the next segment, not before retry interval
+	assert.Nil(t, a.Add(ctx, amp.NewPublish("odds", "2", 2, amp.Diff, nil)))
+	store.fail = false
+	assert.Nil(t, a.rotate(ctx, time.Now()))
+	assert.Len(t, a.pending, 1)
+	assert.Nil(t, a.rotate(ctx, time.Now().Add(time.Minute)))
+	assert.Len(t, a.pending, 0)
+	assert.Len(t, a.Index(), 2)
+
+	// index is written
+	a, err = New(ctx, store)
+	assert.Nil(t, err)
+	assert.Len(t, a.Index(), 2)
+}
+
+func TestMaxPending(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	store := &failingStore{Dir: Dir(dir), fail: true}
+	ctx := context.Background()
+	a, err := New(ctx, store, MaxPending(1))
+	assert.Nil(t, err)
+
+	// only the newest segment is kept while store is unavailable
+	for i := 1; i <= 3; i++ {
+		assert.Nil(t, a.Add(ctx, amp.NewPublish("odds", strconv.Itoa(i), int64(i), amp.Diff, nil)))
+		assert.Error(t, a.Flush(ctx))
+		assert.Len(t, a.pending, 1)
+	}
+	assert.Equal(t, a.pending[0].seg.Size, a.pendingBytes)
+
+	store.fail = false
+	assert.Nil(t, a.Flush(ctx))
+	assert.Len(t, a.Index(), 1)
+	assert.Equal(t, 0, a.pendingBytes)
+}
+
+// blockingStore blocks Put until release is closed
+type blockingStore struct {
+	Dir
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) Put(ctx context.Context, key string, body []byte) error {
+	select {
+	case s.entered <- struct{}{}:
+	default:
+	}
+	<-s.release
+	return s.Dir.Put(ctx, key, body)
+}
+
+func TestUploadDoesNotBlockAdd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	store := &blockingStore{Dir: Dir(dir), entered: make(chan struct{}, 1), release: make(chan struct{})}
+	ctx := context.Background()
+	a, err := New(ctx, store)
+	assert.Nil(t, err)
+
+	assert.Nil(t, a.Add(ctx, amp.NewPublish("odds", "1", 1, amp.Diff, nil)))
+	flushed := make(chan error)
+	go func() {
+		flushed <- a.Flush(ctx)
+	}()
+	<-store.entered
+
+	// messages are added while segment is uploaded
+	added := make(chan error)
+	go func() {
+		added <- a.Add(ctx, amp.NewPublish("odds", "2", 2, amp.Diff, nil))
+	}()
+	select {
+	case err := <-added:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("add blocked by upload")
+	}
+	assert.Len(t, a.Index(), 0)
+
+	close(store.release)
+	assert.Nil(t, <-flushed)
+	assert.Len(t, a.Index(), 1)
+	assert.Nil(t, a.Flush(ctx))
+	assert.Len(t, a.Index(), 2)
+}
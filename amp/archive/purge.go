@@ -0,0 +1,176 @@
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/replayfile"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+	"github.com/pkg/errors"
+)
+
+// purgesKey is prefix of the purge audit records, each record is stored
+// in its own object, so concurrent purges don't overwrite each other's
+// records (store has no append)
+const purgesKey = "purges/"
+
+// PurgeRecord is audit log entry of the purge.
+type PurgeRecord struct {
+	Time     time.Time `json:"time"`
+	Reason   string    `json:"reason"`
+	Segments int       `json:"segments"` // number of rewritten segments
+	Msgs     int       `json:"msgs"`     // number of removed messages
+}
+
+// Purge removes messages for which match returns true from all archived
+// segments, current segment is flushed first.
+// Segments with matching messages are rewritten, segments left without
+// messages are removed from the index (and deleted if store is Deleter).
+// Purge is recorded in the audit log under purges/ of the archive prefix.
+func (a *Archiver) Purge(ctx context.Context, reason string, match func(*amp.Msg) bool) (PurgeRecord, error) {
+	a.maint.Lock()
+	defer a.maint.Unlock()
+	p := PurgeRecord{Time: time.Now(), Reason: reason}
+	if err := a.Flush(ctx); err != nil {
+		return p, err
+	}
+	// segments are immutable after upload, only index needs lock
+	changed := make(map[string]Segment)
+	for _, s := range a.Index() {
+		removed, err := a.purgeSegment(ctx, &s, match)
+		if err != nil {
+			return p, err
+		}
+		if removed > 0 {
+			changed[s.Key] = s
+			p.Msgs += removed
+		}
+	}
+	p.Segments = len(changed)
+
+	var empty []string
+	if len(changed) > 0 {
+		a.io.Lock()
+		a.Lock()
+		var index []Segment
+		for _, s := range a.index {
+			if c, ok := changed[s.Key]; ok {
+				if c.Count == 0 {
+					empty = append(empty, s.Key)
+					continue
+				}
+				s = c
+			}
+			index = append(index, s)
+		}
+		a.Unlock()
+		err := a.writeIndex(ctx, index)
+		if err == nil {
+			a.Lock()
+			a.index = index
+			a.Unlock()
+		}
+		a.io.Unlock()
+		if err != nil {
+			return p, err
+		}
+	}
+	if d, ok := a.store.(Deleter); ok {
+		for _, k := range empty {
+			if err := d.Delete(ctx, k); err != nil {
+				log.S("key", k).Error(err)
+			}
+		}
+	}
+	if err := a.audit(ctx, p); err != nil {
+		return p, err
+	}
+	metric.Counter("archive.purged", p.Msgs)
+	log.S("reason", reason).I("segments", p.Segments).I("msgs", p.Msgs).Info("purge")
+	return p, nil
+}
+
+// purgeSegment rewrites segment without matching messages, updates
+// segment count and size and returns number of removed messages
+func (a *Archiver) purgeSegment(ctx context.Context, s *Segment, match func(*amp.Msg) bool) (int, error) {
+	rc, err := a.store.Get(ctx, s.Key)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	gr, err := gzip.NewReader(rc)
+	if err != nil {
+		return 0, errors.Wrap(err, s.Key)
+	}
+	defer gr.Close()
+	buf := bytes.NewBuffer(nil)
+	gz := gzip.NewWriter(buf)
+	removed, err := replayfile.NewPlayer(gr, 0).Filter(gz, func(m *amp.Msg) bool { return !match(m) })
+	if err != nil {
+		return 0, errors.Wrap(err, s.Key)
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	if err := gz.Close(); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if err := a.store.Put(ctx, s.Key, buf.Bytes()); err != nil {
+		return 0, err
+	}
+	s.Count -= removed
+	s.Size = buf.Len()
+	return removed, nil
+}
+
+// audit writes purge record as new object of the audit log.
+// Key is ordered by purge time, existing records are never rewritten.
+func (a *Archiver) audit(ctx context.Context, p PurgeRecord) error {
+	buf, err := json.Marshal(p)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	name := purgesKey + p.Time.UTC().Format("2006/01/02/150405") + "-" + strconv.FormatInt(p.Time.UnixNano(), 10) + ".json"
+	return a.store.Put(ctx, key(a.opts.prefix, name), buf)
+}
+
+// Purges returns audit log of the purges, ordered by time.
+func (r *Reader) Purges(ctx context.Context) ([]PurgeRecord, error) {
+	keys, err := r.store.List(ctx, key(r.prefix, purgesKey))
+	if err != nil {
+		return nil, err
+	}
+	var purges []PurgeRecord
+	for _, k := range keys {
+		p, err := readPurge(ctx, r.store, k)
+		if err != nil {
+			return nil, err
+		}
+		purges = append(purges, p)
+	}
+	return purges, nil
+}
+
+func readPurge(ctx context.Context, store Store, key string) (PurgeRecord, error) {
+	var p PurgeRecord
+	rc, err := store.Get(ctx, key)
+	if err != nil {
+		return p, err
+	}
+	defer rc.Close()
+	buf, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return p, errors.WithStack(err)
+	}
+	if err := json.Unmarshal(buf, &p); err != nil {
+		return p, errors.Wrapf(err, "archive purge %s", key)
+	}
+	return p, nil
+}
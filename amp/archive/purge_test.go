@@ -0,0 +1,72 @@
+package archive
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPurge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	store := Dir(dir)
+	ctx := context.Background()
+
+	a, err := New(ctx, store, Prefix("audit"))
+	assert.Nil(t, err)
+	assert.Nil(t, a.Add(ctx, amp.NewPublish("chat", "u1", 1, amp.Append, nil)))
+	assert.Nil(t, a.Add(ctx, amp.NewPublish("chat", "u2", 2, amp.Append, nil)))
+	assert.Nil(t, a.Flush(ctx))
+	assert.Nil(t, a.Add(ctx, amp.NewPublish("chat", "u1", 3, amp.Append, nil))) // in the current segment
+	index := a.Index()
+	assert.Len(t, index, 1)
+
+	p, err := a.Purge(ctx, "erasure u1", func(m *amp.Msg) bool { return m.Path() == "u1" })
+	assert.Nil(t, err)
+	assert.Equal(t, 2, p.Segments)
+	assert.Equal(t, 2, p.Msgs)
+
+	// segment without messages is removed
+	assert.Len(t, a.Index(), 1)
+	assert.Equal(t, index[0].Key, a.Index()[0].Key)
+	assert.Equal(t, 1, a.Index()[0].Count)
+
+	r := NewReader(store, "audit")
+	var uris []string
+	for m := range r.Stream(ctx, time.Now().Add(-time.Hour), time.Now(), 0) {
+		uris = append(uris, m.URI)
+	}
+	assert.Equal(t, []string{"chat/u2"}, uris)
+
+	purges, err := r.Purges(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, purges, 1)
+	assert.Equal(t, "erasure u1", purges[0].Reason)
+	assert.Equal(t, 2, purges[0].Msgs)
+
+	// records written concurrently, by other archivers, are all kept
+	var wg sync.WaitGroup
+	for i := 1; i <= 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			o, _ := New(ctx, store, Prefix("audit"))
+			assert.Nil(t, o.audit(ctx, PurgeRecord{Time: p.Time.Add(time.Duration(i) * time.Second), Msgs: i}))
+		}(i)
+	}
+	wg.Wait()
+	purges, err = r.Purges(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, purges, 9)
+	assert.Equal(t, "erasure u1", purges[0].Reason)
+	for i := 1; i < len(purges); i++ {
+		assert.Equal(t, i, purges[i].Msgs) // ordered by time
+	}
+}
@@ -0,0 +1,182 @@
+package archive
+
+import (
+	"context"
+	"time"
+
+	"github.com/minus5/svckit/lock"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+	"github.com/pkg/errors"
+)
+
+// Retention bounds the archive. Zero value of the field is unlimited.
+// Segments are evicted whole, oldest first. MaxBytes counts compressed
+// segment size, MaxMessages all messages in the segments containing topic.
+type Retention struct {
+	MaxAge      time.Duration
+	MaxBytes    int
+	MaxMessages int
+}
+
+func (r Retention) unlimited() bool {
+	return r.MaxAge == 0 && r.MaxBytes == 0 && r.MaxMessages == 0
+}
+
+// Retain sets retention for all topics without topic retention.
+func Retain(r Retention) func(*options) {
+	return func(o *options) {
+		o.retention = r
+	}
+}
+
+// TopicRetention sets retention for the topic.
+// Segment with many topics is evicted when it is out of retention of each topic.
+func TopicRetention(topic string, r Retention) func(*options) {
+	return func(o *options) {
+		if o.topicRetention == nil {
+			o.topicRetention = make(map[string]Retention)
+		}
+		o.topicRetention[topic] = r
+	}
+}
+
+func (o options) retentionFor(topic string) Retention {
+	if r, ok := o.topicRetention[topic]; ok {
+		return r
+	}
+	return o.retention
+}
+
+func (o options) hasRetention() bool {
+	if !o.retention.unlimited() {
+		return true
+	}
+	for _, r := range o.topicRetention {
+		if !r.unlimited() {
+			return true
+		}
+	}
+	return false
+}
+
+// StartCompactor periodically (each interval) evicts segments out of the
+// retention until ctx is done.
+// Compaction runs under the distributed lock archive-compaction (see
+// svckit/lock), so only one process compacts at a time.
+// Sends metrics archive.evicted, archive.evictedMsgs, archive.evictedBytes
+// and archive.segments.
+func (a *Archiver) StartCompactor(ctx context.Context, interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				err := lock.Do(ctx, "archive-compaction", func(ctx context.Context) error {
+					_, err := a.Compact(ctx, time.Now())
+					return err
+				})
+				if err != nil {
+					log.Error(err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Compact removes segments out of the retention at time now from the
+// index and the store. Returns number of evicted segments.
+// Index is written before segments are deleted so it never points to
+// the missing segment.
+func (a *Archiver) Compact(ctx context.Context, now time.Time) (int, error) {
+	if !a.opts.hasRetention() {
+		return 0, nil
+	}
+	d, ok := a.store.(Deleter)
+	if !ok {
+		return 0, errors.New("archive store does not support delete")
+	}
+	a.maint.Lock()
+	defer a.maint.Unlock()
+	a.io.Lock()
+	a.Lock()
+	keep, evict := a.evict(now)
+	a.Unlock()
+	if len(evict) == 0 {
+		a.io.Unlock()
+		return 0, nil
+	}
+	err := a.writeIndex(ctx, keep)
+	if err == nil {
+		a.Lock()
+		a.index = keep
+		a.Unlock()
+	}
+	a.io.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	msgs, size := 0, 0
+	for _, s := range evict {
+		if err := d.Delete(ctx, s.Key); err != nil {
+			metric.Counter("archive.evictFailed")
+			log.S("key", s.Key).Error(err)
+			continue
+		}
+		msgs += s.Count
+		size += s.Size
+	}
+	metric.Counter("archive.evicted", len(evict))
+	metric.Counter("archive.evictedMsgs", msgs)
+	metric.Counter("archive.evictedBytes", size)
+	metric.Gauge("archive.segments", len(keep))
+	log.I("segments", len(evict)).I("msgs", msgs).I("size", size).Info("segments evicted")
+	return len(evict), nil
+}
+
+// evict splits index into segments to keep and to evict, should be called during a.Lock
+func (a *Archiver) evict(now time.Time) (keep, evict []Segment) {
+	sizes := make(map[string]int)
+	counts := make(map[string]int)
+	drop := make([]bool, len(a.index))
+	// from the newest, only kept segments are counted into topic totals
+	for i := len(a.index) - 1; i >= 0; i-- {
+		s := a.index[i]
+		topics := s.Topics
+		if len(topics) == 0 {
+			topics = []string{""}
+		}
+		drop[i] = true
+		for _, t := range topics {
+			if !a.opts.retentionFor(t).exceeded(now, s, sizes[t]+s.Size, counts[t]+s.Count) {
+				drop[i] = false
+				break
+			}
+		}
+		if drop[i] {
+			continue
+		}
+		for _, t := range topics {
+			sizes[t] += s.Size
+			counts[t] += s.Count
+		}
+	}
+	for i, s := range a.index {
+		if drop[i] {
+			evict = append(evict, s)
+			continue
+		}
+		keep = append(keep, s)
+	}
+	return keep, evict
+}
+
+func (r Retention) exceeded(now time.Time, s Segment, size, count int) bool {
+	return (r.MaxAge > 0 && now.Sub(s.To) > r.MaxAge) ||
+		(r.MaxBytes > 0 && size > r.MaxBytes) ||
+		(r.MaxMessages > 0 && count > r.MaxMessages)
+}
@@ -0,0 +1,101 @@
+package archive
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/lock"
+	"github.com/stretchr/testify/assert"
+)
+
+func addSegment(t *testing.T, a *Archiver, topics ...string) {
+	ctx := context.Background()
+	for _, topic := range topics {
+		assert.Nil(t, a.Add(ctx, amp.NewPublish(topic, "1", 1, amp.Diff, nil)))
+	}
+	assert.Nil(t, a.Flush(ctx))
+}
+
+func TestRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	store := Dir(dir)
+	ctx := context.Background()
+
+	a, err := New(ctx, store, Prefix("audit"),
+		Retain(Retention{MaxAge: time.Hour}),
+		TopicRetention("odds", Retention{MaxMessages: 2}))
+	assert.Nil(t, err)
+	addSegment(t, a, "odds", "odds")
+	addSegment(t, a, "odds", "events")
+	addSegment(t, a, "odds")
+	index := a.Index()
+	assert.Len(t, index, 3)
+
+	// first segment is over odds messages limit
+	n, err := a.Compact(ctx, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, index[1:], a.Index())
+	_, err = store.Get(ctx, index[0].Key)
+	assert.Equal(t, ErrNotFound, err)
+
+	// second segment is kept until events are out of max age
+	n, err = a.Compact(ctx, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+	n, err = a.Compact(ctx, time.Now().Add(2*time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, index[2:], a.Index())
+
+	// compacted index is stored
+	a, err = New(ctx, store, Prefix("audit"))
+	assert.Nil(t, err)
+	assert.Len(t, a.Index(), 1)
+	assert.Equal(t, index[2].Key, a.Index()[0].Key)
+}
+
+type noDeleteStore struct{ Store }
+
+func TestRetentionRequiresDelete(t *testing.T) {
+	_, err := New(context.Background(), noDeleteStore{Dir("")}, Retain(Retention{MaxBytes: 1}))
+	assert.NotNil(t, err)
+}
+
+// testLock records locked keys
+type testLock chan string
+
+func (l testLock) Lock(ctx context.Context, key string) (<-chan struct{}, func() error, error) {
+	select {
+	case l <- key:
+	default:
+	}
+	return nil, func() error { return nil }, nil
+}
+
+func TestStartCompactorLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	keys := make(testLock, 1)
+	lock.Set(keys)
+	defer lock.Set(&lock.Consul{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a, err := New(ctx, Dir(dir), Retain(Retention{MaxAge: time.Hour}))
+	assert.Nil(t, err)
+	a.StartCompactor(ctx, time.Millisecond)
+	select {
+	case key := <-keys:
+		assert.Equal(t, "archive-compaction", key)
+	case <-time.After(time.Second):
+		t.Fatal("compaction lock not taken")
+	}
+}
@@ -0,0 +1,184 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// S3 is Store in the S3 compatible object storage (AWS S3, MinIO).
+// Requests are signed with AWS signature version 4 and use path-style
+// addressing (endpoint/bucket/key).
+type S3 struct {
+	endpoint  string
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// NewS3 creates S3 store.
+// Endpoint is base url of the storage, e.g. https://s3.eu-central-1.amazonaws.com
+// or http://minio:9000.
+func NewS3(endpoint, region, bucket, accessKey, secretKey string) *S3 {
+	return &S3{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		region:    region,
+		bucket:    bucket,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: time.Minute},
+	}
+}
+
+// Put uploads object.
+func (s *S3) Put(ctx context.Context, key string, body []byte) error {
+	rsp, err := s.do(ctx, "PUT", key, nil, body)
+	if err != nil {
+		return err
+	}
+	return rsp.Body.Close()
+}
+
+// Get downloads object. Caller must close returned reader.
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	rsp, err := s.do(ctx, "GET", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return rsp.Body, nil
+}
+
+// Delete removes object, missing object is not an error.
+func (s *S3) Delete(ctx context.Context, key string) error {
+	rsp, err := s.do(ctx, "DELETE", key, nil, nil)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return rsp.Body.Close()
+}
+
+// List returns keys with prefix.
+func (s *S3) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		rsp, err := s.do(ctx, "GET", "", q, nil)
+		if err != nil {
+			return nil, err
+		}
+		var res struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(rsp.Body).Decode(&res)
+		rsp.Body.Close()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for _, c := range res.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+func (s *S3) do(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Response, error) {
+	u, err := url.Parse(s.endpoint + "/" + s.bucket + "/" + key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if query != nil {
+		u.RawQuery = strings.Replace(query.Encode(), "+", "%20", -1)
+	}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req = req.WithContext(ctx)
+	s.sign(req, body, time.Now().UTC())
+	rsp, err := s.client.Do(req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if rsp.StatusCode == http.StatusNotFound {
+		rsp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if rsp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 1024))
+		rsp.Body.Close()
+		return nil, errors.Errorf("s3 %s %s status %d: %s", method, key, rsp.StatusCode, msg)
+	}
+	return rsp, nil
+}
+
+// sign adds AWS signature version 4 headers to the request.
+func (s *S3) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := hexSha256(body)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hexSha256([]byte(canonical))
+
+	key := hmacSha256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSha256(key, s.region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hexSha256(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,82 @@
+package archive
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotFound is returned by Store.Get for missing object.
+var ErrNotFound = errors.New("object not found")
+
+// Store is object storage of the archive segments.
+type Store interface {
+	Put(ctx context.Context, key string, body []byte) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// Deleter is implemented by stores which can remove objects.
+// Archiver with retention requires store to be Deleter.
+type Deleter interface {
+	Delete(ctx context.Context, key string) error
+}
+
+// Dir is Store in the local directory, used in tests and development.
+type Dir string
+
+// Put writes object to the file.
+func (d Dir) Put(ctx context.Context, key string, body []byte) error {
+	fn := filepath.Join(string(d), filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(ioutil.WriteFile(fn, body, 0644))
+}
+
+// Get opens object file.
+func (d Dir) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(string(d), filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, errors.WithStack(err)
+}
+
+// Delete removes object file, missing file is not an error.
+func (d Dir) Delete(ctx context.Context, key string) error {
+	err := os.Remove(filepath.Join(string(d), filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return errors.WithStack(err)
+}
+
+// List returns sorted keys with prefix.
+func (d Dir) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.Walk(string(d), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(string(d), path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	sort.Strings(keys)
+	return keys, errors.WithStack(err)
+}
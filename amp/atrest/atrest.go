@@ -0,0 +1,200 @@
+// Package atrest encrypts data stored to disk (replay files, spools)
+// with AES-GCM.
+//
+// Keyring holds keys by id. Data is always sealed with the current key,
+// and the key id is stored with the data, so after key rotation data
+// sealed with the previous keys can still be opened.
+//
+// Keys are loaded from environment:
+//
+//	SVCKIT_ATREST_KEYS="k2:<base64 key>,k1:<base64 key>"   # first is current
+//
+// or from Consul KV:
+//
+//	<prefix>/current   = k2
+//	<prefix>/keys/k1   = <base64 key>
+//	<prefix>/keys/k2   = <base64 key>
+//
+// Keys are 16, 24 or 32 bytes (AES-128, AES-192, AES-256).
+package atrest
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/minus5/svckit/dcy"
+	"github.com/pkg/errors"
+)
+
+// EnvKeys is environment variable with keys.
+const EnvKeys = "SVCKIT_ATREST_KEYS"
+
+// ErrUnknownKey is returned when data is sealed with key not in the keyring.
+var ErrUnknownKey = errors.New("unknown key")
+
+// Keyring holds encryption keys.
+type Keyring struct {
+	current string
+	aeads   map[string]cipher.AEAD
+	sync.RWMutex
+}
+
+// NewKeyring creates keyring with keys by id; current is id of the key used for sealing.
+func NewKeyring(current string, keys map[string][]byte) (*Keyring, error) {
+	k := &Keyring{}
+	if err := k.Rotate(current, keys); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Rotate replaces keys in the keyring.
+// Keep previous keys in keys to be able to open data sealed with them.
+func (k *Keyring) Rotate(current string, keys map[string][]byte) error {
+	if _, ok := keys[current]; !ok {
+		return errors.Errorf("current key %s not found", current)
+	}
+	aeads := make(map[string]cipher.AEAD)
+	for id, key := range keys {
+		if len(id) == 0 || len(id) > 255 {
+			return errors.Errorf("invalid key id '%s'", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return errors.Wrap(err, id)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return errors.Wrap(err, id)
+		}
+		aeads[id] = aead
+	}
+	k.Lock()
+	defer k.Unlock()
+	k.current = current
+	k.aeads = aeads
+	return nil
+}
+
+// FromEnv creates keyring from EnvKeys environment variable.
+func FromEnv() (*Keyring, error) {
+	current, keys, err := parseKeys(os.Getenv(EnvKeys))
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyring(current, keys)
+}
+
+// FromConsul creates keyring from Consul KV under prefix.
+func FromConsul(prefix string) (*Keyring, error) {
+	current, keys, err := consulKeys(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyring(current, keys)
+}
+
+// ReloadFromConsul rotates keys to the ones currently in Consul.
+func (k *Keyring) ReloadFromConsul(prefix string) error {
+	current, keys, err := consulKeys(prefix)
+	if err != nil {
+		return err
+	}
+	return k.Rotate(current, keys)
+}
+
+func consulKeys(prefix string) (string, map[string][]byte, error) {
+	current, err := dcy.KV(prefix + "/current")
+	if err != nil {
+		return "", nil, errors.WithStack(err)
+	}
+	kvs, err := dcy.KVs(prefix + "/keys")
+	if err != nil {
+		return "", nil, errors.WithStack(err)
+	}
+	keys := make(map[string][]byte)
+	for id, v := range kvs {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+		if err != nil {
+			return "", nil, errors.Wrap(err, id)
+		}
+		keys[id] = key
+	}
+	return strings.TrimSpace(current), keys, nil
+}
+
+// parseKeys parses "id:base64,id:base64", first key is current
+func parseKeys(s string) (string, map[string][]byte, error) {
+	var current string
+	keys := make(map[string][]byte)
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		kv := strings.SplitN(p, ":", 2)
+		if len(kv) != 2 {
+			return "", nil, errors.Errorf("invalid key format %s", kv[0])
+		}
+		key, err := base64.StdEncoding.DecodeString(kv[1])
+		if err != nil {
+			return "", nil, errors.Wrap(err, kv[0])
+		}
+		if current == "" {
+			current = kv[0]
+		}
+		keys[kv[0]] = key
+	}
+	if current == "" {
+		return "", nil, errors.New("no keys")
+	}
+	return current, keys, nil
+}
+
+// Seal encrypts data with the current key.
+// Output is: key id length, key id, nonce, ciphertext.
+func (k *Keyring) Seal(data []byte) ([]byte, error) {
+	k.RLock()
+	id := k.current
+	aead := k.aeads[id]
+	k.RUnlock()
+
+	out := make([]byte, 0, 1+len(id)+aead.NonceSize()+len(data)+aead.Overhead())
+	out = append(out, byte(len(id)))
+	out = append(out, id...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, data, []byte(id)), nil
+}
+
+// Open decrypts data sealed by Seal.
+func (k *Keyring) Open(sealed []byte) ([]byte, error) {
+	if len(sealed) < 1 || len(sealed) < 1+int(sealed[0]) {
+		return nil, errors.New("sealed data too short")
+	}
+	id := string(sealed[1 : 1+int(sealed[0])])
+	k.RLock()
+	aead, ok := k.aeads[id]
+	k.RUnlock()
+	if !ok {
+		return nil, errors.Wrap(ErrUnknownKey, id)
+	}
+	rest := sealed[1+len(id):]
+	if len(rest) < aead.NonceSize() {
+		return nil, errors.New("sealed data too short")
+	}
+	data, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], []byte(id))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return data, nil
+}
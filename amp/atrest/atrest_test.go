@@ -0,0 +1,63 @@
+package atrest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func key(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestSealOpen(t *testing.T) {
+	k, err := NewKeyring("k1", map[string][]byte{"k1": key(1)})
+	assert.Nil(t, err)
+	sealed, err := k.Seal([]byte("personal data"))
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(sealed, []byte("personal")))
+	data, err := k.Open(sealed)
+	assert.Nil(t, err)
+	assert.Equal(t, "personal data", string(data))
+
+	sealed[len(sealed)-1] ^= 1
+	_, err = k.Open(sealed)
+	assert.NotNil(t, err)
+}
+
+func TestRotate(t *testing.T) {
+	k, err := NewKeyring("k1", map[string][]byte{"k1": key(1)})
+	assert.Nil(t, err)
+	old, _ := k.Seal([]byte("old"))
+
+	assert.Nil(t, k.Rotate("k2", map[string][]byte{"k1": key(1), "k2": key(2)}))
+	data, err := k.Open(old)
+	assert.Nil(t, err)
+	assert.Equal(t, "old", string(data))
+	sealed, _ := k.Seal([]byte("new"))
+	assert.Equal(t, "k2", string(sealed[1:3]))
+
+	assert.Nil(t, k.Rotate("k2", map[string][]byte{"k2": key(2)}))
+	_, err = k.Open(old)
+	assert.Equal(t, ErrUnknownKey, errors.Cause(err))
+
+	assert.NotNil(t, k.Rotate("k3", map[string][]byte{"k2": key(2)}))
+	assert.NotNil(t, k.Rotate("k3", map[string][]byte{"k3": []byte("short")}))
+}
+
+func TestFromEnv(t *testing.T) {
+	os.Setenv(EnvKeys, "k2:"+base64.StdEncoding.EncodeToString(key(2))+", k1:"+base64.StdEncoding.EncodeToString(key(1)))
+	defer os.Unsetenv(EnvKeys)
+	k, err := FromEnv()
+	assert.Nil(t, err)
+	assert.Equal(t, "k2", k.current)
+	assert.Len(t, k.aeads, 2)
+
+	os.Setenv(EnvKeys, "")
+	_, err = FromEnv()
+	assert.NotNil(t, err)
+}
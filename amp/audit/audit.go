@@ -0,0 +1,161 @@
+// Package audit records handling of every request into an append-only
+// audit sink, separate from the application logs.
+//
+//	s, err := audit.OpenFile("/var/log/app/audit.log")
+//	a := audit.New(s, audit.Meta("user", "client"))
+//	r.Use(a.Handler)
+//
+// Record contains who sent the request (selected request meta), what
+// was requested (uri and sha256 of the body), when and the outcome
+// (error code and message, handling duration).
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+	"github.com/pkg/errors"
+)
+
+// Record is audit log entry of the handled request.
+type Record struct {
+	Time          time.Time         `json:"time"` // request receive time
+	URI           string            `json:"uri"`
+	CorrelationID uint64            `json:"correlationId,omitempty"`
+	Meta          map[string]string `json:"meta,omitempty"` // request identity
+	BodyHash      string            `json:"bodyHash,omitempty"`
+	Code          int               `json:"code,omitempty"`  // response error code
+	Error         string            `json:"error,omitempty"` // response error message
+	Duration      time.Duration     `json:"duration"`
+}
+
+// Sink stores audit records. Write is called for each handled request
+// from the handler goroutine.
+type Sink interface {
+	Write(r Record) error
+}
+
+// SinkFunc adapts function to the Sink.
+type SinkFunc func(r Record) error
+
+// Write calls f.
+func (f SinkFunc) Write(r Record) error {
+	return f(r)
+}
+
+// Auditor is request handler middleware writing audit records.
+type Auditor struct {
+	sink Sink
+	meta []string
+}
+
+// Meta selects request meta keys which are recorded, all meta is recorded
+// by default.
+func Meta(keys ...string) func(*Auditor) {
+	return func(a *Auditor) {
+		a.meta = keys
+	}
+}
+
+// New creates auditor writing into the sink.
+func New(sink Sink, opts ...func(*Auditor)) *Auditor {
+	a := &Auditor{sink: sink}
+	for _, o := range opts {
+		o(a)
+	}
+	return a
+}
+
+// Handler is middleware which writes audit record for each request.
+// Failed write is logged and counted in audit.failed metric, request
+// outcome is not changed.
+func (a *Auditor) Handler(h amp.Handler) amp.Handler {
+	return func(ctx context.Context, m *amp.Msg) (*amp.Msg, error) {
+		start := time.Now()
+		rsp, err := h(ctx, m)
+		r := a.record(m, start)
+		r.Duration = time.Since(start)
+		switch {
+		case err != nil:
+			r.Error = err.Error()
+			if e, ok := errors.Cause(err).(*amp.Error); ok {
+				r.Code = e.Code
+			}
+		case rsp != nil && rsp.Error != nil:
+			r.Code = rsp.Error.Code
+			r.Error = rsp.Error.Error()
+		}
+		if werr := a.sink.Write(r); werr != nil {
+			metric.Counter("audit.failed")
+			log.S("uri", m.URI).Error(werr)
+		}
+		return rsp, err
+	}
+}
+
+func (a *Auditor) record(m *amp.Msg, start time.Time) Record {
+	r := Record{
+		Time:          start,
+		URI:           m.URI,
+		CorrelationID: m.CorrelationID,
+		Meta:          m.Meta,
+	}
+	if a.meta != nil {
+		r.Meta = nil
+		for _, k := range a.meta {
+			if v, ok := m.Meta[k]; ok {
+				if r.Meta == nil {
+					r.Meta = make(map[string]string)
+				}
+				r.Meta[k] = v
+			}
+		}
+	}
+	if body := m.BodyBytes(); len(body) > 0 {
+		h := sha256.Sum256(body)
+		r.BodyHash = hex.EncodeToString(h[:])
+	}
+	return r
+}
+
+// File is Sink appending records as json lines to the file.
+type File struct {
+	f *os.File
+	sync.Mutex
+}
+
+// OpenFile opens file for appending, file is created if it doesn't exist.
+func OpenFile(name string) (*File, error) {
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &File{f: f}, nil
+}
+
+// Write appends record to the file, record is written with single write.
+func (s *File) Write(r Record) error {
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	s.Lock()
+	defer s.Unlock()
+	_, err = s.f.Write(append(buf, '\n'))
+	return errors.WithStack(err)
+}
+
+// Close closes the file.
+func (s *File) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	return errors.WithStack(s.f.Close())
+}
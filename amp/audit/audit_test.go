@@ -0,0 +1,72 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	var recs []Record
+	a := New(SinkFunc(func(r Record) error {
+		recs = append(recs, r)
+		return nil
+	}), Meta("user"))
+	h := a.Handler(func(ctx context.Context, m *amp.Msg) (*amp.Msg, error) {
+		if m.Path() == "fail" {
+			return nil, errors.WithStack(amp.Errf(42, "failed"))
+		}
+		return m.Response(nil), nil
+	})
+
+	m := amp.NewRequest("math.req/add", map[string]int{"x": 1})
+	m.Meta = map[string]string{"user": "u1", "token": "secret"}
+	_, err := h(context.Background(), m)
+	assert.Nil(t, err)
+	_, err = h(context.Background(), amp.NewRequest("math.req/fail", nil))
+	assert.NotNil(t, err)
+
+	assert.Len(t, recs, 2)
+	assert.Equal(t, "math.req/add", recs[0].URI)
+	assert.Equal(t, map[string]string{"user": "u1"}, recs[0].Meta)
+	assert.Len(t, recs[0].BodyHash, 64)
+	assert.Equal(t, 0, recs[0].Code)
+	assert.Equal(t, 42, recs[1].Code)
+	assert.Equal(t, "failed", recs[1].Error)
+	assert.Nil(t, recs[1].Meta)
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "audit.log")
+
+	for i := 0; i < 2; i++ {
+		s, err := OpenFile(fn)
+		assert.Nil(t, err)
+		assert.Nil(t, s.Write(Record{URI: "math.req/add"}))
+		assert.Nil(t, s.Close())
+	}
+
+	f, err := os.Open(fn)
+	assert.Nil(t, err)
+	defer f.Close()
+	n := 0
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var r Record
+		assert.Nil(t, json.Unmarshal(sc.Bytes(), &r))
+		assert.Equal(t, "math.req/add", r.URI)
+		n++
+	}
+	assert.Equal(t, 2, n)
+}
@@ -0,0 +1,46 @@
+package amp
+
+// BackfillPath is path of the backfill request for the append topic.
+// Backfill request is served by the broker from its cache.
+const BackfillPath = "_backfill"
+
+// BackfillRange is body of the backfill request.
+// Range is by Ts or, when FromOffset is set, by message Offset.
+type BackfillRange struct {
+	From       int64 `json:"from"`                 // first Ts
+	To         int64 `json:"to,omitempty"`         // last Ts, 0 until the last message
+	FromOffset int64 `json:"fromOffset,omitempty"` // first offset
+	ToOffset   int64 `json:"toOffset,omitempty"`   // last offset, 0 until the last message
+}
+
+// BackfillResult is body of the backfill response.
+// Response is sent after all replay messages in the range.
+// To continue with live messages subscribe to the topic with Last Ts.
+type BackfillResult struct {
+	Count int   `json:"count"`           // number of replayed messages
+	First int64 `json:"first,omitempty"` // oldest Ts available, if greater than From range is not complete
+	Last  int64 `json:"last,omitempty"`  // Ts of the last replayed message
+
+	FirstOffset int64 `json:"firstOffset,omitempty"` // oldest offset available
+	LastOffset  int64 `json:"lastOffset,omitempty"`  // offset of the last replayed message
+}
+
+// NewBackfill creates request for all messages of the append topic with Ts
+// in range [from, to].
+func NewBackfill(topic string, from, to int64) *Msg {
+	return NewRequest(topic+"/"+BackfillPath, BackfillRange{From: from, To: to})
+}
+
+// NewBackfillOffset creates request for all messages of the append topic
+// with Offset in range [from, to]. Broker assigns offsets to the append
+// topic messages in order of arrival, starting from 1.
+// To consume topic as log: backfill from the last processed offset and
+// subscribe with the Last Ts from the response.
+func NewBackfillOffset(topic string, from, to int64) *Msg {
+	return NewRequest(topic+"/"+BackfillPath, BackfillRange{FromOffset: from, ToOffset: to})
+}
+
+// IsBackfill returns true for backfill request.
+func (m *Msg) IsBackfill() bool {
+	return m.Type == Request && m.Path() == BackfillPath
+}
@@ -0,0 +1,197 @@
+// Package bridge republishes amp topics from one nsq cluster (datacenter)
+// into another.
+//
+// Only Publish messages are bridged. They are republished as replay
+// messages marked with Origin datacenter. Messages which originate from
+// the destination datacenter are not bridged back, so two bridges in
+// opposite directions don't make a loop.
+//
+// Example:
+//
+//	b := bridge.MustNew(ctx, []string{"math.v1"},
+//		bridge.From("dc1", "10.0.1.1:4161", "10.0.1.2:4161"),
+//		bridge.To("dc2", "127.0.0.1:4150"))
+//	b.Wait()
+package bridge
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/env"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+	"github.com/minus5/svckit/nsq"
+	"github.com/minus5/svckit/signal"
+	"github.com/pkg/errors"
+)
+
+type options struct {
+	from     string   // source datacenter name
+	lookupds []string // source nsqlookupd http addresses
+	to       string   // destination datacenter name
+	nsqd     string   // destination nsqd tcp address
+	channel  string
+}
+
+// From sets source datacenter name and its nsqlookupd http addresses.
+func From(dc string, lookupds ...string) func(*options) {
+	return func(o *options) {
+		o.from = dc
+		o.lookupds = lookupds
+	}
+}
+
+// To sets destination datacenter name and its nsqd tcp address.
+func To(dc string, nsqd string) func(*options) {
+	return func(o *options) {
+		o.to = dc
+		o.nsqd = nsqd
+	}
+}
+
+// Channel sets source nsq channel name. Default is application name,
+// so messages are bridged once when multiple bridge instances are running.
+func Channel(c string) func(*options) {
+	return func(o *options) {
+		o.channel = c
+	}
+}
+
+// Bridge subscribes to the topics in the source cluster and
+// publishes them into the destination cluster.
+type Bridge struct {
+	o    *options
+	pub  *nsq.Producer
+	subs []*nsq.Consumer
+	lags map[string]time.Duration // last lag by topic
+	ctx  context.Context
+	done chan struct{}
+	msgs sync.WaitGroup
+	sync.Mutex
+}
+
+// MustNew creates bridge, fails on error.
+func MustNew(ctx context.Context, topics []string, opts ...func(*options)) *Bridge {
+	b, err := New(ctx, topics, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return b
+}
+
+// New creates bridge for the topics.
+// Bridge is stopped when ctx is done.
+func New(ctx context.Context, topics []string, opts ...func(*options)) (*Bridge, error) {
+	o := &options{channel: env.AppName()}
+	for _, fn := range opts {
+		fn(o)
+	}
+	if o.from == "" || o.to == "" || len(o.lookupds) == 0 || o.nsqd == "" {
+		return nil, errors.New("source and destination must be set")
+	}
+	if o.from == o.to {
+		return nil, errors.Errorf("source and destination are the same datacenter %s", o.from)
+	}
+
+	pub, err := nsq.NewProducer("", nsq.Nsqd(o.nsqd))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	b := &Bridge{
+		o:    o,
+		pub:  pub,
+		lags: make(map[string]time.Duration),
+		ctx:  ctx,
+		done: make(chan struct{}),
+	}
+	for _, topic := range topics {
+		sub, err := nsq.NewConsumer(topic, b.onMessage(topic),
+			nsq.Lookupds(o.lookupds...),
+			nsq.Channel(o.channel),
+			nsq.Ordered())
+		if err != nil {
+			b.close()
+			return nil, errors.WithStack(err)
+		}
+		b.subs = append(b.subs, sub)
+	}
+	go func() {
+		<-ctx.Done()
+		b.close()
+		close(b.done)
+	}()
+	return b, nil
+}
+
+func (b *Bridge) onMessage(topic string) func(*nsq.Message) error {
+	return func(nm *nsq.Message) error {
+		b.msgs.Add(1)
+		defer b.msgs.Done()
+		m := amp.Parse(nm.Body)
+		if m == nil {
+			return nil
+		}
+		if m.Type != amp.Publish || m.Origin == b.o.to {
+			m.Release()
+			return nil
+		}
+		rm := m.AsReplay()
+		if rm.Origin == "" {
+			rm.Origin = b.o.from
+		}
+		buf := rm.Marshal()
+		// retry until destination is reachable, preserving order of the messages
+		err := signal.WithBackoff(b.ctx, func() error {
+			err := b.pub.PublishTo(topic, buf)
+			if err != nil {
+				metric.Counter("bridge.error")
+				log.S("topic", topic).S("to", b.o.to).Error(err)
+			}
+			return err
+		}, 10*time.Second, 0)
+		if err != nil {
+			return err // ctx done, nsq will requeue message
+		}
+		b.setLag(topic, m.Ts)
+		return nil
+	}
+}
+
+func (b *Bridge) setLag(topic string, ts int64) {
+	if ts == 0 {
+		return
+	}
+	lag := time.Duration(amp.TS()-ts) * time.Millisecond
+	b.Lock()
+	b.lags[topic] = lag
+	b.Unlock()
+	metric.Gauge("bridge.lag."+topic, int(lag/time.Millisecond))
+}
+
+// Lag returns, for each bridged topic, time between publishing of the
+// last bridged message in the source and its publishing in the destination.
+func (b *Bridge) Lag() map[string]time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	lags := make(map[string]time.Duration)
+	for k, v := range b.lags {
+		lags[k] = v
+	}
+	return lags
+}
+
+// Wait blocks until bridge is stopped.
+func (b *Bridge) Wait() {
+	<-b.done
+}
+
+func (b *Bridge) close() {
+	for _, sub := range b.subs {
+		sub.Close()
+	}
+	b.msgs.Wait()
+	b.pub.Close()
+}
@@ -0,0 +1,18 @@
+package bridge
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewValidation(t *testing.T) {
+	ctx := context.Background()
+	_, err := New(ctx, []string{"math.v1"})
+	assert.Error(t, err)
+	_, err = New(ctx, []string{"math.v1"}, From("dc1", "10.0.1.1:4161"))
+	assert.Error(t, err)
+	_, err = New(ctx, []string{"math.v1"}, From("dc1", "10.0.1.1:4161"), To("dc1", "127.0.0.1:4150"))
+	assert.Error(t, err)
+}
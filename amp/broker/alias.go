@@ -0,0 +1,115 @@
+package broker
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+)
+
+type alias struct {
+	topic string    // new topic name
+	until time.Time // end of the deprecation window, zero for no end
+}
+
+// Alias maps subscriptions to the old topic name to the new one, until the
+// end of the deprecation window (zero until for no end). Subscribers of
+// the old name get messages of the new topic with uris renamed to the old
+// name. Usage of the old name is logged and counted in broker.alias.<old>.
+func Alias(old, new string, until time.Time) func(*Broker) {
+	return func(s *Broker) {
+		if s.aliases == nil {
+			s.aliases = make(map[string]alias)
+		}
+		s.aliases[old] = alias{topic: new, until: until}
+	}
+}
+
+// aliasSubscriber renames messages back to the names subscriber subscribed to
+type aliasSubscriber struct {
+	c     amp.Subscriber
+	names map[string]string // old name by new uri
+	sync.Mutex
+}
+
+func (a *aliasSubscriber) Send(m *amp.Msg) {
+	a.Lock()
+	old, ok := a.names[m.URI]
+	a.Unlock()
+	if ok {
+		m = m.Rename(old)
+	}
+	a.c.Send(m)
+}
+
+// resolve returns new uri for the aliased uri
+func (s *Broker) resolve(uri string) (string, string, bool) {
+	for old, a := range s.aliases {
+		if uri != old && !strings.HasPrefix(uri, old+"/") {
+			continue
+		}
+		if !a.until.IsZero() && time.Now().After(a.until) {
+			return "", "", false
+		}
+		return a.topic + uri[len(old):], old, true
+	}
+	return "", "", false
+}
+
+// splitAliased splits subscriber topics into direct ones and those
+// subscribed with the old name, which are subscribed with aliasSubscriber
+func (s *Broker) splitAliased(c amp.Subscriber, topics map[string]int64) (map[string]int64, *aliasSubscriber, map[string]int64) {
+	if len(s.aliases) == 0 {
+		return topics, nil, nil
+	}
+	direct := make(map[string]int64)
+	aliased := make(map[string]int64)
+	names := make(map[string]string)
+	for uri, ts := range topics {
+		n, old, ok := s.resolve(uri)
+		if !ok {
+			direct[uri] = ts
+			continue
+		}
+		aliased[n] = ts
+		names[n] = uri
+		metric.Counter("broker.alias." + old)
+		l := log.S("topic", uri).S("alias", n)
+		if mc, ok := c.(interface{ Meta() map[string]string }); ok {
+			for k, v := range mc.Meta() {
+				l = l.S(k, v)
+			}
+		}
+		l.Info("subscribe to deprecated topic name")
+	}
+
+	s.aliasLock.Lock()
+	defer s.aliasLock.Unlock()
+	a, ok := s.aliasSubs[c]
+	if !ok {
+		if len(aliased) == 0 {
+			return direct, nil, nil
+		}
+		a = &aliasSubscriber{c: c}
+		s.aliasSubs[c] = a
+	}
+	a.Lock()
+	a.names = names
+	a.Unlock()
+	return direct, a, aliased
+}
+
+// removeAliased returns aliasSubscriber of the subscriber and forgets it
+func (s *Broker) removeAliased(c amp.Subscriber) *aliasSubscriber {
+	s.aliasLock.Lock()
+	defer s.aliasLock.Unlock()
+	a, ok := s.aliasSubs[c]
+	if !ok {
+		return nil
+	}
+	delete(s.aliasSubs, c)
+	return a
+}
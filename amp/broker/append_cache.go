@@ -3,13 +3,16 @@ package broker
 import "github.com/minus5/svckit/amp"
 
 type appendCache struct {
-	msgs  []*amp.Msg
-	depth int
+	msgs       []*amp.Msg
+	depth      int
+	compaction Compaction
+	offset     int64 // offset of the last added message
 }
 
-func newAppendCache() *appendCache {
+func newAppendCache(c Compaction) *appendCache {
 	return &appendCache{
-		depth: 64,
+		depth:      64,
+		compaction: c,
 	}
 }
 
@@ -24,6 +27,8 @@ func (c *appendCache) Add(m *amp.Msg) {
 	if m.IsReplay() && len(c.msgs) > 0 && c.msgs[len(c.msgs)-1].Ts == m.Ts {
 		return
 	}
+	c.offset++
+	m.SetOffset(c.offset)
 	c.msgs = append(c.msgs, m)
 	ln := len(c.msgs)
 	if ln > 1 {
@@ -31,6 +36,10 @@ func (c *appendCache) Add(m *amp.Msg) {
 			c.msgs = sortMsgs(c.msgs)
 		}
 	}
+	if c.compaction != nil {
+		c.msgs = c.compaction(c.msgs)
+		return
+	}
 	if m.CacheDepth > 0 {
 		c.depth = m.CacheDepth
 	}
@@ -57,6 +66,39 @@ func (c *appendCache) msgsAfter(ts int64) []*amp.Msg {
 	return d
 }
 
+// Range returns messages with Ts in [from, to], to 0 is unlimited
+func (c *appendCache) Range(from, to int64) []*amp.Msg {
+	var d []*amp.Msg
+	for _, m := range c.msgs {
+		if m.Ts >= from && (to == 0 || m.Ts <= to) {
+			d = append(d, m)
+		}
+	}
+	return d
+}
+
+// RangeOffset returns messages with Offset in [from, to], to 0 is unlimited
+func (c *appendCache) RangeOffset(from, to int64) []*amp.Msg {
+	var d []*amp.Msg
+	for _, m := range c.msgs {
+		if m.Offset >= from && (to == 0 || m.Offset <= to) {
+			d = append(d, m)
+		}
+	}
+	return d
+}
+
+// firstOffset returns oldest offset in the cache
+func (c *appendCache) firstOffset() int64 {
+	first := int64(0)
+	for _, m := range c.msgs {
+		if first == 0 || m.Offset < first {
+			first = m.Offset
+		}
+	}
+	return first
+}
+
 func (c *appendCache) Current() []*amp.Msg {
 	return c.msgs
 }
@@ -8,7 +8,7 @@ import (
 )
 
 func TestShrink(t *testing.T) {
-	c := newAppendCache()
+	c := newAppendCache(nil)
 	c.depth = 2
 	c.Add(&amp.Msg{Ts: 10, UpdateType: amp.Append})
 	assert.Len(t, c.msgs, 1)
@@ -3,6 +3,7 @@ package broker
 import (
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/minus5/svckit/amp"
 	"github.com/minus5/svckit/log"
@@ -158,6 +159,31 @@ func TestDobijePropusteneDiffOveNaSubscribe(t *testing.T) {
 	assert.Len(t, c.messages, 4)
 }
 
+func TestLanesKeepURIOrder(t *testing.T) {
+	s := New(nil)
+	c := &testConsumer{topics: map[string]int64{"1": 0}}
+	s.Subscribe(c, c.topics)
+	s.Publish(&amp.Msg{URI: "1", Ts: 101, UpdateType: amp.Full})
+	s.wait("1")
+
+	// loop is busy, messages wait in lanes
+	s.inLoopWait(func() {
+		s.Publish(&amp.Msg{URI: "1", Ts: 102, UpdateType: amp.Diff})
+		s.Publish(&amp.Msg{URI: "1", Ts: 103, UpdateType: amp.Diff})
+		s.Publish(&amp.Msg{URI: "1", Ts: 104, UpdateType: amp.Close})
+	})
+	s.waitClose()
+
+	c.Lock()
+	defer c.Unlock()
+	var ts []int64
+	for _, m := range c.messages {
+		ts = append(ts, m.Ts)
+	}
+	// close is not overtaking diffs published before
+	assert.Equal(t, []int64{101, 102, 103}, ts)
+}
+
 func TestReplay(t *testing.T) {
 	s := New(nil)
 	m1 := &amp.Msg{URI: "1", Ts: 101, UpdateType: amp.Full}
@@ -186,3 +212,140 @@ func TestReplay(t *testing.T) {
 	msgs = s.Replay("")
 	assert.Len(t, msgs, 6)
 }
+
+func TestBackfill(t *testing.T) {
+	s := New(nil)
+	for ts := int64(1); ts <= 5; ts++ {
+		s.Publish(&amp.Msg{Type: amp.Publish, URI: "feed", Ts: ts, UpdateType: amp.Append})
+	}
+	s.wait("feed")
+
+	c := &testConsumer{}
+	s.Backfill(c, amp.Parse(amp.NewBackfill("feed", 2, 4).Marshal()))
+	s.wait("feed")
+
+	assert.Len(t, c.messages, 4)
+	for i, m := range c.messages[:3] {
+		assert.Equal(t, int64(i+2), m.Ts)
+		assert.True(t, m.IsReplay())
+	}
+	rsp := amp.Parse(c.messages[3].Marshal())
+	assert.Equal(t, amp.Response, rsp.Type)
+	var r amp.BackfillResult
+	assert.NoError(t, rsp.Unmarshal(&r))
+	assert.Equal(t, amp.BackfillResult{Count: 3, First: 1, Last: 4, FirstOffset: 1, LastOffset: 4}, r)
+
+	// by offset
+	c = &testConsumer{}
+	s.Backfill(c, amp.Parse(amp.NewBackfillOffset("feed", 4, 0).Marshal()))
+	s.wait("feed")
+	assert.Len(t, c.messages, 3)
+	assert.Equal(t, int64(4), c.messages[0].Offset)
+	assert.Equal(t, int64(5), c.messages[1].Offset)
+	assert.Equal(t, int64(5), amp.Parse(c.messages[1].Marshal()).Offset)
+
+	// unknown topic
+	c = &testConsumer{}
+	s.Backfill(c, amp.Parse(amp.NewBackfill("unknown", 2, 0).Marshal()))
+	s.inLoopWait(func() {})
+	assert.Len(t, c.messages, 1)
+}
+
+func TestLiveness(t *testing.T) {
+	s := New(nil, Liveness(20*time.Millisecond))
+	c := &testConsumer{}
+	s.Subscribe(c, map[string]int64{"1": 0})
+	s.Publish(&amp.Msg{URI: "1", Ts: 1, UpdateType: amp.Full})
+	s.Publish(amp.NewTopicAlive("1"))
+	s.wait("1")
+	assert.Len(t, c.messages, 1)
+
+	statuses := func() []*amp.Msg {
+		c.Lock()
+		defer c.Unlock()
+		var st []*amp.Msg
+		for _, m := range c.messages {
+			if m.IsStatus() {
+				st = append(st, m)
+			}
+		}
+		return st
+	}
+	time.Sleep(50 * time.Millisecond)
+	s.wait("1")
+	assert.Len(t, statuses(), 1)
+
+	s.Publish(amp.NewTopicAlive("1"))
+	s.wait("1")
+	st := statuses()
+	assert.Len(t, st, 2)
+	var ts amp.TopicStatus
+	assert.NoError(t, amp.Parse(st[0].Marshal()).Unmarshal(&ts))
+	assert.True(t, ts.Stale)
+	assert.NoError(t, amp.Parse(st[1].Marshal()).Unmarshal(&ts))
+	assert.False(t, ts.Stale)
+}
+
+func TestChunkedFull(t *testing.T) {
+	s := New(nil)
+	c := &testConsumer{}
+	s.Subscribe(c, map[string]int64{"sport": 0})
+	s.inLoopWait(func() {})
+	full := amp.NewPublish("sport", "", 1, amp.Full, map[string]string{"a": "0123456789"})
+	for _, p := range amp.ChunkFull(full, 8) {
+		s.Publish(p)
+	}
+	s.wait("sport")
+	assert.Len(t, c.messages, 3)
+	assert.Equal(t, amp.FullEnd, c.messages[2].UpdateType)
+
+	// new consumer gets cached full in chunks
+	c2 := &testConsumer{}
+	s.Subscribe(c2, map[string]int64{"sport": 0})
+	s.wait("sport")
+	assert.Len(t, c2.messages, 3)
+	a := amp.NewAssembler()
+	var m *amp.Msg
+	for _, p := range c2.messages {
+		m = a.Add(p)
+	}
+	assert.Equal(t, `{"a":"0123456789"}`, string(m.BodyBytes()))
+}
+
+// benchConsumer only counts messages, marshaling is done in the session
+// goroutines (see amp BenchmarkFanOut).
+type benchConsumer struct {
+	wg *sync.WaitGroup
+}
+
+func (c *benchConsumer) Send(m *amp.Msg) {
+	c.wg.Done()
+}
+
+// BenchmarkFanOut publishes messages to 10k subscribers of the topic.
+func BenchmarkFanOut(b *testing.B) {
+	log.Discard()
+	const subscribers = 10000
+	s := New(nil)
+	var wg sync.WaitGroup
+	for i := 0; i < subscribers; i++ {
+		s.Subscribe(&benchConsumer{wg: &wg}, map[string]int64{"sportsbook/m": 0})
+	}
+	s.inLoop(func() {})
+	s.wait("sportsbook/m")
+	body := map[string]interface{}{"id": 123456, "name": "Dinamo - Hajduk", "odds": []float64{1.45, 3.2, 5.75}}
+
+	wg.Add(subscribers)
+	s.Publish(amp.NewPublish("sportsbook", "m", 1, amp.Full, body))
+	wg.Wait()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		wg.Add(subscribers)
+		s.Publish(amp.NewPublish("sportsbook", "m", int64(i+2), amp.Diff, body))
+		wg.Wait()
+	}
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "msg/s")
+}
@@ -0,0 +1,84 @@
+package broker
+
+import (
+	"strings"
+
+	"github.com/minus5/svckit/amp"
+)
+
+// Compaction reduces messages kept in the append topic cache.
+// It gets messages sorted by Ts and returns messages which should be
+// kept in the same order.
+// When compaction is set for the topic cache depth is not used,
+// compaction is responsible for keeping cache bounded.
+type Compaction func(msgs []*amp.Msg) []*amp.Msg
+
+// KeepLatest keeps only the latest message for each path.
+func KeepLatest() Compaction {
+	return KeepLastN(1)
+}
+
+// KeepLastN keeps last n messages for each path.
+func KeepLastN(n int) Compaction {
+	return func(msgs []*amp.Msg) []*amp.Msg {
+		counts := make(map[string]int)
+		keep := make([]bool, len(msgs))
+		for i := len(msgs) - 1; i >= 0; i-- {
+			p := msgs[i].Path()
+			if counts[p] < n {
+				keep[i] = true
+				counts[p]++
+			}
+		}
+		return filterMsgs(msgs, keep)
+	}
+}
+
+// KeepSinceFull keeps for each path last Full message and all messages after it.
+// Paths without Full message are not compacted.
+func KeepSinceFull() Compaction {
+	return func(msgs []*amp.Msg) []*amp.Msg {
+		full := make(map[string]bool)
+		keep := make([]bool, len(msgs))
+		for i := len(msgs) - 1; i >= 0; i-- {
+			p := msgs[i].Path()
+			if full[p] {
+				continue
+			}
+			keep[i] = true
+			if msgs[i].IsFull() {
+				full[p] = true
+			}
+		}
+		return filterMsgs(msgs, keep)
+	}
+}
+
+func filterMsgs(msgs []*amp.Msg, keep []bool) []*amp.Msg {
+	n := msgs[:0]
+	for i, m := range msgs {
+		if keep[i] {
+			n = append(n, m)
+		}
+	}
+	// release references to the removed messages
+	for i := len(n); i < len(msgs); i++ {
+		msgs[i] = nil
+	}
+	return n
+}
+
+// WithCompaction sets compaction strategy for the append topic.
+func WithCompaction(topic string, c Compaction) func(*Broker) {
+	return func(s *Broker) {
+		s.compactions[topic] = c
+	}
+}
+
+// compaction finds compaction for the broker topic key (uri)
+func (s *Broker) compaction(uri string) Compaction {
+	if c, ok := s.compactions[uri]; ok {
+		return c
+	}
+	return s.compactions[strings.SplitN(uri, "/", 2)[0]]
+}
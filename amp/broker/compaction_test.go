@@ -0,0 +1,48 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func compactionMsgs() []*amp.Msg {
+	return []*amp.Msg{
+		{URI: "t/a", Ts: 1, UpdateType: amp.Full},
+		{URI: "t/b", Ts: 2, UpdateType: amp.Append},
+		{URI: "t/a", Ts: 3, UpdateType: amp.Append},
+		{URI: "t/a", Ts: 4, UpdateType: amp.Full},
+		{URI: "t/b", Ts: 5, UpdateType: amp.Append},
+		{URI: "t/a", Ts: 6, UpdateType: amp.Append},
+	}
+}
+
+func tss(msgs []*amp.Msg) []int64 {
+	var ts []int64
+	for _, m := range msgs {
+		ts = append(ts, m.Ts)
+	}
+	return ts
+}
+
+func TestCompaction(t *testing.T) {
+	assert.Equal(t, []int64{5, 6}, tss(KeepLatest()(compactionMsgs())))
+	assert.Equal(t, []int64{2, 4, 5, 6}, tss(KeepLastN(2)(compactionMsgs())))
+	assert.Equal(t, []int64{2, 4, 5, 6}, tss(KeepSinceFull()(compactionMsgs())))
+}
+
+func TestAppendCacheCompaction(t *testing.T) {
+	c := newAppendCache(KeepLatest())
+	c.depth = 2
+	for _, m := range compactionMsgs() {
+		c.Add(m)
+	}
+	assert.Equal(t, []int64{5, 6}, tss(c.Current()))
+
+	b := New(nil, WithCompaction("t", KeepLatest()))
+	assert.NotNil(t, b.compaction("t/a"))
+	assert.NotNil(t, b.compaction("t"))
+	assert.Nil(t, b.compaction("u/a"))
+	b.waitClose()
+}
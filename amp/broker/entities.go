@@ -0,0 +1,217 @@
+package broker
+
+import (
+	"sort"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+)
+
+const defaultEntityWindow = 10 * time.Minute
+
+// Entities enables entity streams for the topics.
+// Each path of the topic is an entity with lifecycle:
+// Full creates (or replaces) entity, Diff updates it and Close ends it.
+// Broker tracks live entities and subscribers of the topic (without path)
+// get snapshot of all live entities (Full and Diffs after it for each entity)
+// followed by updates of any entity.
+// Subscribers which reconnect within EntityWindow get Close of the entities
+// ended while they were away.
+func Entities(topics ...string) func(*Broker) {
+	return func(s *Broker) {
+		if s.entities == nil {
+			s.entities = make(map[string]bool)
+		}
+		for _, t := range topics {
+			s.entities[t] = true
+		}
+	}
+}
+
+// EntityWindow sets how long Close of the ended entity is kept, default
+// is 10 minutes. Subscriber which reconnects with ts older than the
+// expired Close gets the snapshot of live entities, same as the new one.
+func EntityWindow(d time.Duration) func(*Broker) {
+	return func(s *Broker) {
+		if d > 0 {
+			s.entityWindow = d
+		}
+	}
+}
+
+// isEntity returns true if message is lifecycle message of the entity stream
+func (s *Broker) isEntity(m *amp.Msg) bool {
+	if !s.entities[m.Topic()] || m.Path() == "" {
+		return false
+	}
+	switch m.UpdateType {
+	case amp.Full, amp.Diff, amp.Close:
+		return true
+	}
+	return false
+}
+
+// LiveEntities returns uris of the live entities of the entity stream topic.
+func (s *Broker) LiveEntities(topic string) []string {
+	var uris []string
+	s.inLoopWait(func() {
+		t, ok := s.topics[topic]
+		if !ok {
+			return
+		}
+		ret := make(chan []string, 1)
+		t.loopWork <- func() {
+			ec, ok := t.cache.(*entityCache)
+			if !ok {
+				ret <- nil
+				return
+			}
+			ret <- ec.live()
+		}
+		uris = <-ret
+	})
+	return uris
+}
+
+// entityCache keeps Full and Diffs after it for each live entity (uri) of the topic
+type entityCache struct {
+	entities map[string]*fullDiffCache
+	closed   map[string]*amp.Msg // Close by uri, Close is in the high
+	// priority lane so it can overtake older updates
+	closedAt  map[string]time.Time // when Close is added, by uri
+	window    time.Duration        // Close is kept for window
+	expiredTs int64                // max ts of the expired Close
+	lastSweep time.Time
+}
+
+func newEntityCache(window time.Duration) *entityCache {
+	return &entityCache{
+		entities: make(map[string]*fullDiffCache),
+		closed:   make(map[string]*amp.Msg),
+		closedAt: make(map[string]time.Time),
+		window:   window,
+	}
+}
+
+func (c *entityCache) Add(m *amp.Msg) {
+	c.sweep(time.Now())
+	if m.IsTopicClose() {
+		if e, ok := c.entities[m.URI]; ok && e.full.Ts > m.Ts {
+			return
+		}
+		delete(c.entities, m.URI)
+		c.closed[m.URI] = m
+		c.closedAt[m.URI] = time.Now()
+		return
+	}
+	if cm, ok := c.closed[m.URI]; ok {
+		if m.Ts <= cm.Ts {
+			return
+		}
+		c.removeClosed(m.URI)
+	}
+	e, ok := c.entities[m.URI]
+	if !ok {
+		if !m.IsFull() {
+			// update of the entity which is not created
+			return
+		}
+		e = newFullDiffCache()
+		c.entities[m.URI] = e
+	}
+	e.Add(m)
+}
+
+// sweep removes Close messages older than window
+func (c *entityCache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < c.window/10 {
+		return
+	}
+	c.lastSweep = now
+	for uri, at := range c.closedAt {
+		if now.Sub(at) < c.window {
+			continue
+		}
+		if ts := c.closed[uri].Ts; ts > c.expiredTs {
+			c.expiredTs = ts
+		}
+		c.removeClosed(uri)
+	}
+}
+
+func (c *entityCache) removeClosed(uri string) {
+	delete(c.closed, uri)
+	delete(c.closedAt, uri)
+}
+
+// Find returns snapshot of live entities for subscriber without ts,
+// or messages newer than ts (including Close of the ended entities).
+// Subscriber with ts older than expired Close gets snapshot.
+func (c *entityCache) Find(ts int64) []*amp.Msg {
+	if ts == tsNone || ts < c.expiredTs {
+		return c.Current()
+	}
+	var msgs []*amp.Msg
+	for _, uri := range c.live() {
+		e := c.entities[uri]
+		if e.full.Ts > ts {
+			msgs = append(msgs, e.Current()...)
+			continue
+		}
+		msgs = append(msgs, e.diffsAfter(ts)...)
+	}
+	for _, m := range c.closed {
+		if m.Ts > ts {
+			msgs = append(msgs, m)
+		}
+	}
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].Ts < msgs[j].Ts
+	})
+	return msgs
+}
+
+// FindFor every lifecycle message of the live entity is sent to the subscribers.
+func (c *entityCache) FindFor(consumerTs int64, m *amp.Msg) uint8 {
+	if m.IsReplay() && consumerTs >= m.Ts {
+		return sendNothing
+	}
+	if m.IsTopicClose() {
+		if cm, ok := c.closed[m.URI]; ok && cm == m {
+			return sendMsg
+		}
+		return sendNothing
+	}
+	e, ok := c.entities[m.URI]
+	if !ok || (m.IsFull() && e.full != m) || m.Ts < e.full.Ts {
+		// ignored by Add
+		return sendNothing
+	}
+	return sendMsg
+}
+
+// Current returns Full and Diffs of all live entities,
+// entities are ordered by ts of their Full.
+func (c *entityCache) Current() []*amp.Msg {
+	var msgs []*amp.Msg
+	for _, uri := range c.live() {
+		msgs = append(msgs, c.entities[uri].Current()...)
+	}
+	return msgs
+}
+
+// live returns uris of the live entities ordered by ts of their Full
+func (c *entityCache) live() []string {
+	uris := make([]string, 0, len(c.entities))
+	for uri := range c.entities {
+		uris = append(uris, uri)
+	}
+	sort.Slice(uris, func(i, j int) bool {
+		ti, tj := c.entities[uris[i]].full.Ts, c.entities[uris[j]].full.Ts
+		if ti == tj {
+			return uris[i] < uris[j]
+		}
+		return ti < tj
+	})
+	return uris
+}
@@ -0,0 +1,209 @@
+package broker
+
+import (
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/metric"
+)
+
+// OfflineLimits bound offline queue of each uri, zero field is no limit.
+type OfflineLimits struct {
+	MaxMessages int           // oldest messages are dropped over the limit
+	MaxAge      time.Duration // older messages are dropped
+}
+
+// Offline enables offline queue for the topic which paths are user
+// identities (e.g. notify/<user>). Message for the uri without subscribers
+// (of the uri, or of the topic when it gets the message, see Retain and
+// Entities) is queued instead of published. Subscriber of the uri gets queued
+// messages newer than subscription ts before live messages.
+// Queued messages are kept until subscriber acknowledges them by
+// subscribing with ts of the last received message (as clients do on
+// reconnect), so delivered notifications are not repeated.
+func Offline(topic string, l OfflineLimits) func(*Broker) {
+	return func(s *Broker) {
+		if s.offline == nil {
+			s.offline = make(map[string]OfflineLimits)
+			s.queues = make(map[string]*offlineQueue)
+			s.online = make(map[string]int)
+		}
+		s.offline[topic] = l
+	}
+}
+
+// OfflinePresence sets check of the user presence in the cluster.
+// Message for the user (path of the offline topic uri) connected to other
+// instance is not queued, that instance delivers it. Called from the
+// broker loop, should not block. Users directory could be used:
+//
+//	broker.New(current, broker.Offline("notify", limits), broker.OfflinePresence(dir.Online))
+func OfflinePresence(online func(user string) bool) func(*Broker) {
+	return func(s *Broker) {
+		s.presence = online
+	}
+}
+
+// Notifier is notified about messages which require ack (amp.Msg
+// RequiresAck) queued for the offline uri, and about such messages
+// delivered to the subscriber, from the queue or live. Used for push
+// notification fallback (see amp/push). Called from the broker loop,
+// should not block.
+type Notifier interface {
+	Offline(m *amp.Msg)
+	Delivered(m *amp.Msg)
+}
+
+// OfflineNotify sets notifier of the offline queues.
+func OfflineNotify(n Notifier) func(*Broker) {
+	return func(s *Broker) {
+		s.notifier = n
+	}
+}
+
+// offlineQueue is queue of the messages for the uri without subscribers
+type offlineQueue struct {
+	msgs   []*amp.Msg
+	queued []time.Time // enqueue time of each message
+}
+
+// add appends message and drops messages over the limits, returns number of dropped
+func (q *offlineQueue) add(m *amp.Msg, l OfflineLimits, now time.Time) int {
+	q.msgs = append(q.msgs, m)
+	q.queued = append(q.queued, now)
+	n := q.expire(l, now)
+	if l.MaxMessages > 0 && len(q.msgs) > l.MaxMessages {
+		d := len(q.msgs) - l.MaxMessages
+		q.drop(d)
+		n += d
+	}
+	return n
+}
+
+// expire drops messages older than MaxAge
+func (q *offlineQueue) expire(l OfflineLimits, now time.Time) int {
+	if l.MaxAge <= 0 {
+		return 0
+	}
+	n := 0
+	for n < len(q.queued) && now.Sub(q.queued[n]) > l.MaxAge {
+		n++
+	}
+	q.drop(n)
+	return n
+}
+
+// ack drops messages up to ts
+func (q *offlineQueue) ack(ts int64) {
+	n := 0
+	for n < len(q.msgs) && q.msgs[n].Ts <= ts {
+		n++
+	}
+	q.drop(n)
+}
+
+func (q *offlineQueue) drop(n int) {
+	q.msgs = q.msgs[n:]
+	q.queued = q.queued[n:]
+}
+
+// enqueue queues message for the uri without subscribers, returns false if
+// message should be published
+func (s *Broker) enqueue(m *amp.Msg) bool {
+	l, ok := s.offline[m.Topic()]
+	if !ok || m.Path() == "" || m.IsTopicClose() {
+		return false
+	}
+	if s.isOnline(m) {
+		if s.notifier != nil && m.RequiresAck && s.online[m.URI] > 0 {
+			// delivered live, cancels notification queued on other instance
+			s.notifier.Delivered(m)
+		}
+		return false
+	}
+	q, ok := s.queues[m.URI]
+	if !ok {
+		q = &offlineQueue{}
+		s.queues[m.URI] = q
+	}
+	metric.Counter("broker.offline.queued")
+	if n := q.add(m, l, time.Now()); n > 0 {
+		metric.Counter("broker.offline.dropped", n)
+	}
+	if s.notifier != nil && m.RequiresAck {
+		s.notifier.Offline(m)
+	}
+	return true
+}
+
+// isOnline returns true if message has local subscribers of the uri or
+// of the topic which gets the message, or user is connected to other
+// instance
+func (s *Broker) isOnline(m *amp.Msg) bool {
+	if s.online[m.URI] > 0 || (s.toTopic(m) && s.online[m.Topic()] > 0) {
+		return true
+	}
+	return s.presence != nil && s.presence(m.Path())
+}
+
+// subscribeOffline marks uri (or whole topic) online and sends queued messages newer than ts
+func (s *Broker) subscribeOffline(c amp.Subscriber, uri string, ts int64) {
+	l, ok := s.offline[topicOf(uri)]
+	if !ok {
+		return
+	}
+	s.online[uri]++
+	q, ok := s.queues[uri]
+	if !ok {
+		return
+	}
+	q.expire(l, time.Now())
+	q.ack(ts)
+	if len(q.msgs) == 0 {
+		delete(s.queues, uri)
+		return
+	}
+	metric.Counter("broker.offline.delivered", len(q.msgs))
+	for _, m := range q.msgs {
+		c.Send(m)
+		if s.notifier != nil && m.RequiresAck {
+			s.notifier.Delivered(m)
+		}
+	}
+}
+
+// unsubscribeOffline marks uri offline when there is no more subscribers
+func (s *Broker) unsubscribeOffline(uri string) {
+	if _, ok := s.offline[topicOf(uri)]; !ok {
+		return
+	}
+	s.online[uri]--
+	if s.online[uri] <= 0 {
+		delete(s.online, uri)
+	}
+}
+
+// expireOffline drops expired messages from all queues
+func (s *Broker) expireOffline() {
+	now := time.Now()
+	for uri, q := range s.queues {
+		if n := q.expire(s.offline[topicOf(uri)], now); n > 0 {
+			metric.Counter("broker.offline.dropped", n)
+		}
+		if len(q.msgs) == 0 {
+			delete(s.queues, uri)
+		}
+	}
+}
+
+// offlineExpireInterval is interval of checking queues for expired
+// messages, zero if there is no MaxAge limit
+func (s *Broker) offlineExpireInterval() time.Duration {
+	var d time.Duration
+	for _, l := range s.offline {
+		if l.MaxAge > 0 && (d == 0 || l.MaxAge < d) {
+			d = l.MaxAge
+		}
+	}
+	return d
+}
@@ -0,0 +1,131 @@
+package broker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOffline(t *testing.T) {
+	in := make(chan *amp.Msg)
+	b := New(nil, Offline("notify", OfflineLimits{MaxMessages: 2}))
+	b.Consume(in)
+
+	// user u1 is offline, messages are queued
+	in <- amp.NewPublish("notify", "u1", 1, amp.Append, nil)
+	in <- amp.NewPublish("notify", "u1", 2, amp.Append, nil)
+	in <- amp.NewPublish("notify", "u1", 3, amp.Append, nil)
+	in <- amp.NewPublish("notify", "u2", 4, amp.Append, nil)
+	time.Sleep(10 * time.Millisecond)
+	b.inLoopWait(func() {
+		assert.Len(t, b.queues, 2)
+		assert.Len(t, b.queues["notify/u1"].msgs, 2) // oldest dropped over limit
+	})
+
+	// subscriber gets queued messages
+	c := &aliasTestSubscriber{}
+	b.Subscribe(c, map[string]int64{"notify/u1": 0})
+	in <- amp.NewPublish("notify", "u1", 5, amp.Append, nil)
+	time.Sleep(10 * time.Millisecond)
+	assert.Len(t, c.uris(), 3)
+	c.Lock()
+	assert.Equal(t, int64(2), c.msgs[0].Ts)
+	assert.Equal(t, int64(5), c.msgs[2].Ts)
+	c.Unlock()
+
+	// reconnect with ts acknowledges delivered messages
+	b.Unsubscribe(c)
+	in <- amp.NewPublish("notify", "u1", 6, amp.Append, nil)
+	time.Sleep(10 * time.Millisecond)
+	c = &aliasTestSubscriber{}
+	b.Subscribe(c, map[string]int64{"notify/u1": 5})
+	time.Sleep(10 * time.Millisecond)
+	c.Lock()
+	assert.Len(t, c.msgs, 1)
+	assert.Equal(t, int64(6), c.msgs[0].Ts)
+	c.Unlock()
+
+	n, err := b.Purge(context.Background(), "test", func(m *amp.Msg) bool { return m.URI == "notify/u2" })
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	b.inLoopWait(func() {
+		assert.NotContains(t, b.queues, "notify/u2")
+	})
+
+	close(in)
+	b.Wait()
+}
+
+func TestOfflineExpire(t *testing.T) {
+	q := &offlineQueue{}
+	l := OfflineLimits{MaxAge: time.Minute}
+	now := time.Now()
+	q.add(&amp.Msg{Ts: 1}, l, now.Add(-2*time.Minute))
+	assert.Equal(t, 1, q.add(&amp.Msg{Ts: 2}, l, now))
+	assert.Len(t, q.msgs, 1)
+	q.ack(2)
+	assert.Len(t, q.msgs, 0)
+}
+
+type testNotifier struct {
+	offline   []int64
+	delivered []int64
+}
+
+func (n *testNotifier) Offline(m *amp.Msg)   { n.offline = append(n.offline, m.Ts) }
+func (n *testNotifier) Delivered(m *amp.Msg) { n.delivered = append(n.delivered, m.Ts) }
+
+func TestOfflineNotify(t *testing.T) {
+	n := &testNotifier{}
+	b := New(nil, Offline("notify", OfflineLimits{}), OfflineNotify(n))
+	critical := amp.NewPublish("notify", "u1", 1, amp.Append, nil)
+	critical.RequiresAck = true
+	b.Publish(critical)
+	b.Publish(amp.NewPublish("notify", "u1", 2, amp.Append, nil))
+	time.Sleep(10 * time.Millisecond)
+
+	b.Subscribe(&aliasTestSubscriber{}, map[string]int64{"notify/u1": 0})
+	b.inLoopWait(func() {
+		assert.Equal(t, []int64{1}, n.offline)
+		assert.Equal(t, []int64{1}, n.delivered)
+	})
+
+	// delivered live
+	critical = amp.NewPublish("notify", "u1", 3, amp.Append, nil)
+	critical.RequiresAck = true
+	b.Publish(critical)
+	time.Sleep(10 * time.Millisecond)
+	b.inLoopWait(func() {
+		assert.Equal(t, []int64{1, 3}, n.delivered)
+	})
+}
+
+func TestOfflinePresence(t *testing.T) {
+	online := map[string]bool{"u2": true}
+	b := New(nil, Offline("notify", OfflineLimits{}), Retain("notify"),
+		OfflinePresence(func(user string) bool { return online[user] }))
+
+	// user connected to other instance
+	b.Publish(amp.NewPublish("notify", "u1", 1, amp.Append, nil))
+	b.Publish(amp.NewPublish("notify", "u2", 2, amp.Append, nil))
+	time.Sleep(10 * time.Millisecond)
+	b.inLoopWait(func() {
+		assert.Len(t, b.queues, 1)
+		assert.NotNil(t, b.queues["notify/u1"])
+	})
+
+	// retained message is delivered to the topic subscriber, not queued
+	c := &aliasTestSubscriber{}
+	b.Subscribe(c, map[string]int64{"notify": 0})
+	b.Publish(amp.NewPublish("notify", "u3", 3, amp.Update, nil))
+	b.Publish(amp.NewPublish("notify", "u4", 4, amp.Append, nil))
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, []string{"notify/u3"}, c.uris())
+	b.inLoopWait(func() {
+		assert.Nil(t, b.queues["notify/u3"])
+		assert.NotNil(t, b.queues["notify/u4"])
+	})
+}
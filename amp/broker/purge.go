@@ -0,0 +1,182 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+	"github.com/pkg/errors"
+)
+
+// purgesKey is prefix of the purge audit records, each record is stored
+// in its own object (same as archive purges)
+const purgesKey = "purges/"
+
+// auditStore stores purge audit records, archive.Store implements it
+type auditStore interface {
+	Put(ctx context.Context, key string, body []byte) error
+}
+
+// PurgeRecord is audit log entry of the purge.
+type PurgeRecord struct {
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"`
+	Msgs   int       `json:"msgs"` // number of removed messages
+}
+
+// PurgeAudit sets store of the purge audit log. Each purge is stored as
+// object prefix/purges/<time>.json, without it purge is only logged.
+func PurgeAudit(store auditStore, prefix string) func(*Broker) {
+	return func(s *Broker) {
+		if store == nil {
+			return
+		}
+		s.auditStore = store
+		s.auditPrefix = prefix
+	}
+}
+
+// Purge removes cached messages for which match returns true from all
+// topics (e.g. messages of the user who requested data erasure).
+// Removing Full, or any Diff after it, removes whole topic state, new
+// subscribers get the topic again with the next Full.
+// Purge is written to the audit log (see PurgeAudit) with reason and
+// number of removed messages, which is returned.
+func (s *Broker) Purge(ctx context.Context, reason string, match func(*amp.Msg) bool) (int, error) {
+	n := s.purge(match)
+	return n, s.audit(ctx, PurgeRecord{Time: time.Now(), Reason: reason, Msgs: n})
+}
+
+// purge removes matching messages from topics and offline queues
+func (s *Broker) purge(match func(*amp.Msg) bool) int {
+	n := 0
+	s.inLoopWait(func() {
+		for _, t := range s.topics {
+			n += t.purge(match)
+		}
+		for uri, q := range s.queues {
+			n += q.purge(match)
+			if len(q.msgs) == 0 {
+				delete(s.queues, uri)
+			}
+		}
+	})
+	return n
+}
+
+// audit records purge in the audit log.
+// Key is ordered by purge time, existing records are never rewritten.
+func (s *Broker) audit(ctx context.Context, p PurgeRecord) error {
+	metric.Counter("broker.purged", p.Msgs)
+	log.S("reason", p.Reason).I("msgs", p.Msgs).Info("purge")
+	if s.auditStore == nil {
+		return nil
+	}
+	buf, err := json.Marshal(p)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	key := purgesKey + p.Time.UTC().Format("2006/01/02/150405") + "-" + strconv.FormatInt(p.Time.UnixNano(), 10) + ".json"
+	if s.auditPrefix != "" {
+		key = s.auditPrefix + "/" + key
+	}
+	return s.auditStore.Put(ctx, key, buf)
+}
+
+// purge removes matching messages from the offline queue
+func (q *offlineQueue) purge(match func(*amp.Msg) bool) int {
+	msgs := q.msgs[:0]
+	queued := q.queued[:0]
+	for i, m := range q.msgs {
+		if !match(m) {
+			msgs = append(msgs, m)
+			queued = append(queued, q.queued[i])
+		}
+	}
+	n := len(q.msgs) - len(msgs)
+	q.msgs, q.queued = msgs, queued
+	return n
+}
+
+// purge removes matching messages from the topic cache
+func (t *topic) purge(match func(*amp.Msg) bool) int {
+	ret := make(chan int, 1)
+	t.loopWork <- func() {
+		if t.cache == nil {
+			ret <- 0
+			return
+		}
+		ret <- t.cache.purge(match)
+	}
+	return <-ret
+}
+
+func (c *appendCache) purge(match func(*amp.Msg) bool) int {
+	keep := make([]bool, len(c.msgs))
+	n := 0
+	for i, m := range c.msgs {
+		keep[i] = !match(m)
+		if !keep[i] {
+			n++
+		}
+	}
+	if n > 0 {
+		c.msgs = filterMsgs(c.msgs, keep)
+	}
+	return n
+}
+
+// purge removes full and all diffs if any of them matches, diffs are
+// merged into state in order, state without some of them is corrupt
+func (t *fullDiffCache) purge(match func(*amp.Msg) bool) int {
+	matched := t.full != nil && match(t.full)
+	for _, m := range t.diffs {
+		if matched {
+			break
+		}
+		matched = match(m)
+	}
+	if !matched {
+		return 0
+	}
+	n := len(t.diffs)
+	if t.full != nil {
+		n++
+	}
+	t.full = nil
+	t.diffs = make([]*amp.Msg, 0)
+	t.current = nil
+	return n
+}
+
+func (c *retainedCache) purge(match func(*amp.Msg) bool) int {
+	n := 0
+	for uri, m := range c.msgs {
+		if match(m) {
+			c.clear(uri)
+			n++
+		}
+	}
+	return n
+}
+
+func (c *entityCache) purge(match func(*amp.Msg) bool) int {
+	n := 0
+	for uri, e := range c.entities {
+		n += e.purge(match)
+		if e.full == nil {
+			delete(c.entities, uri)
+		}
+	}
+	for uri, m := range c.closed {
+		if match(m) {
+			c.removeClosed(uri)
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,95 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPurge(t *testing.T) {
+	in := make(chan *amp.Msg)
+	store := &auditTestStore{objects: make(map[string][]byte)}
+	b := New(nil, Retain("scores"), Entities("events"), PurgeAudit(store, "gw"))
+	b.Consume(in)
+
+	in <- amp.NewPublish("chat", "u1", 1, amp.Append, nil)
+	in <- amp.NewPublish("chat", "u2", 2, amp.Append, nil)
+	in <- amp.NewPublish("chat", "u1", 3, amp.Append, nil)
+	in <- amp.NewPublish("scores", "u1", 4, amp.Update, nil)
+	in <- amp.NewPublish("scores", "u2", 5, amp.Update, nil)
+	in <- amp.NewPublish("events", "u1", 6, amp.Full, nil)
+	in <- amp.NewPublish("events", "u2", 7, amp.Full, nil)
+	in <- amp.NewPublish("odds", "", 8, amp.Full, nil)
+	in <- amp.NewPublish("odds", "", 9, amp.Diff, nil)
+	in <- amp.NewPublish("odds", "", 10, amp.Diff, nil)
+	time.Sleep(10 * time.Millisecond)
+
+	ctx := context.Background()
+	n, err := b.Purge(ctx, "test", func(m *amp.Msg) bool { return m.Path() == "u1" || m.Ts == 9 })
+	assert.NoError(t, err)
+	assert.Equal(t, 9, n) // retained and entity messages are also in their uri topics
+
+	var uris []string
+	for _, topic := range []string{"chat/u1", "chat/u2", "scores", "events", "odds"} {
+		for _, m := range b.Replay(topic) {
+			uris = append(uris, m.URI)
+		}
+	}
+	sort.Strings(uris)
+	// matching diff removes whole topic state, later diffs can't be
+	// merged without it
+	assert.Equal(t, []string{"chat/u2", "events/u2", "scores/u2"}, uris)
+	assert.Len(t, b.Replay("odds"), 0)
+
+	// purged full removes topic until the next full
+	in <- amp.NewPublish("odds", "", 11, amp.Full, nil)
+	in <- amp.NewPublish("odds", "", 12, amp.Diff, nil)
+	time.Sleep(10 * time.Millisecond)
+	n, err = b.Purge(ctx, "test", func(m *amp.Msg) bool { return m.Ts == 11 })
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Len(t, b.Replay("odds"), 0)
+
+	// each purge is stored in its own audit record
+	keys := store.keys()
+	assert.Len(t, keys, 2)
+	for _, k := range keys {
+		assert.True(t, strings.HasPrefix(k, "gw/purges/"), k)
+		var p PurgeRecord
+		assert.NoError(t, json.Unmarshal(store.objects[k], &p))
+		assert.Equal(t, "test", p.Reason)
+	}
+
+	close(in)
+	b.Wait()
+}
+
+type auditTestStore struct {
+	objects map[string][]byte
+	sync.Mutex
+}
+
+func (s *auditTestStore) Put(ctx context.Context, key string, body []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	s.objects[key] = body
+	return nil
+}
+
+func (s *auditTestStore) keys() []string {
+	s.Lock()
+	defer s.Unlock()
+	var keys []string
+	for k := range s.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -7,10 +7,10 @@ type ReplayBroker struct {
 	broker   *Broker
 }
 
-func NewWithReplay() *ReplayBroker {
+func NewWithReplay(opts ...func(*Broker)) *ReplayBroker {
 	return &ReplayBroker{
 		messages: make(chan *amp.Msg),
-		broker:   New(nil),
+		broker:   New(nil, opts...),
 	}
 }
 
@@ -0,0 +1,109 @@
+package broker
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/minus5/svckit/amp"
+)
+
+// Retain enables retained messages (MQTT-style) for the topics.
+// Broker keeps latest Update message for each path of the topic and
+// subscribers of the topic (without path) get full retained set on
+// subscribe, followed by all updates of any path.
+// Close message on the path clears retained message of that path.
+func Retain(topics ...string) func(*Broker) {
+	return func(s *Broker) {
+		if s.retain == nil {
+			s.retain = make(map[string]bool)
+		}
+		for _, t := range topics {
+			s.retain[t] = true
+		}
+	}
+}
+
+// ClearRetained removes retained message for the uri (topic/path).
+func (s *Broker) ClearRetained(uri string) {
+	topic := strings.SplitN(uri, "/", 2)[0]
+	s.inLoop(func() {
+		t, ok := s.topics[topic]
+		if !ok {
+			return
+		}
+		t.loopWork <- func() {
+			if rc, ok := t.cache.(*retainedCache); ok {
+				rc.clear(uri)
+			}
+		}
+	})
+}
+
+// retainedCache keeps latest message for each uri of the topic
+type retainedCache struct {
+	msgs   map[string]*amp.Msg
+	closed map[string]int64 // ts of the Close by uri, Close is in the high
+	// priority lane so it can overtake older updates
+}
+
+func newRetainedCache() *retainedCache {
+	return &retainedCache{
+		msgs:   make(map[string]*amp.Msg),
+		closed: make(map[string]int64),
+	}
+}
+
+func (c *retainedCache) Add(m *amp.Msg) {
+	if m.IsTopicClose() {
+		if o, ok := c.msgs[m.URI]; !ok || o.Ts <= m.Ts {
+			c.clear(m.URI)
+			c.closed[m.URI] = m.Ts
+		}
+		return
+	}
+	if ts, ok := c.closed[m.URI]; ok {
+		if m.Ts <= ts {
+			return
+		}
+		delete(c.closed, m.URI)
+	}
+	if o, ok := c.msgs[m.URI]; ok && o.Ts > m.Ts {
+		return
+	}
+	c.msgs[m.URI] = m
+}
+
+func (c *retainedCache) clear(uri string) {
+	delete(c.msgs, uri)
+}
+
+// Find returns retained messages newer than ts.
+func (c *retainedCache) Find(ts int64) []*amp.Msg {
+	var msgs []*amp.Msg
+	for _, m := range c.Current() {
+		if m.Ts > ts {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs
+}
+
+// FindFor every update is sent to the subscribers.
+func (c *retainedCache) FindFor(consumerTs int64, m *amp.Msg) uint8 {
+	return sendMsg
+}
+
+// Current returns all retained messages sorted by ts.
+func (c *retainedCache) Current() []*amp.Msg {
+	msgs := make([]*amp.Msg, 0, len(c.msgs))
+	for _, m := range c.msgs {
+		msgs = append(msgs, m)
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		if msgs[i].Ts == msgs[j].Ts {
+			return msgs[i].URI < msgs[j].URI
+		}
+		return msgs[i].Ts < msgs[j].Ts
+	})
+	return msgs
+}
@@ -0,0 +1,56 @@
+package broker
+
+import (
+	"time"
+
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+)
+
+// ReplayRetention bounds replay state of the broker: cached state of the
+// uri (topic/path) which is not updated for maxAge and has no subscribers
+// is removed, same as when producer closes it. Applies to the topics, all
+// topics if not specified. Long running broker then keeps only state of
+// the live uris. Sends metric broker.evicted.
+func ReplayRetention(maxAge time.Duration, topics ...string) func(*Broker) {
+	return func(s *Broker) {
+		if maxAge <= 0 {
+			return
+		}
+		s.replayMaxAge = maxAge
+		s.replayTopics = make(map[string]bool)
+		for _, t := range topics {
+			s.replayTopics[t] = true
+		}
+	}
+}
+
+// evictIdle removes topics out of the replay retention.
+// Should be called from the broker loop.
+func (s *Broker) evictIdle(now time.Time) {
+	n := 0
+	for name, t := range s.topics {
+		if len(s.replayTopics) > 0 && !s.replayTopics[topicOf(name)] {
+			continue
+		}
+		if !t.idle(now, s.replayMaxAge) {
+			continue
+		}
+		delete(s.topics, name)
+		t.close()
+		n++
+	}
+	if n > 0 {
+		metric.Counter("broker.evicted", n)
+		log.I("topics", n).Debug("idle topics evicted")
+	}
+}
+
+// idle returns true if topic has no consumers and is not updated for maxAge
+func (t *topic) idle(now time.Time, maxAge time.Duration) bool {
+	ret := make(chan bool, 1)
+	t.loopWork <- func() {
+		ret <- len(t.consumers) == 0 && len(t.messages) == 0 && now.Sub(t.updatedAt) > maxAge
+	}
+	return <-ret
+}
@@ -0,0 +1,35 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayRetention(t *testing.T) {
+	in := make(chan *amp.Msg)
+	b := New(nil, ReplayRetention(time.Hour, "odds"))
+	b.Consume(in)
+	in <- amp.NewPublish("odds", "m1", 1, amp.Full, nil)
+	in <- amp.NewPublish("odds", "m2", 2, amp.Full, nil)
+	in <- amp.NewPublish("events", "e1", 3, amp.Full, nil)
+	c := &aliasTestSubscriber{}
+	b.Subscribe(c, map[string]int64{"odds/m2": 0})
+	time.Sleep(10 * time.Millisecond)
+
+	b.inLoopWait(func() {
+		b.evictIdle(time.Now())
+		assert.Len(t, b.topics, 3)
+		// m1 is idle, m2 has subscriber, events are not retained
+		b.evictIdle(time.Now().Add(2 * time.Hour))
+		_, ok := b.topics["odds/m1"]
+		assert.False(t, ok)
+		assert.Len(t, b.topics, 2)
+	})
+	assert.Len(t, b.Replay("odds/m1"), 0)
+	assert.Len(t, b.Replay("odds/m2"), 1)
+	close(in)
+	b.Wait()
+}
@@ -0,0 +1,221 @@
+package broker
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+type aliasTestSubscriber struct {
+	msgs []*amp.Msg
+	sync.Mutex
+}
+
+func (s *aliasTestSubscriber) Send(m *amp.Msg) {
+	s.Lock()
+	defer s.Unlock()
+	s.msgs = append(s.msgs, m)
+}
+
+func (s *aliasTestSubscriber) uris() []string {
+	s.Lock()
+	defer s.Unlock()
+	var uris []string
+	for _, m := range s.msgs {
+		uris = append(uris, m.URI)
+	}
+	return uris
+}
+
+func TestAlias(t *testing.T) {
+	in := make(chan *amp.Msg)
+	b := New(nil, Alias("math.v1", "calc.v1", time.Time{}), Alias("old", "new", time.Now().Add(-time.Second)))
+	b.Consume(in)
+
+	c := &aliasTestSubscriber{}
+	b.Subscribe(c, map[string]int64{"math.v1/i": 0, "chat": 0, "old": 0})
+	in <- amp.NewPublish("calc.v1", "i", 1, amp.Full, nil)
+	in <- amp.NewPublish("chat", "", 1, amp.Full, nil)
+	in <- amp.NewPublish("new", "", 1, amp.Full, nil) // deprecation window is over
+	time.Sleep(10 * time.Millisecond)
+	assert.ElementsMatch(t, []string{"math.v1/i", "chat"}, c.uris())
+
+	b.Unsubscribe(c)
+	in <- amp.NewPublish("calc.v1", "i", 2, amp.Diff, nil)
+	time.Sleep(10 * time.Millisecond)
+	assert.Len(t, c.uris(), 2)
+	assert.Len(t, b.aliasSubs, 0)
+
+	close(in)
+	b.Wait()
+}
+
+func TestRetain(t *testing.T) {
+	in := make(chan *amp.Msg)
+	b := New(nil, Retain("scores"))
+	b.Consume(in)
+
+	in <- amp.NewPublish("scores", "m1", 1, amp.Update, nil)
+	in <- amp.NewPublish("scores", "m2", 2, amp.Update, nil)
+	in <- amp.NewPublish("scores", "m1", 3, amp.Update, nil)
+	in <- amp.NewPublish("scores", "m3", 4, amp.Update, nil)
+	in <- amp.NewPublish("scores", "m3", 5, amp.Close, nil)
+	time.Sleep(10 * time.Millisecond)
+
+	c := &aliasTestSubscriber{}
+	b.Subscribe(c, map[string]int64{"scores": 0})
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, []string{"scores/m2", "scores/m1"}, c.uris())
+
+	in <- amp.NewPublish("scores", "m4", 6, amp.Update, nil)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, "scores/m4", c.uris()[2])
+
+	b.ClearRetained("scores/m1")
+	time.Sleep(10 * time.Millisecond)
+	c2 := &aliasTestSubscriber{}
+	b.Subscribe(c2, map[string]int64{"scores": 0})
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, []string{"scores/m2", "scores/m4"}, c2.uris())
+
+	close(in)
+	b.Wait()
+}
+
+func TestEntities(t *testing.T) {
+	in := make(chan *amp.Msg)
+	b := New(nil, Entities("events"))
+	b.Consume(in)
+
+	in <- amp.NewPublish("events", "e1", 1, amp.Full, nil)
+	in <- amp.NewPublish("events", "e2", 2, amp.Full, nil)
+	in <- amp.NewPublish("events", "e1", 3, amp.Diff, nil)
+	in <- amp.NewPublish("events", "e3", 4, amp.Diff, nil) // not created
+	in <- amp.NewPublish("events", "e2", 5, amp.Close, nil)
+	in <- amp.NewPublish("events", "e4", 6, amp.Full, nil)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, []string{"events/e1", "events/e4"}, b.LiveEntities("events"))
+
+	c := &aliasTestSubscriber{}
+	b.Subscribe(c, map[string]int64{"events": 0})
+	time.Sleep(10 * time.Millisecond)
+	var ts []int64
+	c.Lock()
+	for _, m := range c.msgs {
+		ts = append(ts, m.Ts)
+	}
+	assert.Equal(t, amp.BurstStart, c.msgs[0].UpdateType)
+	c.Unlock()
+	// snapshot in burst: e1 full and diff, e4 full
+	assert.Equal(t, []int64{1, 1, 3, 6, 6}, ts)
+
+	in <- amp.NewPublish("events", "e3", 7, amp.Diff, nil)
+	in <- amp.NewPublish("events", "e4", 8, amp.Diff, nil)
+	in <- amp.NewPublish("events", "e1", 9, amp.Close, nil)
+	time.Sleep(10 * time.Millisecond)
+	// Close is in the high priority lane
+	assert.ElementsMatch(t, []string{"events/e4", "events/e1"}, c.uris()[5:])
+	assert.Equal(t, []string{"events/e4"}, b.LiveEntities("events"))
+
+	// reconnect with ts gets changes after it
+	c2 := &aliasTestSubscriber{}
+	b.Subscribe(c2, map[string]int64{"events": 6})
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, []string{"events/e4", "events/e1"}, c2.uris())
+
+	close(in)
+	b.Wait()
+}
+
+func TestTx(t *testing.T) {
+	in := make(chan *amp.Msg)
+	b := New(nil, Transactions(20*time.Millisecond))
+	b.Consume(in)
+	c := &aliasTestSubscriber{}
+	b.Subscribe(c, map[string]int64{"accounts": 0, "ledger": 0})
+
+	tx := amp.NewTx()
+	tx.Add(amp.NewPublish("accounts", "", 1, amp.Full, nil))
+	tx.Add(amp.NewPublish("ledger", "", 1, amp.Full, nil))
+	var msgs []*amp.Msg
+	tx.Commit(func(m *amp.Msg) { msgs = append(msgs, m) })
+	assert.Len(t, msgs, 3)
+	assert.True(t, msgs[2].IsTxCommit())
+	assert.Equal(t, 2, msgs[2].TxCount())
+	assert.Equal(t, map[string]int{"accounts": 1, "ledger": 1}, msgs[2].TxCounts())
+
+	// commit marker before all prepared messages
+	in <- msgs[0]
+	in <- msgs[2]
+	time.Sleep(10 * time.Millisecond)
+	assert.Len(t, c.uris(), 0)
+	in <- msgs[1]
+	time.Sleep(10 * time.Millisecond)
+	assert.ElementsMatch(t, []string{"accounts", "ledger"}, c.uris())
+
+	// without commit prepared messages are dropped
+	m := amp.NewPublish("accounts", "", 2, amp.Full, nil)
+	amp.NewTx().Add(m)
+	in <- m
+	time.Sleep(30 * time.Millisecond)
+	in <- amp.NewPublish("ledger", "", 3, amp.Diff, nil)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, []string{"ledger"}, c.uris()[2:])
+	b.inLoopWait(func() { b.txs.expire() })
+	assert.Len(t, b.txs.pending, 0)
+
+	close(in)
+	b.Wait()
+}
+
+func TestTxConsumedTopics(t *testing.T) {
+	in := make(chan *amp.Msg)
+	b := New(nil, Transactions(time.Minute, "accounts"))
+	b.Consume(in)
+	c := &aliasTestSubscriber{}
+	b.Subscribe(c, map[string]int64{"accounts": 0, "accounts/1": 0})
+
+	tx := amp.NewTx()
+	tx.Add(amp.NewPublish("accounts", "", 1, amp.Full, nil))
+	tx.Add(amp.NewPublish("accounts", "1", 1, amp.Full, nil))
+	tx.Add(amp.NewPublish("ledger", "", 1, amp.Full, nil))
+	var msgs []*amp.Msg
+	tx.Commit(func(m *amp.Msg) { msgs = append(msgs, m) })
+
+	// ledger is not consumed, transaction is complete without it
+	in <- msgs[0]
+	in <- msgs[1]
+	in <- msgs[3]
+	time.Sleep(10 * time.Millisecond)
+	assert.ElementsMatch(t, []string{"accounts", "accounts/1"}, c.uris())
+	b.inLoopWait(func() {})
+	assert.Len(t, b.txs.pending, 0)
+
+	close(in)
+	b.Wait()
+}
+
+func TestEntityWindow(t *testing.T) {
+	c := newEntityCache(time.Minute)
+	c.Add(amp.NewPublish("events", "e1", 1, amp.Full, nil))
+	c.Add(amp.NewPublish("events", "e2", 2, amp.Full, nil))
+	c.Add(amp.NewPublish("events", "e1", 3, amp.Close, nil))
+	assert.Len(t, c.Find(2), 1)
+	assert.Equal(t, amp.Close, c.Find(2)[0].UpdateType)
+
+	// older update after Close is ignored while Close is kept
+	c.Add(amp.NewPublish("events", "e1", 2, amp.Diff, nil))
+	assert.Len(t, c.closed, 1)
+
+	// Close expires after window, subscriber behind it gets snapshot
+	c.sweep(time.Now().Add(time.Minute))
+	assert.Len(t, c.closed, 0)
+	assert.Len(t, c.closedAt, 0)
+	msgs := c.Find(2)
+	assert.Len(t, msgs, 1)
+	assert.Equal(t, "events/e2", msgs[0].URI)
+	assert.Len(t, c.Find(3), 0)
+}
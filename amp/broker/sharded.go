@@ -0,0 +1,166 @@
+package broker
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+)
+
+// Sharded splits topics by hash of the topic name into n shards, each shard
+// is Broker with its own loop. Single broker loop routes all messages, with
+// thousands of busy topics on many cores that loop becomes the bottleneck.
+//
+// Topic and all its paths are in the same shard so ordering per topic,
+// retained messages and entity streams work as in the Broker.
+// Transactions are held in the Sharded and applied to the shards after
+// commit, each shard applies its messages of the transaction at once.
+type Sharded struct {
+	shards []*Broker
+	txs    *txs // prepared transactions, nil if not enabled
+	txLock sync.Mutex
+}
+
+// NewSharded creates broker with n shards. Options are applied to each shard.
+func NewSharded(n int, current func(string), opts ...func(*Broker)) *Sharded {
+	if n < 1 {
+		n = 1
+	}
+	s := &Sharded{}
+	for i := 0; i < n; i++ {
+		b := New(current, opts...)
+		// transactions span shards, they are held here
+		s.txs, b.txs = b.txs, nil
+		s.shards = append(s.shards, b)
+	}
+	return s
+}
+
+// shard returns shard of the topic or uri (topic/path)
+func (s *Sharded) shard(uri string) *Broker {
+	return s.shards[shardIndex(topicOf(uri), len(s.shards))]
+}
+
+// shardIndex fnv-1a hash of the key modulo n
+func shardIndex(key string, n int) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % uint32(n))
+}
+
+func topicOf(uri string) string {
+	if i := strings.IndexByte(uri, '/'); i >= 0 {
+		return uri[:i]
+	}
+	return uri
+}
+
+// resolved returns uri after aliasing, aliases are the same in all shards
+func (s *Sharded) resolved(uri string) string {
+	if n, _, ok := s.shards[0].resolve(uri); ok {
+		return n
+	}
+	return uri
+}
+
+// Consume consumes all msgs from in channel.
+func (s *Sharded) Consume(in <-chan *amp.Msg) {
+	go func() {
+		defer func() {
+			for _, b := range s.shards {
+				b.signalClose()
+			}
+		}()
+		for m := range in {
+			s.Publish(m)
+		}
+	}()
+}
+
+// Publish routes message to the shard of its topic.
+func (s *Sharded) Publish(m *amp.Msg) {
+	if s.txs != nil {
+		s.txLock.Lock()
+		msgs, ok := s.txs.hold(m)
+		s.txLock.Unlock()
+		if ok {
+			for _, m := range msgs {
+				s.shard(m.Topic()).Publish(m)
+			}
+			return
+		}
+	}
+	s.shard(m.Topic()).Publish(m)
+}
+
+// Subscribe consumer to topics, see Broker.Subscribe.
+func (s *Sharded) Subscribe(c amp.Subscriber, newTopics map[string]int64) {
+	parts := make([]map[string]int64, len(s.shards))
+	for i := range parts {
+		parts[i] = make(map[string]int64)
+	}
+	for uri, ts := range newTopics {
+		parts[shardIndex(topicOf(s.resolved(uri)), len(s.shards))][uri] = ts
+	}
+	// every shard gets its part, also empty, to unsubscribe removed topics
+	for i, b := range s.shards {
+		b.Subscribe(c, parts[i])
+	}
+}
+
+// Unsubscribe from all topics.
+func (s *Sharded) Unsubscribe(c amp.Subscriber) {
+	for _, b := range s.shards {
+		b.Unsubscribe(c)
+	}
+}
+
+// Backfill serves backfill request, see Broker.Backfill.
+func (s *Sharded) Backfill(c amp.Subscriber, m *amp.Msg) {
+	s.shard(s.resolved(m.Topic())).Backfill(c, m)
+}
+
+// Replay collects all current messages of the topic,
+// or of all topics if topic is empty or "*".
+func (s *Sharded) Replay(topic string) []*amp.Msg {
+	if topic != "" && topic != "*" {
+		return s.shard(topic).Replay(topic)
+	}
+	var msgs []*amp.Msg
+	for _, b := range s.shards {
+		msgs = append(msgs, b.Replay(topic)...)
+	}
+	return msgs
+}
+
+// LiveEntities returns uris of the live entities of the entity stream topic.
+func (s *Sharded) LiveEntities(topic string) []string {
+	return s.shard(topic).LiveEntities(topic)
+}
+
+// ClearRetained removes retained message for the uri (topic/path).
+func (s *Sharded) ClearRetained(uri string) {
+	s.shard(uri).ClearRetained(uri)
+}
+
+// Purge removes matching cached messages from all shards, see Broker.Purge.
+// Purge is audited once, shards share audit store.
+func (s *Sharded) Purge(ctx context.Context, reason string, match func(*amp.Msg) bool) (int, error) {
+	n := 0
+	for _, b := range s.shards {
+		n += b.purge(match)
+	}
+	return n, s.shards[0].audit(ctx, PurgeRecord{Time: time.Now(), Reason: reason, Msgs: n})
+}
+
+// Wait blocks until all shards are finished.
+func (s *Sharded) Wait() {
+	for _, b := range s.shards {
+		b.Wait()
+	}
+}
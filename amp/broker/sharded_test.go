@@ -0,0 +1,115 @@
+package broker
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSharded(t *testing.T) {
+	in := make(chan *amp.Msg)
+	b := NewSharded(4, nil, Transactions(time.Second), Alias("math.v1", "calc.v1", time.Time{}))
+	b.Consume(in)
+	assert.Nil(t, b.shards[0].txs)
+
+	c := &aliasTestSubscriber{}
+	b.Subscribe(c, map[string]int64{"a": 0, "b": 0, "c/1": 0, "math.v1/i": 0})
+	// topic and its paths are in the same shard
+	assert.Equal(t, b.shard("c"), b.shard("c/1"))
+
+	in <- amp.NewPublish("a", "", 1, amp.Full, nil)
+	in <- amp.NewPublish("b", "", 1, amp.Full, nil)
+	in <- amp.NewPublish("c", "1", 1, amp.Full, nil)
+	in <- amp.NewPublish("calc.v1", "i", 1, amp.Full, nil)
+	time.Sleep(10 * time.Millisecond)
+	assert.ElementsMatch(t, []string{"a", "b", "c/1", "math.v1/i"}, c.uris())
+	assert.Len(t, b.Replay(""), 4)
+	assert.Len(t, b.Replay("c/1"), 1)
+
+	// transaction across shards
+	tx := amp.NewTx()
+	tx.Add(amp.NewPublish("a", "", 2, amp.Diff, nil))
+	tx.Add(amp.NewPublish("b", "", 2, amp.Diff, nil))
+	var msgs []*amp.Msg
+	tx.Commit(func(m *amp.Msg) { msgs = append(msgs, m) })
+	in <- msgs[0]
+	time.Sleep(10 * time.Millisecond)
+	assert.Len(t, c.uris(), 4)
+	in <- msgs[1]
+	in <- msgs[2]
+	time.Sleep(10 * time.Millisecond)
+	assert.ElementsMatch(t, []string{"a", "b"}, c.uris()[4:])
+
+	// resubscribe removes topics from all shards
+	b.Subscribe(c, map[string]int64{"a": 2})
+	in <- amp.NewPublish("a", "", 3, amp.Diff, nil)
+	in <- amp.NewPublish("b", "", 3, amp.Diff, nil)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, []string{"a"}, c.uris()[6:])
+
+	b.Unsubscribe(c)
+	close(in)
+	b.Wait()
+}
+
+// countingConsumer counts messages until done
+type countingConsumer struct {
+	wg *sync.WaitGroup
+}
+
+func (c *countingConsumer) Send(m *amp.Msg) {
+	c.wg.Done()
+}
+
+type publisher interface {
+	Subscribe(amp.Subscriber, map[string]int64)
+	Publish(*amp.Msg)
+}
+
+// benchmarkTopics publishes from parallel producers to 1000 topics
+// with one subscriber each.
+func benchmarkTopics(b *testing.B, p publisher) {
+	const topics = 1000
+	var wg sync.WaitGroup
+	for i := 0; i < topics; i++ {
+		p.Subscribe(&countingConsumer{wg: &wg}, map[string]int64{fmt.Sprintf("t%d", i): 0})
+	}
+	wg.Add(topics)
+	for i := 0; i < topics; i++ {
+		p.Publish(amp.NewPublish(fmt.Sprintf("t%d", i), "", 1, amp.Full, nil))
+	}
+	wg.Wait()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	wg.Add(b.N)
+	var no int64
+	var lock sync.Mutex
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			lock.Lock()
+			no++
+			ts := no + 1
+			lock.Unlock()
+			p.Publish(amp.NewPublish(fmt.Sprintf("t%d", ts%topics), "", ts, amp.Diff, nil))
+		}
+	})
+	wg.Wait()
+}
+
+// BenchmarkTopics compares single broker loop with the sharded broker,
+// difference is visible with GOMAXPROCS > 1.
+func BenchmarkTopics(b *testing.B) {
+	log.Discard()
+	b.Run("single", func(b *testing.B) {
+		benchmarkTopics(b, New(nil))
+	})
+	b.Run("sharded", func(b *testing.B) {
+		benchmarkTopics(b, NewSharded(8, nil))
+	})
+}
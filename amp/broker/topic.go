@@ -22,23 +22,34 @@ type cache interface {
 	Find(ts int64) []*amp.Msg
 	FindFor(consumerTs int64, m *amp.Msg) uint8
 	Current() []*amp.Msg
+	purge(match func(*amp.Msg) bool) int
 }
 
 type topic struct {
-	messages  chan *amp.Msg
-	loopWork  chan func()
-	consumers map[amp.Subscriber]int64
-	closed    chan struct{}
-	cache     cache
-	updatedAt time.Time
+	name       string
+	messages   chan *amp.Msg
+	loopWork   chan func()
+	consumers  map[amp.Subscriber]int64
+	closed     chan struct{}
+	cache      cache
+	compaction Compaction
+	updatedAt  time.Time
+	lastAlive  time.Time // time of the last producer heartbeat, zero if producer don't send them
+	stale      bool      // heartbeat is missing
+	assembler  *amp.Assembler
+	chunkSize  int                     // size of the chunks of the last chunked full
+	chunked    map[amp.Subscriber]bool // consumers receiving current chunked full
 }
 
-func newTopic() *topic {
+func newTopic(name string, c Compaction) *topic {
 	t := &topic{
-		messages:  make(chan *amp.Msg, 128),
-		consumers: make(map[amp.Subscriber]int64),
-		closed:    make(chan struct{}),
-		loopWork:  make(chan func()),
+		name:       name,
+		messages:   make(chan *amp.Msg, 128),
+		consumers:  make(map[amp.Subscriber]int64),
+		closed:     make(chan struct{}),
+		loopWork:   make(chan func()),
+		compaction: c,
+		updatedAt:  time.Now(),
 	}
 	go t.loop()
 	return t
@@ -77,6 +88,50 @@ func (t *topic) subscribe(c amp.Subscriber, ts int64) {
 		if t.cache != nil {
 			t.sendMany(c, t.cache.Find(ts))
 		}
+		if t.stale {
+			c.Send(t.status())
+		}
+	}
+}
+
+// alive marks producer heartbeat
+func (t *topic) alive() {
+	t.loopWork <- func() {
+		t.markAlive()
+	}
+}
+
+// should be called in loop
+func (t *topic) markAlive() {
+	t.lastAlive = time.Now()
+	if t.stale {
+		t.stale = false
+		t.notifyStatus()
+	}
+}
+
+// checkLiveness marks topic stale if there was no heartbeat in window
+func (t *topic) checkLiveness(window time.Duration) {
+	t.loopWork <- func() {
+		if t.lastAlive.IsZero() || t.stale || time.Since(t.lastAlive) < window {
+			return
+		}
+		t.stale = true
+		t.notifyStatus()
+	}
+}
+
+func (t *topic) status() *amp.Msg {
+	return amp.NewStatus(t.name, amp.TopicStatus{
+		Stale:     t.stale,
+		LastAlive: t.lastAlive.UnixNano() / int64(time.Millisecond),
+	})
+}
+
+func (t *topic) notifyStatus() {
+	m := t.status()
+	for c := range t.consumers {
+		c.Send(m)
 	}
 }
 
@@ -90,6 +145,34 @@ func (t *topic) unsubscribe(c amp.Subscriber) bool {
 	return <-empty
 }
 
+// backfill sends cached messages in range as replays, followed by response
+// to the backfill request.
+func (t *topic) backfill(c amp.Subscriber, req *amp.Msg, r amp.BackfillRange) {
+	t.loopWork <- func() {
+		var rsp amp.BackfillResult
+		ac, ok := t.cache.(*appendCache)
+		if ok && len(ac.msgs) > 0 {
+			var msgs []*amp.Msg
+			if r.FromOffset > 0 {
+				msgs = ac.RangeOffset(r.FromOffset, r.ToOffset)
+			} else {
+				msgs = ac.Range(r.From, r.To)
+			}
+			for _, m := range msgs {
+				c.Send(m.AsReplay())
+			}
+			rsp.Count = len(msgs)
+			rsp.First = ac.msgs[0].Ts
+			rsp.FirstOffset = ac.firstOffset()
+			if len(msgs) > 0 {
+				rsp.Last = msgs[len(msgs)-1].Ts
+				rsp.LastOffset = msgs[len(msgs)-1].Offset
+			}
+		}
+		c.Send(req.Response(rsp))
+	}
+}
+
 func (t *topic) sendMany(c amp.Subscriber, msgs []*amp.Msg) {
 	burstStartEnd := len(msgs) > 2
 	if burstStartEnd {
@@ -105,13 +188,24 @@ func (t *topic) sendMany(c amp.Subscriber, msgs []*amp.Msg) {
 
 func (t *topic) send(c amp.Subscriber, m *amp.Msg) {
 	t.consumers[c] = m.Ts
+	if t.chunkSize > 0 && m.IsFull() {
+		// full was published chunked, send it the same way
+		for _, p := range amp.ChunkFull(m, t.chunkSize) {
+			c.Send(p)
+		}
+		return
+	}
 	c.Send(m)
 }
 
 func (t *topic) onMessage(m *amp.Msg) {
+	if m.IsChunk() {
+		t.onChunk(m)
+		return
+	}
 	if t.cache == nil {
 		if m.UpdateType == amp.Append || m.UpdateType == amp.Update {
-			t.cache = newAppendCache()
+			t.cache = newAppendCache(t.compaction)
 		} else {
 			t.cache = newFullDiffCache()
 		}
@@ -128,6 +222,46 @@ func (t *topic) onMessage(m *amp.Msg) {
 	}
 
 	t.updatedAt = time.Now()
+	if !t.lastAlive.IsZero() {
+		t.markAlive()
+	}
+}
+
+// onChunk forwards parts of the chunked full to the consumers which are
+// waiting for full, and puts assembled full into the cache.
+func (t *topic) onChunk(m *amp.Msg) {
+	if t.assembler == nil {
+		t.assembler = amp.NewAssembler()
+	}
+	if m.UpdateType == amp.FullStart {
+		t.chunkSize = len(m.BodyBytes())
+		t.chunked = make(map[amp.Subscriber]bool)
+		for c, cTs := range t.consumers {
+			if cTs == tsNone {
+				t.chunked[c] = true
+			}
+		}
+	}
+	for c := range t.chunked {
+		if _, ok := t.consumers[c]; ok {
+			c.Send(m)
+		}
+	}
+	full := t.assembler.Add(m)
+	if full == nil {
+		return
+	}
+	if t.cache == nil {
+		t.cache = newFullDiffCache()
+	}
+	t.cache.Add(full)
+	for c := range t.chunked {
+		if _, ok := t.consumers[c]; ok {
+			t.consumers[c] = full.Ts
+		}
+	}
+	t.chunked = nil
+	t.updatedAt = time.Now()
 }
 
 func (t *topic) replay() []*amp.Msg {
@@ -0,0 +1,118 @@
+package broker
+
+import (
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+)
+
+// Transactions enables transactional publish (see amp.Tx).
+// Prepared messages of the transaction are held until commit marker and
+// all messages of the transaction arrive, then they are applied together.
+// Topics are topics consumed by the broker, transaction is complete when
+// its messages of those topics arrive; without topics all messages of the
+// transaction are expected. Transactions not completed within ttl are
+// dropped.
+func Transactions(ttl time.Duration, topics ...string) func(*Broker) {
+	return func(s *Broker) {
+		s.txs = newTxs(ttl, topics)
+	}
+}
+
+// txs holds messages of the pending transactions
+type txs struct {
+	ttl     time.Duration
+	topics  map[string]bool       // consumed topics, nil for all
+	pending map[string]*pendingTx // by transaction id
+}
+
+type pendingTx struct {
+	msgs      []*amp.Msg
+	committed bool
+	count     int // number of expected messages from commit marker
+	at        time.Time
+}
+
+func newTxs(ttl time.Duration, topics []string) *txs {
+	t := &txs{
+		ttl:     ttl,
+		pending: make(map[string]*pendingTx),
+	}
+	if len(topics) > 0 {
+		t.topics = make(map[string]bool)
+		for _, topic := range topics {
+			t.topics[topic] = true
+		}
+	}
+	return t
+}
+
+// expected returns number of the transaction messages of the consumed
+// topics from the commit marker
+func (t *txs) expected(commit *amp.Msg) int {
+	counts := commit.TxCounts()
+	if t.topics == nil || counts == nil {
+		return commit.TxCount()
+	}
+	n := 0
+	for topic, c := range counts {
+		if t.topics[topic] {
+			n += c
+		}
+	}
+	return n
+}
+
+// onTx holds transaction message, returns false if m is not part of
+// transaction and should be routed immediately
+func (s *Broker) onTx(m *amp.Msg) bool {
+	if s.txs == nil {
+		return false
+	}
+	msgs, ok := s.txs.hold(m)
+	for _, m := range msgs {
+		s.route(m)
+	}
+	return ok
+}
+
+// hold returns false if m is not part of transaction.
+// When transaction is complete returns all its messages.
+func (t *txs) hold(m *amp.Msg) ([]*amp.Msg, bool) {
+	id := m.TxID()
+	if id == "" {
+		return nil, false
+	}
+	t.expire()
+	tx, ok := t.pending[id]
+	if !ok {
+		tx = &pendingTx{at: time.Now()}
+		t.pending[id] = tx
+	}
+	if m.IsTxCommit() {
+		tx.committed = true
+		tx.count = t.expected(m)
+	} else {
+		tx.msgs = append(tx.msgs, m)
+	}
+	if tx.committed && len(tx.msgs) >= tx.count {
+		delete(t.pending, id)
+		metric.Counter("broker.tx.commit")
+		return tx.msgs, true
+	}
+	return nil, true
+}
+
+// expire drops transactions older than ttl
+func (t *txs) expire() {
+	for id, tx := range t.pending {
+		if time.Since(tx.at) <= t.ttl {
+			continue
+		}
+		delete(t.pending, id)
+		metric.Counter("broker.tx.expired")
+		log.S("tx", id).I("msgs", len(tx.msgs)).I("count", tx.count).Info("transaction expired")
+	}
+}
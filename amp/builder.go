@@ -0,0 +1,194 @@
+package amp
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Builder builds message with fluent api:
+//
+//	m, err := amp.Build().Topic("math").Path("add").UpdateType(amp.Diff).Body(v).Msg()
+//
+// Message type is Publish by default. Msg validates required fields and
+// stamps Ts of the publish message if not set.
+type Builder struct {
+	m     Msg
+	topic string
+	path  string
+	src   interface{}
+}
+
+// Build starts building new message.
+func Build() *Builder {
+	return &Builder{}
+}
+
+// Type sets message type.
+func (b *Builder) Type(t uint8) *Builder {
+	b.m.Type = t
+	return b
+}
+
+// Topic sets topic part of the uri.
+func (b *Builder) Topic(topic string) *Builder {
+	b.topic = topic
+	return b
+}
+
+// Path sets path part of the uri.
+func (b *Builder) Path(path string) *Builder {
+	b.path = path
+	return b
+}
+
+// URI sets message uri, instead of the Topic and Path.
+func (b *Builder) URI(uri string) *Builder {
+	b.m.URI = uri
+	return b
+}
+
+// UpdateType sets update type of the publish message.
+func (b *Builder) UpdateType(t uint8) *Builder {
+	b.m.UpdateType = t
+	return b
+}
+
+// Ts sets message timestamp (unix milli).
+func (b *Builder) Ts(ts int64) *Builder {
+	b.m.Ts = ts
+	return b
+}
+
+// Body sets message body, marshaled to json.
+func (b *Builder) Body(v interface{}) *Builder {
+	b.src = v
+	return b
+}
+
+// BinaryBody sets raw binary body with content type.
+func (b *Builder) BinaryBody(body []byte, contentType string) *Builder {
+	b.m.body = body
+	b.m.ContentType = contentType
+	if contentType == "" {
+		b.m.ContentType = ContentTypeBinary
+	}
+	return b
+}
+
+// ReplyTo sets topic for the response of the request message.
+func (b *Builder) ReplyTo(topic string) *Builder {
+	b.m.ReplyTo = topic
+	return b
+}
+
+// CorrelationID sets request/response correlation id.
+func (b *Builder) CorrelationID(id uint64) *Builder {
+	b.m.CorrelationID = id
+	return b
+}
+
+// RequireAck marks message as critical, client acknowledges its delivery.
+func (b *Builder) RequireAck() *Builder {
+	b.m.RequiresAck = true
+	return b
+}
+
+// Priority sets delivery lane.
+func (b *Builder) Priority(p uint8) *Builder {
+	b.m.Priority = p
+	return b
+}
+
+// CacheDepth sets cache depth of the append message.
+func (b *Builder) CacheDepth(d int) *Builder {
+	b.m.CacheDepth = d
+	return b
+}
+
+// Meta sets message metadata key.
+func (b *Builder) Meta(key, value string) *Builder {
+	if b.m.Meta == nil {
+		b.m.Meta = make(map[string]string)
+	}
+	b.m.Meta[key] = value
+	return b
+}
+
+// Msg validates and returns built message.
+func (b *Builder) Msg() (*Msg, error) {
+	m := &Msg{
+		Type:          b.m.Type,
+		ReplyTo:       b.m.ReplyTo,
+		CorrelationID: b.m.CorrelationID,
+		URI:           b.m.URI,
+		Ts:            b.m.Ts,
+		UpdateType:    b.m.UpdateType,
+		CacheDepth:    b.m.CacheDepth,
+		Meta:          b.m.Meta,
+		Priority:      b.m.Priority,
+		RequiresAck:   b.m.RequiresAck,
+		ContentType:   b.m.ContentType,
+		body:          b.m.body,
+	}
+	if err := b.validate(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// MustMsg returns built message, panics if message is not valid.
+func (b *Builder) MustMsg() *Msg {
+	m, err := b.Msg()
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func (b *Builder) validate(m *Msg) error {
+	if m.URI != "" && (b.topic != "" || b.path != "") {
+		return errors.New("both uri and topic/path set")
+	}
+	if strings.Contains(b.topic, "/") {
+		return errors.Errorf("topic %q contains /", b.topic)
+	}
+	if m.URI == "" {
+		m.topic = b.topic
+		m.path = strings.Trim(b.path, "/")
+		m.URI = m.topic
+		if m.path != "" {
+			m.URI = m.topic + "/" + m.path
+		}
+	}
+	if m.body != nil && b.src != nil {
+		return errors.New("both body and binary body set")
+	}
+	if b.src != nil {
+		m.src = toBodyMarshaler(b.src)
+	}
+	switch m.Type {
+	case Publish:
+		if m.URI == "" {
+			return errors.New("publish without topic")
+		}
+		if m.UpdateType > FullEnd {
+			return errors.Errorf("unknown update type %d", m.UpdateType)
+		}
+		if m.Ts == 0 {
+			m.Ts = TS()
+		}
+	case Request, Current:
+		if m.URI == "" {
+			return errors.New("request without uri")
+		}
+	case Response:
+		if m.CorrelationID == 0 {
+			return errors.New("response without correlation id")
+		}
+	case Subscribe, Ping, Pong, Alive, Event, Status:
+	default:
+		return errors.Errorf("unknown message type %d", m.Type)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+// Package cache materializes current state of the amp topics.
+//
+// Cache consumes Full/Diff/Append/Update/Close stream and keeps current
+// state for each uri, so gateways and services can answer "current state"
+// queries locally:
+//
+//	c := cache.New()
+//	in := c.Pipe(nsq.Subscribe(ctx, topics))
+//	...
+//	body, ts := c.Get("math.v1/i")
+//
+// Diff is merged into the state same as in the js sdk: null values delete
+// keys, objects are merged recursively, other values are replaced.
+// Append messages are collected into json array of the last depth messages.
+// Chunked fulls are reassembled. Messages with binary body are not cached.
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+)
+
+const defaultDepth = 64
+
+type entry struct {
+	ts      int64
+	state   interface{}       // merged full and diffs
+	appends []json.RawMessage // append messages
+	depth   int
+	buf     []byte // memoization of marshaled state
+}
+
+// Cache keeps current state by uri.
+type Cache struct {
+	entries   map[string]*entry
+	assembler *amp.Assembler
+	sync.Mutex
+}
+
+// New creates empty cache.
+func New() *Cache {
+	return &Cache{
+		entries:   make(map[string]*entry),
+		assembler: amp.NewAssembler(),
+	}
+}
+
+// Pipe adds all messages from in to the cache and passes them to the returned chan.
+func (c *Cache) Pipe(in <-chan *amp.Msg) <-chan *amp.Msg {
+	out := make(chan *amp.Msg)
+	go func() {
+		defer close(out)
+		for m := range in {
+			c.Add(m)
+			out <- m
+		}
+	}()
+	return out
+}
+
+// Add updates state of the message uri.
+func (c *Cache) Add(m *amp.Msg) {
+	if m.Type != amp.Publish || m.IsBinary() {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if m.IsChunk() {
+		if m = c.assembler.Add(m); m == nil {
+			return
+		}
+	}
+	e := c.entries[m.URI]
+
+	switch m.UpdateType {
+	case amp.Full, amp.Update:
+		if e != nil && m.IsReplay() && m.Ts <= e.ts {
+			return
+		}
+		state, err := decode(m)
+		if err != nil {
+			log.S("uri", m.URI).Error(err)
+			return
+		}
+		c.entries[m.URI] = &entry{ts: m.Ts, state: state}
+	case amp.Diff:
+		if e == nil || e.appends != nil || m.Ts <= e.ts {
+			return // without full or already applied
+		}
+		diff, err := decode(m)
+		if err != nil {
+			log.S("uri", m.URI).Error(err)
+			return
+		}
+		e.state = merge(e.state, diff)
+		e.ts = m.Ts
+		e.buf = nil
+	case amp.Append:
+		if e == nil || e.appends == nil {
+			e = &entry{appends: make([]json.RawMessage, 0), depth: defaultDepth}
+			c.entries[m.URI] = e
+		}
+		if m.Ts <= e.ts {
+			return
+		}
+		raw := json.RawMessage(m.BodyBytes())
+		if len(raw) == 0 {
+			raw = json.RawMessage("null")
+		}
+		if m.CacheDepth > 0 {
+			e.depth = m.CacheDepth
+		}
+		e.appends = append(e.appends, raw)
+		if len(e.appends) > e.depth {
+			e.appends = e.appends[len(e.appends)-e.depth:]
+		}
+		e.ts = m.Ts
+		e.buf = nil
+	case amp.Close:
+		delete(c.entries, m.URI)
+	}
+}
+
+// Get returns current state of the uri as json and Ts of the last
+// applied message. Returns nil if there is no state.
+func (c *Cache) Get(uri string) ([]byte, int64) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[uri]
+	if !ok {
+		return nil, 0
+	}
+	if e.buf == nil {
+		var err error
+		if e.appends != nil {
+			e.buf, err = json.Marshal(e.appends)
+		} else {
+			e.buf, err = json.Marshal(e.state)
+		}
+		if err != nil {
+			log.S("uri", uri).Error(err)
+		}
+	}
+	return e.buf, e.ts
+}
+
+// URIs returns all uris in the cache.
+func (c *Cache) URIs() []string {
+	c.Lock()
+	defer c.Unlock()
+	var uris []string
+	for uri := range c.entries {
+		uris = append(uris, uri)
+	}
+	return uris
+}
+
+func decode(m *amp.Msg) (interface{}, error) {
+	raw := m.BodyBytes()
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// merge applies diff to the full
+func merge(full, diff interface{}) interface{} {
+	d, ok := diff.(map[string]interface{})
+	if !ok {
+		return diff
+	}
+	f, ok := full.(map[string]interface{})
+	if !ok {
+		f = make(map[string]interface{})
+	}
+	for k, v := range d {
+		if v == nil {
+			delete(f, k)
+			continue
+		}
+		if _, ok := v.(map[string]interface{}); ok {
+			f[k] = merge(f[k], v)
+			continue
+		}
+		f[k] = v
+	}
+	return f
+}
@@ -0,0 +1,51 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func publish(c *Cache, uri string, ts int64, updateType uint8, body string) {
+	m := amp.Parse([]byte(`{"u":"` + uri + `"}` + "\n" + body))
+	m.Ts = ts
+	m.UpdateType = updateType
+	c.Add(m)
+}
+
+func TestFullDiff(t *testing.T) {
+	c := New()
+	publish(c, "math.v1/i", 1, amp.Diff, `{"x":1}`)
+	buf, _ := c.Get("math.v1/i")
+	assert.Nil(t, buf)
+
+	publish(c, "math.v1/i", 2, amp.Full, `{"x":1,"y":{"a":1,"b":2},"z":3}`)
+	publish(c, "math.v1/i", 3, amp.Diff, `{"x":2,"y":{"b":null,"c":3},"z":null}`)
+	publish(c, "math.v1/i", 3, amp.Diff, `{"x":5}`) // already applied
+	buf, ts := c.Get("math.v1/i")
+	assert.Equal(t, `{"x":2,"y":{"a":1,"c":3}}`, string(buf))
+	assert.Equal(t, int64(3), ts)
+
+	publish(c, "math.v1/i", 4, amp.Close, ``)
+	buf, _ = c.Get("math.v1/i")
+	assert.Nil(t, buf)
+}
+
+func TestAppend(t *testing.T) {
+	c := New()
+	for i, b := range []string{`{"a":1}`, `{"a":2}`, `{"a":3}`} {
+		publish(c, "chat", int64(i+1), amp.Append, b)
+	}
+	buf, ts := c.Get("chat")
+	assert.Equal(t, `[{"a":1},{"a":2},{"a":3}]`, string(buf))
+	assert.Equal(t, int64(3), ts)
+	assert.Equal(t, []string{"chat"}, c.URIs())
+}
+
+func TestLocalMessage(t *testing.T) {
+	c := New()
+	c.Add(amp.NewPublish("math.v1", "i", 1, amp.Full, map[string]int{"x": 1}))
+	buf, _ := c.Get("math.v1/i")
+	assert.Equal(t, `{"x":1}`, string(buf))
+}
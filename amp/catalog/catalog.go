@@ -0,0 +1,290 @@
+// Package catalog is registry of the topics with their metadata.
+//
+// Producers declare their topics, catalog entries are published on the
+// catalog topic every interval:
+//
+//	catalog.Declare(ctx, time.Minute, pub.Publish, catalog.Entry{
+//		Topic:        "math.v1",
+//		UpdateTypes:  []string{"full", "diff"},
+//		Schema:       "https://schemas/math.v1.json",
+//		FullInterval: catalog.Duration(time.Minute),
+//		Owner:        "team-math",
+//	})
+//
+// Gateways consume catalog topic (or load entries from Consul), validate
+// published messages and expose catalog for discovery:
+//
+//	cat := catalog.New()
+//	go cat.Consume(ctx, nsq.Subscribe(ctx, []string{catalog.Topic}))
+//	cat.Route(httpi.Subrouter("/catalog"))
+//	if err := cat.Validate(m); err != nil { ... }
+package catalog
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/dcy"
+	"github.com/minus5/svckit/env"
+	"github.com/minus5/svckit/httpi"
+	"github.com/minus5/svckit/log"
+	"github.com/pkg/errors"
+)
+
+// Topic is topic of the catalog messages, path is declared topic.
+const Topic = "system.catalog"
+
+var (
+	// ErrUnknownTopic is returned by Validate for not declared topic.
+	ErrUnknownTopic = errors.New("unknown topic")
+	// ErrUpdateType is returned by Validate for not declared update type.
+	ErrUpdateType = errors.New("update type not declared")
+)
+
+// update type names used in entries
+var updateTypes = map[string]uint8{
+	"diff":   amp.Diff,
+	"full":   amp.Full,
+	"append": amp.Append,
+	"update": amp.Update,
+	"close":  amp.Close,
+}
+
+// Duration is time.Duration in json as string (1m30s).
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(buf []byte) error {
+	var s string
+	if err := json.Unmarshal(buf, &s); err != nil {
+		return errors.WithStack(err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Entry is metadata of the topic.
+type Entry struct {
+	Topic        string    `json:"topic"`
+	UpdateTypes  []string  `json:"updateTypes,omitempty"`  // diff, full, append, update, close
+	Schema       string    `json:"schema,omitempty"`       // body schema reference
+	FullInterval Duration  `json:"fullInterval,omitempty"` // expected interval between Fulls, 0 unknown
+	Owner        string    `json:"owner,omitempty"`        // owner team
+	App          string    `json:"app,omitempty"`          // producer app, set by Declare
+	Updated      time.Time `json:"updated,omitempty"`      // set by catalog
+}
+
+// validate checks entry fields
+func (e Entry) validate() error {
+	if e.Topic == "" {
+		return errors.New("missing topic")
+	}
+	for _, t := range e.UpdateTypes {
+		if _, ok := updateTypes[t]; !ok {
+			return errors.Errorf("topic %s unknown update type %q", e.Topic, t)
+		}
+	}
+	return nil
+}
+
+// allows returns true if update type is declared, all are allowed
+// if entry has no update types
+func (e Entry) allows(updateType uint8) bool {
+	if len(e.UpdateTypes) == 0 {
+		return true
+	}
+	for _, t := range e.UpdateTypes {
+		if updateTypes[t] == updateType {
+			return true
+		}
+	}
+	return false
+}
+
+// NewEntry creates catalog message for the entry.
+func NewEntry(e Entry) *amp.Msg {
+	return amp.NewPublish(Topic, e.Topic, amp.TS(), amp.Full, e)
+}
+
+// Declare publishes entries every interval until ctx is done.
+// App of the entries is set to the current app.
+func Declare(ctx context.Context, interval time.Duration, publish func(*amp.Msg), entries ...Entry) {
+	for i := range entries {
+		entries[i].App = env.AppName()
+	}
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			for _, e := range entries {
+				publish(NewEntry(e))
+			}
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Catalog keeps declared topics.
+type Catalog struct {
+	entries map[string]Entry
+	sync.RWMutex
+}
+
+// New creates empty catalog.
+func New() *Catalog {
+	return &Catalog{entries: make(map[string]Entry)}
+}
+
+// Set adds or replaces entry.
+func (c *Catalog) Set(e Entry) error {
+	if err := e.validate(); err != nil {
+		return err
+	}
+	e.Updated = time.Now()
+	c.Lock()
+	defer c.Unlock()
+	c.entries[e.Topic] = e
+	return nil
+}
+
+// Add adds entry from the catalog message.
+func (c *Catalog) Add(m *amp.Msg) {
+	if m.Topic() != Topic {
+		return
+	}
+	var e Entry
+	if err := m.Unmarshal(&e); err != nil {
+		log.S("uri", m.URI).Error(err)
+		return
+	}
+	if err := c.Set(e); err != nil {
+		log.S("uri", m.URI).Error(err)
+	}
+}
+
+// Consume adds all catalog messages from in, until in is closed or ctx is done.
+func (c *Catalog) Consume(ctx context.Context, in <-chan *amp.Msg) {
+	for {
+		select {
+		case m, ok := <-in:
+			if !ok {
+				return
+			}
+			c.Add(m)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// LoadConsul adds entries from Consul KV.
+// Under prefix key is topic and value is json entry.
+func (c *Catalog) LoadConsul(prefix string) error {
+	kvs, err := dcy.KVs(prefix)
+	if err == dcy.ErrKeyNotFound {
+		return nil
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+	for topic, v := range kvs {
+		if topic == "" {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal([]byte(v), &e); err != nil {
+			return errors.Wrapf(err, "catalog entry %s", topic)
+		}
+		if e.Topic == "" {
+			e.Topic = topic
+		}
+		if err := c.Set(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns entry of the topic.
+func (c *Catalog) Get(topic string) (Entry, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	e, ok := c.entries[topic]
+	return e, ok
+}
+
+// Entries returns all entries sorted by topic.
+func (c *Catalog) Entries() []Entry {
+	c.RLock()
+	defer c.RUnlock()
+	entries := make([]Entry, 0, len(c.entries))
+	for _, e := range c.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Topic < entries[j].Topic })
+	return entries
+}
+
+// Validate checks that publish message topic is declared with
+// message update type. Other message types are not checked.
+func (c *Catalog) Validate(m *amp.Msg) error {
+	if m.Type != amp.Publish {
+		return nil
+	}
+	e, ok := c.Get(m.Topic())
+	if !ok {
+		return errors.Wrap(ErrUnknownTopic, m.Topic())
+	}
+	switch m.UpdateType {
+	case amp.BurstStart, amp.BurstEnd, amp.FullStart, amp.FullPart, amp.FullEnd:
+		// burst markers and chunks of the full
+		return nil
+	}
+	if !e.allows(m.UpdateType) {
+		return errors.Wrapf(ErrUpdateType, "%s %d", m.Topic(), m.UpdateType)
+	}
+	return nil
+}
+
+// Route registers catalog view on the router.
+func (c *Catalog) Route(rt *httpi.Router) {
+	rt.Route("", c.httpList).Methods("GET")
+	rt.Route("/", c.httpList).Methods("GET")
+	rt.RouteVars("/{topic}", c.httpGet).Methods("GET")
+}
+
+func (c *Catalog) httpList(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(c.Entries()); err != nil {
+		log.Error(err)
+	}
+}
+
+func (c *Catalog) httpGet(w http.ResponseWriter, req *http.Request, vars map[string]string) {
+	e, ok := c.Get(vars["topic"])
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(e); err != nil {
+		log.Error(err)
+	}
+}
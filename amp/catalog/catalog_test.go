@@ -0,0 +1,48 @@
+package catalog
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCatalog(t *testing.T) {
+	c := New()
+	c.Add(amp.Parse(NewEntry(Entry{
+		Topic:        "math.v1",
+		UpdateTypes:  []string{"full", "diff"},
+		FullInterval: Duration(time.Minute),
+		Owner:        "team-math",
+	}).Marshal()))
+	c.Add(amp.Parse(NewEntry(Entry{Topic: "chat"}).Marshal()))
+	c.Add(amp.NewPublish("math.v1", "", 1, amp.Full, nil)) // not catalog message
+	assert.Error(t, c.Set(Entry{Topic: "odds", UpdateTypes: []string{"replace"}}))
+
+	e, ok := c.Get("math.v1")
+	assert.True(t, ok)
+	assert.Equal(t, "team-math", e.Owner)
+	assert.Equal(t, Duration(time.Minute), e.FullInterval)
+	assert.Len(t, c.Entries(), 2)
+
+	assert.NoError(t, c.Validate(amp.NewPublish("math.v1", "", 1, amp.Diff, nil)))
+	assert.NoError(t, c.Validate(amp.NewPublish("chat", "", 1, amp.Append, nil))) // all types allowed
+	assert.NoError(t, c.Validate(amp.NewRequest("odds.req/get", nil)))
+	err := c.Validate(amp.NewPublish("math.v1", "", 1, amp.Append, nil))
+	assert.Equal(t, ErrUpdateType, errors.Cause(err))
+	err = c.Validate(amp.NewPublish("odds", "", 1, amp.Full, nil))
+	assert.Equal(t, ErrUnknownTopic, errors.Cause(err))
+
+	w := httptest.NewRecorder()
+	c.httpList(w, httptest.NewRequest("GET", "/catalog", nil))
+	assert.Contains(t, w.Body.String(), `"fullInterval":"1m0s"`)
+	w = httptest.NewRecorder()
+	c.httpGet(w, httptest.NewRequest("GET", "/catalog/chat", nil), map[string]string{"topic": "chat"})
+	assert.Contains(t, w.Body.String(), `"topic":"chat"`)
+	w = httptest.NewRecorder()
+	c.httpGet(w, httptest.NewRequest("GET", "/catalog/odds", nil), map[string]string{"topic": "odds"})
+	assert.Equal(t, 404, w.Code)
+}
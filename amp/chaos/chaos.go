@@ -0,0 +1,200 @@
+// Package chaos injects faults into transports and handlers, to validate
+// client resume logic and retries under controlled chaos.
+//
+// Injector is disabled by default. It is enabled by environment variable
+// with comma separated faults, each affecting percent of the messages:
+//
+//	SVCKIT_CHAOS=delay=5%:200ms,drop=1%,duplicate=1%,corrupt=1%,error=2%
+//
+// or from code with Set. Transports nsq and ws delay, drop, duplicate and
+// corrupt outgoing messages, responders fail requests with error fault.
+package chaos
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+	"github.com/pkg/errors"
+)
+
+// EnvChaos is environment variable with faults configuration.
+const EnvChaos = "SVCKIT_CHAOS"
+
+// ErrInjected is handler error injected by error fault.
+var ErrInjected = amp.Retryable(errors.New("chaos: injected error"))
+
+// Config is percent of the messages affected by each fault.
+type Config struct {
+	Delay     int
+	DelayTime time.Duration // delay of the delayed messages
+	Drop      int
+	Duplicate int
+	Corrupt   int
+	Error     int // handler errors
+}
+
+// Injector injects faults. Nil injector is disabled.
+type Injector struct {
+	cfg  Config
+	rnd  *rand.Rand
+	lock sync.Mutex
+}
+
+var injector *Injector
+
+func init() {
+	v, ok := os.LookupEnv(EnvChaos)
+	if !ok || v == "" {
+		return
+	}
+	cfg, err := Parse(v)
+	if err != nil {
+		log.S("env", EnvChaos).Error(err)
+		return
+	}
+	log.S("env", EnvChaos).S("faults", v).Info("chaos enabled")
+	injector = New(cfg)
+}
+
+// New creates injector.
+func New(cfg Config) *Injector {
+	return &Injector{cfg: cfg, rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// Set sets injector used by transports and responders, nil disables.
+// Call before starting transports.
+func Set(i *Injector) {
+	injector = i
+}
+
+// Get returns current injector, nil if disabled.
+func Get() *Injector {
+	return injector
+}
+
+// Parse parses faults configuration, see package doc.
+func Parse(s string) (Config, error) {
+	var cfg Config
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return cfg, errors.Errorf("wrong fault %q, expecting name=percent%%", f)
+		}
+		v := kv[1]
+		if kv[0] == "delay" {
+			p := strings.IndexByte(v, ':')
+			if p < 0 {
+				return cfg, errors.Errorf("wrong delay %q, expecting percent%%:duration", v)
+			}
+			d, err := time.ParseDuration(v[p+1:])
+			if err != nil {
+				return cfg, errors.Wrapf(err, "delay %q", v)
+			}
+			cfg.DelayTime = d
+			v = v[:p]
+		}
+		percent, err := strconv.Atoi(strings.TrimSuffix(v, "%"))
+		if err != nil || percent < 0 || percent > 100 {
+			return cfg, errors.Errorf("wrong percent in %q", f)
+		}
+		switch kv[0] {
+		case "delay":
+			cfg.Delay = percent
+		case "drop":
+			cfg.Drop = percent
+		case "duplicate":
+			cfg.Duplicate = percent
+		case "corrupt":
+			cfg.Corrupt = percent
+		case "error":
+			cfg.Error = percent
+		default:
+			return cfg, errors.Errorf("unknown fault %q", kv[0])
+		}
+	}
+	return cfg, nil
+}
+
+// hit returns true for percent of the calls
+func (i *Injector) hit(percent int) bool {
+	if percent <= 0 {
+		return false
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return i.rnd.Intn(100) < percent
+}
+
+// Send sends payload with faults injected: delays, drops, duplicates
+// or corrupts it. Payload is not modified, corrupted copy is sent.
+// Delayed payload is copied and sent from the timer goroutine after
+// DelayTime, so the caller is not blocked and messages sent in the
+// meantime overtake it. Error of the delayed send is only logged.
+func (i *Injector) Send(payload []byte, send func([]byte) error) error {
+	if i == nil {
+		return send(payload)
+	}
+	if i.hit(i.cfg.Delay) {
+		metric.Counter("chaos.delay")
+		c := make([]byte, len(payload))
+		copy(c, payload)
+		time.AfterFunc(i.cfg.DelayTime, func() {
+			if err := i.send(c, send); err != nil {
+				log.Error(err)
+			}
+		})
+		return nil
+	}
+	return i.send(payload, send)
+}
+
+// send drops, corrupts or duplicates payload
+func (i *Injector) send(payload []byte, send func([]byte) error) error {
+	if i.hit(i.cfg.Drop) {
+		metric.Counter("chaos.drop")
+		return nil
+	}
+	if i.hit(i.cfg.Corrupt) && len(payload) > 0 {
+		metric.Counter("chaos.corrupt")
+		c := make([]byte, len(payload))
+		copy(c, payload)
+		i.lock.Lock()
+		c[i.rnd.Intn(len(c))] ^= 0xff
+		i.lock.Unlock()
+		payload = c
+	}
+	if err := send(payload); err != nil {
+		return err
+	}
+	if i.hit(i.cfg.Duplicate) {
+		metric.Counter("chaos.duplicate")
+		return send(payload)
+	}
+	return nil
+}
+
+// Handler is middleware which fails percent of the requests with ErrInjected.
+func (i *Injector) Handler(h amp.Handler) amp.Handler {
+	if i == nil || i.cfg.Error <= 0 {
+		return h
+	}
+	return func(ctx context.Context, m *amp.Msg) (*amp.Msg, error) {
+		if i.hit(i.cfg.Error) {
+			amp.CountMsg("chaos.error", m)
+			return nil, ErrInjected
+		}
+		return h(ctx, m)
+	}
+}
@@ -0,0 +1,81 @@
+package chaos
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	cfg, err := Parse("delay=5%:200ms, drop=1%,duplicate=2,corrupt=3%,error=4%")
+	assert.NoError(t, err)
+	assert.Equal(t, Config{Delay: 5, DelayTime: 200 * time.Millisecond, Drop: 1, Duplicate: 2, Corrupt: 3, Error: 4}, cfg)
+
+	for _, s := range []string{"drop", "drop=x%", "drop=101%", "delay=5%", "delay=5%:x", "reorder=1%"} {
+		_, err := Parse(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestSend(t *testing.T) {
+	var sent [][]byte
+	send := func(buf []byte) error {
+		sent = append(sent, buf)
+		return nil
+	}
+	payload := []byte("payload")
+
+	// disabled
+	var i *Injector
+	assert.NoError(t, i.Send(payload, send))
+	assert.Len(t, sent, 1)
+
+	sent = nil
+	assert.NoError(t, New(Config{Drop: 100}).Send(payload, send))
+	assert.Len(t, sent, 0)
+
+	assert.NoError(t, New(Config{Duplicate: 100}).Send(payload, send))
+	assert.Len(t, sent, 2)
+
+	sent = nil
+	assert.NoError(t, New(Config{Corrupt: 100}).Send(payload, send))
+	assert.NotEqual(t, payload, sent[0])
+	assert.Equal(t, "payload", string(payload)) // shared payload is not modified
+
+	// delayed send doesn't block the caller
+	delayed := make(chan []byte, 1)
+	start := time.Now()
+	assert.NoError(t, New(Config{Delay: 100, DelayTime: 10 * time.Millisecond}).Send(payload, func(buf []byte) error {
+		delayed <- buf
+		return nil
+	}))
+	assert.True(t, time.Since(start) < 10*time.Millisecond)
+	buf := <-delayed
+	assert.True(t, time.Since(start) >= 10*time.Millisecond)
+	assert.Equal(t, payload, buf)
+	assert.False(t, &buf[0] == &payload[0]) // sent copy
+
+	// about percent of messages
+	sent = nil
+	i = New(Config{Drop: 30})
+	for j := 0; j < 1000; j++ {
+		i.Send(payload, send)
+	}
+	assert.InDelta(t, 700, len(sent), 100)
+}
+
+func TestHandler(t *testing.T) {
+	h := func(ctx context.Context, m *amp.Msg) (*amp.Msg, error) {
+		return m.Response(nil), nil
+	}
+	m := &amp.Msg{URI: "math.req/add"}
+	_, err := New(Config{Error: 100}).Handler(h)(context.Background(), m)
+	assert.Equal(t, ErrInjected, err)
+	assert.True(t, amp.IsRetryable(err))
+
+	_, err = New(Config{Drop: 100}).Handler(h)(context.Background(), m)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,29 @@
+package amp
+
+import "hash/crc32"
+
+// crc32 Castagnoli is hardware accelerated on most platforms
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+func checksum(body []byte) uint32 {
+	return crc32.Checksum(body, checksumTable)
+}
+
+// StampChecksum sets checksum of the message body.
+// Publisher stamps messages, consumers verify them with VerifyChecksum.
+func (m *Msg) StampChecksum() {
+	sum := checksum(m.BodyBytes())
+	m.Lock()
+	defer m.Unlock()
+	m.Checksum = sum
+	m.payloads = nil // header is changed
+}
+
+// VerifyChecksum returns false if message has checksum which doesn't
+// match body. Messages without checksum are valid.
+func (m *Msg) VerifyChecksum() bool {
+	if m.Checksum == 0 {
+		return true
+	}
+	return m.Checksum == checksum(m.BodyBytes())
+}
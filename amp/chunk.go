@@ -0,0 +1,126 @@
+package amp
+
+import (
+	"hash/crc32"
+
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+)
+
+// Chunk describes part of the chunked full.
+type Chunk struct {
+	No  int    `json:"n"`           // part number, from 0
+	Of  int    `json:"o"`           // number of parts
+	Sum uint32 `json:"s,omitempty"` // crc32 of the whole body, in the last part
+}
+
+// IsChunk returns true for parts of the chunked full.
+func (m *Msg) IsChunk() bool {
+	return m.UpdateType == FullStart || m.UpdateType == FullPart || m.UpdateType == FullEnd
+}
+
+// ChunkFull splits Full message with body larger than size into
+// FullStart, FullPart... and FullEnd messages, so websocket frames stay
+// small. Parts are reassembled by Assembler. Producers publishing over
+// nsq split fulls with the publisher ChunkFulls option (see amp/nsq),
+// broker keeps sending fulls of the topic in chunks of the same size.
+// Other messages are returned unchanged.
+func ChunkFull(m *Msg, size int) []*Msg {
+	if !m.IsFull() || size <= 0 {
+		return []*Msg{m}
+	}
+	body := m.BodyBytes()
+	if len(body) <= size {
+		return []*Msg{m}
+	}
+	of := (len(body) + size - 1) / size
+	parts := make([]*Msg, 0, of)
+	for no := 0; no < of; no++ {
+		end := (no + 1) * size
+		if end > len(body) {
+			end = len(body)
+		}
+		p := &Msg{
+			Type:        Publish,
+			URI:         m.URI,
+			Ts:          m.Ts,
+			UpdateType:  FullPart,
+			Replay:      m.Replay,
+			KeyID:       m.KeyID,
+			DictID:      m.DictID,
+			ContentType: m.ContentType,
+			Chunk:       &Chunk{No: no, Of: of},
+			body:        body[no*size : end],
+		}
+		switch no {
+		case 0:
+			p.UpdateType = FullStart
+		case of - 1:
+			p.UpdateType = FullEnd
+			p.Chunk.Sum = crc32.ChecksumIEEE(body)
+		}
+		parts = append(parts, p)
+	}
+	return parts
+}
+
+// Assembler reassembles chunked fulls.
+// Not safe for concurrent use.
+type Assembler struct {
+	parts map[string][]*Msg // received parts by uri
+}
+
+// NewAssembler creates assembler.
+func NewAssembler() *Assembler {
+	return &Assembler{parts: make(map[string][]*Msg)}
+}
+
+// Add adds chunk to the assembly. Returns Full message when the last part
+// is received, nil otherwise. Incomplete assemblies or ones with checksum
+// mismatch are dropped.
+func (a *Assembler) Add(m *Msg) *Msg {
+	if !m.IsChunk() || m.Chunk == nil {
+		return nil
+	}
+	if m.UpdateType == FullStart {
+		a.parts[m.URI] = []*Msg{m}
+		return nil
+	}
+	parts, ok := a.parts[m.URI]
+	if !ok {
+		return nil // part without start
+	}
+	if parts[0].Ts != m.Ts || m.Chunk.No != len(parts) {
+		delete(a.parts, m.URI)
+		log.S("uri", m.URI).I("no", m.Chunk.No).ErrorS("chunk out of order")
+		metric.Counter("chunkError")
+		return nil
+	}
+	parts = append(parts, m)
+	if m.UpdateType != FullEnd {
+		a.parts[m.URI] = parts
+		return nil
+	}
+	delete(a.parts, m.URI)
+
+	var body []byte
+	for _, p := range parts {
+		body = append(body, p.body...)
+	}
+	if crc32.ChecksumIEEE(body) != m.Chunk.Sum || len(parts) != m.Chunk.Of {
+		log.S("uri", m.URI).ErrorS("chunked full checksum mismatch")
+		metric.Counter("chunkError")
+		return nil
+	}
+	return &Msg{
+		Type:        Publish,
+		URI:         m.URI,
+		Ts:          m.Ts,
+		UpdateType:  Full,
+		Replay:      m.Replay,
+		KeyID:       m.KeyID,
+		DictID:      m.DictID,
+		ContentType: m.ContentType,
+		body:        body,
+	}
+}
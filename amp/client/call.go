@@ -0,0 +1,49 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/pkg/errors"
+)
+
+// Requester sends request, response is delivered to the subscriber.
+// Implemented by amp/nsq and amp/inmem Requester.
+type Requester interface {
+	Send(amp.Subscriber, *amp.Msg)
+}
+
+// Call sends request with body req to the uri and unmarshals response
+// body into rsp (if not nil). Waits for the response until ctx is done,
+// ctx deadline is set as request deadline.
+func Call(ctx context.Context, r Requester, uri string, req, rsp interface{}) error {
+	m := amp.NewRequest(uri, req)
+	if d, ok := ctx.Deadline(); ok {
+		m.SetDeadline(time.Until(d))
+	}
+	ch := make(oneShot, 1)
+	r.Send(ch, m)
+	select {
+	case m := <-ch:
+		if err := m.Err(); err != nil {
+			return err
+		}
+		if rsp == nil {
+			return nil
+		}
+		return errors.WithStack(m.Unmarshal(rsp))
+	case <-ctx.Done():
+		return errors.Wrapf(ctx.Err(), "request %s", uri)
+	}
+}
+
+// oneShot receives single response
+type oneShot chan *amp.Msg
+
+func (c oneShot) Send(m *amp.Msg) {
+	select {
+	case c <- m:
+	default:
+	}
+}
@@ -0,0 +1,43 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/inmem"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCall(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bus := inmem.New()
+	bus.NewResponder(ctx, func(ctx context.Context, m *amp.Msg) (*amp.Msg, error) {
+		var p struct{ X, Y int }
+		if err := m.Unmarshal(&p); err != nil {
+			return nil, err
+		}
+		if p.X < 0 {
+			return nil, amp.Errf(-1, "negative")
+		}
+		if p.X == 42 {
+			return nil, nil // no response
+		}
+		return m.Response(map[string]int{"z": p.X + p.Y}), nil
+	}, []string{"math.req"})
+	r := bus.NewRequester(ctx)
+
+	var rsp struct{ Z int }
+	assert.NoError(t, Call(ctx, r, "math.req/add", map[string]int{"x": 1, "y": 2}, &rsp))
+	assert.Equal(t, 3, rsp.Z)
+
+	err := Call(ctx, r, "math.req/add", map[string]int{"x": -1}, &rsp)
+	assert.Equal(t, -1, err.(*amp.Error).Code)
+
+	tctx, tcancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer tcancel()
+	err = Call(tctx, r, "math.req/add", map[string]int{"x": 42}, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,158 @@
+// Package client is amp consumer for Go services and tools.
+//
+// Client connects over websocket or nsq transport, keeps map of
+// subscriptions with the last received Ts and re-subscribes with
+// that map after each reconnect, so only missed messages are replayed.
+// Replayed messages which are already received are dropped.
+// Messages which require ack (see amp.NewAck) are acknowledged by the
+// websocket and tcp transports on receipt.
+//
+// Example:
+//
+//	c := client.NewWS(ctx, "ws://localhost:8090/api")
+//	c.OnMessage("math.v1", func(m *amp.Msg) {
+//		...
+//	})
+//	c.Wait()
+package client
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/minus5/svckit/amp"
+)
+
+type transport interface {
+	Subscribe(subscriptions map[string]int64) // send current subscriptions
+	Messages() <-chan *amp.Msg                // received messages, closed on exit
+}
+
+// Client dispatches received messages to the registered handlers.
+type Client struct {
+	transport     transport
+	handlers      map[string][]func(*amp.Msg) // handlers by uri
+	subscriptions map[string]int64            // subscribed uris with last received ts
+	assembler     *amp.Assembler              // chunked fulls
+	closed        chan struct{}
+	sync.Mutex
+}
+
+func newClient(t transport) *Client {
+	c := &Client{
+		transport:     t,
+		handlers:      make(map[string][]func(*amp.Msg)),
+		subscriptions: make(map[string]int64),
+		assembler:     amp.NewAssembler(),
+		closed:        make(chan struct{}),
+	}
+	go c.loop()
+	return c
+}
+
+// OnMessage subscribes to the uri and registers fn to be called on each
+// message for that uri. Uri could be topic or topic/path.
+func (c *Client) OnMessage(uri string, fn func(*amp.Msg)) {
+	c.Lock()
+	c.handlers[uri] = append(c.handlers[uri], fn)
+	_, subscribed := c.subscriptions[uri]
+	if !subscribed {
+		c.subscriptions[uri] = 0
+	}
+	subs := c.copySubscriptions()
+	c.Unlock()
+
+	if !subscribed {
+		c.transport.Subscribe(subs)
+	}
+}
+
+// Subscriptions returns subscribed uris with last received ts.
+// Transport uses them to re-subscribe after reconnect.
+func (c *Client) Subscriptions() map[string]int64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.copySubscriptions()
+}
+
+// should be called during c.Lock
+func (c *Client) copySubscriptions() map[string]int64 {
+	subs := make(map[string]int64)
+	for k, v := range c.subscriptions {
+		subs[k] = v
+	}
+	return subs
+}
+
+// Wait blocks until transport is closed.
+func (c *Client) Wait() {
+	<-c.closed
+}
+
+func (c *Client) loop() {
+	defer close(c.closed)
+	for m := range c.transport.Messages() {
+		c.receive(m)
+	}
+}
+
+func (c *Client) receive(m *amp.Msg) {
+	if m.Type != amp.Publish {
+		return
+	}
+	c.Lock()
+	if m.IsChunk() {
+		if m = c.assembler.Add(m); m == nil {
+			c.Unlock()
+			return
+		}
+	}
+	uri, ok := c.findURI(m)
+	if !ok {
+		c.Unlock()
+		return
+	}
+	if c.isDuplicate(uri, m) {
+		c.Unlock()
+		return
+	}
+	if m.Ts > 0 && m.UpdateType != amp.BurstStart && m.UpdateType != amp.BurstEnd {
+		c.subscriptions[uri] = m.Ts
+	}
+	handlers := c.handlers[uri]
+	c.Unlock()
+
+	for _, h := range handlers {
+		h(m)
+	}
+}
+
+// isDuplicate checks whether message is already received.
+// Should be called during c.Lock.
+func (c *Client) isDuplicate(uri string, m *amp.Msg) bool {
+	ts := c.subscriptions[uri]
+	if ts == 0 || m.Ts == 0 {
+		return false
+	}
+	if m.IsReplay() {
+		return m.Ts <= ts
+	}
+	return m.Ts == ts && !m.IsFull()
+}
+
+// findURI finds subscribed uri for the message.
+// Should be called during c.Lock.
+func (c *Client) findURI(m *amp.Msg) (string, bool) {
+	if _, ok := c.subscriptions[m.URI]; ok {
+		return m.URI, true
+	}
+	if _, ok := c.subscriptions[m.Topic()]; ok {
+		return m.Topic(), true
+	}
+	for uri := range c.subscriptions {
+		if strings.HasPrefix(m.URI, uri+"/") {
+			return uri, true
+		}
+	}
+	return "", false
+}
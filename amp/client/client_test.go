@@ -0,0 +1,45 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+type testTransport struct {
+	out  chan *amp.Msg
+	subs []map[string]int64
+}
+
+func (t *testTransport) Subscribe(s map[string]int64) { t.subs = append(t.subs, s) }
+func (t *testTransport) Messages() <-chan *amp.Msg    { return t.out }
+
+func TestClientDispatchAndDeduplicate(t *testing.T) {
+	tr := &testTransport{out: make(chan *amp.Msg, 16)}
+	c := newClient(tr)
+
+	var received []*amp.Msg
+	c.OnMessage("math.v1", func(m *amp.Msg) { received = append(received, m) })
+	assert.Len(t, tr.subs, 1)
+	assert.Equal(t, int64(0), tr.subs[0]["math.v1"])
+
+	m1 := &amp.Msg{Type: amp.Publish, URI: "math.v1/i", Ts: 1, UpdateType: amp.Full}
+	m2 := &amp.Msg{Type: amp.Publish, URI: "math.v1/i", Ts: 2, UpdateType: amp.Diff}
+	tr.out <- m1
+	tr.out <- m2
+	tr.out <- m1.AsReplay() // already have it
+	tr.out <- m2            // duplicate
+	tr.out <- &amp.Msg{Type: amp.Publish, URI: "chat/1", Ts: 3}
+	m3 := &amp.Msg{Type: amp.Publish, URI: "math.v1/i", Ts: 3, UpdateType: amp.Diff}
+	tr.out <- m3.AsReplay()
+	close(tr.out)
+	c.Wait()
+
+	assert.Len(t, received, 3)
+	assert.Equal(t, m1, received[0])
+	assert.Equal(t, m2, received[1])
+	assert.Equal(t, int64(3), received[2].Ts)
+	// last ts is used for re-subscribe
+	assert.Equal(t, int64(3), c.Subscriptions()["math.v1"])
+}
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"context"
+	"sync"
+
+	"github.com/minus5/svckit/amp"
+	ampnsq "github.com/minus5/svckit/amp/nsq"
+)
+
+type nsqTransport struct {
+	ctx       context.Context
+	requester *ampnsq.Requester
+	topics    map[string]struct{} // nsq topics we are consuming
+	uris      map[string]struct{} // uris for which current is requested
+	out       chan *amp.Msg
+	consumers sync.WaitGroup
+	sync.Mutex
+}
+
+// NewNSQ creates client which consumes nsq topics directly.
+// On each new subscription current state is requested from the producer.
+func NewNSQ(ctx context.Context) *Client {
+	t := &nsqTransport{
+		ctx:       ctx,
+		requester: ampnsq.MustRequester(ctx),
+		topics:    make(map[string]struct{}),
+		uris:      make(map[string]struct{}),
+		out:       make(chan *amp.Msg, 16),
+	}
+	go func() {
+		<-ctx.Done()
+		t.requester.Wait()
+		t.consumers.Wait()
+		close(t.out)
+	}()
+	return newClient(t)
+}
+
+func (t *nsqTransport) Messages() <-chan *amp.Msg {
+	return t.out
+}
+
+// Subscribe starts consuming nsq topic for each new uri,
+// and requests current state for it.
+// Nsq consumer handles reconnects itself.
+func (t *nsqTransport) Subscribe(subscriptions map[string]int64) {
+	t.Lock()
+	defer t.Unlock()
+	for uri := range subscriptions {
+		if _, ok := t.uris[uri]; ok {
+			continue
+		}
+		t.uris[uri] = struct{}{}
+		topic := amp.NewCurrent(uri).Topic()
+		if _, ok := t.topics[topic]; !ok {
+			t.topics[topic] = struct{}{}
+			t.consume(topic)
+		}
+		t.requester.Current(uri)
+	}
+}
+
+func (t *nsqTransport) consume(topic string) {
+	in := ampnsq.Subscribe(t.ctx, []string{topic})
+	t.consumers.Add(1)
+	go func() {
+		defer t.consumers.Done()
+		for m := range in {
+			t.out <- m
+		}
+	}()
+}
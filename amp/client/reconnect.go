@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/signal"
+)
+
+// retry calls connect until it succeeds or ctx is done.
+// Reconnect hint from the server disconnect message (if any) sets delay
+// before the first attempt and backoff policy, otherwise default
+// exponential backoff is used.
+func retry(ctx context.Context, connect func() error, h *amp.ReconnectHint) error {
+	if h != nil && h.Delay > 0 {
+		if err := sleep(ctx, time.Duration(h.Delay)*time.Millisecond); err != nil {
+			return err
+		}
+	}
+	if h == nil || h.Backoff == nil {
+		return signal.WithBackoff(ctx, connect, maxReconnectInterval, 0)
+	}
+	for attempt := 0; ; attempt++ {
+		if err := connect(); err == nil {
+			return nil
+		}
+		if err := sleep(ctx, h.Backoff.Delay(attempt)); err != nil {
+			return err
+		}
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// redirect returns url of the gateway to reconnect to by the hint
+// address. Address is url which replaces the current one, or host:port
+// which replaces host in the current url.
+func redirect(current, address string) string {
+	if address == "" {
+		return current
+	}
+	if strings.Contains(address, "://") {
+		return address
+	}
+	u, err := url.Parse(current)
+	if err != nil {
+		return current
+	}
+	u.Host = address
+	return u.String()
+}
+
+// redirectAddr returns host:port to reconnect to by the hint address.
+func redirectAddr(current, address string) string {
+	if address == "" {
+		return current
+	}
+	if strings.Contains(address, "://") {
+		u, err := url.Parse(address)
+		if err != nil || u.Host == "" {
+			return current
+		}
+		return u.Host
+	}
+	return address
+}
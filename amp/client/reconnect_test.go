@@ -0,0 +1,18 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirect(t *testing.T) {
+	cur := "ws://gw1:8080/api?user=u1"
+	assert.Equal(t, cur, redirect(cur, ""))
+	assert.Equal(t, "ws://gw2:9090/api?user=u1", redirect(cur, "gw2:9090"))
+	assert.Equal(t, "wss://gw2/api", redirect(cur, "wss://gw2/api"))
+
+	assert.Equal(t, "gw1:8080", redirectAddr("gw1:8080", ""))
+	assert.Equal(t, "gw2:9090", redirectAddr("gw1:8080", "gw2:9090"))
+	assert.Equal(t, "gw2:9090", redirectAddr("gw1:8080", "tcp://gw2:9090"))
+}
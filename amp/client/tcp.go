@@ -0,0 +1,145 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/tcp"
+	"github.com/minus5/svckit/log"
+)
+
+type tcpTransport struct {
+	addr          string
+	tlsConfig     *tls.Config
+	conn          *tcp.Conn
+	out           chan *amp.Msg
+	subscriptions func() map[string]int64
+	hint          *amp.ReconnectHint // from the last disconnect message
+	sync.Mutex
+}
+
+// NewTCP creates client connected to the amp tcp server on addr (host:port).
+// If tlsConfig is not nil connection is tls.
+// Reconnects until ctx is done.
+func NewTCP(ctx context.Context, addr string, tlsConfig *tls.Config) *Client {
+	t := &tcpTransport{
+		addr:      addr,
+		tlsConfig: tlsConfig,
+		out:       make(chan *amp.Msg, 16),
+	}
+	c := newClient(t)
+	t.subscriptions = c.Subscriptions
+	go t.loop(ctx)
+	return c
+}
+
+func (t *tcpTransport) Messages() <-chan *amp.Msg {
+	return t.out
+}
+
+// Subscribe sends subscriptions if connected.
+// On connect subscriptions are sent anyway.
+func (t *tcpTransport) Subscribe(subscriptions map[string]int64) {
+	t.Lock()
+	defer t.Unlock()
+	if t.conn == nil {
+		return
+	}
+	m := &amp.Msg{Type: amp.Subscribe, Subscriptions: subscriptions}
+	if err := t.conn.Write(m.Marshal(), false); err != nil {
+		log.S("addr", t.addr).Error(err)
+	}
+}
+
+func (t *tcpTransport) loop(ctx context.Context) {
+	defer close(t.out)
+	go func() {
+		<-ctx.Done()
+		t.Lock()
+		defer t.Unlock()
+		if t.conn != nil {
+			_ = t.conn.Close()
+		}
+	}()
+
+	for {
+		conn, err := t.dial(ctx)
+		if err != nil {
+			return
+		}
+		t.read(conn)
+		t.Lock()
+		t.conn = nil
+		t.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		log.S("addr", t.addr).Info("reconnecting")
+	}
+}
+
+// dial connects and sends all current subscriptions.
+// Retries until ctx is done.
+func (t *tcpTransport) dial(ctx context.Context) (*tcp.Conn, error) {
+	var conn *tcp.Conn
+	connect := func() error {
+		c, err := tcp.Dial(ctx, t.addr, t.tlsConfig)
+		if err != nil {
+			log.S("addr", t.addr).Error(err)
+			return err
+		}
+		t.Lock()
+		defer t.Unlock()
+		m := &amp.Msg{Type: amp.Subscribe, Subscriptions: t.subscriptions(), Version: amp.ProtocolVersion}
+		if err := c.Write(m.Marshal(), false); err != nil {
+			return err
+		}
+		t.conn = c
+		conn = c
+		return nil
+	}
+	h := t.hint
+	t.hint = nil
+	if h != nil && h.Address != "" {
+		t.addr = redirectAddr(t.addr, h.Address)
+		log.S("addr", t.addr).Info("redirected")
+	}
+	if err := retry(ctx, connect, h); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// read receives messages, replies to the server pings and acknowledges
+// messages which require it
+func (t *tcpTransport) read(conn *tcp.Conn) {
+	for {
+		buf, err := conn.Read()
+		if err != nil {
+			return
+		}
+		m := amp.Parse(buf)
+		if m == nil {
+			continue
+		}
+		if m.IsPing() {
+			t.Lock()
+			_ = conn.Write(m.Pong().Marshal(), false)
+			t.Unlock()
+			continue
+		}
+		if m.RequiresAck {
+			t.Lock()
+			_ = conn.Write(amp.NewAck(m).Marshal(), false)
+			t.Unlock()
+		}
+		if h, ok := m.ReconnectHint(); ok {
+			t.hint = &h
+		}
+		t.out <- m
+	}
+}
@@ -0,0 +1,151 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+	"github.com/pkg/errors"
+)
+
+var (
+	maxReconnectInterval = 10 * time.Second
+)
+
+type wsTransport struct {
+	url           string
+	conn          net.Conn
+	out           chan *amp.Msg
+	subscriptions func() map[string]int64
+	hint          *amp.ReconnectHint // from the last disconnect message
+	sync.Mutex
+}
+
+// NewWS creates client connected to the amp websocket gateway on url.
+// Reconnects until ctx is done.
+func NewWS(ctx context.Context, url string) *Client {
+	t := &wsTransport{
+		url: url,
+		out: make(chan *amp.Msg, 16),
+	}
+	c := newClient(t)
+	t.subscriptions = c.Subscriptions
+	go t.loop(ctx)
+	return c
+}
+
+func (t *wsTransport) Messages() <-chan *amp.Msg {
+	return t.out
+}
+
+// Subscribe sends subscriptions if connected.
+// On connect subscriptions are sent anyway.
+func (t *wsTransport) Subscribe(subscriptions map[string]int64) {
+	t.Lock()
+	defer t.Unlock()
+	if t.conn == nil {
+		return
+	}
+	if err := t.write(subscriptions); err != nil {
+		log.S("url", t.url).Error(err)
+		_ = t.conn.Close()
+	}
+}
+
+// should be called during t.Lock
+func (t *wsTransport) write(subscriptions map[string]int64) error {
+	m := &amp.Msg{Type: amp.Subscribe, Subscriptions: subscriptions, Version: amp.ProtocolVersion}
+	return errors.WithStack(wsutil.WriteClientText(t.conn, m.Marshal()))
+}
+
+func (t *wsTransport) loop(ctx context.Context) {
+	defer close(t.out)
+	go func() {
+		<-ctx.Done()
+		t.Lock()
+		defer t.Unlock()
+		if t.conn != nil {
+			_ = t.conn.Close()
+		}
+	}()
+
+	for {
+		conn, err := t.dial(ctx)
+		if err != nil {
+			return
+		}
+		t.read(conn)
+		t.Lock()
+		t.conn = nil
+		t.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		log.S("url", t.url).Info("reconnecting")
+	}
+}
+
+// dial connects and sends all current subscriptions.
+// Retries until ctx is done.
+func (t *wsTransport) dial(ctx context.Context) (net.Conn, error) {
+	var conn net.Conn
+	connect := func() error {
+		c, _, _, err := ws.Dial(ctx, t.url)
+		if err != nil {
+			log.S("url", t.url).Error(err)
+			return err
+		}
+		t.Lock()
+		defer t.Unlock()
+		t.conn = c
+		if err := t.write(t.subscriptions()); err != nil {
+			t.conn = nil
+			_ = c.Close()
+			return err
+		}
+		conn = c
+		return nil
+	}
+	h := t.hint
+	t.hint = nil
+	if h != nil && h.Address != "" {
+		t.url = redirect(t.url, h.Address)
+		log.S("url", t.url).Info("redirected")
+	}
+	if err := retry(ctx, connect, h); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (t *wsTransport) read(conn net.Conn) {
+	for {
+		buf, _, err := wsutil.ReadServerData(conn)
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+		if m := amp.Parse(buf); m != nil {
+			if m.RequiresAck {
+				t.Lock()
+				err = wsutil.WriteClientText(conn, amp.NewAck(m).Marshal())
+				t.Unlock()
+				if err != nil {
+					_ = conn.Close()
+					return
+				}
+			}
+			if h, ok := m.ReconnectHint(); ok {
+				t.hint = &h
+			}
+			t.out <- m
+		}
+	}
+}
@@ -0,0 +1,404 @@
+// Package cluster coordinates gateway instances running behind the load
+// balancer over the NSQ cluster topic:
+//
+//   - current requests (state of the topic for the new subscribers) are
+//     sent upstream once per window by the topic owner, instead of by
+//     every instance on which clients subscribe; producer publishes
+//     current state to all instances
+//   - parked sessions (see session.Resume) are shared, client can resume
+//     on any instance; session is registered on its owner member which
+//     grants it to the first claiming instance, resume tokens are never
+//     published, only their hashes
+//
+// Instances are members of the consumer group (see amp/group), each
+// topic and parked session is owned by one live member. Upstream
+// subscriptions and replay caches are not shared, every instance
+// consumes topics of its clients and keeps its own broker cache.
+//
+//	g := group.New("gateway", 30*time.Second)
+//	g.Announce(ctx, presence.Gateway, version, 10*time.Second, pub.Publish)
+//	go g.Consume(ctx, nsq.Subscribe(ctx, []string{presence.Topic}))
+//	c := cluster.New(g, pub.Publish)
+//	go c.Consume(ctx, nsq.Subscribe(ctx, []string{cluster.Topic}))
+//	b := broker.New(c.Current(requester.Current))
+//	sessions := session.Factory(ctx, b, requester, session.Resume(time.Minute), session.SharedResume(c))
+//
+// Every instance must consume cluster topic on its own channel.
+// Subscriptions of the resumed session are restored from the last
+// delivered messages, responses and acks waiting on the other instance
+// are not moved. Sessions parked on the owner which left the group can't
+// be resumed on the other instances.
+package cluster
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+)
+
+// Topic is topic of the cluster messages.
+const Topic = "system.cluster"
+
+// Kinds of the cluster messages, path of the message uri.
+const (
+	kindCurrent = "current"
+	kindPark    = "park"
+	kindClaim   = "claim"
+	kindGrant   = "grant"
+	kindRelease = "release"
+)
+
+type members interface {
+	Self() string
+	Owner(key string) string
+}
+
+// Current is body of the current request forwarded to the topic owner.
+type Current struct {
+	Topic string `json:"topic"`
+}
+
+// Parked is body of the parked session registration sent to the session
+// owner.
+type Parked struct {
+	Ref      string           `json:"ref"`      // hash of the resume token
+	Identity string           `json:"identity"` // hash of the client identity
+	Instance string           `json:"instance"` // instance where session is parked
+	Subs     map[string]int64 `json:"subs"`     // subscriptions with ts of the last delivered message
+	Until    int64            `json:"until"`    // end of the grace period, unix milli
+}
+
+// Claim is body of the request to the session owner to resume session on
+// the instance.
+type Claim struct {
+	Ref      string `json:"ref"`
+	Identity string `json:"identity"`
+	Instance string `json:"instance"` // claiming instance
+}
+
+// Grant is body of the session owner reply to the claim.
+type Grant struct {
+	Ref      string           `json:"ref"`
+	Instance string           `json:"instance"`         // claiming instance
+	Parked   string           `json:"parked,omitempty"` // instance where session was parked, empty if claim is denied
+	Subs     map[string]int64 `json:"subs,omitempty"`
+}
+
+// Release is body of the announcement that session is resumed locally or
+// expired.
+type Release struct {
+	Ref string `json:"ref"`
+}
+
+// Cluster shares current requests and parked sessions between instances.
+type Cluster struct {
+	members  members
+	publish  func(*amp.Msg)
+	current  func(topic string)
+	window   time.Duration
+	timeout  time.Duration
+	requests map[string]time.Time  // last current request by topic
+	parked   map[string]*Parked    // sessions owned by this instance, by ref
+	taken    map[string]func()     // sessions parked on this instance, by ref
+	claims   map[string]chan Grant // claims of this instance waiting for the owner, by ref
+	sync.Mutex
+}
+
+// Window sets minimal interval between current requests of the topic,
+// default 1s.
+func Window(d time.Duration) func(*Cluster) {
+	return func(c *Cluster) {
+		c.window = d
+	}
+}
+
+// Timeout sets how long to wait for the session owner reply when
+// resuming session, default 1s.
+func Timeout(d time.Duration) func(*Cluster) {
+	return func(c *Cluster) {
+		if d > 0 {
+			c.timeout = d
+		}
+	}
+}
+
+// New creates cluster of the group members, cluster messages are
+// published with publish.
+func New(m members, publish func(*amp.Msg), opts ...func(*Cluster)) *Cluster {
+	c := &Cluster{
+		members:  m,
+		publish:  publish,
+		window:   time.Second,
+		timeout:  time.Second,
+		requests: make(map[string]time.Time),
+		parked:   make(map[string]*Parked),
+		taken:    make(map[string]func()),
+		claims:   make(map[string]chan Grant),
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+func (c *Cluster) send(kind string, o interface{}) {
+	c.publish(amp.NewPublish(Topic, kind, amp.TS(), amp.Append, o))
+}
+
+// owns returns whether this instance is the owner of the key
+func (c *Cluster) owns(key string) bool {
+	return c.members.Owner(key) == c.members.Self()
+}
+
+// ref is the key of the parked session, resume tokens are never published
+func ref(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// Current wraps broker current function. Request is sent upstream by the
+// topic owner, other instances forward it to the owner.
+func (c *Cluster) Current(current func(topic string)) func(topic string) {
+	c.Lock()
+	c.current = current
+	c.Unlock()
+	return func(topic string) {
+		if !c.owns(topic) {
+			metric.Counter("cluster.current.forwarded")
+			c.send(kindCurrent, Current{Topic: topic})
+			return
+		}
+		c.requestCurrent(topic)
+	}
+}
+
+// requestCurrent sends current request once per window
+func (c *Cluster) requestCurrent(topic string) {
+	c.Lock()
+	now := time.Now()
+	if last, ok := c.requests[topic]; ok && now.Sub(last) < c.window {
+		c.Unlock()
+		metric.Counter("cluster.current.deduplicated")
+		return
+	}
+	c.requests[topic] = now
+	for t, at := range c.requests {
+		if now.Sub(at) >= c.window {
+			delete(c.requests, t)
+		}
+	}
+	f := c.current
+	c.Unlock()
+	if f != nil {
+		f(topic)
+	}
+}
+
+// Park registers session parked on this instance on the session owner.
+// Taken is called when session is resumed on the other instance.
+func (c *Cluster) Park(token, identity string, subs map[string]int64, until time.Time, taken func()) {
+	p := Parked{
+		Ref:      ref(token),
+		Identity: identity,
+		Instance: c.members.Self(),
+		Subs:     subs,
+		Until:    until.UnixNano() / int64(time.Millisecond),
+	}
+	c.Lock()
+	c.taken[p.Ref] = taken
+	c.Unlock()
+	if c.owns(p.Ref) {
+		c.park(p)
+		return
+	}
+	c.send(kindPark, p)
+}
+
+// Take claims session parked on the other instance from the session
+// owner, returns its subscriptions. False if there is no such session, it
+// is parked by the other client, already resumed or owner doesn't reply
+// in time.
+func (c *Cluster) Take(token, identity string) (map[string]int64, bool) {
+	cl := Claim{Ref: ref(token), Identity: identity, Instance: c.members.Self()}
+	ch := make(chan Grant, 1)
+	c.Lock()
+	c.claims[cl.Ref] = ch
+	c.Unlock()
+	defer func() {
+		c.Lock()
+		if c.claims[cl.Ref] == ch {
+			delete(c.claims, cl.Ref)
+		}
+		c.Unlock()
+	}()
+	if c.owns(cl.Ref) {
+		c.claim(cl)
+	} else {
+		c.send(kindClaim, cl)
+	}
+	select {
+	case g := <-ch:
+		if g.Parked == "" {
+			return nil, false
+		}
+		metric.Counter("cluster.resumed")
+		return g.Subs, true
+	case <-time.After(c.timeout):
+		metric.Counter("cluster.claimTimeout")
+		return nil, false
+	}
+}
+
+// Release removes session parked on this instance, which is resumed
+// locally or expired.
+func (c *Cluster) Release(token string) {
+	r := Release{Ref: ref(token)}
+	c.Lock()
+	delete(c.taken, r.Ref)
+	c.Unlock()
+	if c.owns(r.Ref) {
+		c.release(r)
+		return
+	}
+	c.send(kindRelease, r)
+}
+
+// park registers parked session on the owner
+func (c *Cluster) park(p Parked) {
+	c.Lock()
+	defer c.Unlock()
+	c.parked[p.Ref] = &p
+	c.expire()
+}
+
+// claim grants parked session to the first claiming instance of the same
+// client, called on the session owner
+func (c *Cluster) claim(cl Claim) {
+	g := Grant{Ref: cl.Ref, Instance: cl.Instance}
+	c.Lock()
+	c.expire()
+	if p, ok := c.parked[cl.Ref]; ok && p.Identity == cl.Identity && p.Instance != cl.Instance {
+		delete(c.parked, cl.Ref)
+		g.Parked = p.Instance
+		g.Subs = p.Subs
+	}
+	c.Unlock()
+	c.grant(g)
+	if g.Instance != c.members.Self() || (g.Parked != "" && g.Parked != c.members.Self()) {
+		c.send(kindGrant, g)
+	}
+}
+
+// release removes parked session from the owner
+func (c *Cluster) release(r Release) {
+	c.Lock()
+	delete(c.parked, r.Ref)
+	c.Unlock()
+}
+
+// grant applies owner decision on the claim, on the claiming instance and
+// on the instance where session is parked
+func (c *Cluster) grant(g Grant) {
+	self := c.members.Self()
+	var ch chan Grant
+	var taken func()
+	c.Lock()
+	if g.Instance == self {
+		ch = c.claims[g.Ref]
+		delete(c.claims, g.Ref)
+	}
+	if g.Parked == self {
+		taken = c.taken[g.Ref]
+		delete(c.taken, g.Ref)
+	}
+	c.Unlock()
+	if ch != nil {
+		ch <- g
+	}
+	if taken != nil {
+		taken()
+	}
+}
+
+// Add applies cluster message of the other instance.
+func (c *Cluster) Add(m *amp.Msg) {
+	if m.Topic() != Topic {
+		return
+	}
+	switch m.Path() {
+	case kindCurrent:
+		var r Current
+		if err := m.Unmarshal(&r); err != nil {
+			log.Error(err)
+			return
+		}
+		if c.owns(r.Topic) {
+			c.requestCurrent(r.Topic)
+		}
+	case kindPark:
+		var p Parked
+		if err := m.Unmarshal(&p); err != nil {
+			log.Error(err)
+			return
+		}
+		if c.owns(p.Ref) {
+			c.park(p)
+		}
+	case kindClaim:
+		var cl Claim
+		if err := m.Unmarshal(&cl); err != nil {
+			log.Error(err)
+			return
+		}
+		if c.owns(cl.Ref) {
+			c.claim(cl)
+		}
+	case kindGrant:
+		var g Grant
+		if err := m.Unmarshal(&g); err != nil {
+			log.Error(err)
+			return
+		}
+		c.grant(g)
+	case kindRelease:
+		var r Release
+		if err := m.Unmarshal(&r); err != nil {
+			log.Error(err)
+			return
+		}
+		if c.owns(r.Ref) {
+			c.release(r)
+		}
+	}
+}
+
+// expire removes owned sessions after grace period, should be called during c.Lock
+func (c *Cluster) expire() {
+	now := amp.TS()
+	for token, p := range c.parked {
+		if p.Until < now {
+			delete(c.parked, token)
+		}
+	}
+}
+
+// Consume applies cluster messages from in, until in is closed or ctx is done.
+func (c *Cluster) Consume(ctx context.Context, in <-chan *amp.Msg) {
+	for {
+		select {
+		case m, ok := <-in:
+			if !ok {
+				return
+			}
+			c.Add(m)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
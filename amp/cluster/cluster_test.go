@@ -0,0 +1,107 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+// testMembers owns topics by the first letter
+type testMembers struct {
+	self string
+}
+
+func (m testMembers) Self() string { return m.self }
+func (m testMembers) Owner(key string) string {
+	if key < "m" {
+		return "gw1"
+	}
+	return "gw2"
+}
+
+// testCluster creates instances connected with the in memory topic
+func testCluster() (*Cluster, *Cluster) {
+	var c1, c2 *Cluster
+	publish := func(m *amp.Msg) {
+		m = amp.Parse(m.Marshal())
+		c1.Add(m)
+		c2.Add(m)
+	}
+	c1 = New(testMembers{"gw1"}, publish, Window(time.Minute))
+	c2 = New(testMembers{"gw2"}, publish, Window(time.Minute))
+	return c1, c2
+}
+
+func TestCurrent(t *testing.T) {
+	c1, c2 := testCluster()
+	var requested []string
+	current := func(topic string) { requested = append(requested, topic) }
+	cur1 := c1.Current(current)
+	cur2 := c2.Current(func(topic string) { requested = append(requested, "gw2:"+topic) })
+
+	cur1("chat")
+	cur2("chat") // forwarded to gw1, deduplicated in window
+	cur2("odds") // owned by gw2
+	cur1("odds") // forwarded
+	assert.Equal(t, []string{"chat", "gw2:odds"}, requested)
+}
+
+func TestSharedResume(t *testing.T) {
+	c1, c2 := testCluster() // gw1 owns all refs
+	taken := 0
+	subs := map[string]int64{"chat": 10}
+
+	// parked on the owner, resumed on the other instance
+	c1.Park("s1", "id", subs, time.Now().Add(time.Minute), func() { taken++ })
+	_, ok := c1.Take("s1", "id") // parked on this instance, resumed locally
+	assert.False(t, ok)
+	_, ok = c2.Take("s1", "other") // other client
+	assert.False(t, ok)
+	assert.Equal(t, 0, taken)
+	s, ok := c2.Take("s1", "id")
+	assert.True(t, ok)
+	assert.Equal(t, subs, s)
+	assert.Equal(t, 1, taken)
+	assert.Len(t, c1.parked, 0)
+	assert.Len(t, c1.taken, 0)
+	_, ok = c2.Take("s1", "id")
+	assert.False(t, ok)
+
+	// parked on the other instance, resumed on the owner
+	c2.Park("s2", "id", subs, time.Now().Add(time.Minute), func() { taken++ })
+	assert.Len(t, c1.parked, 1)
+	assert.Len(t, c2.parked, 0)
+	s, ok = c1.Take("s2", "id")
+	assert.True(t, ok)
+	assert.Equal(t, subs, s)
+	assert.Equal(t, 2, taken)
+	assert.Len(t, c2.taken, 0)
+
+	// released (resumed locally or expired) is not resumed on other instance
+	c2.Park("s3", "id", subs, time.Now().Add(time.Minute), func() { taken++ })
+	c2.Release("s3")
+	_, ok = c1.Take("s3", "id")
+	assert.False(t, ok)
+
+	// expired grace period
+	c1.Park("s4", "id", subs, time.Now().Add(-time.Millisecond), func() { taken++ })
+	_, ok = c2.Take("s4", "id")
+	assert.False(t, ok)
+	assert.Equal(t, 2, taken)
+}
+
+func TestSharedResumeTokens(t *testing.T) {
+	var published []string
+	c := New(testMembers{"gw2"}, func(m *amp.Msg) { published = append(published, string(m.Marshal())) }, Timeout(time.Millisecond))
+	c.Park("secret-token", "id", nil, time.Now().Add(time.Minute), func() {})
+	_, ok := c.Take("secret-token", "id") // owner doesn't reply
+	assert.False(t, ok)
+	c.Release("secret-token")
+	assert.Len(t, published, 3)
+	for _, m := range published {
+		assert.NotContains(t, m, "secret-token")
+	}
+	assert.Len(t, c.claims, 0)
+}
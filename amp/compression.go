@@ -0,0 +1,91 @@
+package amp
+
+import "sync"
+
+// Compression policy modes
+const (
+	CompressAuto   uint8 = iota // compress messages larger than threshold
+	CompressAlways              // compress every message
+	CompressNever               // never compress, for incompressible (binary) topics
+)
+
+// CompressionPolicy decides whether message is compressed when the
+// connection supports compression.
+type CompressionPolicy struct {
+	Mode      uint8 // CompressAuto, CompressAlways or CompressNever
+	Threshold int   // min payload size for CompressAuto, default limit if 0
+	Algorithm uint8 // CompressionDeflate, used also when 0
+}
+
+var compressionPolicies = struct {
+	limit  int
+	topics map[string]CompressionPolicy
+	sync.RWMutex
+}{
+	limit:  8 * 1024,
+	topics: make(map[string]CompressionPolicy),
+}
+
+// SetCompressionLimit sets default threshold, messages smaller than limit
+// are not compressed.
+func SetCompressionLimit(n int) {
+	compressionPolicies.Lock()
+	defer compressionPolicies.Unlock()
+	compressionPolicies.limit = n
+}
+
+// SetTopicCompression sets compression policy for the topic messages.
+func SetTopicCompression(topic string, p CompressionPolicy) {
+	compressionPolicies.Lock()
+	defer compressionPolicies.Unlock()
+	compressionPolicies.topics[topic] = p
+}
+
+// RemoveTopicCompression returns topic to the default compression policy.
+func RemoveTopicCompression(topic string) {
+	compressionPolicies.Lock()
+	defer compressionPolicies.Unlock()
+	delete(compressionPolicies.topics, topic)
+}
+
+// TopicCompression returns compression policy of the topic.
+func TopicCompression(topic string) CompressionPolicy {
+	compressionPolicies.RLock()
+	defer compressionPolicies.RUnlock()
+	if p, ok := compressionPolicies.topics[topic]; ok {
+		return p
+	}
+	return CompressionPolicy{}
+}
+
+func compressionLimit() int {
+	compressionPolicies.RLock()
+	defer compressionPolicies.RUnlock()
+	return compressionPolicies.limit
+}
+
+// compression returns compression for the payload of size n
+// when the connection supports supportedCompression
+func (p CompressionPolicy) compression(supportedCompression uint8, n int) uint8 {
+	if supportedCompression == CompressionNone || p.Mode == CompressNever {
+		return CompressionNone
+	}
+	algorithm := p.Algorithm
+	if algorithm == CompressionNone {
+		algorithm = CompressionDeflate
+	}
+	if algorithm != supportedCompression {
+		return CompressionNone
+	}
+	if p.Mode == CompressAlways {
+		return algorithm
+	}
+	threshold := p.Threshold
+	if threshold == 0 {
+		threshold = compressionLimit()
+	}
+	if n < threshold {
+		return CompressionNone
+	}
+	return algorithm
+}
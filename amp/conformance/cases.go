@@ -0,0 +1,119 @@
+package conformance
+
+import (
+	"strings"
+
+	"github.com/minus5/svckit/amp"
+)
+
+const ts = int64(1700000000000)
+
+type testCase struct {
+	name    string
+	msg     *amp.Msg
+	deflate bool // add deflated payload
+}
+
+func cases() []testCase {
+	type xy struct {
+		X int `json:"x"`
+		Y int `json:"y"`
+	}
+	full := amp.NewPublish("math.v1", "i", ts, amp.Full, xy{1, 2})
+
+	appendMsg := amp.NewPublish("chat", "lobby", ts, amp.Append, map[string]string{"text": "hi"})
+	appendMsg.SetOffset(42)
+	appendMsg.CacheDepth = 100
+
+	subscribe := &amp.Msg{
+		Type:          amp.Subscribe,
+		Subscriptions: map[string]int64{"math.v1/i": 0, "chat/lobby": ts},
+		Filters:       map[string]string{"chat/lobby": "user == 'ana'"},
+	}
+
+	versioned := &amp.Msg{
+		Type:          amp.Subscribe,
+		Subscriptions: map[string]int64{"math.v1/i": 0},
+		Version:       amp.ProtocolVersion,
+	}
+
+	request := amp.NewRequest("math.req/add", xy{1, 2})
+	request.CorrelationID = 7
+	request.Timeout = 5000
+	request.Priority = amp.PriorityHigh
+	request.Meta = map[string]string{"client": "web"}
+
+	errRsp := request.ResponseError(amp.Errf(amp.ErrorCodeOverloaded, "overloaded"))
+	transportErr := request.ResponseTransportError(amp.Errf(0, "timeout"))
+
+	ping := &amp.Msg{Type: amp.Ping, CorrelationID: 3, Ts: ts}
+
+	status := amp.NewStatus("math.v1", amp.TopicStatus{Stale: true, LastAlive: ts - 30000})
+	status.Ts = ts
+
+	chunked := amp.NewPublish("sport.v1", "events", ts, amp.Full, strings.Repeat("abcdefghij", 4))
+	parts := amp.ChunkFull(chunked, 16)
+
+	binary := amp.NewPublishBinary("img", "logo", ts, amp.Full, []byte{0x89, 'P', 'N', 'G', 0, 0xff, '\n', 1}, "image/png")
+
+	encrypted := amp.NewPublish("odds", "1", ts, amp.Diff, "c2VjcmV0")
+	encrypted.KeyID = "k1"
+	dict := amp.NewPublish("odds", "2", ts, amp.Full, "ZGljdA==")
+	dict.DictID = "d1"
+	bridged := amp.NewPublish("chat", "", ts, amp.Full, nil)
+	bridged.Origin = "dc2"
+
+	large := amp.NewPublish("sport.v1", "all", ts, amp.Full,
+		map[string]string{"events": strings.Repeat("event ", 200)})
+
+	return []testCase{
+		{name: "publish full", msg: full, deflate: true},
+		{name: "publish diff", msg: amp.NewPublish("math.v1", "i", ts+1, amp.Diff, map[string]int{"x": 3})},
+		{name: "publish append with offset", msg: appendMsg},
+		{name: "publish update", msg: amp.NewPublish("scores", "m1", ts, amp.Update, map[string]int{"home": 1})},
+		{name: "publish close", msg: amp.NewPublish("scores", "m1", ts, amp.Close, nil)},
+		{name: "burst start", msg: full.BurstStart()},
+		{name: "burst end", msg: full.BurstEnd()},
+		{name: "replay", msg: amp.NewPublish("math.v1", "i", ts, amp.Full, xy{1, 2}).AsReplay()},
+		{name: "subscribe", msg: subscribe},
+		{name: "subscribe with protocol version", msg: versioned},
+		{name: "request", msg: request, deflate: true},
+		{name: "response", msg: request.Response(map[string]int{"z": 3})},
+		{name: "response error", msg: errRsp},
+		{name: "response transport error", msg: transportErr},
+		{name: "ping", msg: ping},
+		{name: "pong", msg: ping.Pong()},
+		{name: "alive", msg: amp.NewAlive()},
+		{name: "current", msg: amp.NewCurrent("math.v1/i")},
+		{name: "status", msg: status},
+		{name: "chunked full start", msg: parts[0]},
+		{name: "chunked full part", msg: parts[1]},
+		{name: "chunked full end", msg: parts[len(parts)-1]},
+		{name: "binary body", msg: binary},
+		{name: "encrypted body", msg: encrypted},
+		{name: "dictionary compressed body", msg: dict},
+		{name: "bridged", msg: bridged},
+		{name: "unicode and html in body", msg: amp.NewPublish("chat", "lobby", ts, amp.Append,
+			map[string]string{"text": "Čađ <b>&</b>\n\"ok\""})},
+		{name: "large deflated", msg: large, deflate: true},
+	}
+}
+
+// parseOnly vectors are accepted by the parser but serializer doesn't
+// produce them
+func parseOnly() []Vector {
+	return []Vector{
+		{
+			Name:      "header without separator",
+			Wire:      `{"t":4,"i":1}`,
+			ParseOnly: true,
+			Header:    map[string]interface{}{"type": 4, "correlationID": 1},
+		},
+		{
+			Name:      "unknown header keys",
+			Wire:      "{\"t\":5,\"w\":1,\"unknown\":\"x\"}\n",
+			ParseOnly: true,
+			Header:    map[string]interface{}{"type": 5},
+		},
+	}
+}
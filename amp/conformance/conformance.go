@@ -0,0 +1,238 @@
+// Package conformance contains golden test vectors of the amp wire format
+// and harness which checks implementation against them.
+//
+// Vectors are in testdata/vectors.json. Implementations in other languages
+// (browser client served by amp/ws, js sdk) load that file and for each
+// vector:
+//
+//   - take wire payload (Wire, or WireBase64 for binary body) and check
+//     that inflated Deflated payload is the same
+//   - parse payload and compare header (with long key names, see Keys)
+//     and body with Header and Body (BodyBase64 for binary body)
+//   - serialize parsed message and compare with the payload,
+//     vectors marked ParseOnly are only parsed
+//
+// After intentional protocol change regenerate vectors with:
+//
+//	go test ./amp/conformance -update
+package conformance
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/pkg/errors"
+)
+
+// Keys maps short wire header keys to the long names used in the vectors.
+var Keys = map[string]string{
+	"t": "type",
+	"r": "replyTo",
+	"i": "correlationID",
+	"e": "error",
+	"u": "uri",
+	"s": "ts",
+	"p": "updateType",
+	"l": "replay",
+	"b": "subscriptions",
+	"f": "filters",
+	"k": "chunk",
+	"h": "checksum",
+	"d": "cacheDepth",
+	"m": "meta",
+	"y": "priority",
+	"o": "origin",
+	"x": "keyID",
+	"z": "dictID",
+	"c": "contentType",
+	"n": "offset",
+	"a": "timeout",
+	"v": "version",
+}
+
+// ErrorKeys maps short keys of the error header to the long names.
+var ErrorKeys = map[string]string{
+	"s": "source",
+	"m": "message",
+	"c": "code",
+	"r": "retryable",
+}
+
+// Vector is single wire format test case.
+type Vector struct {
+	Name       string                 `json:"name"`
+	Wire       string                 `json:"wire,omitempty"`       // text payload
+	WireBase64 string                 `json:"wireBase64,omitempty"` // payload with binary body
+	Deflated   string                 `json:"deflated,omitempty"`   // base64 of websocket permessage-deflate payload
+	ParseOnly  bool                   `json:"parseOnly,omitempty"`  // accepted but not produced by serializer
+	Header     map[string]interface{} `json:"header"`               // header with long key names
+	Body       json.RawMessage        `json:"body,omitempty"`       // json body
+	BodyBase64 string                 `json:"bodyBase64,omitempty"` // binary body or part of the chunked full
+}
+
+// Payload returns wire payload of the vector.
+func (v Vector) Payload() ([]byte, error) {
+	if v.WireBase64 != "" {
+		buf, err := base64.StdEncoding.DecodeString(v.WireBase64)
+		return buf, errors.WithStack(err)
+	}
+	return []byte(v.Wire), nil
+}
+
+// Load reads vectors from the json file.
+func Load(file string) ([]Vector, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var vs []Vector
+	if err := json.Unmarshal(buf, &vs); err != nil {
+		return nil, errors.Wrap(err, file)
+	}
+	return vs, nil
+}
+
+// Check checks amp implementation against the vector.
+func Check(v Vector) error {
+	payload, err := v.Payload()
+	if err != nil {
+		return err
+	}
+	if v.Deflated != "" {
+		d, err := base64.StdEncoding.DecodeString(v.Deflated)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if !bytes.Equal(amp.Undeflate(d), payload) {
+			return errors.Errorf("%s: inflated payload differs", v.Name)
+		}
+	}
+	m := amp.Parse(payload)
+	if m == nil {
+		return errors.Errorf("%s: parse failed", v.Name)
+	}
+	h, err := Header(m)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(h, normalize(v.Header)) {
+		return errors.Errorf("%s: header %v, expected %v", v.Name, h, v.Header)
+	}
+	if err := checkBody(v, m.BodyBytes()); err != nil {
+		return err
+	}
+	if v.ParseOnly {
+		return nil
+	}
+	if out := m.Marshal(); !bytes.Equal(out, payload) {
+		return errors.Errorf("%s: serialized %q, expected %q", v.Name, out, payload)
+	}
+	return nil
+}
+
+func checkBody(v Vector, body []byte) error {
+	if v.BodyBase64 != "" {
+		if base64.StdEncoding.EncodeToString(body) != v.BodyBase64 {
+			return errors.Errorf("%s: binary body differs", v.Name)
+		}
+		return nil
+	}
+	if len(v.Body) == 0 && len(body) == 0 {
+		return nil
+	}
+	var got, expected interface{}
+	if err := json.Unmarshal(body, &got); err != nil {
+		return errors.Wrap(err, v.Name)
+	}
+	if err := json.Unmarshal(v.Body, &expected); err != nil {
+		return errors.Wrap(err, v.Name)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		return errors.Errorf("%s: body %s, expected %s", v.Name, body, v.Body)
+	}
+	return nil
+}
+
+// Header returns message header with long key names.
+func Header(m *amp.Msg) (map[string]interface{}, error) {
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var short map[string]interface{}
+	if err := json.Unmarshal(buf, &short); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	h := make(map[string]interface{})
+	for k, v := range short {
+		if k == "e" {
+			v = rename(v.(map[string]interface{}), ErrorKeys)
+		}
+		h[Keys[k]] = v
+	}
+	return h, nil
+}
+
+func rename(src map[string]interface{}, keys map[string]string) map[string]interface{} {
+	dst := make(map[string]interface{})
+	for k, v := range src {
+		dst[keys[k]] = v
+	}
+	return dst
+}
+
+// normalize converts header decoded from the vectors file to the same
+// types as Header returns
+func normalize(h map[string]interface{}) map[string]interface{} {
+	buf, _ := json.Marshal(h)
+	var n map[string]interface{}
+	_ = json.Unmarshal(buf, &n)
+	if n == nil {
+		n = make(map[string]interface{})
+	}
+	return n
+}
+
+// Generate creates vectors from the current implementation.
+func Generate() ([]Vector, error) {
+	var vs []Vector
+	for _, c := range cases() {
+		v, err := vector(c)
+		if err != nil {
+			return nil, err
+		}
+		vs = append(vs, v)
+	}
+	return append(vs, parseOnly()...), nil
+}
+
+func vector(c testCase) (Vector, error) {
+	v := Vector{Name: c.name}
+	payload := c.msg.Marshal()
+	if c.msg.IsBinary() {
+		v.WireBase64 = base64.StdEncoding.EncodeToString(payload)
+	} else {
+		v.Wire = string(payload)
+	}
+	if c.msg.IsBinary() || c.msg.IsChunk() {
+		// body of the chunk is not valid json by itself
+		v.BodyBase64 = base64.StdEncoding.EncodeToString(c.msg.BodyBytes())
+	} else {
+		v.Body = c.msg.BodyBytes()
+	}
+	if c.deflate {
+		d, _ := c.msg.MarshalPolicy(amp.CompatibilityVersionDefault,
+			amp.CompressionPolicy{Mode: amp.CompressAlways})
+		v.Deflated = base64.StdEncoding.EncodeToString(d)
+	}
+	h, err := Header(c.msg)
+	if err != nil {
+		return v, err
+	}
+	v.Header = h
+	return v, nil
+}
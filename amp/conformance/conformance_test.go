@@ -0,0 +1,70 @@
+package conformance
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/minus5/svckit/amp/ws"
+	"github.com/stretchr/testify/assert"
+)
+
+const vectorsFile = "testdata/vectors.json"
+
+var update = flag.Bool("update", false, "regenerate testdata/vectors.json")
+
+func TestGolden(t *testing.T) {
+	vs, err := Generate()
+	assert.NoError(t, err)
+	if *update {
+		buf, err := json.MarshalIndent(vs, "", "  ")
+		assert.NoError(t, err)
+		assert.NoError(t, ioutil.WriteFile(vectorsFile, append(buf, '\n'), 0644))
+	}
+
+	golden, err := Load(vectorsFile)
+	assert.NoError(t, err)
+	assert.Len(t, golden, len(vs))
+	for i, v := range vs {
+		if i >= len(golden) {
+			break
+		}
+		g := golden[i]
+		// deflate output may differ between compressor versions,
+		// Check verifies that deflated payload inflates to the wire
+		g.Deflated, v.Deflated = "", ""
+		ga, _ := json.Marshal(g)
+		va, _ := json.Marshal(v)
+		assert.JSONEq(t, string(ga), string(va), "protocol change in "+v.Name+", run go test -update if intentional")
+	}
+}
+
+func TestVectors(t *testing.T) {
+	vs, err := Load(vectorsFile)
+	assert.NoError(t, err)
+	for _, v := range vs {
+		assert.NoError(t, Check(v))
+	}
+}
+
+// TestJSClient runs browser client served by the gateway against the vectors.
+func TestJSClient(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node not found")
+	}
+	dir, err := ioutil.TempDir("", "conformance")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	client := filepath.Join(dir, "amp.js")
+	assert.NoError(t, ioutil.WriteFile(client, []byte(ws.ClientJS), 0644))
+	vectors, err := filepath.Abs(vectorsFile)
+	assert.NoError(t, err)
+
+	out, err := exec.Command(node, "testdata/harness.js", client, vectors).CombinedOutput()
+	assert.NoError(t, err, string(out))
+}
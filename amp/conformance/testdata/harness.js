@@ -0,0 +1,58 @@
+// Conformance harness for the JavaScript amp clients.
+// Usage: node harness.js <client.js> <vectors.json>
+// Client module should export parse(data) and serialize(msg).
+"use strict";
+
+var assert = require("assert");
+var fs = require("fs");
+
+var amp = require(process.argv[2]);
+var vectors = JSON.parse(fs.readFileSync(process.argv[3], "utf8"));
+
+// header keys which client sets to the default value when missing
+var defaults = { type: 0, updateType: 0 };
+// message types sent by the client
+var clientTypes = [1, 2, 4, 5];
+
+function payload(v) {
+  if (v.wireBase64) {
+    var b = Buffer.from(v.wireBase64, "base64");
+    return b.buffer.slice(b.byteOffset, b.byteOffset + b.length);
+  }
+  return v.wire;
+}
+
+function rawBody(msg) {
+  if (msg.contentType) {
+    return Buffer.from(msg.body);
+  }
+  return Buffer.from(msg.rawBody || "", "utf8");
+}
+
+var failed = 0;
+vectors.forEach(function (v) {
+  try {
+    var msg = amp.parse(payload(v));
+    for (var key in v.header) {
+      assert.deepStrictEqual(msg[key], v.header[key], key);
+    }
+    for (var d in defaults) {
+      if (v.header[d] === undefined && msg[d] !== undefined) {
+        assert.strictEqual(msg[d], defaults[d], d);
+      }
+    }
+    if (v.bodyBase64) {
+      assert.strictEqual(rawBody(msg).toString("base64"), v.bodyBase64, "body");
+    } else if (v.body !== undefined) {
+      assert.deepStrictEqual(msg.body, v.body, "body");
+    }
+    if (!v.parseOnly && clientTypes.indexOf(v.header.type) > -1) {
+      assert.strictEqual(amp.serialize(msg), v.wire, "serialize");
+    }
+  } catch (e) {
+    failed++;
+    console.log(v.name + ": " + e.message);
+  }
+});
+console.log(vectors.length - failed + "/" + vectors.length + " vectors passed");
+process.exit(failed > 0 ? 1 : 0);
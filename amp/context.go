@@ -0,0 +1,130 @@
+package amp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"time"
+)
+
+// TraceKey is the request Meta key with the trace id, set by the requester
+// (see StartTrace) and kept in the requests sent while handling request.
+const TraceKey = "trace"
+
+type ctxKey struct{}
+
+// NewContext returns handler context for the request message.
+// Context is done when parent is done (responder is stopped), when the
+// request deadline, from the Timeout set by the requester, passes or when
+// the transport cancels request (client of the request disconnected).
+// Request message, with its Meta and trace id, is available in the context
+// (see FromContext, MetaFromContext, TraceFromContext).
+func NewContext(parent context.Context, m *Msg) (context.Context, context.CancelFunc) {
+	ctx := context.WithValue(parent, ctxKey{}, m)
+	if !m.deadline.IsZero() {
+		return context.WithDeadline(ctx, m.deadline)
+	}
+	return context.WithCancel(ctx)
+}
+
+// FromContext returns request message from the handler context.
+func FromContext(ctx context.Context) *Msg {
+	m, _ := ctx.Value(ctxKey{}).(*Msg)
+	return m
+}
+
+// MetaFromContext returns request Meta value from the handler context.
+func MetaFromContext(ctx context.Context, key string) string {
+	if m := FromContext(ctx); m != nil {
+		return m.Meta[key]
+	}
+	return ""
+}
+
+// TraceFromContext returns trace id of the request from the handler context.
+func TraceFromContext(ctx context.Context) string {
+	return MetaFromContext(ctx, TraceKey)
+}
+
+// Queue is state of the responder queue when the request is taken by the
+// worker.
+type Queue struct {
+	Wait  time.Duration // how long the request waited for the worker
+	Depth int           // number of the requests still waiting
+}
+
+type queueKey struct{}
+
+// WithQueue returns handler context with the queue state of the request.
+// Set by the responder, used by the Shedder.
+func WithQueue(parent context.Context, q Queue) context.Context {
+	return context.WithValue(parent, queueKey{}, q)
+}
+
+// QueueFromContext returns queue state of the request from the handler
+// context, false if the handler is not called from the responder queue.
+func QueueFromContext(ctx context.Context) (Queue, bool) {
+	q, ok := ctx.Value(queueKey{}).(Queue)
+	return q, ok
+}
+
+// StartTrace sets new trace id to the request Meta, if it doesn't have
+// one. Meta is copied, it could be shared with the session.
+func (m *Msg) StartTrace() {
+	if m.Meta[TraceKey] != "" {
+		return
+	}
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return
+	}
+	meta := make(map[string]string, len(m.Meta)+1)
+	for k, v := range m.Meta {
+		meta[k] = v
+	}
+	meta[TraceKey] = hex.EncodeToString(buf)
+	m.Meta = meta
+}
+
+// SetDeadline sets request deadline, timeout from now.
+// Deadline already set to the earlier time is not changed.
+// Timeout is sent relative, so the deadline doesn't depend on the clocks
+// of the requester and responder hosts.
+func (m *Msg) SetDeadline(timeout time.Duration) {
+	d := time.Now().Add(timeout)
+	if m.deadline.IsZero() || d.Before(m.deadline) {
+		m.deadline = d
+	}
+	m.Timeout = m.remaining()
+}
+
+// ClearDeadline removes request deadline, for the request handled again
+// after the original deadline (e.g. replay of the stored request).
+func (m *Msg) ClearDeadline() {
+	m.deadline = time.Time{}
+	m.Timeout = 0
+}
+
+// Deadline returns request deadline, false if there is no deadline.
+func (m *Msg) Deadline() (time.Time, bool) {
+	return m.deadline, !m.deadline.IsZero()
+}
+
+// Expired returns true if request deadline has passed.
+// Responders don't call handler for expired requests.
+func (m *Msg) Expired() bool {
+	return !m.deadline.IsZero() && time.Now().After(m.deadline)
+}
+
+// remaining returns milliseconds until deadline, -1 for the expired
+// request
+func (m *Msg) remaining() int64 {
+	if m.deadline.IsZero() {
+		return 0
+	}
+	if ms := int64(time.Until(m.deadline) / time.Millisecond); ms > 0 {
+		return ms
+	}
+	return -1
+}
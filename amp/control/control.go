@@ -0,0 +1,203 @@
+// Package control is control plane of the svckit services.
+//
+// Admin publishes signed commands to the control topic (see ampcli control),
+// all services consume them and execute registered handlers:
+//
+//	c := control.MustNew()
+//	c.Handle(control.PurgeCache, func(cmd control.Command) error {
+//		cache.Purge(cmd.Args["topic"])
+//		return nil
+//	})
+//	go c.Consume(ctx, nsq.Subscribe(ctx, []string{control.Topic}))
+//
+// Commands are signed with HMAC-SHA256 of the shared secret from
+// SVCKIT_CONTROL_SECRET environment variable. Commands with wrong
+// signature or older than MaxAge are ignored.
+package control
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/env"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+	"github.com/pkg/errors"
+)
+
+// Topic is topic of the control messages.
+const Topic = "system.control"
+
+// EnvSecret is environment variable with the commands signing secret.
+const EnvSecret = "SVCKIT_CONTROL_SECRET"
+
+// MaxAge of the command, older commands are ignored.
+var MaxAge = time.Minute
+
+// Command names
+const (
+	ReloadConfig = "reloadConfig" // reload service configuration
+	LogLevel     = "logLevel"     // args: level=debug|info
+	PurgeCache   = "purgeCache"   // args: topic
+	Drain        = "drain"        // stop accepting new work
+)
+
+var (
+	// ErrSignature is returned for command with wrong signature.
+	ErrSignature = errors.New("wrong signature")
+	// ErrExpired is returned for command older than MaxAge.
+	ErrExpired = errors.New("command expired")
+)
+
+// Command is body of the control message.
+type Command struct {
+	Name   string            `json:"name"`
+	Target string            `json:"target,omitempty"` // app name, all services if empty
+	Args   map[string]string `json:"args,omitempty"`
+	Ts     int64             `json:"ts"`
+	Sig    []byte            `json:"sig,omitempty"`
+}
+
+// NewCommand creates signed control message.
+func NewCommand(secret []byte, name, target string, args map[string]string) *amp.Msg {
+	c := Command{Name: name, Target: target, Args: args, Ts: amp.TS()}
+	c.Sig = c.sign(secret)
+	return amp.Build().Type(amp.Event).Topic(Topic).Ts(c.Ts).Body(c).MustMsg()
+}
+
+// sign calculates signature of the command without Sig
+func (c Command) sign(secret []byte) []byte {
+	c.Sig = nil
+	buf, _ := json.Marshal(c) // map keys are sorted
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(buf)
+	return mac.Sum(nil)
+}
+
+func (c Command) verify(secret []byte) error {
+	if !hmac.Equal(c.Sig, c.sign(secret)) {
+		return ErrSignature
+	}
+	if time.Since(time.Unix(0, c.Ts*int64(time.Millisecond))) > MaxAge {
+		return ErrExpired
+	}
+	return nil
+}
+
+// Secret returns signing secret from the environment.
+func Secret() ([]byte, error) {
+	s := os.Getenv(EnvSecret)
+	if s == "" {
+		return nil, errors.Errorf("%s not set", EnvSecret)
+	}
+	return []byte(s), nil
+}
+
+// Controller executes control commands.
+type Controller struct {
+	secret   []byte
+	app      string
+	handlers map[string]func(Command) error
+	sync.Mutex
+}
+
+// New creates controller with the secret from the environment.
+// LogLevel command is handled by default.
+func New() (*Controller, error) {
+	secret, err := Secret()
+	if err != nil {
+		return nil, err
+	}
+	return NewWithSecret(secret), nil
+}
+
+// MustNew creates controller, panics if secret is not set.
+func MustNew() *Controller {
+	c, err := New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return c
+}
+
+// NewWithSecret creates controller with the secret.
+func NewWithSecret(secret []byte) *Controller {
+	c := &Controller{
+		secret:   secret,
+		app:      env.AppName(),
+		handlers: make(map[string]func(Command) error),
+	}
+	c.Handle(LogLevel, setLogLevel)
+	return c
+}
+
+// Handle registers command handler.
+func (c *Controller) Handle(name string, h func(Command) error) {
+	c.Lock()
+	defer c.Unlock()
+	c.handlers[name] = h
+}
+
+// Consume executes commands from in, until in is closed or ctx is done.
+func (c *Controller) Consume(ctx context.Context, in <-chan *amp.Msg) {
+	for {
+		select {
+		case m, ok := <-in:
+			if !ok {
+				return
+			}
+			if err := c.Execute(m); err != nil {
+				log.S("uri", m.URI).Error(err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Execute verifies control message and calls command handler.
+// Commands for other services and without handler are ignored.
+func (c *Controller) Execute(m *amp.Msg) error {
+	if m.URI != Topic {
+		return nil
+	}
+	var cmd Command
+	if err := json.Unmarshal(m.BodyBytes(), &cmd); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := cmd.verify(c.secret); err != nil {
+		metric.Counter("control.rejected")
+		return errors.Wrap(err, cmd.Name)
+	}
+	if cmd.Target != "" && cmd.Target != c.app {
+		return nil
+	}
+	c.Lock()
+	h, ok := c.handlers[cmd.Name]
+	c.Unlock()
+	if !ok {
+		return nil
+	}
+	log.S("command", cmd.Name).Info("control command")
+	metric.Counter("control." + cmd.Name)
+	return h(cmd)
+}
+
+func setLogLevel(cmd Command) error {
+	switch strings.ToLower(cmd.Args["level"]) {
+	case "debug":
+		log.EnableDebug()
+	case "info":
+		log.DisableDebug()
+	default:
+		return errors.Errorf("unknown log level %q", cmd.Args["level"])
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package control
+
+import (
+	"testing"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/env"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestController(t *testing.T) {
+	secret := []byte("secret")
+	c := NewWithSecret(secret)
+	var purged []string
+	c.Handle(PurgeCache, func(cmd Command) error {
+		purged = append(purged, cmd.Args["topic"])
+		return nil
+	})
+
+	m := NewCommand(secret, PurgeCache, "", map[string]string{"topic": "math.v1"})
+	assert.Nil(t, c.Execute(amp.Parse(m.Marshal())))
+	assert.Equal(t, []string{"math.v1"}, purged)
+
+	// other service
+	m = NewCommand(secret, PurgeCache, "other", map[string]string{"topic": "chat"})
+	assert.Nil(t, c.Execute(m))
+	// this service
+	m = NewCommand(secret, PurgeCache, env.AppName(), map[string]string{"topic": "chat"})
+	assert.Nil(t, c.Execute(m))
+	assert.Equal(t, []string{"math.v1", "chat"}, purged)
+
+	// wrong secret
+	m = NewCommand([]byte("wrong"), PurgeCache, "", map[string]string{"topic": "x"})
+	assert.Equal(t, ErrSignature, errors.Cause(c.Execute(m)))
+
+	// expired
+	cmd := Command{Name: PurgeCache, Ts: amp.TS() - 2*MaxAge.Nanoseconds()/1e6}
+	cmd.Sig = cmd.sign(secret)
+	m = amp.Build().Type(amp.Event).Topic(Topic).Body(cmd).MustMsg()
+	assert.Equal(t, ErrExpired, errors.Cause(c.Execute(m)))
+	assert.Len(t, purged, 2)
+
+	assert.NotNil(t, c.Execute(NewCommand(secret, LogLevel, "", map[string]string{"level": "trace"})))
+	assert.Nil(t, c.Execute(NewCommand(secret, LogLevel, "", map[string]string{"level": "debug"})))
+}
@@ -0,0 +1,87 @@
+package amp
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/metric"
+)
+
+// Dedupe is middleware which executes handler once for the request
+// CorrelationID (and ReplyTo) within ttl. Duplicate request, caused by
+// hedging or redelivery, gets cached response of the first one. Duplicate
+// arriving while the first is in progress waits for its response.
+// Requests without CorrelationID are passed to the handler.
+func Dedupe(ttl time.Duration, h Handler) Handler {
+	d := &dedupe{
+		ttl:     ttl,
+		handler: h,
+		entries: make(map[string]*dedupeEntry),
+	}
+	return d.handle
+}
+
+type dedupe struct {
+	ttl       time.Duration
+	handler   Handler
+	entries   map[string]*dedupeEntry
+	lastSweep time.Time
+	sync.Mutex
+}
+
+type dedupeEntry struct {
+	done    chan struct{}
+	rsp     *Msg
+	err     error
+	expires time.Time
+}
+
+func (d *dedupe) handle(ctx context.Context, m *Msg) (*Msg, error) {
+	if m.CorrelationID == 0 {
+		return d.handler(ctx, m)
+	}
+	key := m.ReplyTo + "." + strconv.FormatUint(m.CorrelationID, 10)
+
+	d.Lock()
+	now := time.Now()
+	d.sweep(now)
+	if e, ok := d.entries[key]; ok {
+		d.Unlock()
+		<-e.done
+		metric.Counter("requestDuplicate")
+		return e.rsp, e.err
+	}
+	e := &dedupeEntry{done: make(chan struct{}), expires: now.Add(d.ttl)}
+	d.entries[key] = e
+	d.Unlock()
+
+	e.rsp, e.err = d.handler(ctx, m)
+	if IsRetryable(e.err) {
+		// redelivered request should call handler again
+		d.Lock()
+		delete(d.entries, key)
+		d.Unlock()
+	}
+	close(e.done)
+	return e.rsp, e.err
+}
+
+// sweep removes expired entries, at most once per ttl
+func (d *dedupe) sweep(now time.Time) {
+	if now.Sub(d.lastSweep) < d.ttl {
+		return
+	}
+	d.lastSweep = now
+	for k, e := range d.entries {
+		if now.After(e.expires) {
+			select {
+			case <-e.done:
+				delete(d.entries, k)
+			default:
+				// still in progress
+			}
+		}
+	}
+}
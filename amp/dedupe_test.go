@@ -0,0 +1,53 @@
+package amp
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupe(t *testing.T) {
+	calls := 0
+	h := Dedupe(10*time.Millisecond, func(ctx context.Context, m *Msg) (*Msg, error) {
+		calls++
+		return m.Response(calls), nil
+	})
+	req := func(correlationID uint64) *Msg {
+		return &Msg{Type: Request, ReplyTo: "rsp", CorrelationID: correlationID, URI: "math.req/add"}
+	}
+
+	rsp1, err := h(context.Background(), req(1))
+	assert.Nil(t, err)
+	rsp2, err := h(context.Background(), req(1))
+	assert.Nil(t, err)
+	assert.True(t, rsp1 == rsp2)
+	assert.Equal(t, 1, calls)
+
+	_, _ = h(context.Background(), req(2))
+	assert.Equal(t, 2, calls)
+	// without CorrelationID
+	_, _ = h(context.Background(), req(0))
+	_, _ = h(context.Background(), req(0))
+	assert.Equal(t, 4, calls)
+
+	// after ttl handler is called again
+	time.Sleep(20 * time.Millisecond)
+	_, _ = h(context.Background(), req(1))
+	assert.Equal(t, 5, calls)
+}
+
+func TestDedupeRetryable(t *testing.T) {
+	calls := 0
+	h := Dedupe(time.Minute, func(ctx context.Context, m *Msg) (*Msg, error) {
+		calls++
+		return nil, Retryable(fmt.Errorf("unavailable"))
+	})
+	req := &Msg{Type: Request, ReplyTo: "rsp", CorrelationID: 1, URI: "math.req/add"}
+	_, err := h(context.Background(), req)
+	assert.True(t, IsRetryable(err))
+	_, _ = h(context.Background(), req)
+	assert.Equal(t, 2, calls)
+}
@@ -0,0 +1,144 @@
+// Package delta replaces consecutive Full messages with Diffs.
+//
+// Differ keeps previous Full for each uri and publishes difference between
+// previous and current Full as Diff message, when it is smaller than the
+// Full. Diff is in the format which js sdk merges: changed values are set,
+// removed keys are null, objects are diffed recursively.
+//
+//	in := delta.New(delta.MaxDiffs(10)).Pipe(msgs)
+//	pub := nsq.NewPublisher(broker.Pipe(in))
+package delta
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+)
+
+type state struct {
+	full  interface{}
+	diffs int // diffs published since last full
+}
+
+// Differ converts Full messages into Diffs.
+type Differ struct {
+	maxDiffs int
+	states   map[string]*state
+}
+
+// New creates differ.
+func New(opts ...func(*Differ)) *Differ {
+	d := &Differ{
+		maxDiffs: 10,
+		states:   make(map[string]*state),
+	}
+	for _, o := range opts {
+		o(d)
+	}
+	return d
+}
+
+// MaxDiffs sets max number of Fulls replaced by Diffs in a row.
+// After that Full is published, so broker cache of the diffs stays small.
+func MaxDiffs(n int) func(*Differ) {
+	return func(d *Differ) {
+		d.maxDiffs = n
+	}
+}
+
+// Pipe passes messages from in to the returned chan, replacing Fulls with Diffs.
+func (d *Differ) Pipe(in <-chan *amp.Msg) <-chan *amp.Msg {
+	out := make(chan *amp.Msg)
+	go func() {
+		defer close(out)
+		for m := range in {
+			out <- d.Convert(m)
+		}
+	}()
+	return out
+}
+
+// Convert returns Diff message if m is Full and diff with the previous
+// Full is smaller, otherwise returns m.
+// Diffs published by the producer are not tracked, producer which mixes
+// Fulls and Diffs should not use Differ.
+func (d *Differ) Convert(m *amp.Msg) *amp.Msg {
+	if m.Type != amp.Publish {
+		return m
+	}
+	if m.UpdateType == amp.Close {
+		delete(d.states, m.URI)
+		return m
+	}
+	if !m.IsFull() || m.IsReplay() || m.KeyID != "" || m.DictID != "" || m.IsBinary() {
+		return m
+	}
+	body := m.BodyBytes()
+	full, err := decode(body)
+	if err != nil {
+		log.S("uri", m.URI).Error(err)
+		delete(d.states, m.URI)
+		return m
+	}
+	s, ok := d.states[m.URI]
+	if !ok || s.diffs >= d.maxDiffs {
+		d.states[m.URI] = &state{full: full}
+		return m
+	}
+	buf, err := json.Marshal(diff(s.full, full))
+	if err != nil || len(buf) >= len(body) {
+		d.states[m.URI] = &state{full: full}
+		return m
+	}
+	s.full = full
+	s.diffs++
+	dm := amp.NewPublish(m.Topic(), m.Path(), m.Ts, amp.Diff, json.RawMessage(buf))
+	dm.Priority = m.Priority
+	return dm
+}
+
+func decode(buf []byte) (interface{}, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// diff returns value which merged into prev gives cur
+func diff(prev, cur interface{}) interface{} {
+	p, ok1 := prev.(map[string]interface{})
+	c, ok2 := cur.(map[string]interface{})
+	if !ok1 || !ok2 {
+		return cur
+	}
+	d := make(map[string]interface{})
+	for k := range p {
+		if _, ok := c[k]; !ok {
+			d[k] = nil
+		}
+	}
+	for k, cv := range c {
+		pv, ok := p[k]
+		if !ok {
+			d[k] = cv
+			continue
+		}
+		if reflect.DeepEqual(pv, cv) {
+			continue
+		}
+		_, pm := pv.(map[string]interface{})
+		_, cm := cv.(map[string]interface{})
+		if pm && cm {
+			d[k] = diff(pv, cv)
+			continue
+		}
+		d[k] = cv
+	}
+	return d
+}
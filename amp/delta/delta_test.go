@@ -0,0 +1,80 @@
+package delta
+
+import (
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+type obj map[string]interface{}
+
+func TestConvert(t *testing.T) {
+	d := New(MaxDiffs(2))
+	c := cache.New()
+	full := func(ts int64, o obj) *amp.Msg {
+		m := d.Convert(amp.NewPublish("sport", "i", ts, amp.Full, o))
+		c.Add(m)
+		return m
+	}
+	big := "some long value which makes full larger than diff"
+	m := full(1, obj{"a": 1, "b": obj{"c": 2, "d": big}, "e": big})
+	assert.True(t, m.IsFull())
+
+	m = full(2, obj{"a": 2, "b": obj{"c": 3, "d": big}})
+	assert.Equal(t, amp.Diff, m.UpdateType)
+	assert.Equal(t, `{"a":2,"b":{"c":3},"e":null}`, string(m.BodyBytes()))
+
+	// small full, diff is not smaller
+	m = full(3, obj{"x": 1})
+	assert.True(t, m.IsFull())
+
+	m = full(4, obj{"x": 1, "y": big})
+	assert.Equal(t, amp.Diff, m.UpdateType)
+	m = full(5, obj{"x": 2, "y": big})
+	assert.Equal(t, amp.Diff, m.UpdateType)
+	// max diffs reached
+	m = full(6, obj{"x": 3, "y": big})
+	assert.True(t, m.IsFull())
+
+	m = full(7, obj{"x": 4, "y": big})
+	assert.Equal(t, amp.Diff, m.UpdateType)
+	buf, _ := c.Get("sport/i")
+	assert.Equal(t, `{"x":4,"y":"`+big+`"}`, string(buf))
+}
+
+func TestProducer(t *testing.T) {
+	now := time.Unix(1000, 0)
+	p := NewProducer("math.v1", "i", FullInterval(time.Minute), DiffsPerFull(2))
+	p.now = func() time.Time { return now }
+	update := func(o obj) *amp.Msg {
+		m, err := p.Update(o)
+		assert.NoError(t, err)
+		return m
+	}
+
+	m := update(obj{"x": 1, "y": 1, "name": "sum"})
+	assert.Equal(t, amp.Full, m.UpdateType)
+	assert.Nil(t, update(obj{"x": 1, "y": 1, "name": "sum"}))
+
+	m = update(obj{"x": 2, "y": 1, "name": "sum"})
+	assert.Equal(t, amp.Diff, m.UpdateType)
+	assert.Equal(t, `{"x":2}`, string(m.BodyBytes()))
+	m = update(obj{"y": 1, "name": "sum"})
+	assert.Equal(t, amp.Diff, m.UpdateType)
+	assert.Equal(t, `{"x":null}`, string(m.BodyBytes()))
+
+	// max diffs reached
+	m = update(obj{"x": 3, "y": 1, "name": "sum"})
+	assert.Equal(t, amp.Full, m.UpdateType)
+
+	// full interval elapsed
+	m = update(obj{"x": 4, "y": 1, "name": "sum"})
+	assert.Equal(t, amp.Diff, m.UpdateType)
+	now = now.Add(time.Minute)
+	m = update(obj{"x": 5, "y": 1, "name": "sum"})
+	assert.Equal(t, amp.Full, m.UpdateType)
+	assert.Equal(t, `{"name":"sum","x":5,"y":1}`, string(m.BodyBytes()))
+}
@@ -0,0 +1,151 @@
+package delta
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+	"github.com/pkg/errors"
+)
+
+// Producer holds current state object of the uri and publishes its
+// changes. First state and every FullInterval state is published as Full,
+// between them only changed fields are published as Diff:
+//
+//	p := delta.NewProducer("math.v1", "i", delta.FullInterval(30*time.Second))
+//	pub := nsq.NewPublisher(broker.Pipe(p.Pipe(ctx, states)))
+type Producer struct {
+	topic        string
+	path         string
+	fullInterval time.Duration
+	maxDiffs     int
+	now          func() time.Time
+
+	state    interface{} // last published state
+	lastFull time.Time
+	diffs    int // diffs published since last full
+}
+
+// FullInterval sets max interval between Fulls, default 30s.
+// Full is published on interval even if state is not changed.
+func FullInterval(d time.Duration) func(*Producer) {
+	return func(p *Producer) {
+		p.fullInterval = d
+	}
+}
+
+// DiffsPerFull sets max number of Diffs between Fulls, default unlimited.
+func DiffsPerFull(n int) func(*Producer) {
+	return func(p *Producer) {
+		p.maxDiffs = n
+	}
+}
+
+// NewProducer creates producer for the topic/path.
+func NewProducer(topic, path string, opts ...func(*Producer)) *Producer {
+	p := &Producer{
+		topic:        topic,
+		path:         path,
+		fullInterval: 30 * time.Second,
+		now:          time.Now,
+	}
+	for _, o := range opts {
+		o(p)
+	}
+	return p
+}
+
+// Update sets new state o and returns message to publish:
+// Full when it is due, Diff with changed fields, or nil if nothing changed.
+func (p *Producer) Update(o interface{}) (*amp.Msg, error) {
+	body, err := json.Marshal(o)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	cur, err := decode(body)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	now := p.now()
+	if p.fullDue(now) {
+		return p.full(cur, body, now), nil
+	}
+	d := diff(p.state, cur)
+	if m, ok := d.(map[string]interface{}); ok && len(m) == 0 {
+		return nil, nil
+	}
+	buf, err := json.Marshal(d)
+	if err != nil || len(buf) >= len(body) {
+		return p.full(cur, body, now), nil
+	}
+	p.state = cur
+	p.diffs++
+	return amp.NewPublish(p.topic, p.path, amp.TS(), amp.Diff, json.RawMessage(buf)), nil
+}
+
+// Full returns Full message of the current state, nil before first Update.
+func (p *Producer) Full() *amp.Msg {
+	if p.state == nil {
+		return nil
+	}
+	body, err := json.Marshal(p.state)
+	if err != nil {
+		return nil
+	}
+	return p.full(p.state, body, p.now())
+}
+
+func (p *Producer) fullDue(now time.Time) bool {
+	return p.state == nil ||
+		now.Sub(p.lastFull) >= p.fullInterval ||
+		(p.maxDiffs > 0 && p.diffs >= p.maxDiffs)
+}
+
+func (p *Producer) full(state interface{}, body []byte, now time.Time) *amp.Msg {
+	p.state = state
+	p.lastFull = now
+	p.diffs = 0
+	return amp.NewPublish(p.topic, p.path, amp.TS(), amp.Full, json.RawMessage(body))
+}
+
+// Pipe publishes messages for the states from in, and Full on FullInterval
+// when state is not changing. Returned chan is closed when in is closed
+// or ctx is done.
+func (p *Producer) Pipe(ctx context.Context, in <-chan interface{}) <-chan *amp.Msg {
+	out := make(chan *amp.Msg)
+	go func() {
+		defer close(out)
+		tick := time.NewTicker(p.fullInterval)
+		defer tick.Stop()
+		for {
+			var m *amp.Msg
+			select {
+			case o, ok := <-in:
+				if !ok {
+					return
+				}
+				var err error
+				if m, err = p.Update(o); err != nil {
+					log.S("topic", p.topic).S("path", p.path).Error(err)
+				}
+			case <-tick.C:
+				if p.fullDue(p.now()) {
+					m = p.Full()
+				}
+			case <-ctx.Done():
+				return
+			}
+			if m == nil {
+				continue
+			}
+			select {
+			case out <- m:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,166 @@
+package amp
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DemandTopic is control topic on which gateways announce topics their
+// clients are subscribed to. Producers listen on it and generate data
+// only for the watched topics.
+const DemandTopic = "system.demand"
+
+// NewDemandAnnounce creates gateway announcement of the currently needed
+// topics. Announcement is complete list, it replaces previous one of the
+// same gateway.
+func NewDemandAnnounce(gateway string, topics []string) *Msg {
+	subs := make(map[string]int64, len(topics))
+	for _, t := range topics {
+		subs[t] = 0
+	}
+	return &Msg{
+		Type:          Subscribe,
+		URI:           DemandTopic,
+		Ts:            TS(),
+		Subscriptions: subs,
+		Meta:          map[string]string{"gateway": gateway},
+	}
+}
+
+type gatewayDemand struct {
+	topics map[string]int64
+	at     time.Time
+}
+
+// Demand tracks which topics are watched by at least one gateway.
+// Gateway announcements expire after ttl, so topics of the gateway which
+// stopped announcing are released. Start and stop callbacks are called
+// when topic becomes watched and when nobody is watching it anymore.
+type Demand struct {
+	ttl      time.Duration
+	gateways map[string]gatewayDemand
+	watched  map[string]int // number of gateways by topic
+	start    func(topic string)
+	stop     func(topic string)
+	sync.Mutex
+}
+
+// NewDemand creates demand tracker.
+func NewDemand(ttl time.Duration, start, stop func(topic string)) *Demand {
+	return &Demand{
+		ttl:      ttl,
+		gateways: make(map[string]gatewayDemand),
+		watched:  make(map[string]int),
+		start:    start,
+		stop:     stop,
+	}
+}
+
+// Add applies gateway announcement from the DemandTopic.
+func (d *Demand) Add(m *Msg) {
+	if m.Type != Subscribe || m.URI != DemandTopic {
+		return
+	}
+	gateway := m.Meta["gateway"]
+	d.Lock()
+	var old map[string]int64
+	if g, ok := d.gateways[gateway]; ok {
+		old = g.topics
+	}
+	d.gateways[gateway] = gatewayDemand{topics: m.Subscriptions, at: time.Now()}
+	started, stopped := d.update(old, m.Subscriptions)
+	d.Unlock()
+	d.notify(started, stopped)
+}
+
+// Expire releases topics of the gateways without announcement in ttl.
+func (d *Demand) Expire() {
+	d.Lock()
+	var stopped []string
+	for gateway, g := range d.gateways {
+		if time.Since(g.at) <= d.ttl {
+			continue
+		}
+		delete(d.gateways, gateway)
+		_, s := d.update(g.topics, nil)
+		stopped = append(stopped, s...)
+	}
+	d.Unlock()
+	d.notify(nil, stopped)
+}
+
+// Consume applies announcements from in and expires old ones
+// until in is closed or ctx is done.
+func (d *Demand) Consume(ctx context.Context, in <-chan *Msg) {
+	t := time.NewTicker(d.ttl / 2)
+	defer t.Stop()
+	for {
+		select {
+		case m, ok := <-in:
+			if !ok {
+				return
+			}
+			d.Add(m)
+		case <-t.C:
+			d.Expire()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Watched returns true if any gateway needs the topic.
+func (d *Demand) Watched(topic string) bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.watched[topic] > 0
+}
+
+// Topics returns all watched topics.
+func (d *Demand) Topics() []string {
+	d.Lock()
+	defer d.Unlock()
+	topics := make([]string, 0, len(d.watched))
+	for t := range d.watched {
+		topics = append(topics, t)
+	}
+	return topics
+}
+
+// update changes watched counters, should be called during d.Lock
+func (d *Demand) update(old, current map[string]int64) (started, stopped []string) {
+	for t := range current {
+		if _, ok := old[t]; ok {
+			continue
+		}
+		d.watched[t]++
+		if d.watched[t] == 1 {
+			started = append(started, t)
+		}
+	}
+	for t := range old {
+		if _, ok := current[t]; ok {
+			continue
+		}
+		d.watched[t]--
+		if d.watched[t] <= 0 {
+			delete(d.watched, t)
+			stopped = append(stopped, t)
+		}
+	}
+	return started, stopped
+}
+
+func (d *Demand) notify(started, stopped []string) {
+	for _, t := range started {
+		if d.start != nil {
+			d.start(t)
+		}
+	}
+	for _, t := range stopped {
+		if d.stop != nil {
+			d.stop(t)
+		}
+	}
+}
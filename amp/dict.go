@@ -0,0 +1,298 @@
+package amp
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DictPath is path of the request for the topic compression dictionary.
+// Producer of the dictionary compressed topic serves it with Dicts.Handler.
+const DictPath = "_dict"
+
+// ErrUnknownDict is returned when message is compressed with dictionary which is not known.
+var ErrUnknownDict = errors.New("unknown dictionary")
+
+// DictRequest is body of the dictionary request.
+type DictRequest struct {
+	Topic string `json:"topic"`
+	ID    string `json:"id,omitempty"` // dictionary id from the message DictID, current if empty
+}
+
+// TopicDict is body of the dictionary response.
+// Message body is base64 encoded json string of the deflate stream
+// compressed with Data as preset dictionary.
+type TopicDict struct {
+	Topic string `json:"topic"`
+	ID    string `json:"id"`
+	Data  []byte `json:"data"`
+}
+
+// NewDictRequest creates request for the topic dictionary to the producer request topic.
+func NewDictRequest(requestTopic, topic, id string) *Msg {
+	return NewRequest(requestTopic+"/"+DictPath, DictRequest{Topic: topic, ID: id})
+}
+
+// Dicts holds per topic compression dictionaries.
+// Small messages (under compression limit) of the same topic are usually
+// very similar, compressing them with the dictionary trained on the previous
+// messages of the topic gives good ratio even for few hundred bytes.
+//
+// Bodies are compressed with deflate using the dictionary as preset
+// dictionary, so no dependency outside of the standard library is needed
+// (zstd dictionaries are not supported).
+//
+// Dictionary id is checksum of its data, message DictID is the id of the
+// dictionary used. Client which doesn't have that dictionary requests it
+// with NewDictRequest and adds it with Set. Few old dictionaries are kept
+// so messages in caches could still be decompressed after training.
+type Dicts struct {
+	size    int // max dictionary size
+	samples int // number of samples kept per topic
+	keep    int // number of old dictionaries kept
+
+	current map[string]string            // current dictionary id by topic
+	dicts   map[string]map[string][]byte // dictionaries by topic and id
+	order   map[string][]string          // dictionary ids by topic, oldest first
+	sampled map[string][][]byte          // latest message bodies by topic
+	sync.RWMutex
+}
+
+// DictSize sets max dictionary size, deflate uses at most 32KB.
+func DictSize(n int) func(*Dicts) {
+	return func(d *Dicts) {
+		d.size = n
+	}
+}
+
+// DictSamples sets number of message bodies per topic used for training.
+func DictSamples(n int) func(*Dicts) {
+	return func(d *Dicts) {
+		d.samples = n
+	}
+}
+
+// NewDicts creates empty dictionaries set.
+func NewDicts(opts ...func(*Dicts)) *Dicts {
+	d := &Dicts{
+		size:    16 * 1024,
+		samples: 128,
+		keep:    2,
+		current: make(map[string]string),
+		dicts:   make(map[string]map[string][]byte),
+		order:   make(map[string][]string),
+		sampled: make(map[string][][]byte),
+	}
+	for _, o := range opts {
+		o(d)
+	}
+	return d
+}
+
+// Sample remembers message body for the next training of the topic dictionary.
+func (d *Dicts) Sample(m *Msg) {
+	if m.KeyID != "" || m.DictID != "" {
+		return
+	}
+	body := m.BodyBytes()
+	if len(body) == 0 || len(body) >= compressionLimit() {
+		return
+	}
+	topic := m.Topic()
+	d.Lock()
+	defer d.Unlock()
+	s := append(d.sampled[topic], body)
+	if len(s) > d.samples {
+		s = s[len(s)-d.samples:]
+	}
+	d.sampled[topic] = s
+}
+
+// Train builds new version of the topic dictionary from the samples and
+// makes it current. Returns id of the new dictionary.
+// Deflate finds matches closer to the end of the dictionary with the
+// shorter distances, so latest samples are placed at the end.
+func (d *Dicts) Train(topic string) (string, bool) {
+	d.Lock()
+	s := d.sampled[topic]
+	d.sampled[topic] = nil
+	d.Unlock()
+	if len(s) == 0 {
+		return "", false
+	}
+	var data []byte
+	for i := len(s) - 1; i >= 0 && len(data) < d.size; i-- {
+		data = append(append([]byte{}, s[i]...), data...)
+	}
+	if len(data) > d.size {
+		data = data[len(data)-d.size:]
+	}
+	id := dictID(data)
+	d.set(topic, id, data)
+	return id, true
+}
+
+// dictID returns id of the dictionary data
+func dictID(data []byte) string {
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE(data))
+}
+
+// Set adds topic dictionary with id, received from the producer (see
+// TopicDict), and makes it current. Returns error if id doesn't match data.
+func (d *Dicts) Set(topic, id string, data []byte) error {
+	if id != dictID(data) {
+		return errors.Errorf("dictionary %s of the topic %s id mismatch", id, topic)
+	}
+	d.set(topic, id, data)
+	return nil
+}
+
+func (d *Dicts) set(topic, id string, data []byte) {
+	d.Lock()
+	defer d.Unlock()
+	d.current[topic] = id
+	if _, ok := d.dicts[topic]; !ok {
+		d.dicts[topic] = make(map[string][]byte)
+	}
+	if _, ok := d.dicts[topic][id]; ok {
+		return
+	}
+	d.dicts[topic][id] = data
+	order := append(d.order[topic], id)
+	for len(order) > d.keep+1 {
+		delete(d.dicts[topic], order[0])
+		order = order[1:]
+	}
+	d.order[topic] = order
+}
+
+// Run periodically trains dictionaries of all sampled topics until ctx is done.
+func (d *Dicts) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			d.RLock()
+			topics := make([]string, 0, len(d.sampled))
+			for topic := range d.sampled {
+				topics = append(topics, topic)
+			}
+			d.RUnlock()
+			for _, topic := range topics {
+				d.Train(topic)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Dict returns topic dictionary by id, or current one if id is empty.
+func (d *Dicts) Dict(topic, id string) (TopicDict, bool) {
+	id, data := d.get(topic, id)
+	if data == nil {
+		return TopicDict{}, false
+	}
+	return TopicDict{Topic: topic, ID: id, Data: data}, true
+}
+
+func (d *Dicts) get(topic, id string) (string, []byte) {
+	d.RLock()
+	defer d.RUnlock()
+	if id == "" {
+		id = d.current[topic]
+	}
+	return id, d.dicts[topic][id]
+}
+
+// Compress replaces message body with the body compressed with the current
+// topic dictionary and sets DictID.
+// Messages of the topics without dictionary, large or encrypted messages
+// and messages which would not get smaller are not changed.
+func (d *Dicts) Compress(m *Msg) error {
+	if m.KeyID != "" || m.DictID != "" {
+		return nil
+	}
+	id, dict := d.get(m.Topic(), "")
+	if dict == nil {
+		return nil
+	}
+	body := m.BodyBytes()
+	if len(body) >= compressionLimit() {
+		return nil
+	}
+	buf := bytes.NewBuffer(nil)
+	w, err := flate.NewWriterDict(buf, flate.BestCompression, dict)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, _ = w.Write(body)
+	if err := w.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	compressed, _ := json.Marshal(buf.Bytes()) // []byte is encoded as base64 string
+	if len(compressed) >= len(body) {
+		return nil
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.body = compressed
+	m.src = nil
+	m.payloads = nil
+	m.fields = nil
+	m.DictID = id
+	return nil
+}
+
+// Decompress replaces dictionary compressed message body with the original.
+func (d *Dicts) Decompress(m *Msg) error {
+	if m.DictID == "" {
+		return nil
+	}
+	_, dict := d.get(m.Topic(), m.DictID)
+	if dict == nil {
+		return errors.Wrap(ErrUnknownDict, m.DictID)
+	}
+	var compressed []byte
+	if err := json.Unmarshal(m.BodyBytes(), &compressed); err != nil {
+		return errors.WithStack(err)
+	}
+	r := flate.NewReaderDict(bytes.NewReader(compressed), dict)
+	defer r.Close()
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.body = body
+	m.src = nil
+	m.payloads = nil
+	m.fields = nil
+	m.DictID = ""
+	return nil
+}
+
+// Handler serves dictionary requests.
+func (d *Dicts) Handler() Handler {
+	return func(ctx context.Context, m *Msg) (*Msg, error) {
+		var req DictRequest
+		if err := m.Unmarshal(&req); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		dict, ok := d.Dict(req.Topic, req.ID)
+		if !ok {
+			return nil, errors.Wrap(ErrUnknownDict, req.Topic)
+		}
+		return m.Response(dict), nil
+	}
+}
@@ -0,0 +1,282 @@
+package amp
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// KeyPath is path of the request for the topic encryption key.
+// Producer of the encrypted topic serves it with TopicKeys.Handler.
+const KeyPath = "_key"
+
+// ErrUnknownKey is returned when message is encrypted with key which is not known.
+var ErrUnknownKey = errors.New("unknown key")
+
+// KeyRequest is body of the key request.
+type KeyRequest struct {
+	Topic     string `json:"topic"`
+	ID        string `json:"id,omitempty"` // key id from the message KeyID, current key if empty
+	PublicKey []byte `json:"pub"`          // client P-256 public key (uncompressed point), see KeyPair
+}
+
+// TopicKey is body of the key response.
+// Topic key is AES-256 key, message body is base64 encoded json string of
+// 12 bytes nonce followed by AES-GCM ciphertext, additional data is
+// message uri.
+// Key is wrapped for the requesting client, gateways relaying the
+// response can't read it. Ephemeral is producer P-256 public key, key
+// encryption key is SHA-256 of the x coordinate of the ECDH shared secret
+// of the ephemeral and client key. Wrapped is 12 bytes nonce followed by
+// AES-GCM ciphertext of the topic key, additional data is topic/id.
+type TopicKey struct {
+	Topic     string `json:"topic"`
+	ID        string `json:"id"`
+	Ephemeral []byte `json:"eph"`
+	Wrapped   []byte `json:"key"`
+}
+
+// NewKeyRequest creates request for the topic key to the producer request
+// topic. Pub is public key of the client KeyPair.
+func NewKeyRequest(requestTopic, topic, id string, pub []byte) *Msg {
+	return NewRequest(requestTopic+"/"+KeyPath, KeyRequest{Topic: topic, ID: id, PublicKey: pub})
+}
+
+// KeyPair is client P-256 key pair for the key requests.
+type KeyPair struct {
+	priv   []byte
+	Public []byte // sent in the key request
+}
+
+// NewKeyPair generates random key pair.
+func NewKeyPair() (*KeyPair, error) {
+	priv, x, y, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &KeyPair{priv: priv, Public: elliptic.Marshal(elliptic.P256(), x, y)}, nil
+}
+
+// Unwrap returns topic key from the key response.
+func (p *KeyPair) Unwrap(tk TopicKey) ([]byte, error) {
+	aead, err := keyEncryption(p.priv, tk.Ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	ns := aead.NonceSize()
+	if len(tk.Wrapped) < ns {
+		return nil, errors.New("wrapped key too short")
+	}
+	key, err := aead.Open(nil, tk.Wrapped[:ns], tk.Wrapped[ns:], []byte(tk.Topic+"/"+tk.ID))
+	return key, errors.WithStack(err)
+}
+
+// wrapKey encrypts key for the owner of the public key
+func wrapKey(tk TopicKey, key, pub []byte) (TopicKey, error) {
+	priv, x, y, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tk, errors.WithStack(err)
+	}
+	aead, err := keyEncryption(priv, pub)
+	if err != nil {
+		return tk, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return tk, errors.WithStack(err)
+	}
+	tk.Ephemeral = elliptic.Marshal(elliptic.P256(), x, y)
+	tk.Wrapped = aead.Seal(nonce, nonce, key, []byte(tk.Topic+"/"+tk.ID))
+	return tk, nil
+}
+
+// keyEncryption returns cipher of the key encryption key derived from the
+// private key and peer public key
+func keyEncryption(priv, pub []byte) (cipher.AEAD, error) {
+	curve := elliptic.P256()
+	x, y := elliptic.Unmarshal(curve, pub)
+	if x == nil || !curve.IsOnCurve(x, y) {
+		return nil, errors.New("invalid public key")
+	}
+	sx, _ := curve.ScalarMult(x, y, priv)
+	secret := make([]byte, 32)
+	b := sx.Bytes()
+	copy(secret[len(secret)-len(b):], b)
+	kek := sha256.Sum256(secret)
+	block, err := aes.NewCipher(kek[:])
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	return aead, errors.WithStack(err)
+}
+
+type topicKey struct {
+	key  []byte
+	aead cipher.AEAD
+}
+
+// TopicKeys holds per topic encryption keys.
+// Body of the encrypted message is readable only by the producer and clients
+// which got the key, gateways and brokers relay ciphertext.
+// Messages are encrypted with the current topic key, old keys are kept
+// so messages in caches could still be decrypted after Rotate.
+//
+// Encrypted bodies are opaque for the middleware so filters,
+// amp/delta and diff merging in amp/cache don't apply to them.
+type TopicKeys struct {
+	current map[string]string               // current key id by topic
+	keys    map[string]map[string]*topicKey // keys by topic and id
+	sync.RWMutex
+}
+
+// NewTopicKeys creates empty keys set.
+func NewTopicKeys() *TopicKeys {
+	return &TopicKeys{
+		current: make(map[string]string),
+		keys:    make(map[string]map[string]*topicKey),
+	}
+}
+
+// Set adds key for the topic and makes it current.
+func (k *TopicKeys) Set(topic, id string, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	k.Lock()
+	defer k.Unlock()
+	if _, ok := k.keys[topic]; !ok {
+		k.keys[topic] = make(map[string]*topicKey)
+	}
+	k.keys[topic][id] = &topicKey{key: key, aead: aead}
+	k.current[topic] = id
+	return nil
+}
+
+// Rotate generates new random key for the topic and makes it current.
+// Returns id of the new key.
+func (k *TopicKeys) Rotate(topic string) (string, error) {
+	buf := make([]byte, 32+8)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return "", errors.WithStack(err)
+	}
+	id := hex.EncodeToString(buf[32:])
+	return id, k.Set(topic, id, buf[:32])
+}
+
+// Remove removes old key of the topic.
+func (k *TopicKeys) Remove(topic, id string) {
+	k.Lock()
+	defer k.Unlock()
+	delete(k.keys[topic], id)
+}
+
+// Add adds topic key from the key response, unwrapped with the client
+// key pair.
+func (k *TopicKeys) Add(p *KeyPair, tk TopicKey) error {
+	key, err := p.Unwrap(tk)
+	if err != nil {
+		return err
+	}
+	return k.Set(tk.Topic, tk.ID, key)
+}
+
+func (k *TopicKeys) get(topic, id string) (string, *topicKey) {
+	k.RLock()
+	defer k.RUnlock()
+	if id == "" {
+		id = k.current[topic]
+	}
+	return id, k.keys[topic][id]
+}
+
+// Encrypt replaces message body with the ciphertext and sets KeyID.
+// Messages of the topics without key are not changed.
+func (k *TopicKeys) Encrypt(m *Msg) error {
+	id, tk := k.get(m.Topic(), "")
+	if tk == nil || m.KeyID != "" {
+		return nil
+	}
+	nonce := make([]byte, tk.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return errors.WithStack(err)
+	}
+	sealed := tk.aead.Seal(nonce, nonce, m.BodyBytes(), []byte(m.URI))
+	body, _ := json.Marshal(sealed) // []byte is encoded as base64 string
+	m.Lock()
+	defer m.Unlock()
+	m.body = body
+	m.src = nil
+	m.payloads = nil
+	m.fields = nil
+	m.KeyID = id
+	return nil
+}
+
+// Decrypt replaces encrypted message body with the plaintext.
+func (k *TopicKeys) Decrypt(m *Msg) error {
+	if m.KeyID == "" {
+		return nil
+	}
+	_, tk := k.get(m.Topic(), m.KeyID)
+	if tk == nil {
+		return errors.Wrap(ErrUnknownKey, m.KeyID)
+	}
+	var sealed []byte
+	if err := json.Unmarshal(m.BodyBytes(), &sealed); err != nil {
+		return errors.WithStack(err)
+	}
+	ns := tk.aead.NonceSize()
+	if len(sealed) < ns {
+		return errors.New("encrypted body too short")
+	}
+	body, err := tk.aead.Open(nil, sealed[:ns], sealed[ns:], []byte(m.URI))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.body = body
+	m.src = nil
+	m.payloads = nil
+	m.fields = nil
+	m.KeyID = ""
+	return nil
+}
+
+// Handler serves key requests, key is wrapped with the client public key.
+// Authorize decides whether the client (by request Meta) could get the key.
+func (k *TopicKeys) Handler(authorize func(m *Msg, topic string) bool) Handler {
+	return func(ctx context.Context, m *Msg) (*Msg, error) {
+		var req KeyRequest
+		if err := m.Unmarshal(&req); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if authorize == nil || !authorize(m, req.Topic) {
+			return nil, errors.Wrap(ErrUnknownKey, req.Topic)
+		}
+		id, key := k.get(req.Topic, req.ID)
+		if key == nil {
+			return nil, errors.Wrap(ErrUnknownKey, req.Topic)
+		}
+		tk, err := wrapKey(TopicKey{Topic: req.Topic, ID: id}, key.key, req.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		return m.Response(tk), nil
+	}
+}
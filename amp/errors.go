@@ -0,0 +1,173 @@
+package amp
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// LangKey is the client session metadata key with the language of the
+// user-facing error messages (see ResponseError).
+const LangKey = "lang"
+
+// ErrorDef describes registered error code.
+type ErrorDef struct {
+	Code      int
+	Retryable bool
+	Messages  map[string]string // user-facing messages by language, "" is default
+}
+
+var (
+	errorDefs   = make(map[int]ErrorDef)
+	errorDefsMu sync.RWMutex
+)
+
+// RegisterError registers error code.
+// Should be called from init of the package which defines codes.
+func RegisterError(d ErrorDef) {
+	errorDefsMu.Lock()
+	defer errorDefsMu.Unlock()
+	if _, ok := errorDefs[d.Code]; ok {
+		panic(fmt.Sprintf("amp: error code %d already registered", d.Code))
+	}
+	errorDefs[d.Code] = d
+}
+
+func errorDef(code int) (ErrorDef, bool) {
+	errorDefsMu.RLock()
+	defer errorDefsMu.RUnlock()
+	d, ok := errorDefs[code]
+	return d, ok
+}
+
+// Errf creates application error with the code.
+// Formatted message is internal, user-facing message and retryable flag
+// are taken from the code registration. For unregistered codes formatted
+// message is also user-facing.
+func Errf(code int, format string, args ...interface{}) *Error {
+	e := &Error{
+		Source:   ApplicationError,
+		Code:     code,
+		Internal: fmt.Sprintf(format, args...),
+	}
+	e.Message = e.Internal
+	if d, ok := errorDef(code); ok {
+		e.Retryable = d.Retryable
+		if msg, ok := d.Messages[""]; ok {
+			e.Message = msg
+		}
+	}
+	return e
+}
+
+func (e *Error) Error() string {
+	if e.Internal != "" {
+		return e.Internal
+	}
+	return e.Message
+}
+
+// Localize returns copy of the error with user-facing message in
+// language lang, if there is one registered for the error code.
+func (e *Error) Localize(lang string) *Error {
+	d, ok := errorDef(e.Code)
+	if !ok {
+		return e
+	}
+	msg, ok := d.Messages[lang]
+	if !ok {
+		return e
+	}
+	le := *e
+	le.Message = msg
+	return &le
+}
+
+// Err returns response error or nil.
+func (m *Msg) Err() error {
+	if m.Error == nil {
+		return nil
+	}
+	return m.Error
+}
+
+// toError maps handler error to the response error
+func toError(err error) *Error {
+	if e, ok := errors.Cause(err).(*Error); ok {
+		return &Error{
+			Source:    e.Source,
+			Message:   e.Message,
+			Code:      e.Code,
+			Retryable: e.Retryable,
+		}
+	}
+	return &Error{
+		Source:    ApplicationError,
+		Message:   err.Error(),
+		Retryable: IsRetryable(err),
+	}
+}
+
+// classifiedError marks handler error as retryable or permanent
+type classifiedError struct {
+	error
+	retryable bool
+}
+
+func (e *classifiedError) Cause() error {
+	return e.error
+}
+
+// Retryable marks handler error as temporary failure.
+// Responder with Retry option requeues the request and calls handler again.
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classifiedError{error: err, retryable: true}
+}
+
+// Permanent marks handler error as failure which will not be resolved by
+// retrying. Responder with DeadLetter option sends the request to the
+// dead letter topic.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classifiedError{error: err}
+}
+
+// IsRetryable returns true if err is marked with Retryable or is *Error
+// with Retryable flag (registered retryable error code).
+func IsRetryable(err error) bool {
+	c, ok := classify(err)
+	return ok && c
+}
+
+// IsPermanent returns true if err is marked with Permanent.
+func IsPermanent(err error) bool {
+	c, ok := classify(err)
+	return ok && !c
+}
+
+// classify finds the outermost classification in the chain of causes
+func classify(err error) (retryable bool, ok bool) {
+	for err != nil {
+		switch e := err.(type) {
+		case *classifiedError:
+			return e.retryable, true
+		case *Error:
+			if e.Retryable {
+				return true, true
+			}
+			return false, false
+		}
+		c, ok := err.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		err = c.Cause()
+	}
+	return false, false
+}
@@ -0,0 +1,136 @@
+package amp
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// BodyField extracts single field from the json body without unmarshaling
+// whole body. Path is dot separated list of object keys and array indexes:
+//
+//	m.BodyField("event.id")
+//	m.BodyField("odds.0.home")
+//
+// Extracted fields are cached in the message.
+func (m *Msg) BodyField(path string) (json.RawMessage, bool) {
+	m.Lock()
+	if v, ok := m.fields[path]; ok {
+		m.Unlock()
+		return v, v != nil
+	}
+	m.Unlock()
+
+	var v json.RawMessage
+	if !m.IsBinary() {
+		v = extractField(m.BodyBytes(), strings.Split(path, "."))
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if m.fields == nil {
+		m.fields = make(map[string]json.RawMessage)
+	}
+	m.fields[path] = v
+	return v, v != nil
+}
+
+// BodyFieldString returns string field from the body, empty if not found.
+func (m *Msg) BodyFieldString(path string) string {
+	raw, ok := m.BodyField(path)
+	if !ok {
+		return ""
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return ""
+	}
+	return s
+}
+
+// extractField walks tokens of the body until field on the path is found,
+// values of other fields are skipped
+func extractField(body []byte, path []string) json.RawMessage {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	for _, key := range path {
+		t, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+		d, ok := t.(json.Delim)
+		if !ok {
+			return nil
+		}
+		switch d {
+		case '{':
+			if !seekKey(dec, key) {
+				return nil
+			}
+		case '[':
+			idx, err := strconv.Atoi(key)
+			if err != nil || !seekIndex(dec, idx) {
+				return nil
+			}
+		default:
+			return nil
+		}
+	}
+	var raw json.RawMessage
+	if err := dec.Decode(&raw); err != nil {
+		return nil
+	}
+	return raw
+}
+
+// seekKey positions decoder at the value of the object key
+func seekKey(dec *json.Decoder, key string) bool {
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return false
+		}
+		if k, ok := t.(string); ok && k == key {
+			return true
+		}
+		if err := skipValue(dec); err != nil {
+			return false
+		}
+	}
+	return false
+}
+
+// seekIndex positions decoder at the array element
+func seekIndex(dec *json.Decoder, idx int) bool {
+	for i := 0; dec.More(); i++ {
+		if i == idx {
+			return true
+		}
+		if err := skipValue(dec); err != nil {
+			return false
+		}
+	}
+	return false
+}
+
+// skipValue reads next value from the decoder, nested objects and arrays
+// are read token by token without allocating them
+func skipValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if d, ok := t.(json.Delim); ok {
+			if d == '{' || d == '[' {
+				depth++
+			} else {
+				depth--
+			}
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,360 @@
+// Package filter evaluates subscription filter expressions on message body.
+//
+// Expression compares body fields with constants:
+//
+//	body.league == "NBA"
+//	body.odds.home >= 1.5 && !(body.live == true)
+//	body.sport == "tennis" || body.sport == "football"
+//
+// Supported operators are == != < <= > >= && || ! and parentheses.
+// Constants are strings in double quotes, numbers, true, false and null.
+// Missing field is null.
+//
+// Session evaluates filters of the Full/Diff topics on the state merged
+// from Full and Diffs, not on the single Diff body (see amp/session).
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// Filter is compiled expression.
+type Filter struct {
+	expr string
+	root node
+}
+
+// Compile parses filter expression.
+func Compile(expr string) (*Filter, error) {
+	toks, err := lex(expr)
+	if err != nil {
+		return nil, errors.Wrap(err, expr)
+	}
+	p := &parser{toks: toks}
+	root, err := p.or()
+	if err == nil && p.pos < len(p.toks) {
+		err = fmt.Errorf("unexpected %s", p.toks[p.pos].val)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, expr)
+	}
+	return &Filter{expr: expr, root: root}, nil
+}
+
+// String returns filter expression.
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// Match evaluates filter on json body.
+// Body which is not valid json doesn't match.
+func (f *Filter) Match(body []byte) bool {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return false
+	}
+	return truthy(f.root.eval(v))
+}
+
+// lexer
+
+const (
+	tIdent = iota
+	tString
+	tNumber
+	tOp
+)
+
+type token struct {
+	typ int
+	val string
+}
+
+var ops = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")"}
+
+func lex(s string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(s) && s[j] != '"' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			v, err := strconv.Unquote(s[i : j+1])
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, token{tString, v})
+			i = j + 1
+		case c == '-' || unicode.IsDigit(c):
+			j := i + 1
+			for j < len(s) && (unicode.IsDigit(rune(s[j])) || s[j] == '.' || s[j] == 'e' || s[j] == 'E') {
+				j++
+			}
+			toks = append(toks, token{tNumber, s[i:j]})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i + 1
+			for j < len(s) && (unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j])) || s[j] == '_' || s[j] == '.') {
+				j++
+			}
+			toks = append(toks, token{tIdent, s[i:j]})
+			i = j
+		default:
+			found := false
+			for _, op := range ops {
+				if strings.HasPrefix(s[i:], op) {
+					toks = append(toks, token{tOp, op})
+					i += len(op)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unexpected character %q", c)
+			}
+		}
+	}
+	return toks, nil
+}
+
+// parser
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func (p *parser) peekOp(ops ...string) (string, bool) {
+	if p.pos >= len(p.toks) || p.toks[p.pos].typ != tOp {
+		return "", false
+	}
+	for _, op := range ops {
+		if p.toks[p.pos].val == op {
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) or() (node, error) {
+	l, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.peekOp("||"); !ok {
+			return l, nil
+		}
+		p.pos++
+		r, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l = &binary{op: "||", l: l, r: r}
+	}
+}
+
+func (p *parser) and() (node, error) {
+	l, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.peekOp("&&"); !ok {
+			return l, nil
+		}
+		p.pos++
+		r, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		l = &binary{op: "&&", l: l, r: r}
+	}
+}
+
+func (p *parser) not() (node, error) {
+	if _, ok := p.peekOp("!"); ok {
+		p.pos++
+		n, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return &negation{n: n}, nil
+	}
+	return p.cmp()
+}
+
+func (p *parser) cmp() (node, error) {
+	l, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.peekOp("==", "!=", "<", "<=", ">", ">=")
+	if !ok {
+		return l, nil
+	}
+	p.pos++
+	r, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	return &binary{op: op, l: l, r: r}, nil
+}
+
+func (p *parser) operand() (node, error) {
+	if p.pos >= len(p.toks) {
+		return nil, fmt.Errorf("unexpected end")
+	}
+	t := p.toks[p.pos]
+	p.pos++
+	switch t.typ {
+	case tString:
+		return &constant{v: t.val}, nil
+	case tNumber:
+		f, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return nil, err
+		}
+		return &constant{v: f}, nil
+	case tIdent:
+		switch t.val {
+		case "true":
+			return &constant{v: true}, nil
+		case "false":
+			return &constant{v: false}, nil
+		case "null":
+			return &constant{v: nil}, nil
+		}
+		parts := strings.Split(t.val, ".")
+		if parts[0] != "body" {
+			return nil, fmt.Errorf("unknown identifier %s", t.val)
+		}
+		return &field{path: parts[1:]}, nil
+	}
+	if t.val == "(" {
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.peekOp(")"); !ok {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return n, nil
+	}
+	return nil, fmt.Errorf("unexpected %s", t.val)
+}
+
+// evaluation
+
+type node interface {
+	eval(body interface{}) interface{}
+}
+
+type constant struct {
+	v interface{}
+}
+
+func (c *constant) eval(interface{}) interface{} {
+	return c.v
+}
+
+type field struct {
+	path []string
+}
+
+func (f *field) eval(body interface{}) interface{} {
+	v := body
+	for _, p := range f.path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[p]
+	}
+	return v
+}
+
+type negation struct {
+	n node
+}
+
+func (n *negation) eval(body interface{}) interface{} {
+	return !truthy(n.n.eval(body))
+}
+
+type binary struct {
+	op   string
+	l, r node
+}
+
+func (b *binary) eval(body interface{}) interface{} {
+	switch b.op {
+	case "&&":
+		return truthy(b.l.eval(body)) && truthy(b.r.eval(body))
+	case "||":
+		return truthy(b.l.eval(body)) || truthy(b.r.eval(body))
+	}
+	l, r := b.l.eval(body), b.r.eval(body)
+	switch b.op {
+	case "==":
+		return reflect.DeepEqual(l, r)
+	case "!=":
+		return !reflect.DeepEqual(l, r)
+	}
+	switch lv := l.(type) {
+	case float64:
+		rv, ok := r.(float64)
+		return ok && compare(b.op, lv < rv, lv == rv)
+	case string:
+		rv, ok := r.(string)
+		return ok && compare(b.op, lv < rv, lv == rv)
+	}
+	return false
+}
+
+func compare(op string, less, equal bool) bool {
+	switch op {
+	case "<":
+		return less
+	case "<=":
+		return less || equal
+	case ">":
+		return !less && !equal
+	case ">=":
+		return !less
+	}
+	return false
+}
+
+func truthy(v interface{}) bool {
+	switch t := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return t
+	case float64:
+		return t != 0
+	case string:
+		return t != ""
+	}
+	return true
+}
@@ -0,0 +1,48 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	body := []byte(`{"league":"NBA","live":false,"odds":{"home":1.75,"away":2.1},"tags":["a"]}`)
+	cases := []struct {
+		expr  string
+		match bool
+	}{
+		{`body.league == "NBA"`, true},
+		{`body.league != "NBA"`, false},
+		{`body.odds.home >= 1.5 && !(body.live == true)`, true},
+		{`body.odds.home < 1.5 || body.league == "NHL"`, false},
+		{`body.missing == null`, true},
+		{`body.odds.away > 2`, true},
+		{`body.league > "MLB"`, true},
+		{`body.tags == "a"`, false},
+		{`body.live`, false},
+		{`!body.live`, true},
+	}
+	for _, c := range cases {
+		f, err := Compile(c.expr)
+		assert.NoError(t, err, c.expr)
+		assert.Equal(t, c.match, f.Match(body), c.expr)
+	}
+	f, _ := Compile(`body.league == "NBA"`)
+	assert.False(t, f.Match([]byte("not json")))
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, expr := range []string{
+		``,
+		`body.league ==`,
+		`header.league == "NBA"`,
+		`(body.live == true`,
+		`body.league == "NBA`,
+		`body.league # 1`,
+		`body.a == 1 body.b == 2`,
+	} {
+		_, err := Compile(expr)
+		assert.Error(t, err, expr)
+	}
+}
@@ -0,0 +1,216 @@
+// Package flags is runtime changeable feature flags for handlers
+// and routing.
+//
+//	f := flags.New()
+//	f.WatchConsul(ctx, "flags/pricing", 10*time.Second) // or WatchFile
+//	r.Use(f.Handler)
+//	r.Handle("price/:id", price, f.Divert("new-pricing", newPrice))
+//
+// Handlers branch by flag:
+//
+//	if flags.Enabled(ctx, "new-pricing") { ... }
+//
+// Flag value is on, off or percent of the clients (for example 10%).
+// Client is selected by the client request meta, so the same client
+// always gets the same result.
+package flags
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/dcy"
+	"github.com/minus5/svckit/log"
+	"github.com/pkg/errors"
+)
+
+// ClientKey is request meta key identifying the client for percent flags.
+const ClientKey = "client"
+
+type ctxKey struct{}
+
+// Flags is set of feature flags.
+type Flags struct {
+	percents map[string]int // percent of the clients with flag enabled
+	sync.RWMutex
+}
+
+// New creates set without flags, all flags are off.
+func New() *Flags {
+	return &Flags{percents: make(map[string]int)}
+}
+
+// Set sets flag value: on, off or percent (10%).
+func (f *Flags) Set(name, value string) error {
+	p, err := parse(value)
+	if err != nil {
+		return errors.Wrapf(err, "flag %s", name)
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.percents[name] = p
+	return nil
+}
+
+// Load replaces all flags with values.
+func (f *Flags) Load(values map[string]string) error {
+	percents := make(map[string]int)
+	for name, v := range values {
+		p, err := parse(v)
+		if err != nil {
+			return errors.Wrapf(err, "flag %s", name)
+		}
+		percents[name] = p
+	}
+	f.Lock()
+	f.percents = percents
+	f.Unlock()
+	return nil
+}
+
+func parse(v string) (int, error) {
+	v = strings.ToLower(strings.TrimSpace(v))
+	switch v {
+	case "on", "true", "1":
+		return 100, nil
+	case "off", "false", "0", "":
+		return 0, nil
+	}
+	if strings.HasSuffix(v, "%") {
+		p, err := strconv.Atoi(strings.TrimSpace(v[:len(v)-1]))
+		if err == nil && p >= 0 && p <= 100 {
+			return p, nil
+		}
+	}
+	return 0, errors.Errorf("wrong value %q, expecting on, off or percent", v)
+}
+
+// EnabledFor returns true if flag is enabled for the client.
+// Without client percent flags are enabled at random.
+func (f *Flags) EnabledFor(name, client string) bool {
+	f.RLock()
+	p := f.percents[name]
+	f.RUnlock()
+	switch {
+	case p <= 0:
+		return false
+	case p >= 100:
+		return true
+	case client == "":
+		return rand.Intn(100) < p
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name + "/" + client))
+	return int(h.Sum32()%100) < p
+}
+
+// Handler is middleware which makes flags available to the handler
+// by Enabled.
+func (f *Flags) Handler(h amp.Handler) amp.Handler {
+	return func(ctx context.Context, m *amp.Msg) (*amp.Msg, error) {
+		return h(context.WithValue(ctx, ctxKey{}, f), m)
+	}
+}
+
+// Divert is route middleware which sends requests with flag enabled
+// to the handler to, others go to the route handler.
+func (f *Flags) Divert(name string, to amp.Handler) amp.Middleware {
+	return func(h amp.Handler) amp.Handler {
+		return func(ctx context.Context, m *amp.Msg) (*amp.Msg, error) {
+			if f.EnabledFor(name, m.Meta[ClientKey]) {
+				amp.CountMsg("flag."+name, m)
+				return to(ctx, m)
+			}
+			return h(ctx, m)
+		}
+	}
+}
+
+// Enabled returns true if flag is enabled for the client of the request
+// in handler ctx. False if flags are not in ctx (see Handler).
+func Enabled(ctx context.Context, name string) bool {
+	f, ok := ctx.Value(ctxKey{}).(*Flags)
+	if !ok {
+		return false
+	}
+	return f.EnabledFor(name, amp.MetaFromContext(ctx, ClientKey))
+}
+
+// LoadConsul replaces flags with those from Consul KV.
+// Under prefix key is flag name and value is flag value.
+func (f *Flags) LoadConsul(prefix string) error {
+	kvs, err := dcy.KVs(prefix)
+	if err == dcy.ErrKeyNotFound {
+		kvs = make(map[string]string)
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+	delete(kvs, "")
+	return f.Load(kvs)
+}
+
+// LoadFile replaces flags with those from the json file,
+// object with flag names as keys and flag values.
+func (f *Flags) LoadFile(path string) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var values map[string]string
+	if err := json.Unmarshal(buf, &values); err != nil {
+		return errors.Wrapf(err, "flags file %s", path)
+	}
+	return f.Load(values)
+}
+
+// WatchConsul reloads flags from Consul KV every interval until ctx is done.
+func (f *Flags) WatchConsul(ctx context.Context, prefix string, interval time.Duration) {
+	f.watch(ctx, interval, func() error { return f.LoadConsul(prefix) }, log.S("prefix", prefix))
+}
+
+// WatchFile reloads flags from the file when it is changed, checks every
+// interval until ctx is done.
+func (f *Flags) WatchFile(ctx context.Context, path string, interval time.Duration) {
+	var modified time.Time
+	load := func() error {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if fi.ModTime().Equal(modified) {
+			return nil
+		}
+		if err := f.LoadFile(path); err != nil {
+			return err
+		}
+		modified = fi.ModTime()
+		return nil
+	}
+	f.watch(ctx, interval, load, log.S("path", path))
+}
+
+func (f *Flags) watch(ctx context.Context, interval time.Duration, load func() error, l *log.Agregator) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			if err := load(); err != nil {
+				l.Error(err)
+			}
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
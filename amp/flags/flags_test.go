@@ -0,0 +1,95 @@
+package flags
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnabled(t *testing.T) {
+	f := New()
+	assert.False(t, f.EnabledFor("new-pricing", "c1"))
+	assert.NoError(t, f.Set("new-pricing", "on"))
+	assert.True(t, f.EnabledFor("new-pricing", "c1"))
+	assert.Error(t, f.Set("new-pricing", "maybe"))
+	assert.Error(t, f.Set("new-pricing", "120%"))
+
+	// percent is stable per client
+	assert.NoError(t, f.Set("new-pricing", "30%"))
+	on := 0
+	for i := 0; i < 1000; i++ {
+		c := fmt.Sprintf("c%d", i)
+		e := f.EnabledFor("new-pricing", c)
+		assert.Equal(t, e, f.EnabledFor("new-pricing", c))
+		if e {
+			on++
+		}
+	}
+	assert.InDelta(t, 300, on, 60)
+}
+
+func TestHandler(t *testing.T) {
+	f := New()
+	f.Set("new-pricing", "on")
+	ctx := context.Background()
+	assert.False(t, Enabled(ctx, "new-pricing"))
+
+	old := func(ctx context.Context, m *amp.Msg) (*amp.Msg, error) {
+		return m.Response(Enabled(ctx, "new-pricing")), nil
+	}
+	diverted := func(ctx context.Context, m *amp.Msg) (*amp.Msg, error) {
+		return m.Response("diverted"), nil
+	}
+	r := amp.NewRouter()
+	r.Use(f.Handler)
+	r.Handle("price", old)
+	r.Handle("odds", old, f.Divert("new-odds", diverted))
+
+	m := &amp.Msg{URI: "pricing.req/price", Meta: map[string]string{ClientKey: "c1"}}
+	rsp, err := r.Handler(ctx, m)
+	assert.NoError(t, err)
+	assert.Equal(t, true, body(rsp))
+
+	m = &amp.Msg{URI: "pricing.req/odds"}
+	rsp, _ = r.Handler(ctx, m)
+	assert.Equal(t, true, body(rsp))
+	f.Set("new-odds", "on")
+	rsp, _ = r.Handler(ctx, m)
+	assert.Equal(t, "diverted", body(rsp))
+}
+
+func body(m *amp.Msg) interface{} {
+	var v interface{}
+	json.Unmarshal(m.BodyBytes(), &v)
+	return v
+}
+
+func TestWatchFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flags")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "flags.json")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`{"a": "on", "b": "off"}`), 0644))
+
+	f := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f.WatchFile(ctx, path, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	assert.True(t, f.EnabledFor("a", ""))
+	assert.False(t, f.EnabledFor("b", ""))
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`{"b": "on"}`), 0644))
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	time.Sleep(10 * time.Millisecond)
+	assert.False(t, f.EnabledFor("a", ""))
+	assert.True(t, f.EnabledFor("b", ""))
+}
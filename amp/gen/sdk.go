@@ -0,0 +1,272 @@
+package gen
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/token"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Service describes requests and topics of the service.
+// It is input for the client SDK generation (GoClient, TsClient):
+//
+//	s := gen.Service{
+//		Name: "math",
+//		Methods: []gen.Method{
+//			{Name: "Add", URI: "math.req/add", Request: params{}, Response: rsp{}},
+//		},
+//		Topics: []gen.Topic{
+//			{Name: "I", URI: "math.v1/i", Body: params{}},
+//		},
+//	}
+//	gen.GoClient(s, "./client/client_gen.go")
+//
+// Fields of the request struct become arguments of the generated method,
+// so add becomes client.Add(ctx, x, y).
+type Service struct {
+	Name    string // service name
+	Package string // package of the generated Go client, default Name
+	Methods []Method
+	Topics  []Topic
+}
+
+// Method is request uri with request and response body types.
+type Method struct {
+	Name     string      // name of the client method
+	URI      string      // request uri
+	Request  interface{} // request struct value, nil if request has no body
+	Response interface{} // response struct value, nil if response has no body
+}
+
+// Topic is subscription uri with message body type.
+type Topic struct {
+	Name string      // name of the client subscription method (On<Name>)
+	URI  string      // topic or topic/path
+	Body interface{} // message body struct value
+}
+
+type sdkData struct {
+	Package  string
+	Service  string
+	Client   string
+	UsesTime bool
+	Types    []*sdkType
+	Methods  []sdkMethod
+	Topics   []sdkTopic
+}
+
+type sdkType struct {
+	Name   string
+	Fields []sdkField
+}
+
+type sdkField struct {
+	Name     string // Go field name
+	Arg      string // method argument name
+	JSON     string // json key
+	GoType   string
+	TsType   string
+	Optional bool
+}
+
+type sdkMethod struct {
+	Name     string
+	TsName   string
+	URI      string
+	Args     []sdkField
+	Request  string // request type name, empty if no body
+	Response string // response type name, empty if no body
+}
+
+type sdkTopic struct {
+	Name string
+	URI  string
+	Body string
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// GoClient generates Go client of the service into the file.
+func GoClient(s Service, file string) error {
+	return generateSDK(s, goClientTemplate, file, true)
+}
+
+// TsClient generates TypeScript client of the service into the file.
+// Generated client wraps api of the js sdk (request, subscribe, unSubscribe).
+func TsClient(s Service, file string) error {
+	return generateSDK(s, tsClientTemplate, file, false)
+}
+
+func generateSDK(s Service, tpl *template.Template, file string, gofmt bool) error {
+	d, err := newSDKData(s)
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	if err := tpl.Execute(&b, d); err != nil {
+		return errors.WithStack(err)
+	}
+	src := b.Bytes()
+	if gofmt {
+		if src, err = format.Source(src); err != nil {
+			return errors.Wrap(err, "go fmt")
+		}
+	}
+	if err := ioutil.WriteFile(file, src, 0644); err != nil {
+		return errors.WithStack(err)
+	}
+	fmt.Printf("generated %s\n", file)
+	return nil
+}
+
+func newSDKData(s Service) (*sdkData, error) {
+	d := &sdkData{
+		Package: s.Package,
+		Service: s.Name,
+		Client:  strings.Title(s.Name) + "Client",
+	}
+	if d.Package == "" {
+		d.Package = s.Name
+	}
+	types := make(map[string]*sdkType)
+	for _, m := range s.Methods {
+		if m.Name == "" || m.URI == "" {
+			return nil, errors.Errorf("method %q without name or uri", m.URI)
+		}
+		sm := sdkMethod{Name: m.Name, TsName: nonExported(m.Name), URI: m.URI}
+		if m.Request != nil {
+			t, err := d.addType(types, reflect.TypeOf(m.Request))
+			if err != nil {
+				return nil, err
+			}
+			sm.Request = t.Name
+			sm.Args = t.Fields
+		}
+		if m.Response != nil {
+			t, err := d.addType(types, reflect.TypeOf(m.Response))
+			if err != nil {
+				return nil, err
+			}
+			sm.Response = t.Name
+		}
+		d.Methods = append(d.Methods, sm)
+	}
+	for _, t := range s.Topics {
+		if t.Name == "" || t.URI == "" {
+			return nil, errors.Errorf("topic %q without name or uri", t.URI)
+		}
+		st := sdkTopic{Name: t.Name, URI: t.URI}
+		if t.Body != nil {
+			bt, err := d.addType(types, reflect.TypeOf(t.Body))
+			if err != nil {
+				return nil, err
+			}
+			st.Body = bt.Name
+		}
+		d.Topics = append(d.Topics, st)
+	}
+	for _, t := range types {
+		d.Types = append(d.Types, t)
+	}
+	sort.Slice(d.Types, func(i, j int) bool { return d.Types[i].Name < d.Types[j].Name })
+	return d, nil
+}
+
+// addType adds struct type t and all structs used in its fields
+func (d *sdkData) addType(types map[string]*sdkType, t reflect.Type) (*sdkType, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || t.Name() == "" {
+		return nil, errors.Errorf("%s is not named struct", t)
+	}
+	name := strings.Title(t.Name())
+	if st, ok := types[name]; ok {
+		return st, nil
+	}
+	st := &sdkType{Name: name}
+	types[name] = st
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		key, opts := f.Name, ""
+		if tag, ok := f.Tag.Lookup("json"); ok {
+			if tag == "-" {
+				continue
+			}
+			p := strings.SplitN(tag, ",", 2)
+			if p[0] != "" {
+				key = p[0]
+			}
+			if len(p) > 1 {
+				opts = p[1]
+			}
+		}
+		goType, tsType, err := d.fieldType(types, f.Type)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s.%s", t.Name(), f.Name)
+		}
+		arg := nonExported(f.Name)
+		if token.Lookup(arg).IsKeyword() {
+			arg += "_"
+		}
+		st.Fields = append(st.Fields, sdkField{
+			Name:     f.Name,
+			Arg:      arg,
+			JSON:     key,
+			GoType:   goType,
+			TsType:   tsType,
+			Optional: strings.Contains(opts, "omitempty") || f.Type.Kind() == reflect.Ptr,
+		})
+	}
+	return st, nil
+}
+
+// fieldType returns Go and TypeScript type of the field
+func (d *sdkData) fieldType(types map[string]*sdkType, t reflect.Type) (string, string, error) {
+	if t == timeType {
+		d.UsesTime = true
+		return "time.Time", "string", nil
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "bool", "boolean", nil
+	case reflect.String:
+		return "string", "string", nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return t.Kind().String(), "number", nil
+	case reflect.Interface:
+		return "interface{}", "any", nil
+	case reflect.Ptr:
+		g, ts, err := d.fieldType(types, t.Elem())
+		return "*" + g, ts, err
+	case reflect.Slice:
+		g, ts, err := d.fieldType(types, t.Elem())
+		return "[]" + g, ts + "[]", err
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return "", "", errors.Errorf("map key %s is not string", t.Key())
+		}
+		g, ts, err := d.fieldType(types, t.Elem())
+		return "map[string]" + g, "{ [key: string]: " + ts + " }", err
+	case reflect.Struct:
+		st, err := d.addType(types, t)
+		if err != nil {
+			return "", "", err
+		}
+		return st.Name, st.Name, nil
+	}
+	return "", "", errors.Errorf("unsupported type %s", t)
+}
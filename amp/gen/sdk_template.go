@@ -0,0 +1,110 @@
+package gen
+
+import "text/template"
+
+var goClientTemplate = template.Must(template.New("").Parse(`// Code generated by go generate; DO NOT EDIT.
+package {{.Package}}
+
+import (
+	"context"
+{{- if .UsesTime}}
+	"time"
+{{- end}}
+
+{{if .Topics}}	"github.com/minus5/svckit/amp"
+{{end}}	"github.com/minus5/svckit/amp/client"
+)
+
+{{range .Types}}
+type {{.Name}} struct {
+{{- range .Fields}}
+	{{.Name}} {{.GoType}} ` + "`" + `json:"{{.JSON}}{{if .Optional}},omitempty{{end}}"` + "`" + `
+{{- end}}
+}
+{{end}}
+
+// Client is typed client of the {{.Service}} service.
+type Client struct {
+	requester  client.Requester
+	subscriber *client.Client
+}
+
+// New creates client. Requester is used for the requests, subscriber
+// (could be nil) for the topics.
+func New(requester client.Requester, subscriber *client.Client) *Client {
+	return &Client{requester: requester, subscriber: subscriber}
+}
+{{range .Methods}}
+// {{.Name}} sends {{.URI}} request.
+func (c *Client) {{.Name}}(ctx context.Context{{range .Args}}, {{.Arg}} {{.GoType}}{{end}}) ({{if .Response}}*{{.Response}}, {{end}}error) {
+{{- if .Request}}
+	req := &{{.Request}}{
+{{- range .Args}}
+		{{.Name}}: {{.Arg}},
+{{- end}}
+	}
+{{- else}}
+	var req interface{}
+{{- end}}
+{{- if .Response}}
+	rsp := &{{.Response}}{}
+	if err := client.Call(ctx, c.requester, "{{.URI}}", req, rsp); err != nil {
+		return nil, err
+	}
+	return rsp, nil
+{{- else}}
+	return client.Call(ctx, c.requester, "{{.URI}}", req, nil)
+{{- end}}
+}
+{{end}}
+{{- range .Topics}}
+// On{{.Name}} subscribes to {{.URI}}, fn is called with each message and its body.
+func (c *Client) On{{.Name}}(fn func(m *amp.Msg{{if .Body}}, body *{{.Body}}{{end}})) {
+	c.subscriber.OnMessage("{{.URI}}", func(m *amp.Msg) {
+{{- if .Body}}
+		body := &{{.Body}}{}
+		if err := m.Unmarshal(body); err != nil {
+			return
+		}
+		fn(m, body)
+{{- else}}
+		fn(m)
+{{- end}}
+	})
+}
+{{end}}`))
+
+var tsClientTemplate = template.Must(template.New("").Parse(`// Code generated by go generate; DO NOT EDIT.
+{{range .Types}}
+export interface {{.Name}} {
+{{- range .Fields}}
+  {{.JSON}}{{if .Optional}}?{{end}}: {{.TsType}};
+{{- end}}
+}
+{{end}}
+// Api is the api of the js sdk.
+export interface Api {
+  request(uri: string, payload: any, ok: (rsp: any) => void, fail: (err: any) => void): void;
+  subscribe(key: string, handler: (full: any, diff: any) => void): void;
+  unSubscribe(key: string, handler: (full: any, diff: any) => void): void;
+}
+
+// {{.Client}} is typed client of the {{.Service}} service.
+export class {{.Client}} {
+  constructor(private api: Api) {}
+{{range .Methods}}
+  // {{.TsName}} sends {{.URI}} request.
+  {{.TsName}}({{range $i, $a := .Args}}{{if $i}}, {{end}}{{$a.Arg}}: {{$a.TsType}}{{end}}): Promise<{{if .Response}}{{.Response}}{{else}}void{{end}}> {
+    const payload = {{if .Request}}{ {{- range $i, $a := .Args}}{{if $i}},{{end}} {{$a.JSON}}: {{$a.Arg}}{{end}} }{{else}}null{{end}};
+    return new Promise((resolve, reject) => this.api.request("{{.URI}}", payload, resolve, reject));
+  }
+{{end}}
+{{- range .Topics}}
+  // on{{.Name}} subscribes to {{.URI}}, returns unsubscribe function.
+  on{{.Name}}(handler: (full: {{if .Body}}{{.Body}}{{else}}any{{end}}, diff: {{if .Body}}Partial<{{.Body}}>{{else}}any{{end}} | null) => void): () => void {
+    this.api.subscribe("{{.URI}}", handler);
+    return () => this.api.unSubscribe("{{.URI}}", handler);
+  }
+{{end -}}
+}
+`))
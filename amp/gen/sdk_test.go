@@ -0,0 +1,68 @@
+package gen
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type sdkParams struct {
+	X    int64  `json:"x,omitempty"`
+	Type string `json:"type"`
+	Skip string `json:"-"`
+}
+
+type sdkEvent struct {
+	At      time.Time          `json:"at"`
+	Players []sdkPlayer        `json:"players"`
+	Odds    map[string]float64 `json:"odds"`
+	Note    *string            `json:"note"`
+}
+
+type sdkPlayer struct {
+	Name string
+}
+
+func TestSDK(t *testing.T) {
+	s := Service{
+		Name: "sport",
+		Methods: []Method{
+			{Name: "Find", URI: "sport.req/find", Request: sdkParams{}, Response: sdkEvent{}},
+			{Name: "Ping", URI: "sport.req/ping"},
+		},
+		Topics: []Topic{{Name: "Events", URI: "sport.v1/events", Body: &sdkEvent{}}},
+	}
+	d, err := newSDKData(s)
+	assert.NoError(t, err)
+	assert.True(t, d.UsesTime)
+	assert.Len(t, d.Types, 3)
+	args := d.Methods[0].Args
+	assert.Len(t, args, 2)
+	assert.Equal(t, "type_", args[1].Arg)
+	assert.True(t, args[0].Optional)
+
+	ev := d.Types[0]
+	assert.Equal(t, "SdkEvent", ev.Name)
+	assert.Equal(t, "[]SdkPlayer", ev.Fields[1].GoType)
+	assert.Equal(t, "SdkPlayer[]", ev.Fields[1].TsType)
+	assert.Equal(t, "{ [key: string]: number }", ev.Fields[2].TsType)
+	assert.True(t, ev.Fields[3].Optional)
+
+	dir, err := ioutil.TempDir("", "sdk")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, GoClient(s, filepath.Join(dir, "client.go")))
+	buf, _ := ioutil.ReadFile(filepath.Join(dir, "client.go"))
+	assert.Contains(t, string(buf), "func (c *Client) Find(ctx context.Context, x int64, type_ string) (*SdkEvent, error)")
+	assert.Contains(t, string(buf), "func (c *Client) Ping(ctx context.Context) error")
+	assert.NoError(t, TsClient(s, filepath.Join(dir, "client.ts")))
+	buf, _ = ioutil.ReadFile(filepath.Join(dir, "client.ts"))
+	assert.Contains(t, string(buf), "find(x: number, type_: string): Promise<SdkEvent>")
+
+	_, err = newSDKData(Service{Methods: []Method{{Name: "Find", URI: "sport.req/find", Request: map[int]string{}}}})
+	assert.Error(t, err)
+}
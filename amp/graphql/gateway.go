@@ -0,0 +1,293 @@
+// Package graphql is GraphQL server on top of amp, so front-end teams can
+// consume feeds with their standard GraphQL tooling.
+//
+// Root query fields are mapped to amp requests, field arguments are request
+// body and response body is projected by the field selection set.
+// Root subscription fields are mapped to topics. Full, Diff and Update
+// messages are merged into the current state of the uri and the state is
+// projected and sent to the client, Append messages are projected one by
+// one. Reserved fields _uri, _ts and _type (update type of the message)
+// select message attributes.
+//
+// Fields, arguments and results are typed by the schema types, untyped
+// fields are JSON. Introspection (__schema, __type, __typename) is
+// resolved by the gateway.
+//
+//	s := graphql.NewSchema().
+//		Query("add", "math.req/add").
+//		Subscription("odds", "odds")
+//	g := graphql.New(s, brk, requester)
+//	g.Route(httpi.Subrouter("/graphql"))
+//	ws.Listen(ctx, ln, func(c *ws.Conn) { g.Serve(c) })
+//
+// Queries are POSTed as json {"query": ..., "variables": ...}.
+// Subscriptions use graphql-ws (subscriptions-transport-ws) protocol.
+// Schema fields can be stitched from many services (see Schema.LoadConsul).
+package graphql
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/httpi"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+	"github.com/pkg/errors"
+)
+
+// Reserved subscription fields
+const (
+	fieldURI  = "_uri"
+	fieldTs   = "_ts"
+	fieldType = "_type"
+)
+
+type broker interface {
+	Subscribe(amp.Subscriber, map[string]int64)
+	Unsubscribe(amp.Subscriber)
+}
+
+type requester interface {
+	Send(amp.Subscriber, *amp.Msg)
+}
+
+// Gateway executes GraphQL operations against amp.
+type Gateway struct {
+	schema    *Schema
+	broker    broker
+	requester requester
+	timeout   time.Duration
+}
+
+// Timeout sets max duration of the query request, default 10s.
+func Timeout(d time.Duration) func(*Gateway) {
+	return func(g *Gateway) {
+		g.timeout = d
+	}
+}
+
+// New creates gateway.
+func New(schema *Schema, brk broker, req requester, opts ...func(*Gateway)) *Gateway {
+	g := &Gateway{
+		schema:    schema,
+		broker:    brk,
+		requester: req,
+		timeout:   10 * time.Second,
+	}
+	for _, o := range opts {
+		o(g)
+	}
+	return g
+}
+
+// Error is GraphQL response error.
+type Error struct {
+	Message string   `json:"message"`
+	Path    []string `json:"path,omitempty"`
+	Code    int      `json:"code,omitempty"`
+}
+
+// Response is GraphQL response.
+type Response struct {
+	Data   object  `json:"data"`
+	Errors []Error `json:"errors,omitempty"`
+}
+
+type request struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+// Route registers query endpoint and schema on the router.
+func (g *Gateway) Route(rt *httpi.Router) {
+	rt.Route("/", g.httpQuery).Methods("POST")
+	rt.Route("/schema", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(g.schema.SDL()))
+	}).Methods("GET")
+}
+
+func (g *Gateway) httpQuery(w http.ResponseWriter, r *http.Request) {
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	op, err := Parse(req.Query, req.Variables)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Errors: []Error{{Message: err.Error()}}})
+		return
+	}
+	if op.Type != OpQuery {
+		writeJSON(w, http.StatusBadRequest, Response{Errors: []Error{{Message: "subscriptions are supported over websocket only"}}})
+		return
+	}
+	writeJSON(w, http.StatusOK, g.Query(op))
+}
+
+func writeJSON(w http.ResponseWriter, status int, o interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(o); err != nil {
+		log.Error(err)
+	}
+}
+
+// Query executes query operation.
+// Root fields are requested concurrently.
+func (g *Gateway) Query(op *Operation) Response {
+	type result struct {
+		value interface{}
+		err   *Error
+	}
+	results := make([]result, len(op.Selections))
+	var wg sync.WaitGroup
+	for i, sel := range op.Selections {
+		if isIntrospection(sel.Name) {
+			v, err := g.schema.introspect(sel)
+			results[i].value = v
+			if err != nil {
+				results[i].err = &Error{Message: err.Error(), Path: []string{sel.Alias}}
+			}
+			continue
+		}
+		f, err := g.schema.check(OpQuery, sel)
+		if err != nil {
+			results[i].err = &Error{Message: err.Error(), Path: []string{sel.Alias}}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, sel *Selection, f Field) {
+			defer wg.Done()
+			v, err := g.request(f, sel)
+			if err != nil {
+				e := &Error{Message: err.Error(), Path: []string{sel.Alias}}
+				if ae, ok := errors.Cause(err).(*amp.Error); ok {
+					e.Message = ae.Message
+					e.Code = ae.Code
+				}
+				results[i].err = e
+				metric.Counter("graphql.query." + sel.Name + ".failed")
+				return
+			}
+			results[i].value = project(v, sel.Selections)
+		}(i, sel, f)
+	}
+	wg.Wait()
+
+	var rsp Response
+	for i, sel := range op.Selections {
+		rsp.Data = append(rsp.Data, member{Key: sel.Alias, Value: results[i].value})
+		if results[i].err != nil {
+			rsp.Errors = append(rsp.Errors, *results[i].err)
+		}
+	}
+	return rsp
+}
+
+// request sends amp request for the field and waits for the response
+func (g *Gateway) request(f Field, sel *Selection) (interface{}, error) {
+	args := sel.Args
+	if args == nil {
+		args = make(map[string]interface{})
+	}
+	rsp := make(oneShot, 1)
+	g.requester.Send(rsp, amp.NewRequest(f.Request, args))
+	metric.Counter("graphql.query." + sel.Name)
+	select {
+	case m := <-rsp:
+		if m.Error != nil {
+			return nil, m.Error
+		}
+		return decode(m.BodyBytes())
+	case <-time.After(g.timeout):
+		return nil, errors.Errorf("request %s timeout", f.Request)
+	}
+}
+
+// oneShot receives single response
+type oneShot chan *amp.Msg
+
+func (c oneShot) Send(m *amp.Msg) {
+	select {
+	case c <- m:
+	default:
+	}
+}
+
+func decode(body []byte) (interface{}, error) {
+	if len(body) == 0 {
+		return nil, nil
+	}
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return v, nil
+}
+
+// project returns v with only selected fields, lists are projected element
+// by element, scalars are returned unchanged. Fields __typename of the
+// typed results are resolved by the schema check.
+func project(v interface{}, sels []*Selection) interface{} {
+	if len(sels) == 0 {
+		return v
+	}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		o := make(object, 0, len(sels))
+		for _, s := range sels {
+			if s.typename != "" {
+				o = append(o, member{Key: s.Alias, Value: s.typename})
+				continue
+			}
+			o = append(o, member{Key: s.Alias, Value: project(t[s.Name], s.Selections)})
+		}
+		return o
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, e := range t {
+			l[i] = project(e, sels)
+		}
+		return l
+	}
+	return v
+}
+
+// object is json object which keeps order of the selected fields
+type object []member
+
+type member struct {
+	Key   string
+	Value interface{}
+}
+
+func (o object) MarshalJSON() ([]byte, error) {
+	if o == nil {
+		return []byte("null"), nil
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, m := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(m.Key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(m.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,367 @@
+package graphql
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/httpi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	op, err := Parse(`subscription Odds($id: String = "1", $n: Int!) {
+		match: odds(path: $id, limit: $n, tags: [A, "b"], f: {x: true}) { home away { price } }
+	}`, map[string]interface{}{"n": 3})
+	assert.NoError(t, err)
+	assert.Equal(t, OpSubscription, op.Type)
+	assert.Equal(t, "Odds", op.Name)
+	assert.Len(t, op.Selections, 1)
+	s := op.Selections[0]
+	assert.Equal(t, "match", s.Alias)
+	assert.Equal(t, "odds", s.Name)
+	assert.Equal(t, "1", s.Args["path"])
+	assert.Equal(t, 3, s.Args["limit"])
+	assert.Equal(t, []interface{}{"A", "b"}, s.Args["tags"])
+	assert.Equal(t, map[string]interface{}{"x": true}, s.Args["f"])
+	assert.Len(t, s.Selections, 2)
+	assert.Equal(t, "price", s.Selections[1].Selections[0].Name)
+
+	op, err = Parse(`{ add(x: 1, y: -2.5) }`, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, OpQuery, op.Type)
+	assert.Equal(t, json.Number("-2.5"), op.Selections[0].Args["y"])
+
+	for _, q := range []string{
+		`mutation { a }`,
+		`{ a { ...F } }`,
+		`{ a { ...F } } fragment F on A { b ...F }`,
+		`{ a @defer }`,
+		`{ a @skip }`,
+		`{ a: b a }`,
+		`{ }`,
+		`{ a } { b }`,
+		`{ a(x: "unterminated) }`,
+	} {
+		_, err := Parse(q, nil)
+		assert.Error(t, err, q)
+	}
+}
+
+func TestParseFragments(t *testing.T) {
+	op, err := Parse(`query($no: Boolean = false) {
+		a { ...F x @include(if: $no) ... on A { y z { v } } }
+		b @skip(if: true)
+	}
+	fragment F on A { x z { w } }`, nil)
+	assert.NoError(t, err)
+	assert.Len(t, op.Selections, 1)
+	a := op.Selections[0]
+	assert.Len(t, a.Selections, 3)
+	assert.Equal(t, "x", a.Selections[0].Name)
+	assert.Equal(t, "z", a.Selections[1].Name)
+	assert.Equal(t, "y", a.Selections[2].Name)
+	z := a.Selections[1].Selections
+	assert.Len(t, z, 2)
+	assert.Equal(t, "w", z[0].Name)
+	assert.Equal(t, "v", z[1].Name)
+}
+
+func TestProject(t *testing.T) {
+	op, _ := Parse(`{ f { b a: c list { x } } }`, nil)
+	v, _ := decode([]byte(`{"a":1,"b":2,"c":3,"list":[{"x":1,"y":2},{"x":3}]}`))
+	buf, err := json.Marshal(project(v, op.Selections[0].Selections))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"b":2,"a":3,"list":[{"x":1},{"x":3}]}`, string(buf))
+}
+
+func TestSchemaStitch(t *testing.T) {
+	s := NewSchema()
+	assert.NoError(t, s.Stitch("math", []Field{{Name: "add", Request: "math.req/add"}, {Name: "sums", Topic: "sums"}}))
+	assert.Error(t, s.Stitch("calc", []Field{{Name: "add", Request: "calc.req/add"}}))
+	assert.Error(t, s.Stitch("calc", []Field{{Name: "bad"}}))
+	assert.NoError(t, s.Stitch("math", []Field{{Name: "mul", Request: "math.req/mul"}}))
+
+	_, ok := s.field(OpQuery, "add")
+	assert.False(t, ok)
+	f, ok := s.field(OpQuery, "mul")
+	assert.True(t, ok)
+	assert.Equal(t, "math", f.Service)
+	assert.Equal(t, "scalar JSON\n\ntype Query {\n  mul(args: JSON): JSON\n}\n", s.SDL())
+}
+
+func testTypedSchema(t *testing.T) *Schema {
+	s := NewSchema()
+	assert.NoError(t, s.Stitch("odds", []Field{
+		{Name: "match", Request: "odds.req/match", Args: []TypeField{{Name: "id", Type: "ID!"}, {Name: "limit", Type: "Int"}}, Type: "Match"},
+		{Name: "odds", Topic: "odds", Type: "Match"},
+	}, Type{Name: "Match", Fields: []TypeField{
+		{Name: "id", Type: "ID!"},
+		{Name: "odds", Type: "[Odds!]"},
+		{Name: "extra"},
+	}}, Type{Name: "Odds", Fields: []TypeField{
+		{Name: "home", Type: "Float"},
+		{Name: "away", Type: "Float"},
+	}}))
+	return s
+}
+
+func TestSchemaTypes(t *testing.T) {
+	s := testTypedSchema(t)
+	assert.Equal(t, `scalar JSON
+
+type Match {
+  id: ID!
+  odds: [Odds!]
+  extra: JSON
+}
+
+type Odds {
+  home: Float
+  away: Float
+}
+
+type Query {
+  match(id: ID!, limit: Int): Match
+}
+
+type Subscription {
+  odds(args: JSON): Match
+}
+`, s.SDL())
+
+	// types of other service are not visible, names are owned by service
+	assert.Error(t, s.Stitch("live", []Field{{Name: "live", Topic: "live", Type: "Odds"}}))
+	assert.Error(t, s.Stitch("live", nil, Type{Name: "Odds", Fields: []TypeField{{Name: "x"}}}))
+	assert.Error(t, s.Stitch("live", []Field{{Name: "live", Request: "live.req/x", Args: []TypeField{{Name: "m", Type: "Match"}}}}))
+	assert.Error(t, s.Stitch("live", nil, Type{Name: "String", Fields: []TypeField{{Name: "x"}}}))
+	assert.Error(t, s.Stitch("live", nil, Type{Name: "Live", Fields: []TypeField{{Name: "x", Type: "[Int"}}}))
+
+	for q, msg := range map[string]string{
+		`{ match(id: "1") { id odds { home } extra { a } __typename } }`: "",
+		`{ match(id: 1, limit: 2) { id } }`:                              "",
+		`{ match { id } }`:                                               "argument id of field match: null value of type ID!",
+		`{ match(id: "1", limit: 1.5) { id } }`:                          "argument limit of field match: invalid value 1.5 of type Int",
+		`{ match(id: "1", x: 1) { id } }`:                                "unknown argument x of field match",
+		`{ match(id: "1") }`:                                             "field match of type Match must have selections",
+		`{ match(id: "1") { id { x } } }`:                                "field id of type ID! must not have selections",
+		`{ match(id: "1") { nope } }`:                                    "unknown field nope of type Match",
+		`{ nope }`:                                                       "unknown field nope",
+	} {
+		op, err := Parse(q, nil)
+		assert.NoError(t, err, q)
+		_, err = s.check(OpQuery, op.Selections[0])
+		if msg == "" {
+			assert.NoError(t, err, q)
+			continue
+		}
+		if assert.Error(t, err, q) {
+			assert.Equal(t, msg, err.Error(), q)
+		}
+	}
+
+	op, _ := Parse(`{ match(id: "1") { t: __typename odds { __typename home } } }`, nil)
+	_, err := s.check(OpQuery, op.Selections[0])
+	assert.NoError(t, err)
+	v, _ := decode([]byte(`{"id":"1","odds":[{"home":1.5,"away":2}]}`))
+	buf, err := json.Marshal(project(v, op.Selections[0].Selections))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"t":"Match","odds":[{"__typename":"Odds","home":1.5}]}`, string(buf))
+
+	op, _ = Parse(`subscription { odds(path: "m1") { _uri _ts id } }`, nil)
+	_, err = s.check(OpSubscription, op.Selections[0])
+	assert.NoError(t, err)
+	op, _ = Parse(`subscription { odds(path: 1) { id } }`, nil)
+	_, err = s.check(OpSubscription, op.Selections[0])
+	assert.Error(t, err)
+}
+
+func TestIntrospection(t *testing.T) {
+	g := New(testTypedSchema(t), nil, nil)
+	op, err := Parse(`{
+		__typename
+		__schema { queryType { name } subscriptionType { name } types { name kind } directives { name } }
+		t: __type(name: "Match") { ...T }
+		q: __type(name: "Query") { fields { name args { name type { ...R } } type { ...R } } }
+		none: __type(name: "None") { name }
+	}
+	fragment T on __Type { kind name fields { name type { ...R } } }
+	fragment R on __Type { kind name ofType { kind name ofType { kind name } } }`, nil)
+	assert.NoError(t, err)
+	rsp := g.Query(op)
+	assert.Len(t, rsp.Errors, 0)
+	buf, err := json.Marshal(rsp.Data)
+	assert.NoError(t, err)
+	var data struct {
+		Typename string `json:"__typename"`
+		Schema   struct {
+			QueryType        struct{ Name string }
+			SubscriptionType struct{ Name string }
+			Types            []struct{ Name, Kind string }
+			Directives       []struct{ Name string }
+		} `json:"__schema"`
+		T    json.RawMessage
+		Q    json.RawMessage
+		None json.RawMessage
+	}
+	assert.NoError(t, json.Unmarshal(buf, &data))
+	assert.Equal(t, "Query", data.Typename)
+	assert.Equal(t, "Query", data.Schema.QueryType.Name)
+	assert.Equal(t, "Subscription", data.Schema.SubscriptionType.Name)
+	var types []string
+	for _, t := range data.Schema.Types {
+		types = append(types, t.Name+":"+t.Kind)
+	}
+	assert.Equal(t, []string{"Boolean:SCALAR", "Float:SCALAR", "ID:SCALAR", "Int:SCALAR", "JSON:SCALAR", "String:SCALAR",
+		"Match:OBJECT", "Odds:OBJECT", "Query:OBJECT", "Subscription:OBJECT"}, types)
+	assert.Len(t, data.Schema.Directives, 2)
+	assert.Equal(t, `{"kind":"OBJECT","name":"Match","fields":[`+
+		`{"name":"id","type":{"kind":"NON_NULL","name":null,"ofType":{"kind":"SCALAR","name":"ID","ofType":null}}},`+
+		`{"name":"odds","type":{"kind":"LIST","name":null,"ofType":{"kind":"NON_NULL","name":null,"ofType":{"kind":"OBJECT","name":"Odds"}}}},`+
+		`{"name":"extra","type":{"kind":"SCALAR","name":"JSON","ofType":null}}]}`, string(data.T))
+	assert.Equal(t, `{"fields":[{"name":"match","args":[`+
+		`{"name":"id","type":{"kind":"NON_NULL","name":null,"ofType":{"kind":"SCALAR","name":"ID","ofType":null}}},`+
+		`{"name":"limit","type":{"kind":"SCALAR","name":"Int","ofType":null}}],`+
+		`"type":{"kind":"OBJECT","name":"Match","ofType":null}}]}`, string(data.Q))
+	assert.Equal(t, "null", string(data.None))
+}
+
+type testRequester struct{}
+
+func (testRequester) Send(s amp.Subscriber, m *amp.Msg) {
+	var args struct{ X, Y int }
+	json.Unmarshal(m.BodyBytes(), &args)
+	if m.URI == "math.req/fail" {
+		s.Send(m.ResponseError(&amp.Error{Message: "failed", Code: 42}))
+		return
+	}
+	s.Send(m.Response(map[string]int{"sum": args.X + args.Y, "diff": args.X - args.Y}))
+}
+
+func TestQuery(t *testing.T) {
+	s := NewSchema().Query("add", "math.req/add").Query("fail", "math.req/fail")
+	g := New(s, nil, testRequester{})
+	rt := httpi.NewRouter()
+	g.Route(rt)
+	srv := httptest.NewServer(rt.Handler())
+	defer srv.Close()
+
+	body := `{"query":"query($y: Int) { r: add(x: 3, y: $y) { sum } fail missing }","variables":{"y":2}}`
+	rsp, err := http.Post(srv.URL+"/", "application/json", strings.NewReader(body))
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	var r struct {
+		Data   json.RawMessage
+		Errors []Error
+	}
+	assert.NoError(t, json.NewDecoder(rsp.Body).Decode(&r))
+	assert.Equal(t, `{"r":{"sum":5},"fail":null,"missing":null}`, string(r.Data))
+	assert.Len(t, r.Errors, 2)
+	assert.Equal(t, Error{Message: "failed", Path: []string{"fail"}, Code: 42}, r.Errors[0])
+	assert.Equal(t, []string{"missing"}, r.Errors[1].Path)
+}
+
+type testBroker struct {
+	sub    amp.Subscriber
+	topics map[string]int64
+	sync.Mutex
+}
+
+func (b *testBroker) Subscribe(s amp.Subscriber, topics map[string]int64) {
+	b.Lock()
+	defer b.Unlock()
+	b.sub, b.topics = s, topics
+}
+
+func (b *testBroker) Unsubscribe(s amp.Subscriber) {
+	b.Subscribe(nil, nil)
+}
+
+func (b *testBroker) state() (amp.Subscriber, map[string]int64) {
+	b.Lock()
+	defer b.Unlock()
+	return b.sub, b.topics
+}
+
+type testConn struct {
+	in  chan []byte
+	out chan []byte
+}
+
+func (c *testConn) Read() ([]byte, error) {
+	buf, ok := <-c.in
+	if !ok {
+		return nil, assert.AnError
+	}
+	return buf, nil
+}
+
+func (c *testConn) Write(payload []byte, deflated bool) error {
+	c.out <- payload
+	return nil
+}
+
+func (c *testConn) Close() error { return nil }
+
+func (c *testConn) next(t *testing.T) wsMessage {
+	select {
+	case buf := <-c.out:
+		var m wsMessage
+		assert.NoError(t, json.Unmarshal(buf, &m))
+		return m
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	return wsMessage{}
+}
+
+func TestSubscription(t *testing.T) {
+	b := &testBroker{}
+	g := New(NewSchema().Subscription("odds", "odds"), b, nil)
+	c := &testConn{in: make(chan []byte, 16), out: make(chan []byte, 16)}
+	done := make(chan struct{})
+	go func() {
+		g.Serve(c)
+		close(done)
+	}()
+
+	c.in <- []byte(`{"type":"connection_init"}`)
+	assert.Equal(t, gqlConnectionAck, c.next(t).Type)
+
+	c.in <- []byte(`{"id":"1","type":"start","payload":{"query":"subscription { o: odds(path: \"m1\") { home away _uri _ts _type } }"}}`)
+	c.in <- []byte(`{"id":"2","type":"start","payload":{"query":"subscription { nope }"}}`)
+	m := c.next(t)
+	assert.Equal(t, gqlError, m.Type)
+	assert.Equal(t, "2", m.ID)
+
+	sub, topics := b.state()
+	assert.Equal(t, map[string]int64{"odds": 0}, topics)
+	sub.Send(amp.NewPublish("odds", "m2", 1, amp.Full, map[string]float64{"home": 1.1}))
+	// diff without full is not projected as the state
+	sub.Send(amp.NewPublish("odds", "m1", 1, amp.Diff, map[string]float64{"home": 1.2}))
+	sub.Send(amp.NewPublish("odds", "m1", 2, amp.Full, map[string]float64{"home": 1.1, "away": 2}))
+	sub.Send(amp.NewPublish("odds", "m1", 3, amp.Diff, map[string]float64{"home": 1.5}))
+	m = c.next(t)
+	assert.Equal(t, gqlData, m.Type)
+	assert.Equal(t, "1", m.ID)
+	assert.Equal(t, `{"data":{"o":{"home":1.1,"away":2,"_uri":"odds/m1","_ts":2,"_type":1}}}`, string(m.Payload))
+	m = c.next(t)
+	assert.Equal(t, `{"data":{"o":{"home":1.5,"away":2,"_uri":"odds/m1","_ts":3,"_type":0}}}`, string(m.Payload))
+
+	c.in <- []byte(`{"id":"1","type":"stop"}`)
+	m = c.next(t)
+	assert.Equal(t, gqlComplete, m.Type)
+	_, topics = b.state()
+	assert.Len(t, topics, 0)
+
+	close(c.in)
+	<-done
+	sub, _ = b.state()
+	assert.Nil(t, sub)
+}
@@ -0,0 +1,150 @@
+package graphql
+
+import "github.com/pkg/errors"
+
+// Introspection fields, resolved by the gateway
+const (
+	fieldTypename = "__typename"
+	fieldSchema   = "__schema"
+	fieldTypeOf   = "__type"
+)
+
+func isIntrospection(name string) bool {
+	return name == fieldTypename || name == fieldSchema || name == fieldTypeOf
+}
+
+// introspect resolves root introspection field of the query.
+// Introspection objects are built as json maps and projected by the
+// selection, same as the request responses.
+func (s *Schema) introspect(sel *Selection) (interface{}, error) {
+	switch sel.Name {
+	case fieldTypename:
+		return "Query", nil
+	case fieldTypeOf:
+		name, ok := sel.Args["name"].(string)
+		if !ok {
+			return nil, errors.Errorf("field %s requires string argument name", fieldTypeOf)
+		}
+		_, types := s.introspection()
+		t, ok := types[name]
+		if !ok {
+			return nil, nil
+		}
+		return project(t, sel.Selections), nil
+	}
+	schema, _ := s.introspection()
+	return project(schema, sel.Selections), nil
+}
+
+type jsonObject = map[string]interface{}
+
+// introspection returns __Schema object and __Type objects by name.
+// Objects reference each other, projection walks only selected depth.
+func (s *Schema) introspection() (jsonObject, map[string]jsonObject) {
+	s.RLock()
+	defer s.RUnlock()
+	types := make(map[string]jsonObject)
+	var list []interface{}
+	add := func(name, kind string) jsonObject {
+		t := jsonObject{
+			"kind":           kind,
+			"name":           name,
+			"description":    nil,
+			"fields":         nil,
+			"inputFields":    nil,
+			"interfaces":     nil,
+			"enumValues":     nil,
+			"possibleTypes":  nil,
+			"ofType":         nil,
+			"specifiedByUrl": nil,
+		}
+		if kind == kindObject {
+			t["interfaces"] = []interface{}{}
+		}
+		types[name] = t
+		list = append(list, t)
+		return t
+	}
+	for _, n := range scalars {
+		add(n, kindScalar)
+	}
+	objects := s.objectTypes()
+	for _, t := range objects {
+		add(t.Name, kindObject)
+	}
+	// ref returns __Type of the type reference
+	var ref func(r *typeRef) jsonObject
+	ref = func(r *typeRef) jsonObject {
+		if r.kind == "" {
+			return types[r.name]
+		}
+		o := jsonObject{"kind": r.kind, "name": nil, "ofType": ref(r.ofType)}
+		for _, k := range []string{"description", "fields", "inputFields", "interfaces", "enumValues", "possibleTypes", "specifiedByUrl"} {
+			o[k] = nil
+		}
+		return o
+	}
+	inputValue := func(f TypeField) jsonObject {
+		return jsonObject{
+			"name":         f.Name,
+			"description":  nil,
+			"type":         ref(mustTypeRef(f.Type)),
+			"defaultValue": nil,
+		}
+	}
+	field := func(name, typ string, args []TypeField) jsonObject {
+		in := []interface{}{}
+		for _, a := range args {
+			in = append(in, inputValue(a))
+		}
+		return jsonObject{
+			"name":              name,
+			"description":       nil,
+			"args":              in,
+			"type":              ref(mustTypeRef(typ)),
+			"isDeprecated":      false,
+			"deprecationReason": nil,
+		}
+	}
+	for _, t := range objects {
+		fields := []interface{}{}
+		for _, f := range t.Fields {
+			fields = append(fields, field(f.Name, f.Type, nil))
+		}
+		types[t.Name]["fields"] = fields
+	}
+	root := func(name string, m map[string]Field) jsonObject {
+		fields := []interface{}{}
+		for _, f := range sortedFields(m) {
+			fields = append(fields, field(f.Name, f.Type, fieldArgs(f)))
+		}
+		t := add(name, kindObject)
+		t["fields"] = fields
+		return t
+	}
+	directive := func(name, desc string) jsonObject {
+		return jsonObject{
+			"name":         name,
+			"description":  desc,
+			"locations":    []interface{}{"FIELD", "FRAGMENT_SPREAD", "INLINE_FRAGMENT"},
+			"args":         []interface{}{inputValue(TypeField{Name: "if", Type: "Boolean!"})},
+			"isRepeatable": false,
+		}
+	}
+
+	schema := jsonObject{
+		"description":      nil,
+		"queryType":        root("Query", s.queries), // required, even if empty
+		"mutationType":     nil,
+		"subscriptionType": nil,
+		"directives": []interface{}{
+			directive("include", "Directs the executor to include this field or fragment only when the `if` argument is true."),
+			directive("skip", "Directs the executor to skip this field or fragment when the `if` argument is true."),
+		},
+	}
+	if len(s.subscriptions) > 0 {
+		schema["subscriptionType"] = root("Subscription", s.subscriptions)
+	}
+	schema["types"] = list
+	return schema, types
+}
@@ -0,0 +1,490 @@
+package graphql
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// Operation types
+const (
+	OpQuery        = "query"
+	OpSubscription = "subscription"
+)
+
+// Operation is parsed GraphQL operation.
+// Only subset of the language needed for mapping to amp is supported:
+// single operation with type and name, variables, field aliases,
+// arguments, nested selections, fragments and @skip/@include directives.
+// Fragments are expanded into the selections and directives evaluated
+// while parsing. Fragment type conditions are not checked, schema has no
+// interfaces or unions.
+type Operation struct {
+	Type       string
+	Name       string
+	Selections []*Selection
+}
+
+// Selection is requested field.
+type Selection struct {
+	Alias      string // response key, same as name if not aliased
+	Name       string
+	Args       map[string]interface{}
+	Selections []*Selection
+
+	typename string // value of the __typename field, set by the schema check
+	fragment string // name of the fragment spread, expanded after parsing
+	inline   bool   // inline fragment, expanded after parsing
+}
+
+// Parse parses operation, variables are substituted in arguments.
+func Parse(query string, variables map[string]interface{}) (*Operation, error) {
+	p := &parser{lex: newLexer(query), vars: variables, fragments: make(map[string][]*Selection)}
+	op, err := p.document()
+	if err != nil {
+		return nil, errors.Wrap(err, "graphql parse")
+	}
+	return op, nil
+}
+
+type token struct {
+	kind  byte // 'n' name, 's' string, '0' number, 'p' punctuator, 0 eof
+	value string
+	pos   int
+}
+
+type lexer struct {
+	src string
+	pos int
+}
+
+func newLexer(src string) *lexer {
+	return &lexer{src: src}
+}
+
+func (l *lexer) next() (token, error) {
+	// skip ignored: whitespace, commas, comments
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if c == '#' {
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+			continue
+		}
+		if c == ',' || unicode.IsSpace(rune(c)) {
+			l.pos++
+			continue
+		}
+		break
+	}
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return token{pos: start}, nil
+	}
+	c := l.src[l.pos]
+	switch {
+	case c == '"':
+		end := l.pos + 1
+		for end < len(l.src) && l.src[end] != '"' {
+			if l.src[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(l.src) {
+			return token{}, errors.Errorf("unterminated string at %d", start)
+		}
+		s, err := strconv.Unquote(l.src[start : end+1])
+		if err != nil {
+			return token{}, errors.Errorf("invalid string at %d", start)
+		}
+		l.pos = end + 1
+		return token{kind: 's', value: s, pos: start}, nil
+	case c == '-' || (c >= '0' && c <= '9'):
+		l.pos++
+		for l.pos < len(l.src) && strings.IndexByte("0123456789.eE+-", l.src[l.pos]) >= 0 {
+			l.pos++
+		}
+		return token{kind: '0', value: l.src[start:l.pos], pos: start}, nil
+	case c == '_' || unicode.IsLetter(rune(c)):
+		for l.pos < len(l.src) && (l.src[l.pos] == '_' || unicode.IsLetter(rune(l.src[l.pos])) || unicode.IsDigit(rune(l.src[l.pos]))) {
+			l.pos++
+		}
+		return token{kind: 'n', value: l.src[start:l.pos], pos: start}, nil
+	case strings.IndexByte("!$():=@[]{}|", c) >= 0:
+		l.pos++
+		return token{kind: 'p', value: string(c), pos: start}, nil
+	case c == '.' && strings.HasPrefix(l.src[l.pos:], "..."):
+		l.pos += 3
+		return token{kind: 'p', value: "...", pos: start}, nil
+	}
+	return token{}, errors.Errorf("unexpected character %q at %d", c, start)
+}
+
+type parser struct {
+	lex       *lexer
+	tok       token
+	vars      map[string]interface{}
+	fragments map[string][]*Selection // selections of the fragment definitions by name
+	err       error
+}
+
+func (p *parser) advance() {
+	if p.err != nil {
+		return
+	}
+	p.tok, p.err = p.lex.next()
+}
+
+func (p *parser) peek(kind byte, value string) bool {
+	return p.err == nil && p.tok.kind == kind && (value == "" || p.tok.value == value)
+}
+
+func (p *parser) expect(kind byte, value string) string {
+	if p.err != nil {
+		return ""
+	}
+	if !p.peek(kind, value) {
+		want := value
+		if want == "" {
+			want = "name"
+		}
+		p.err = errors.Errorf("expected %s at %d, got %q", want, p.tok.pos, p.tok.value)
+		return ""
+	}
+	v := p.tok.value
+	p.advance()
+	return v
+}
+
+// document parses single operation and fragment definitions
+func (p *parser) document() (*Operation, error) {
+	p.advance()
+	var op *Operation
+	for p.err == nil && p.tok.kind != 0 {
+		if p.peek('n', "fragment") {
+			p.fragment()
+			continue
+		}
+		if op != nil {
+			return nil, errors.Errorf("unexpected %q at %d, only single operation is supported", p.tok.value, p.tok.pos)
+		}
+		op = p.operation()
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	if op == nil {
+		return nil, errors.New("missing operation")
+	}
+	sels, err := p.expand(op.Selections, make(map[string]bool))
+	if err != nil {
+		return nil, err
+	}
+	op.Selections = sels
+	return op, nil
+}
+
+func (p *parser) operation() *Operation {
+	op := &Operation{Type: OpQuery}
+	if p.peek('n', OpQuery) || p.peek('n', OpSubscription) || p.peek('n', "mutation") {
+		op.Type = p.expect('n', "")
+		if op.Type == "mutation" {
+			p.err = errors.New("mutations are not supported")
+			return nil
+		}
+		if p.peek('n', "") {
+			op.Name = p.expect('n', "")
+		}
+		if p.peek('p', "(") {
+			p.variableDefinitions()
+		}
+	}
+	op.Selections = p.selectionSet()
+	return op
+}
+
+// fragment parses fragment definition
+func (p *parser) fragment() {
+	p.expect('n', "fragment")
+	pos := p.tok.pos
+	name := p.expect('n', "")
+	p.expect('n', "on")
+	p.expect('n', "")
+	sels := p.selectionSet()
+	if p.err != nil {
+		return
+	}
+	if _, ok := p.fragments[name]; ok {
+		p.err = errors.Errorf("fragment %s redefined at %d", name, pos)
+		return
+	}
+	p.fragments[name] = sels
+}
+
+// expand replaces fragment spreads and inline fragments with their
+// selections and merges fields with the same response key.
+// Selections of the fragment definitions are copied, not modified.
+func (p *parser) expand(sels []*Selection, spread map[string]bool) ([]*Selection, error) {
+	var out []*Selection
+	for _, s := range sels {
+		switch {
+		case s.fragment != "":
+			body, ok := p.fragments[s.fragment]
+			if !ok {
+				return nil, errors.Errorf("unknown fragment %s", s.fragment)
+			}
+			if spread[s.fragment] {
+				return nil, errors.Errorf("fragment %s spreads itself", s.fragment)
+			}
+			spread[s.fragment] = true
+			exp, err := p.expand(body, spread)
+			delete(spread, s.fragment)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, exp...)
+		case s.inline:
+			exp, err := p.expand(s.Selections, spread)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, exp...)
+		default:
+			c := *s
+			if s.Selections != nil {
+				exp, err := p.expand(s.Selections, spread)
+				if err != nil {
+					return nil, err
+				}
+				c.Selections = exp
+			}
+			out = append(out, &c)
+		}
+	}
+	return merge(out)
+}
+
+// merge merges fields with the same response key
+func merge(sels []*Selection) ([]*Selection, error) {
+	var out []*Selection
+	keys := make(map[string]*Selection)
+	for _, s := range sels {
+		o, ok := keys[s.Alias]
+		if !ok {
+			keys[s.Alias] = s
+			out = append(out, s)
+			continue
+		}
+		if o.Name != s.Name || !reflect.DeepEqual(o.Args, s.Args) {
+			return nil, errors.Errorf("conflicting fields for %s", s.Alias)
+		}
+		if s.Selections == nil {
+			continue
+		}
+		m, err := merge(append(o.Selections[:len(o.Selections):len(o.Selections)], s.Selections...))
+		if err != nil {
+			return nil, err
+		}
+		o.Selections = m
+	}
+	return out, nil
+}
+
+// variableDefinitions skips definitions, variable types are not checked
+func (p *parser) variableDefinitions() {
+	p.expect('p', "(")
+	for p.err == nil && !p.peek('p', ")") {
+		p.expect('p', "$")
+		name := p.expect('n', "")
+		p.expect('p', ":")
+		p.typeRef()
+		if p.peek('p', "=") {
+			p.advance()
+			v := p.value()
+			if _, ok := p.vars[name]; !ok && p.err == nil {
+				if p.vars == nil {
+					p.vars = make(map[string]interface{})
+				}
+				p.vars[name] = v
+			}
+		}
+	}
+	p.expect('p', ")")
+}
+
+func (p *parser) typeRef() {
+	if p.peek('p', "[") {
+		p.advance()
+		p.typeRef()
+		p.expect('p', "]")
+	} else {
+		p.expect('n', "")
+	}
+	if p.peek('p', "!") {
+		p.advance()
+	}
+}
+
+func (p *parser) selectionSet() []*Selection {
+	p.expect('p', "{")
+	sels := []*Selection{}
+	n := 0
+	for p.err == nil && !p.peek('p', "}") {
+		if s := p.selection(); s != nil {
+			sels = append(sels, s)
+		}
+		n++
+	}
+	p.expect('p', "}")
+	if p.err == nil && n == 0 {
+		p.err = errors.New("empty selection set")
+	}
+	return sels
+}
+
+// selection parses field, fragment spread or inline fragment.
+// Returns nil if skipped by the directive.
+func (p *parser) selection() *Selection {
+	if p.peek('p', "...") {
+		p.advance()
+		if p.peek('n', "") && !p.peek('n', "on") {
+			s := &Selection{fragment: p.expect('n', "")}
+			if !p.directives() {
+				return nil
+			}
+			return s
+		}
+		if p.peek('n', "on") {
+			p.advance()
+			p.expect('n', "")
+		}
+		include := p.directives()
+		s := &Selection{inline: true, Selections: p.selectionSet()}
+		if !include {
+			return nil
+		}
+		return s
+	}
+	s := &Selection{Name: p.expect('n', "")}
+	if p.peek('p', ":") {
+		p.advance()
+		s.Alias = s.Name
+		s.Name = p.expect('n', "")
+	} else {
+		s.Alias = s.Name
+	}
+	if p.peek('p', "(") {
+		s.Args = p.arguments()
+	}
+	include := p.directives()
+	if p.peek('p', "{") {
+		s.Selections = p.selectionSet()
+	}
+	if !include {
+		return nil
+	}
+	return s
+}
+
+func (p *parser) arguments() map[string]interface{} {
+	p.expect('p', "(")
+	args := make(map[string]interface{})
+	for p.err == nil && !p.peek('p', ")") {
+		name := p.expect('n', "")
+		p.expect('p', ":")
+		args[name] = p.value()
+	}
+	p.expect('p', ")")
+	return args
+}
+
+// directives evaluates @skip and @include, returns whether to include
+// the selection
+func (p *parser) directives() bool {
+	include := true
+	for p.peek('p', "@") {
+		pos := p.tok.pos
+		p.advance()
+		name := p.expect('n', "")
+		var args map[string]interface{}
+		if p.peek('p', "(") {
+			args = p.arguments()
+		}
+		if p.err != nil {
+			return false
+		}
+		if name != "skip" && name != "include" {
+			p.err = errors.Errorf("unknown directive @%s at %d", name, pos)
+			return false
+		}
+		cond, ok := args["if"].(bool)
+		if !ok || len(args) != 1 {
+			p.err = errors.Errorf("directive @%s requires boolean argument if at %d", name, pos)
+			return false
+		}
+		if cond == (name == "skip") {
+			include = false
+		}
+	}
+	return include
+}
+
+func (p *parser) value() interface{} {
+	if p.err != nil {
+		return nil
+	}
+	t := p.tok
+	switch {
+	case t.kind == 'p' && t.value == "$":
+		p.advance()
+		name := p.expect('n', "")
+		return p.vars[name]
+	case t.kind == 's':
+		p.advance()
+		return t.value
+	case t.kind == '0':
+		p.advance()
+		n := json.Number(t.value)
+		if _, err := n.Float64(); err != nil {
+			p.err = errors.Errorf("invalid number %q at %d", t.value, t.pos)
+		}
+		return n
+	case t.kind == 'n':
+		p.advance()
+		switch t.value {
+		case "true":
+			return true
+		case "false":
+			return false
+		case "null":
+			return nil
+		}
+		return t.value // enum
+	case t.kind == 'p' && t.value == "[":
+		p.advance()
+		list := []interface{}{}
+		for p.err == nil && !p.peek('p', "]") {
+			list = append(list, p.value())
+		}
+		p.expect('p', "]")
+		return list
+	case t.kind == 'p' && t.value == "{":
+		p.advance()
+		obj := make(map[string]interface{})
+		for p.err == nil && !p.peek('p', "}") {
+			name := p.expect('n', "")
+			p.expect('p', ":")
+			obj[name] = p.value()
+		}
+		p.expect('p', "}")
+		return obj
+	}
+	p.err = errors.Errorf("unexpected %q at %d", t.value, t.pos)
+	return nil
+}
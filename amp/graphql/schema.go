@@ -0,0 +1,298 @@
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/dcy"
+	"github.com/minus5/svckit/log"
+	"github.com/pkg/errors"
+)
+
+// Field is root level schema field.
+// Query fields are mapped to amp requests, subscription fields to topics.
+// Field result is of the Type (see TypeField for the type references),
+// field without type is JSON. Args are of the scalar types, field without
+// Args accepts any arguments.
+type Field struct {
+	Name    string      `json:"name"`
+	Request string      `json:"request,omitempty"` // request uri (topic/method) of the query field
+	Topic   string      `json:"topic,omitempty"`   // topic of the subscription field
+	Args    []TypeField `json:"args,omitempty"`    // arguments, request body of the query field
+	Type    string      `json:"type,omitempty"`    // result type
+	Service string      `json:"service,omitempty"` // service which registered field
+}
+
+func (f Field) validate(known map[string]bool) error {
+	if f.Name == "" {
+		return errors.New("field without name")
+	}
+	if (f.Request == "") == (f.Topic == "") {
+		return errors.Errorf("field %s must have either request or topic", f.Name)
+	}
+	if err := validateField(TypeField{Name: f.Name, Type: f.Type}, known); err != nil {
+		return err
+	}
+	for _, a := range f.Args {
+		// arguments are input values, only scalars are allowed
+		if err := validateField(a, nil); err != nil {
+			return errors.Wrapf(err, "field %s argument", f.Name)
+		}
+	}
+	return nil
+}
+
+// Schema holds root query and subscription fields.
+// Fields are stitched together from many services, each service owns its
+// fields and can replace them without affecting fields of others.
+type Schema struct {
+	queries       map[string]Field
+	subscriptions map[string]Field
+	types         map[string]Type
+	sync.RWMutex
+}
+
+// NewSchema creates empty schema.
+func NewSchema() *Schema {
+	return &Schema{
+		queries:       make(map[string]Field),
+		subscriptions: make(map[string]Field),
+		types:         make(map[string]Type),
+	}
+}
+
+// Query adds query field mapped to request uri.
+func (s *Schema) Query(name, uri string) *Schema {
+	s.Lock()
+	defer s.Unlock()
+	s.queries[name] = Field{Name: name, Request: uri}
+	return s
+}
+
+// Subscription adds subscription field mapped to topic.
+func (s *Schema) Subscription(name, topic string) *Schema {
+	s.Lock()
+	defer s.Unlock()
+	s.subscriptions[name] = Field{Name: name, Topic: topic}
+	return s
+}
+
+// Stitch replaces all fields and types of the service with fields and
+// types. Fields and types reference types of the same service or the
+// built in scalars. Returns error if field or type name is already owned
+// by other service.
+func (s *Schema) Stitch(service string, fields []Field, types ...Type) error {
+	known := make(map[string]bool)
+	for _, t := range types {
+		known[t.Name] = true
+	}
+	for _, t := range types {
+		if err := t.validate(known); err != nil {
+			return errors.Wrapf(err, "service %s", service)
+		}
+	}
+	for _, f := range fields {
+		if err := f.validate(known); err != nil {
+			return errors.Wrapf(err, "service %s", service)
+		}
+	}
+	s.Lock()
+	defer s.Unlock()
+	for _, f := range fields {
+		m := s.queries
+		if f.Topic != "" {
+			m = s.subscriptions
+		}
+		if o, ok := m[f.Name]; ok && o.Service != service {
+			return errors.Errorf("field %s of service %s already defined by %q", f.Name, service, o.Service)
+		}
+	}
+	for _, t := range types {
+		if o, ok := s.types[t.Name]; ok && o.Service != service {
+			return errors.Errorf("type %s of service %s already defined by %q", t.Name, service, o.Service)
+		}
+	}
+	s.remove(func(svc string) bool { return svc == service })
+	for _, f := range fields {
+		f.Service = service
+		if f.Topic != "" {
+			s.subscriptions[f.Name] = f
+		} else {
+			s.queries[f.Name] = f
+		}
+	}
+	for _, t := range types {
+		t.Service = service
+		s.types[t.Name] = t
+	}
+	return nil
+}
+
+// remove removes fields and types of the services.
+// Should be called during s.Lock.
+func (s *Schema) remove(service func(string) bool) {
+	for _, m := range []map[string]Field{s.queries, s.subscriptions} {
+		for n, f := range m {
+			if service(f.Service) {
+				delete(m, n)
+			}
+		}
+	}
+	for n, t := range s.types {
+		if service(t.Service) {
+			delete(s.types, n)
+		}
+	}
+}
+
+// registryEntry is value of the service in the schema registry
+type registryEntry struct {
+	Fields []Field `json:"fields"`
+	Types  []Type  `json:"types"`
+}
+
+func (e *registryEntry) UnmarshalJSON(buf []byte) error {
+	if b := bytes.TrimSpace(buf); len(b) > 0 && b[0] == '[' {
+		return json.Unmarshal(b, &e.Fields)
+	}
+	type entry registryEntry
+	return json.Unmarshal(buf, (*entry)(e))
+}
+
+// LoadConsul stitches fields from the schema registry in Consul KV.
+// Under prefix key is service name and value json array of fields, or
+// object with fields and types, for example:
+//
+//	graphql/schema/math = [{"name":"add","request":"math.req/add"}]
+//	graphql/schema/odds = {"fields":[{"name":"odds","topic":"odds","type":"Odds"}],
+//		"types":[{"name":"Odds","fields":[{"name":"home","type":"Float"}]}]}
+//
+// Fields of services removed from the registry are removed from the schema.
+func (s *Schema) LoadConsul(prefix string) error {
+	kvs, err := dcy.KVs(prefix)
+	if err == dcy.ErrKeyNotFound {
+		kvs = make(map[string]string)
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+	for service, v := range kvs {
+		if service == "" {
+			continue
+		}
+		var e registryEntry
+		if err := json.Unmarshal([]byte(v), &e); err != nil {
+			return errors.Wrapf(err, "schema of service %s", service)
+		}
+		if err := s.Stitch(service, e.Fields, e.Types...); err != nil {
+			return err
+		}
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.remove(func(service string) bool {
+		_, ok := kvs[service]
+		return service != "" && !ok
+	})
+	return nil
+}
+
+// WatchConsul reloads schema from Consul KV every interval until ctx is done.
+func (s *Schema) WatchConsul(ctx context.Context, prefix string, interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			if err := s.LoadConsul(prefix); err != nil {
+				log.S("prefix", prefix).Error(err)
+			}
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (s *Schema) field(opType, name string) (Field, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.fieldLocked(opType, name)
+}
+
+// fieldLocked should be called during s.RLock.
+func (s *Schema) fieldLocked(opType, name string) (Field, bool) {
+	m := s.queries
+	if opType == OpSubscription {
+		m = s.subscriptions
+	}
+	f, ok := m[name]
+	return f, ok
+}
+
+// SDL returns schema in GraphQL schema definition language.
+// Fields without arguments have single JSON argument args.
+func (s *Schema) SDL() string {
+	s.RLock()
+	defer s.RUnlock()
+	var buf bytes.Buffer
+	buf.WriteString("scalar JSON\n")
+	for _, t := range s.objectTypes() {
+		fmt.Fprintf(&buf, "\ntype %s {\n", t.Name)
+		for _, f := range t.Fields {
+			fmt.Fprintf(&buf, "  %s: %s\n", f.Name, mustTypeRef(f.Type))
+		}
+		buf.WriteString("}\n")
+	}
+	typ := func(name string, m map[string]Field) {
+		if len(m) == 0 {
+			return
+		}
+		fmt.Fprintf(&buf, "\ntype %s {\n", name)
+		for _, f := range sortedFields(m) {
+			var args []string
+			for _, a := range fieldArgs(f) {
+				args = append(args, a.Name+": "+mustTypeRef(a.Type).String())
+			}
+			fmt.Fprintf(&buf, "  %s(%s): %s\n", f.Name, strings.Join(args, ", "), mustTypeRef(f.Type))
+		}
+		buf.WriteString("}\n")
+	}
+	typ("Query", s.queries)
+	typ("Subscription", s.subscriptions)
+	return buf.String()
+}
+
+// objectTypes returns types sorted by name.
+// Should be called during s.RLock.
+func (s *Schema) objectTypes() []Type {
+	types := make([]Type, 0, len(s.types))
+	for _, t := range s.types {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i].Name < types[j].Name })
+	return types
+}
+
+func sortedFields(m map[string]Field) []Field {
+	fields := make([]Field, 0, len(m))
+	for _, f := range m {
+		fields = append(fields, f)
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Name < fields[j].Name })
+	return fields
+}
+
+// fieldArgs returns declared arguments, JSON args for the field without them
+func fieldArgs(f Field) []TypeField {
+	if len(f.Args) == 0 {
+		return []TypeField{{Name: "args", Type: scalarJSON}}
+	}
+	return f.Args
+}
@@ -0,0 +1,276 @@
+package graphql
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/cache"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+)
+
+// graphql-ws protocol message types
+const (
+	gqlConnectionInit      = "connection_init"
+	gqlConnectionAck       = "connection_ack"
+	gqlConnectionError     = "connection_error"
+	gqlConnectionTerminate = "connection_terminate"
+	gqlStart               = "start"
+	gqlStop                = "stop"
+	gqlData                = "data"
+	gqlError               = "error"
+	gqlComplete            = "complete"
+)
+
+// max number of messages waiting to be written to the connection
+const maxWriteQueue = 1024
+
+type conn interface {
+	Read() ([]byte, error)
+	Write(payload []byte, deflated bool) error
+	Close() error
+}
+
+type wsMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// subscription is started subscription operation
+type subscription struct {
+	id    string
+	sel   *Selection
+	path  string
+	state *cache.Cache // state of the subscribed uris
+}
+
+// connection is graphql-ws client connection, it is broker subscriber
+type connection struct {
+	g    *Gateway
+	conn conn
+	subs map[string]subscription // by operation id
+	out  chan []byte
+	done chan struct{}
+	sync.Mutex
+}
+
+// Serve handles graphql-ws connection until it is closed.
+func (g *Gateway) Serve(c conn) {
+	s := &connection{
+		g:    g,
+		conn: c,
+		subs: make(map[string]subscription),
+		out:  make(chan []byte, maxWriteQueue),
+		done: make(chan struct{}),
+	}
+	go s.writeLoop()
+	defer func() {
+		g.broker.Unsubscribe(s)
+		close(s.done)
+		c.Close()
+	}()
+	for {
+		buf, err := c.Read()
+		if err != nil {
+			return
+		}
+		var m wsMessage
+		if err := json.Unmarshal(buf, &m); err != nil {
+			s.write(wsMessage{Type: gqlConnectionError, Payload: errorPayload(err)})
+			return
+		}
+		switch m.Type {
+		case gqlConnectionInit:
+			s.write(wsMessage{Type: gqlConnectionAck})
+		case gqlStart:
+			s.start(m)
+		case gqlStop:
+			s.stop(m.ID)
+		case gqlConnectionTerminate:
+			return
+		}
+	}
+}
+
+func (s *connection) start(m wsMessage) {
+	var req request
+	if err := json.Unmarshal(m.Payload, &req); err != nil {
+		s.write(wsMessage{ID: m.ID, Type: gqlError, Payload: errorPayload(err)})
+		return
+	}
+	op, err := Parse(req.Query, req.Variables)
+	if err != nil {
+		s.write(wsMessage{ID: m.ID, Type: gqlError, Payload: errorPayload(err)})
+		return
+	}
+	if op.Type == OpQuery {
+		go func() {
+			s.data(m.ID, s.g.Query(op))
+			s.write(wsMessage{ID: m.ID, Type: gqlComplete})
+		}()
+		return
+	}
+	if len(op.Selections) != 1 {
+		s.write(wsMessage{ID: m.ID, Type: gqlError, Payload: errorMessage("subscription must select exactly one field")})
+		return
+	}
+	sel := op.Selections[0]
+	f, err := s.g.schema.check(OpSubscription, sel)
+	if err != nil {
+		s.write(wsMessage{ID: m.ID, Type: gqlError, Payload: errorPayload(err)})
+		return
+	}
+	path, _ := sel.Args[argPath].(string)
+	s.Lock()
+	s.subs[m.ID] = subscription{id: m.ID, sel: sel, path: f.Topic + "/" + path, state: cache.New()}
+	s.subscribe()
+	s.Unlock()
+	metric.Counter("graphql.subscription." + sel.Name)
+}
+
+func (s *connection) stop(id string) {
+	s.Lock()
+	if _, ok := s.subs[id]; ok {
+		delete(s.subs, id)
+		s.subscribe()
+	}
+	s.Unlock()
+	s.write(wsMessage{ID: id, Type: gqlComplete})
+}
+
+// subscribe replaces broker subscriptions with topics of the started subscriptions
+func (s *connection) subscribe() {
+	topics := make(map[string]int64)
+	for _, sub := range s.subs {
+		topics[topic(sub.path)] = 0
+	}
+	s.g.broker.Subscribe(s, topics)
+}
+
+// Send projects published message for the subscriptions.
+func (s *connection) Send(m *amp.Msg) {
+	if m.Type != amp.Publish || m.IsBinary() {
+		return
+	}
+	s.Lock()
+	var subs []subscription
+	for _, sub := range s.subs {
+		if topic(sub.path) == m.Topic() && (sub.path == m.Topic()+"/" || sub.path == m.URI) {
+			subs = append(subs, sub)
+		}
+	}
+	s.Unlock()
+	updateType := m.UpdateType
+	if m.IsChunk() {
+		updateType = amp.Full // assembled
+	}
+	for _, sub := range subs {
+		body, ok := sub.merge(m)
+		if !ok {
+			continue
+		}
+		v, err := decode(body)
+		if err != nil {
+			log.S("uri", m.URI).Error(err)
+			continue
+		}
+		var data interface{}
+		if o, ok := v.(map[string]interface{}); ok || v == nil {
+			if o == nil {
+				o = make(map[string]interface{})
+			}
+			o[fieldURI] = m.URI
+			o[fieldTs] = m.Ts
+			o[fieldType] = updateType
+			data = project(o, sub.sel.Selections)
+		} else {
+			data = project(v, sub.sel.Selections)
+		}
+		s.data(sub.id, Response{Data: object{{Key: sub.sel.Alias, Value: data}}})
+	}
+}
+
+// merge merges message into the state of the uri and returns state to
+// project. Diff is not projected as the state until it is merged into the
+// Full, nor are parts of the chunked Full until it is assembled.
+func (sub subscription) merge(m *amp.Msg) ([]byte, bool) {
+	switch {
+	case m.UpdateType == amp.Append:
+		return m.BodyBytes(), true
+	case m.UpdateType == amp.Close:
+		sub.state.Add(m)
+		return nil, true
+	case m.IsChunk():
+		sub.state.Add(m)
+		if m.UpdateType != amp.FullEnd {
+			return nil, false
+		}
+	case m.UpdateType == amp.Full || m.UpdateType == amp.Diff || m.UpdateType == amp.Update:
+		sub.state.Add(m)
+	default:
+		return nil, false
+	}
+	body, ts := sub.state.Get(m.URI)
+	if body == nil || ts != m.Ts {
+		return nil, false // diff without full or already merged
+	}
+	return body, true
+}
+
+func (s *connection) data(id string, rsp Response) {
+	payload, err := json.Marshal(rsp)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	s.write(wsMessage{ID: id, Type: gqlData, Payload: payload})
+}
+
+// write queues message, connection is closed if the client is too slow
+func (s *connection) write(m wsMessage) {
+	buf, err := json.Marshal(m)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	select {
+	case s.out <- buf:
+	case <-s.done:
+	default:
+		metric.Counter("graphql.slow")
+		s.conn.Close()
+	}
+}
+
+func (s *connection) writeLoop() {
+	for {
+		select {
+		case buf := <-s.out:
+			if err := s.conn.Write(buf, false); err != nil {
+				s.conn.Close()
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func topic(uri string) string {
+	if i := strings.Index(uri, "/"); i >= 0 {
+		return uri[:i]
+	}
+	return uri
+}
+
+func errorPayload(err error) json.RawMessage {
+	return errorMessage(err.Error())
+}
+
+func errorMessage(msg string) json.RawMessage {
+	buf, _ := json.Marshal(Error{Message: msg})
+	return buf
+}
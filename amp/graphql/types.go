@@ -0,0 +1,163 @@
+package graphql
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// Type kinds, as in the introspection
+const (
+	kindScalar  = "SCALAR"
+	kindObject  = "OBJECT"
+	kindList    = "LIST"
+	kindNonNull = "NON_NULL"
+)
+
+// scalarJSON is type of the untyped fields, any json value.
+// Selection on JSON field projects the json object by field names.
+const scalarJSON = "JSON"
+
+// built in scalar types
+var scalars = []string{"Boolean", "Float", "ID", "Int", scalarJSON, "String"}
+
+func isScalar(name string) bool {
+	for _, s := range scalars {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Type is object type of the field results.
+type Type struct {
+	Name    string      `json:"name"`
+	Fields  []TypeField `json:"fields"`
+	Service string      `json:"service,omitempty"` // service which registered type
+}
+
+// TypeField is field of the object type or argument of the root field.
+// Type is GraphQL type reference, for example Int!, [Odds!] or Odds.
+// Empty type is JSON.
+type TypeField struct {
+	Name string `json:"name"`
+	Type string `json:"type,omitempty"`
+}
+
+func (t Type) field(name string) (TypeField, bool) {
+	for _, f := range t.Fields {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return TypeField{}, false
+}
+
+// validate checks type names, known are names of the types defined by
+// the same service
+func (t Type) validate(known map[string]bool) error {
+	if !isName(t.Name) || strings.HasPrefix(t.Name, "__") {
+		return errors.Errorf("invalid type name %q", t.Name)
+	}
+	if isScalar(t.Name) || t.Name == "Query" || t.Name == "Subscription" {
+		return errors.Errorf("type %s is reserved", t.Name)
+	}
+	if len(t.Fields) == 0 {
+		return errors.Errorf("type %s without fields", t.Name)
+	}
+	for _, f := range t.Fields {
+		if err := validateField(f, known); err != nil {
+			return errors.Wrapf(err, "type %s", t.Name)
+		}
+	}
+	return nil
+}
+
+func validateField(f TypeField, known map[string]bool) error {
+	if !isName(f.Name) {
+		return errors.Errorf("invalid field name %q", f.Name)
+	}
+	r, err := parseTypeRef(f.Type)
+	if err != nil {
+		return errors.Wrapf(err, "field %s", f.Name)
+	}
+	if n := r.named(); !isScalar(n) && !known[n] {
+		return errors.Errorf("field %s of unknown type %s", f.Name, n)
+	}
+	return nil
+}
+
+func isName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		if c != '_' && !unicode.IsLetter(c) && (i == 0 || !unicode.IsDigit(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// typeRef is parsed type reference
+type typeRef struct {
+	kind   string // kindNonNull, kindList, or empty for named type
+	name   string // of the named type
+	ofType *typeRef
+}
+
+// parseTypeRef parses type reference, empty is JSON
+func parseTypeRef(s string) (*typeRef, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "":
+		return &typeRef{name: scalarJSON}, nil
+	case strings.HasSuffix(s, "!"):
+		of, err := parseTypeRef(s[:len(s)-1])
+		if err != nil {
+			return nil, err
+		}
+		if of.kind == kindNonNull {
+			return nil, errors.Errorf("invalid type %q", s)
+		}
+		return &typeRef{kind: kindNonNull, ofType: of}, nil
+	case strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]"):
+		of, err := parseTypeRef(s[1 : len(s)-1])
+		if err != nil {
+			return nil, err
+		}
+		return &typeRef{kind: kindList, ofType: of}, nil
+	case isName(s):
+		return &typeRef{name: s}, nil
+	}
+	return nil, errors.Errorf("invalid type %q", s)
+}
+
+// mustTypeRef parses type reference validated when added to the schema
+func mustTypeRef(s string) *typeRef {
+	r, err := parseTypeRef(s)
+	if err != nil {
+		return &typeRef{name: scalarJSON}
+	}
+	return r
+}
+
+// named returns name of the named type inside list and non null
+func (r *typeRef) named() string {
+	for r.ofType != nil {
+		r = r.ofType
+	}
+	return r.name
+}
+
+func (r *typeRef) String() string {
+	switch r.kind {
+	case kindNonNull:
+		return r.ofType.String() + "!"
+	case kindList:
+		return "[" + r.ofType.String() + "]"
+	}
+	return r.name
+}
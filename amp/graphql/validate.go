@@ -0,0 +1,165 @@
+package graphql
+
+import (
+	"encoding/json"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// argPath is subscription field argument, uri path under the field topic
+const argPath = "path"
+
+// check finds root field of the selection and validates selection
+// arguments and nested selections against the field type.
+// Fields of the JSON type are not checked, their selections project json
+// objects by field names.
+func (s *Schema) check(opType string, sel *Selection) (Field, error) {
+	s.RLock()
+	defer s.RUnlock()
+	f, ok := s.fieldLocked(opType, sel.Name)
+	if !ok {
+		return f, errors.Errorf("unknown field %s", sel.Name)
+	}
+	if err := checkArgs(opType, f, sel.Args); err != nil {
+		return f, err
+	}
+	ref := mustTypeRef(f.Type)
+	if opType == OpSubscription {
+		// message attributes are selected at the root of the result
+		sels := sel.Selections[:0:0]
+		for _, c := range sel.Selections {
+			if c.Name != fieldURI && c.Name != fieldTs && c.Name != fieldType {
+				sels = append(sels, c)
+			}
+		}
+		if len(sels) == 0 && len(sel.Selections) > 0 {
+			return f, nil
+		}
+		return f, s.checkSelections(sel.Name, ref, sels)
+	}
+	return f, s.checkSelections(sel.Name, ref, sel.Selections)
+}
+
+// checkArgs checks arguments against declared field arguments,
+// arguments of the field without declared ones are not checked
+func checkArgs(opType string, f Field, args map[string]interface{}) error {
+	if p, ok := args[argPath]; ok && opType == OpSubscription {
+		if _, ok := p.(string); !ok {
+			return errors.Errorf("argument %s of field %s must be string", argPath, f.Name)
+		}
+	}
+	if len(f.Args) == 0 {
+		return nil
+	}
+	declared := make(map[string]bool)
+	for _, a := range f.Args {
+		declared[a.Name] = true
+		if err := checkValue(mustTypeRef(a.Type), args[a.Name]); err != nil {
+			return errors.Wrapf(err, "argument %s of field %s", a.Name, f.Name)
+		}
+	}
+	for n := range args {
+		if !declared[n] && !(n == argPath && opType == OpSubscription) {
+			return errors.Errorf("unknown argument %s of field %s", n, f.Name)
+		}
+	}
+	return nil
+}
+
+// checkValue checks argument value against the type
+func checkValue(ref *typeRef, v interface{}) error {
+	if ref.kind == kindNonNull {
+		if v == nil {
+			return errors.Errorf("null value of type %s", ref)
+		}
+		return checkValue(ref.ofType, v)
+	}
+	if v == nil {
+		return nil
+	}
+	if ref.kind == kindList {
+		l, ok := v.([]interface{})
+		if !ok {
+			return checkValue(ref.ofType, v) // single value is coerced to the list
+		}
+		for _, e := range l {
+			if err := checkValue(ref.ofType, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	ok := true
+	switch ref.name {
+	case "Int":
+		f, isNum := number(v)
+		ok = isNum && f == math.Trunc(f)
+	case "Float":
+		_, ok = number(v)
+	case "String":
+		_, ok = v.(string)
+	case "ID":
+		_, isNum := number(v)
+		_, isStr := v.(string)
+		ok = isNum || isStr
+	case "Boolean":
+		_, ok = v.(bool)
+	}
+	if !ok {
+		return errors.Errorf("invalid value %v of type %s", v, ref)
+	}
+	return nil
+}
+
+// number returns value of the parsed or decoded number
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// checkSelections checks selections of the field of type ref.
+// Should be called during s.RLock.
+func (s *Schema) checkSelections(field string, ref *typeRef, sels []*Selection) error {
+	name := ref.named()
+	if name == scalarJSON {
+		return nil
+	}
+	if isScalar(name) {
+		if len(sels) > 0 {
+			return errors.Errorf("field %s of type %s must not have selections", field, ref)
+		}
+		return nil
+	}
+	t := s.types[name]
+	if len(sels) == 0 {
+		return errors.Errorf("field %s of type %s must have selections", field, ref)
+	}
+	for _, sel := range sels {
+		if sel.Name == fieldTypename {
+			sel.typename = name
+			continue
+		}
+		tf, ok := t.field(sel.Name)
+		if !ok {
+			return errors.Errorf("unknown field %s of type %s", sel.Name, name)
+		}
+		if len(sel.Args) > 0 {
+			return errors.Errorf("field %s of type %s has no arguments", sel.Name, name)
+		}
+		if err := s.checkSelections(sel.Name, mustTypeRef(tf.Type), sel.Selections); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+// Package group implements consumer groups for amp subscribers.
+//
+// Messages of a topic are load-balanced across members of the group
+// instead of being broadcast to all subscribers. Each member receives
+// all messages and keeps only those it owns. Ownership is decided by
+// rendezvous hashing of the message URI over the live members, so
+// messages of the same URI are always handled by the same member and
+// only URIs of the joined/left member are moved on rebalance.
+//
+// Membership is tracked through presence messages:
+//
+//	g := group.New("odds-calculator", 30*time.Second)
+//	g.Announce(ctx, presence.Service, version, 10*time.Second, pub.Publish)
+//	go g.Consume(ctx, nsq.Subscribe(ctx, []string{presence.Topic}))
+//	for m := range g.Filter(ctx, nsq.Subscribe(ctx, []string{"odds"})) {
+//		...
+//	}
+package group
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/presence"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+)
+
+// Group tracks live members of the consumer group and decides which
+// messages are owned by the current process.
+type Group struct {
+	name        string
+	self        string
+	ttl         time.Duration
+	seen        map[string]time.Time // last presence by member id
+	members     []string             // sorted live members, including self
+	onRebalance func(members []string)
+	sync.Mutex
+}
+
+// New creates group with the current process as the only member.
+// Members without presence message within ttl are removed from the group.
+func New(name string, ttl time.Duration) *Group {
+	self := presence.Self("", "").ID()
+	return &Group{
+		name:    name,
+		self:    self,
+		ttl:     ttl,
+		seen:    make(map[string]time.Time),
+		members: []string{self},
+	}
+}
+
+// Name of the group.
+func (g *Group) Name() string {
+	return g.name
+}
+
+// OnRebalance sets callback called with new member list each time
+// member joins or leaves the group.
+func (g *Group) OnRebalance(f func(members []string)) {
+	g.Lock()
+	defer g.Unlock()
+	g.onRebalance = f
+}
+
+// Announce publishes presence of the current process as the group member
+// every interval until ctx is done.
+func (g *Group) Announce(ctx context.Context, kind, version string, interval time.Duration, publish func(*amp.Msg)) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			i := presence.Self(kind, version)
+			i.Groups = []string{g.name}
+			publish(presence.NewAlive(i))
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Add applies presence message. Messages of components which are not
+// members of this group are ignored.
+func (g *Group) Add(m *amp.Msg) {
+	if !m.IsAlive() || m.URI != presence.Topic {
+		return
+	}
+	var i presence.Info
+	if err := m.Unmarshal(&i); err != nil {
+		log.Error(err)
+		return
+	}
+	if !i.Member(g.name) {
+		return
+	}
+	g.Lock()
+	g.seen[i.ID()] = time.Now()
+	g.Unlock()
+	g.rebalance()
+}
+
+// Expire removes members without presence message in ttl.
+func (g *Group) Expire() {
+	g.Lock()
+	for id, at := range g.seen {
+		if time.Since(at) > g.ttl {
+			delete(g.seen, id)
+		}
+	}
+	g.Unlock()
+	g.rebalance()
+}
+
+// Consume applies presence messages from in and expires old members
+// until in is closed or ctx is done.
+func (g *Group) Consume(ctx context.Context, in <-chan *amp.Msg) {
+	t := time.NewTicker(g.ttl / 2)
+	defer t.Stop()
+	for {
+		select {
+		case m, ok := <-in:
+			if !ok {
+				return
+			}
+			g.Add(m)
+		case <-t.C:
+			g.Expire()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Self returns member id of the current process.
+func (g *Group) Self() string {
+	return g.self
+}
+
+// Members returns sorted ids of the live group members.
+func (g *Group) Members() []string {
+	g.Lock()
+	defer g.Unlock()
+	return append([]string(nil), g.members...)
+}
+
+// Owner returns member responsible for the key.
+func (g *Group) Owner(key string) string {
+	g.Lock()
+	defer g.Unlock()
+	return owner(g.members, key)
+}
+
+// Owns returns true if message should be handled by the current process.
+func (g *Group) Owns(m *amp.Msg) bool {
+	return g.Owner(m.URI) == g.self
+}
+
+// Filter forwards from in only messages owned by the current process.
+// Returned channel is closed when in is closed or ctx is done.
+func (g *Group) Filter(ctx context.Context, in <-chan *amp.Msg) <-chan *amp.Msg {
+	out := make(chan *amp.Msg)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case m, ok := <-in:
+				if !ok {
+					return
+				}
+				if !g.Owns(m) {
+					continue
+				}
+				select {
+				case out <- m:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// rebalance recalculates member list and notifies on change.
+func (g *Group) rebalance() {
+	g.Lock()
+	members := make([]string, 0, len(g.seen)+1)
+	members = append(members, g.self)
+	for id := range g.seen {
+		if id != g.self {
+			members = append(members, id)
+		}
+	}
+	sort.Strings(members)
+	if equal(members, g.members) {
+		g.Unlock()
+		return
+	}
+	g.members = members
+	f := g.onRebalance
+	g.Unlock()
+
+	metric.Gauge("group."+g.name+".members", len(members))
+	log.S("group", g.name).I("members", len(members)).Info("rebalance")
+	if f != nil {
+		f(append([]string(nil), members...))
+	}
+}
+
+// owner selects member with the highest hash of member and key
+// (rendezvous hashing).
+func owner(members []string, key string) string {
+	var max uint64
+	var o string
+	for _, m := range members {
+		h := fnv.New64a()
+		h.Write([]byte(m))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		if s := mix(h.Sum64()); o == "" || s > max {
+			max, o = s, m
+		}
+	}
+	return o
+}
+
+// mix spreads bits of the fnv hash, similar keys give similar fnv sums
+// (splitmix64 finalizer).
+func mix(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
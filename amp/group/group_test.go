@@ -0,0 +1,68 @@
+package group
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/presence"
+	"github.com/stretchr/testify/assert"
+)
+
+func alive(host string, groups ...string) *amp.Msg {
+	i := presence.Self(presence.Service, "1.0.0")
+	i.Host = host
+	i.Groups = groups
+	return amp.Parse(presence.NewAlive(i).Marshal())
+}
+
+func TestGroup(t *testing.T) {
+	g := New("calc", 20*time.Millisecond)
+	var rebalanced [][]string
+	g.OnRebalance(func(m []string) { rebalanced = append(rebalanced, m) })
+
+	// alone, owns everything
+	m := amp.NewPublish("odds", "1", 1, amp.Diff, nil)
+	assert.True(t, g.Owns(m))
+
+	g.Add(alive("other", "calc"))
+	g.Add(alive("stranger", "other")) // not member
+	assert.Len(t, g.Members(), 2)
+	assert.Len(t, rebalanced, 1)
+	g.Add(alive("other", "calc")) // no change
+	assert.Len(t, rebalanced, 1)
+
+	// keys are distributed between members
+	owned := 0
+	for i := 0; i < 100; i++ {
+		if g.Owner(fmt.Sprintf("odds/%d", i)) == g.self {
+			owned++
+		}
+	}
+	assert.True(t, owned > 20 && owned < 80, "owned %d", owned)
+
+	// member leaves, all keys return
+	time.Sleep(30 * time.Millisecond)
+	g.Expire()
+	assert.Equal(t, []string{g.self}, g.Members())
+	assert.Len(t, rebalanced, 2)
+	assert.Equal(t, g.self, g.Owner("odds/1"))
+}
+
+func TestOwnerStable(t *testing.T) {
+	members := []string{"a", "b", "c"}
+	moved := 0
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("k%d", i)
+		o := owner(members, key)
+		if o == "c" {
+			continue
+		}
+		// when c leaves only its keys are moved
+		if owner(members[:2], key) != o {
+			moved++
+		}
+	}
+	assert.Equal(t, 0, moved)
+}
@@ -0,0 +1,45 @@
+package amp
+
+// TopicStatus is body of the Status message.
+type TopicStatus struct {
+	Stale     bool  `json:"stale"`               // producer heartbeat is missing
+	LastAlive int64 `json:"lastAlive,omitempty"` // ts of the last producer heartbeat
+}
+
+// NewTopicAlive creates producer heartbeat message for the topic.
+// Gateways use it to distinguish topic without updates from dead producer.
+func NewTopicAlive(topic string) *Msg {
+	return &Msg{
+		Type: Alive,
+		URI:  topic,
+		Ts:   TS(),
+	}
+}
+
+// NewStatus creates topic status message for the subscribers.
+func NewStatus(topic string, s TopicStatus) *Msg {
+	return &Msg{
+		Type: Status,
+		URI:  topic,
+		Ts:   TS(),
+		src:  toBodyMarshaler(s),
+	}
+}
+
+// NewDisconnect creates status message with transport error sent to the
+// client before server closes the connection.
+func NewDisconnect(reason string) *Msg {
+	return &Msg{
+		Type: Status,
+		Ts:   TS(),
+		Error: &Error{
+			Source:  TransportError,
+			Message: reason,
+		},
+	}
+}
+
+// IsStatus returns true if message is Status type
+func (m *Msg) IsStatus() bool {
+	return m.Type == Status
+}
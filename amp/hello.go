@@ -0,0 +1,115 @@
+package amp
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// Compressions and codecs announced in the handshake.
+const (
+	CompressionNameDeflate = "deflate"
+	CompressionNameNone    = "none"
+
+	CodecJSON   = "json"   // json bodies
+	CodecBinary = "binary" // binary bodies (see NewPublishBinary), ProtocolVersion2
+)
+
+// Hello is body of the handshake message sent by the client as the first
+// message of the connection. It replaces implicit per transport
+// assumptions (VersionKey in the ws query string, Version field of the
+// first tcp message).
+type Hello struct {
+	Version      uint8    `json:"version"`                // protocol version
+	Compressions []string `json:"compressions,omitempty"` // supported compressions, in order of preference
+	Codecs       []string `json:"codecs,omitempty"`       // supported body codecs
+	Client       string   `json:"client,omitempty"`       // client application and version, e.g. web/2.1.0
+	Device       string   `json:"device,omitempty"`       // device info, e.g. ios/17.2
+	Resume       string   `json:"resume,omitempty"`       // SessionID of the previous connection to resume
+}
+
+// Welcome is body of the server reply to Hello with accepted options.
+type Welcome struct {
+	Version     uint8    `json:"version"`               // accepted protocol version
+	Compression string   `json:"compression,omitempty"` // compression used for the server messages
+	Codecs      []string `json:"codecs,omitempty"`      // accepted body codecs
+	SessionID   string   `json:"sessionId"`             // resume token for the next connection
+	Resumed     bool     `json:"resumed,omitempty"`     // previous session is resumed
+}
+
+// NewHello creates handshake message.
+func NewHello(h Hello) *Msg {
+	return &Msg{
+		Type: Connect,
+		Ts:   TS(),
+		src:  toBodyMarshaler(h),
+	}
+}
+
+// Welcome creates server reply to the Hello message.
+func (m *Msg) Welcome(w Welcome) *Msg {
+	return &Msg{
+		Type:          Connect,
+		Ts:            TS(),
+		CorrelationID: m.CorrelationID,
+		src:           toBodyMarshaler(w),
+	}
+}
+
+// IsConnect returns true if message is Connect (handshake) type.
+func (m *Msg) IsConnect() bool {
+	return m.Type == Connect
+}
+
+// ParseHello returns Hello from the handshake message body.
+func (m *Msg) ParseHello() (Hello, error) {
+	var h Hello
+	if err := json.Unmarshal(m.BodyBytes(), &h); err != nil {
+		return h, errors.Wrap(err, "hello")
+	}
+	return h, nil
+}
+
+// NegotiateHello selects options supported by both sides.
+// Server supports compressions and codecs in the arguments, compression
+// is the first one from the client list supported by server, none if
+// there is no such. Client without version is ProtocolVersionMin.
+func NegotiateHello(h Hello, sessionID string, compressions, codecs []string) (Welcome, error) {
+	w := Welcome{SessionID: sessionID, Compression: CompressionNameNone}
+	v := h.Version
+	if v == 0 {
+		v = ProtocolVersionMin
+	}
+	v, err := CheckVersion(v)
+	if err != nil {
+		return w, err
+	}
+	w.Version = v
+	for _, c := range h.Compressions {
+		if contains(compressions, c) {
+			w.Compression = c
+			break
+		}
+	}
+	for _, c := range h.Codecs {
+		if c == CodecBinary && v < ProtocolVersion2 {
+			continue
+		}
+		if contains(codecs, c) {
+			w.Codecs = append(w.Codecs, c)
+		}
+	}
+	if len(w.Codecs) == 0 {
+		w.Codecs = []string{CodecJSON}
+	}
+	return w, nil
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
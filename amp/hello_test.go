@@ -0,0 +1,41 @@
+package amp
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHello(t *testing.T) {
+	m := NewHello(Hello{
+		Version:      ProtocolVersion,
+		Compressions: []string{"zstd", CompressionNameDeflate},
+		Codecs:       []string{CodecBinary, "msgpack", CodecJSON},
+		Client:       "web/2.1.0",
+	})
+	m = Parse(m.Marshal())
+	assert.True(t, m.IsConnect())
+	h, err := m.ParseHello()
+	assert.Nil(t, err)
+	assert.Equal(t, "web/2.1.0", h.Client)
+
+	w, err := NegotiateHello(h, "s1", []string{CompressionNameNone, CompressionNameDeflate}, []string{CodecJSON, CodecBinary})
+	assert.Nil(t, err)
+	assert.Equal(t, Welcome{
+		Version:     ProtocolVersion,
+		Compression: CompressionNameDeflate,
+		Codecs:      []string{CodecBinary, CodecJSON},
+		SessionID:   "s1",
+	}, w)
+
+	// old client without binary bodies
+	w, err = NegotiateHello(Hello{Codecs: []string{CodecBinary}}, "s2", nil, []string{CodecJSON, CodecBinary})
+	assert.Nil(t, err)
+	assert.Equal(t, ProtocolVersionMin, w.Version)
+	assert.Equal(t, CompressionNameNone, w.Compression)
+	assert.Equal(t, []string{CodecJSON}, w.Codecs)
+
+	_, err = NegotiateHello(Hello{Version: 99}, "s3", nil, nil)
+	assert.Equal(t, ErrUnsupportedVersion, errors.Cause(err))
+}
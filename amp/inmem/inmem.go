@@ -0,0 +1,197 @@
+// Package inmem is in memory amp transport for tests.
+//
+// Bus replaces nsq; it has the same Subscribe, Publisher, Responder and
+// Requester api as amp/nsq package, so services and middleware can be
+// tested end-to-end without running nsqd.
+// Messages are marshaled on publish and parsed on delivery, same as on
+// the wire. Latency, drops and reordering could be simulated by options:
+//
+//	bus := inmem.New(inmem.Latency(time.Millisecond), inmem.Drop(0.01), inmem.Reorder(0.1))
+//	rsp := bus.NewResponder(ctx, handler, []string{"math.req"})
+//	req := bus.NewRequester(ctx)
+package inmem
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+)
+
+// Bus routes messages between in memory topic subscriptions.
+type Bus struct {
+	subs      map[string]map[*subscription]struct{} // subscriptions by topic
+	latency   time.Duration
+	drop      float64
+	reorder   float64
+	rnd       *rand.Rand
+	replyNo   int
+	running   map[requestKey]context.CancelFunc // handler contexts of the running requests
+	cancelled map[requestKey]struct{}           // requests cancelled before they are started
+	sync.Mutex
+}
+
+// New creates new bus.
+func New(opts ...func(*Bus)) *Bus {
+	b := &Bus{
+		subs:      make(map[string]map[*subscription]struct{}),
+		rnd:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		running:   make(map[requestKey]context.CancelFunc),
+		cancelled: make(map[requestKey]struct{}),
+	}
+	for _, o := range opts {
+		o(b)
+	}
+	return b
+}
+
+// Latency delays delivery of each message.
+func Latency(d time.Duration) func(*Bus) {
+	return func(b *Bus) {
+		b.latency = d
+	}
+}
+
+// Drop drops rate (0-1) of published messages.
+func Drop(rate float64) func(*Bus) {
+	return func(b *Bus) {
+		b.drop = rate
+	}
+}
+
+// Reorder delivers rate (0-1) of messages after the next message on the topic.
+func Reorder(rate float64) func(*Bus) {
+	return func(b *Bus) {
+		b.reorder = rate
+	}
+}
+
+// Seed sets seed for the random drops and reorders,
+// to make test repeatable.
+func Seed(seed int64) func(*Bus) {
+	return func(b *Bus) {
+		b.rnd = rand.New(rand.NewSource(seed))
+	}
+}
+
+type delivery struct {
+	at  time.Time
+	buf []byte
+}
+
+// subscription is one consumer of the topic
+type subscription struct {
+	queue chan delivery
+	done  chan struct{} // closed when subscription ctx is done
+	held  *delivery     // message held for reordering, guarded by Bus lock
+}
+
+// Publish sends message to all subscribers of the topic.
+func (b *Bus) Publish(topic string, m *amp.Msg) {
+	b.publish(topic, m.Marshal())
+}
+
+// target is subscription with messages to queue
+type target struct {
+	s  *subscription
+	ds []delivery
+}
+
+func (b *Bus) publish(topic string, buf []byte) {
+	b.Lock()
+	var targets []target
+	for s := range b.subs[topic] {
+		if b.drop > 0 && b.rnd.Float64() < b.drop {
+			continue
+		}
+		d := delivery{at: time.Now().Add(b.latency), buf: buf}
+		if b.reorder > 0 && s.held == nil && b.rnd.Float64() < b.reorder {
+			s.held = &d
+			continue
+		}
+		t := target{s: s, ds: []delivery{d}}
+		if s.held != nil {
+			t.ds = append(t.ds, *s.held)
+			s.held = nil
+		}
+		targets = append(targets, t)
+	}
+	b.Unlock()
+
+	// queued outside of the lock, subscriber with the full queue blocks
+	// only its publisher
+	for _, t := range targets {
+		for _, d := range t.ds {
+			select {
+			case t.s.queue <- d:
+			case <-t.s.done:
+			}
+		}
+	}
+}
+
+// Subscribe to the topics.
+// Returns channel of received messages which is closed when ctx is done.
+func (b *Bus) Subscribe(ctx context.Context, topics []string) <-chan *amp.Msg {
+	out := make(chan *amp.Msg, 16)
+	s := &subscription{
+		queue: make(chan delivery, 1024),
+		done:  make(chan struct{}),
+	}
+	b.Lock()
+	for _, t := range topics {
+		if _, ok := b.subs[t]; !ok {
+			b.subs[t] = make(map[*subscription]struct{})
+		}
+		b.subs[t][s] = struct{}{}
+	}
+	b.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.Lock()
+		for _, t := range topics {
+			delete(b.subs[t], s)
+		}
+		b.Unlock()
+		close(s.done)
+	}()
+
+	go func() {
+		defer close(out)
+		deliver := func(d delivery) {
+			time.Sleep(time.Until(d.at))
+			if m := amp.Parse(d.buf); m != nil {
+				out <- m
+			}
+		}
+		for {
+			select {
+			case d := <-s.queue:
+				deliver(d)
+			case <-s.done:
+				// deliver queued, queue is not closed because
+				// publishers could still hold the subscription
+				for {
+					select {
+					case d := <-s.queue:
+						deliver(d)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+	return out
+}
+
+func (b *Bus) replyTopic() string {
+	b.Lock()
+	defer b.Unlock()
+	b.replyNo++
+	return fmt.Sprintf("z...rsp-inmem-%d", b.replyNo)
+}
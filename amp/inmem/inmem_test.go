@@ -0,0 +1,148 @@
+package inmem
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+type testSubscriber struct {
+	msgs chan *amp.Msg
+}
+
+func (s *testSubscriber) Send(m *amp.Msg) {
+	s.msgs <- m
+}
+
+func TestRequestResponse(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	bus := New(Latency(time.Millisecond))
+	handler := func(ctx context.Context, m *amp.Msg) (*amp.Msg, error) {
+		_, ok := ctx.Deadline()
+		_, has := m.Deadline()
+		assert.Equal(t, has, ok)
+		assert.NotEmpty(t, amp.TraceFromContext(ctx))
+		var p struct{ X, Y int }
+		if err := m.Unmarshal(&p); err != nil {
+			return nil, err
+		}
+		if p.X+p.Y == 42 {
+			return nil, fmt.Errorf("the answer")
+		}
+		return m.Response(map[string]int{"z": p.X + p.Y}), nil
+	}
+	rsp := bus.NewResponder(ctx, handler, []string{"math.req"})
+	req := bus.NewRequester(ctx)
+
+	s := &testSubscriber{msgs: make(chan *amp.Msg, 2)}
+	m := amp.NewRequest("math.req/add", map[string]int{"X": 1, "Y": 2})
+	m.CorrelationID = 7
+	req.Send(s, m)
+	r := <-s.msgs
+	assert.Equal(t, uint64(7), r.CorrelationID)
+	var z map[string]int
+	assert.Nil(t, r.Unmarshal(&z))
+	assert.Equal(t, 3, z["z"])
+
+	req.Send(s, amp.NewRequest("math.req/add", map[string]int{"X": 40, "Y": 2}))
+	r = <-s.msgs
+	assert.NotNil(t, r.Error)
+	assert.Equal(t, "the answer", r.Error.Message)
+
+	// expired request is not handled
+	m = amp.NewRequest("math.req/add", map[string]int{"X": 1, "Y": 1})
+	m.SetDeadline(-time.Millisecond)
+	req.Send(s, m)
+	m = amp.NewRequest("math.req/add", map[string]int{"X": 2, "Y": 2})
+	m.SetDeadline(time.Minute)
+	req.Send(s, m)
+	r = <-s.msgs
+	assert.Nil(t, r.Unmarshal(&z))
+	assert.Equal(t, 4, z["z"])
+
+	cancel()
+	rsp.Wait()
+	req.Wait()
+}
+
+func TestCancelOnUnsubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bus := New()
+	started := make(chan struct{})
+	done := make(chan error, 1)
+	bus.NewResponder(ctx, func(ctx context.Context, m *amp.Msg) (*amp.Msg, error) {
+		close(started)
+		<-ctx.Done()
+		done <- ctx.Err()
+		return nil, ctx.Err()
+	}, []string{"math.req"})
+	req := bus.NewRequester(ctx)
+
+	s := &testSubscriber{msgs: make(chan *amp.Msg, 1)}
+	req.Send(s, amp.NewRequest("math.req/add", nil))
+	<-started
+	// client disconnected, nobody is waiting for the response
+	req.Unsubscribe(s)
+	select {
+	case err := <-done:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("handler context not cancelled")
+	}
+}
+
+func TestPublishReorder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	bus := New(Reorder(1), Seed(1))
+	in := bus.Subscribe(ctx, []string{"math.v1"})
+	bus.Publish("math.v1", amp.NewPublish("math.v1", "", 1, amp.Diff, nil))
+	bus.Publish("math.v1", amp.NewPublish("math.v1", "", 2, amp.Diff, nil))
+	assert.Equal(t, int64(2), (<-in).Ts)
+	assert.Equal(t, int64(1), (<-in).Ts)
+	cancel()
+	for range in {
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bus := New()
+	bus.Subscribe(ctx, []string{"slow"}) // never read
+
+	published := make(chan struct{})
+	go func() {
+		for i := 0; i < 2048; i++ {
+			bus.Publish("slow", amp.NewPublish("slow", "", int64(i), amp.Diff, nil))
+		}
+		close(published)
+	}()
+	time.Sleep(50 * time.Millisecond) // until slow queue is full
+
+	// full subscriber queue doesn't block other topics
+	received := make(chan int64)
+	go func() {
+		in := bus.Subscribe(ctx, []string{"fast"})
+		bus.Publish("fast", amp.NewPublish("fast", "", 1, amp.Diff, nil))
+		received <- (<-in).Ts
+	}()
+	select {
+	case ts := <-received:
+		assert.Equal(t, int64(1), ts)
+	case <-time.After(time.Second):
+		t.Fatal("blocked by slow subscriber")
+	}
+
+	// blocked publisher is released when subscription is done
+	cancel()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("publisher not released")
+	}
+}
@@ -0,0 +1,207 @@
+package inmem
+
+import (
+	"context"
+	"sync"
+
+	"github.com/minus5/svckit/amp"
+)
+
+// Publisher publishes messages to the bus, same as amp/nsq Publisher.
+type Publisher struct {
+	done chan struct{}
+}
+
+// NewPublisher publishes all messages from in to the message topic.
+func (b *Bus) NewPublisher(in <-chan *amp.Msg) *Publisher {
+	p := &Publisher{
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(p.done)
+		for m := range in {
+			b.Publish(m.Topic(), m)
+		}
+	}()
+	return p
+}
+
+// Wait until in chan is closed.
+func (p *Publisher) Wait() {
+	<-p.done
+}
+
+// Responder calls handler for each request, same as amp/nsq Responder.
+type Responder struct {
+	done chan struct{}
+}
+
+// NewResponder subscribes to the topics and publishes handler
+// response to the request ReplyTo topic.
+func (b *Bus) NewResponder(ctx context.Context,
+	handler amp.Handler,
+	topics []string) *Responder {
+
+	r := &Responder{
+		done: make(chan struct{}),
+	}
+	handler = amp.Instrument(amp.Recover(handler))
+	in := b.Subscribe(ctx, topics)
+	go func() {
+		defer close(r.done)
+		for m := range in {
+			if m.Expired() {
+				continue
+			}
+			hctx, cancel := amp.NewContext(ctx, m)
+			if !b.started(m, cancel) {
+				cancel()
+				continue
+			}
+			rm, err := handler(hctx, m)
+			b.finished(m)
+			cancel()
+			if err != nil {
+				rm = m.ResponseError(err)
+			}
+			if rm == nil || m.ReplyTo == "" {
+				continue
+			}
+			b.Publish(m.ReplyTo, rm)
+		}
+	}()
+	return r
+}
+
+// Wait until ctx is done and all requests are handled.
+func (r *Responder) Wait() {
+	<-r.done
+}
+
+// Requester sends requests and delivers responses, same as amp/nsq Requester.
+type Requester struct {
+	bus           *Bus
+	topic         string
+	queue         map[uint64]*request
+	correlationNo uint64
+	closed        chan struct{}
+	sync.Mutex
+}
+
+type request struct {
+	msg    *amp.Msg
+	source amp.Subscriber
+}
+
+// NewRequester creates requester with own responses topic.
+func (b *Bus) NewRequester(ctx context.Context) *Requester {
+	r := &Requester{
+		bus:    b,
+		topic:  b.replyTopic(),
+		queue:  make(map[uint64]*request),
+		closed: make(chan struct{}),
+	}
+	in := b.Subscribe(ctx, []string{r.topic})
+	go func() {
+		defer close(r.closed)
+		for m := range in {
+			r.reply(m.CorrelationID, m)
+		}
+	}()
+	return r
+}
+
+func (r *Requester) reply(correlationID uint64, m *amp.Msg) {
+	r.Lock()
+	req, ok := r.queue[correlationID]
+	if ok {
+		delete(r.queue, correlationID)
+	}
+	r.Unlock()
+	if !ok {
+		return
+	}
+	m.CorrelationID = req.msg.CorrelationID
+	req.source.Send(m)
+}
+
+// Send request m, response is delivered to e.
+func (r *Requester) Send(e amp.Subscriber, m *amp.Msg) {
+	r.Lock()
+	r.correlationNo++
+	correlationID := r.correlationNo
+	r.queue[correlationID] = &request{msg: m, source: e}
+	r.Unlock()
+
+	rm := m.Request()
+	rm.CorrelationID = correlationID
+	rm.ReplyTo = r.topic
+	rm.StartTrace()
+	r.bus.Publish(m.Topic(), rm)
+}
+
+// Current sends current message for the uri.
+func (r *Requester) Current(uri string) {
+	m := amp.NewCurrent(uri)
+	r.bus.Publish(m.Topic()+".current", m)
+}
+
+// Unsubscribe stops waiting for responses for e, handler contexts of its
+// requests are cancelled.
+func (r *Requester) Unsubscribe(e amp.Subscriber) {
+	var pending []uint64
+	r.Lock()
+	for key, req := range r.queue {
+		if req.source == e {
+			delete(r.queue, key)
+			pending = append(pending, key)
+		}
+	}
+	r.Unlock()
+	for _, id := range pending {
+		r.bus.cancel(requestKey{replyTo: r.topic, correlationID: id})
+	}
+}
+
+// requestKey identifies request on the bus
+type requestKey struct {
+	replyTo       string
+	correlationID uint64
+}
+
+// started registers cancel of the request handler context, returns false
+// if request is already cancelled
+func (b *Bus) started(m *amp.Msg, cancel context.CancelFunc) bool {
+	k := requestKey{replyTo: m.ReplyTo, correlationID: m.CorrelationID}
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.cancelled[k]; ok {
+		delete(b.cancelled, k)
+		return false
+	}
+	b.running[k] = cancel
+	return true
+}
+
+func (b *Bus) finished(m *amp.Msg) {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.running, requestKey{replyTo: m.ReplyTo, correlationID: m.CorrelationID})
+}
+
+// cancel cancels handler context of the request
+func (b *Bus) cancel(k requestKey) {
+	b.Lock()
+	defer b.Unlock()
+	if cancel, ok := b.running[k]; ok {
+		delete(b.running, k)
+		cancel()
+		return
+	}
+	b.cancelled[k] = struct{}{}
+}
+
+// Wait until ctx is done.
+func (r *Requester) Wait() {
+	<-r.closed
+}
@@ -0,0 +1,187 @@
+// Package inspect is tcpdump for the amp layer. Inspector is transparent
+// pipe between the gateway and nsq, or between two services, which logs
+// and records messages of the enabled topics matching the filter.
+//
+//	insp := inspect.New(inspect.Record(replayfile.NewRecorder(f)))
+//	broker.Consume(insp.Pipe(nsq.Subscribe(ctx, topics)))  // published messages
+//	r.Use(insp.Handler)                                    // requests and responses
+//	ctl.Handle(inspect.ControlCommand, insp.Command)       // enable at runtime
+//
+// Topics are enabled at runtime by the control command:
+//
+//	ampcli control inspect topic=math.v1 filter='body.x > 1'
+//	ampcli control inspect topic=math.v1 off=true
+package inspect
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/control"
+	"github.com/minus5/svckit/amp/filter"
+	"github.com/minus5/svckit/amp/replayfile"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+	"github.com/pkg/errors"
+)
+
+// ControlCommand is name of the control command which enables inspection,
+// args: topic (* for all topics), filter expression, off=true disables.
+const ControlCommand = "inspect"
+
+// AllTopics enables inspection of all topics.
+const AllTopics = "*"
+
+// Inspector logs and records messages of the enabled topics.
+type Inspector struct {
+	topics   map[string]*filter.Filter // enabled topics, nil filter matches all
+	recorder *replayfile.Recorder
+	noLog    bool
+	sync.RWMutex
+}
+
+// Record records inspected messages.
+func Record(r *replayfile.Recorder) func(*Inspector) {
+	return func(i *Inspector) {
+		i.recorder = r
+	}
+}
+
+// NoLog disables logging of inspected messages, use with Record.
+func NoLog() func(*Inspector) {
+	return func(i *Inspector) {
+		i.noLog = true
+	}
+}
+
+// New creates inspector without enabled topics.
+func New(opts ...func(*Inspector)) *Inspector {
+	i := &Inspector{topics: make(map[string]*filter.Filter)}
+	for _, o := range opts {
+		o(i)
+	}
+	return i
+}
+
+// Enable enables inspection of the topic messages which match filter
+// expression (see amp/filter), all messages if expr is empty.
+func (i *Inspector) Enable(topic, expr string) error {
+	var f *filter.Filter
+	if expr != "" {
+		var err error
+		if f, err = filter.Compile(expr); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	i.Lock()
+	defer i.Unlock()
+	i.topics[topic] = f
+	return nil
+}
+
+// Disable disables inspection of the topic.
+func (i *Inspector) Disable(topic string) {
+	i.Lock()
+	defer i.Unlock()
+	delete(i.topics, topic)
+}
+
+// Command is control command handler, see ControlCommand.
+func (i *Inspector) Command(cmd control.Command) error {
+	topic := cmd.Args["topic"]
+	if topic == "" {
+		return errors.New("missing topic")
+	}
+	if cmd.Args["off"] == "true" {
+		i.Disable(topic)
+		return nil
+	}
+	return i.Enable(topic, cmd.Args["filter"])
+}
+
+// match returns true if message for the uri should be inspected
+func (i *Inspector) match(uri string, m *amp.Msg) bool {
+	i.RLock()
+	defer i.RUnlock()
+	if len(i.topics) == 0 {
+		return false
+	}
+	f, ok := i.topics[topicOf(uri)]
+	if !ok {
+		if f, ok = i.topics[AllTopics]; !ok {
+			return false
+		}
+	}
+	return f == nil || (!m.IsBinary() && f.Match(m.BodyBytes()))
+}
+
+// Inspect logs and records message if it's topic is enabled.
+// Direction describes where the message is going (publish, request, response).
+func (i *Inspector) Inspect(direction string, m *amp.Msg) {
+	if m == nil {
+		return
+	}
+	i.inspect(direction, m.URI, m)
+}
+
+// inspect inspects message for the uri, response has no uri so
+// request uri is used
+func (i *Inspector) inspect(direction, uri string, m *amp.Msg) {
+	if !i.match(uri, m) {
+		return
+	}
+	metric.Counter("inspect." + direction)
+	if !i.noLog {
+		l := log.S("direction", direction).S("uri", uri).I("type", int(m.Type)).I("ts", int(m.Ts))
+		if m.CorrelationID != 0 {
+			l = l.I("correlationID", int(m.CorrelationID))
+		}
+		if m.IsBinary() {
+			l = l.I("binary", len(m.BodyBytes()))
+		} else {
+			l = l.J("body", m.BodyBytes())
+		}
+		l.Info("inspect")
+	}
+	if i.recorder != nil {
+		i.recorder.Record(m)
+	}
+}
+
+// Pipe passes all messages from in to the returned chan, inspecting them.
+// Recorder is flushed when in is closed.
+func (i *Inspector) Pipe(in <-chan *amp.Msg) <-chan *amp.Msg {
+	out := make(chan *amp.Msg)
+	go func() {
+		defer close(out)
+		if i.recorder != nil {
+			defer i.recorder.Flush()
+		}
+		for m := range in {
+			i.Inspect("publish", m)
+			out <- m
+		}
+	}()
+	return out
+}
+
+// Handler is middleware which inspects requests and their responses.
+func (i *Inspector) Handler(h amp.Handler) amp.Handler {
+	return func(ctx context.Context, m *amp.Msg) (*amp.Msg, error) {
+		i.Inspect("request", m)
+		rsp, err := h(ctx, m)
+		if rsp != nil {
+			i.inspect("response", m.URI, rsp)
+		}
+		return rsp, err
+	}
+}
+
+func topicOf(uri string) string {
+	if p := strings.IndexByte(uri, '/'); p >= 0 {
+		return uri[:p]
+	}
+	return uri
+}
@@ -0,0 +1,59 @@
+package inspect
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/control"
+	"github.com/minus5/svckit/amp/replayfile"
+	"github.com/stretchr/testify/assert"
+)
+
+func recorded(buf *bytes.Buffer) []string {
+	var uris []string
+	replayfile.NewPlayer(buf, 0).Play(context.Background(), func(m *amp.Msg) {
+		uris = append(uris, m.URI)
+	})
+	return uris
+}
+
+func TestPipe(t *testing.T) {
+	var buf bytes.Buffer
+	insp := New(Record(replayfile.NewRecorder(&buf)), NoLog())
+	assert.NoError(t, insp.Enable("math.v1", "body.x > 1"))
+	assert.Error(t, insp.Enable("math.v1", "body.x >"))
+
+	in := make(chan *amp.Msg, 4)
+	in <- amp.NewPublish("math.v1", "a", 1, amp.Diff, map[string]int{"x": 1})
+	in <- amp.NewPublish("math.v1", "b", 2, amp.Diff, map[string]int{"x": 2})
+	in <- amp.NewPublish("chat", "", 1, amp.Diff, nil)
+	close(in)
+	n := 0
+	for range insp.Pipe(in) {
+		n++
+	}
+	assert.Equal(t, 3, n) // all messages are passed
+	assert.Equal(t, []string{"math.v1/b"}, recorded(&buf))
+}
+
+func TestHandler(t *testing.T) {
+	var buf bytes.Buffer
+	insp := New(Record(replayfile.NewRecorder(&buf)), NoLog())
+	h := insp.Handler(func(ctx context.Context, m *amp.Msg) (*amp.Msg, error) {
+		return m.Response(map[string]int{"sum": 3}), nil
+	})
+	req := amp.NewRequest("math.req/add", map[string]int{"x": 1})
+
+	h(context.Background(), req)
+	assert.NoError(t, insp.Command(control.Command{Args: map[string]string{"topic": AllTopics}}))
+	h(context.Background(), req)
+	assert.NoError(t, insp.Command(control.Command{Args: map[string]string{"topic": AllTopics, "off": "true"}}))
+	h(context.Background(), req)
+	assert.Error(t, insp.Command(control.Command{}))
+
+	insp.recorder.Flush()
+	// request and response without uri
+	assert.Equal(t, []string{"math.req/add", ""}, recorded(&buf))
+}
@@ -0,0 +1,58 @@
+package amp
+
+import "sync"
+
+// LanesOrder is order in which priority lanes are processed.
+var LanesOrder = []uint8{PriorityHigh, PriorityNormal, PriorityLow}
+
+// laneRank is position of the lane in LanesOrder
+var laneRank = [...]int{PriorityHigh: 0, PriorityNormal: 1, PriorityLow: 2}
+
+// Lanes keeps order of the messages of the same URI when they are put
+// into priority lanes. Message is never put into lane which is processed
+// before the lane with waiting message of the same URI, so Full or Close
+// can't overtake Diffs published before it.
+type Lanes struct {
+	waiting map[string]*[3]int // waiting messages by URI and lane
+	sync.Mutex
+}
+
+// NewLanes creates empty lanes.
+func NewLanes() *Lanes {
+	return &Lanes{waiting: make(map[string]*[3]int)}
+}
+
+// Put returns lane for the message and counts it as waiting in the lane.
+func (l *Lanes) Put(m *Msg) uint8 {
+	lane := m.Lane()
+	l.Lock()
+	defer l.Unlock()
+	w, ok := l.waiting[m.URI]
+	if !ok {
+		w = &[3]int{}
+		l.waiting[m.URI] = w
+	}
+	for _, later := range LanesOrder[laneRank[lane]+1:] {
+		if w[later] > 0 {
+			lane = later
+		}
+	}
+	w[lane]++
+	return lane
+}
+
+// Done removes message, which is taken from the lane, from waiting.
+func (l *Lanes) Done(m *Msg, lane uint8) {
+	l.Lock()
+	defer l.Unlock()
+	w, ok := l.waiting[m.URI]
+	if !ok {
+		return
+	}
+	if w[lane] > 0 {
+		w[lane]--
+	}
+	if *w == [3]int{} {
+		delete(l.waiting, m.URI)
+	}
+}
@@ -0,0 +1,102 @@
+package amp
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minus5/svckit/metric"
+)
+
+// per message metrics configuration
+var metrics struct {
+	enabled bool
+	paths   bool
+}
+
+// EnableMetrics turns on automatic metrics for each published, received
+// and subscribed message and for each request/response handled by
+// responders and requesters. Call it once on service start.
+// Metric names have topic, path (if paths is true) and status in them:
+//
+//	amp.<event>.<topic>[.<path>][.<status>]
+//
+// where event is publish, receive, subscribe, request or handle and status
+// is ok or error.<code>. Request and handle are timings, others counters.
+func EnableMetrics(paths bool) {
+	metrics.enabled = true
+	metrics.paths = paths
+}
+
+// DisableMetrics turns off automatic metrics.
+func DisableMetrics() {
+	metrics.enabled = false
+}
+
+// CountMsg increments event counter for the message uri.
+func CountMsg(event string, m *Msg) {
+	if !metrics.enabled {
+		return
+	}
+	metric.Counter(metricName(event, m.URI, ""))
+}
+
+// CountURI increments event counter for the uri.
+func CountURI(event string, uri string) {
+	if !metrics.enabled {
+		return
+	}
+	metric.Counter(metricName(event, uri, ""))
+}
+
+// TimeMsg submits duration since start for the request uri
+// with status of the response.
+func TimeMsg(event string, req *Msg, rsp *Msg, start time.Time) {
+	if !metrics.enabled {
+		return
+	}
+	metric.Time(metricName(event, req.URI, status(rsp.Error)), int(time.Since(start)/time.Millisecond))
+}
+
+// Instrument is middleware which submits handler timing with
+// response status. Responders wrap handlers with Instrument.
+func Instrument(h Handler) Handler {
+	return func(ctx context.Context, m *Msg) (*Msg, error) {
+		if !metrics.enabled {
+			return h(ctx, m)
+		}
+		start := time.Now()
+		rm, err := h(ctx, m)
+		var e *Error
+		if err != nil {
+			e = toError(err)
+		} else if rm != nil {
+			e = rm.Error
+		}
+		metric.Time(metricName("handle", m.URI, status(e)), int(time.Since(start)/time.Millisecond))
+		return rm, err
+	}
+}
+
+func status(e *Error) string {
+	if e == nil {
+		return "ok"
+	}
+	return "error." + strconv.Itoa(e.Code)
+}
+
+func metricName(event, uri, status string) string {
+	topic, path := uri, ""
+	if i := strings.Index(uri, "/"); i >= 0 {
+		topic, path = uri[:i], uri[i+1:]
+	}
+	parts := []string{"amp", event, topic}
+	if metrics.paths && path != "" {
+		parts = append(parts, strings.Replace(path, "/", ".", -1))
+	}
+	if status != "" {
+		parts = append(parts, status)
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,693 @@
+// Package mqtt exposes amp topics to MQTT 3.1.1 clients, so embedded
+// devices can participate without a custom amp client.
+//
+// Topic filters are mapped to amp subscriptions: "odds/#" and "odds" are
+// subscriptions to the amp topic odds, "odds/1" to the single path.
+// Messages are sent as PUBLISH packets on the message uri with body as
+// payload. MQTT publishes from the clients into inbound topics are
+// published into amp.
+//
+// QoS levels are mapped to amp semantics:
+//
+//	QoS 0: client gets current topic state and live updates, nothing is acknowledged
+//	QoS 1: client acknowledges each message by packet id, persistent session
+//	       (clean session flag off) keeps unacknowledged messages, on reconnect
+//	       they are retransmitted and broker replays messages sent after them
+//	QoS 2: granted as QoS 1 for subscriptions, exactly once for inbound publishes
+//
+// Persistent session of the disconnected client expires after SessionExpiry.
+//
+// Usage:
+//
+//	b := mqtt.New(brk, pub.Publish, mqtt.Topics("odds"), mqtt.Inbound("telemetry"))
+//	go b.Listen(ctx, tcp.MustOpen(1883, nil))
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+	"github.com/pkg/errors"
+)
+
+const (
+	protocolLevel  = 4 // MQTT 3.1.1
+	connectTimeout = 10 * time.Second
+)
+
+type broker interface {
+	Subscribe(amp.Subscriber, map[string]int64) // subscribe to the topics
+	Unsubscribe(amp.Subscriber)                 // unsubscribe from all topics
+}
+
+type options struct {
+	topics     map[string]bool // exposed topics, all if empty
+	inbound    map[string]bool // topics clients can publish into
+	updateType uint8
+	auth       func(clientID, username, password string) bool
+	maxPacket  int
+	queueSize  int
+	expiry     time.Duration
+}
+
+// Topics selects amp topics exposed to the clients, all topics by default.
+func Topics(topics ...string) func(*options) {
+	return func(o *options) {
+		for _, t := range topics {
+			o.topics[t] = true
+		}
+	}
+}
+
+// Inbound selects topics clients can publish into, none by default.
+func Inbound(topics ...string) func(*options) {
+	return func(o *options) {
+		for _, t := range topics {
+			o.inbound[t] = true
+		}
+	}
+}
+
+// UpdateType sets update type of the inbound messages, default amp.Diff.
+func UpdateType(ut uint8) func(*options) {
+	return func(o *options) {
+		o.updateType = ut
+	}
+}
+
+// Auth sets authentication of the connecting clients.
+func Auth(f func(clientID, username, password string) bool) func(*options) {
+	return func(o *options) {
+		o.auth = f
+	}
+}
+
+// MaxPacket sets max size of the received packet, default 256KB.
+func MaxPacket(n int) func(*options) {
+	return func(o *options) {
+		o.maxPacket = n
+	}
+}
+
+// SessionExpiry sets how long persistent session of the disconnected
+// client is kept, default one hour.
+func SessionExpiry(d time.Duration) func(*options) {
+	return func(o *options) {
+		if d > 0 {
+			o.expiry = d
+		}
+	}
+}
+
+// state of the persistent session
+type state struct {
+	subs         map[string]byte  // qos by amp uri
+	sent         map[string]int64 // ts of the last sent QoS 1 message by amp uri
+	inflight     []inflight       // sent QoS 1 messages waiting for PUBACK, in send order
+	inQoS2       map[uint16]bool  // received QoS 2 publishes waiting for PUBREL
+	nextID       uint16
+	owner        *client   // connected client, nil when disconnected
+	disconnected time.Time // when owner disconnected
+	sync.Mutex
+}
+
+// inflight is QoS 1 message waiting for PUBACK
+type inflight struct {
+	id  uint16
+	msg *amp.Msg
+}
+
+func newState() *state {
+	return &state{
+		subs:   make(map[string]byte),
+		sent:   make(map[string]int64),
+		inQoS2: make(map[uint16]bool),
+	}
+}
+
+func (s *state) attach(c *client) {
+	s.Lock()
+	defer s.Unlock()
+	s.owner = c
+}
+
+func (s *state) detach(c *client, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	if s.owner == c {
+		s.owner = nil
+		s.disconnected = now
+	}
+}
+
+func (s *state) expired(now time.Time, expiry time.Duration) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.owner == nil && now.Sub(s.disconnected) > expiry
+}
+
+func (s *state) subscribe(uri string, qos byte) {
+	s.Lock()
+	defer s.Unlock()
+	s.subs[uri] = qos
+}
+
+func (s *state) unsubscribe(uri string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.subs, uri)
+	delete(s.sent, uri)
+}
+
+// topics returns broker subscriptions.
+// QoS 1 subscriptions continue after the last sent message, unacknowledged
+// are retransmitted from the session.
+func (s *state) topics() map[string]int64 {
+	s.Lock()
+	defer s.Unlock()
+	topics := make(map[string]int64, len(s.subs))
+	for uri, qos := range s.subs {
+		var ts int64
+		if qos > 0 {
+			ts = s.sent[uri]
+		}
+		topics[uri] = ts
+	}
+	return topics
+}
+
+// subscription returns subscribed uri and qos of the message uri
+func (s *state) subscription(uri string) (string, byte) {
+	s.Lock()
+	defer s.Unlock()
+	if qos, ok := s.subs[uri]; ok {
+		return uri, qos
+	}
+	uri = topicOf(uri)
+	return uri, s.subs[uri]
+}
+
+// track stores QoS 1 message of the subscription uri sent by the client c,
+// returns its packet id
+func (s *state) track(c *client, uri string, m *amp.Msg, max int) (uint16, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.owner != c {
+		return 0, errors.New("session taken over by other connection")
+	}
+	if len(s.inflight) >= max {
+		return 0, errors.Errorf("%d messages not acknowledged", len(s.inflight))
+	}
+	id := s.packetID()
+	s.inflight = append(s.inflight, inflight{id: id, msg: m})
+	if m.Ts > s.sent[uri] {
+		s.sent[uri] = m.Ts
+	}
+	return id, nil
+}
+
+// packetID returns next packet id not used by the inflight messages.
+// Should be called during s.Lock.
+func (s *state) packetID() uint16 {
+	for {
+		s.nextID++
+		if s.nextID == 0 {
+			continue
+		}
+		used := false
+		for _, f := range s.inflight {
+			if f.id == s.nextID {
+				used = true
+				break
+			}
+		}
+		if !used {
+			return s.nextID
+		}
+	}
+}
+
+// ack removes acknowledged message from inflight
+func (s *state) ack(id uint16) {
+	s.Lock()
+	defer s.Unlock()
+	for i, f := range s.inflight {
+		if f.id == id {
+			s.inflight = append(s.inflight[:i:i], s.inflight[i+1:]...)
+			return
+		}
+	}
+}
+
+// unacked returns inflight messages in send order
+func (s *state) unacked() []inflight {
+	s.Lock()
+	defer s.Unlock()
+	return append([]inflight(nil), s.inflight...)
+}
+
+// seenQoS2 marks QoS 2 packet id as received, returns true for duplicates
+func (s *state) seenQoS2(id uint16) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.inQoS2[id] {
+		return true
+	}
+	s.inQoS2[id] = true
+	return false
+}
+
+func (s *state) releaseQoS2(id uint16) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.inQoS2, id)
+}
+
+// Bridge serves MQTT clients.
+type Bridge struct {
+	broker   broker
+	publish  func(*amp.Msg)
+	opts     options
+	sessions map[string]*state  // persistent sessions by client id
+	clients  map[string]*client // connected clients by client id
+	sync.Mutex
+}
+
+// New creates bridge. Outgoing messages are taken from the broker,
+// inbound are sent to publish.
+func New(brk broker, publish func(*amp.Msg), opts ...func(*options)) *Bridge {
+	o := options{
+		topics:    make(map[string]bool),
+		inbound:   make(map[string]bool),
+		maxPacket: 256 * 1024,
+		queueSize: 256,
+		expiry:    time.Hour,
+	}
+	for _, f := range opts {
+		f(&o)
+	}
+	return &Bridge{
+		broker:   brk,
+		publish:  publish,
+		opts:     o,
+		sessions: make(map[string]*state),
+		clients:  make(map[string]*client),
+	}
+}
+
+// Listen accepts connections, blocks until ctx is done.
+// Then stops listening for new connections, and waits for current to finish.
+func (b *Bridge) Listen(ctx context.Context, ln net.Listener) {
+	go func() {
+		t := time.NewTicker(b.opts.expiry / 10)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				b.expire(time.Now())
+			case <-ctx.Done():
+				_ = ln.Close()
+				b.Lock()
+				for _, c := range b.clients {
+					c.close()
+				}
+				b.Unlock()
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.serve(nc)
+		}()
+	}
+	wg.Wait()
+}
+
+func (b *Bridge) serve(nc net.Conn) {
+	c := &client{
+		b:      b,
+		conn:   nc,
+		r:      bufio.NewReader(nc),
+		out:    make(chan *amp.Msg, b.opts.queueSize),
+		closed: make(chan struct{}),
+	}
+	if err := c.connect(); err != nil {
+		log.S("remote", nc.RemoteAddr().String()).Error(err)
+		_ = nc.Close()
+		return
+	}
+	metric.Counter("mqtt.connect")
+	defer b.disconnect(c)
+	go c.writeLoop()
+	if err := c.readLoop(); err != nil && errors.Cause(err) != errDisconnect {
+		log.S("client", c.id).Info(err.Error())
+	}
+}
+
+// attach registers connected client, returns its persistent session state
+func (b *Bridge) attach(c *client, clean bool) (*state, bool) {
+	b.Lock()
+	defer b.Unlock()
+	if o, ok := b.clients[c.id]; ok {
+		o.close() // client with the same id is disconnected
+	}
+	b.clients[c.id] = c
+	s, ok := b.sessions[c.id]
+	if clean || !ok {
+		s = newState()
+		ok = false
+	}
+	if clean {
+		delete(b.sessions, c.id)
+	} else {
+		b.sessions[c.id] = s
+	}
+	s.attach(c)
+	return s, ok
+}
+
+func (b *Bridge) disconnect(c *client) {
+	b.broker.Unsubscribe(c)
+	c.close()
+	b.Lock()
+	if b.clients[c.id] == c {
+		delete(b.clients, c.id)
+	}
+	b.Unlock()
+	c.state.detach(c, time.Now())
+}
+
+// expire removes persistent sessions of the clients disconnected longer
+// than session expiry
+func (b *Bridge) expire(now time.Time) {
+	b.Lock()
+	defer b.Unlock()
+	n := 0
+	for id, s := range b.sessions {
+		if s.expired(now, b.opts.expiry) {
+			delete(b.sessions, id)
+			n++
+		}
+	}
+	if n > 0 {
+		metric.Counter("mqtt.expired", n)
+	}
+}
+
+func (b *Bridge) exposed(topic string) bool {
+	return len(b.opts.topics) == 0 || b.opts.topics[topic]
+}
+
+// filterURI maps MQTT topic filter to amp uri
+func filterURI(filter string) (string, bool) {
+	if strings.Contains(filter, "+") {
+		return "", false
+	}
+	if strings.HasSuffix(filter, "/#") {
+		filter = strings.TrimSuffix(filter, "/#")
+		if strings.Contains(filter, "/") {
+			return "", false // only whole topic wildcard is supported
+		}
+	}
+	if filter == "" || strings.Contains(filter, "#") {
+		return "", false
+	}
+	return filter, true
+}
+
+func topicOf(uri string) string {
+	return strings.SplitN(uri, "/", 2)[0]
+}
+
+var errDisconnect = errors.New("disconnect")
+
+// client is connected MQTT client, subscriber of the broker
+type client struct {
+	b         *Bridge
+	conn      net.Conn
+	r         *bufio.Reader
+	id        string
+	keepAlive time.Duration
+	state     *state
+	out       chan *amp.Msg
+	closed    chan struct{}
+	once      sync.Once
+	wLock     sync.Mutex
+}
+
+func (c *client) connect() error {
+	_ = c.conn.SetReadDeadline(time.Now().Add(connectTimeout))
+	p, err := readPacket(c.r, c.b.opts.maxPacket)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if p.typ != connect {
+		return errors.Errorf("expected connect packet, got %d", p.typ)
+	}
+	cp, err := decodeConnect(p)
+	if err != nil {
+		return err
+	}
+	if cp.protocol != "MQTT" || cp.level != protocolLevel {
+		_ = c.write(encodeConnack(false, badProtocol))
+		return errors.Errorf("unsupported protocol %s %d", cp.protocol, cp.level)
+	}
+	if a := c.b.opts.auth; a != nil && !a(cp.clientID, cp.username, cp.password) {
+		_ = c.write(encodeConnack(false, badCredentials))
+		return errors.Errorf("client %s not authorized", cp.clientID)
+	}
+	c.id = cp.clientID
+	if c.id == "" {
+		c.id = c.conn.RemoteAddr().String()
+		cp.cleanSession = true
+	}
+	// client must send some packet within 1.5 keep alive interval
+	c.keepAlive = time.Duration(cp.keepAlive) * 1500 * time.Millisecond
+	_ = c.conn.SetReadDeadline(time.Time{})
+	s, present := c.b.attach(c, cp.cleanSession)
+	c.state = s
+	if err := c.write(encodeConnack(present, accepted)); err != nil {
+		return err
+	}
+	if present {
+		if err := c.retransmit(); err != nil {
+			return err
+		}
+		c.resubscribe()
+	}
+	return nil
+}
+
+// retransmit sends unacknowledged messages of the persistent session with
+// the original packet ids, before any new message
+func (c *client) retransmit() error {
+	for _, f := range c.state.unacked() {
+		pp := &publishPacket{topic: f.msg.URI, id: f.id, qos: 1, dup: true, payload: f.msg.BodyBytes()}
+		if err := c.write(pp.encode()); err != nil {
+			return err
+		}
+		metric.Counter("mqtt.retransmit")
+	}
+	return nil
+}
+
+func (c *client) readLoop() error {
+	for {
+		if c.keepAlive > 0 {
+			_ = c.conn.SetReadDeadline(time.Now().Add(c.keepAlive))
+		}
+		p, err := readPacket(c.r, c.b.opts.maxPacket)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if err := c.handle(p); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *client) handle(p *packet) error {
+	switch p.typ {
+	case publish:
+		return c.onPublish(p)
+	case puback:
+		id, err := decodeID(p)
+		if err != nil {
+			return err
+		}
+		c.state.ack(id)
+	case pubrel:
+		id, err := decodeID(p)
+		if err != nil {
+			return err
+		}
+		c.state.releaseQoS2(id)
+		return c.write(encodeAck(pubcomp, id))
+	case subscribe:
+		return c.onSubscribe(p)
+	case unsubscribe:
+		return c.onUnsubscribe(p)
+	case pingreq:
+		return c.write((&packet{typ: pingresp}).encode())
+	case disconnect:
+		return errDisconnect
+	default:
+		return errors.Errorf("unexpected packet type %d", p.typ)
+	}
+	return nil
+}
+
+// onPublish publishes inbound message into amp
+func (c *client) onPublish(p *packet) error {
+	pp, err := decodePublish(p)
+	if err != nil {
+		return err
+	}
+	parts := strings.SplitN(pp.topic, "/", 2)
+	if !c.b.opts.inbound[parts[0]] {
+		// MQTT 3.1.1 has no negative ack, message is dropped
+		metric.Counter("mqtt.inbound.rejected")
+		log.S("client", c.id).S("topic", pp.topic).Info("publish into not allowed topic")
+	} else if pp.qos < 2 || !c.state.seenQoS2(pp.id) {
+		path := ""
+		if len(parts) > 1 {
+			path = parts[1]
+		}
+		var m *amp.Msg
+		if json.Valid(pp.payload) {
+			m = amp.NewPublish(parts[0], path, amp.TS(), c.b.opts.updateType, json.RawMessage(pp.payload))
+		} else {
+			m = amp.NewPublishBinary(parts[0], path, amp.TS(), c.b.opts.updateType, pp.payload, "")
+		}
+		m.Meta = map[string]string{"mqttClient": c.id}
+		c.b.publish(m)
+		metric.Counter("mqtt.inbound")
+	}
+	switch pp.qos {
+	case 1:
+		return c.write(encodeAck(puback, pp.id))
+	case 2:
+		return c.write(encodeAck(pubrec, pp.id))
+	}
+	return nil
+}
+
+func (c *client) onSubscribe(p *packet) error {
+	id, subs, err := decodeSubscribe(p)
+	if err != nil {
+		return err
+	}
+	codes := make([]byte, len(subs))
+	for i, s := range subs {
+		uri, ok := filterURI(s.filter)
+		if !ok || !c.b.exposed(topicOf(uri)) {
+			codes[i] = subscribeFailure
+			continue
+		}
+		qos := s.qos
+		if qos > 1 {
+			qos = 1
+		}
+		c.state.subscribe(uri, qos)
+		codes[i] = qos
+	}
+	if err := c.write(encodeSuback(id, codes)); err != nil {
+		return err
+	}
+	c.resubscribe()
+	return nil
+}
+
+func (c *client) onUnsubscribe(p *packet) error {
+	id, filters, err := decodeUnsubscribe(p)
+	if err != nil {
+		return err
+	}
+	for _, f := range filters {
+		if uri, ok := filterURI(f); ok {
+			c.state.unsubscribe(uri)
+		}
+	}
+	c.resubscribe()
+	return c.write(encodeAck(unsuback, id))
+}
+
+// resubscribe sends complete set of subscriptions to the broker
+func (c *client) resubscribe() {
+	c.b.broker.Subscribe(c, c.state.topics())
+}
+
+// Send implements amp.Subscriber interface.
+func (c *client) Send(m *amp.Msg) {
+	if m.Type != amp.Publish {
+		return
+	}
+	select {
+	case c.out <- m:
+	case <-c.closed:
+	default:
+		// slow client, persistent session will continue from the last sent
+		metric.Counter("mqtt.slow")
+		log.S("client", c.id).Info("disconnecting slow client")
+		c.close()
+	}
+}
+
+func (c *client) writeLoop() {
+	for {
+		select {
+		case m := <-c.out:
+			if err := c.send(m); err != nil {
+				c.close()
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *client) send(m *amp.Msg) error {
+	uri, qos := c.state.subscription(m.URI)
+	pp := &publishPacket{topic: m.URI, qos: qos, payload: m.BodyBytes()}
+	if qos > 0 {
+		id, err := c.state.track(c, uri, m, c.b.opts.queueSize)
+		if err != nil {
+			log.S("client", c.id).Info(err.Error())
+			return err
+		}
+		pp.id = id
+	}
+	metric.Counter("mqtt.outbound")
+	return c.write(pp.encode())
+}
+
+func (c *client) write(buf []byte) error {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+	_, err := c.conn.Write(buf)
+	return errors.WithStack(err)
+}
+
+func (c *client) close() {
+	c.once.Do(func() {
+		close(c.closed)
+		_ = c.conn.Close()
+	})
+}
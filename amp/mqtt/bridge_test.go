@@ -0,0 +1,217 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	ampBroker "github.com/minus5/svckit/amp/broker"
+	"github.com/stretchr/testify/assert"
+)
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, addr, id string, clean bool) (*testClient, bool) {
+	conn, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	c := &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	var flags byte
+	if clean {
+		flags = 0x02
+	}
+	body := appendString(nil, "MQTT")
+	body = append(body, protocolLevel, flags)
+	body = appendUint16(body, 60)
+	body = appendString(body, id)
+	c.write((&packet{typ: connect, body: body}).encode())
+	p := c.read()
+	assert.Equal(t, connack, p.typ)
+	assert.Equal(t, accepted, p.body[1])
+	return c, p.body[0] == 1
+}
+
+func (c *testClient) write(buf []byte) {
+	_, err := c.conn.Write(buf)
+	assert.Nil(c.t, err)
+}
+
+func (c *testClient) read() *packet {
+	_ = c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	p, err := readPacket(c.r, 1024)
+	assert.Nil(c.t, err)
+	return p
+}
+
+func (c *testClient) readPublish() *publishPacket {
+	p := c.read()
+	assert.Equal(c.t, publish, p.typ)
+	pp, err := decodePublish(p)
+	assert.Nil(c.t, err)
+	return pp
+}
+
+func (c *testClient) subscribe(filters ...subscription) []byte {
+	body := appendUint16(nil, 1)
+	for _, f := range filters {
+		body = append(appendString(body, f.filter), f.qos)
+	}
+	c.write((&packet{typ: subscribe, flags: 2, body: body}).encode())
+	p := c.read()
+	assert.Equal(c.t, suback, p.typ)
+	return p.body[2:]
+}
+
+func TestBridge(t *testing.T) {
+	brk := ampBroker.New(nil)
+	var published []*amp.Msg
+	var lock sync.Mutex
+	b := New(brk, func(m *amp.Msg) {
+		lock.Lock()
+		defer lock.Unlock()
+		published = append(published, m)
+	}, Topics("odds"), Inbound("telemetry"))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		b.Listen(ctx, ln)
+		close(done)
+	}()
+	addr := ln.Addr().String()
+
+	brk.Publish(amp.NewPublish("odds", "", 1, amp.Full, map[string]int{"v": 1}))
+	c, present := dial(t, addr, "dev1", false)
+	assert.False(t, present)
+	codes := c.subscribe(subscription{"odds/#", 2}, subscription{"secret/#", 0}, subscription{"odds/+/x", 0})
+	assert.Equal(t, []byte{1, subscribeFailure, subscribeFailure}, codes)
+
+	pp := c.readPublish()
+	assert.Equal(t, "odds", pp.topic)
+	assert.Equal(t, byte(1), pp.qos)
+	assert.Equal(t, `{"v":1}`, string(pp.payload))
+	c.write(encodeAck(puback, pp.id))
+
+	brk.Publish(amp.NewPublish("odds", "", 2, amp.Diff, map[string]int{"v": 2}))
+	pp = c.readPublish()
+	assert.Equal(t, `{"v":2}`, string(pp.payload))
+	c.write(encodeAck(puback, pp.id))
+	brk.Publish(amp.NewPublish("odds", "", 3, amp.Diff, map[string]int{"v": 3}))
+	pp = c.readPublish() // not acknowledged
+	assert.Equal(t, `{"v":3}`, string(pp.payload))
+	unacked := pp.id
+	c.write((&packet{typ: pingreq}).encode())
+	assert.Equal(t, pingresp, c.read().typ)
+	c.write((&packet{typ: disconnect}).encode())
+	c.conn.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	// unacknowledged message is retransmitted, missed are replayed after it
+	brk.Publish(amp.NewPublish("odds", "", 4, amp.Diff, map[string]int{"v": 4}))
+	time.Sleep(10 * time.Millisecond)
+	c, present = dial(t, addr, "dev1", false)
+	assert.True(t, present)
+	pp = c.readPublish()
+	assert.Equal(t, `{"v":3}`, string(pp.payload))
+	assert.Equal(t, unacked, pp.id)
+	assert.True(t, pp.dup)
+	pp = c.readPublish()
+	assert.Equal(t, `{"v":4}`, string(pp.payload))
+	assert.False(t, pp.dup)
+	c.write(encodeAck(puback, pp.id))
+	c.write(encodeAck(puback, unacked))
+
+	// inbound publishes
+	c.write((&publishPacket{topic: "telemetry/dev1", qos: 1, id: 5, payload: []byte(`{"t":20}`)}).encode())
+	p := c.read()
+	assert.Equal(t, puback, p.typ)
+	c.write((&publishPacket{topic: "odds/x", qos: 0, payload: []byte(`{}`)}).encode()) // not allowed
+	// duplicate QoS 2 publish is published once
+	for i := 0; i < 2; i++ {
+		c.write((&publishPacket{topic: "telemetry/dev1", qos: 2, id: 6, payload: []byte("raw")}).encode())
+		assert.Equal(t, pubrec, c.read().typ)
+	}
+	c.write(encodeAck(pubrel, 6))
+	assert.Equal(t, pubcomp, c.read().typ)
+
+	lock.Lock()
+	assert.Len(t, published, 2)
+	assert.Equal(t, "telemetry/dev1", published[0].URI)
+	assert.Equal(t, `{"t":20}`, string(published[0].BodyBytes()))
+	assert.Equal(t, "dev1", published[0].Meta["mqttClient"])
+	assert.True(t, published[1].IsBinary())
+	lock.Unlock()
+
+	// clean session starts without subscriptions
+	c.conn.Close()
+	c, present = dial(t, addr, "dev1", true)
+	assert.False(t, present)
+	c.conn.Close()
+
+	cancel()
+	<-done
+}
+
+func TestBridgeAck(t *testing.T) {
+	brk := ampBroker.New(nil)
+	b := New(brk, func(*amp.Msg) {}, SessionExpiry(time.Minute))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		b.Listen(ctx, ln)
+		close(done)
+	}()
+	addr := ln.Addr().String()
+
+	brk.Publish(amp.NewPublish("odds", "", 1, amp.Full, map[string]int{"v": 1}))
+	c, _ := dial(t, addr, "dev1", false)
+	c.subscribe(subscription{"odds", 1})
+	pp1 := c.readPublish()
+	brk.Publish(amp.NewPublish("odds", "", 2, amp.Diff, map[string]int{"v": 2}))
+	pp2 := c.readPublish()
+	assert.NotEqual(t, pp1.id, pp2.id)
+	// later message acknowledged, earlier is still inflight
+	c.write(encodeAck(puback, pp2.id))
+	c.write((&packet{typ: disconnect}).encode())
+	c.conn.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	c, present := dial(t, addr, "dev1", false)
+	assert.True(t, present)
+	pp := c.readPublish()
+	assert.Equal(t, pp1.id, pp.id)
+	assert.Equal(t, `{"v":1}`, string(pp.payload))
+	c.write(encodeAck(puback, pp.id))
+	// nothing else is sent
+	_ = c.conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err = readPacket(c.r, 1024)
+	assert.NotNil(t, err)
+	c.conn.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	// session of the disconnected client expires
+	b.expire(time.Now())
+	b.Lock()
+	assert.Len(t, b.sessions, 1)
+	b.Unlock()
+	b.expire(time.Now().Add(2 * time.Minute))
+	b.Lock()
+	assert.Len(t, b.sessions, 0)
+	b.Unlock()
+	c, present = dial(t, addr, "dev1", false)
+	assert.False(t, present)
+	c.conn.Close()
+
+	cancel()
+	<-done
+}
@@ -0,0 +1,284 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// MQTT 3.1.1 control packet types
+const (
+	connect     byte = 1
+	connack     byte = 2
+	publish     byte = 3
+	puback      byte = 4
+	pubrec      byte = 5
+	pubrel      byte = 6
+	pubcomp     byte = 7
+	subscribe   byte = 8
+	suback      byte = 9
+	unsubscribe byte = 10
+	unsuback    byte = 11
+	pingreq     byte = 12
+	pingresp    byte = 13
+	disconnect  byte = 14
+)
+
+// connack and suback return codes
+const (
+	accepted         byte = 0
+	badProtocol      byte = 1
+	badCredentials   byte = 4
+	subscribeFailure byte = 0x80
+)
+
+// max number of bytes of the remaining length field
+const maxRemainingBytes = 4
+
+var (
+	errMalformed   = errors.New("malformed packet")
+	errPacketLarge = errors.New("packet too large")
+)
+
+// packet is MQTT control packet.
+type packet struct {
+	typ   byte
+	flags byte // lower 4 bits of the fixed header
+	body  []byte
+}
+
+func (p *packet) qos() byte {
+	return (p.flags >> 1) & 3
+}
+
+func readPacket(r *bufio.Reader, maxSize int) (*packet, error) {
+	h, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	l, mul := 0, 1
+	for i := 0; ; i++ {
+		if i == maxRemainingBytes {
+			return nil, errMalformed
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		l += int(b&127) * mul
+		mul *= 128
+		if b&128 == 0 {
+			break
+		}
+	}
+	if l > maxSize {
+		return nil, errors.Wrapf(errPacketLarge, "%d bytes", l)
+	}
+	p := &packet{typ: h >> 4, flags: h & 15, body: make([]byte, l)}
+	if _, err := io.ReadFull(r, p.body); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *packet) encode() []byte {
+	buf := []byte{p.typ<<4 | p.flags}
+	l := len(p.body)
+	for {
+		b := byte(l % 128)
+		l /= 128
+		if l > 0 {
+			b |= 128
+		}
+		buf = append(buf, b)
+		if l == 0 {
+			break
+		}
+	}
+	return append(buf, p.body...)
+}
+
+// reader reads fields from the packet body
+type reader struct {
+	buf []byte
+	err error
+}
+
+func (r *reader) byte() byte {
+	if r.err != nil || len(r.buf) < 1 {
+		r.err = errMalformed
+		return 0
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b
+}
+
+func (r *reader) uint16() uint16 {
+	if r.err != nil || len(r.buf) < 2 {
+		r.err = errMalformed
+		return 0
+	}
+	v := binary.BigEndian.Uint16(r.buf)
+	r.buf = r.buf[2:]
+	return v
+}
+
+func (r *reader) bytes() []byte {
+	l := int(r.uint16())
+	if r.err != nil || len(r.buf) < l {
+		r.err = errMalformed
+		return nil
+	}
+	b := r.buf[:l]
+	r.buf = r.buf[l:]
+	return b
+}
+
+func (r *reader) string() string {
+	return string(r.bytes())
+}
+
+func (r *reader) empty() bool {
+	return len(r.buf) == 0
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
+
+func appendString(buf []byte, s string) []byte {
+	return append(appendUint16(buf, uint16(len(s))), s...)
+}
+
+// connectPacket is decoded CONNECT packet
+type connectPacket struct {
+	protocol     string
+	level        byte
+	cleanSession bool
+	keepAlive    uint16
+	clientID     string
+	username     string
+	password     string
+}
+
+func decodeConnect(p *packet) (*connectPacket, error) {
+	r := &reader{buf: p.body}
+	c := &connectPacket{
+		protocol: r.string(),
+		level:    r.byte(),
+	}
+	flags := r.byte()
+	c.cleanSession = flags&0x02 != 0
+	c.keepAlive = r.uint16()
+	c.clientID = r.string()
+	if flags&0x04 != 0 { // will
+		r.string()
+		r.bytes()
+	}
+	if flags&0x80 != 0 {
+		c.username = r.string()
+	}
+	if flags&0x40 != 0 {
+		c.password = r.string()
+	}
+	return c, errors.WithStack(r.err)
+}
+
+func encodeConnack(sessionPresent bool, code byte) []byte {
+	var sp byte
+	if sessionPresent {
+		sp = 1
+	}
+	return (&packet{typ: connack, body: []byte{sp, code}}).encode()
+}
+
+// publishPacket is decoded PUBLISH packet
+type publishPacket struct {
+	topic    string
+	id       uint16
+	qos      byte
+	payload  []byte
+	dup      bool
+	retained bool
+}
+
+func decodePublish(p *packet) (*publishPacket, error) {
+	r := &reader{buf: p.body}
+	pp := &publishPacket{
+		topic:    r.string(),
+		qos:      p.qos(),
+		dup:      p.flags&0x08 != 0,
+		retained: p.flags&0x01 != 0,
+	}
+	if pp.qos > 0 {
+		pp.id = r.uint16()
+	}
+	pp.payload = r.buf
+	return pp, errors.WithStack(r.err)
+}
+
+func (pp *publishPacket) encode() []byte {
+	flags := pp.qos << 1
+	if pp.dup {
+		flags |= 0x08
+	}
+	if pp.retained {
+		flags |= 0x01
+	}
+	body := appendString(nil, pp.topic)
+	if pp.qos > 0 {
+		body = appendUint16(body, pp.id)
+	}
+	return (&packet{typ: publish, flags: flags, body: append(body, pp.payload...)}).encode()
+}
+
+// encodeAck encodes PUBACK, PUBREC, PUBREL, PUBCOMP and UNSUBACK packets
+func encodeAck(typ byte, id uint16) []byte {
+	var flags byte
+	if typ == pubrel {
+		flags = 2
+	}
+	return (&packet{typ: typ, flags: flags, body: appendUint16(nil, id)}).encode()
+}
+
+func decodeID(p *packet) (uint16, error) {
+	r := &reader{buf: p.body}
+	id := r.uint16()
+	return id, errors.WithStack(r.err)
+}
+
+// subscription is topic filter with requested qos
+type subscription struct {
+	filter string
+	qos    byte
+}
+
+func decodeSubscribe(p *packet) (uint16, []subscription, error) {
+	r := &reader{buf: p.body}
+	id := r.uint16()
+	var subs []subscription
+	for !r.empty() && r.err == nil {
+		subs = append(subs, subscription{filter: r.string(), qos: r.byte()})
+	}
+	if len(subs) == 0 && r.err == nil {
+		r.err = errMalformed
+	}
+	return id, subs, errors.WithStack(r.err)
+}
+
+func encodeSuback(id uint16, codes []byte) []byte {
+	return (&packet{typ: suback, body: append(appendUint16(nil, id), codes...)}).encode()
+}
+
+func decodeUnsubscribe(p *packet) (uint16, []string, error) {
+	r := &reader{buf: p.body}
+	id := r.uint16()
+	var filters []string
+	for !r.empty() && r.err == nil {
+		filters = append(filters, r.string())
+	}
+	return id, filters, errors.WithStack(r.err)
+}
@@ -0,0 +1,201 @@
+// Package mux keeps single upstream subscription per topic for many clients.
+//
+// Gateway with thousands of clients subscribed to the same topics
+// subscribes upstream (nsq) to the topic once, when the first client
+// subscribes, and unsubscribes when the last client leaves.
+// Messages from upstream are published to the broker which delivers them
+// to the clients:
+//
+//	b := broker.New(requester.Current)
+//	m := mux.New(ctx, b, func(ctx context.Context, topic string) <-chan *amp.Msg {
+//		return nsq.Subscribe(ctx, []string{topic})
+//	})
+//	sessions := session.Factory(ctx, m, requester)
+//
+// With Announce gateway publishes needed topics to the amp.DemandTopic,
+// so producers could generate data only for the watched topics.
+package mux
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+)
+
+// Upstream subscribes to the topic until ctx is done.
+type Upstream func(ctx context.Context, topic string) <-chan *amp.Msg
+
+type broker interface {
+	Subscribe(amp.Subscriber, map[string]int64)
+	Unsubscribe(amp.Subscriber)
+	Backfill(amp.Subscriber, *amp.Msg)
+	Publish(*amp.Msg)
+}
+
+type upstream struct {
+	refs   int
+	cancel func()
+}
+
+// Mux reference counts client subscriptions and manages upstream
+// subscriptions. Implements broker interface of the session package.
+type Mux struct {
+	ctx       context.Context
+	broker    broker
+	subscribe Upstream
+	upstreams map[string]*upstream
+	clients   map[amp.Subscriber]map[string]struct{}
+	changed   chan struct{} // signal that upstream topics are changed
+	wg        sync.WaitGroup
+	sync.Mutex
+}
+
+// New creates subscription multiplexer.
+func New(ctx context.Context, b broker, up Upstream) *Mux {
+	return &Mux{
+		ctx:       ctx,
+		broker:    b,
+		subscribe: up,
+		upstreams: make(map[string]*upstream),
+		clients:   make(map[amp.Subscriber]map[string]struct{}),
+		changed:   make(chan struct{}, 1),
+	}
+}
+
+// Subscribe sets client topics, topics are complete list of client
+// subscriptions (same as in the broker).
+func (x *Mux) Subscribe(c amp.Subscriber, topics map[string]int64) {
+	x.Lock()
+	old := x.clients[c]
+	current := make(map[string]struct{}, len(topics))
+	for t := range topics {
+		current[t] = struct{}{}
+		if _, ok := old[t]; !ok {
+			x.acquire(t)
+		}
+	}
+	for t := range old {
+		if _, ok := current[t]; !ok {
+			x.release(t)
+		}
+	}
+	x.clients[c] = current
+	x.Unlock()
+
+	x.broker.Subscribe(c, topics)
+}
+
+// Unsubscribe removes client from all topics.
+func (x *Mux) Unsubscribe(c amp.Subscriber) {
+	x.broker.Unsubscribe(c)
+
+	x.Lock()
+	defer x.Unlock()
+	for t := range x.clients[c] {
+		x.release(t)
+	}
+	delete(x.clients, c)
+}
+
+// Backfill passes backfill request to the broker.
+func (x *Mux) Backfill(c amp.Subscriber, m *amp.Msg) {
+	x.broker.Backfill(c, m)
+}
+
+// Refs returns number of clients subscribed to the topic.
+func (x *Mux) Refs(topic string) int {
+	x.Lock()
+	defer x.Unlock()
+	if u, ok := x.upstreams[topic]; ok {
+		return u.refs
+	}
+	return 0
+}
+
+// Topics returns topics with upstream subscription.
+func (x *Mux) Topics() []string {
+	x.Lock()
+	defer x.Unlock()
+	topics := make([]string, 0, len(x.upstreams))
+	for t := range x.upstreams {
+		topics = append(topics, t)
+	}
+	return topics
+}
+
+// Announce publishes gateway topics to the amp.DemandTopic every interval
+// and on each change, until ctx is done.
+// Interval should be shorter than ttl of the producers amp.Demand.
+func (x *Mux) Announce(gateway string, interval time.Duration, publish func(*amp.Msg)) {
+	x.wg.Add(1)
+	go func() {
+		defer x.wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			publish(amp.NewDemandAnnounce(gateway, x.Topics()))
+			select {
+			case <-t.C:
+			case <-x.changed:
+			case <-x.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Wait waits until all upstream subscriptions are finished,
+// after ctx is done.
+func (x *Mux) Wait() {
+	<-x.ctx.Done()
+	x.wg.Wait()
+}
+
+// acquire adds client reference to the topic, subscribes upstream on first
+func (x *Mux) acquire(topic string) {
+	if u, ok := x.upstreams[topic]; ok {
+		u.refs++
+		return
+	}
+	ctx, cancel := context.WithCancel(x.ctx)
+	x.upstreams[topic] = &upstream{refs: 1, cancel: cancel}
+	in := x.subscribe(ctx, topic)
+	x.wg.Add(1)
+	go func() {
+		defer x.wg.Done()
+		for m := range in {
+			x.broker.Publish(m)
+		}
+	}()
+	x.signalChanged()
+	log.S("topic", topic).Debug("upstream subscribe")
+	metric.Gauge("mux.upstreams", len(x.upstreams))
+}
+
+// release removes client reference, unsubscribes upstream on last
+func (x *Mux) release(topic string) {
+	u, ok := x.upstreams[topic]
+	if !ok {
+		return
+	}
+	u.refs--
+	if u.refs > 0 {
+		return
+	}
+	u.cancel()
+	delete(x.upstreams, topic)
+	x.signalChanged()
+	log.S("topic", topic).Debug("upstream unsubscribe")
+	metric.Gauge("mux.upstreams", len(x.upstreams))
+}
+
+func (x *Mux) signalChanged() {
+	select {
+	case x.changed <- struct{}{}:
+	default:
+	}
+}
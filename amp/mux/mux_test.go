@@ -0,0 +1,110 @@
+package mux
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+type testBroker struct {
+	msgs []*amp.Msg
+	sync.Mutex
+}
+
+func (b *testBroker) Subscribe(amp.Subscriber, map[string]int64) {}
+func (b *testBroker) Unsubscribe(amp.Subscriber)                 {}
+func (b *testBroker) Backfill(amp.Subscriber, *amp.Msg)          {}
+func (b *testBroker) Publish(m *amp.Msg) {
+	b.Lock()
+	defer b.Unlock()
+	b.msgs = append(b.msgs, m)
+}
+
+type testClient struct{ no int }
+
+func (c *testClient) Send(*amp.Msg) {}
+
+func TestMux(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var lock sync.Mutex
+	active := make(map[string]chan *amp.Msg)
+	subscribed := 0
+	up := func(ctx context.Context, topic string) <-chan *amp.Msg {
+		ch := make(chan *amp.Msg, 1)
+		lock.Lock()
+		active[topic] = ch
+		subscribed++
+		lock.Unlock()
+		go func() {
+			<-ctx.Done()
+			lock.Lock()
+			delete(active, topic)
+			lock.Unlock()
+			close(ch)
+		}()
+		return ch
+	}
+	b := &testBroker{}
+	x := New(ctx, b, up)
+	c1, c2 := &testClient{no: 1}, &testClient{no: 2}
+
+	x.Subscribe(c1, map[string]int64{"a": 0, "b": 0})
+	x.Subscribe(c2, map[string]int64{"a": 0})
+	assert.Equal(t, 2, x.Refs("a"))
+	assert.Equal(t, 1, x.Refs("b"))
+	assert.Equal(t, 2, subscribed)
+
+	lock.Lock()
+	active["a"] <- amp.NewPublish("a", "", 1, amp.Full, nil)
+	lock.Unlock()
+
+	// c1 leaves b
+	x.Subscribe(c1, map[string]int64{"a": 0})
+	assert.Equal(t, 0, x.Refs("b"))
+	x.Unsubscribe(c1)
+	assert.Equal(t, 1, x.Refs("a"))
+	x.Unsubscribe(c2)
+	assert.Equal(t, 0, x.Refs("a"))
+
+	time.Sleep(10 * time.Millisecond)
+	lock.Lock()
+	assert.Len(t, active, 0)
+	lock.Unlock()
+	b.Lock()
+	assert.Len(t, b.msgs, 1)
+	b.Unlock()
+
+	cancel()
+	x.Wait()
+}
+
+func TestAnnounce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	up := func(ctx context.Context, topic string) <-chan *amp.Msg {
+		ch := make(chan *amp.Msg)
+		go func() {
+			<-ctx.Done()
+			close(ch)
+		}()
+		return ch
+	}
+	x := New(ctx, &testBroker{}, up)
+	announced := make(chan *amp.Msg, 16)
+	x.Announce("gw1", time.Hour, func(m *amp.Msg) { announced <- m })
+
+	m := <-announced
+	assert.Equal(t, amp.DemandTopic, m.URI)
+	assert.Len(t, m.Subscriptions, 0)
+
+	x.Subscribe(&testClient{no: 1}, map[string]int64{"a": 0})
+	m = <-announced
+	assert.Equal(t, "gw1", m.Meta["gateway"])
+	assert.Equal(t, map[string]int64{"a": 0}, m.Subscriptions)
+
+	cancel()
+	x.Wait()
+}
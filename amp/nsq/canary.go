@@ -0,0 +1,118 @@
+package nsq
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/dcy"
+	"github.com/minus5/svckit/log"
+	"github.com/pkg/errors"
+)
+
+// Canary routes percentage of requests for the topic to the canary topic
+// (for example from math.req to math.req.v2), rest goes to the original topic.
+type Canary struct {
+	routes map[string]canaryRoute
+	sync.RWMutex
+}
+
+type canaryRoute struct {
+	topic   string
+	percent int
+}
+
+// NewCanary creates empty canary routing table.
+func NewCanary() *Canary {
+	return &Canary{routes: make(map[string]canaryRoute)}
+}
+
+// Set routes percent of requests for the topic to the canaryTopic.
+// Percent 0 removes the route.
+func (c *Canary) Set(topic, canaryTopic string, percent int) {
+	c.Lock()
+	defer c.Unlock()
+	if percent <= 0 {
+		delete(c.routes, topic)
+		return
+	}
+	if percent > 100 {
+		percent = 100
+	}
+	c.routes[topic] = canaryRoute{topic: canaryTopic, percent: percent}
+}
+
+// Topic returns topic where the request should be sent.
+func (c *Canary) Topic(m *amp.Msg) string {
+	topic := m.Topic()
+	c.RLock()
+	r, ok := c.routes[topic]
+	c.RUnlock()
+	if ok && rand.Intn(100) < r.percent {
+		return r.topic
+	}
+	return topic
+}
+
+// LoadConsul replaces routes with those from Consul KV.
+// Under prefix key is original topic and value is 'canaryTopic:percent',
+// for example: math.req = math.req.v2:10
+func (c *Canary) LoadConsul(prefix string) error {
+	kvs, err := dcy.KVs(prefix)
+	if err == dcy.ErrKeyNotFound {
+		kvs = make(map[string]string)
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+	routes := make(map[string]canaryRoute)
+	for topic, v := range kvs {
+		if topic == "" {
+			continue
+		}
+		r, err := parseCanaryRoute(v)
+		if err != nil {
+			return errors.Wrapf(err, "canary route %s", topic)
+		}
+		if r.percent > 0 {
+			routes[topic] = r
+		}
+	}
+	c.Lock()
+	c.routes = routes
+	c.Unlock()
+	return nil
+}
+
+// WatchConsul reloads routes from Consul KV every interval until ctx is done.
+func (c *Canary) WatchConsul(ctx context.Context, prefix string, interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			if err := c.LoadConsul(prefix); err != nil {
+				log.S("prefix", prefix).Error(err)
+			}
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func parseCanaryRoute(v string) (canaryRoute, error) {
+	p := strings.LastIndex(v, ":")
+	if p <= 0 {
+		return canaryRoute{}, errors.Errorf("wrong format %q, expecting topic:percent", v)
+	}
+	percent, err := strconv.Atoi(strings.TrimSpace(v[p+1:]))
+	if err != nil || percent < 0 || percent > 100 {
+		return canaryRoute{}, errors.Errorf("wrong percent in %q", v)
+	}
+	return canaryRoute{topic: strings.TrimSpace(v[:p]), percent: percent}, nil
+}
@@ -0,0 +1,37 @@
+package nsq
+
+import (
+	"testing"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanary(t *testing.T) {
+	c := NewCanary()
+	m := &amp.Msg{URI: "math.req/add"}
+	assert.Equal(t, "math.req", c.Topic(m))
+
+	c.Set("math.req", "math.req.v2", 100)
+	assert.Equal(t, "math.req.v2", c.Topic(m))
+
+	c.Set("math.req", "math.req.v2", 30)
+	v2 := 0
+	for i := 0; i < 1000; i++ {
+		if c.Topic(m) == "math.req.v2" {
+			v2++
+		}
+	}
+	assert.InDelta(t, 300, v2, 100)
+
+	c.Set("math.req", "math.req.v2", 0)
+	assert.Equal(t, "math.req", c.Topic(m))
+
+	r, err := parseCanaryRoute("math.req.v2:10")
+	assert.Nil(t, err)
+	assert.Equal(t, canaryRoute{topic: "math.req.v2", percent: 10}, r)
+	_, err = parseCanaryRoute("math.req.v2")
+	assert.NotNil(t, err)
+	_, err = parseCanaryRoute("math.req.v2:101")
+	assert.NotNil(t, err)
+}
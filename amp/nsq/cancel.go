@@ -0,0 +1,166 @@
+package nsq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/env"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+	"github.com/minus5/svckit/nsq"
+	"github.com/pkg/errors"
+)
+
+// CancelTopic is the topic of the request cancel notices, published by
+// requesters and consumed by all responder instances (see CancelRequests).
+const CancelTopic = "z...cancel"
+
+// how long cancel notice is kept for the request which is not started yet
+const cancelledTTL = time.Minute
+
+// attemptKey is the request meta key with the attempt number of the hedged
+// request copy. Copies share correlation id (for Dedupe) and are cancelled
+// by attempt.
+const attemptKey = "attempt"
+
+// cancelNotice identifies request by requester responses topic,
+// correlation id and attempt of the hedged request
+type cancelNotice struct {
+	ReplyTo       string `json:"r"`
+	CorrelationID uint64 `json:"i"`
+	Attempt       string `json:"a,omitempty"`
+}
+
+func noticeOf(m *amp.Msg) cancelNotice {
+	return cancelNotice{ReplyTo: m.ReplyTo, CorrelationID: m.CorrelationID, Attempt: m.Meta[attemptKey]}
+}
+
+// cancels are handler contexts of the running requests
+type cancels struct {
+	running   map[cancelNotice]context.CancelFunc
+	cancelled map[cancelNotice]time.Time // notices received before request is started
+	lastSweep time.Time
+	sync.Mutex
+}
+
+func newCancels() *cancels {
+	return &cancels{
+		running:   make(map[cancelNotice]context.CancelFunc),
+		cancelled: make(map[cancelNotice]time.Time),
+	}
+}
+
+// start registers cancel of the request handler context, returns false
+// if request is already cancelled
+func (c *cancels) start(m *amp.Msg, cancel context.CancelFunc) bool {
+	n := noticeOf(m)
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.cancelled[n]; ok {
+		delete(c.cancelled, n)
+		return false
+	}
+	c.running[n] = cancel
+	return true
+}
+
+// done unregisters finished request
+func (c *cancels) done(m *amp.Msg) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.running, noticeOf(m))
+}
+
+// cancel cancels running request, or remembers notice for the request
+// which is not started yet
+func (c *cancels) cancel(n cancelNotice, now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	c.sweep(now)
+	if cancel, ok := c.running[n]; ok {
+		delete(c.running, n)
+		cancel()
+		metric.Counter("responder.cancelled")
+		return
+	}
+	c.cancelled[n] = now
+}
+
+// sweep removes notices of the requests which never started.
+// Should be called during c.Lock.
+func (c *cancels) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < cancelledTTL {
+		return
+	}
+	c.lastSweep = now
+	for n, t := range c.cancelled {
+		if now.Sub(t) > cancelledTTL {
+			delete(c.cancelled, n)
+		}
+	}
+}
+
+// notices returns cancel notices of all sent copies of the request
+func (r *Requester) notices(correlationID uint64, req *request) []cancelNotice {
+	if req.attempts == 0 {
+		return []cancelNotice{{ReplyTo: r.topic, CorrelationID: correlationID}}
+	}
+	ns := make([]cancelNotice, 0, req.attempts)
+	for a := 1; a <= req.attempts; a++ {
+		ns = append(ns, cancelNotice{ReplyTo: r.topic, CorrelationID: correlationID, Attempt: strconv.Itoa(a)})
+	}
+	return ns
+}
+
+// withAttempt returns copy of the marshaled request with the attempt number
+// in meta
+func withAttempt(buf []byte, attempt int) []byte {
+	m := amp.Parse(buf)
+	meta := make(map[string]string, len(m.Meta)+1)
+	for k, v := range m.Meta {
+		meta[k] = v
+	}
+	meta[attemptKey] = strconv.Itoa(attempt)
+	m.Meta = meta
+	return m.Marshal()
+}
+
+// consume subscribes to the cancel notices, each responder instance in
+// its own ephemeral channel
+func (c *cancels) consume(ctx context.Context) {
+	channel := fmt.Sprintf("%s-%s#ephemeral", env.AppName(), env.InstanceId())
+	sub, err := nsq.NewConsumer(CancelTopic, func(nm *nsq.Message) error {
+		var n cancelNotice
+		if err := json.Unmarshal(nm.Body, &n); err != nil {
+			log.Error(errors.WithStack(err))
+			return nil
+		}
+		c.cancel(n, time.Now())
+		return nil
+	}, nsq.Channel(channel))
+	if err != nil {
+		log.Error(errors.WithStack(err))
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		sub.Close()
+	}()
+}
+
+// cancel publishes cancel notices of the requests, nobody is waiting
+// for their responses
+func (r *Requester) cancel(notices []cancelNotice) {
+	for _, n := range notices {
+		buf, _ := json.Marshal(n)
+		if err := r.producer.PublishTo(CancelTopic, buf); err != nil {
+			log.Error(err)
+			return
+		}
+	}
+}
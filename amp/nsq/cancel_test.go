@@ -0,0 +1,55 @@
+package nsq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCancels(t *testing.T) {
+	c := newCancels()
+	now := time.Now()
+	m := &amp.Msg{Type: amp.Request, ReplyTo: "rsp", CorrelationID: 1}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.True(t, c.start(m, cancel))
+	c.cancel(noticeOf(m), now)
+	assert.Error(t, ctx.Err())
+	assert.Len(t, c.running, 0)
+
+	// notice before request is started
+	m2 := &amp.Msg{Type: amp.Request, ReplyTo: "rsp", CorrelationID: 2}
+	c.cancel(noticeOf(m2), now)
+	_, cancel = context.WithCancel(context.Background())
+	assert.False(t, c.start(m2, cancel))
+	cancel()
+
+	// finished request
+	_, cancel = context.WithCancel(context.Background())
+	assert.True(t, c.start(m2, cancel))
+	c.done(m2)
+	cancel()
+	assert.Len(t, c.running, 0)
+
+	// hedged copies are cancelled by attempt
+	h1 := &amp.Msg{Type: amp.Request, ReplyTo: "rsp", CorrelationID: 5, Meta: map[string]string{attemptKey: "1"}}
+	h2 := &amp.Msg{Type: amp.Request, ReplyTo: "rsp", CorrelationID: 5, Meta: map[string]string{attemptKey: "2"}}
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	assert.True(t, c.start(h1, cancel1))
+	assert.True(t, c.start(h2, cancel2))
+	c.cancel(noticeOf(h2), now)
+	assert.NoError(t, ctx1.Err())
+	assert.Error(t, ctx2.Err())
+	c.done(h1)
+	cancel1()
+	assert.Len(t, c.running, 0)
+
+	// notices of the requests never started expire
+	c.cancel(cancelNotice{ReplyTo: "rsp", CorrelationID: 3}, now)
+	c.cancel(cancelNotice{ReplyTo: "rsp", CorrelationID: 4}, now.Add(2*cancelledTTL))
+	assert.Len(t, c.cancelled, 1)
+}
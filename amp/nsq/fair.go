@@ -0,0 +1,110 @@
+package nsq
+
+import "sync"
+
+// requests waiting in the queue of each topic, when the queue is full
+// nsq consumer of that topic waits, other topics are not affected
+const fairQueueSize = 64
+
+// fairQueue holds requests in per topic queues and hands them to the
+// workers by weighted round robin, so flooded topic can't starve others.
+// Topic with weight n gets up to n requests in each round.
+type fairQueue struct {
+	weights map[string]int
+	queues  map[string]*topicQueue
+	order   []*topicQueue
+	next    int // position in order of the topic being served
+	closed  bool
+	cond    *sync.Cond
+	sync.Mutex
+}
+
+type topicQueue struct {
+	weight int
+	credit int // requests left in the current round
+	items  []delivery
+}
+
+func newFairQueue(weights map[string]int) *fairQueue {
+	q := &fairQueue{
+		weights: weights,
+		queues:  make(map[string]*topicQueue),
+	}
+	q.cond = sync.NewCond(q)
+	return q
+}
+
+// queue returns queue of the topic, creates it on first request
+func (q *fairQueue) queue(topic string) *topicQueue {
+	tq, ok := q.queues[topic]
+	if !ok {
+		w := q.weights[topic]
+		if w < 1 {
+			w = 1
+		}
+		tq = &topicQueue{weight: w, credit: w}
+		q.queues[topic] = tq
+		q.order = append(q.order, tq)
+	}
+	return tq
+}
+
+// push adds request to its topic queue, blocks while that queue is full
+func (q *fairQueue) push(d delivery) {
+	q.Lock()
+	defer q.Unlock()
+	tq := q.queue(d.m.Topic())
+	for len(tq.items) >= fairQueueSize && !q.closed {
+		q.cond.Wait()
+	}
+	tq.items = append(tq.items, d)
+	q.cond.Broadcast()
+}
+
+// pop returns next request, blocks until there is one.
+// Returns false when queue is closed and empty.
+func (q *fairQueue) pop() (delivery, bool) {
+	q.Lock()
+	defer q.Unlock()
+	for {
+		if d, ok := q.take(); ok {
+			q.cond.Broadcast()
+			return d, true
+		}
+		if q.closed {
+			return delivery{}, false
+		}
+		q.cond.Wait()
+	}
+}
+
+// take takes request from the topic in turn
+func (q *fairQueue) take() (delivery, bool) {
+	if len(q.order) == 0 {
+		return delivery{}, false
+	}
+	// one more than topics, to come back to the topic which only
+	// has ended its round
+	for i := 0; i <= len(q.order); i++ {
+		tq := q.order[q.next]
+		if len(tq.items) == 0 || tq.credit == 0 {
+			// topic is done for this round
+			tq.credit = tq.weight
+			q.next = (q.next + 1) % len(q.order)
+			continue
+		}
+		d := tq.items[0]
+		tq.items[0] = delivery{}
+		tq.items = tq.items[1:]
+		tq.credit--
+		return d, true
+	}
+	return delivery{}, false
+}
+
+func (q *fairQueue) close() {
+	q.Lock()
+	defer q.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
@@ -0,0 +1,58 @@
+package nsq
+
+import (
+	"testing"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFairQueue(t *testing.T) {
+	q := newFairQueue(map[string]int{"b.req": 2})
+	for i := 0; i < 50; i++ {
+		q.push(delivery{m: &amp.Msg{URI: "a.req/flood"}})
+	}
+	for i := 0; i < 10; i++ {
+		q.push(delivery{m: &amp.Msg{URI: "b.req/add"}})
+	}
+	q.push(delivery{m: &amp.Msg{URI: "c.req/add"}})
+
+	var topics []string
+	for i := 0; i < 8; i++ {
+		d, ok := q.pop()
+		assert.True(t, ok)
+		topics = append(topics, d.m.Topic())
+	}
+	// a is flooded but b and c get their turns, b twice per round
+	assert.Equal(t, []string{"a.req", "b.req", "b.req", "c.req", "a.req", "b.req", "b.req", "a.req"}, topics)
+
+	q.close()
+	n := 8
+	for {
+		if _, ok := q.pop(); !ok {
+			break
+		}
+		n++
+	}
+	assert.Equal(t, 61, n)
+}
+
+func TestFairQueueEmpty(t *testing.T) {
+	q := newFairQueue(nil)
+	_, ok := q.take()
+	assert.False(t, ok)
+
+	// pop waits on empty queue until request is pushed
+	done := make(chan delivery)
+	go func() {
+		d, _ := q.pop()
+		done <- d
+	}()
+	q.push(delivery{m: &amp.Msg{URI: "a.req/add"}})
+	d := <-done
+	assert.Equal(t, "a.req/add", d.m.URI)
+
+	q.close()
+	_, ok = q.pop()
+	assert.False(t, ok)
+}
@@ -0,0 +1,157 @@
+package nsq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+	"github.com/pkg/errors"
+)
+
+// Flow control policies, what publisher does when topic backlog
+// is over the max depth.
+const (
+	// Block stops reading from the input channel until backlog drops,
+	// so backpressure propagates to the producing pipeline.
+	Block uint8 = iota
+	// DropDiffs drops Diff messages of the congested topic.
+	// Full messages are never dropped.
+	DropDiffs
+)
+
+var depthPollInterval = time.Second
+
+// FlowControl enables publisher flow control. Depth of the published topics
+// is polled from the nsqd http stats api (nsqdHTTP is host:port).
+// When depth is greater than maxDepth publisher applies policy.
+func FlowControl(nsqdHTTP string, maxDepth int64, policy uint8) func(*options) {
+	return func(o *options) {
+		o.flowControl = &flowControl{
+			url:       fmt.Sprintf("http://%s/stats?format=json", nsqdHTTP),
+			maxDepth:  maxDepth,
+			policy:    policy,
+			congested: make(map[string]bool),
+		}
+	}
+}
+
+type flowControl struct {
+	url       string
+	maxDepth  int64
+	policy    uint8
+	congested map[string]bool // topics over max depth
+	changed   *sync.Cond
+	sync.Mutex
+}
+
+// admit returns false if message should be dropped.
+// Blocks while topic is congested with Block policy.
+func (f *flowControl) admit(m *amp.Msg) bool {
+	f.Lock()
+	defer f.Unlock()
+	topic := m.Topic()
+	if f.policy == DropDiffs {
+		if f.congested[topic] && m.Type == amp.Publish && m.UpdateType == amp.Diff {
+			metric.Counter("publisher.dropped")
+			return false
+		}
+		return true
+	}
+	for f.congested[topic] {
+		f.changed.Wait()
+	}
+	return true
+}
+
+// poll periodically reads topic depths from nsqd
+func (f *flowControl) poll(ctx context.Context) {
+	f.changed = sync.NewCond(f)
+	go func() {
+		t := time.NewTicker(depthPollInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				depths, err := f.depths()
+				if err != nil {
+					log.S("url", f.url).Error(err)
+					continue
+				}
+				f.update(depths)
+			case <-ctx.Done():
+				f.update(nil) // unblock
+				return
+			}
+		}
+	}()
+}
+
+func (f *flowControl) update(depths map[string]int64) {
+	f.Lock()
+	defer f.Unlock()
+	congested := make(map[string]bool)
+	for topic, depth := range depths {
+		if depth > f.maxDepth {
+			congested[topic] = true
+			if !f.congested[topic] {
+				log.S("topic", topic).I("depth", int(depth)).Info("publisher backpressure")
+			}
+		}
+	}
+	f.congested = congested
+	f.changed.Broadcast()
+}
+
+func (f *flowControl) depths() (map[string]int64, error) {
+	rsp, err := http.Get(f.url)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("nsqd stats status %d", rsp.StatusCode)
+	}
+	var s nsqdStats
+	if err := json.NewDecoder(rsp.Body).Decode(&s); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return s.depths(), nil
+}
+
+type nsqdTopicStats struct {
+	TopicName string `json:"topic_name"`
+	Depth     int64  `json:"depth"`
+	Channels  []struct {
+		Depth int64 `json:"depth"`
+	} `json:"channels"`
+}
+
+// nsqdStats is response of the nsqd /stats api.
+// Older nsqd versions wrap response into data.
+type nsqdStats struct {
+	Topics []nsqdTopicStats `json:"topics"`
+	Data   struct {
+		Topics []nsqdTopicStats `json:"topics"`
+	} `json:"data"`
+}
+
+// depths returns backlog by topic, max of topic and its channels depths
+func (s nsqdStats) depths() map[string]int64 {
+	depths := make(map[string]int64)
+	for _, t := range append(s.Topics, s.Data.Topics...) {
+		d := t.Depth
+		for _, c := range t.Channels {
+			if c.Depth > d {
+				d = c.Depth
+			}
+		}
+		depths[t.TopicName] = d
+	}
+	return depths
+}
@@ -0,0 +1,37 @@
+package nsq
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNsqdStatsDepths(t *testing.T) {
+	buf := []byte(`{"version":"1.2.0","topics":[
+		{"topic_name":"math.v1","depth":0,"channels":[{"depth":10},{"depth":1200}]},
+		{"topic_name":"chat","depth":5,"channels":[]}]}`)
+	var s nsqdStats
+	assert.NoError(t, json.Unmarshal(buf, &s))
+	assert.Equal(t, map[string]int64{"math.v1": 1200, "chat": 5}, s.depths())
+
+	buf = []byte(`{"status_code":200,"data":{"topics":[{"topic_name":"chat","depth":7}]}}`)
+	s = nsqdStats{}
+	assert.NoError(t, json.Unmarshal(buf, &s))
+	assert.Equal(t, map[string]int64{"chat": 7}, s.depths())
+}
+
+func TestFlowControlDropDiffs(t *testing.T) {
+	f := &flowControl{maxDepth: 100, policy: DropDiffs, congested: make(map[string]bool)}
+	f.changed = sync.NewCond(f)
+	f.update(map[string]int64{"math.v1": 101, "chat": 100})
+
+	assert.False(t, f.admit(amp.NewPublish("math.v1", "i", 1, amp.Diff, nil)))
+	assert.True(t, f.admit(amp.NewPublish("math.v1", "i", 2, amp.Full, nil)))
+	assert.True(t, f.admit(amp.NewPublish("chat", "", 1, amp.Diff, nil)))
+
+	f.update(map[string]int64{"math.v1": 10})
+	assert.True(t, f.admit(amp.NewPublish("math.v1", "i", 3, amp.Diff, nil)))
+}
@@ -0,0 +1,276 @@
+package nsq
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/presence"
+)
+
+type options struct {
+	orderingWindow time.Duration
+	current        func(uri string)
+	concurrency    int
+	orderKey       func(*amp.Msg) string
+	flowControl    *flowControl
+	heartbeat      time.Duration
+	checksum       bool
+	chunkSize      int              // max body size of the published full
+	verify         func(uri string) // called on checksum mismatch
+	hedgeDelay     time.Duration
+	hedgeURIs      map[string]struct{}
+	dedupeTTL      time.Duration
+	canary         *Canary
+	sticky         *Sticky
+	instanceID     string // sticky responder instance
+	fairWeights    map[string]int
+	shadowRatio    float64
+	shadowTopics   map[string]string
+	timeout        time.Duration
+	retryAttempts  int
+	retryDelay     time.Duration
+	retryMaxDelay  time.Duration
+	deadLetter     string
+	cancel         bool // publish and consume request cancel notices
+}
+
+func (o *options) apply(opts ...func(*options)) *options {
+	for _, fn := range opts {
+		fn(o)
+	}
+	return o
+}
+
+// OrderingWindow holds out of order messages for the window duration and
+// delivers them ordered by Ts per uri, redeliveries are dropped. When message comes after window
+// is exceeded current is called to request full message for the uri.
+// Example:
+//
+//	nsq.Subscribe(ctx, topics, nsq.OrderingWindow(time.Second, requester.Current))
+func OrderingWindow(window time.Duration, current func(uri string)) func(*options) {
+	return func(o *options) {
+		o.orderingWindow = window
+		o.current = current
+	}
+}
+
+// Concurrency sets number of responder workers calling handler.
+func Concurrency(n int) func(*options) {
+	return func(o *options) {
+		if n > 0 {
+			o.concurrency = n
+		}
+	}
+}
+
+// OrderedBy serializes handling of the messages with the same key,
+// while messages with different keys are handled in parallel.
+// Example:
+//
+//	nsq.NewResponder(ctx, handler, topics, nsq.Concurrency(16), nsq.OrderedBy(nsq.ByURI))
+func OrderedBy(key func(*amp.Msg) string) func(*options) {
+	return func(o *options) {
+		o.orderKey = key
+	}
+}
+
+// ByURI is OrderedBy key, messages for the same topic/path are serialized.
+func ByURI(m *amp.Msg) string {
+	return m.URI
+}
+
+// ByTopic is OrderedBy key, messages for the same topic are serialized.
+func ByTopic(m *amp.Msg) string {
+	return m.Topic()
+}
+
+// FairQueue makes responder keep requests in per topic queues and hand
+// them to the workers by weighted round robin. Flood of requests on one
+// topic doesn't starve other topics of the responder. Topic with weight n
+// gets n times more workers time than topic with weight 1 when both are
+// busy, topics not in weights have weight 1.
+// Example:
+//
+//	nsq.NewResponder(ctx, handler, topics, nsq.Concurrency(16), nsq.FairQueue(map[string]int{"math.req": 4}))
+func FairQueue(weights map[string]int) func(*options) {
+	return func(o *options) {
+		o.fairWeights = make(map[string]int)
+		for t, w := range weights {
+			o.fairWeights[t] = w
+		}
+	}
+}
+
+// Heartbeat makes publisher send amp.NewTopicAlive message every interval
+// to each topic it has published to.
+func Heartbeat(interval time.Duration) func(*options) {
+	return func(o *options) {
+		o.heartbeat = interval
+	}
+}
+
+// Checksum makes publisher stamp body checksum on each message.
+func Checksum() func(*options) {
+	return func(o *options) {
+		o.checksum = true
+	}
+}
+
+// ChunkFulls makes publisher split Full messages with body larger than
+// size into chunks (see amp.ChunkFull), so nsq messages and websocket
+// frames stay small.
+func ChunkFulls(size int) func(*options) {
+	return func(o *options) {
+		if size > 0 {
+			o.chunkSize = size
+		}
+	}
+}
+
+// VerifyChecksum makes subscriber verify message body checksum.
+// Messages with checksum mismatch are dropped, and current is called
+// to request full message for the uri.
+func VerifyChecksum(current func(uri string)) func(*options) {
+	return func(o *options) {
+		o.verify = current
+	}
+}
+
+// Hedge makes requester send duplicate request when response is not
+// received within delay. Duplicate is usually handled by another responder
+// instance, first response is used and the other is dropped.
+// Use only for idempotent methods, listed in uris (topic/path).
+// Without uris all requests are hedged. With CancelRequests the request
+// which lost is cancelled when the first response is received (copies
+// are cancelled by attempt number in the request meta), responder Dedupe
+// middleware handles duplicate received by the same instance once.
+func Hedge(delay time.Duration, uris ...string) func(*options) {
+	return func(o *options) {
+		o.hedgeDelay = delay
+		o.hedgeURIs = make(map[string]struct{})
+		for _, u := range uris {
+			o.hedgeURIs[u] = struct{}{}
+		}
+	}
+}
+
+// Timeout sets deadline of the requests sent by requester.
+// Responder stops handling the request (handler ctx is done) when
+// deadline passes, as nobody is waiting for the response anymore.
+// Requester replies with ErrTimeout transport error if response is not
+// received within d.
+func Timeout(d time.Duration) func(*options) {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// CancelRequests makes requester publish cancel notice of the pending
+// requests when the client disconnects (requester Unsubscribe), and
+// responder cancel handler ctx of the request on the notice, so handler
+// can stop the work nobody is waiting for.
+// Set on both requesters and responders.
+func CancelRequests() func(*options) {
+	return func(o *options) {
+		o.cancel = true
+	}
+}
+
+// Retry makes responder requeue requests failed with retryable error
+// (see amp.Retryable) up to attempts times. Requeue delay starts at delay
+// and doubles with each attempt, up to maxDelay. Response is sent after
+// the last attempt. Use only for idempotent methods.
+func Retry(attempts int, delay, maxDelay time.Duration) func(*options) {
+	return func(o *options) {
+		o.retryAttempts = attempts
+		o.retryDelay = delay
+		o.retryMaxDelay = maxDelay
+	}
+}
+
+func (o *options) requeueDelay(attempt uint16) time.Duration {
+	d := o.retryDelay
+	for i := uint16(1); i < attempt && d < o.retryMaxDelay; i++ {
+		d *= 2
+	}
+	if d > o.retryMaxDelay {
+		d = o.retryMaxDelay
+	}
+	return d
+}
+
+// DeadLetter makes responder publish requests failed with permanent error
+// (see amp.Permanent), or with retryable error after the last Retry
+// attempt, to the dead letter topic. Error is in the message Meta.
+func DeadLetter(topic string) func(*options) {
+	return func(o *options) {
+		o.deadLetter = topic
+	}
+}
+
+func (o *options) hedged(m *amp.Msg) bool {
+	if o.hedgeDelay <= 0 {
+		return false
+	}
+	if len(o.hedgeURIs) == 0 {
+		return true
+	}
+	_, ok := o.hedgeURIs[m.URI]
+	return ok
+}
+
+// Dedupe makes responder detect duplicate requests (same CorrelationID)
+// within ttl and reply with the cached response instead of calling
+// handler again.
+func Dedupe(ttl time.Duration) func(*options) {
+	return func(o *options) {
+		o.dedupeTTL = ttl
+	}
+}
+
+// Route sends requests to the topics selected by canary routing table.
+func Route(c *Canary) func(*options) {
+	return func(o *options) {
+		o.canary = c
+	}
+}
+
+// RouteSticky sends requests with entity key to the responder instance
+// selected by sticky routing table, before canary routing.
+func RouteSticky(s *Sticky) func(*options) {
+	return func(o *options) {
+		o.sticky = s
+	}
+}
+
+// StickyInstance makes responder also handle requests sent to this
+// instance by the RouteSticky requesters. Instance is identified by
+// presence id, announce presence so requesters can find it.
+func StickyInstance() func(*options) {
+	return func(o *options) {
+		o.instanceID = presence.Self(presence.Service, "").ID()
+	}
+}
+
+// Shadow mirrors ratio (0-1) of requests for the topic to the shadow topic.
+// Shadow topics are map from original to shadow topic name.
+// Mirrored request is sent without ReplyTo so the shadow responder
+// does not respond.
+func Shadow(ratio float64, topics map[string]string) func(*options) {
+	return func(o *options) {
+		o.shadowRatio = ratio
+		o.shadowTopics = topics
+	}
+}
+
+func (o *options) shadowTopic(topic string) (string, bool) {
+	if o.shadowRatio <= 0 {
+		return "", false
+	}
+	st, ok := o.shadowTopics[topic]
+	if !ok || rand.Float64() >= o.shadowRatio {
+		return "", false
+	}
+	return st, true
+}
@@ -0,0 +1,37 @@
+package nsq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShadowTopic(t *testing.T) {
+	o := (&options{}).apply(Shadow(1, map[string]string{"math.req": "math.req.shadow"}))
+	st, ok := o.shadowTopic("math.req")
+	assert.True(t, ok)
+	assert.Equal(t, "math.req.shadow", st)
+	_, ok = o.shadowTopic("chat.req")
+	assert.False(t, ok)
+
+	o = (&options{}).apply(Shadow(0, map[string]string{"math.req": "math.req.shadow"}))
+	_, ok = o.shadowTopic("math.req")
+	assert.False(t, ok)
+}
+
+func TestRequeueDelay(t *testing.T) {
+	o := (&options{}).apply(Retry(5, time.Second, 5*time.Second))
+	assert.Equal(t, time.Second, o.requeueDelay(1))
+	assert.Equal(t, 2*time.Second, o.requeueDelay(2))
+	assert.Equal(t, 4*time.Second, o.requeueDelay(3))
+	assert.Equal(t, 5*time.Second, o.requeueDelay(4))
+	assert.Equal(t, 5*time.Second, o.requeueDelay(100))
+}
+
+func TestChunkFulls(t *testing.T) {
+	o := (&options{}).apply(ChunkFulls(1024))
+	assert.Equal(t, 1024, o.chunkSize)
+	o = (&options{}).apply(ChunkFulls(0))
+	assert.Equal(t, 0, o.chunkSize)
+}
@@ -0,0 +1,175 @@
+package nsq
+
+import (
+	"sort"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+)
+
+var (
+	orderingTick       = 10 * time.Millisecond // interval for checking expired messages
+	maxOrderingPending = 1024                  // max number of held messages per uri
+	orderingIdle       = time.Minute           // uri state is removed after idle interval
+)
+
+type pendingMsg struct {
+	msg     *amp.Msg
+	seq     string // nsq message id, same for redeliveries
+	arrived time.Time
+}
+
+// uriQueue holds out of order messages for one uri
+type uriQueue struct {
+	lastTs   int64               // ts of the last delivered message
+	lastSeqs map[string]struct{} // seqs of the delivered messages with lastTs
+	pending  []pendingMsg        // held messages sorted by Ts
+	touched  time.Time           // last added message
+}
+
+// delivered returns true if message with ts and seq is already delivered
+// as one of the messages with lastTs
+func (q *uriQueue) delivered(ts int64, seq string) bool {
+	if ts != q.lastTs {
+		return false
+	}
+	_, ok := q.lastSeqs[seq]
+	return ok
+}
+
+// held returns true if message with ts and seq is already pending
+func (q *uriQueue) held(ts int64, seq string) bool {
+	for _, p := range q.pending {
+		if p.msg.Ts == ts && p.seq == seq {
+			return true
+		}
+	}
+	return false
+}
+
+// orderer holds messages which came out of order (nsq reorders on requeue)
+// for the window duration and delivers them ordered by Ts per uri.
+// Message which comes after window is exceeded can't be delivered in order,
+// for such diff full message is requested by calling current.
+// Redeliveries are recognized by (Ts, seq) and delivered only once.
+// Uris without messages for orderingIdle are forgotten.
+type orderer struct {
+	window  time.Duration
+	current func(uri string)
+	in      chan orderedMsg
+	out     chan *amp.Msg
+	uris    map[string]*uriQueue
+}
+
+// orderedMsg is received message with its sequence
+type orderedMsg struct {
+	msg *amp.Msg
+	seq string
+}
+
+func newOrderer(window time.Duration, current func(string), out chan *amp.Msg) *orderer {
+	o := &orderer{
+		window:  window,
+		current: current,
+		in:      make(chan orderedMsg),
+		out:     out,
+		uris:    make(map[string]*uriQueue),
+	}
+	go o.loop()
+	return o
+}
+
+func (o *orderer) loop() {
+	defer close(o.out)
+	tick := time.NewTicker(orderingTick)
+	defer tick.Stop()
+	for {
+		select {
+		case om, ok := <-o.in:
+			if !ok {
+				o.flushAll()
+				return
+			}
+			o.add(om.msg, om.seq, time.Now())
+		case now := <-tick.C:
+			o.flush(now)
+		}
+	}
+}
+
+func (o *orderer) add(m *amp.Msg, seq string, now time.Time) {
+	if m.Ts == 0 {
+		// no information for ordering
+		o.out <- m
+		return
+	}
+	q, ok := o.uris[m.URI]
+	if !ok {
+		q = &uriQueue{}
+		o.uris[m.URI] = q
+	}
+	q.touched = now
+	if q.held(m.Ts, seq) || q.delivered(m.Ts, seq) {
+		metric.Counter("orderer.duplicate")
+		return
+	}
+	if m.Ts < q.lastTs {
+		// late for more than window, we already delivered newer messages
+		log.S("uri", m.URI).I("ts", int(m.Ts)).I("lastTs", int(q.lastTs)).Info("out of order message")
+		if !m.IsFull() && o.current != nil {
+			o.current(m.URI)
+		}
+		return
+	}
+	i := sort.Search(len(q.pending), func(i int) bool { return q.pending[i].msg.Ts > m.Ts })
+	q.pending = append(q.pending, pendingMsg{})
+	copy(q.pending[i+1:], q.pending[i:])
+	q.pending[i] = pendingMsg{msg: m, seq: seq, arrived: now}
+
+	if len(q.pending) > maxOrderingPending {
+		o.deliver(q, len(q.pending)-maxOrderingPending)
+	}
+}
+
+// flush delivers messages which are held for longer than window.
+// To preserve order all messages with smaller Ts are also delivered.
+// Removes idle uris.
+func (o *orderer) flush(now time.Time) {
+	for uri, q := range o.uris {
+		if len(q.pending) == 0 && now.Sub(q.touched) >= orderingIdle {
+			delete(o.uris, uri)
+			continue
+		}
+		n := 0
+		for i, p := range q.pending {
+			if now.Sub(p.arrived) >= o.window {
+				n = i + 1
+			}
+		}
+		o.deliver(q, n)
+	}
+}
+
+func (o *orderer) flushAll() {
+	for _, q := range o.uris {
+		o.deliver(q, len(q.pending))
+	}
+}
+
+// deliver sends first n pending messages
+func (o *orderer) deliver(q *uriQueue, n int) {
+	if n == 0 {
+		return
+	}
+	for _, p := range q.pending[:n] {
+		if p.msg.Ts != q.lastTs {
+			q.lastTs = p.msg.Ts
+			q.lastSeqs = make(map[string]struct{})
+		}
+		q.lastSeqs[p.seq] = struct{}{}
+		o.out <- p.msg
+	}
+	q.pending = q.pending[n:]
+}
@@ -0,0 +1,100 @@
+package nsq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func testOrderer(window time.Duration) (*orderer, chan *amp.Msg, *[]string) {
+	out := make(chan *amp.Msg, 16)
+	var currents []string
+	o := &orderer{
+		window:  window,
+		current: func(uri string) { currents = append(currents, uri) },
+		out:     out,
+		uris:    make(map[string]*uriQueue),
+	}
+	return o, out, &currents
+}
+
+func TestOrdererReorders(t *testing.T) {
+	o, out, _ := testOrderer(time.Second)
+	now := time.Now()
+	m1 := &amp.Msg{URI: "a", Ts: 1, UpdateType: amp.Full}
+	m2 := &amp.Msg{URI: "a", Ts: 2}
+	m3 := &amp.Msg{URI: "a", Ts: 3}
+	o.add(m1, "1", now)
+	o.add(m3, "3", now)
+	o.add(m2, "2", now.Add(100*time.Millisecond))
+
+	o.flush(now.Add(500 * time.Millisecond))
+	assert.Len(t, out, 0)
+
+	// m3 expired, m1 and m2 with smaller Ts are delivered before it
+	o.flush(now.Add(time.Second))
+	assert.Len(t, out, 3)
+	assert.Equal(t, m1, <-out)
+	assert.Equal(t, m2, <-out)
+	assert.Equal(t, m3, <-out)
+}
+
+func TestOrdererRequestsCurrentForLateDiff(t *testing.T) {
+	o, out, currents := testOrderer(time.Second)
+	now := time.Now()
+	o.add(&amp.Msg{URI: "a", Ts: 2}, "2", now)
+	o.flush(now.Add(time.Second))
+	assert.Len(t, out, 1)
+	<-out
+
+	o.add(&amp.Msg{URI: "a", Ts: 1}, "1", now.Add(2*time.Second))
+	o.flushAll()
+	assert.Len(t, out, 0)
+	assert.Equal(t, []string{"a"}, *currents)
+
+	// late full is just skipped
+	o.add(&amp.Msg{URI: "a", Ts: 1, UpdateType: amp.Full}, "3", now.Add(2*time.Second))
+	assert.Len(t, *currents, 1)
+}
+
+func TestOrdererWithoutTs(t *testing.T) {
+	o, out, _ := testOrderer(time.Second)
+	m := &amp.Msg{URI: "a"}
+	o.add(m, "", time.Now())
+	assert.Len(t, out, 1)
+	assert.Equal(t, m, <-out)
+}
+
+func TestOrdererSameTs(t *testing.T) {
+	o, out, currents := testOrderer(time.Second)
+	now := time.Now()
+	m1 := &amp.Msg{URI: "a", Ts: 1}
+	m2 := &amp.Msg{URI: "a", Ts: 1}
+	o.add(m1, "1", now)
+	o.add(m1, "1", now) // redelivery while held
+	o.flush(now.Add(time.Second))
+	assert.Len(t, out, 1)
+	assert.Equal(t, m1, <-out)
+
+	// redelivery after delivered is dropped, other message with the same
+	// ts is delivered
+	o.add(m1, "1", now.Add(time.Second))
+	o.add(m2, "2", now.Add(time.Second))
+	o.flushAll()
+	assert.Len(t, out, 1)
+	assert.Equal(t, m2, <-out)
+	assert.Len(t, *currents, 0)
+}
+
+func TestOrdererExpiresIdleURIs(t *testing.T) {
+	o, out, _ := testOrderer(time.Second)
+	now := time.Now()
+	o.add(&amp.Msg{URI: "a", Ts: 1}, "1", now)
+	o.flush(now.Add(time.Second))
+	<-out
+	assert.Len(t, o.uris, 1)
+	o.flush(now.Add(orderingIdle))
+	assert.Len(t, o.uris, 0)
+}
@@ -1,14 +1,20 @@
 package nsq
 
 import (
+	"context"
+	"sync"
+	"time"
+
 	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/chaos"
 	"github.com/minus5/svckit/nsq"
 )
 
 func Publish(topic string, in <-chan *amp.Msg) chan *amp.Msg {
 	pub := nsq.Pub(topic)
 	publish := func(m *amp.Msg) {
-		pub.Publish(m.Marshal())
+		chaos.Get().Send(m.Marshal(), pub.Publish)
+		amp.CountMsg("publish", m)
 	}
 	out := make(chan *amp.Msg, 16)
 	go func() {
@@ -21,31 +27,160 @@ func Publish(topic string, in <-chan *amp.Msg) chan *amp.Msg {
 	return out
 }
 
+// Publisher publishes messages to the nsq topics.
+// Messages are published by priority lanes (amp.Msg.Lane), so control
+// messages (Full, Close, Pong) are never stuck behind backlog of diffs of
+// the other uris. Messages of the same uri are published in order.
 type Publisher struct {
-	done chan struct{}
+	done     chan struct{}
+	lanes    [3][]*amp.Msg // waiting messages indexed by priority
+	order    *amp.Lanes    // keeps uri order between lanes
+	closed   bool          // input channel is closed
+	changed  *sync.Cond
+	fc       *flowControl
+	topics   map[string]struct{} // published topics, for heartbeat
+	checksum bool
+	chunk    int // size of the full chunks, 0 for no chunking
+	sync.Mutex
 }
 
+// maxLaneDepth is max number of waiting messages in the lane, receiving
+// blocks until lane has room
+const maxLaneDepth = 1024
+
 func (p *Publisher) Wait() {
 	<-p.done
 }
 
-func (p *Publisher) loop(in <-chan *amp.Msg) {
+// receive puts input messages into lanes
+func (p *Publisher) receive(in <-chan *amp.Msg) {
+	for m := range in {
+		if p.fc != nil && !p.fc.admit(m) {
+			continue
+		}
+		l := p.order.Put(m)
+		p.Lock()
+		for len(p.lanes[l]) >= maxLaneDepth {
+			p.changed.Wait()
+		}
+		p.lanes[l] = append(p.lanes[l], m)
+		if p.topics != nil {
+			p.topics[m.Topic()] = struct{}{}
+		}
+		p.Unlock()
+		p.changed.Broadcast()
+	}
+	p.Lock()
+	p.closed = true
+	p.Unlock()
+	p.changed.Broadcast()
+}
+
+// next returns first message from the highest priority lane.
+// Blocks until there is a message. Returns nil when input is closed
+// and all lanes are empty.
+func (p *Publisher) next() *amp.Msg {
+	p.Lock()
+	defer p.Unlock()
+	for {
+		for _, l := range amp.LanesOrder {
+			if len(p.lanes[l]) > 0 {
+				m := p.lanes[l][0]
+				p.lanes[l] = p.lanes[l][1:]
+				p.order.Done(m, l)
+				p.changed.Broadcast()
+				return m
+			}
+		}
+		if p.closed {
+			return nil
+		}
+		p.changed.Wait()
+	}
+}
+
+func (p *Publisher) loop() {
 	defer close(p.done)
 
 	pub := nsq.Pub("")
 	publish := func(m *amp.Msg) {
-		pub.PublishTo(m.Topic(), m.Marshal())
+		if p.checksum {
+			m.StampChecksum()
+		}
+		topic := m.Topic()
+		chaos.Get().Send(m.Marshal(), func(buf []byte) error {
+			return pub.PublishTo(topic, buf)
+		})
+		amp.CountMsg("publish", m)
 	}
 
-	for m := range in {
-		publish(m)
+	for {
+		m := p.next()
+		if m == nil {
+			return
+		}
+		for _, c := range amp.ChunkFull(m, p.chunk) {
+			publish(c)
+		}
 	}
 }
 
-func NewPublisher(in <-chan *amp.Msg) *Publisher {
+// NewPublisher publishes messages from in until it is closed.
+// Options: FlowControl, Heartbeat, Checksum, ChunkFulls.
+func NewPublisher(in <-chan *amp.Msg, opts ...func(*options)) *Publisher {
+	o := (&options{}).apply(opts...)
 	p := &Publisher{
-		done: make(chan struct{}),
+		done:     make(chan struct{}),
+		order:    amp.NewLanes(),
+		fc:       o.flowControl,
+		checksum: o.checksum,
+		chunk:    o.chunkSize,
 	}
-	go p.loop(in)
+	p.changed = sync.NewCond(p)
+	if p.fc != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		p.fc.poll(ctx)
+		go func() {
+			<-p.done
+			cancel()
+		}()
+	}
+	if o.heartbeat > 0 {
+		p.topics = make(map[string]struct{})
+		go p.heartbeat(o.heartbeat)
+	}
+	go p.receive(in)
+	go p.loop()
 	return p
 }
+
+// heartbeat puts alive message for each published topic into high lane.
+// Alive is skipped when the lane is full, the messages waiting in it will
+// show that topic is alive.
+func (p *Publisher) heartbeat(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			p.Lock()
+			if p.closed {
+				p.Unlock()
+				return
+			}
+			for topic := range p.topics {
+				m := amp.NewTopicAlive(topic)
+				l := p.order.Put(m)
+				if len(p.lanes[l]) >= maxLaneDepth {
+					amp.CountMsg("aliveSkipped", m)
+					continue
+				}
+				p.lanes[l] = append(p.lanes[l], m)
+			}
+			p.Unlock()
+			p.changed.Broadcast()
+		case <-p.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package nsq
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func testPublisher(in <-chan *amp.Msg) *Publisher {
+	p := &Publisher{order: amp.NewLanes()}
+	p.changed = sync.NewCond(p)
+	go p.receive(in)
+	return p
+}
+
+func TestPublisherLanesOrder(t *testing.T) {
+	in := make(chan *amp.Msg, 4)
+	in <- amp.NewPublish("a", "", 1, amp.Diff, nil)
+	in <- amp.NewPublish("b", "", 2, amp.Diff, nil)
+	in <- amp.NewPublish("a", "", 3, amp.Full, nil)
+	in <- amp.NewPublish("c", "", 4, amp.Full, nil)
+	close(in)
+	p := testPublisher(in)
+	time.Sleep(10 * time.Millisecond)
+
+	var ts []int64
+	for m := p.next(); m != nil; m = p.next() {
+		ts = append(ts, m.Ts)
+	}
+	// full of c overtakes diffs, full of a waits for its diff
+	assert.Equal(t, []int64{4, 1, 2, 3}, ts)
+}
+
+func TestPublisherLanesBounded(t *testing.T) {
+	in := make(chan *amp.Msg)
+	p := testPublisher(in)
+	go func() {
+		for i := 0; i <= maxLaneDepth; i++ {
+			in <- amp.NewPublish("a", "", int64(i), amp.Diff, nil)
+		}
+		close(in)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	p.Lock()
+	assert.Len(t, p.lanes[amp.PriorityNormal], maxLaneDepth)
+	p.Unlock()
+
+	n := 0
+	for m := p.next(); m != nil; m = p.next() {
+		n++
+	}
+	assert.Equal(t, maxLaneDepth+1, n)
+}
+
+func TestPublisherHeartbeatBounded(t *testing.T) {
+	p := &Publisher{order: amp.NewLanes(), topics: map[string]struct{}{"a": {}}}
+	p.changed = sync.NewCond(p)
+	l := p.order.Put(amp.NewTopicAlive("a"))
+	for i := 0; i < maxLaneDepth; i++ {
+		p.lanes[l] = append(p.lanes[l], amp.NewTopicAlive("a"))
+	}
+	go p.heartbeat(time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	p.Lock()
+	assert.Len(t, p.lanes[l], maxLaneDepth)
+	p.closed = true
+	p.Unlock()
+}
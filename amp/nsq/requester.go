@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/minus5/svckit/amp"
 	"github.com/minus5/svckit/env"
@@ -12,30 +13,57 @@ import (
 	"github.com/pkg/errors"
 )
 
+// ErrTimeout is transport error of the response when responder
+// doesn't reply within Timeout.
+var ErrTimeout = errors.New("request timeout")
+
+// producer publishes to the nsq topics
+type producer interface {
+	PublishTo(topic string, msg []byte) error
+	Close()
+}
+
 type Requester struct {
 	topic         string
-	producer      *nsq.Producer
+	producer      producer
 	consumer      *nsq.Consumer
 	queue         map[uint64]*request // requests in process
 	correlationNo uint64
 	closed        chan struct{}
+	opts          *options
 	sync.Mutex
 }
 
 type request struct {
-	msg    *amp.Msg
-	source amp.Subscriber
+	msg      *amp.Msg
+	source   amp.Subscriber
+	start    time.Time
+	hedge    *time.Timer // duplicate request, stopped on response
+	attempts int         // copies of the hedged request sent, 0 if not hedged
+	timer    *time.Timer // timeout response, stopped on response
 }
 
-func MustRequester(ctx context.Context) *Requester {
-	r, err := NewRequester(ctx)
+// stop stops request timers
+func (req *request) stop() {
+	if req.hedge != nil {
+		req.hedge.Stop()
+	}
+	if req.timer != nil {
+		req.timer.Stop()
+	}
+}
+
+func MustRequester(ctx context.Context, opts ...func(*options)) *Requester {
+	r, err := NewRequester(ctx, opts...)
 	if err != nil {
 		log.Fatal(err)
 	}
 	return r
 }
 
-func NewRequester(ctx context.Context) (*Requester, error) {
+// NewRequester creates requester.
+// Options: CancelRequests, Hedge, Route, RouteSticky, Shadow, Timeout.
+func NewRequester(ctx context.Context, opts ...func(*options)) (*Requester, error) {
 	p, err := nsq.NewProducer("")
 	if err != nil {
 		return nil, errors.WithStack(err)
@@ -45,6 +73,7 @@ func NewRequester(ctx context.Context) (*Requester, error) {
 		queue:    make(map[uint64]*request),
 		topic:    resposesTopicName(),
 		closed:   make(chan struct{}),
+		opts:     (&options{}).apply(opts...),
 	}
 	c, err := nsq.NewConsumer(r.topic, r.responses)
 	if err != nil {
@@ -65,6 +94,9 @@ func (r *Requester) responses(nm *nsq.Message) error {
 	return nil
 }
 
+// reply sends response to the request source, responses of the
+// requests which are not waiting (duplicates of the hedged request or
+// late responses) are dropped
 func (r *Requester) reply(correlationID uint64, m *amp.Msg) {
 	r.Lock()
 	req, ok := r.queue[correlationID]
@@ -76,7 +108,14 @@ func (r *Requester) reply(correlationID uint64, m *amp.Msg) {
 	if !ok {
 		return
 	}
+	req.stop()
+	if req.attempts > 1 && r.opts.cancel {
+		// the other one of the duplicate requests lost, winner is unknown
+		// so all are cancelled; notice of the finished one is dropped
+		go r.cancel(r.notices(correlationID, req))
+	}
 	m.CorrelationID = req.msg.CorrelationID
+	amp.TimeMsg("request", req.msg, m, req.start)
 	req.source.Send(m)
 	return
 }
@@ -85,20 +124,85 @@ func (r *Requester) Send(e amp.Subscriber, m *amp.Msg) {
 	r.Lock()
 	r.correlationNo++
 	correlationID := r.correlationNo
-	r.queue[correlationID] = &request{msg: m, source: e}
-	r.Unlock()
+	req := &request{msg: m, source: e, start: time.Now()}
+	r.queue[correlationID] = req
 
 	rm := m.Request()
 	rm.CorrelationID = correlationID
 	rm.ReplyTo = r.topic
+	rm.StartTrace()
+	if r.opts.timeout > 0 {
+		rm.SetDeadline(r.opts.timeout)
+		req.timer = time.AfterFunc(r.opts.timeout, func() {
+			amp.CountMsg("timeout", m)
+			r.reply(correlationID, m.ResponseTransportError(ErrTimeout))
+		})
+	}
 	buf := rm.Marshal()
+	topic := m.Topic()
+	if st, ok := r.sticky(m); ok {
+		topic = st
+	} else if r.opts.canary != nil {
+		topic = r.opts.canary.Topic(m)
+	}
 
-	go func() {
-		err := r.producer.PublishTo(m.Topic(), buf)
+	publish := func(buf []byte) {
+		err := r.producer.PublishTo(topic, buf)
 		if err != nil {
 			r.reply(correlationID, m.ResponseTransportError(err))
 		}
-	}()
+	}
+	if r.opts.hedged(m) {
+		hbuf := withAttempt(buf, 2)
+		buf = withAttempt(buf, 1)
+		req.attempts = 1
+		req.hedge = time.AfterFunc(r.opts.hedgeDelay, func() {
+			if r.hedge(correlationID) {
+				amp.CountMsg("hedge", m)
+				publish(hbuf)
+			}
+		})
+	}
+	r.Unlock()
+
+	go publish(buf)
+	if st, ok := r.opts.shadowTopic(m.Topic()); ok {
+		sm := m.Request()
+		sm.CorrelationID = 0
+		sm.Timeout = rm.Timeout
+		go r.shadow(st, sm)
+	}
+}
+
+// sticky returns instance topic for the sticky request
+func (r *Requester) sticky(m *amp.Msg) (string, bool) {
+	if r.opts.sticky == nil {
+		return "", false
+	}
+	return r.opts.sticky.route(m)
+}
+
+// shadow sends copy of the request to the shadow topic, response is not expected.
+// Copy has no ReplyTo and CorrelationID so shadow responder's response
+// can't reach the requester.
+func (r *Requester) shadow(topic string, sm *amp.Msg) {
+	if err := r.producer.PublishTo(topic, sm.Marshal()); err != nil {
+		log.S("topic", topic).Error(err)
+		return
+	}
+	amp.CountMsg("shadow", sm)
+}
+
+// hedge marks request as hedged, returns false if response for the
+// request is already received
+func (r *Requester) hedge(correlationID uint64) bool {
+	r.Lock()
+	defer r.Unlock()
+	req, ok := r.queue[correlationID]
+	if ok {
+		req.attempts = 2
+	}
+	return ok
 }
 
 // Current send current message for the uri
@@ -109,13 +213,19 @@ func (r *Requester) Current(uri string) {
 }
 
 func (r *Requester) Unsubscribe(e amp.Subscriber) {
+	var pending []cancelNotice
 	r.Lock()
-	defer r.Unlock()
 	for key, req := range r.queue {
 		if req.source == e {
+			req.stop()
 			delete(r.queue, key)
+			pending = append(pending, r.notices(key, req)...)
 		}
 	}
+	r.Unlock()
+	if r.opts.cancel && len(pending) > 0 {
+		go r.cancel(pending)
+	}
 }
 
 func (r *Requester) waitDone(ctx context.Context) {
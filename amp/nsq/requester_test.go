@@ -0,0 +1,113 @@
+package nsq
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+type published struct {
+	topic string
+	msg   []byte
+}
+
+type testProducer chan published
+
+func (p testProducer) PublishTo(topic string, msg []byte) error {
+	p <- published{topic: topic, msg: msg}
+	return nil
+}
+
+func (p testProducer) Close() {}
+
+func (p testProducer) next(t *testing.T) published {
+	select {
+	case m := <-p:
+		return m
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	return published{}
+}
+
+func (p testProducer) none(t *testing.T, d time.Duration) {
+	select {
+	case m := <-p:
+		t.Fatalf("unexpected publish to %s", m.topic)
+	case <-time.After(d):
+	}
+}
+
+type testSource chan *amp.Msg
+
+func (s testSource) Send(m *amp.Msg) {
+	s <- m
+}
+
+func testRequester(opts ...func(*options)) (*Requester, testProducer) {
+	p := make(testProducer, 16)
+	return &Requester{
+		producer: p,
+		queue:    make(map[uint64]*request),
+		topic:    "z...rsp-test",
+		opts:     (&options{}).apply(opts...),
+	}, p
+}
+
+func TestHedge(t *testing.T) {
+	r, p := testRequester(Hedge(20*time.Millisecond, "math.req/add"), CancelRequests())
+	src := make(testSource, 4)
+	start := time.Now()
+	r.Send(src, amp.NewRequest("math.req/add", nil))
+
+	first := p.next(t)
+	assert.Equal(t, "math.req", first.topic)
+	// duplicate is sent after delay
+	second := p.next(t)
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+	assert.Equal(t, first.topic, second.topic)
+	rm := amp.Parse(first.msg)
+	rm2 := amp.Parse(second.msg)
+	// copies share correlation id, attempts are distinct
+	assert.Equal(t, rm.CorrelationID, rm2.CorrelationID)
+	assert.Equal(t, "1", rm.Meta[attemptKey])
+	assert.Equal(t, "2", rm2.Meta[attemptKey])
+	assert.NotEqual(t, noticeOf(rm), noticeOf(rm2))
+
+	// first response is used, duplicate is dropped
+	r.reply(rm.CorrelationID, rm.Response(1))
+	r.reply(rm.CorrelationID, rm.Response(2))
+	rsp := <-src
+	assert.Equal(t, "1", string(rsp.BodyBytes()))
+	assert.Len(t, src, 0)
+
+	// request which lost is cancelled, each copy by its attempt
+	for _, a := range []string{"1", "2"} {
+		cn := p.next(t)
+		assert.Equal(t, CancelTopic, cn.topic)
+		var n cancelNotice
+		assert.NoError(t, json.Unmarshal(cn.msg, &n))
+		assert.Equal(t, cancelNotice{ReplyTo: r.topic, CorrelationID: rm.CorrelationID, Attempt: a}, n)
+	}
+	p.none(t, 30*time.Millisecond)
+}
+
+func TestHedgeNotNeeded(t *testing.T) {
+	r, p := testRequester(Hedge(20*time.Millisecond, "math.req/add"), CancelRequests())
+	src := make(testSource, 4)
+
+	// response within delay, duplicate is not sent
+	r.Send(src, amp.NewRequest("math.req/add", nil))
+	rm := amp.Parse(p.next(t).msg)
+	r.reply(rm.CorrelationID, rm.Response(1))
+	<-src
+	p.none(t, 40*time.Millisecond)
+
+	// uri which is not hedged
+	r.Send(src, amp.NewRequest("math.req/mul", nil))
+	p.next(t)
+	p.none(t, 40*time.Millisecond)
+}
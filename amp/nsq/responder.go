@@ -2,51 +2,197 @@ package nsq
 
 import (
 	"context"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/chaos"
 	"github.com/minus5/svckit/log"
 	"github.com/minus5/svckit/nsq"
 )
 
 type Responder struct {
+	queued  int64 // requests waiting for the worker, first for the atomic alignment
+	ctx     context.Context
 	done    chan struct{}
-	handler func(m *amp.Msg) (*amp.Msg, error)
+	handler amp.Handler
+	pub     *nsq.Producer
+	opts    *options
+	cancels *cancels // running requests, nil without CancelRequests
 }
 
+// NewResponder calls handler for each message on the topics,
+// and publishes response to the message ReplyTo topic.
+// Handler is called from Concurrency workers, by default one.
+// Handler panic is recovered and returned as error response.
+// With Dedupe option duplicate requests get cached response.
+// Handler ctx is done when ctx is done or request deadline passes,
+// requests which are already expired are dropped without calling handler.
+// Failed requests are requeued or sent to the dead letter topic by the
+// error classification (see Retry and DeadLetter options).
+// With StickyInstance responder also handles requests routed to this
+// instance. With CancelRequests handler ctx is also done when the client
+// of the request disconnects.
+// Handler ctx has the queue state of the request (see amp.QueueFromContext):
+// how long it waited for the worker and how many requests are waiting.
 func NewResponder(ctx context.Context,
-	handler func(m *amp.Msg) (*amp.Msg, error),
-	topics []string) *Responder {
+	handler amp.Handler,
+	topics []string, opts ...func(*options)) *Responder {
 
+	o := (&options{concurrency: 1}).apply(opts...)
+	h := amp.Instrument(amp.Recover(chaos.Get().Handler(handler)))
+	if o.dedupeTTL > 0 {
+		h = amp.Dedupe(o.dedupeTTL, h)
+	}
 	r := &Responder{
+		ctx:     ctx,
 		done:    make(chan struct{}),
-		handler: handler,
+		handler: h,
+		opts:    o,
 	}
 
-	in := Subscribe(ctx, topics)
-	go r.loop(in)
+	if o.cancel {
+		r.cancels = newCancels()
+		r.cancels.consume(ctx)
+	}
+	if o.instanceID != "" {
+		all := append([]string{}, topics...)
+		for _, t := range topics {
+			all = append(all, InstanceTopic(t, o.instanceID))
+		}
+		topics = all
+	}
+	next := subscribeRequests(ctx, topics, o, &r.queued)
+	go r.loop(next, o)
 	return r
 }
 
-func (r *Responder) loop(in <-chan *amp.Msg) {
+func (r *Responder) loop(next func() (delivery, bool), o *options) {
 	defer close(r.done)
 
-	pub := nsq.Pub("")
-	defer pub.Close()
+	r.pub = nsq.Pub("")
+	defer r.pub.Close()
+
+	var wg sync.WaitGroup
+	work := func(ch <-chan delivery) {
+		defer wg.Done()
+		for d := range ch {
+			r.handle(d)
+		}
+	}
+
+	if o.orderKey == nil {
+		// all workers take from the same input
+		wg.Add(o.concurrency)
+		for i := 0; i < o.concurrency; i++ {
+			go func() {
+				defer wg.Done()
+				for {
+					d, ok := next()
+					if !ok {
+						return
+					}
+					r.handle(d)
+				}
+			}()
+		}
+		wg.Wait()
+		return
+	}
+
+	// messages with the same key go to the same worker
+	// with fair queue workers don't buffer, to keep the fair order
+	buffer := 16
+	if o.fairWeights != nil {
+		buffer = 0
+	}
+	workers := make([]chan delivery, o.concurrency)
+	for i := range workers {
+		workers[i] = make(chan delivery, buffer)
+		wg.Add(1)
+		go work(workers[i])
+	}
+	for {
+		d, ok := next()
+		if !ok {
+			break
+		}
+		workers[keyHash(o.orderKey(d.m))%uint32(len(workers))] <- d
+	}
+	for _, w := range workers {
+		close(w)
+	}
+	wg.Wait()
+}
 
-	for m := range in {
-		rm, err := r.handler(m)
-		if err != nil {
-			rm = m.ResponseError(err)
+func (r *Responder) handle(d delivery) {
+	m := d.m
+	depth := atomic.AddInt64(&r.queued, -1)
+	if m.Expired() {
+		amp.CountMsg("expired", m)
+		d.nm.Finish()
+		return
+	}
+	ctx, cancel := amp.NewContext(r.ctx, m)
+	ctx = amp.WithQueue(ctx, amp.Queue{Wait: time.Since(d.received), Depth: int(depth)})
+	if r.cancels != nil {
+		if !r.cancels.start(m, cancel) {
+			cancel()
+			amp.CountMsg("cancelled", m)
+			d.nm.Finish()
+			return
 		}
-		if rm == nil || m.ReplyTo == "" {
-			continue
+		defer r.cancels.done(m)
+	}
+	rm, err := r.handler(ctx, m)
+	cancel()
+	if err != nil {
+		if amp.IsRetryable(err) && int(d.nm.Attempts) < r.opts.retryAttempts {
+			amp.CountMsg("requeue", m)
+			d.nm.RequeueWithoutBackoff(r.opts.requeueDelay(d.nm.Attempts))
+			return
 		}
-		if err := pub.PublishTo(m.ReplyTo, rm.Marshal()); err != nil {
-			log.Error(err)
+		if amp.IsPermanent(err) || amp.IsRetryable(err) {
+			r.deadLetter(m, err)
 		}
+		rm = m.ResponseError(err)
+	}
+	d.nm.Finish()
+	if rm == nil || m.ReplyTo == "" {
+		return
+	}
+	if err := r.pub.PublishTo(m.ReplyTo, rm.Marshal()); err != nil {
+		log.Error(err)
 	}
 }
 
+// deadLetter publishes failed request to the dead letter topic
+func (r *Responder) deadLetter(m *amp.Msg, err error) {
+	if r.opts.deadLetter == "" {
+		return
+	}
+	dm := m.Request()
+	dm.ReplyTo = m.ReplyTo
+	dm.Meta = make(map[string]string, len(m.Meta)+1)
+	for k, v := range m.Meta {
+		dm.Meta[k] = v
+	}
+	dm.Meta["error"] = err.Error()
+	if err := r.pub.PublishTo(r.opts.deadLetter, dm.Marshal()); err != nil {
+		log.S("topic", r.opts.deadLetter).Error(err)
+		return
+	}
+	amp.CountMsg("deadLetter", m)
+}
+
 func (r *Responder) Wait() {
 	<-r.done
 }
+
+func keyHash(key string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum32()
+}
@@ -0,0 +1,168 @@
+package nsq
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/presence"
+	"github.com/minus5/svckit/metric"
+)
+
+// virtual nodes per instance on the hash ring
+const stickyReplicas = 64
+
+// Sticky routes requests with entity key always to the same responder
+// instance, so handlers can keep per entity state in memory.
+// Instances are placed on the consistent hash ring, when instance is
+// added or removed only keys of that instance move to other instances.
+// Request is sent to the instance topic (see InstanceTopic), responder
+// subscribes to it with StickyInstance option.
+// Requests without key, or for topics without instances, are sent to
+// the topic and handled by any instance. Instances not refreshed within
+// ttl (set by WatchPresence) are not used, requests fall back to the topic.
+type Sticky struct {
+	key   func(*amp.Msg) string
+	rings map[string]*hashRing
+	ttl   time.Duration
+	sync.RWMutex
+}
+
+// NewSticky creates empty sticky routing table. Key returns entity key
+// of the request, EntityKey if nil.
+func NewSticky(key func(*amp.Msg) string) *Sticky {
+	if key == nil {
+		key = EntityKey
+	}
+	return &Sticky{key: key, rings: make(map[string]*hashRing)}
+}
+
+// EntityKey is path of the request uri after the method,
+// for uri cart.req/add/42 key is 42.
+func EntityKey(m *amp.Msg) string {
+	p := m.Path()
+	if i := strings.IndexByte(p, '/'); i >= 0 {
+		return p[i+1:]
+	}
+	return ""
+}
+
+// InstanceTopic is topic of the responder instance.
+func InstanceTopic(topic, instanceID string) string {
+	return fmt.Sprintf("%s.%08x", topic, keyHash(instanceID))
+}
+
+// Set replaces responder instances of the topic.
+// Empty instances removes sticky routing for the topic.
+func (s *Sticky) Set(topic string, instances []string) {
+	s.Lock()
+	defer s.Unlock()
+	if len(instances) == 0 {
+		delete(s.rings, topic)
+		return
+	}
+	r := newHashRing(instances)
+	r.updated = time.Now()
+	s.rings[topic] = r
+}
+
+// Topic returns topic where the request should be sent.
+func (s *Sticky) Topic(m *amp.Msg) string {
+	if topic, ok := s.route(m); ok {
+		return topic
+	}
+	return m.Topic()
+}
+
+// route returns instance topic, false if request is not sticky
+func (s *Sticky) route(m *amp.Msg) (string, bool) {
+	key := s.key(m)
+	if key == "" {
+		return "", false
+	}
+	topic := m.Topic()
+	s.RLock()
+	r, ok := s.rings[topic]
+	ttl := s.ttl
+	s.RUnlock()
+	if !ok {
+		return "", false
+	}
+	if ttl > 0 && time.Since(r.updated) > ttl {
+		metric.Counter("sticky.stale")
+		return "", false
+	}
+	return InstanceTopic(topic, r.get(key)), true
+}
+
+// Instances returns ids of the alive components of the app.
+func Instances(alive []presence.Info, app string) []string {
+	var ids []string
+	for _, i := range alive {
+		if i.App == app && i.Kind == presence.Service {
+			ids = append(ids, i.ID())
+		}
+	}
+	return ids
+}
+
+// WatchPresence sets instances of the topics from presence registry
+// every interval until ctx is done. Apps maps topic to the responder app.
+// Instances not refreshed within three intervals are not used.
+func (s *Sticky) WatchPresence(ctx context.Context, reg *presence.Registry, apps map[string]string, interval time.Duration) {
+	s.Lock()
+	s.ttl = 3 * interval
+	s.Unlock()
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			alive := reg.Alive()
+			for topic, app := range apps {
+				s.Set(topic, Instances(alive, app))
+			}
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// hashRing is consistent hash ring of the instances
+type hashRing struct {
+	hashes    []uint32
+	instances map[uint32]string
+	updated   time.Time
+}
+
+func newHashRing(instances []string) *hashRing {
+	r := &hashRing{instances: make(map[uint32]string)}
+	for _, id := range instances {
+		for i := 0; i < stickyReplicas; i++ {
+			h := keyHash(fmt.Sprintf("%s#%d", id, i))
+			if _, ok := r.instances[h]; ok {
+				continue
+			}
+			r.instances[h] = id
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// get returns instance of the key, first on the ring after key hash
+func (r *hashRing) get(key string) string {
+	h := keyHash(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.instances[r.hashes[i]]
+}
@@ -0,0 +1,63 @@
+package nsq
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/presence"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSticky(t *testing.T) {
+	s := NewSticky(nil)
+	m := &amp.Msg{URI: "cart.req/add/42"}
+	assert.Equal(t, "42", EntityKey(m))
+	assert.Equal(t, "cart.req", s.Topic(m))
+
+	s.Set("cart.req", []string{"a", "b", "c"})
+	topic := s.Topic(m)
+	assert.Contains(t, []string{InstanceTopic("cart.req", "a"), InstanceTopic("cart.req", "b"), InstanceTopic("cart.req", "c")}, topic)
+	// without key any instance
+	assert.Equal(t, "cart.req", s.Topic(&amp.Msg{URI: "cart.req/list"}))
+
+	// only keys of the removed instance move
+	keys := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		m := &amp.Msg{URI: fmt.Sprintf("cart.req/add/%d", i)}
+		keys[m.URI] = s.Topic(m)
+	}
+	s.Set("cart.req", []string{"a", "b"})
+	moved := 0
+	for uri, before := range keys {
+		after := s.Topic(&amp.Msg{URI: uri})
+		if before == InstanceTopic("cart.req", "c") {
+			assert.NotEqual(t, before, after)
+			moved++
+			continue
+		}
+		assert.Equal(t, before, after)
+	}
+	assert.InDelta(t, 333, moved, 120)
+
+	s.Set("cart.req", nil)
+	assert.Equal(t, "cart.req", s.Topic(m))
+
+	// instances not refreshed within ttl are not used
+	s.ttl = 10 * time.Millisecond
+	s.Set("cart.req", []string{"a"})
+	assert.Equal(t, InstanceTopic("cart.req", "a"), s.Topic(m))
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, "cart.req", s.Topic(m))
+	s.Set("cart.req", []string{"a"})
+	assert.Equal(t, InstanceTopic("cart.req", "a"), s.Topic(m))
+
+	alive := []presence.Info{
+		{App: "cart", Host: "h1", Kind: presence.Service},
+		{App: "cart", Host: "h2", Kind: presence.Service},
+		{App: "cart", Host: "h3", Kind: presence.Gateway},
+		{App: "math", Host: "h1", Kind: presence.Service},
+	}
+	assert.Len(t, Instances(alive, "cart"), 2)
+}
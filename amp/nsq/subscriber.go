@@ -3,17 +3,33 @@ package nsq
 import (
 	"context"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/minus5/svckit/amp"
 	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
 	"github.com/minus5/svckit/nsq"
 	"github.com/pkg/errors"
 )
 
 type subscriber struct {
-	subs []*nsq.Consumer
-	out  chan *amp.Msg
-	msgs sync.WaitGroup
+	subs     []*nsq.Consumer
+	out      chan *amp.Msg
+	requests chan delivery // used by responder instead of out
+	fair     *fairQueue    // used by responder with FairQueue instead of requests
+	msgs     sync.WaitGroup
+	orderer  *orderer
+	verify   func(uri string)
+	queued   *int64 // number of requests waiting for the responder worker
+}
+
+// delivery is received request with its nsq message,
+// responder finishes or requeues the message after handling request
+type delivery struct {
+	m        *amp.Msg
+	nm       *nsq.Message
+	received time.Time
 }
 
 func (s *subscriber) onMessage(m *nsq.Message) error {
@@ -23,18 +39,49 @@ func (s *subscriber) onMessage(m *nsq.Message) error {
 	if am == nil {
 		return nil
 	}
-	if am.IsAlive() {
+	if am.IsAlive() && am.URI == "" {
 		log.Info("alive")
+		am.Release()
+		return nil
+	}
+	amp.CountMsg("receive", am)
+	if s.verify != nil && !am.VerifyChecksum() {
+		log.S("uri", am.URI).I("ts", int(am.Ts)).ErrorS("checksum mismatch")
+		metric.Counter("checksumMismatch")
+		go s.verify(am.URI)
+		am.Release()
+		return nil
+	}
+	if s.fair != nil || s.requests != nil {
+		m.DisableAutoResponse()
+		d := delivery{m: am, nm: m, received: time.Now()}
+		atomic.AddInt64(s.queued, 1)
+		if s.fair != nil {
+			s.fair.push(d)
+		} else {
+			s.requests <- d
+		}
+		return nil
+	}
+	if s.orderer != nil && !am.IsAlive() {
+		s.orderer.in <- orderedMsg{msg: am, seq: string(m.ID[:])}
 		return nil
 	}
 	s.out <- am
 	return nil
 }
 
-func Subscribe(ctx context.Context, topics []string) <-chan *amp.Msg {
+// Subscribe to the nsq topics.
+// Returns channel of received messages which is closed when ctx is done.
+func Subscribe(ctx context.Context, topics []string, opts ...func(*options)) <-chan *amp.Msg {
+	o := (&options{}).apply(opts...)
 	out := make(chan *amp.Msg, 16)
 	s := &subscriber{
-		out: out,
+		out:    out,
+		verify: o.verify,
+	}
+	if o.orderingWindow > 0 {
+		s.orderer = newOrderer(o.orderingWindow, o.current, out)
 	}
 	if err := s.subscribe(topics); err != nil {
 		log.Fatal(err)
@@ -43,10 +90,54 @@ func Subscribe(ctx context.Context, topics []string) <-chan *amp.Msg {
 	return out
 }
 
+// subscribeRequests subscribes to the request topics.
+// Returns function which blocks until next request is received, it
+// returns false when ctx is done and all requests are taken.
+// Returned deliveries must be finished or requeued.
+// With fair queue request is taken from the queue only when worker
+// calls next, so requests are not buffered out of the fair order.
+// Received requests are counted in queued, worker decrements it when it
+// takes the request.
+func subscribeRequests(ctx context.Context, topics []string, o *options, queued *int64) func() (delivery, bool) {
+	s := &subscriber{
+		verify: o.verify,
+		queued: queued,
+	}
+	var next func() (delivery, bool)
+	if o.fairWeights != nil {
+		s.fair = newFairQueue(o.fairWeights)
+		next = s.fair.pop
+	} else {
+		requests := make(chan delivery, 16)
+		s.requests = requests
+		next = func() (delivery, bool) {
+			d, ok := <-requests
+			return d, ok
+		}
+	}
+	if err := s.subscribe(topics); err != nil {
+		log.Fatal(err)
+	}
+	go s.waitClose(ctx)
+	return next
+}
+
 func (s *subscriber) waitClose(ctx context.Context) {
 	<-ctx.Done()
 	s.close()
 	s.msgs.Wait()
+	if s.fair != nil {
+		s.fair.close()
+		return
+	}
+	if s.requests != nil {
+		close(s.requests)
+		return
+	}
+	if s.orderer != nil {
+		close(s.orderer.in) // orderer closes out
+		return
+	}
 	close(s.out)
 }
 
@@ -0,0 +1,206 @@
+// Package outbox implements transactional outbox for amp messages.
+//
+// Service writes message into the outbox table in the same database
+// transaction in which it changes its data, so message is published if
+// and only if transaction is committed:
+//
+//	tx, _ := db.Begin()
+//	... update data
+//	ob.Add(ctx, tx, amp.NewPublish(...))
+//	tx.Commit()
+//
+// Relay reads the table in insert order and publishes messages. Rows are
+// deleted after messages are successfully published, so message could be
+// published twice if relay is stopped in between (consumers drop
+// duplicates by Ts). Run single relay, e.g. on the leader instance (see
+// leader package):
+//
+//	pub := nsq.Pub("")
+//	go ob.Relay(ctx, func(m *amp.Msg) error {
+//		return pub.PublishTo(m.Topic(), m.Marshal())
+//	})
+//
+// Outbox table:
+//
+//	CREATE TABLE amp_outbox (
+//	  id      BIGSERIAL PRIMARY KEY, -- AUTO_INCREMENT for MySQL
+//	  topic   VARCHAR(255) NOT NULL,
+//	  payload BYTEA NOT NULL         -- BLOB for MySQL
+//	);
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+	"github.com/pkg/errors"
+)
+
+// Execer is *sql.Tx (or *sql.DB).
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+type options struct {
+	table        string
+	dollar       bool
+	batch        int
+	pollInterval time.Duration
+}
+
+// Table sets outbox table name, default amp_outbox.
+func Table(name string) func(*options) {
+	return func(o *options) {
+		o.table = name
+	}
+}
+
+// Dollar uses $1, $2... placeholders (PostgreSQL), default is ?.
+func Dollar() func(*options) {
+	return func(o *options) {
+		o.dollar = true
+	}
+}
+
+// Batch sets max number of rows relay reads at once, default 100.
+func Batch(n int) func(*options) {
+	return func(o *options) {
+		o.batch = n
+	}
+}
+
+// PollInterval sets how often relay checks empty outbox, default 1s.
+func PollInterval(d time.Duration) func(*options) {
+	return func(o *options) {
+		o.pollInterval = d
+	}
+}
+
+// Outbox writes messages to the outbox table and relays them to the publisher.
+type Outbox struct {
+	db *sql.DB
+	o  *options
+}
+
+// New creates outbox in the db.
+func New(db *sql.DB, opts ...func(*options)) *Outbox {
+	o := &options{
+		table:        "amp_outbox",
+		batch:        100,
+		pollInterval: time.Second,
+	}
+	for _, fn := range opts {
+		fn(o)
+	}
+	return &Outbox{db: db, o: o}
+}
+
+// placeholder returns n-th (from 1) query placeholder
+func (ob *Outbox) placeholder(n int) string {
+	if ob.o.dollar {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+// Add writes message to the outbox in the transaction tx.
+func (ob *Outbox) Add(ctx context.Context, tx Execer, m *amp.Msg) error {
+	q := fmt.Sprintf("INSERT INTO %s (topic, payload) VALUES (%s, %s)",
+		ob.o.table, ob.placeholder(1), ob.placeholder(2))
+	_, err := tx.ExecContext(ctx, q, m.Topic(), m.Marshal())
+	return errors.WithStack(err)
+}
+
+type row struct {
+	id      int64
+	payload []byte
+}
+
+// Relay publishes outbox messages until ctx is done. Message which
+// failed to publish is retried after poll interval, with the messages
+// after it.
+func (ob *Outbox) Relay(ctx context.Context, publish func(*amp.Msg) error) {
+	for {
+		n, err := ob.relay(ctx, publish)
+		if err != nil {
+			log.Error(err)
+			metric.Counter("outbox.error")
+		}
+		if n == ob.o.batch && err == nil {
+			continue // more rows waiting
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(ob.o.pollInterval):
+		}
+	}
+}
+
+// relay publishes one batch, returns number of relayed messages
+func (ob *Outbox) relay(ctx context.Context, publish func(*amp.Msg) error) (int, error) {
+	rows, err := ob.fetch(ctx)
+	if err != nil || len(rows) == 0 {
+		return 0, err
+	}
+	ids := make([]int64, 0, len(rows))
+	for _, r := range rows {
+		if ctx.Err() != nil {
+			break
+		}
+		m := amp.Parse(r.payload)
+		if m == nil {
+			ids = append(ids, r.id) // unparsable, logged in Parse, delete it
+			continue
+		}
+		if err := publish(m); err != nil {
+			// delete only published messages
+			if derr := ob.delete(context.Background(), ids); derr != nil {
+				log.Error(derr)
+			}
+			return len(ids), errors.Wrap(err, "publish")
+		}
+		ids = append(ids, r.id)
+	}
+	metric.Counter("outbox.relayed", len(ids))
+	return len(ids), ob.delete(context.Background(), ids)
+}
+
+func (ob *Outbox) fetch(ctx context.Context) ([]row, error) {
+	q := fmt.Sprintf("SELECT id, payload FROM %s ORDER BY id LIMIT %d", ob.o.table, ob.o.batch)
+	rs, err := ob.db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rs.Close()
+	var rows []row
+	for rs.Next() {
+		var r row
+		if err := rs.Scan(&r.id, &r.payload); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		rows = append(rows, r)
+	}
+	return rows, errors.WithStack(rs.Err())
+}
+
+func (ob *Outbox) delete(ctx context.Context, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	ps := make([]string, len(ids))
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		ps[i] = ob.placeholder(i + 1)
+		args[i] = id
+	}
+	q := fmt.Sprintf("DELETE FROM %s WHERE id IN (%s)", ob.o.table, strings.Join(ps, ", "))
+	_, err := ob.db.ExecContext(ctx, q, args...)
+	return errors.WithStack(err)
+}
@@ -0,0 +1,139 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+// memory driver, understands only outbox queries
+type memDB struct {
+	rows   map[int64][]byte
+	lastID int64
+	sync.Mutex
+}
+
+var mem = &memDB{rows: make(map[int64][]byte)}
+
+func init() {
+	sql.Register("outboxmem", mem)
+}
+
+func (d *memDB) Open(name string) (driver.Conn, error) { return d, nil }
+func (d *memDB) Prepare(query string) (driver.Stmt, error) {
+	return &memStmt{db: d, query: query}, nil
+}
+func (d *memDB) Close() error              { return nil }
+func (d *memDB) Begin() (driver.Tx, error) { return d, nil }
+func (d *memDB) Commit() error             { return nil }
+func (d *memDB) Rollback() error           { return nil }
+
+type memStmt struct {
+	db    *memDB
+	query string
+}
+
+func (s *memStmt) Close() error  { return nil }
+func (s *memStmt) NumInput() int { return -1 }
+func (s *memStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.Lock()
+	defer s.db.Unlock()
+	switch {
+	case strings.HasPrefix(s.query, "INSERT"):
+		s.db.lastID++
+		s.db.rows[s.db.lastID] = args[1].([]byte)
+	case strings.HasPrefix(s.query, "DELETE"):
+		for _, a := range args {
+			delete(s.db.rows, a.(int64))
+		}
+	}
+	return driver.RowsAffected(1), nil
+}
+func (s *memStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.Lock()
+	defer s.db.Unlock()
+	r := &memRows{}
+	for id := range s.db.rows {
+		r.ids = append(r.ids, id)
+	}
+	sort.Slice(r.ids, func(i, j int) bool { return r.ids[i] < r.ids[j] })
+	for _, id := range r.ids {
+		r.payloads = append(r.payloads, s.db.rows[id])
+	}
+	return r, nil
+}
+
+type memRows struct {
+	ids      []int64
+	payloads [][]byte
+	i        int
+}
+
+func (r *memRows) Columns() []string { return []string{"id", "payload"} }
+func (r *memRows) Close() error      { return nil }
+func (r *memRows) Next(dest []driver.Value) error {
+	if r.i >= len(r.ids) {
+		return io.EOF
+	}
+	dest[0], dest[1] = r.ids[r.i], r.payloads[r.i]
+	r.i++
+	return nil
+}
+
+func TestRelay(t *testing.T) {
+	db, err := sql.Open("outboxmem", "")
+	assert.Nil(t, err)
+	ob := New(db, Dollar(), PollInterval(time.Millisecond))
+	assert.Equal(t, "$2", ob.placeholder(2))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tx, err := db.Begin()
+	assert.Nil(t, err)
+	for ts := int64(1); ts <= 3; ts++ {
+		assert.Nil(t, ob.Add(ctx, tx, amp.NewPublish("math.v1", "i", ts, amp.Diff, nil)))
+	}
+	assert.Nil(t, tx.Commit())
+
+	msgs := make(chan *amp.Msg, 16)
+	fail := true
+	done := make(chan struct{})
+	go func() {
+		ob.Relay(ctx, func(m *amp.Msg) error {
+			if m.Ts == 2 && fail {
+				// first publish of the second message fails
+				fail = false
+				mem.Lock()
+				assert.Len(t, mem.rows, 3)
+				mem.Unlock()
+				return errors.New("nsqd unavailable")
+			}
+			msgs <- m
+			return nil
+		})
+		close(done)
+	}()
+	for ts := int64(1); ts <= 3; ts++ {
+		m := <-msgs
+		assert.Equal(t, ts, m.Ts)
+		assert.Equal(t, "math.v1/i", m.URI)
+	}
+	// deleted after publish
+	time.Sleep(10 * time.Millisecond)
+	mem.Lock()
+	assert.Len(t, mem.rows, 0)
+	mem.Unlock()
+
+	cancel()
+	<-done
+	assert.Len(t, msgs, 0)
+}
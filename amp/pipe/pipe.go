@@ -0,0 +1,140 @@
+// Package pipe has composable operators over amp message channels.
+//
+// Each operator reads from in until it is closed and returns output
+// channel which is closed after in, so operators are chained by nesting:
+//
+//	out := pipe.Throttle(pipe.Filter(in, isDiff), time.Millisecond)
+//	pub := nsq.NewPublisher(broker.Pipe(out))
+package pipe
+
+import (
+	"time"
+
+	"github.com/minus5/svckit/amp"
+)
+
+// Map replaces each message with the result of fn.
+// Messages for which fn returns nil are dropped.
+func Map(in <-chan *amp.Msg, fn func(*amp.Msg) *amp.Msg) <-chan *amp.Msg {
+	out := make(chan *amp.Msg)
+	go func() {
+		defer close(out)
+		for m := range in {
+			if m = fn(m); m != nil {
+				out <- m
+			}
+		}
+	}()
+	return out
+}
+
+// Filter passes only messages for which fn returns true.
+func Filter(in <-chan *amp.Msg, fn func(*amp.Msg) bool) <-chan *amp.Msg {
+	return Map(in, func(m *amp.Msg) *amp.Msg {
+		if fn(m) {
+			return m
+		}
+		return nil
+	})
+}
+
+// Throttle limits rate to one message per interval.
+// Messages are delayed, never dropped.
+func Throttle(in <-chan *amp.Msg, interval time.Duration) <-chan *amp.Msg {
+	out := make(chan *amp.Msg)
+	go func() {
+		defer close(out)
+		var last time.Time
+		for m := range in {
+			if wait := interval - time.Since(last); wait > 0 {
+				time.Sleep(wait)
+			}
+			out <- m
+			last = time.Now()
+		}
+	}()
+	return out
+}
+
+// Debounce holds Full and Update messages until there is no newer one for
+// the same uri within interval, so only the last one of the burst is sent.
+// Other messages are passed immediately, after the held message for the
+// same uri, to keep the order.
+func Debounce(in <-chan *amp.Msg, interval time.Duration) <-chan *amp.Msg {
+	out := make(chan *amp.Msg)
+	go func() {
+		defer close(out)
+		type held struct {
+			m  *amp.Msg
+			at time.Time
+		}
+		pending := make(map[string]held)
+		tick := time.NewTicker(interval / 2)
+		defer tick.Stop()
+		flush := func(all bool) {
+			for uri, h := range pending {
+				if all || time.Since(h.at) >= interval {
+					out <- h.m
+					delete(pending, uri)
+				}
+			}
+		}
+		for {
+			select {
+			case m, ok := <-in:
+				if !ok {
+					flush(true)
+					return
+				}
+				if m.Type == amp.Publish && (m.UpdateType == amp.Full || m.UpdateType == amp.Update) {
+					pending[m.URI] = held{m: m, at: time.Now()}
+					continue
+				}
+				if h, ok := pending[m.URI]; ok {
+					out <- h.m
+					delete(pending, m.URI)
+				}
+				out <- m
+			case <-tick.C:
+				flush(false)
+			}
+		}
+	}()
+	return out
+}
+
+// Buffer decouples producer from the consumer with buffer of size messages.
+func Buffer(in <-chan *amp.Msg, size int) <-chan *amp.Msg {
+	out := make(chan *amp.Msg, size)
+	go func() {
+		defer close(out)
+		for m := range in {
+			out <- m
+		}
+	}()
+	return out
+}
+
+// Tee sends each message to n output channels.
+// Slowest consumer sets the pace for all.
+func Tee(in <-chan *amp.Msg, n int) []<-chan *amp.Msg {
+	outs := make([]chan *amp.Msg, n)
+	ret := make([]<-chan *amp.Msg, n)
+	for i := range outs {
+		outs[i] = make(chan *amp.Msg)
+		ret[i] = outs[i]
+	}
+	go func() {
+		defer func() {
+			for _, out := range outs {
+				close(out)
+			}
+		}()
+		for m := range in {
+			for _, out := range outs {
+				out <- m
+			}
+		}
+	}()
+	return ret
+}
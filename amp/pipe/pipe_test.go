@@ -0,0 +1,70 @@
+package pipe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func source(msgs ...*amp.Msg) <-chan *amp.Msg {
+	in := make(chan *amp.Msg, len(msgs))
+	for _, m := range msgs {
+		in <- m
+	}
+	close(in)
+	return in
+}
+
+func collect(in <-chan *amp.Msg) []int64 {
+	var ts []int64
+	for m := range in {
+		ts = append(ts, m.Ts)
+	}
+	return ts
+}
+
+func publish(uri string, ts int64, updateType uint8) *amp.Msg {
+	return amp.NewPublish(uri, "", ts, updateType, nil)
+}
+
+func TestMapFilter(t *testing.T) {
+	in := source(publish("a", 1, amp.Diff), publish("b", 2, amp.Diff), publish("a", 3, amp.Full))
+	out := Map(Filter(in, func(m *amp.Msg) bool { return m.URI == "a" }),
+		func(m *amp.Msg) *amp.Msg {
+			m.Ts *= 10
+			return m
+		})
+	assert.Equal(t, []int64{10, 30}, collect(out))
+}
+
+func TestThrottle(t *testing.T) {
+	start := time.Now()
+	out := Throttle(source(publish("a", 1, amp.Diff), publish("a", 2, amp.Diff), publish("a", 3, amp.Diff)), 10*time.Millisecond)
+	assert.Equal(t, []int64{1, 2, 3}, collect(out))
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+}
+
+func TestDebounce(t *testing.T) {
+	in := make(chan *amp.Msg)
+	out := Debounce(in, 20*time.Millisecond)
+	go func() {
+		in <- publish("a", 1, amp.Full)
+		in <- publish("a", 2, amp.Full)
+		in <- publish("b", 3, amp.Full)
+		in <- publish("b", 4, amp.Diff) // flushes held 3
+		time.Sleep(50 * time.Millisecond)
+		in <- publish("a", 5, amp.Full)
+		close(in)
+	}()
+	assert.Equal(t, []int64{3, 4, 2, 5}, collect(out))
+}
+
+func TestTeeBuffer(t *testing.T) {
+	outs := Tee(Buffer(source(publish("a", 1, amp.Diff), publish("a", 2, amp.Diff)), 2), 2)
+	done := make(chan []int64)
+	go func() { done <- collect(outs[1]) }()
+	assert.Equal(t, []int64{1, 2}, collect(outs[0]))
+	assert.Equal(t, []int64{1, 2}, <-done)
+}
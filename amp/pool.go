@@ -0,0 +1,88 @@
+package amp
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	msgPool = sync.Pool{
+		New: func() interface{} { return &Msg{} },
+	}
+	bufPool = sync.Pool{
+		New: func() interface{} { return bytes.NewBuffer(make([]byte, 0, 1024)) },
+	}
+	flatePool    sync.Pool // *flate.Writer, allocating new one is expensive
+	deflateRatio ratio     // compression ratio of the deflated payloads
+)
+
+func acquireMsg() *Msg {
+	return msgPool.Get().(*Msg)
+}
+
+// Release returns message to the pool of messages used by Parse.
+// Message must not be used after Release. Release only messages which are
+// not referenced anywhere else (not in broker cache, not sent to subscribers).
+func (m *Msg) Release() {
+	m.reset()
+	msgPool.Put(m)
+}
+
+// reset clears all fields. Message owns no buffers worth reusing, body and
+// payloads may still be referenced by the parsed frame or by the connections
+// they were sent to.
+func (m *Msg) reset() {
+	*m = Msg{}
+}
+
+func acquireBuf() *bytes.Buffer {
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func releaseBuf(buf *bytes.Buffer) {
+	bufPool.Put(buf)
+}
+
+func acquireFlate(w io.Writer) *flate.Writer {
+	if c, ok := flatePool.Get().(*flate.Writer); ok {
+		c.Reset(w)
+		return c
+	}
+	c, _ := flate.NewWriter(w, flate.DefaultCompression)
+	return c
+}
+
+func releaseFlate(c *flate.Writer) {
+	flatePool.Put(c)
+}
+
+// ratio is moving average of the output/input size ratio, in 1/1024 units.
+type ratio struct {
+	v int64
+}
+
+// size returns expected output size for the input of n bytes
+func (r *ratio) size(n int) int {
+	v := atomic.LoadInt64(&r.v)
+	if v == 0 {
+		return n
+	}
+	// room for the flush marker and variance of the ratio
+	return int(int64(n)*v/1024) + 64
+}
+
+func (r *ratio) update(in, out int) {
+	if in == 0 {
+		return
+	}
+	v := int64(out) * 1024 / int64(in)
+	if old := atomic.LoadInt64(&r.v); old != 0 {
+		v = (old*7 + v) / 8
+	}
+	atomic.StoreInt64(&r.v, v)
+}
@@ -0,0 +1,94 @@
+package amp
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var benchBody = map[string]interface{}{
+	"id":    123456,
+	"name":  "Dinamo - Hajduk",
+	"odds":  []float64{1.45, 3.2, 5.75},
+	"start": "2019-04-12T18:00:00Z",
+}
+
+func TestRelease(t *testing.T) {
+	m := Parse([]byte(`{"t":2,"i":1,"u":"math.req/add","b":{"a":1}}` + "\n" + `{"x":1}`))
+	assert.NotNil(t, m)
+	m.Release()
+	m = acquireMsg()
+	assert.Equal(t, "", m.URI)
+	assert.Nil(t, m.Subscriptions)
+	assert.Nil(t, m.body)
+	assert.Nil(t, m.payloads)
+}
+
+func TestResetHeader(t *testing.T) {
+	m := Parse([]byte(`{"t":3,"i":1,"u":"chat/lobby","s":5,"p":1,"q":true,"v":2,"a":9,"m":{"user":"u1"}}` + "\n" + `{"x":1}`))
+	assert.True(t, m.RequiresAck)
+	m.reset()
+	// all header fields are cleared, so pooled message doesn't carry
+	// them into the next one
+	v := reflect.ValueOf(m).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if f := v.Type().Field(i); f.PkgPath == "" && f.Name != "Mutex" {
+			assert.Equal(t, reflect.Zero(f.Type).Interface(), v.Field(i).Interface(), f.Name)
+		}
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	buf := NewPublish("sportsbook", "m", 123, Diff, benchBody).Marshal()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Parse(buf)
+	}
+}
+
+func BenchmarkParseRelease(b *testing.B) {
+	buf := NewPublish("sportsbook", "m", 123, Diff, benchBody).Marshal()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Parse(buf).Release()
+	}
+}
+
+func BenchmarkMarshal(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		NewPublish("sportsbook", "m", 123, Diff, benchBody).Marshal()
+	}
+}
+
+// BenchmarkMarshalDeflate each message is deflated once,
+// as the first subscriber on deflate connection does.
+func BenchmarkMarshalDeflate(b *testing.B) {
+	b.ReportAllocs()
+	p := CompressionPolicy{Mode: CompressAlways}
+	for i := 0; i < b.N; i++ {
+		NewPublish("sportsbook", "m", 123, Diff, benchBody).MarshalPolicy(CompatibilityVersionDefault, p)
+	}
+}
+
+func BenchmarkTopicPath(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m := &Msg{URI: "sportsbook/events/123"}
+		m.Topic()
+		m.Path()
+	}
+}
+
+// BenchmarkFanOut publish message to 1000 subscribers,
+// payload is created once and reused for all of them.
+func BenchmarkFanOut(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m := NewPublish("sportsbook", "m", 123, Diff, benchBody)
+		for j := 0; j < 1000; j++ {
+			m.MarshalDeflate()
+		}
+	}
+}
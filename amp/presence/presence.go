@@ -0,0 +1,187 @@
+// Package presence tracks which services and gateways are alive.
+//
+// Each component periodically publishes amp.Alive message with its
+// identity on the presence topic:
+//
+//	presence.Announce(ctx, presence.Gateway, version, 10*time.Second, pub.Publish)
+//
+// Registry consumes presence topic and shows alive components:
+//
+//	reg := presence.NewRegistry(30 * time.Second)
+//	go reg.Consume(ctx, nsq.Subscribe(ctx, []string{presence.Topic}))
+//	reg.Route(httpi.Subrouter("/presence"))
+package presence
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/env"
+	"github.com/minus5/svckit/httpi"
+	"github.com/minus5/svckit/log"
+)
+
+// Topic is topic of the presence Alive messages.
+const Topic = "system.presence"
+
+// Component kinds
+const (
+	Service = "service"
+	Gateway = "gateway"
+)
+
+var start = time.Now()
+
+// Info is identity of the component, body of the presence message.
+type Info struct {
+	App      string    `json:"app"`
+	Host     string    `json:"host"`
+	Instance string    `json:"instance,omitempty"`
+	Dc       string    `json:"dc,omitempty"`
+	Kind     string    `json:"kind"`
+	Version  string    `json:"version,omitempty"`
+	Groups   []string  `json:"groups,omitempty"` // consumer groups of the component
+	Start    time.Time `json:"start"`
+	Uptime   int64     `json:"uptime"`             // seconds
+	LastSeen time.Time `json:"lastSeen,omitempty"` // set by registry
+}
+
+// ID is unique id of the component instance.
+func (i Info) ID() string {
+	return i.Dc + "/" + i.App + "/" + i.Host + "/" + i.Instance
+}
+
+// Member returns true if component is member of the consumer group.
+func (i Info) Member(group string) bool {
+	for _, g := range i.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// Self returns info of the current process.
+func Self(kind, version string) Info {
+	return Info{
+		App:      env.AppName(),
+		Host:     env.Hostname(),
+		Instance: env.InstanceId(),
+		Dc:       env.Dc(),
+		Kind:     kind,
+		Version:  version,
+		Start:    start,
+		Uptime:   int64(time.Since(start) / time.Second),
+	}
+}
+
+// NewAlive creates presence message.
+func NewAlive(i Info) *amp.Msg {
+	return amp.Build().Type(amp.Alive).Topic(Topic).Ts(amp.TS()).Body(i).MustMsg()
+}
+
+// Announce publishes presence message of the current process every
+// interval until ctx is done.
+func Announce(ctx context.Context, kind, version string, interval time.Duration, publish func(*amp.Msg)) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			publish(NewAlive(Self(kind, version)))
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Registry keeps components which announced presence within ttl.
+type Registry struct {
+	ttl     time.Duration
+	entries map[string]Info
+	sync.Mutex
+}
+
+// NewRegistry creates empty registry.
+func NewRegistry(ttl time.Duration) *Registry {
+	return &Registry{
+		ttl:     ttl,
+		entries: make(map[string]Info),
+	}
+}
+
+// Add adds presence message to the registry.
+func (r *Registry) Add(m *amp.Msg) {
+	if !m.IsAlive() || m.URI != Topic {
+		return
+	}
+	var i Info
+	if err := m.Unmarshal(&i); err != nil {
+		log.Error(err)
+		return
+	}
+	i.LastSeen = time.Now()
+	r.Lock()
+	defer r.Unlock()
+	r.entries[i.ID()] = i
+}
+
+// Consume adds all presence messages from in, until in is closed or ctx is done.
+func (r *Registry) Consume(ctx context.Context, in <-chan *amp.Msg) {
+	for {
+		select {
+		case m, ok := <-in:
+			if !ok {
+				return
+			}
+			r.Add(m)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Alive returns components seen within ttl, sorted by kind, app and host.
+// Expired components are removed.
+func (r *Registry) Alive() []Info {
+	r.Lock()
+	defer r.Unlock()
+	alive := make([]Info, 0, len(r.entries))
+	for id, i := range r.entries {
+		if time.Since(i.LastSeen) > r.ttl {
+			delete(r.entries, id)
+			continue
+		}
+		alive = append(alive, i)
+	}
+	sort.Slice(alive, func(a, b int) bool {
+		if alive[a].Kind != alive[b].Kind {
+			return alive[a].Kind < alive[b].Kind
+		}
+		if alive[a].App != alive[b].App {
+			return alive[a].App < alive[b].App
+		}
+		return alive[a].ID() < alive[b].ID()
+	})
+	return alive
+}
+
+// Route registers presence view on the router.
+func (r *Registry) Route(rt *httpi.Router) {
+	rt.Route("", r.httpList).Methods("GET")
+	rt.Route("/", r.httpList).Methods("GET")
+}
+
+func (r *Registry) httpList(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(r.Alive()); err != nil {
+		log.Error(err)
+	}
+}
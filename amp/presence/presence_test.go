@@ -0,0 +1,35 @@
+package presence
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry(20 * time.Millisecond)
+	gw := Self(Gateway, "1.2.3")
+	gw.Host = "gw1"
+	r.Add(amp.Parse(NewAlive(gw).Marshal()))
+	svc := Self(Service, "2.0.0")
+	svc.Host = "svc1"
+	r.Add(amp.Parse(NewAlive(svc).Marshal()))
+	r.Add(amp.NewTopicAlive("math")) // not presence message
+
+	alive := r.Alive()
+	assert.Len(t, alive, 2)
+	assert.Equal(t, Gateway, alive[0].Kind)
+	assert.Equal(t, "1.2.3", alive[0].Version)
+	assert.Equal(t, "svc1", alive[1].Host)
+
+	w := httptest.NewRecorder()
+	r.httpList(w, httptest.NewRequest("GET", "/presence", nil))
+	assert.Contains(t, w.Body.String(), `"version":"2.0.0"`)
+
+	time.Sleep(30 * time.Millisecond)
+	r.Add(amp.Parse(NewAlive(gw).Marshal()))
+	assert.Len(t, r.Alive(), 1)
+}
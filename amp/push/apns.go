@@ -0,0 +1,91 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// APNs is Apple Push Notification service provider (HTTP/2 API with
+// token based authentication).
+type APNs struct {
+	URL     string                    // https://api.push.apple.com or https://api.sandbox.push.apple.com
+	Topic   string                    // bundle id of the app
+	Devices Devices                   // device tokens of the user
+	Token   func() (string, error)    // provider authentication token (JWT)
+	Invalid func(user, device string) // called for device token which is no longer active, optional
+	Client  *http.Client
+}
+
+// NewAPNs creates APNs provider for the app bundle id.
+func NewAPNs(bundleID string, devices Devices, token func() (string, error)) *APNs {
+	return &APNs{
+		URL:     "https://api.push.apple.com",
+		Topic:   bundleID,
+		Devices: devices,
+		Token:   token,
+		Client:  http.DefaultClient,
+	}
+}
+
+type apnsAlert struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+}
+
+// Push sends notification to each device of the user, returns first error.
+func (a *APNs) Push(ctx context.Context, n Notification) error {
+	devices, err := a.Devices(n.User)
+	if err != nil {
+		return errors.Wrapf(err, "apns devices %s", n.User)
+	}
+	if len(devices) == 0 {
+		return nil
+	}
+	token, err := a.Token()
+	if err != nil {
+		return errors.Wrap(err, "apns token")
+	}
+	payload := map[string]interface{}{
+		"aps": map[string]interface{}{
+			"alert": apnsAlert{Title: n.Title, Body: n.Body},
+		},
+	}
+	for k, v := range n.Data {
+		payload[k] = v
+	}
+	buf, err := json.Marshal(payload)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var first error
+	for _, d := range devices {
+		err := a.send(ctx, token, d, n.ID, buf)
+		if se, ok := errors.Cause(err).(*statusError); ok && se.code == http.StatusGone {
+			invalid(a.Invalid, "apns", n.User, d)
+			continue
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (a *APNs) send(ctx context.Context, token, device, id string, buf []byte) error {
+	req, err := http.NewRequest("POST", a.URL+"/3/device/"+device, bytes.NewReader(buf))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Authorization", "bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("apns-topic", a.Topic)
+	req.Header.Set("apns-push-type", "alert")
+	if len(id) <= 64 {
+		req.Header.Set("apns-collapse-id", id)
+	}
+	return do(ctx, a.Client, req, "apns")
+}
@@ -0,0 +1,131 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+	"github.com/pkg/errors"
+)
+
+// FCM is Firebase Cloud Messaging (HTTP v1 API) provider.
+type FCM struct {
+	URL     string                   // messages:send endpoint of the project
+	Devices Devices                  // registration tokens of the user
+	Token   func() (string, error)   // OAuth2 access token of the service account
+	Invalid func(user, token string) // called for unregistered token, optional
+	Client  *http.Client
+}
+
+// NewFCM creates FCM provider for the Firebase project.
+func NewFCM(project string, devices Devices, token func() (string, error)) *FCM {
+	return &FCM{
+		URL:     fmt.Sprintf("https://fcm.googleapis.com/v1/projects/%s/messages:send", project),
+		Devices: devices,
+		Token:   token,
+		Client:  http.DefaultClient,
+	}
+}
+
+type fcmMessage struct {
+	Message struct {
+		Token        string            `json:"token"`
+		Notification fcmNotification   `json:"notification"`
+		Data         map[string]string `json:"data,omitempty"`
+		Android      struct {
+			CollapseKey string `json:"collapse_key,omitempty"`
+		} `json:"android"`
+	} `json:"message"`
+}
+
+type fcmNotification struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+}
+
+// Push sends notification to each device of the user, returns first error.
+func (f *FCM) Push(ctx context.Context, n Notification) error {
+	devices, err := f.Devices(n.User)
+	if err != nil {
+		return errors.Wrapf(err, "fcm devices %s", n.User)
+	}
+	if len(devices) == 0 {
+		return nil
+	}
+	token, err := f.Token()
+	if err != nil {
+		return errors.Wrap(err, "fcm token")
+	}
+	var first error
+	for _, d := range devices {
+		var m fcmMessage
+		m.Message.Token = d
+		m.Message.Notification = fcmNotification{Title: n.Title, Body: n.Body}
+		m.Message.Data = n.Data
+		m.Message.Android.CollapseKey = n.ID
+		err := f.send(ctx, token, m)
+		if se, ok := errors.Cause(err).(*statusError); ok && se.code == http.StatusNotFound && bytes.Contains(se.body, []byte("UNREGISTERED")) {
+			invalid(f.Invalid, "fcm", n.User, d)
+			continue
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (f *FCM) send(ctx context.Context, token string, m fcmMessage) error {
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req, err := http.NewRequest("POST", f.URL, bytes.NewReader(buf))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	return do(ctx, f.Client, req, "fcm")
+}
+
+// statusError is unsuccessful response of the provider
+type statusError struct {
+	provider string
+	code     int
+	body     []byte
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s status %d: %s", e.provider, e.code, e.body)
+}
+
+// invalid reports device token rejected by the provider
+func invalid(fn func(user, token string), provider, user, token string) {
+	metric.Counter("push.invalidToken")
+	log.S("provider", provider).S("user", user).Info("invalid device token")
+	if fn != nil {
+		fn(user, token)
+	}
+}
+
+// do sends request and checks response status
+func do(ctx context.Context, c *http.Client, req *http.Request, provider string) error {
+	rsp, err := c.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, provider)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 1024))
+		return errors.WithStack(&statusError{provider: provider, code: rsp.StatusCode, body: bytes.TrimSpace(body)})
+	}
+	_, _ = io.Copy(ioutil.Discard, rsp.Body)
+	return nil
+}
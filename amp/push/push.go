@@ -0,0 +1,275 @@
+// Package push is push notification fallback for the users without live
+// connection. Broker with offline queue (broker.Offline) hands critical
+// messages (amp.Msg RequiresAck) of the offline users to the Pusher,
+// which renders notification from the message body and sends it by the
+// provider (FCM, APNs).
+//
+//	p := push.New(push.NewFCM(project, devices, token),
+//		push.Template("notify", "{{.title}}", "{{.from}}: {{.text}}"),
+//		push.Delay(5*time.Second))
+//	defer p.Close()
+//	b := broker.New(nil, broker.Offline("notify", limits), broker.OfflineNotify(p))
+//
+// Paths of the offline topic are user identities. Notification is sent
+// after delay; message delivered live within delay (user reconnected) is
+// not pushed. Notification data contains uri and ts of the message so
+// the client can deduplicate message later delivered live.
+//
+// User could reconnect to other gateway instance. Pushers of all instances
+// exchange notices of the delivered messages on the DeliveredTopic:
+//
+//	p := push.New(provider, push.Cluster(pub.Publish), ...)
+//	go p.Consume(ctx, nsq.Subscribe(ctx, []string{push.DeliveredTopic}))
+//
+// Device tokens rejected by the provider (uninstalled app) are reported
+// to the Invalid callback of the provider, to be removed from the devices.
+package push
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+	"github.com/pkg/errors"
+)
+
+// DeliveredTopic is topic of the notices about messages delivered live,
+// shared by pushers of all gateway instances.
+const DeliveredTopic = "push.delivered"
+
+// deliveredNotice is body of the DeliveredTopic message
+type deliveredNotice struct {
+	ID string `json:"id"`
+}
+
+// Notification is push notification for all devices of the user.
+type Notification struct {
+	ID    string            // unique id of the message, collapse key
+	User  string            // user identity, path of the message uri
+	Title string            // rendered title
+	Body  string            // rendered body
+	Data  map[string]string // uri and ts of the message
+}
+
+// Provider sends notification to the user devices.
+type Provider interface {
+	Push(ctx context.Context, n Notification) error
+}
+
+// Devices returns device tokens of the user.
+type Devices func(user string) ([]string, error)
+
+type tmpl struct {
+	title *template.Template
+	body  *template.Template
+}
+
+// Pusher sends push notifications for the messages of the offline users.
+// Implements broker.Notifier.
+type Pusher struct {
+	provider  Provider
+	templates map[string]tmpl
+	delay     time.Duration
+	timeout   time.Duration
+	pending   map[string]*time.Timer // scheduled notifications by id
+	publish   func(*amp.Msg)         // publishes delivered notices, nil without cluster
+	closed    bool
+	wg        sync.WaitGroup
+	sync.Mutex
+}
+
+// Template sets notification title and body templates (text/template)
+// for the topic, executed with the json message body. Messages of the
+// topics without template are not pushed. Panics if template is invalid.
+func Template(topic, title, body string) func(*Pusher) {
+	return func(p *Pusher) {
+		p.templates[topic] = tmpl{
+			title: template.Must(template.New(topic + ".title").Parse(title)),
+			body:  template.Must(template.New(topic + ".body").Parse(body)),
+		}
+	}
+}
+
+// Delay sets time to wait for the user to reconnect before sending
+// notification, default 0 (immediately).
+func Delay(d time.Duration) func(*Pusher) {
+	return func(p *Pusher) {
+		p.delay = d
+	}
+}
+
+// Timeout sets timeout of the provider call, default 10s.
+func Timeout(d time.Duration) func(*Pusher) {
+	return func(p *Pusher) {
+		p.timeout = d
+	}
+}
+
+// Cluster publishes notice of each message delivered live, so pushers of
+// other instances cancel its notification (see Consume).
+func Cluster(publish func(*amp.Msg)) func(*Pusher) {
+	return func(p *Pusher) {
+		p.publish = publish
+	}
+}
+
+// New creates pusher which sends notifications by the provider.
+func New(provider Provider, opts ...func(*Pusher)) *Pusher {
+	p := &Pusher{
+		provider:  provider,
+		templates: make(map[string]tmpl),
+		timeout:   10 * time.Second,
+		pending:   make(map[string]*time.Timer),
+	}
+	for _, o := range opts {
+		o(p)
+	}
+	return p
+}
+
+func id(m *amp.Msg) string {
+	return m.URI + ":" + strconv.FormatInt(m.Ts, 10)
+}
+
+// Offline schedules notification for the message of the offline user.
+func (p *Pusher) Offline(m *amp.Msg) {
+	if _, ok := p.templates[m.Topic()]; !ok || m.Path() == "" {
+		return
+	}
+	k := id(m)
+	p.Lock()
+	defer p.Unlock()
+	if _, ok := p.pending[k]; ok || p.closed {
+		return
+	}
+	p.wg.Add(1)
+	p.pending[k] = time.AfterFunc(p.delay, func() {
+		defer p.wg.Done()
+		p.Lock()
+		_, ok := p.pending[k]
+		delete(p.pending, k)
+		p.Unlock()
+		if ok {
+			p.push(m)
+		}
+	})
+}
+
+// Delivered cancels notification of the message delivered live, on this
+// and, with Cluster, on other instances.
+func (p *Pusher) Delivered(m *amp.Msg) {
+	if _, ok := p.templates[m.Topic()]; !ok || m.Path() == "" {
+		return
+	}
+	k := id(m)
+	p.cancel(k)
+	if p.publish != nil {
+		p.publish(amp.NewPublish(DeliveredTopic, "", amp.TS(), amp.Append, deliveredNotice{ID: k}))
+	}
+}
+
+// cancel cancels scheduled notification
+func (p *Pusher) cancel(k string) {
+	p.Lock()
+	defer p.Unlock()
+	t, ok := p.pending[k]
+	if !ok {
+		return
+	}
+	delete(p.pending, k)
+	if t.Stop() {
+		p.wg.Done()
+	}
+	metric.Counter("push.deduplicated")
+}
+
+// Consume cancels notifications of the messages delivered on other
+// instances, from DeliveredTopic messages in, until in is closed or ctx
+// is done.
+func (p *Pusher) Consume(ctx context.Context, in <-chan *amp.Msg) {
+	for {
+		select {
+		case m, ok := <-in:
+			if !ok {
+				return
+			}
+			if m.Topic() != DeliveredTopic {
+				continue
+			}
+			var n deliveredNotice
+			if err := m.Unmarshal(&n); err != nil {
+				log.S("uri", m.URI).Error(err)
+				continue
+			}
+			p.cancel(n.ID)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *Pusher) push(m *amp.Msg) {
+	n, err := p.render(m)
+	if err != nil {
+		metric.Counter("push.failed")
+		log.S("uri", m.URI).Error(err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	if err := p.provider.Push(ctx, n); err != nil {
+		metric.Counter("push.failed")
+		log.S("uri", m.URI).Error(err)
+		return
+	}
+	metric.Counter("push.sent")
+}
+
+// render creates notification from the message body
+func (p *Pusher) render(m *amp.Msg) (Notification, error) {
+	t := p.templates[m.Topic()]
+	var body map[string]interface{}
+	if buf := m.BodyBytes(); len(buf) > 0 {
+		if err := json.Unmarshal(buf, &body); err != nil {
+			return Notification{}, errors.Wrap(err, "push body")
+		}
+	}
+	var title, text bytes.Buffer
+	if err := t.title.Execute(&title, body); err != nil {
+		return Notification{}, errors.WithStack(err)
+	}
+	if err := t.body.Execute(&text, body); err != nil {
+		return Notification{}, errors.WithStack(err)
+	}
+	return Notification{
+		ID:    id(m),
+		User:  m.Path(),
+		Title: title.String(),
+		Body:  text.String(),
+		Data: map[string]string{
+			"uri": m.URI,
+			"ts":  strconv.FormatInt(m.Ts, 10),
+		},
+	}, nil
+}
+
+// Close cancels scheduled and waits for the running notifications.
+func (p *Pusher) Close() {
+	p.Lock()
+	p.closed = true
+	for k, t := range p.pending {
+		delete(p.pending, k)
+		if t.Stop() {
+			p.wg.Done()
+		}
+	}
+	p.Unlock()
+	p.wg.Wait()
+}
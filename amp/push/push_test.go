@@ -0,0 +1,148 @@
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+type testProvider struct {
+	sent []Notification
+	sync.Mutex
+}
+
+func (p *testProvider) Push(ctx context.Context, n Notification) error {
+	p.Lock()
+	defer p.Unlock()
+	p.sent = append(p.sent, n)
+	return nil
+}
+
+func (p *testProvider) count() int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.sent)
+}
+
+func notify(user string, ts int64) *amp.Msg {
+	m := amp.NewPublish("notify", user, ts, amp.Append, map[string]string{"from": "ana", "text": "hi"})
+	m.RequiresAck = true
+	return amp.Parse(m.Marshal())
+}
+
+func TestPusher(t *testing.T) {
+	prov := &testProvider{}
+	p := New(prov, Template("notify", "Message", "{{.from}}: {{.text}}"), Delay(10*time.Millisecond))
+
+	p.Offline(notify("u1", 1))
+	p.Offline(notify("u1", 1)) // same message once
+	p.Offline(notify("u2", 2))
+	p.Offline(amp.NewPublish("chat", "u1", 3, amp.Append, nil)) // no template
+	p.Delivered(notify("u2", 2))                                // delivered live within delay
+	time.Sleep(30 * time.Millisecond)
+
+	assert.Equal(t, 1, prov.count())
+	n := prov.sent[0]
+	assert.Equal(t, "u1", n.User)
+	assert.Equal(t, "Message", n.Title)
+	assert.Equal(t, "ana: hi", n.Body)
+	assert.Equal(t, "notify/u1:1", n.ID)
+	assert.Equal(t, map[string]string{"uri": "notify/u1", "ts": "1"}, n.Data)
+
+	// delivered on other instance
+	var notices []*amp.Msg
+	p.publish = func(m *amp.Msg) { notices = append(notices, amp.Parse(m.Marshal())) }
+	p.Offline(notify("u3", 5))
+	p.Delivered(notify("u1", 6))
+	assert.Len(t, notices, 1)
+	q := New(prov, Template("notify", "Message", "{{.from}}: {{.text}}"), Delay(10*time.Millisecond))
+	q.Offline(notify("u1", 6))
+	in := make(chan *amp.Msg, 1)
+	in <- notices[0]
+	close(in)
+	q.Consume(context.Background(), in)
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, 2, prov.count()) // only u3
+	assert.Equal(t, "u3", prov.sent[1].User)
+
+	// close cancels scheduled notifications
+	p.Offline(notify("u1", 4))
+	p.Close()
+	assert.Equal(t, 2, prov.count())
+}
+
+func TestProviders(t *testing.T) {
+	var reqs []*http.Request
+	var bodies []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&b)
+		reqs = append(reqs, r)
+		bodies = append(bodies, b)
+	}))
+	defer srv.Close()
+	devices := func(user string) ([]string, error) { return []string{"d1", "d2"}, nil }
+	token := func() (string, error) { return "tkn", nil }
+	n := Notification{ID: "notify/u1:1", User: "u1", Title: "t", Body: "b", Data: map[string]string{"uri": "notify/u1"}}
+
+	f := NewFCM("project", devices, token)
+	f.URL = srv.URL
+	assert.Nil(t, f.Push(context.Background(), n))
+	assert.Len(t, reqs, 2)
+	assert.Equal(t, "Bearer tkn", reqs[0].Header.Get("Authorization"))
+	msg := bodies[1]["message"].(map[string]interface{})
+	assert.Equal(t, "d2", msg["token"])
+	assert.Equal(t, "b", msg["notification"].(map[string]interface{})["body"])
+
+	a := NewAPNs("com.example.app", devices, token)
+	a.URL = srv.URL
+	assert.Nil(t, a.Push(context.Background(), n))
+	assert.Len(t, reqs, 4)
+	assert.Equal(t, "/3/device/d1", reqs[2].URL.Path)
+	assert.Equal(t, "com.example.app", reqs[2].Header.Get("apns-topic"))
+	assert.Equal(t, "notify/u1:1", reqs[2].Header.Get("apns-collapse-id"))
+	assert.Equal(t, "notify/u1", bodies[2]["uri"])
+
+	fail := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad token", http.StatusForbidden)
+	}))
+	defer fail.Close()
+	a.URL = fail.URL
+	err := a.Push(context.Background(), n)
+	assert.Contains(t, err.Error(), "apns status 403: bad token")
+
+	// unregistered tokens
+	var invalid []string
+	gone := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/d1") {
+			http.Error(w, `{"reason":"Unregistered"}`, http.StatusGone)
+		}
+	}))
+	defer gone.Close()
+	a.URL = gone.URL
+	a.Invalid = func(user, device string) { invalid = append(invalid, user+":"+device) }
+	assert.Nil(t, a.Push(context.Background(), n))
+	assert.Equal(t, []string{"u1:d1"}, invalid)
+
+	invalid = nil
+	unregistered := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b fcmMessage
+		_ = json.NewDecoder(r.Body).Decode(&b)
+		if b.Message.Token == "d2" {
+			http.Error(w, `{"error":{"status":"NOT_FOUND","details":[{"errorCode":"UNREGISTERED"}]}}`, http.StatusNotFound)
+		}
+	}))
+	defer unregistered.Close()
+	f.URL = unregistered.URL
+	f.Invalid = a.Invalid
+	assert.Nil(t, f.Push(context.Background(), n))
+	assert.Equal(t, []string{"u1:d2"}, invalid)
+}
@@ -0,0 +1,246 @@
+// Package quarantine keeps messages on which handler panics or
+// consistently returns error, instead of losing them silently.
+//
+// Quarantined messages could be inspected, retried or discarded over http:
+//
+//	q := quarantine.New(handler, quarantine.Attempts(3))
+//	responder := nsq.NewResponder(ctx, q.Handler, topics)
+//	q.Route(httpi.Subrouter("/quarantine"))
+//
+//	GET    /quarantine            list of quarantined messages
+//	POST   /quarantine/{id}/retry call handler again
+//	DELETE /quarantine/{id}       discard message
+package quarantine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/httpi"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+	"github.com/pkg/errors"
+)
+
+// ErrNotFound is returned from Retry for unknown id.
+var ErrNotFound = errors.New("not found")
+
+// Entry is quarantined message.
+type Entry struct {
+	ID       int64     `json:"id"`
+	URI      string    `json:"uri"`
+	Msg      string    `json:"msg"` // marshaled message
+	Error    string    `json:"error"`
+	Panic    bool      `json:"panic,omitempty"`
+	Attempts int       `json:"attempts"`
+	Time     time.Time `json:"time"`
+}
+
+// Quarantine wraps message handler.
+type Quarantine struct {
+	handler  amp.Handler
+	attempts int
+	size     int
+	skip     func(error) bool
+	entries  map[int64]*Entry
+	lastID   int64
+	sync.Mutex
+}
+
+// New creates quarantine for the handler.
+func New(handler amp.Handler, opts ...func(*Quarantine)) *Quarantine {
+	q := &Quarantine{
+		handler:  handler,
+		attempts: 1,
+		size:     1024,
+		entries:  make(map[int64]*Entry),
+	}
+	for _, o := range opts {
+		o(q)
+	}
+	return q
+}
+
+// Attempts sets number of handler calls before message is quarantined.
+func Attempts(n int) func(*Quarantine) {
+	return func(q *Quarantine) {
+		if n > 0 {
+			q.attempts = n
+		}
+	}
+}
+
+// Size limits number of quarantined messages.
+// When full, the oldest message is discarded.
+func Size(n int) func(*Quarantine) {
+	return func(q *Quarantine) {
+		if n > 0 {
+			q.size = n
+		}
+	}
+}
+
+// Skip errors for which fn returns true are returned to the caller
+// without retry or quarantine (e.g. validation errors).
+func Skip(fn func(error) bool) func(*Quarantine) {
+	return func(q *Quarantine) {
+		q.skip = fn
+	}
+}
+
+// Handler calls wrapped handler up to Attempts times.
+// If all calls panic or return error message is quarantined
+// and the last error returned.
+func (q *Quarantine) Handler(ctx context.Context, m *amp.Msg) (*amp.Msg, error) {
+	var err error
+	var panicked bool
+	for i := 0; i < q.attempts; i++ {
+		var rm *amp.Msg
+		rm, panicked, err = q.call(ctx, m)
+		if err == nil {
+			return rm, nil
+		}
+		if !panicked && q.skip != nil && q.skip(err) {
+			return nil, err
+		}
+	}
+	q.add(m, err, panicked, q.attempts)
+	return nil, err
+}
+
+// call calls handler, converting panic into error
+func (q *Quarantine) call(ctx context.Context, m *amp.Msg) (rm *amp.Msg, panicked bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+			panicked = true
+		}
+	}()
+	rm, err = q.handler(ctx, m)
+	return
+}
+
+func (q *Quarantine) add(m *amp.Msg, err error, panicked bool, attempts int) {
+	q.Lock()
+	defer q.Unlock()
+	q.lastID++
+	e := &Entry{
+		ID:       q.lastID,
+		URI:      m.URI,
+		Msg:      string(m.Marshal()),
+		Error:    err.Error(),
+		Panic:    panicked,
+		Attempts: attempts,
+		Time:     time.Now(),
+	}
+	q.entries[e.ID] = e
+	if len(q.entries) > q.size {
+		delete(q.entries, q.oldest())
+	}
+	metric.Counter("quarantine")
+	log.S("uri", e.URI).I("id", int(e.ID)).I("attempts", attempts).Error(err)
+}
+
+// oldest returns id of the oldest entry, should be called during q.Lock
+func (q *Quarantine) oldest() int64 {
+	var id int64
+	for k := range q.entries {
+		if id == 0 || k < id {
+			id = k
+		}
+	}
+	return id
+}
+
+// List returns quarantined messages ordered by id.
+func (q *Quarantine) List() []Entry {
+	q.Lock()
+	defer q.Unlock()
+	l := make([]Entry, 0, len(q.entries))
+	for _, e := range q.entries {
+		l = append(l, *e)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].ID < l[j].ID })
+	return l
+}
+
+// Retry removes message from quarantine and calls handler again.
+// Response is discarded, requester is probably long gone.
+// If handler fails again message is returned to quarantine.
+func (q *Quarantine) Retry(id int64) error {
+	q.Lock()
+	e, ok := q.entries[id]
+	if ok {
+		delete(q.entries, id)
+	}
+	q.Unlock()
+	if !ok {
+		return errors.WithStack(ErrNotFound)
+	}
+
+	m := amp.Parse([]byte(e.Msg))
+	if m == nil {
+		return errors.Errorf("unable to parse message %d", id)
+	}
+	m.ClearDeadline() // original deadline has passed
+	ctx, cancel := amp.NewContext(context.Background(), m)
+	defer cancel()
+	_, panicked, err := q.call(ctx, m)
+	if err != nil {
+		q.add(m, err, panicked, e.Attempts+1)
+	}
+	return err
+}
+
+// Discard removes message from quarantine.
+func (q *Quarantine) Discard(id int64) bool {
+	q.Lock()
+	defer q.Unlock()
+	_, ok := q.entries[id]
+	delete(q.entries, id)
+	return ok
+}
+
+// Route registers inspection api on the router.
+func (q *Quarantine) Route(r *httpi.Router) {
+	r.Route("", q.httpList).Methods("GET")
+	r.Route("/", q.httpList).Methods("GET")
+	r.RouteVars("/{id:[0-9]+}/retry", q.httpRetry).Methods("POST")
+	r.RouteVars("/{id:[0-9]+}", q.httpDiscard).Methods("DELETE")
+}
+
+func (q *Quarantine) httpList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(q.List()); err != nil {
+		log.Error(err)
+	}
+}
+
+func (q *Quarantine) httpRetry(w http.ResponseWriter, r *http.Request, vars map[string]string) {
+	id, _ := strconv.ParseInt(vars["id"], 10, 64)
+	err := q.Retry(id)
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusOK)
+	case errors.Cause(err) == ErrNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusConflict)
+	}
+}
+
+func (q *Quarantine) httpDiscard(w http.ResponseWriter, r *http.Request, vars map[string]string) {
+	id, _ := strconv.ParseInt(vars["id"], 10, 64)
+	if !q.Discard(id) {
+		http.Error(w, ErrNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,68 @@
+package quarantine
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuarantine(t *testing.T) {
+	calls := 0
+	fail := true
+	q := New(func(ctx context.Context, m *amp.Msg) (*amp.Msg, error) {
+		calls++
+		if m.URI == "math.req/panic" {
+			panic("boom")
+		}
+		if fail {
+			return nil, fmt.Errorf("failed")
+		}
+		return m.Response(nil), nil
+	}, Attempts(3))
+
+	_, err := q.Handler(context.Background(), amp.NewRequest("math.req/add", nil))
+	assert.Error(t, err)
+	assert.Equal(t, 3, calls)
+	_, err = q.Handler(context.Background(), amp.NewRequest("math.req/panic", nil))
+	assert.Error(t, err)
+
+	l := q.List()
+	assert.Len(t, l, 2)
+	assert.Equal(t, "math.req/add", l[0].URI)
+	assert.Equal(t, 3, l[0].Attempts)
+	assert.False(t, l[0].Panic)
+	assert.True(t, l[1].Panic)
+	assert.Equal(t, "panic: boom", l[1].Error)
+
+	// retry fails, message returns to quarantine
+	assert.Error(t, q.Retry(l[0].ID))
+	l = q.List()
+	assert.Len(t, l, 2)
+	assert.Equal(t, 4, l[1].Attempts)
+
+	// retry succeeds
+	fail = false
+	assert.NoError(t, q.Retry(l[1].ID))
+	assert.Len(t, q.List(), 1)
+
+	assert.True(t, q.Discard(l[0].ID))
+	assert.False(t, q.Discard(l[0].ID))
+	assert.Len(t, q.List(), 0)
+	assert.Equal(t, ErrNotFound, errors.Cause(q.Retry(l[0].ID)))
+}
+
+func TestSize(t *testing.T) {
+	q := New(func(ctx context.Context, m *amp.Msg) (*amp.Msg, error) {
+		return nil, fmt.Errorf("failed")
+	}, Size(2), Skip(func(err error) bool { return false }))
+	for i := 0; i < 3; i++ {
+		q.Handler(context.Background(), amp.NewRequest(fmt.Sprintf("math.req/%d", i), nil))
+	}
+	l := q.List()
+	assert.Len(t, l, 2)
+	assert.Equal(t, "math.req/1", l[0].URI)
+}
@@ -0,0 +1,293 @@
+// Package quota accounts messages and bytes published per topic and per
+// client and enforces configured limits.
+//
+//	q := quota.New(
+//		quota.Topic("chat", quota.Limit{MsgsPerSec: 100}),
+//		quota.DefaultClient(quota.Limit{MsgsPerSec: 5, BytesPerDay: 1 << 20}),
+//	)
+//	publish = q.Publish(publish)  // drops messages over quota
+//	r.Use(q.Handler)              // rejects requests over quota
+//	q.Route(httpi.Subrouter("/quota"))
+//
+// Messages over quota are rejected with retryable ErrorCodeThrottled error.
+// Usage is exposed on the http endpoint for capacity planning. Accounts of
+// the clients idle for an hour, without usage in the current day, are
+// dropped.
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/httpi"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+)
+
+// ErrorCodeThrottled is code of the error when message is over quota.
+const ErrorCodeThrottled = -131
+
+const (
+	clientIdle    = time.Hour   // client account is dropped after
+	sweepInterval = time.Minute // how often idle client accounts are checked
+)
+
+func init() {
+	amp.RegisterError(amp.ErrorDef{
+		Code:      ErrorCodeThrottled,
+		Retryable: true,
+		Messages:  map[string]string{"": "too many requests"},
+	})
+}
+
+// Limit is quota for the topic or client. Zero value is no limit.
+type Limit struct {
+	MsgsPerSec  float64 `json:"msgsPerSec,omitempty"`
+	BytesPerDay int64   `json:"bytesPerDay,omitempty"`
+}
+
+// Usage is accounted traffic of the topic or client.
+type Usage struct {
+	Msgs       int64 `json:"msgs"`       // accepted messages since start
+	Bytes      int64 `json:"bytes"`      // accepted bytes since start
+	BytesToday int64 `json:"bytesToday"` // accepted bytes in current (UTC) day
+	Throttled  int64 `json:"throttled"`  // rejected messages since start
+	Limit      Limit `json:"limit"`
+}
+
+// Quotas accounts usage and enforces limits.
+type Quotas struct {
+	topicLimits   map[string]Limit
+	clientLimits  map[string]Limit
+	defaultClient Limit
+	clientKey     func(*amp.Msg) string
+	now           func() time.Time
+
+	topics    map[string]*account
+	clients   map[string]*account
+	lastSweep time.Time
+	sync.Mutex
+}
+
+// Topic sets limit for the topic.
+func Topic(topic string, l Limit) func(*Quotas) {
+	return func(q *Quotas) {
+		q.topicLimits[topic] = l
+	}
+}
+
+// Client sets limit for the client.
+func Client(client string, l Limit) func(*Quotas) {
+	return func(q *Quotas) {
+		q.clientLimits[client] = l
+	}
+}
+
+// DefaultClient sets limit for the clients without their own limit.
+func DefaultClient(l Limit) func(*Quotas) {
+	return func(q *Quotas) {
+		q.defaultClient = l
+	}
+}
+
+// ClientKey sets function which identifies client of the message,
+// default is Meta "client" value. Messages without client are accounted
+// only per topic.
+func ClientKey(fn func(*amp.Msg) string) func(*Quotas) {
+	return func(q *Quotas) {
+		q.clientKey = fn
+	}
+}
+
+// New creates quotas.
+func New(opts ...func(*Quotas)) *Quotas {
+	q := &Quotas{
+		topicLimits:  make(map[string]Limit),
+		clientLimits: make(map[string]Limit),
+		clientKey:    func(m *amp.Msg) string { return m.Meta["client"] },
+		now:          time.Now,
+		topics:       make(map[string]*account),
+		clients:      make(map[string]*account),
+	}
+	for _, o := range opts {
+		o(q)
+	}
+	return q
+}
+
+// Allow accounts message and returns throttled error if topic or client
+// of the message is over quota.
+func (q *Quotas) Allow(m *amp.Msg) error {
+	size := int64(len(m.BodyBytes()))
+	topic := m.Topic()
+	client := q.clientKey(m)
+
+	q.Lock()
+	defer q.Unlock()
+	now := q.now()
+	q.sweep(now)
+	ta := q.account(q.topics, topic, q.topicLimits[topic], now)
+	var ca *account
+	if client != "" {
+		l, ok := q.clientLimits[client]
+		if !ok {
+			l = q.defaultClient
+		}
+		ca = q.account(q.clients, client, l, now)
+	}
+
+	if reason := ta.check(now, size); reason != "" {
+		ta.Throttled++
+		metric.Counter("quota.topic." + topic + ".throttled")
+		return amp.Errf(ErrorCodeThrottled, "topic %s over %s quota", topic, reason)
+	}
+	if ca != nil {
+		if reason := ca.check(now, size); reason != "" {
+			ca.Throttled++
+			metric.Counter("quota.client.throttled")
+			return amp.Errf(ErrorCodeThrottled, "client %s over %s quota", client, reason)
+		}
+		ca.add(now, size)
+	}
+	ta.add(now, size)
+	return nil
+}
+
+func (q *Quotas) account(accounts map[string]*account, key string, l Limit, now time.Time) *account {
+	a, ok := accounts[key]
+	if !ok {
+		a = &account{tokens: l.burst(), last: now}
+		accounts[key] = a
+	}
+	a.Limit = l
+	a.seen = now
+	return a
+}
+
+// sweep drops idle client accounts, should be called during q.Lock
+func (q *Quotas) sweep(now time.Time) {
+	if now.Sub(q.lastSweep) < sweepInterval {
+		return
+	}
+	q.lastSweep = now
+	for k, a := range q.clients {
+		if a.idle(now) {
+			delete(q.clients, k)
+		}
+	}
+}
+
+// Publish returns publish function which drops messages over quota.
+func (q *Quotas) Publish(publish func(*amp.Msg)) func(*amp.Msg) {
+	return func(m *amp.Msg) {
+		if err := q.Allow(m); err != nil {
+			log.S("uri", m.URI).Debug(err.Error())
+			return
+		}
+		publish(m)
+	}
+}
+
+// Handler is middleware which rejects requests over quota.
+func (q *Quotas) Handler(h amp.Handler) amp.Handler {
+	return func(ctx context.Context, m *amp.Msg) (*amp.Msg, error) {
+		if err := q.Allow(m); err != nil {
+			return nil, err
+		}
+		return h(ctx, m)
+	}
+}
+
+// Usage returns usage by topic and by client.
+func (q *Quotas) Usage() (topics map[string]Usage, clients map[string]Usage) {
+	q.Lock()
+	defer q.Unlock()
+	now := q.now()
+	copyUsage := func(accounts map[string]*account) map[string]Usage {
+		u := make(map[string]Usage, len(accounts))
+		for k, a := range accounts {
+			a.rollDay(now)
+			u[k] = a.Usage
+		}
+		return u
+	}
+	return copyUsage(q.topics), copyUsage(q.clients)
+}
+
+// Route registers usage endpoint on the router.
+func (q *Quotas) Route(rt *httpi.Router) {
+	rt.Route("/", func(w http.ResponseWriter, r *http.Request) {
+		topics, clients := q.Usage()
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"topics":  topics,
+			"clients": clients,
+		}); err != nil {
+			log.Error(err)
+		}
+	}).Methods("GET")
+}
+
+// burst is size of the msgs/sec token bucket, one second of messages but
+// at least one message
+func (l Limit) burst() float64 {
+	if l.MsgsPerSec < 1 {
+		return 1
+	}
+	return l.MsgsPerSec
+}
+
+// account is usage with token bucket for the msgs/sec limit
+type account struct {
+	Usage
+	tokens float64
+	last   time.Time // of the tokens refill
+	seen   time.Time // of the last message
+	day    int64     // unix day of BytesToday
+}
+
+// idle returns true if account was not used for clientIdle and there is
+// no usage limited in the current day
+func (a *account) idle(now time.Time) bool {
+	a.rollDay(now)
+	return now.Sub(a.seen) >= clientIdle && (a.Limit.BytesPerDay == 0 || a.BytesToday == 0)
+}
+
+// check returns name of the exceeded limit
+func (a *account) check(now time.Time, size int64) string {
+	a.rollDay(now)
+	if a.Limit.BytesPerDay > 0 && a.BytesToday+size > a.Limit.BytesPerDay {
+		return "bytes/day"
+	}
+	if a.Limit.MsgsPerSec > 0 {
+		a.tokens += now.Sub(a.last).Seconds() * a.Limit.MsgsPerSec
+		if burst := a.Limit.burst(); a.tokens > burst {
+			a.tokens = burst
+		}
+		a.last = now
+		if a.tokens < 1 {
+			return "msgs/sec"
+		}
+	}
+	return ""
+}
+
+func (a *account) add(now time.Time, size int64) {
+	if a.Limit.MsgsPerSec > 0 {
+		a.tokens--
+	}
+	a.Msgs++
+	a.Bytes += size
+	a.BytesToday += size
+}
+
+func (a *account) rollDay(now time.Time) {
+	if day := now.Unix() / 86400; day != a.day {
+		a.day = day
+		a.BytesToday = 0
+	}
+}
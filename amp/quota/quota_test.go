@@ -0,0 +1,127 @@
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/httpi"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func msg(topic, client, body string) *amp.Msg {
+	m := amp.Parse([]byte(`{"u":"` + topic + `/x","m":{"client":"` + client + `"}}` + "\n" + body))
+	return m
+}
+
+func TestMsgsPerSec(t *testing.T) {
+	now := time.Unix(1000, 0)
+	q := New(Topic("chat", Limit{MsgsPerSec: 2}))
+	q.now = func() time.Time { return now }
+
+	assert.NoError(t, q.Allow(msg("chat", "", "{}")))
+	assert.NoError(t, q.Allow(msg("chat", "", "{}")))
+	err := q.Allow(msg("chat", "", "{}"))
+	assert.Equal(t, ErrorCodeThrottled, errors.Cause(err).(*amp.Error).Code)
+	assert.True(t, amp.IsRetryable(err))
+	assert.NoError(t, q.Allow(msg("odds", "", "{}")))
+
+	now = now.Add(500 * time.Millisecond)
+	assert.NoError(t, q.Allow(msg("chat", "", "{}")))
+	assert.Error(t, q.Allow(msg("chat", "", "{}")))
+
+	topics, _ := q.Usage()
+	assert.Equal(t, int64(3), topics["chat"].Msgs)
+	assert.Equal(t, int64(2), topics["chat"].Throttled)
+	assert.Equal(t, int64(6), topics["chat"].Bytes)
+}
+
+func TestMsgsPerSecUnderOne(t *testing.T) {
+	now := time.Unix(1000, 0)
+	q := New(Topic("chat", Limit{MsgsPerSec: 0.5}))
+	q.now = func() time.Time { return now }
+
+	assert.NoError(t, q.Allow(msg("chat", "", "{}")))
+	assert.Error(t, q.Allow(msg("chat", "", "{}")))
+	now = now.Add(time.Second)
+	assert.Error(t, q.Allow(msg("chat", "", "{}")))
+	now = now.Add(time.Second)
+	assert.NoError(t, q.Allow(msg("chat", "", "{}")))
+}
+
+func TestIdleClients(t *testing.T) {
+	now := time.Unix(86400*10+100, 0)
+	q := New(DefaultClient(Limit{MsgsPerSec: 1}), Client("daily", Limit{BytesPerDay: 100}))
+	q.now = func() time.Time { return now }
+
+	assert.NoError(t, q.Allow(msg("chat", "1", "{}")))
+	assert.NoError(t, q.Allow(msg("chat", "daily", "{}")))
+	now = now.Add(clientIdle)
+	assert.NoError(t, q.Allow(msg("chat", "2", "{}")))
+	_, clients := q.Usage()
+	assert.Len(t, clients, 2)
+	assert.Contains(t, clients, "daily") // keeps usage of the current day
+
+	now = now.Add(24 * time.Hour)
+	assert.NoError(t, q.Allow(msg("chat", "3", "{}")))
+	_, clients = q.Usage()
+	assert.Len(t, clients, 1)
+}
+
+func TestBytesPerDay(t *testing.T) {
+	now := time.Unix(86400*11-30*60, 0) // 23:30
+	q := New(DefaultClient(Limit{BytesPerDay: 10}), Client("vip", Limit{}))
+	q.now = func() time.Time { return now }
+
+	assert.NoError(t, q.Allow(msg("chat", "1", `"12345"`)))
+	assert.Error(t, q.Allow(msg("chat", "1", `"12345"`)))
+	assert.NoError(t, q.Allow(msg("chat", "2", `"12345"`)))
+	assert.NoError(t, q.Allow(msg("chat", "vip", `"12345"`)))
+	assert.NoError(t, q.Allow(msg("chat", "vip", `"12345"`)))
+
+	// next day
+	now = now.Add(45 * time.Minute)
+	assert.NoError(t, q.Allow(msg("chat", "1", `"12345"`)))
+	_, clients := q.Usage()
+	assert.Equal(t, int64(7), clients["1"].BytesToday)
+	assert.Equal(t, int64(14), clients["1"].Bytes)
+	assert.Equal(t, int64(1), clients["1"].Throttled)
+
+	// idle account is dropped
+	now = now.Add(24 * time.Hour)
+	assert.NoError(t, q.Allow(msg("chat", "2", `"12345"`)))
+	_, clients = q.Usage()
+	assert.NotContains(t, clients, "1")
+}
+
+func TestHandlerAndRoute(t *testing.T) {
+	q := New(Topic("math.req", Limit{MsgsPerSec: 1}))
+	h := q.Handler(func(ctx context.Context, m *amp.Msg) (*amp.Msg, error) {
+		return m.Response(nil), nil
+	})
+	_, err := h(context.Background(), amp.NewRequest("math.req/add", nil))
+	assert.NoError(t, err)
+	_, err = h(context.Background(), amp.NewRequest("math.req/add", nil))
+	assert.Error(t, err)
+
+	published := 0
+	publish := q.Publish(func(*amp.Msg) { published++ })
+	publish(amp.NewPublish("math.req", "", 1, amp.Full, nil))
+	assert.Equal(t, 0, published)
+
+	rt := httpi.NewRouter()
+	q.Route(rt)
+	w := httptest.NewRecorder()
+	rt.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	var rsp struct {
+		Topics map[string]Usage
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &rsp))
+	assert.Equal(t, int64(1), rsp.Topics["math.req"].Msgs)
+	assert.Equal(t, int64(2), rsp.Topics["math.req"].Throttled)
+	assert.Equal(t, 1.0, rsp.Topics["math.req"].Limit.MsgsPerSec)
+}
@@ -0,0 +1,66 @@
+package amp
+
+import (
+	"encoding/json"
+	"math/rand"
+	"time"
+)
+
+// ReconnectHint is body of the disconnect message telling the client
+// where and when to reconnect (e.g. gateway is draining before deploy).
+type ReconnectHint struct {
+	Address string   `json:"address,omitempty"` // reconnect to other host:port or url, empty for the same
+	Delay   int64    `json:"delay,omitempty"`   // wait before reconnect, milliseconds
+	Backoff *Backoff `json:"backoff,omitempty"` // reconnect backoff policy, nil for the client default
+}
+
+// Backoff is server controlled reconnect policy. During incidents server
+// can slow down reconnect attempts of all clients.
+type Backoff struct {
+	Min    int64   `json:"min"`              // delay of the first attempt, milliseconds
+	Max    int64   `json:"max"`              // maximum delay, milliseconds
+	Jitter float64 `json:"jitter,omitempty"` // randomization factor, 0-1
+}
+
+// Delay returns wait time before reconnect attempt (starting from 0).
+// Delay is doubled on each attempt up to Max, and randomized by Jitter.
+func (b Backoff) Delay(attempt int) time.Duration {
+	d := b.Min
+	for i := 0; i < attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max {
+		d = b.Max
+	}
+	if b.Jitter > 0 {
+		d += int64(float64(d) * b.Jitter * (2*rand.Float64() - 1))
+	}
+	if d < 0 {
+		d = 0
+	}
+	return time.Duration(d) * time.Millisecond
+}
+
+// NewReconnect creates disconnect message with the reconnect hint.
+func NewReconnect(reason string, h ReconnectHint) *Msg {
+	m := NewDisconnect(reason)
+	m.src = toBodyMarshaler(h)
+	return m
+}
+
+// ReconnectHint returns reconnect hint of the disconnect message,
+// false if message doesn't have it.
+func (m *Msg) ReconnectHint() (ReconnectHint, bool) {
+	var h ReconnectHint
+	if !m.IsStatus() || m.Error == nil {
+		return h, false
+	}
+	body := m.BodyBytes()
+	if len(body) == 0 {
+		return h, false
+	}
+	if err := json.Unmarshal(body, &h); err != nil {
+		return h, false
+	}
+	return h, true
+}
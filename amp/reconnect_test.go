@@ -0,0 +1,40 @@
+package amp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconnectHint(t *testing.T) {
+	m := Parse(NewReconnect("draining", ReconnectHint{Address: "wss://gw2.example.com", Delay: 500}).Marshal())
+	assert.True(t, m.IsStatus())
+	assert.Equal(t, "draining", m.Error.Message)
+	h, ok := m.ReconnectHint()
+	assert.True(t, ok)
+	assert.Equal(t, ReconnectHint{Address: "wss://gw2.example.com", Delay: 500}, h)
+
+	_, ok = Parse(NewDisconnect("slow consumer").Marshal()).ReconnectHint()
+	assert.False(t, ok)
+	_, ok = Parse(NewStatus("chat", TopicStatus{Stale: true}).Marshal()).ReconnectHint()
+	assert.False(t, ok)
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	b := &Backoff{Min: 100, Max: 1000}
+	m := Parse(NewReconnect("slow consumer", ReconnectHint{Backoff: b}).Marshal())
+	h, ok := m.ReconnectHint()
+	assert.True(t, ok)
+	assert.Equal(t, b, h.Backoff)
+
+	assert.Equal(t, 100*time.Millisecond, b.Delay(0))
+	assert.Equal(t, 400*time.Millisecond, b.Delay(2))
+	assert.Equal(t, time.Second, b.Delay(10))
+
+	b.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := b.Delay(10)
+		assert.True(t, d >= 500*time.Millisecond && d <= 1500*time.Millisecond)
+	}
+}
@@ -0,0 +1,40 @@
+package amp
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+)
+
+// ErrorCodePanic is code of the response error when handler panics.
+const ErrorCodePanic = -129
+
+func init() {
+	RegisterError(ErrorDef{
+		Code:     ErrorCodePanic,
+		Messages: map[string]string{"": "internal error"},
+	})
+}
+
+// Recover is middleware which converts handler panic into error response.
+// Panic is logged with the stack and counted in metric.
+// Responders wrap handlers with Recover.
+func Recover(h Handler) Handler {
+	return func(ctx context.Context, m *Msg) (rm *Msg, err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				log.S("topic", m.Topic()).
+					S("path", m.Path()).
+					I("correlationID", int(m.CorrelationID)).
+					S("stack", string(debug.Stack())).
+					ErrorS(fmt.Sprintf("handler panic: %v", p))
+				metric.Counter("handlerPanic")
+				rm, err = nil, Errf(ErrorCodePanic, "panic: %v", p)
+			}
+		}()
+		return h(ctx, m)
+	}
+}
@@ -0,0 +1,224 @@
+// Package replayfile records amp messages to the file and replays them later
+// with original timing (or accelerated) into the broker.
+// Used to reproduce production scenarios in tests.
+//
+// File is sequence of records:
+//
+//	<unix nano receive time> <payload length>\n<payload>\n
+//
+// where payload is amp.Msg.Marshal.
+// When recorder is created with keyring payload is encrypted
+// (see amp/atrest), player must use the same keyring.
+package replayfile
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/atrest"
+	"github.com/pkg/errors"
+)
+
+// Recorder writes messages of the selected topics into the writer.
+type Recorder struct {
+	w      *bufio.Writer
+	topics map[string]struct{}
+	keys   *atrest.Keyring
+	err    error
+	sync.Mutex
+}
+
+// NewRecorder creates recorder for the topics.
+// If topics are not specified all messages are recorded.
+func NewRecorder(w io.Writer, topics ...string) *Recorder {
+	r := &Recorder{
+		w:      bufio.NewWriter(w),
+		topics: make(map[string]struct{}),
+	}
+	for _, t := range topics {
+		r.topics[t] = struct{}{}
+	}
+	return r
+}
+
+// Encrypt payloads with the current key from keyring.
+func (r *Recorder) Encrypt(k *atrest.Keyring) *Recorder {
+	r.keys = k
+	return r
+}
+
+// Pipe records all messages from in and passes them to the returned chan.
+// Writer is flushed when in is closed.
+func (r *Recorder) Pipe(in <-chan *amp.Msg) <-chan *amp.Msg {
+	out := make(chan *amp.Msg)
+	go func() {
+		defer close(out)
+		defer r.Flush()
+		for m := range in {
+			r.Record(m)
+			out <- m
+		}
+	}()
+	return out
+}
+
+// Record writes message if it's topic is selected.
+func (r *Recorder) Record(m *amp.Msg) {
+	if len(r.topics) > 0 {
+		if _, ok := r.topics[m.Topic()]; !ok {
+			return
+		}
+	}
+	payload := m.Marshal()
+	if r.keys != nil {
+		var err error
+		if payload, err = r.keys.Seal(payload); err != nil {
+			r.Lock()
+			r.err = err
+			r.Unlock()
+			return
+		}
+	}
+	r.write(time.Now(), payload)
+}
+
+func (r *Recorder) write(t time.Time, payload []byte) {
+	r.Lock()
+	defer r.Unlock()
+	if r.err != nil {
+		return
+	}
+	if _, err := fmt.Fprintf(r.w, "%d %d\n", t.UnixNano(), len(payload)); err != nil {
+		r.err = errors.WithStack(err)
+		return
+	}
+	if _, err := r.w.Write(payload); err != nil {
+		r.err = errors.WithStack(err)
+		return
+	}
+	r.err = errors.WithStack(r.w.WriteByte('\n'))
+}
+
+// Flush writes buffered data to the underlying writer.
+// Returns first error occurred during recording.
+func (r *Recorder) Flush() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	r.err = errors.WithStack(r.w.Flush())
+	return r.err
+}
+
+// Player reads recorded messages.
+type Player struct {
+	r     *bufio.Reader
+	speed float64
+	keys  *atrest.Keyring
+}
+
+// NewPlayer creates player which replays messages speed times faster
+// than they were recorded. Speed 1 is original timing,
+// speed 0 replays as fast as possible.
+func NewPlayer(r io.Reader, speed float64) *Player {
+	return &Player{
+		r:     bufio.NewReader(r),
+		speed: speed,
+	}
+}
+
+// Decrypt payloads recorded with encryption.
+func (p *Player) Decrypt(k *atrest.Keyring) *Player {
+	p.keys = k
+	return p
+}
+
+// Play calls publish for each recorded message.
+// Blocks until all messages are replayed or ctx is done.
+func (p *Player) Play(ctx context.Context, publish func(*amp.Msg)) error {
+	var first, start time.Time
+	for {
+		t, _, m, err := p.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if first.IsZero() {
+			first, start = t, time.Now()
+		}
+		if p.speed > 0 {
+			at := start.Add(time.Duration(float64(t.Sub(first)) / p.speed))
+			select {
+			case <-time.After(time.Until(at)):
+			case <-ctx.Done():
+				return nil
+			}
+		} else {
+			select {
+			case <-ctx.Done():
+				return nil
+			default:
+			}
+		}
+		publish(m)
+	}
+}
+
+// Filter copies records for which keep returns true into w, preserving
+// receive time and payload (encrypted payload stays encrypted).
+// Returns number of removed records.
+func (p *Player) Filter(w io.Writer, keep func(*amp.Msg) bool) (int, error) {
+	r := &Recorder{w: bufio.NewWriter(w)}
+	removed := 0
+	for {
+		t, raw, m, err := p.next()
+		if err == io.EOF {
+			return removed, r.Flush()
+		}
+		if err != nil {
+			return removed, err
+		}
+		if !keep(m) {
+			removed++
+			continue
+		}
+		r.write(t, raw)
+	}
+}
+
+// next returns receive time, recorded payload and parsed message of the next record
+func (p *Player) next() (time.Time, []byte, *amp.Msg, error) {
+	var ns int64
+	var ln int
+	if _, err := fmt.Fscanf(p.r, "%d %d\n", &ns, &ln); err != nil {
+		if err == io.EOF {
+			return time.Time{}, nil, nil, err
+		}
+		return time.Time{}, nil, nil, errors.WithStack(err)
+	}
+	raw := make([]byte, ln+1)
+	if _, err := io.ReadFull(p.r, raw); err != nil {
+		return time.Time{}, nil, nil, errors.WithStack(err)
+	}
+	raw = raw[:ln]
+	payload := raw
+	if p.keys != nil {
+		var err error
+		if payload, err = p.keys.Open(raw); err != nil {
+			return time.Time{}, nil, nil, err
+		}
+	}
+	m := amp.Parse(payload)
+	if m == nil {
+		return time.Time{}, nil, nil, errors.Errorf("unable to parse message at %d", ns)
+	}
+	return time.Unix(0, ns), raw, m, nil
+}
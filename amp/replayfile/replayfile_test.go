@@ -0,0 +1,84 @@
+package replayfile
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/atrest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordReplay(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	r := NewRecorder(buf, "math.v1")
+	in := make(chan *amp.Msg, 3)
+	in <- amp.NewPublish("math.v1", "i", 1, amp.Full, map[string]int{"x": 1})
+	in <- amp.NewPublish("chat", "1", 2, amp.Append, "skipped")
+	in <- amp.NewPublish("math.v1", "i", 3, amp.Diff, map[string]string{"y": "a\nb"})
+	close(in)
+	n := 0
+	for range r.Pipe(in) {
+		n++
+	}
+	assert.Equal(t, 3, n)
+	assert.Nil(t, r.Flush())
+
+	var msgs []*amp.Msg
+	err := NewPlayer(buf, 0).Play(context.Background(), func(m *amp.Msg) {
+		msgs = append(msgs, m)
+	})
+	assert.Nil(t, err)
+	assert.Len(t, msgs, 2)
+	assert.Equal(t, int64(1), msgs[0].Ts)
+	assert.Equal(t, amp.Full, msgs[0].UpdateType)
+	assert.Equal(t, int64(3), msgs[1].Ts)
+	var body map[string]string
+	assert.Nil(t, msgs[1].Unmarshal(&body))
+	assert.Equal(t, "a\nb", body["y"])
+}
+
+func TestEncrypted(t *testing.T) {
+	k, err := atrest.NewKeyring("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+	assert.Nil(t, err)
+	buf := bytes.NewBuffer(nil)
+	r := NewRecorder(buf).Encrypt(k)
+	r.Record(amp.NewPublish("math.v1", "i", 1, amp.Full, map[string]string{"name": "secret"}))
+	assert.Nil(t, r.Flush())
+	assert.False(t, bytes.Contains(buf.Bytes(), []byte("secret")))
+
+	var msgs []*amp.Msg
+	err = NewPlayer(buf, 0).Decrypt(k).Play(context.Background(), func(m *amp.Msg) {
+		msgs = append(msgs, m)
+	})
+	assert.Nil(t, err)
+	assert.Len(t, msgs, 1)
+	var body map[string]string
+	assert.Nil(t, msgs[0].Unmarshal(&body))
+	assert.Equal(t, "secret", body["name"])
+}
+
+func TestFilter(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	r := NewRecorder(buf)
+	r.Record(amp.NewPublish("chat", "u1", 1, amp.Append, nil))
+	r.Record(amp.NewPublish("chat", "u2", 2, amp.Append, nil))
+	r.Record(amp.NewPublish("chat", "u1", 3, amp.Append, nil))
+	assert.Nil(t, r.Flush())
+	orig := buf.String()
+
+	out := bytes.NewBuffer(nil)
+	removed, err := NewPlayer(buf, 0).Filter(out, func(m *amp.Msg) bool { return m.Path() != "u1" })
+	assert.Nil(t, err)
+	assert.Equal(t, 2, removed)
+	// kept record is copied unchanged
+	assert.Contains(t, orig, out.String())
+
+	var msgs []*amp.Msg
+	assert.Nil(t, NewPlayer(out, 0).Play(context.Background(), func(m *amp.Msg) {
+		msgs = append(msgs, m)
+	}))
+	assert.Len(t, msgs, 1)
+	assert.Equal(t, "chat/u2", msgs[0].URI)
+}
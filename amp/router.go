@@ -0,0 +1,135 @@
+package amp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Handler handles request message and returns response.
+// Ctx is done when nobody is waiting for the response anymore
+// (see NewContext).
+type Handler func(ctx context.Context, m *Msg) (*Msg, error)
+
+// Middleware wraps handler.
+type Middleware func(Handler) Handler
+
+// Router dispatches request messages to the handlers by the message path.
+// Path segments starting with colon are parameters, available in handler
+// with m.Param:
+//
+//	r := amp.NewRouter()
+//	r.Handle("add", amp.Typed(add))
+//	r.Handle("match/:id/odds", odds, auth)
+//	responder := nsq.NewResponder(ctx, r.Handler, topics)
+type Router struct {
+	routes     []*route
+	notFound   Handler
+	middleware []Middleware
+}
+
+type route struct {
+	segments   []string
+	handler    Handler
+	middleware []Middleware
+}
+
+// NewRouter creates empty router.
+func NewRouter() *Router {
+	return &Router{
+		notFound: func(ctx context.Context, m *Msg) (*Msg, error) {
+			return nil, fmt.Errorf("unknown method %s", m.Path())
+		},
+	}
+}
+
+// Handle registers handler for the path, with optional route middleware.
+func (r *Router) Handle(path string, h Handler, mw ...Middleware) {
+	r.routes = append(r.routes, &route{
+		segments:   strings.Split(strings.Trim(path, "/"), "/"),
+		handler:    h,
+		middleware: mw,
+	})
+}
+
+// NotFound sets handler for the paths without registered route.
+func (r *Router) NotFound(h Handler) {
+	r.notFound = h
+}
+
+// Use adds middleware for all routes.
+// Middlewares are called in order of adding, before route middleware.
+func (r *Router) Use(mw ...Middleware) {
+	r.middleware = append(r.middleware, mw...)
+}
+
+// Handler dispatches message to the handler of the matching route.
+func (r *Router) Handler(ctx context.Context, m *Msg) (*Msg, error) {
+	h := r.notFound
+	var mw []Middleware
+	if rt, params := r.match(m.Path()); rt != nil {
+		h = rt.handler
+		mw = rt.middleware
+		m.params = params
+	}
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		h = r.middleware[i](h)
+	}
+	return h(ctx, m)
+}
+
+// match finds route for the path.
+// When more routes match, the one with more static segments wins.
+func (r *Router) match(path string) (*route, map[string]string) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	var best *route
+	bestScore := -1
+	for _, rt := range r.routes {
+		if score, ok := rt.match(segments); ok && score > bestScore {
+			best, bestScore = rt, score
+		}
+	}
+	if best == nil {
+		return nil, nil
+	}
+	return best, best.params(segments)
+}
+
+// match returns number of static segments for the matched route
+func (rt *route) match(segments []string) (int, bool) {
+	if len(segments) != len(rt.segments) {
+		return 0, false
+	}
+	score := 0
+	for i, s := range rt.segments {
+		if strings.HasPrefix(s, ":") {
+			continue
+		}
+		if s != segments[i] {
+			return 0, false
+		}
+		score++
+	}
+	return score, true
+}
+
+func (rt *route) params(segments []string) map[string]string {
+	var p map[string]string
+	for i, s := range rt.segments {
+		if strings.HasPrefix(s, ":") {
+			if p == nil {
+				p = make(map[string]string)
+			}
+			p[s[1:]] = segments[i]
+		}
+	}
+	return p
+}
+
+// Param returns value of the path parameter set by Router.
+func (m *Msg) Param(name string) string {
+	return m.params[name]
+}
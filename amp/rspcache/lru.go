@@ -0,0 +1,89 @@
+package rspcache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/metric"
+)
+
+// LRU is in-memory store with limited number of entries.
+// Least recently used entries are evicted when full.
+type LRU struct {
+	size    int
+	entries map[string]*list.Element
+	order   *list.List // front is most recently used
+	sync.Mutex
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// NewLRU creates LRU for size entries.
+func NewLRU(size int) *LRU {
+	return &LRU{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Get returns value if key is found and not expired.
+func (l *LRU) Get(key string) ([]byte, bool) {
+	l.Lock()
+	defer l.Unlock()
+	e, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+	le := e.Value.(*lruEntry)
+	if time.Now().After(le.expires) {
+		l.remove(e)
+		return nil, false
+	}
+	l.order.MoveToFront(e)
+	return le.value, true
+}
+
+// Set stores value for ttl.
+func (l *LRU) Set(key string, value []byte, ttl time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	expires := time.Now().Add(ttl)
+	if e, ok := l.entries[key]; ok {
+		le := e.Value.(*lruEntry)
+		le.value, le.expires = value, expires
+		l.order.MoveToFront(e)
+		return
+	}
+	l.entries[key] = l.order.PushFront(&lruEntry{key: key, value: value, expires: expires})
+	for l.order.Len() > l.size {
+		l.remove(l.order.Back())
+		metric.Counter("rspcache.evicted")
+	}
+}
+
+// Remove deletes key.
+func (l *LRU) Remove(key string) {
+	l.Lock()
+	defer l.Unlock()
+	if e, ok := l.entries[key]; ok {
+		l.remove(e)
+	}
+}
+
+// Len returns number of entries.
+func (l *LRU) Len() int {
+	l.Lock()
+	defer l.Unlock()
+	return l.order.Len()
+}
+
+func (l *LRU) remove(e *list.Element) {
+	l.order.Remove(e)
+	delete(l.entries, e.Value.(*lruEntry).key)
+}
@@ -0,0 +1,66 @@
+package rspcache
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/minus5/svckit/internal/resp"
+)
+
+// Redis is remote store in the Redis server.
+// Uses only GET and SET commands.
+type Redis struct {
+	password string
+	db       int
+	prefix   string
+	client   *resp.Client
+}
+
+// Password sets Redis AUTH password.
+func Password(p string) func(*Redis) {
+	return func(r *Redis) {
+		r.password = p
+	}
+}
+
+// DB selects Redis database.
+func DB(db int) func(*Redis) {
+	return func(r *Redis) {
+		r.db = db
+	}
+}
+
+// Prefix sets prefix of the Redis keys, default "rspcache:".
+func Prefix(p string) func(*Redis) {
+	return func(r *Redis) {
+		r.prefix = p
+	}
+}
+
+// NewRedis creates Redis store on the addr (host:port).
+// Connections are opened on demand and kept in the pool.
+func NewRedis(addr string, opts ...func(*Redis)) *Redis {
+	r := &Redis{
+		prefix: "rspcache:",
+	}
+	for _, o := range opts {
+		o(r)
+	}
+	r.client = resp.New(addr, resp.Password(r.password), resp.DB(r.db))
+	return r
+}
+
+// Get returns value of the key, nil if not found.
+func (r *Redis) Get(key string) ([]byte, error) {
+	return r.client.Do("GET", r.prefix+key)
+}
+
+// Set stores value with ttl.
+func (r *Redis) Set(key string, value []byte, ttl time.Duration) error {
+	ms := int64(ttl / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	_, err := r.client.Do("SET", r.prefix+key, string(value), "PX", strconv.FormatInt(ms, 10))
+	return err
+}
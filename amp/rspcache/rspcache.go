@@ -0,0 +1,118 @@
+// Package rspcache caches responses of the idempotent (read-only) request
+// handlers, so hot requests don't hit the backing service every time.
+//
+// Responses are cached by request uri and body hash in the in-memory LRU,
+// and optionally in the remote store shared by all service instances
+// (see Redis). Caching is opt-in per route, with the route ttl:
+//
+//	c := rspcache.New(10000, rspcache.Remote(rspcache.NewRedis("redis:6379")))
+//	r := amp.NewRouter()
+//	r.Handle("odds/:id", odds, c.TTL(time.Second))
+//
+// Only successful json responses are cached.
+package rspcache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+)
+
+// Store is remote response store.
+type Store interface {
+	// Get returns nil value if key is not found.
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte, ttl time.Duration) error
+}
+
+// Cache of the handler responses.
+type Cache struct {
+	local  *LRU
+	remote Store
+}
+
+// Remote sets second level store, queried on local miss.
+func Remote(s Store) func(*Cache) {
+	return func(c *Cache) {
+		c.remote = s
+	}
+}
+
+// New creates cache with local LRU of size entries.
+func New(size int, opts ...func(*Cache)) *Cache {
+	c := &Cache{local: NewLRU(size)}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// TTL returns middleware which caches handler responses for ttl.
+func (c *Cache) TTL(ttl time.Duration) amp.Middleware {
+	return func(h amp.Handler) amp.Handler {
+		return func(ctx context.Context, m *amp.Msg) (*amp.Msg, error) {
+			key := Key(m)
+			if body := c.get(key, ttl); body != nil {
+				return m.Response(json.RawMessage(body)), nil
+			}
+			metric.Counter("rspcache.miss")
+			rsp, err := h(ctx, m)
+			if err != nil || rsp == nil || rsp.Error != nil || rsp.IsBinary() {
+				return rsp, err
+			}
+			c.set(key, rsp.BodyBytes(), ttl)
+			return rsp, nil
+		}
+	}
+}
+
+func (c *Cache) get(key string, ttl time.Duration) []byte {
+	if body, ok := c.local.Get(key); ok {
+		metric.Counter("rspcache.hit")
+		return body
+	}
+	if c.remote == nil {
+		return nil
+	}
+	body, err := c.remote.Get(key)
+	if err != nil {
+		log.S("key", key).Error(err)
+		return nil
+	}
+	if body != nil {
+		metric.Counter("rspcache.remote.hit")
+		c.local.Set(key, body, ttl)
+	}
+	return body
+}
+
+func (c *Cache) set(key string, body []byte, ttl time.Duration) {
+	if body == nil {
+		return
+	}
+	c.local.Set(key, body, ttl)
+	if c.remote == nil {
+		return
+	}
+	if err := c.remote.Set(key, body, ttl); err != nil {
+		log.S("key", key).Error(err)
+	}
+}
+
+// Invalidate removes key from the local cache.
+// Remote entries expire by ttl.
+func (c *Cache) Invalidate(key string) {
+	c.local.Remove(key)
+}
+
+// Key returns cache key of the request: uri and hash of the body.
+func Key(m *amp.Msg) string {
+	h := sha256.Sum256(m.BodyBytes())
+	return m.URI + "#" + hex.EncodeToString(h[:16])
+}
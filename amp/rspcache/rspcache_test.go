@@ -0,0 +1,84 @@
+package rspcache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/internal/resp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRU(t *testing.T) {
+	l := NewLRU(2)
+	l.Set("a", []byte("1"), time.Minute)
+	l.Set("b", []byte("2"), time.Minute)
+	_, ok := l.Get("a")
+	assert.True(t, ok)
+	l.Set("c", []byte("3"), time.Minute) // evicts b
+	_, ok = l.Get("b")
+	assert.False(t, ok)
+	assert.Equal(t, 2, l.Len())
+
+	l.Set("d", []byte("4"), time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	_, ok = l.Get("d")
+	assert.False(t, ok)
+}
+
+func TestTTL(t *testing.T) {
+	calls := 0
+	h := func(ctx context.Context, m *amp.Msg) (*amp.Msg, error) {
+		calls++
+		var req struct{ X int }
+		m.Unmarshal(&req)
+		return m.Response(map[string]int{"y": req.X * 2}), nil
+	}
+	c := New(16)
+	r := amp.NewRouter()
+	r.Handle("double", h, c.TTL(time.Minute))
+
+	req := func(body string) string {
+		m := amp.Parse([]byte(`{"t":2,"u":"math.req/double"}` + "\n" + body))
+		rsp, err := r.Handler(context.Background(), m)
+		assert.NoError(t, err)
+		return string(rsp.BodyBytes())
+	}
+	assert.Equal(t, `{"y":2}`, req(`{"X":1}`))
+	assert.Equal(t, `{"y":2}`, req(`{"X":1}`))
+	assert.Equal(t, `{"y":4}`, req(`{"X":2}`))
+	assert.Equal(t, 2, calls)
+
+	m := amp.Parse([]byte(`{"t":2,"u":"math.req/double"}` + "\n" + `{"X":1}`))
+	c.Invalidate(Key(m))
+	req(`{"X":1}`)
+	assert.Equal(t, 3, calls)
+}
+
+func TestRedis(t *testing.T) {
+	srv, err := resp.NewServer(nil)
+	assert.NoError(t, err)
+	defer srv.Close()
+	addr := srv.Addr()
+
+	r := NewRedis(addr)
+	v, err := r.Get("a")
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+	assert.NoError(t, r.Set("a", []byte(`{"x":1}`), time.Second))
+	v, err = r.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, `{"x":1}`, string(v))
+
+	_, err = NewRedis(addr, DB(1)).Get("a")
+	assert.Error(t, err)
+
+	// remote hit fills local cache of the other instance
+	c1 := New(16, Remote(r))
+	c2 := New(16, Remote(r))
+	c1.set("k", []byte("1"), time.Minute)
+	assert.Equal(t, []byte("1"), c2.get("k", time.Minute))
+	_, ok := c2.local.Get("k")
+	assert.True(t, ok)
+}
@@ -0,0 +1,163 @@
+package schedule
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// cron is parsed cron expression, fields are bit sets of allowed values
+type cron struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+	every                         time.Duration // for @every
+}
+
+type field struct {
+	min, max int
+}
+
+var fields = []field{
+	{0, 59}, // minute
+	{0, 23}, // hour
+	{1, 31}, // day of month
+	{1, 12}, // month
+	{0, 6},  // day of week, 0 is Sunday
+}
+
+var shortcuts = map[string]string{
+	"@yearly":  "0 0 1 1 *",
+	"@monthly": "0 0 1 * *",
+	"@weekly":  "0 0 * * 0",
+	"@daily":   "0 0 * * *",
+	"@hourly":  "0 * * * *",
+}
+
+// parseCron parses standard five field cron expression
+// (minute hour day-of-month month day-of-week) with *, lists, ranges and
+// steps, shortcuts @hourly, @daily... and @every <duration>.
+func parseCron(spec string) (*cron, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(spec[len("@every "):]))
+		if err != nil {
+			return nil, errors.Wrap(err, spec)
+		}
+		if d <= 0 {
+			return nil, errors.Errorf("invalid interval in '%s'", spec)
+		}
+		return &cron{every: d}, nil
+	}
+	if s, ok := shortcuts[spec]; ok {
+		spec = s
+	}
+	parts := strings.Fields(spec)
+	if len(parts) != len(fields) {
+		return nil, errors.Errorf("expected %d fields in '%s'", len(fields), spec)
+	}
+	var bits [5]uint64
+	for i, p := range parts {
+		max := fields[i].max
+		if i == 4 {
+			max = 7 // 7 is also Sunday
+		}
+		b, err := parseField(p, fields[i].min, max)
+		if err != nil {
+			return nil, errors.Wrap(err, spec)
+		}
+		bits[i] = b
+	}
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return &cron{
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: parts[2] == "*",
+		dowStar: parts[4] == "*",
+	}, nil
+}
+
+func parseField(s string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, p := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.Index(p, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(p[i+1:]); err != nil || step <= 0 {
+				return 0, errors.Errorf("invalid step '%s'", p)
+			}
+			p = p[:i]
+		}
+		from, to := min, max
+		if p != "*" {
+			r := strings.SplitN(p, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(r[0]); err != nil {
+				return 0, errors.Errorf("invalid value '%s'", p)
+			}
+			to = from
+			if len(r) == 2 {
+				if to, err = strconv.Atoi(r[1]); err != nil {
+					return 0, errors.Errorf("invalid value '%s'", p)
+				}
+			} else if step > 1 {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, errors.Errorf("value out of range '%s'", p)
+		}
+		for v := from; v <= to; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func has(bits uint64, v int) bool {
+	return bits&(1<<uint(v)) != 0
+}
+
+func (c *cron) dayMatches(t time.Time) bool {
+	dom, dow := has(c.dom, t.Day()), has(c.dow, int(t.Weekday()))
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns first activation time after t.
+// Zero time if there is none in the next five years.
+func (c *cron) next(t time.Time) time.Time {
+	if c.every > 0 {
+		return t.Add(c.every)
+	}
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !has(c.month, int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !has(c.hour, t.Hour()) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !has(c.minute, t.Minute()) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
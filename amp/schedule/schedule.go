@@ -0,0 +1,146 @@
+// Package schedule publishes messages on cron expressions.
+//
+// Used for periodic tasks driven by messages, like Full regeneration
+// or cache invalidation:
+//
+//	s := schedule.New()
+//	s.MustAdd("*/5 * * * *", 10*time.Second, func() *amp.Msg {
+//		return amp.NewPublish("cache", "invalidate", amp.TS(), amp.Full, nil)
+//	})
+//	go leader.New(s.LeaderWorker()) // only leader instance fires
+//	pub := nsq.NewPublisher(s.Run(ctx))
+package schedule
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+)
+
+type job struct {
+	spec   string
+	cron   *cron
+	jitter time.Duration
+	msg    func() *amp.Msg
+}
+
+// Scheduler fires jobs and sends their messages to the output channel.
+type Scheduler struct {
+	jobs        []*job
+	leaderAware bool
+	leader      int32 // 1 while this instance is leader
+	sync.Mutex
+}
+
+// New creates empty scheduler.
+func New() *Scheduler {
+	return &Scheduler{}
+}
+
+// Add adds job which calls msg on each activation of the cron spec
+// delayed by random duration up to jitter. Nil messages are not sent.
+// Spec is five field cron expression (minute hour day-of-month month
+// day-of-week), or shortcut @hourly, @daily, @weekly, @monthly, @yearly,
+// @every <duration>.
+func (s *Scheduler) Add(spec string, jitter time.Duration, msg func() *amp.Msg) error {
+	c, err := parseCron(spec)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.jobs = append(s.jobs, &job{spec: spec, cron: c, jitter: jitter, msg: msg})
+	return nil
+}
+
+// MustAdd raises fatal if spec is invalid.
+func (s *Scheduler) MustAdd(spec string, jitter time.Duration, msg func() *amp.Msg) {
+	if err := s.Add(spec, jitter, msg); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// LeaderWorker returns worker for the leader.New.
+// After it is called scheduler fires jobs only while this instance is
+// the leader.
+func (s *Scheduler) LeaderWorker() func(<-chan struct{}) {
+	s.Lock()
+	s.leaderAware = true
+	s.Unlock()
+	return func(lost <-chan struct{}) {
+		atomic.StoreInt32(&s.leader, 1)
+		log.Info("scheduler leadership acquired")
+		<-lost
+		atomic.StoreInt32(&s.leader, 0)
+		log.Info("scheduler leadership lost")
+	}
+}
+
+func (s *Scheduler) active() bool {
+	s.Lock()
+	defer s.Unlock()
+	return !s.leaderAware || atomic.LoadInt32(&s.leader) == 1
+}
+
+// Run starts all jobs. Returns channel of job messages, closed when ctx is done.
+func (s *Scheduler) Run(ctx context.Context) <-chan *amp.Msg {
+	out := make(chan *amp.Msg, 16)
+	s.Lock()
+	jobs := s.jobs
+	s.Unlock()
+	var wg sync.WaitGroup
+	for _, j := range jobs {
+		wg.Add(1)
+		go func(j *job) {
+			defer wg.Done()
+			s.loop(ctx, j, out)
+		}(j)
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+func (s *Scheduler) loop(ctx context.Context, j *job, out chan<- *amp.Msg) {
+	last := time.Now()
+	for {
+		// next activation is calculated from the previous one, not from
+		// the jittered fire time, activations missed (sleep) are skipped
+		at := j.cron.next(last)
+		if at.Before(time.Now()) {
+			at = j.cron.next(time.Now())
+		}
+		if at.IsZero() {
+			log.S("spec", j.spec).ErrorS("no next activation")
+			return
+		}
+		last = at
+		if j.jitter > 0 {
+			at = at.Add(time.Duration(rand.Int63n(int64(j.jitter))))
+		}
+		t := time.NewTimer(time.Until(at))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+		if !s.active() {
+			continue
+		}
+		if m := j.msg(); m != nil {
+			select {
+			case out <- m:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package schedule
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCron(t *testing.T) {
+	at := func(s string) time.Time {
+		t, _ := time.Parse("2006-01-02 15:04", s)
+		return t
+	}
+	cases := []struct {
+		spec, from, next string
+	}{
+		{"*/5 * * * *", "2019-06-01 10:02", "2019-06-01 10:05"},
+		{"0 * * * *", "2019-06-01 10:00", "2019-06-01 11:00"},
+		{"30 2 * * *", "2019-06-01 10:00", "2019-06-02 02:30"},
+		{"0 0 1 * *", "2019-06-15 10:00", "2019-07-01 00:00"},
+		{"0 9 * * 1-5", "2019-06-01 10:00", "2019-06-03 09:00"}, // Saturday -> Monday
+		{"0 9 * * 7", "2019-06-01 10:00", "2019-06-02 09:00"},   // Sunday
+		{"0 0 13 * 5", "2019-06-01 10:00", "2019-06-07 00:00"},  // Friday or 13th
+		{"15,45 8-9 * 2 *", "2019-06-01 10:00", "2020-02-01 08:15"},
+		{"@daily", "2019-06-01 10:00", "2019-06-02 00:00"},
+		{"0 0 30 2 *", "2019-06-01 10:00", ""},
+	}
+	for _, c := range cases {
+		cr, err := parseCron(c.spec)
+		assert.Nil(t, err, c.spec)
+		n := cr.next(at(c.from))
+		if c.next == "" {
+			assert.True(t, n.IsZero(), c.spec)
+			continue
+		}
+		assert.Equal(t, at(c.next), n, c.spec)
+	}
+
+	for _, spec := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *", "@every x", "a * * * *"} {
+		_, err := parseCron(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
+
+func TestRun(t *testing.T) {
+	s := New()
+	assert.Nil(t, s.Add("@every 10ms", 0, func() *amp.Msg {
+		return amp.NewPublish("cache", "invalidate", amp.TS(), amp.Full, nil)
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	msgs := s.Run(ctx)
+	m := <-msgs
+	assert.Equal(t, "cache/invalidate", m.URI)
+	cancel()
+	for range msgs {
+	}
+}
+
+func TestLeaderWorker(t *testing.T) {
+	s := New()
+	fired := make(chan struct{}, 16)
+	s.MustAdd("@every 5ms", 0, func() *amp.Msg {
+		fired <- struct{}{}
+		return nil
+	})
+	worker := s.LeaderWorker()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Run(ctx)
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Len(t, fired, 0)
+
+	lost := make(chan struct{})
+	go worker(lost)
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatal("not fired")
+	}
+	close(lost)
+}
@@ -5,7 +5,12 @@ var messageType = {
     response: 3,
     ping: 4,
     pong: 5,
-    alive: 6
+    alive: 6,
+    current: 7,
+    event: 8,
+    status: 9,
+    connect: 10,
+    ack: 11
 };
 
 var updateType = {
@@ -14,24 +19,44 @@ var updateType = {
   append: 2,
   update: 3,
   close: 4,
-	burstStart: 5,
-	burstEnd: 6
+  burstStart: 5,
+  burstEnd: 6,
+  fullStart: 7,
+  fullPart: 8,
+  fullEnd: 9
 };
 
 var keys = {
   "t": "type",
+  "r": "replyTo",
   "i": "correlationID",
   "e": "error",
   "u": "uri",
   "s": "ts",
   "p": "updateType",
-  "b": "subscriptions"
+  "l": "replay",
+  "b": "subscriptions",
+  "f": "filters",
+  "k": "chunk",
+  "h": "checksum",
+  "d": "cacheDepth",
+  "m": "meta",
+  "y": "priority",
+  "o": "origin",
+  "x": "keyID",
+  "z": "dictID",
+  "c": "contentType",
+  "n": "offset",
+  "a": "timeout",
+  "v": "version",
+  "q": "requiresAck"
 };
 
 var errorKeys = {
   "s": "source",
   "m": "message",
-  "c": "code"
+  "c": "code",
+  "r": "retryable"
 };
 
 function unpackHeader(o) {
@@ -103,10 +128,32 @@ function unpackMsg(data) {
   return msg;
 }
 
+// unpackBinary unpacks message from binary websocket frame,
+// body is ArrayBuffer of the bytes after the header
+function unpackBinary(data) {
+  var bytes = new Uint8Array(data),
+      sep = bytes.indexOf(10),
+      msg = null;
+  if (sep < 0) {
+    sep = bytes.length;
+  }
+  try {
+    msg = unpackHeader(JSON.parse(new TextDecoder().decode(bytes.subarray(0, sep))));
+  }catch(e){
+    return null;
+  }
+  msg["body"] = data.slice(sep + 1);
+  return msg;
+}
+
 function unpack(data) {
   if (!data) {
     return null;
   }
+  if (data instanceof ArrayBuffer) {
+    var m = unpackBinary(data);
+    return m ? [m] : [];
+  }
   var p = data.split("\n\n");
   var msgs = [];
   for(var i=0; i<p.length; i++) {
@@ -118,6 +165,60 @@ function unpack(data) {
   return msgs;
 }
 
+function utf8Decode(bytes) {
+  return new TextDecoder("utf-8").decode(bytes);
+}
+
+function isChunk(msg) {
+  return msg.updateType === updateType.fullStart ||
+    msg.updateType === updateType.fullPart ||
+    msg.updateType === updateType.fullEnd;
+}
+
+// parse decodes one message from the websocket frame (string or ArrayBuffer).
+// Unlike unpack it keeps the body text in rawBody, leaves parts of the
+// chunked full unparsed and throws on invalid message.
+function parse(data) {
+  var header, body;
+  if (typeof data === "string") {
+    var i = data.indexOf("\n");
+    header = i < 0 ? data : data.substring(0, i);
+    body = i < 0 ? "" : data.substring(i + 1);
+  } else {
+    var bytes = new Uint8Array(data), j = bytes.indexOf(10);
+    header = utf8Decode(j < 0 ? bytes : bytes.subarray(0, j));
+    body = j < 0 ? new Uint8Array(0) : bytes.slice(j + 1);
+  }
+  var msg = unpackHeader(JSON.parse(header));
+  if (msg.contentType) {
+    msg.body = body; // binary body
+  } else if (body.length > 0) {
+    msg.rawBody = typeof body === "string" ? body : utf8Decode(body);
+    if (!isChunk(msg)) {
+      msg.body = JSON.parse(msg.rawBody);
+    }
+  }
+  return msg;
+}
+
+// serialize encodes message into the wire format, same as Go amp.Msg
+// marshal: zero header values are omitted and header is always followed by
+// the separator.
+function serialize(msg) {
+  var header = {};
+  for (var short in keys) {
+    var v = msg[keys[short]];
+    if (v !== undefined && v !== null && v !== 0 && v !== "") {
+      header[short] = v;
+    }
+  }
+  var buf = JSON.stringify(header) + "\n";
+  if (msg.body !== undefined && msg.body !== null) {
+    buf += JSON.stringify(msg.body);
+  }
+  return buf;
+}
+
 function now() {
   return (new Date()).getTime();
 }
@@ -128,6 +229,10 @@ module.exports = {
   unpack: unpack,
   unpackMsg: unpackMsg,
   pack: pack,
+  parse: parse,
+  serialize: serialize,
+  isChunk: isChunk,
   ping: function(ts) {return {type: messageType.ping, ts: (ts || now()) }; },
-  pong: function() {return {type: messageType.pong}; }
+  pong: function() {return {type: messageType.pong}; },
+  ack: function(m) {return {type: messageType.ack, uri: m.uri, ts: m.ts}; }
 }
@@ -0,0 +1,11 @@
+// client.js is entry of the ws client bundle which gateway serves as
+// /amp.js (see amp/ws/jsclient.go). It exports wire format and connect.
+var amp = require("./amp.js");
+
+module.exports = {
+  messageType: amp.messageType,
+  updateType: amp.updateType,
+  parse: amp.parse,
+  serialize: amp.serialize,
+  connect: require("./connect.js")
+};
@@ -0,0 +1,297 @@
+// connect is ws transport client, served by the gateway from amp/ws.
+//
+//   var c = connect("ws://host/api", {onStatus: fn})
+//   var unsubscribe = c.subscribe("math.v1/i", function(msg) {...})
+//   c.request("math.req/add", {x: 1, y: 2}).then(function(body) {...})
+//   c.close()
+//
+// Client re-subscribes after reconnect with ts of the last received message,
+// so only missed messages are replayed, and replays already received are
+// dropped. It answers server pings and pings server when connection is idle,
+// and acknowledges messages which require it.
+var amp = require("./amp.js");
+
+// protocol version, sent in the connection url query string
+var protocolVersion = 2;
+
+// redirect returns url of the gateway to reconnect to, address is url
+// or host:port which replaces host in the current url
+function redirect(url, address) {
+  if (address.indexOf("://") > 0) {
+    return address;
+  }
+  return url.replace(/^(\w+:\/\/)[^\/?#]*/, "$1" + address);
+}
+
+function connect(url, opts) {
+  opts = opts || {};
+  var pingInterval = opts.pingInterval || 16000,
+      requestTimeout = opts.requestTimeout || 10000,
+      maxReconnect = opts.maxReconnectInterval || 10000,
+      onStatus = opts.onStatus || function () {};
+
+  var ws = null, connected = false, closed = false,
+      reconnectDelay = 0, lastReceived = 0, pingTimer = null,
+      hint = null, backoff = null, attempt = 0,
+      correlationID = 0, requests = {}, queue = [],
+      subscriptions = {}, // uri -> {ts, handlers}
+      chunks = {};        // uri -> parts of the chunked full
+
+  function send(msg) {
+    if (connected) {
+      ws.send(amp.serialize(msg));
+    } else {
+      queue.push(msg);
+    }
+  }
+
+  // resubscribe sends current subscriptions, on connect they are sent anyway
+  function resubscribe() {
+    if (connected) {
+      send(subscribeMessage());
+    }
+  }
+
+  function subscribeMessage() {
+    var b = {};
+    for (var uri in subscriptions) {
+      b[uri] = subscriptions[uri].ts;
+    }
+    return { type: amp.messageType.subscribe, subscriptions: b };
+  }
+
+  function open() {
+    ws = new WebSocket(url + (url.indexOf("?") < 0 ? "?" : "&") + "v=" + protocolVersion);
+    ws.binaryType = "arraybuffer";
+    ws.onopen = function () {
+      connected = true;
+      reconnectDelay = 0;
+      backoff = null;
+      attempt = 0;
+      lastReceived = Date.now();
+      onStatus("connected");
+      ws.send(amp.serialize(subscribeMessage()));
+      var q = queue;
+      queue = [];
+      q.forEach(send);
+    };
+    ws.onmessage = function (e) {
+      lastReceived = Date.now();
+      receive(amp.parse(e.data));
+    };
+    ws.onclose = function () {
+      connected = false;
+      ws = null;
+      if (closed) {
+        return;
+      }
+      onStatus("disconnected");
+      setTimeout(open, nextDelay());
+    };
+    ws.onerror = function () {
+      ws.close();
+    };
+  }
+
+  // nextDelay returns wait before the reconnect attempt. Reconnect hint
+  // from the server disconnect message sets other address, delay before
+  // the first attempt and backoff policy.
+  function nextDelay() {
+    var h = hint;
+    hint = null;
+    if (h) {
+      if (h.address) {
+        url = redirect(url, h.address);
+      }
+      if (h.backoff) {
+        backoff = h.backoff;
+      }
+      if (h.delay > 0) {
+        attempt = 0;
+        return h.delay;
+      }
+    }
+    if (backoff) {
+      var d = Math.min(backoff.min * Math.pow(2, attempt++), backoff.max);
+      if (backoff.jitter > 0) {
+        d += d * backoff.jitter * (2 * Math.random() - 1);
+      }
+      return Math.max(d, 0);
+    }
+    reconnectDelay = Math.min(Math.max(reconnectDelay * 2, 500), maxReconnect);
+    return reconnectDelay;
+  }
+
+  // ping server when connection is idle, reconnect if there is no answer
+  function keepalive() {
+    if (!connected) {
+      return;
+    }
+    var idle = Date.now() - lastReceived;
+    if (idle > 2 * pingInterval) {
+      ws.close();
+      return;
+    }
+    if (idle > pingInterval) {
+      send({ type: amp.messageType.ping, ts: Date.now() });
+    }
+  }
+
+  function receive(msg) {
+    if (msg.requiresAck) {
+      send({ type: amp.messageType.ack, uri: msg.uri, ts: msg.ts });
+    }
+    switch (msg.type) {
+      case amp.messageType.ping:
+        send({ type: amp.messageType.pong, correlationID: msg.correlationID, ts: msg.ts });
+        return;
+      case amp.messageType.response:
+        onResponse(msg);
+        return;
+      case amp.messageType.status:
+        if (msg.error && msg.body && typeof msg.body === "object") {
+          hint = msg.body; // disconnect with reconnect hint
+        }
+        onPublish(msg);
+        return;
+      case amp.messageType.publish:
+        onPublish(msg);
+        return;
+    }
+  }
+
+  function onResponse(msg) {
+    var r = requests[msg.correlationID];
+    if (!r) {
+      return;
+    }
+    delete requests[msg.correlationID];
+    clearTimeout(r.timer);
+    if (msg.error) {
+      r.reject(msg.error);
+      return;
+    }
+    r.resolve(msg.body);
+  }
+
+  function findSubscription(uri) {
+    if (subscriptions[uri]) {
+      return uri;
+    }
+    for (var s in subscriptions) {
+      if (uri.indexOf(s + "/") === 0) {
+        return s;
+      }
+    }
+    return null;
+  }
+
+  // assemble returns full message when last part of the chunked full arrives
+  function assemble(msg) {
+    if (msg.updateType === amp.updateType.fullStart) {
+      chunks[msg.uri] = [];
+    }
+    var parts = chunks[msg.uri];
+    if (!parts) {
+      return null;
+    }
+    parts.push(msg.rawBody || "");
+    if (msg.updateType !== amp.updateType.fullEnd) {
+      return null;
+    }
+    delete chunks[msg.uri];
+    msg.updateType = amp.updateType.full;
+    msg.rawBody = parts.join("");
+    msg.body = JSON.parse(msg.rawBody);
+    delete msg.chunk;
+    return msg;
+  }
+
+  function onPublish(msg) {
+    if (amp.isChunk(msg) && !(msg = assemble(msg))) {
+      return;
+    }
+    var uri = findSubscription(msg.uri);
+    if (uri === null) {
+      return;
+    }
+    var s = subscriptions[uri];
+    if (s.ts > 0 && msg.ts > 0) {
+      if (msg.replay && msg.ts <= s.ts) {
+        return; // already received
+      }
+      if (msg.ts === s.ts && msg.updateType !== amp.updateType.full) {
+        return;
+      }
+    }
+    if (msg.ts > 0 && msg.type === amp.messageType.publish &&
+        msg.updateType !== amp.updateType.burstStart && msg.updateType !== amp.updateType.burstEnd) {
+      s.ts = msg.ts;
+    }
+    s.handlers.slice().forEach(function (h) { h(msg); });
+  }
+
+  function subscribe(uri, handler) {
+    var s = subscriptions[uri];
+    if (!s) {
+      s = subscriptions[uri] = { ts: 0, handlers: [] };
+      resubscribe();
+    }
+    s.handlers.push(handler);
+    return function unsubscribe() {
+      var i = s.handlers.indexOf(handler);
+      if (i > -1) {
+        s.handlers.splice(i, 1);
+      }
+      if (s.handlers.length === 0 && subscriptions[uri] === s) {
+        delete subscriptions[uri];
+        resubscribe();
+      }
+    };
+  }
+
+  // request sends request to the uri, returns promise resolved with
+  // response body or rejected with error {source, message, code, retryable}
+  function request(uri, body, timeout) {
+    timeout = timeout || requestTimeout;
+    correlationID++;
+    var id = correlationID;
+    return new Promise(function (resolve, reject) {
+      requests[id] = {
+        resolve: resolve,
+        reject: reject,
+        timer: setTimeout(function () {
+          delete requests[id];
+          reject({ source: 1, message: "request timeout", retryable: true });
+        }, timeout)
+      };
+      send({
+        type: amp.messageType.request,
+        correlationID: id,
+        uri: uri,
+        ts: Date.now(),
+        timeout: timeout,
+        body: body
+      });
+    });
+  }
+
+  function close() {
+    closed = true;
+    clearInterval(pingTimer);
+    if (ws) {
+      ws.close();
+    }
+  }
+
+  pingTimer = setInterval(keepalive, pingInterval / 4);
+  open();
+
+  return {
+    subscribe: subscribe,
+    request: request,
+    close: close
+  };
+}
+
+module.exports = connect;
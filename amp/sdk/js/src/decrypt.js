@@ -0,0 +1,81 @@
+/*
+Decrypts bodies of the end-to-end encrypted messages (msg.keyID is set).
+Key for the topic is requested from the producer with '_key' request:
+  request uri: <request topic>/_key, body: {topic: topic, id: msg.keyID, pub: pair.pub}
+  response: {topic, id, eph, key} where key is AES-256 key wrapped for the
+  client key pair, gateway relaying the response can't read it.
+Key encryption key is SHA-256 of the ECDH (P-256) shared secret of the
+client and eph key, wrapped key is 12 bytes nonce followed by AES-GCM
+ciphertext, additional data is topic/id.
+Encrypted body is base64 string of 12 bytes nonce followed by AES-GCM
+ciphertext, additional data is message uri.
+*/
+
+function fromBase64(s) {
+  var bin = atob(s);
+  var buf = new Uint8Array(bin.length);
+  for (var i = 0; i < bin.length; i++) {
+    buf[i] = bin.charCodeAt(i);
+  }
+  return buf;
+}
+
+function toBase64(buf) {
+  var bin = "";
+  var bytes = new Uint8Array(buf);
+  for (var i = 0; i < bytes.length; i++) {
+    bin += String.fromCharCode(bytes[i]);
+  }
+  return btoa(bin);
+}
+
+var ecdh = {name: "ECDH", namedCurve: "P-256"};
+
+// keyPair resolves with client key pair, pair.pub is sent in the key request
+function keyPair() {
+  return crypto.subtle.generateKey(ecdh, false, ["deriveBits"]).then(function(pair) {
+    return crypto.subtle.exportKey("raw", pair.publicKey).then(function(pub) {
+      return {privateKey: pair.privateKey, pub: toBase64(pub)};
+    });
+  });
+}
+
+// importKey creates crypto key from the key response body
+function importKey(pair, rsp) {
+  return crypto.subtle.importKey("raw", fromBase64(rsp.eph), ecdh, false, []).then(function(eph) {
+    return crypto.subtle.deriveBits({name: "ECDH", public: eph}, pair.privateKey, 256);
+  }).then(function(secret) {
+    return crypto.subtle.digest("SHA-256", secret);
+  }).then(function(kek) {
+    return crypto.subtle.importKey("raw", kek, "AES-GCM", false, ["decrypt"]);
+  }).then(function(kek) {
+    var wrapped = fromBase64(rsp.key);
+    return crypto.subtle.decrypt({
+      name: "AES-GCM",
+      iv: wrapped.slice(0, 12),
+      additionalData: new TextEncoder().encode(rsp.topic + "/" + rsp.id),
+    }, kek, wrapped.slice(12));
+  }).then(function(key) {
+    return crypto.subtle.importKey("raw", key, "AES-GCM", false, ["decrypt"]);
+  });
+}
+
+// decrypt resolves with message where body is replaced by decrypted one
+function decrypt(key, msg) {
+  var sealed = fromBase64(msg.body);
+  return crypto.subtle.decrypt({
+    name: "AES-GCM",
+    iv: sealed.slice(0, 12),
+    additionalData: new TextEncoder().encode(msg.uri),
+  }, key, sealed.slice(12)).then(function(plain) {
+    msg.body = JSON.parse(new TextDecoder().decode(plain));
+    delete msg.keyID;
+    return msg;
+  });
+}
+
+module.exports = {
+  keyPair,
+  importKey,
+  decrypt,
+};
@@ -133,6 +133,9 @@ module.exports = function(config) {
       if (m === null) {
         return pongReceived;
       }
+      if (m.requiresAck) {
+        send(amp.ack(m), failHandlers.ignore);
+      }
       switch (m.type) {
       case amp.messageType.publish:
         sub.publish(m);
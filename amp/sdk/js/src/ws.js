@@ -194,6 +194,7 @@ module.exports = function(uri, onMessage_, onChange_) { // TODO get rid of this
 
     try {
       ws = new WebSocket(uri);
+      ws.binaryType = "arraybuffer";
     } catch (e) {
       reconnect();
       status.event("wsError", e);
@@ -0,0 +1,161 @@
+package session
+
+import (
+	"sort"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/metric"
+)
+
+// RequireAcks tracks delivery of the critical messages (amp.Msg
+// RequiresAck). Message not acknowledged by the client within retry
+// interval is written again, after attempts writes it is undelivered.
+// Delivery receipts (amp.Receipt) are published with publish, to the
+// producer's ReplyTo topic or amp.ReceiptsTopic.
+// Clients with legacy encoding (ProtocolVersion1 or without version) don't
+// get RequiresAck flag, their messages are not tracked.
+func RequireAcks(retry time.Duration, attempts int, publish func(*amp.Msg)) func(*Sessions) {
+	return func(s *Sessions) {
+		s.opts.acks = &acks{
+			retry:    retry,
+			attempts: attempts,
+			publish:  publish,
+		}
+	}
+}
+
+type acks struct {
+	retry    time.Duration
+	attempts int
+	publish  func(*amp.Msg)
+}
+
+// unacked is critical message written to the client, waiting for ack
+type unacked struct {
+	seq      uint64 // session sequence of the message, in write order
+	m        *amp.Msg
+	attempts int
+	sentAt   time.Time // zero while queued for retry
+}
+
+// awaitAck starts tracking written message which requires ack
+func (s *session) awaitAck(m *amp.Msg) {
+	if s.acks == nil || !m.RequiresAck {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.version() != amp.CompatibilityVersionDefault {
+		return // legacy encoding drops RequiresAck, client can't ack
+	}
+	u := s.find(func(u *unacked) bool { return u.m == m && u.sentAt.IsZero() })
+	if u == nil {
+		s.ackSeq++
+		u = &unacked{seq: s.ackSeq, m: m}
+		s.unacked[u.seq] = u
+	}
+	u.attempts++
+	u.sentAt = time.Now()
+}
+
+// find returns first written message which matches.
+// Should be called during s.Lock.
+func (s *session) find(match func(*unacked) bool) *unacked {
+	var first *unacked
+	for _, u := range s.unacked {
+		if match(u) && (first == nil || u.seq < first.seq) {
+			first = u
+		}
+	}
+	return first
+}
+
+// adoptAcks takes messages waiting for ack of the resumed session,
+// they are renumbered in the session sequence keeping the write order.
+// Should be called during s.Lock.
+func (s *session) adoptAcks(waiting map[uint64]*unacked) {
+	us := make([]*unacked, 0, len(waiting))
+	for _, u := range waiting {
+		us = append(us, u)
+	}
+	sort.Slice(us, func(i, j int) bool { return us[i].seq < us[j].seq })
+	for _, u := range us {
+		s.ackSeq++
+		u.seq = s.ackSeq
+		s.unacked[u.seq] = u
+	}
+}
+
+// ack receives client acknowledgment and reports delivery to the producer.
+// Client acks by uri and ts, messages with the same uri and ts are
+// acknowledged in write order.
+func (s *session) ack(m *amp.Msg) {
+	if s.acks == nil {
+		return
+	}
+	s.Lock()
+	u := s.find(func(u *unacked) bool { return u.m.URI == m.URI && u.m.Ts == m.Ts })
+	if u != nil {
+		delete(s.unacked, u.seq)
+	}
+	s.Unlock()
+	if u == nil {
+		return
+	}
+	metric.Counter("ack.delivered")
+	s.receipt(u, amp.Delivered)
+}
+
+// retryAcks writes again messages without ack within retry interval,
+// messages over attempts are reported undelivered
+func (s *session) retryAcks() {
+	var failed, due []*unacked
+	s.Lock()
+	for seq, u := range s.unacked {
+		if u.sentAt.IsZero() || time.Since(u.sentAt) < s.acks.retry {
+			continue
+		}
+		if u.attempts >= s.acks.attempts {
+			delete(s.unacked, seq)
+			failed = append(failed, u)
+			continue
+		}
+		due = append(due, u)
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].seq < due[j].seq })
+	for _, u := range due {
+		u.sentAt = time.Time{} // until written again
+		metric.Counter("ack.retry")
+		s.enqueue(u.m)
+	}
+	s.Unlock()
+	for _, u := range failed {
+		s.log().S("uri", u.m.URI).I("attempts", u.attempts).Info("undelivered")
+		metric.Counter("ack.undelivered")
+		s.receipt(u, amp.Undelivered)
+	}
+}
+
+// dropAcks reports all messages waiting for ack undelivered
+func (s *session) dropAcks() {
+	if s.acks == nil {
+		return
+	}
+	s.Lock()
+	waiting := s.unacked
+	s.unacked = make(map[uint64]*unacked)
+	s.Unlock()
+	for _, u := range waiting {
+		metric.Counter("ack.undelivered")
+		s.receipt(u, amp.Undelivered)
+	}
+}
+
+func (s *session) receipt(u *unacked, status string) {
+	s.acks.publish(u.m.NewReceipt(amp.Receipt{
+		Status:   status,
+		Attempts: u.attempts,
+		Meta:     s.Meta(),
+	}))
+}
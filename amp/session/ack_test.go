@@ -0,0 +1,84 @@
+package session
+
+import (
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireAcks(t *testing.T) {
+	var receipts []amp.Receipt
+	publish := func(m *amp.Msg) {
+		var r amp.Receipt
+		assert.Nil(t, amp.Parse(m.Marshal()).Unmarshal(&r))
+		receipts = append(receipts, r)
+	}
+	s := &Sessions{}
+	RequireAcks(time.Millisecond, 2, publish)(s)
+	conn := &mockConn{out: make(chan []byte, 16), meta: map[string]string{"user": "u1", amp.VersionKey: "2"}}
+	ss := newSession(conn, &mockRequester{}, &mockBroker{}, amp.CompatibilityVersionDefault, options{acks: s.opts.acks})
+
+	critical := amp.Build().Type(amp.Publish).URI("notify/u1").Ts(1).RequireAck().MustMsg()
+	ss.connWrite(critical)
+	ss.connWrite(amp.NewPublish("notify", "u1", 2, amp.Append, nil)) // not critical
+	assert.Len(t, ss.unacked, 1)
+
+	// ack reports delivery
+	ss.receive(amp.Parse(amp.NewAck(critical).Marshal()))
+	assert.Len(t, ss.unacked, 0)
+	assert.Len(t, receipts, 1)
+	assert.Equal(t, amp.Receipt{URI: "notify/u1", Ts: 1, Status: amp.Delivered, Attempts: 1, Meta: conn.meta}, receipts[0])
+
+	// unacked message is written again, then reported undelivered
+	critical = amp.Build().Type(amp.Publish).URI("notify/u1").Ts(3).RequireAck().MustMsg()
+	ss.connWrite(critical)
+	time.Sleep(2 * time.Millisecond)
+	ss.retryAcks()
+	assert.Len(t, ss.outQueue, 1)
+	ss.connWrite(ss.outQueue[0])
+	ss.outQueue = nil
+	time.Sleep(2 * time.Millisecond)
+	ss.retryAcks()
+	assert.Len(t, ss.unacked, 0)
+	assert.Len(t, receipts, 2)
+	assert.Equal(t, amp.Undelivered, receipts[1].Status)
+	assert.Equal(t, 2, receipts[1].Attempts)
+
+	// disconnect reports waiting messages undelivered
+	ss.connWrite(amp.Build().Type(amp.Publish).URI("notify/u1").Ts(4).RequireAck().MustMsg())
+	ss.unsubscribe()
+	assert.Len(t, receipts, 3)
+	assert.Equal(t, int64(4), receipts[2].Ts)
+}
+
+func TestRequireAcksSameTs(t *testing.T) {
+	var receipts []amp.Receipt
+	publish := func(m *amp.Msg) {
+		var r amp.Receipt
+		assert.Nil(t, amp.Parse(m.Marshal()).Unmarshal(&r))
+		receipts = append(receipts, r)
+	}
+	s := &Sessions{}
+	RequireAcks(time.Minute, 2, publish)(s)
+	conn := &mockConn{out: make(chan []byte, 16), meta: map[string]string{amp.VersionKey: "2"}}
+	ss := newSession(conn, &mockRequester{}, &mockBroker{}, amp.CompatibilityVersionDefault, options{acks: s.opts.acks})
+
+	// two messages on the same uri in the same millisecond
+	ss.connWrite(amp.Build().Type(amp.Publish).URI("notify/u1").Ts(1).RequireAck().MustMsg())
+	ss.connWrite(amp.Build().Type(amp.Publish).URI("notify/u1").Ts(1).RequireAck().MustMsg())
+	assert.Len(t, ss.unacked, 2)
+	ack := amp.NewAck(amp.NewPublish("notify", "u1", 1, amp.Append, nil))
+	ss.receive(amp.Parse(ack.Marshal()))
+	assert.Len(t, ss.unacked, 1)
+	ss.receive(amp.Parse(ack.Marshal()))
+	assert.Len(t, ss.unacked, 0)
+	assert.Len(t, receipts, 2)
+
+	// legacy client can't ack, message is not tracked
+	conn = &mockConn{out: make(chan []byte, 16), meta: map[string]string{}}
+	ss = newSession(conn, &mockRequester{}, &mockBroker{}, amp.CompatibilityVersionDefault, options{acks: s.opts.acks})
+	ss.connWrite(amp.Build().Type(amp.Publish).URI("notify/u1").Ts(2).RequireAck().MustMsg())
+	assert.Len(t, ss.unacked, 0)
+}
@@ -0,0 +1,56 @@
+package session
+
+import (
+	"sync"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+)
+
+// backoff holds current reconnect policy sent to the clients
+type backoff struct {
+	policy *amp.Backoff
+	sync.Mutex
+}
+
+func (b *backoff) get() *amp.Backoff {
+	if b == nil {
+		return nil
+	}
+	b.Lock()
+	defer b.Unlock()
+	return b.policy
+}
+
+func (b *backoff) set(p *amp.Backoff) {
+	b.Lock()
+	defer b.Unlock()
+	b.policy = p
+}
+
+// ReconnectBackoff sets reconnect backoff policy sent to the clients in
+// each disconnect message. Can be changed at runtime with SetBackoff.
+func ReconnectBackoff(p amp.Backoff) func(*Sessions) {
+	return func(s *Sessions) {
+		s.opts.backoff = &backoff{policy: &p}
+	}
+}
+
+// SetBackoff changes reconnect backoff policy at runtime, e.g. to slow
+// down reconnect attempts of all clients during incident. Nil removes
+// policy, clients use their default.
+func (s *Sessions) SetBackoff(p *amp.Backoff) {
+	if p != nil {
+		log.I("minMs", int(p.Min)).I("maxMs", int(p.Max)).Info("reconnect backoff")
+	}
+	s.opts.backoff.set(p)
+}
+
+// disconnect creates disconnect message with the current backoff policy
+func (b *backoff) disconnect(reason string) *amp.Msg {
+	p := b.get()
+	if p == nil {
+		return amp.NewDisconnect(reason)
+	}
+	return amp.NewReconnect(reason, amp.ReconnectHint{Backoff: p})
+}
@@ -0,0 +1,43 @@
+package session
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	var b *backoff
+	_, ok := amp.Parse(b.disconnect("slow consumer").Marshal()).ReconnectHint()
+	assert.False(t, ok)
+
+	p := amp.Backoff{Min: 1000, Max: 30000, Jitter: 0.5}
+	s := &Sessions{}
+	ReconnectBackoff(p)(s)
+	h, ok := amp.Parse(s.opts.backoff.disconnect("slow consumer").Marshal()).ReconnectHint()
+	assert.True(t, ok)
+	assert.Equal(t, p, *h.Backoff)
+
+	s.SetBackoff(nil)
+	_, ok = amp.Parse(s.opts.backoff.disconnect("slow consumer").Marshal()).ReconnectHint()
+	assert.False(t, ok)
+}
+
+func TestDrainBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := Factory(ctx, &mockBroker{}, &mockRequester{})
+	p := amp.Backoff{Min: 5000, Max: 60000}
+	s.SetBackoff(&p)
+	s.Drain(ctx, time.Millisecond, amp.ReconnectHint{Delay: 100})
+
+	c := &mockConn{in: make(chan []byte), out: make(chan []byte, 1), meta: versioned()}
+	s.Serve(c)
+	h, ok := amp.Parse(<-c.out).ReconnectHint()
+	assert.True(t, ok)
+	assert.Equal(t, int64(100), h.Delay)
+	assert.Equal(t, p, *h.Backoff)
+}
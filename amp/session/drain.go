@@ -0,0 +1,107 @@
+package session
+
+import (
+	"context"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+)
+
+// ErrorCodeDraining is error code of the disconnect message sent to the
+// clients of the draining gateway.
+const ErrorCodeDraining = -135
+
+func init() {
+	amp.RegisterError(amp.ErrorDef{
+		Code:      ErrorCodeDraining,
+		Retryable: true,
+		Messages:  map[string]string{"": "server is restarting"},
+	})
+}
+
+// newDrainMsg creates drain disconnect message, with the current backoff
+// policy if hint doesn't have one
+func newDrainMsg(h amp.ReconnectHint, b *backoff) *amp.Msg {
+	if h.Backoff == nil {
+		h.Backoff = b.get()
+	}
+	m := amp.NewReconnect("draining", h)
+	m.Error.Code = ErrorCodeDraining
+	return m
+}
+
+// Drain prepares gateway for shutdown (rolling deploy). New connections
+// are rejected and active sessions are disconnected gradually over window,
+// so clients don't reconnect all at once. Each client gets disconnect
+// message with reconnect hint (other address, e.g. of the sticky
+// instance, or delay). Blocks until all sessions are disconnected or ctx
+// is done.
+func (s *Sessions) Drain(ctx context.Context, window time.Duration, h amp.ReconnectHint) {
+	s.activeLock.Lock()
+	s.draining = &h
+	sessions := make([]*session, 0, len(s.active))
+	for ss := range s.active {
+		sessions = append(sessions, ss)
+	}
+	s.activeLock.Unlock()
+
+	log.I("sessions", len(sessions)).I("windowMs", int(window/time.Millisecond)).Info("drain")
+	if len(sessions) == 0 {
+		return
+	}
+	// window shorter than number of sessions disconnects all at once
+	var tick <-chan time.Time
+	if interval := window / time.Duration(len(sessions)); interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for i, ss := range sessions {
+		if i > 0 && tick != nil {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+				return
+			}
+		}
+		ss.drain(newDrainMsg(h, s.opts.backoff))
+		metric.Counter("drained")
+	}
+}
+
+// Draining returns true if Drain is started.
+func (s *Sessions) Draining() bool {
+	s.activeLock.Lock()
+	defer s.activeLock.Unlock()
+	return s.draining != nil
+}
+
+// reject closes new connection of the draining gateway, returns false if
+// gateway is not draining
+func (s *Sessions) reject(conn connection) bool {
+	s.activeLock.Lock()
+	h := s.draining
+	s.activeLock.Unlock()
+	if h == nil {
+		return false
+	}
+	metric.Counter("drainRejected")
+	_ = conn.Write(newDrainMsg(*h, s.opts.backoff).Marshal(), false)
+	_ = conn.Close()
+	return true
+}
+
+// drain sends disconnect message after already queued messages,
+// connection is closed after it is written
+func (s *session) drain(m *amp.Msg) {
+	s.Lock()
+	defer s.Unlock()
+	if s.closing {
+		return
+	}
+	s.push(m)
+	s.closing = true
+	s.signalQueueChanged()
+}
@@ -0,0 +1,71 @@
+package session
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := Factory(ctx, &mockBroker{}, &mockRequester{})
+	var conns []*mockConn
+	for i := 0; i < 3; i++ {
+		c := &mockConn{in: make(chan []byte), out: make(chan []byte, 16), meta: versioned()}
+		conns = append(conns, c)
+		go s.Serve(c)
+	}
+	for s.wsConnections.Count() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	hint := amp.ReconnectHint{Address: "wss://gw2", Delay: 100}
+	start := time.Now()
+	s.Drain(ctx, 20*time.Millisecond, hint)
+	assert.True(t, time.Since(start) >= 10*time.Millisecond) // spread over window
+	assert.True(t, s.Draining())
+	for _, c := range conns {
+		m := amp.Parse(<-c.out)
+		assert.Equal(t, ErrorCodeDraining, m.Error.Code)
+		h, ok := m.ReconnectHint()
+		assert.True(t, ok)
+		assert.Equal(t, hint, h)
+	}
+	for s.wsConnections.Count() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// new connection is rejected
+	c := &mockConn{in: make(chan []byte), out: make(chan []byte, 1), meta: versioned()}
+	s.Serve(c)
+	m := amp.Parse(<-c.out)
+	assert.Equal(t, ErrorCodeDraining, m.Error.Code)
+	_, ok := <-c.in
+	assert.False(t, ok)
+}
+
+func TestDrainAtOnce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := Factory(ctx, &mockBroker{}, &mockRequester{})
+	var conns []*mockConn
+	for i := 0; i < 3; i++ {
+		c := &mockConn{in: make(chan []byte), out: make(chan []byte, 16), meta: versioned()}
+		conns = append(conns, c)
+		go s.Serve(c)
+	}
+	for s.wsConnections.Count() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// window shorter than one tick per session
+	s.Drain(ctx, 0, amp.ReconnectHint{})
+	for _, c := range conns {
+		m := amp.Parse(<-c.out)
+		assert.Equal(t, ErrorCodeDraining, m.Error.Code)
+	}
+}
@@ -2,6 +2,7 @@ package session
 
 import (
 	"context"
+	"sort"
 	"sync"
 	"time"
 
@@ -17,6 +18,7 @@ type requester interface {
 type broker interface {
 	Subscribe(amp.Subscriber, map[string]int64) // subscribe to the topics
 	Unsubscribe(amp.Subscriber)                 // unsubscribe from all topics
+	Backfill(amp.Subscriber, *amp.Msg)          // replay range of the append topic
 	Wait()                                      // wait for clean exit
 }
 
@@ -30,6 +32,12 @@ type connection interface {
 	Meta() map[string]string                   // session metadata, set by the client
 }
 
+// binaryWriter is implemented by connections which distinguish text and
+// binary frames (websocket), used for messages with binary body
+type binaryWriter interface {
+	WriteBinary(payload []byte, deflated bool) error
+}
+
 type counter struct {
 	value int
 	max   int
@@ -71,16 +79,69 @@ type Sessions struct {
 	wg                 sync.WaitGroup
 	wsConnections      counter
 	poolingConnections counter
+	opts               options
+	active             map[*session]struct{}
+	activeLock         sync.Mutex
+	draining           *amp.ReconnectHint // set by Drain
+}
+
+// MaxLag disconnects slow consumers, sessions in which the oldest message
+// waiting to be written is older than d. Client gets Status message with
+// transport error before connection is closed.
+func MaxLag(d time.Duration) func(*Sessions) {
+	return func(s *Sessions) {
+		s.opts.maxLag = d
+	}
+}
+
+// Keepalive sends Ping to the clients every interval and closes connection
+// if Pong is not received within timeout. Round trip time is submitted
+// to the rtt metric.
+func Keepalive(interval, timeout time.Duration) func(*Sessions) {
+	return func(s *Sessions) {
+		s.opts.pingInterval = interval
+		s.opts.pongTimeout = timeout
+	}
+}
+
+// Compression sets compression policy for all connections, instead of
+// the topic policy (see amp.SetTopicCompression).
+func Compression(p amp.CompressionPolicy) func(*Sessions) {
+	return func(s *Sessions) {
+		s.opts.compression = &p
+	}
+}
+
+// MaxPendingRequests limits number of requests per client waiting for
+// response. Requests over the limit are rejected with ErrTooManyRequests
+// transport error, without sending them to the requester.
+func MaxPendingRequests(n int) func(*Sessions) {
+	return func(s *Sessions) {
+		s.opts.maxPending = n
+	}
 }
 
 // Factory creates new seessions factory.
-func Factory(ctx context.Context, broker broker, requester requester) *Sessions {
+// Client limits are set with LimitClients, session resumption with Resume,
+// delivery tracking of the critical messages with RequireAcks, user
+// addressing with Users.
+func Factory(ctx context.Context, broker broker, requester requester, opts ...func(*Sessions)) *Sessions {
 	cancelSig, cancelSessions := context.WithCancel(context.Background())
 	s := &Sessions{
 		broker:    broker,
 		requester: requester,
 		cancelSig: cancelSig,
 		closed:    make(chan struct{}),
+		active:    make(map[*session]struct{}),
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	if s.opts.backoff == nil {
+		s.opts.backoff = &backoff{}
+	}
+	if s.opts.resumer != nil {
+		s.opts.resumer.shared = s.opts.shared
 	}
 
 	go s.waitDone(ctx, cancelSessions)
@@ -90,23 +151,66 @@ func Factory(ctx context.Context, broker broker, requester requester) *Sessions
 // Serve creates new session for connection.
 // Blocks until connection is closed
 func (s *Sessions) Serve(conn connection) {
-	s.wg.Add(1)
-	s.wsConnections.Up()
-	serve(s.cancelSig, conn, s.requester, s.broker, amp.CompatibilityVersionDefault)
-	s.wg.Done()
-	s.wsConnections.Down()
+	s.serve(conn, amp.CompatibilityVersionDefault)
 }
 
 // Serve creates new session for connection.
 // Blocks until connection is closed
 func (s *Sessions) ServeV1(conn connection) {
+	s.serve(conn, amp.CompatibilityVersion1)
+}
+
+func (s *Sessions) serve(conn connection, compatibilityVersion uint8) {
+	if s.reject(conn) {
+		return
+	}
 	s.wg.Add(1)
 	s.wsConnections.Up()
-	serve(s.cancelSig, conn, s.requester, s.broker, amp.CompatibilityVersion1)
+	ss := newSession(conn, s.requester, s.broker, compatibilityVersion, s.opts)
+	s.activeLock.Lock()
+	s.active[ss] = struct{}{}
+	draining := s.draining
+	s.activeLock.Unlock()
+	if draining != nil { // drain started after reject check
+		ss.drain(newDrainMsg(*draining, s.opts.backoff))
+	}
+
+	ss.loop(s.cancelSig)
+
+	s.activeLock.Lock()
+	delete(s.active, ss)
+	s.activeLock.Unlock()
 	s.wg.Done()
 	s.wsConnections.Down()
 }
 
+// Lag is delivery lag of the ws session.
+type Lag struct {
+	No       uint64        // connection identifier
+	QueueLen int           // messages waiting to be written
+	Age      time.Duration // age of the oldest waiting message
+}
+
+// Lags returns delivery lag of the sessions which have waiting messages,
+// sorted by age, the slowest first.
+func (s *Sessions) Lags() []Lag {
+	s.activeLock.Lock()
+	sessions := make([]*session, 0, len(s.active))
+	for ss := range s.active {
+		sessions = append(sessions, ss)
+	}
+	s.activeLock.Unlock()
+
+	var lags []Lag
+	for _, ss := range sessions {
+		if l, age := ss.lag(); l > 0 {
+			lags = append(lags, Lag{No: ss.conn.No(), QueueLen: l, Age: age})
+		}
+	}
+	sort.Slice(lags, func(i, j int) bool { return lags[i].Age > lags[j].Age })
+	return lags
+}
+
 func (s *Sessions) waitDone(ctx context.Context, cancelSessions func()) {
 	<-ctx.Done()       // wait for application interupt signal
 	s.requester.Wait() // wait for clean exit of requester
@@ -138,6 +242,11 @@ func (s *Sessions) Pool(m *amp.Msg) []*amp.Msg {
 		return []*amp.Msg{m.Pong()}
 	case amp.Request:
 		p := newPooler()
+		if m.IsBackfill() {
+			s.broker.Backfill(p, m)
+			p.waitResponse(s.cancelSig, poolInterval)
+			return p.msgs
+		}
 		s.requester.Send(p, m)
 		p.waitOne(s.cancelSig, poolInterval)
 		s.requester.Unsubscribe(p)
@@ -174,8 +283,9 @@ type pooler struct {
 func (p *pooler) Send(m *amp.Msg) {
 	p.Lock()
 	p.msgs = append(p.msgs, m)
+	onMsg := p.onMsg
 	p.Unlock()
-	p.onMsg()
+	onMsg()
 }
 
 func (p *pooler) waitOne(app context.Context, interval time.Duration) {
@@ -186,6 +296,29 @@ func (p *pooler) waitOne(app context.Context, interval time.Duration) {
 	}
 }
 
+// waitResponse waits for the response message, collecting all messages before it
+func (p *pooler) waitResponse(app context.Context, interval time.Duration) {
+	timeout := time.After(interval)
+	for {
+		p.Lock()
+		if n := len(p.msgs); n > 0 && p.msgs[n-1].Type == amp.Response {
+			p.Unlock()
+			return
+		}
+		var msgWait context.Context
+		msgWait, p.onMsg = context.WithCancel(context.Background())
+		p.Unlock()
+
+		select {
+		case <-app.Done():
+			return
+		case <-timeout:
+			return
+		case <-msgWait.Done():
+		}
+	}
+}
+
 func (p *pooler) wait(app context.Context, interval time.Duration) {
 	select {
 	case <-app.Done():
@@ -0,0 +1,102 @@
+package session
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/cache"
+	"github.com/minus5/svckit/amp/filter"
+)
+
+// filters are subscription filters of the session by uri or topic.
+//
+// Full and Diff are filtered together: they are merged into the uri state
+// and filter is evaluated on the merged state. Client gets diffs while the
+// state matches, Full when state starts matching and Close when it stops
+// matching, so its state is always merged from the same stream.
+// Append messages and binary bodies are filtered one by one.
+type filters struct {
+	exprs   map[string]*filter.Filter
+	state   *cache.Cache    // state of the filtered uris
+	matched map[string]bool // uris with matching state sent to the client
+	sync.Mutex
+}
+
+func newFilters(exprs map[string]*filter.Filter) *filters {
+	return &filters{
+		exprs:   exprs,
+		state:   cache.New(),
+		matched: make(map[string]bool),
+	}
+}
+
+func (f *filters) find(m *amp.Msg) (*filter.Filter, bool) {
+	if m.Type != amp.Publish {
+		return nil, false
+	}
+	flt, ok := f.exprs[m.URI]
+	if !ok {
+		flt, ok = f.exprs[m.Topic()]
+	}
+	return flt, ok
+}
+
+// apply returns messages to send to the client instead of m.
+// Decodes message body, should be called outside of the session lock.
+func (f *filters) apply(m *amp.Msg) []*amp.Msg {
+	flt, ok := f.find(m)
+	if !ok {
+		return []*amp.Msg{m}
+	}
+	switch {
+	case m.UpdateType == amp.BurstStart || m.UpdateType == amp.BurstEnd:
+		return []*amp.Msg{m}
+	case m.UpdateType == amp.Append || m.IsBinary():
+		if flt.Match(m.BodyBytes()) {
+			return []*amp.Msg{m}
+		}
+		return nil
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	f.state.Add(m)
+	if m.UpdateType == amp.Close {
+		delete(f.matched, m.URI)
+		return []*amp.Msg{m}
+	}
+	if m.IsChunk() && m.UpdateType != amp.FullEnd {
+		return nil // parts are sent as one Full when assembled
+	}
+
+	body, ts := f.state.Get(m.URI)
+	was := f.matched[m.URI]
+	is := body != nil && flt.Match(body)
+	if is {
+		f.matched[m.URI] = true
+	} else {
+		delete(f.matched, m.URI)
+	}
+	switch {
+	case is && (m.UpdateType == amp.Full || m.UpdateType == amp.Update):
+		return []*amp.Msg{m}
+	case is && was && m.UpdateType == amp.Diff:
+		return []*amp.Msg{m}
+	case is:
+		// state started matching on diff or assembled chunked full
+		return []*amp.Msg{publishState(m, ts, amp.Full, body)}
+	case was:
+		return []*amp.Msg{publishState(m, ts, amp.Close, nil)}
+	}
+	return nil
+}
+
+// publishState creates message for the uri of m
+func publishState(m *amp.Msg, ts int64, updateType uint8, body []byte) *amp.Msg {
+	var o interface{}
+	if body != nil {
+		o = json.RawMessage(body)
+	}
+	return amp.NewPublish(m.Topic(), m.Path(), ts, updateType, o)
+}
@@ -0,0 +1,50 @@
+package session
+
+import (
+	"time"
+
+	"github.com/minus5/svckit/amp"
+)
+
+// keepalive sends pings to the client and expects pong within timeout.
+// Only one ping is waiting for pong at the time, so round trip time is
+// measured from the ping send time (clients don't echo ping Ts).
+type keepalive struct {
+	interval time.Duration
+	timeout  time.Duration
+	no       uint64
+	sentAt   time.Time     // zero if no ping is waiting for pong
+	rtt      time.Duration // last round trip time
+}
+
+func newKeepalive(interval, timeout time.Duration) *keepalive {
+	if interval <= 0 {
+		return nil
+	}
+	return &keepalive{interval: interval, timeout: timeout}
+}
+
+// ping returns ping message to send, nil if previous is still waiting for pong
+func (k *keepalive) ping() *amp.Msg {
+	if !k.sentAt.IsZero() {
+		return nil
+	}
+	k.no++
+	k.sentAt = time.Now()
+	return &amp.Msg{Type: amp.Ping, CorrelationID: k.no, Ts: amp.TS()}
+}
+
+// pong records round trip time of the waiting ping
+func (k *keepalive) pong() (time.Duration, bool) {
+	if k.sentAt.IsZero() {
+		return 0, false
+	}
+	k.rtt = time.Since(k.sentAt)
+	k.sentAt = time.Time{}
+	return k.rtt, true
+}
+
+// dead returns true if pong is not received within timeout
+func (k *keepalive) dead() bool {
+	return k.timeout > 0 && !k.sentAt.IsZero() && time.Since(k.sentAt) > k.timeout
+}
@@ -0,0 +1,270 @@
+package session
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/metric"
+)
+
+// Error codes of the client limits.
+// Subscription over limit is rejected with Status message on the topic,
+// request over rate with error response. Writes to the client over
+// bandwidth are delayed until bandwidth is available.
+const (
+	ErrorCodeSubscriptionLimit = -132
+	ErrorCodeRequestRate       = -133
+)
+
+func init() {
+	amp.RegisterError(amp.ErrorDef{
+		Code:     ErrorCodeSubscriptionLimit,
+		Messages: map[string]string{"": "too many subscriptions"},
+	})
+	amp.RegisterError(amp.ErrorDef{
+		Code:      ErrorCodeRequestRate,
+		Retryable: true,
+		Messages:  map[string]string{"": "too many requests"},
+	})
+}
+
+// ClientLimits are limits of the client in all of its sessions.
+// Zero value of the field is no limit.
+type ClientLimits struct {
+	MaxSubscriptions int     // topics subscribed at the same time
+	RequestsPerSec   float64 // rate of the requests
+	BytesPerSec      int     // bandwidth of the messages written to the client
+}
+
+// LimitClients enforces limits for each client. Client is identified by
+// the session meta key (set by authentication), sessions without the key
+// are limited each on its own.
+func LimitClients(key string, l ClientLimits) func(*Sessions) {
+	return func(s *Sessions) {
+		s.opts.clients = &clients{
+			key:    key,
+			limits: l,
+			m:      make(map[string]*client),
+		}
+	}
+}
+
+// clients is registry of the limited clients
+type clients struct {
+	key    string
+	limits ClientLimits
+	m      map[string]*client
+	sync.Mutex
+}
+
+// client is usage of the client in all of its sessions
+type client struct {
+	id       string
+	sessions map[*session][]string // subscribed topics by session
+	requests bucket
+	bytes    bucket
+}
+
+// bucket is token bucket holding one second of the rate
+type bucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64, now time.Time) bucket {
+	return bucket{rate: rate, tokens: rate, last: now}
+}
+
+// take returns false if there is not enough tokens for n.
+// Full bucket allows n over the rate, tokens are then owed.
+func (b *bucket) take(now time.Time, n float64) bool {
+	if b.rate <= 0 {
+		return true
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	if b.tokens < n && b.tokens < b.rate {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// wait takes n tokens, owing them if there is not enough, and returns
+// time until the debt is paid
+func (b *bucket) wait(now time.Time, n float64) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// acquire registers session of the client
+func (cs *clients) acquire(s *session) *client {
+	id := s.conn.Meta()[cs.key]
+	if id == "" {
+		id = "#" + strconv.FormatUint(s.conn.No(), 10)
+	}
+	cs.Lock()
+	defer cs.Unlock()
+	c, ok := cs.m[id]
+	if !ok {
+		now := time.Now()
+		c = &client{
+			id:       id,
+			sessions: make(map[*session][]string),
+			requests: newBucket(cs.limits.RequestsPerSec, now),
+			bytes:    newBucket(float64(cs.limits.BytesPerSec), now),
+		}
+		cs.m[id] = c
+	}
+	c.sessions[s] = nil
+	return c
+}
+
+// release unregisters session of the client
+func (cs *clients) release(s *session, c *client) {
+	cs.Lock()
+	defer cs.Unlock()
+	delete(c.sessions, s)
+	if len(c.sessions) == 0 {
+		delete(cs.m, c.id)
+	}
+}
+
+// subscribe splits topics into allowed and rejected by subscriptions limit.
+// Topics the session is already subscribed to are kept first.
+func (cs *clients) subscribe(s *session, c *client, topics map[string]int64) (map[string]int64, []string) {
+	cs.Lock()
+	defer cs.Unlock()
+	max := cs.limits.MaxSubscriptions
+	if max <= 0 {
+		return topics, nil
+	}
+	for o, subs := range c.sessions {
+		if o != s {
+			max -= len(subs)
+		}
+	}
+	if len(topics) <= max {
+		c.sessions[s] = keys(topics)
+		return topics, nil
+	}
+	prev := make(map[string]bool)
+	for _, t := range c.sessions[s] {
+		prev[t] = true
+	}
+	ordered := keys(topics)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return prev[ordered[i]] && !prev[ordered[j]]
+	})
+	if max < 0 {
+		max = 0
+	}
+	allowed := make(map[string]int64)
+	for _, t := range ordered[:max] {
+		allowed[t] = topics[t]
+	}
+	c.sessions[s] = ordered[:max]
+	return allowed, ordered[max:]
+}
+
+// request returns false if request is over the client rate
+func (cs *clients) request(c *client) bool {
+	cs.Lock()
+	defer cs.Unlock()
+	return c.requests.take(time.Now(), 1)
+}
+
+// written accounts bytes written to the client, returns how long writes
+// to the client should wait to stay within bandwidth
+func (cs *clients) written(c *client, n int) time.Duration {
+	cs.Lock()
+	defer cs.Unlock()
+	return c.bytes.wait(time.Now(), float64(n))
+}
+
+func keys(m map[string]int64) []string {
+	ks := make([]string, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
+
+// limitSubscriptions removes subscriptions over the client limit,
+// client gets Status with error for each rejected topic
+func (s *session) limitSubscriptions(topics map[string]int64) map[string]int64 {
+	if s.clients == nil {
+		return topics
+	}
+	allowed, rejected := s.clients.subscribe(s, s.client, topics)
+	if len(rejected) == 0 {
+		return allowed
+	}
+	err := amp.Errf(ErrorCodeSubscriptionLimit, "subscription limit %d", s.clients.limits.MaxSubscriptions).
+		Localize(s.Meta()[amp.LangKey])
+	for _, t := range rejected {
+		s.log().S("client", s.client.id).S("uri", t).Info("subscription limit")
+		metric.Counter("subscriptionLimit")
+		s.Send(&amp.Msg{
+			Type:  amp.Status,
+			URI:   t,
+			Ts:    amp.TS(),
+			Error: err,
+		})
+	}
+	return allowed
+}
+
+// requestAllowed returns false if request is over the client rate,
+// client gets error response
+func (s *session) requestAllowed(m *amp.Msg) bool {
+	if s.clients == nil || s.clients.request(s.client) {
+		return true
+	}
+	s.log().S("client", s.client.id).S("uri", m.URI).Info("request rate limit")
+	metric.Counter("requestRateLimit")
+	s.reply(m.ResponseError(amp.Errf(ErrorCodeRequestRate, "request rate limit %v/s", s.clients.limits.RequestsPerSec)))
+	return false
+}
+
+// limitBandwidth accounts written bytes, client over bandwidth is
+// throttled: next write waits until bandwidth is available
+func (s *session) limitBandwidth(n int) {
+	if s.clients == nil {
+		return
+	}
+	d := s.clients.written(s.client, n)
+	if d <= 0 {
+		return
+	}
+	metric.Counter("bandwidthLimit")
+	s.Lock()
+	s.throttled = time.Now().Add(d)
+	s.Unlock()
+}
+
+// throttle returns time left until the next write is allowed
+func (s *session) throttle() time.Duration {
+	s.Lock()
+	defer s.Unlock()
+	return time.Until(s.throttled)
+}
@@ -0,0 +1,117 @@
+package session
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+// subscribingBroker remembers subscriptions
+type subscribingBroker struct {
+	mockBroker
+	topics map[string]int64
+}
+
+func (b *subscribingBroker) Subscribe(c amp.Subscriber, topics map[string]int64) { b.topics = topics }
+
+func testClients(l ClientLimits) *clients {
+	s := &Sessions{}
+	LimitClients("user", l)(s)
+	return s.opts.clients
+}
+
+func TestSubscriptionLimit(t *testing.T) {
+	cs := testClients(ClientLimits{MaxSubscriptions: 3})
+	meta := map[string]string{"user": "u1"}
+	brk := &subscribingBroker{}
+	s1 := newSession(&mockConn{meta: meta}, &mockRequester{}, brk, amp.CompatibilityVersionDefault, options{clients: cs})
+	s2 := newSession(&mockConn{meta: meta}, &mockRequester{}, brk, amp.CompatibilityVersionDefault, options{clients: cs})
+	assert.Equal(t, s1.client, s2.client)
+
+	s1.receive(&amp.Msg{Type: amp.Subscribe, Subscriptions: map[string]int64{"a": 0, "b": 0}})
+	assert.Len(t, brk.topics, 2)
+
+	// limit is shared by the sessions of the client
+	s2.receive(&amp.Msg{Type: amp.Subscribe, Subscriptions: map[string]int64{"c": 0, "d": 0}})
+	assert.Equal(t, map[string]int64{"c": 0}, brk.topics)
+	assert.Len(t, s2.outQueue, 1)
+	m := s2.outQueue[0]
+	assert.Equal(t, amp.Status, m.Type)
+	assert.Equal(t, "d", m.URI)
+	assert.Equal(t, ErrorCodeSubscriptionLimit, m.Error.Code)
+
+	// already subscribed topics are kept
+	s1.receive(&amp.Msg{Type: amp.Subscribe, Subscriptions: map[string]int64{"0": 0, "a": 0, "b": 0}})
+	assert.Equal(t, map[string]int64{"a": 0, "b": 0}, brk.topics)
+
+	// closed session frees subscriptions
+	s2.unsubscribe()
+	s1.receive(&amp.Msg{Type: amp.Subscribe, Subscriptions: map[string]int64{"0": 0, "b": 0, "c": 0}})
+	assert.Len(t, brk.topics, 3)
+	s1.unsubscribe()
+	assert.Len(t, cs.m, 0)
+}
+
+func TestRequestRateLimit(t *testing.T) {
+	cs := testClients(ClientLimits{RequestsPerSec: 2})
+	req := &countingRequester{}
+	s := newSession(&mockConn{}, req, &mockBroker{}, amp.CompatibilityVersionDefault, options{clients: cs})
+
+	for i := 1; i <= 3; i++ {
+		s.receive(&amp.Msg{Type: amp.Request, URI: "math.req/add", CorrelationID: uint64(i)})
+	}
+	assert.Equal(t, 2, req.sent)
+	assert.Len(t, s.outQueue, 1)
+	rsp := s.outQueue[0]
+	assert.Equal(t, uint64(3), rsp.CorrelationID)
+	assert.Equal(t, ErrorCodeRequestRate, rsp.Error.Code)
+	assert.True(t, rsp.Error.Retryable)
+
+	time.Sleep(600 * time.Millisecond)
+	s.receive(&amp.Msg{Type: amp.Request, URI: "math.req/add", CorrelationID: 4})
+	assert.Equal(t, 3, req.sent)
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	cs := testClients(ClientLimits{BytesPerSec: 64})
+	conn := &mockConn{out: make(chan []byte, 4), in: make(chan []byte)}
+	s := newSession(conn, &mockRequester{}, &mockBroker{}, amp.CompatibilityVersionDefault, options{clients: cs})
+
+	big := amp.NewPublish("chat", "lobby", 1, amp.Append, strings.Repeat("a", 100))
+	s.connWrite(big)
+	d := s.throttle()
+	assert.True(t, d > 0) // written, but next write waits
+	s.connWrite(big)
+	assert.True(t, s.throttle() > d) // debt grows
+	assert.False(t, s.closing)
+	assert.Len(t, conn.out, 2)
+}
+
+func TestBandwidthThrottle(t *testing.T) {
+	cs := testClients(ClientLimits{BytesPerSec: 1000})
+	conn := &mockConn{out: make(chan []byte, 8), in: make(chan []byte)}
+	s := newSession(conn, &mockRequester{}, &mockBroker{}, amp.CompatibilityVersionDefault, options{clients: cs})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.loop(ctx)
+
+	// first message uses full bucket, second waits for the bandwidth
+	big := amp.NewPublish("chat", "lobby", 1, amp.Append, strings.Repeat("a", 1200))
+	s.Send(big)
+	s.Send(big)
+	<-conn.out
+	select {
+	case <-conn.out:
+		t.Fatal("write should be throttled")
+	case <-time.After(100 * time.Millisecond):
+	}
+	select {
+	case <-conn.out:
+	case <-time.After(time.Second):
+		t.Fatal("write should continue after throttle")
+	}
+}
@@ -0,0 +1,311 @@
+package session
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/metric"
+)
+
+// Resume keeps state of the disconnected session for the grace period.
+// Client which sent Hello gets resume token in Welcome (SessionID) and
+// on reconnect sends it in Hello.Resume. Resumed session gets its
+// subscriptions back from the last delivered message of each topic
+// (broker replays missed messages) and responses to the requests sent
+// before disconnect.
+// Session is bound to the client identity, values of the session meta
+// keys (e.g. auth cookie, certificate "cn"); it is resumed only by the
+// connection with the same values. Without keys whole meta must match.
+func Resume(grace time.Duration, keys ...string) func(*Sessions) {
+	return func(s *Sessions) {
+		s.opts.resumer = &resumer{
+			grace:  grace,
+			keys:   keys,
+			parked: make(map[string]*parked),
+		}
+	}
+}
+
+type sharedResume interface {
+	Park(token, identity string, subs map[string]int64, until time.Time, taken func()) // share parked session
+	Take(token, identity string) (map[string]int64, bool)                              // session parked on other instance
+	Release(token string)                                                              // session resumed locally or expired
+}
+
+// SharedResume shares parked sessions with the other gateway instances
+// (see amp/cluster), so client can resume on any instance. Session
+// resumed on the other instance gets back subscriptions only. Used with
+// Resume.
+func SharedResume(sr sharedResume) func(*Sessions) {
+	return func(s *Sessions) {
+		s.opts.shared = sr
+	}
+}
+
+// resumer is registry of the disconnected sessions waiting to be resumed
+type resumer struct {
+	grace  time.Duration
+	keys   []string // meta keys of the client identity
+	parked map[string]*parked
+	shared sharedResume
+	sync.Mutex
+}
+
+type parked struct {
+	s        *session
+	identity string
+	timer    *time.Timer
+}
+
+// identity returns hash of the client identity from the session meta
+func (r *resumer) identity(meta map[string]string) string {
+	keys := r.keys
+	if len(keys) == 0 {
+		for k := range meta {
+			keys = append(keys, k)
+		}
+	}
+	sorted := make([]string, len(keys))
+	copy(sorted, keys)
+	sort.Strings(sorted)
+	h := sha256.New()
+	for _, k := range sorted {
+		v, ok := meta[k]
+		if !ok {
+			continue
+		}
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// park keeps disconnected session until it is resumed or grace period expires
+func (r *resumer) park(s *session) {
+	id := s.id
+	identity := r.identity(s.conn.Meta())
+	r.Lock()
+	r.parked[id] = &parked{
+		s:        s,
+		identity: identity,
+		timer: time.AfterFunc(r.grace, func() {
+			r.expire(id, s)
+		}),
+	}
+	r.Unlock()
+	metric.Counter("sessionParked")
+	if r.shared == nil {
+		return
+	}
+	s.Lock()
+	subs := make(map[string]int64, len(s.subs))
+	for t, ts := range s.subs {
+		subs[t] = ts
+	}
+	s.Unlock()
+	r.shared.Park(id, identity, subs, time.Now().Add(r.grace), func() {
+		if r.remove(id, s) {
+			s.unsubscribe()
+		}
+	})
+}
+
+// remove removes parked session from the registry, returns false if it
+// is not parked
+func (r *resumer) remove(id string, s *session) bool {
+	r.Lock()
+	defer r.Unlock()
+	p, ok := r.parked[id]
+	if !ok || p.s != s {
+		return false
+	}
+	delete(r.parked, id)
+	p.timer.Stop()
+	return true
+}
+
+// take removes parked session from the registry, nil if not found or
+// parked by the other client
+func (r *resumer) take(id, identity string) *session {
+	r.Lock()
+	p, ok := r.parked[id]
+	if ok && p.identity != identity {
+		r.Unlock()
+		metric.Counter("sessionResumeDenied")
+		return nil
+	}
+	if ok {
+		delete(r.parked, id)
+		p.timer.Stop()
+	}
+	r.Unlock()
+	if !ok {
+		return nil
+	}
+	if r.shared != nil {
+		r.shared.Release(id)
+	}
+	return p.s
+}
+
+// expire drops parked session after grace period
+func (r *resumer) expire(id string, s *session) {
+	r.Lock()
+	p, ok := r.parked[id]
+	if ok && p.s == s {
+		delete(r.parked, id)
+	}
+	r.Unlock()
+	if ok && p.s == s {
+		metric.Counter("sessionExpired")
+		if r.shared != nil {
+			r.shared.Release(id)
+		}
+		s.unsubscribe()
+	}
+}
+
+// disconnected parks resumable session, other sessions are unsubscribed
+func (s *session) disconnected() {
+	s.Lock()
+	resumable := s.resumer != nil && s.id != ""
+	if resumable {
+		s.parked = true
+	}
+	s.Unlock()
+	if !resumable {
+		s.unsubscribe()
+		return
+	}
+	// subscriptions are restored by last delivered ts, requester keeps
+	// sending responses to the parked session
+	s.broker.Unsubscribe(s)
+	s.releaseClient()
+	s.userDisconnected()
+	s.resumer.park(s)
+}
+
+// resume takes over state of the parked session, returns its subscriptions
+// and responses received while parked, false if there is no session for
+// the token
+func (s *session) resume(token string) (map[string]int64, []*amp.Msg, bool) {
+	if s.resumer == nil || token == "" {
+		return nil, nil, false
+	}
+	identity := s.resumer.identity(s.conn.Meta())
+	old := s.resumer.take(token, identity)
+	if old == nil {
+		return s.resumeShared(token, identity)
+	}
+	old.Lock()
+	subs := old.subs
+	filters := old.filters
+	rsps := old.parkedRsps
+	pending := old.pending
+	waiting := old.unacked
+	meta := old.meta
+	old.parkedRsps = nil
+	old.pending = 0
+	old.unacked = make(map[uint64]*unacked)
+	old.forward = s
+	old.Unlock()
+
+	s.Lock()
+	s.subs = subs
+	s.filters = filters
+	s.pending += pending
+	s.adoptAcks(waiting)
+	s.prev = append(s.prev, old)
+	// meta set by the responses to the resumed session is kept
+	merged := make(map[string]string, len(s.meta)+len(meta))
+	for k, v := range s.meta {
+		merged[k] = v
+	}
+	for k, v := range meta {
+		merged[k] = v
+	}
+	s.meta = merged
+	s.Unlock()
+	metric.Counter("sessionResumed")
+	s.log().I("subscriptions", len(subs)).I("responses", len(rsps)).Info("session resumed")
+	return subs, rsps, true
+}
+
+// resumeShared takes over subscriptions of the session parked on the
+// other instance
+func (s *session) resumeShared(token, identity string) (map[string]int64, []*amp.Msg, bool) {
+	if s.resumer.shared == nil {
+		return nil, nil, false
+	}
+	subs, ok := s.resumer.shared.Take(token, identity)
+	if !ok {
+		return nil, nil, false
+	}
+	s.Lock()
+	s.subs = subs
+	s.Unlock()
+	metric.Counter("sessionResumedShared")
+	s.log().I("subscriptions", len(subs)).Info("session resumed from other instance")
+	return subs, nil, true
+}
+
+// restore sends responses and subscribes to the topics of the resumed session
+func (s *session) restore(subs map[string]int64, rsps []*amp.Msg) {
+	for _, m := range rsps {
+		s.Send(m)
+	}
+	s.broker.Subscribe(s, s.limitSubscriptions(subs))
+}
+
+// parkedSend keeps responses for the parked session, returns the session
+// which resumed it, response should be forwarded to it out of s.Lock.
+// Should be called during s.Lock.
+func (s *session) parkedSend(m *amp.Msg) *session {
+	if m.Type != amp.Response {
+		return nil
+	}
+	if s.forward != nil {
+		return s.forward
+	}
+	if s.pending > 0 {
+		s.pending--
+	}
+	s.parkedRsps = append(s.parkedRsps, m)
+	return nil
+}
+
+// delivered remembers ts of the last message written for the subscription
+func (s *session) delivered(m *amp.Msg) {
+	if m.Type != amp.Publish {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.subs[m.URI]; ok {
+		s.subs[m.URI] = m.Ts
+		return
+	}
+	if _, ok := s.subs[m.Topic()]; ok {
+		s.subs[m.Topic()] = m.Ts
+	}
+}
+
+// subscribed remembers subscriptions of the session
+func (s *session) subscribed(topics map[string]int64) {
+	subs := make(map[string]int64, len(topics))
+	s.Lock()
+	defer s.Unlock()
+	for t, ts := range topics {
+		if last, ok := s.subs[t]; ok && last > ts {
+			ts = last
+		}
+		subs[t] = ts
+	}
+	s.subs = subs
+}
@@ -0,0 +1,154 @@
+package session
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func testResumer(grace time.Duration, keys ...string) *resumer {
+	s := &Sessions{}
+	Resume(grace, keys...)(s)
+	return s.opts.resumer
+}
+
+func welcome(t *testing.T, s *session) amp.Welcome {
+	var w amp.Welcome
+	for _, m := range s.outQueue {
+		if m.IsConnect() {
+			assert.Nil(t, json.Unmarshal(m.BodyBytes(), &w))
+		}
+	}
+	return w
+}
+
+func TestResume(t *testing.T) {
+	r := testResumer(time.Minute)
+	brk := &subscribingBroker{}
+	req := &countingRequester{}
+	s1 := newSession(&mockConn{}, req, brk, amp.CompatibilityVersionDefault, options{resumer: r})
+	s1.receive(amp.Parse(amp.NewHello(amp.Hello{Version: amp.ProtocolVersion}).Marshal()))
+	token := welcome(t, s1).SessionID
+	assert.NotEmpty(t, token)
+
+	s1.receive(&amp.Msg{Type: amp.Subscribe, Subscriptions: map[string]int64{"a": 0, "b": 0}})
+	s1.delivered(&amp.Msg{Type: amp.Publish, URI: "a", Ts: 10})
+	s1.receive(&amp.Msg{Type: amp.Request, URI: "math.req/add", CorrelationID: 1})
+	assert.Equal(t, 1, req.sent)
+
+	// disconnected session is parked, keeps responses
+	s1.disconnected()
+	assert.Len(t, r.parked, 1)
+	s1.Send(&amp.Msg{Type: amp.Response, CorrelationID: 1})
+	s1.Send(&amp.Msg{Type: amp.Publish, URI: "b", Ts: 11})
+	assert.Len(t, s1.parkedRsps, 1)
+
+	// reconnect with token restores subscriptions and responses
+	brk.topics = nil
+	s2 := newSession(&mockConn{}, req, brk, amp.CompatibilityVersionDefault, options{resumer: r})
+	s2.receive(amp.Parse(amp.NewHello(amp.Hello{Version: amp.ProtocolVersion, Resume: token}).Marshal()))
+	w := welcome(t, s2)
+	assert.True(t, w.Resumed)
+	assert.Equal(t, token, w.SessionID)
+	assert.Len(t, r.parked, 0)
+	assert.Equal(t, map[string]int64{"a": 10, "b": 0}, brk.topics)
+	assert.Len(t, s2.outQueue, 2)
+	assert.True(t, s2.outQueue[0].IsConnect())
+	assert.Equal(t, uint64(1), s2.outQueue[1].CorrelationID)
+
+	// late response to the old session is forwarded
+	s1.Send(&amp.Msg{Type: amp.Response, CorrelationID: 2})
+	assert.Len(t, s2.outQueue, 3)
+
+	// unknown token starts new session
+	s3 := newSession(&mockConn{}, req, brk, amp.CompatibilityVersionDefault, options{resumer: r})
+	s3.receive(amp.Parse(amp.NewHello(amp.Hello{Version: amp.ProtocolVersion, Resume: "unknown"}).Marshal()))
+	w = welcome(t, s3)
+	assert.False(t, w.Resumed)
+	assert.NotEqual(t, "unknown", w.SessionID)
+}
+
+func TestResumeExpire(t *testing.T) {
+	r := testResumer(time.Millisecond)
+	s := newSession(&mockConn{}, &mockRequester{}, &mockBroker{}, amp.CompatibilityVersionDefault, options{resumer: r})
+	s.receive(amp.Parse(amp.NewHello(amp.Hello{Version: amp.ProtocolVersion}).Marshal()))
+	s.disconnected()
+	time.Sleep(20 * time.Millisecond)
+	r.Lock()
+	assert.Len(t, r.parked, 0)
+	r.Unlock()
+
+	// session without handshake is not parked
+	s = newSession(&mockConn{}, &mockRequester{}, &mockBroker{}, amp.CompatibilityVersionDefault, options{resumer: r})
+	s.disconnected()
+	assert.Len(t, r.parked, 0)
+}
+
+// testShared is shared resume store of two instances
+type testShared struct {
+	subs  map[string]map[string]int64
+	taken map[string]func()
+}
+
+func (t *testShared) Park(token, identity string, subs map[string]int64, until time.Time, taken func()) {
+	t.subs[token] = subs
+	t.taken[token] = taken
+}
+
+func (t *testShared) Take(token, identity string) (map[string]int64, bool) {
+	subs, ok := t.subs[token]
+	if ok {
+		t.taken[token]()
+	}
+	delete(t.subs, token)
+	return subs, ok
+}
+
+func (t *testShared) Release(token string) { delete(t.subs, token) }
+
+func TestSharedResume(t *testing.T) {
+	shared := &testShared{subs: make(map[string]map[string]int64), taken: make(map[string]func())}
+	r1, r2 := testResumer(time.Minute), testResumer(time.Minute)
+	r1.shared, r2.shared = shared, shared
+
+	s1 := newSession(&mockConn{}, &mockRequester{}, &mockBroker{}, amp.CompatibilityVersionDefault, options{resumer: r1})
+	s1.receive(amp.Parse(amp.NewHello(amp.Hello{Version: amp.ProtocolVersion}).Marshal()))
+	token := welcome(t, s1).SessionID
+	s1.receive(&amp.Msg{Type: amp.Subscribe, Subscriptions: map[string]int64{"a": 0}})
+	s1.delivered(&amp.Msg{Type: amp.Publish, URI: "a", Ts: 7})
+	s1.disconnected()
+	assert.Equal(t, map[string]int64{"a": 7}, shared.subs[token])
+
+	// resumed on the other instance
+	brk := &subscribingBroker{}
+	s2 := newSession(&mockConn{}, &mockRequester{}, brk, amp.CompatibilityVersionDefault, options{resumer: r2})
+	s2.receive(amp.Parse(amp.NewHello(amp.Hello{Version: amp.ProtocolVersion, Resume: token}).Marshal()))
+	assert.True(t, welcome(t, s2).Resumed)
+	assert.Equal(t, map[string]int64{"a": 7}, brk.topics)
+	assert.Len(t, r1.parked, 0)
+}
+
+func TestResumeIdentity(t *testing.T) {
+	r := testResumer(time.Minute, "auth")
+	s1 := newSession(&mockConn{meta: map[string]string{"auth": "alice", "ga": "1"}}, &mockRequester{}, &mockBroker{}, amp.CompatibilityVersionDefault, options{resumer: r})
+	s1.receive(amp.Parse(amp.NewHello(amp.Hello{Version: amp.ProtocolVersion}).Marshal()))
+	token := welcome(t, s1).SessionID
+	s1.disconnected()
+
+	// other client with stolen token
+	s2 := newSession(&mockConn{meta: map[string]string{"auth": "mallory"}}, &mockRequester{}, &mockBroker{}, amp.CompatibilityVersionDefault, options{resumer: r})
+	s2.receive(amp.Parse(amp.NewHello(amp.Hello{Version: amp.ProtocolVersion, Resume: token}).Marshal()))
+	w := welcome(t, s2)
+	assert.False(t, w.Resumed)
+	assert.NotEqual(t, token, w.SessionID)
+	assert.Len(t, r.parked, 1)
+
+	// same client, other meta keys are not compared
+	s3 := newSession(&mockConn{meta: map[string]string{"auth": "alice", "ga": "2"}}, &mockRequester{}, &mockBroker{}, amp.CompatibilityVersionDefault, options{resumer: r})
+	s3.receive(amp.Parse(amp.NewHello(amp.Hello{Version: amp.ProtocolVersion, Resume: token}).Marshal()))
+	assert.True(t, welcome(t, s3).Resumed)
+	assert.Len(t, r.parked, 0)
+}
@@ -7,8 +7,11 @@ import (
 	"time"
 
 	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/filter"
 	"github.com/minus5/svckit/log"
 	"github.com/minus5/svckit/metric"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
 )
 
 var (
@@ -17,29 +20,86 @@ var (
 	startupInterval    = 2 * time.Second  // grace period for having more then max messages in outQueue
 )
 
+// ErrTooManyRequests is transport error of the response to the request
+// over MaxPendingRequests limit.
+var ErrTooManyRequests = errors.New("too many pending requests")
+
+// ErrBinaryNotAccepted is transport error of the response with binary
+// body to the client which accepted only json codec in the handshake.
+var ErrBinaryNotAccepted = errors.New("binary body not accepted")
+
 type session struct {
-	conn            connection      // client websocket connection
-	broker          broker          // broker for subscribe on published messages
-	requester       requester       // requester for request / response messages
-	outQueue        []*amp.Msg      // output messages queue
-	outQueueChanged chan (struct{}) // signal that queue changed
-	stats           struct {        // sessions stats counters
+	conn            connection             // client websocket connection
+	broker          broker                 // broker for subscribe on published messages
+	requester       requester              // requester for request / response messages
+	outQueue        []*amp.Msg             // output messages queue
+	queuedAt        []time.Time            // time when each outQueue message is queued
+	outQueueChanged chan (struct{})        // signal that queue changed
+	maxLag          time.Duration          // max age of the oldest queued message, 0 no limit
+	keepalive       *keepalive             // server pings, nil if disabled
+	compression     *amp.CompressionPolicy // connection policy, topic policy if nil
+	stats           struct {               // sessions stats counters
 		start         time.Time
 		outMessages   int
 		inMessages    int
 		aliveMessages int
 		maxQueueLen   int
+		rtt           time.Duration
 	}
 	compatibilityVersion uint8
+	protocol             uint8               // negotiated protocol version
+	hello                *amp.Hello          // client handshake, nil if client didn't send it
+	noDeflate            bool                // client didn't accept deflate in handshake
+	noBinary             bool                // client didn't accept binary codec in handshake
+	id                   string              // session id (resume token), set in handshake
+	subs                 map[string]int64    // subscriptions with ts of the last delivered message
+	resumer              *resumer            // parks disconnected sessions, nil if resume is disabled
+	parked               bool                // disconnected, waiting to be resumed
+	parkedRsps           []*amp.Msg          // responses received while parked
+	forward              *session            // session which resumed this one
+	prev                 []*session          // resumed sessions, forwarding responses to this one
+	acks                 *acks               // delivery tracking of critical messages, nil if disabled
+	unacked              map[uint64]*unacked // written critical messages waiting for ack, by seq
+	ackSeq               uint64              // sequence of the last tracked message
+	users                directory           // users directory, nil if not used
+	user                 string              // user identity in the users directory
+	usersKey             string              // meta key of the user identity
+	userGone             bool                // unregistered from the users directory
+	userLock             sync.Mutex          // orders registrations in the users directory
+	meta                 map[string]string   // connection meta, updated by the responses
+	backoff              *backoff            // reconnect policy sent in disconnect messages
+	filters              *filters            // subscription filters, nil if not used
+	assembler            *amp.Assembler      // chunked fulls for the clients without chunks
+	pending              int                 // requests waiting for response
+	maxPending           int                 // max pending requests, 0 no limit
+	clients              *clients            // client limits, nil if not limited
+	client               *client             // client of the session
+	throttled            time.Time           // client over bandwidth, writes wait until
 	started              bool
 	closed               bool
+	closing              bool // close after queue is written
 	sync.Mutex
 }
 
-// serve starts new session
-// Blocks until session is finished.
-func serve(cancelSig context.Context, conn connection, req requester, brk broker,
-	compatibilityVersion uint8) {
+// options of the sessions, set in Factory
+type options struct {
+	maxLag       time.Duration
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+	compression  *amp.CompressionPolicy
+	maxPending   int
+	clients      *clients
+	resumer      *resumer
+	acks         *acks
+	users        directory
+	usersKey     string
+	shared       sharedResume
+	backoff      *backoff
+}
+
+// newSession creates session for the connection, start it with loop.
+func newSession(conn connection, req requester, brk broker,
+	compatibilityVersion uint8, o options) *session {
 	s := &session{
 		conn:                 conn,
 		requester:            req,
@@ -47,9 +107,29 @@ func serve(cancelSig context.Context, conn connection, req requester, brk broker
 		outQueue:             make([]*amp.Msg, 0),
 		outQueueChanged:      make(chan struct{}),
 		compatibilityVersion: compatibilityVersion,
+		maxLag:               o.maxLag,
+		compression:          o.compression,
+		maxPending:           o.maxPending,
+		clients:              o.clients,
+		resumer:              o.resumer,
+		acks:                 o.acks,
+		unacked:              make(map[uint64]*unacked),
+		users:                o.users,
+		usersKey:             o.usersKey,
+		meta:                 conn.Meta(),
+		backoff:              o.backoff,
+	}
+	if s.clients != nil {
+		s.client = s.clients.acquire(s)
+	}
+	s.userChanged()
+	// v1 clients don't reply to pings
+	if compatibilityVersion == amp.CompatibilityVersionDefault {
+		s.keepalive = newKeepalive(o.pingInterval, o.pongTimeout)
+		s.negotiate(amp.NegotiateVersion(conn.Meta()))
 	}
 	s.stats.start = time.Now()
-	s.loop(cancelSig)
+	return s
 }
 
 func (s *session) loop(cancelSig context.Context) {
@@ -64,7 +144,7 @@ func (s *session) loop(cancelSig context.Context) {
 		s.Lock()
 		defer s.Unlock()
 		if len(s.outQueue) == 0 {
-			s.outQueue = append(s.outQueue, amp.NewAlive())
+			s.push(amp.NewAlive())
 			s.stats.aliveMessages++
 		}
 	}
@@ -77,28 +157,72 @@ func (s *session) loop(cancelSig context.Context) {
 			select { /// non blocking write
 			case outMessages <- s.outQueue[0]:
 				s.outQueue = s.outQueue[1:]
+				s.queuedAt = s.queuedAt[1:]
 			default:
 			}
 		}
 	}
 
+	// close connection after disconnect notification is written
+	closeIfDrained := func() {
+		s.Lock()
+		defer s.Unlock()
+		if s.closing && len(s.outQueue) == 0 && !s.closed {
+			s.closed = true
+			_ = s.conn.Close()
+		}
+	}
+
+	// timer for server pings
+	var pingTick <-chan time.Time
+	if s.keepalive != nil {
+		t := time.NewTicker(s.keepalive.interval)
+		defer t.Stop()
+		pingTick = t.C
+	}
+
+	// timer for retries of the unacknowledged messages
+	var ackTick <-chan time.Time
+	if s.acks != nil {
+		t := time.NewTicker(s.acks.retry)
+		defer t.Stop()
+		ackTick = t.C
+	}
+
 	defer s.logStats()
 
+	// writes are paused while client is over bandwidth
+	var throttle <-chan time.Time
+
 	for {
 		tryPopQueue()
 
+		writes := outMessages
+		if throttle != nil {
+			writes = nil
+		}
 		select {
 		case <-s.outQueueChanged:
 			// just start another loop iteration
 		case <-alive.C:
 			sendAlive()
-		case msg := <-outMessages:
+		case <-pingTick:
+			s.ping()
+		case <-ackTick:
+			s.retryAcks()
+		case msg := <-writes:
 			s.connWrite(msg)
 			alive.Reset(aliveInterval)
 			s.stats.outMessages++
+			closeIfDrained()
+			if d := s.throttle(); d > 0 {
+				throttle = time.After(d)
+			}
+		case <-throttle:
+			throttle = nil
 		case msg, ok := <-inMessages:
 			if !ok {
-				s.unsubscribe()
+				s.disconnected()
 				return
 			}
 			s.receive(msg)
@@ -110,13 +234,48 @@ func (s *session) loop(cancelSig context.Context) {
 	}
 }
 
+// ping sends ping to the client, or closes connection if previous is not answered
+func (s *session) ping() {
+	if s.keepalive.dead() {
+		s.Lock()
+		defer s.Unlock()
+		if !s.closed {
+			s.log().I("timeoutMs", int(s.keepalive.timeout/time.Millisecond)).Info("pong timeout")
+			metric.Counter("pongTimeout")
+			s.closed = true
+			_ = s.conn.Close()
+		}
+		return
+	}
+	if m := s.keepalive.ping(); m != nil {
+		s.Send(m)
+	}
+}
+
+// pong measures round trip time of the server ping
+func (s *session) pong() {
+	if s.keepalive == nil {
+		return
+	}
+	if rtt, ok := s.keepalive.pong(); ok {
+		s.stats.rtt = rtt
+		metric.Time("rtt", int(rtt/time.Millisecond))
+	}
+}
+
 func (s *session) logStats() {
 	s.Lock()
 	defer s.Unlock()
 	duration := int(time.Now().Sub(s.stats.start) / time.Millisecond)
-	s.log().I("inMessages", s.stats.inMessages).
+	l := s.log()
+	if s.hello != nil {
+		l = l.S("client", s.hello.Client).S("device", s.hello.Device)
+	}
+	l.I("inMessages", s.stats.inMessages).
 		I("outMessages", s.stats.outMessages).
 		I("aliveMessages", s.stats.aliveMessages).
+		I("maxQueueLen", s.stats.maxQueueLen).
+		I("rttMs", int(s.stats.rtt/time.Millisecond)).
 		I("durationMs", duration).
 		Debug("stats")
 	metric.Time("inMessages", s.stats.inMessages)
@@ -128,6 +287,21 @@ func (s *session) logStats() {
 func (s *session) unsubscribe() {
 	s.broker.Unsubscribe(s)
 	s.requester.Unsubscribe(s)
+	s.Lock()
+	prev := s.prev
+	s.Unlock()
+	for _, p := range prev {
+		p.unsubscribe()
+	}
+	s.dropAcks()
+	s.userDisconnected()
+	s.releaseClient()
+}
+
+func (s *session) releaseClient() {
+	if s.clients != nil {
+		s.clients.release(s, s.client)
+	}
 }
 
 func (s *session) readLoop() chan *amp.Msg {
@@ -139,7 +313,7 @@ func (s *session) readLoop() chan *amp.Msg {
 			if err != nil {
 				return
 			}
-			if m := amp.ParseCompatibility(buf, s.compatibilityVersion); m != nil {
+			if m := s.parse(buf); m != nil {
 				in <- m
 			}
 		}
@@ -147,26 +321,246 @@ func (s *session) readLoop() chan *amp.Msg {
 	return in
 }
 
+// parse decodes client message.
+// Messages from the current version clients are parsed strictly,
+// invalid ones are logged and skipped.
+func (s *session) parse(buf []byte) *amp.Msg {
+	if s.compatibilityVersion != amp.CompatibilityVersionDefault {
+		return amp.ParseCompatibility(buf, s.compatibilityVersion)
+	}
+	m, err := amp.ParseStrict(buf, amp.DefaultLimits)
+	if err != nil {
+		s.log().I("len", len(buf)).Error(err)
+		metric.Counter("parseError")
+		return nil
+	}
+	return m
+}
+
+// negotiate sets protocol version announced by the client.
+// Unsupported version is reported to the client and connection is closed.
+func (s *session) negotiate(version uint8, err error) {
+	s.Lock()
+	defer s.Unlock()
+	if err == nil {
+		s.protocol = version
+		return
+	}
+	s.log().Error(err)
+	metric.Counter("unsupportedVersion")
+	// reason is written in the current encoding, legacy one has no status
+	s.protocol = amp.ProtocolVersion
+	s.push(s.backoff.disconnect(err.Error()))
+	s.closing = true
+	s.signalQueueChanged()
+}
+
 // receive gets client messages
 func (s *session) receive(m *amp.Msg) {
+	if m.Version != 0 && m.Version != s.protocolVersion() {
+		s.negotiate(amp.CheckVersion(m.Version))
+	}
+	if s.isClosing() {
+		m.Release()
+		return
+	}
 	switch m.Type {
 	case amp.Ping:
 		s.Send(m.Pong())
+		m.Release()
+	case amp.Pong:
+		s.pong()
+		m.Release()
+	case amp.Connect:
+		s.handshake(m)
+		m.Release()
+	case amp.Ack:
+		s.ack(m)
+		m.Release()
 	case amp.Request:
+		if m.IsBackfill() {
+			s.broker.Backfill(s, m)
+			return
+		}
+		m.Meta = s.Meta()
+		if !s.requestAllowed(m) {
+			return
+		}
+		if !s.requestStarted() {
+			s.log().S("uri", m.URI).Info("too many pending requests")
+			metric.Counter("requestLimit")
+			s.reply(m.ResponseTransportError(ErrTooManyRequests))
+			return
+		}
 		// TODO what URI-a are ok, make filter
-		m.Meta = s.conn.Meta()
 		s.requester.Send(s, m)
 	case amp.Subscribe:
-		s.broker.Subscribe(s, m.Subscriptions)
+		s.setFilters(m.Filters)
+		subs := s.limitSubscriptions(m.Subscriptions)
+		s.subscribed(subs)
+		for uri := range subs {
+			amp.CountURI("subscribe", uri)
+		}
+		s.broker.Subscribe(s, subs)
+		m.Release()
+	}
+}
+
+// handshake negotiates connection options announced by the client in
+// Hello and replies with Welcome
+func (s *session) handshake(m *amp.Msg) {
+	h, err := m.ParseHello()
+	if err != nil {
+		s.negotiate(0, err)
+		return
+	}
+	compressions := []string{amp.CompressionNameNone}
+	if s.conn.DeflateSupported() {
+		compressions = append(compressions, amp.CompressionNameDeflate)
+	}
+	codecs := []string{amp.CodecJSON, amp.CodecBinary}
+	w, err := amp.NegotiateHello(h, uuid.NewV4().String(), compressions, codecs)
+	if err != nil {
+		s.negotiate(0, err)
+		return
+	}
+	subs, rsps, resumed := s.resume(h.Resume)
+	if resumed {
+		w.SessionID = h.Resume
+		w.Resumed = true
+		s.userChanged()
+	}
+	s.Lock()
+	s.id = w.SessionID
+	s.protocol = w.Version
+	s.noDeflate = w.Compression != amp.CompressionNameDeflate
+	s.noBinary = !accepts(w.Codecs, amp.CodecBinary)
+	s.hello = &h
+	s.Unlock()
+	s.log().S("client", h.Client).S("device", h.Device).S("sessionID", w.SessionID).
+		I("version", int(w.Version)).S("compression", w.Compression).Debug("hello")
+	s.Send(m.Welcome(w))
+	if resumed {
+		s.restore(subs, rsps)
+	}
+}
+
+func accepts(codecs []string, codec string) bool {
+	for _, c := range codecs {
+		if c == codec {
+			return true
+		}
 	}
+	return false
+}
+
+// requestStarted counts pending request, returns false if the client
+// already has max pending requests
+func (s *session) requestStarted() bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.maxPending > 0 && s.pending >= s.maxPending {
+		return false
+	}
+	s.pending++
+	return true
+}
+
+// setFilters compiles subscription filters.
+// Invalid filters are logged and ignored.
+func (s *session) setFilters(exprs map[string]string) {
+	compiled := make(map[string]*filter.Filter)
+	for uri, expr := range exprs {
+		f, err := filter.Compile(expr)
+		if err != nil {
+			s.log().S("uri", uri).Error(err)
+			metric.Counter("filterError")
+			continue
+		}
+		compiled[uri] = f
+	}
+	var f *filters
+	if len(compiled) > 0 {
+		f = newFilters(compiled)
+	}
+	s.Lock()
+	s.filters = f
+	s.Unlock()
+}
+
+// Meta returns client session metadata.
+func (s *session) Meta() map[string]string {
+	s.Lock()
+	defer s.Unlock()
+	return s.meta
 }
 
 // Send message to the clinet
 // Implements amp.Subscriber interface.
 func (s *session) Send(m *amp.Msg) {
-	// add to queue
+	if m.Type == amp.Response {
+		s.updateMeta(m.Meta)
+	}
 	s.Lock()
+	f := s.filters
+	s.Unlock()
+	if f == nil {
+		s.send(m)
+		return
+	}
+	// filters decode message body, applied outside of the session lock
+	for _, fm := range f.apply(m) {
+		s.send(fm)
+	}
+}
+
+// send adds message to the queue
+func (s *session) send(m *amp.Msg) {
+	s.Lock()
+	if s.parked {
+		fwd := s.parkedSend(m)
+		s.Unlock()
+		if fwd != nil {
+			fwd.send(m) // already filtered
+		}
+		return
+	}
 	defer s.Unlock()
+	if m.IsChunk() && s.version() != amp.CompatibilityVersionDefault {
+		// clients without chunks get assembled full
+		if s.assembler == nil {
+			s.assembler = amp.NewAssembler()
+		}
+		if m = s.assembler.Add(m); m == nil {
+			return
+		}
+	}
+	if m.IsBinary() && s.noBinary {
+		metric.Counter("binaryNotAccepted")
+		if m.Type != amp.Response {
+			return
+		}
+		m = m.ResponseTransportError(ErrBinaryNotAccepted)
+	}
+	if m.Type == amp.Response && s.pending > 0 {
+		s.pending--
+	}
+	s.enqueue(m)
+}
+
+// reply sends response created by the session itself, for the request
+// which is not counted as pending
+func (s *session) reply(m *amp.Msg) {
+	s.Lock()
+	defer s.Unlock()
+	s.enqueue(m)
+}
+
+// should be called during s.Lock
+func (s *session) enqueue(m *amp.Msg) {
+	if s.closing {
+		return
+	}
 
 	if s.isStarted() {
 		queueLen := len(s.outQueue)
@@ -182,16 +576,66 @@ func (s *session) Send(m *amp.Msg) {
 			s.closed = true
 			return
 		}
+		if s.isSlow() {
+			s.disconnectSlow()
+			return
+		}
 	}
 
+	s.push(m)
+	s.signalQueueChanged()
+}
+
+// should be called during s.Lock
+func (s *session) push(m *amp.Msg) {
 	s.outQueue = append(s.outQueue, m)
-	// signal queue changed
+	s.queuedAt = append(s.queuedAt, time.Now())
+}
+
+// should be called during s.Lock
+func (s *session) signalQueueChanged() {
 	select {
 	case s.outQueueChanged <- struct{}{}:
 	default:
 	}
 }
 
+// lag returns queue length and age of the oldest queued message.
+func (s *session) lag() (int, time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.queuedAt) == 0 {
+		return 0, 0
+	}
+	return len(s.outQueue), time.Since(s.queuedAt[0])
+}
+
+// should be called during s.Lock
+func (s *session) isSlow() bool {
+	return s.maxLag > 0 && len(s.queuedAt) > 0 && time.Since(s.queuedAt[0]) > s.maxLag
+}
+
+// disconnectSlow replaces queue with the disconnect notification,
+// connection is closed after it is written.
+// Should be called during s.Lock.
+func (s *session) disconnectSlow() {
+	s.log().I("len", len(s.outQueue)).
+		I("lagMs", int(time.Since(s.queuedAt[0])/time.Millisecond)).
+		Info("slow consumer")
+	metric.Counter("slowConsumer")
+	s.outQueue = s.outQueue[:0]
+	s.queuedAt = s.queuedAt[:0]
+	s.push(s.backoff.disconnect("slow consumer"))
+	s.closing = true
+	s.signalQueueChanged()
+}
+
+func (s *session) isClosing() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.closing
+}
+
 // should be called during s.Lock
 func (s *session) isStarted() bool {
 	if !s.started {
@@ -217,18 +661,51 @@ func (s *session) logOutQueueOverflow() {
 func (s *session) connWrite(m *amp.Msg) {
 	var payload []byte
 	deflated := false
-	if s.conn.DeflateSupported() {
-		payload, deflated = m.MarshalDeflateCompatiblity(s.compatibilityVersion)
+	s.Lock()
+	version := s.version()
+	deflate := s.conn.DeflateSupported() && !s.noDeflate
+	s.Unlock()
+	if deflate {
+		if s.compression != nil {
+			payload, deflated = m.MarshalPolicy(version, *s.compression)
+		} else {
+			payload, deflated = m.MarshalDeflateCompatiblity(version)
+		}
 	} else {
-		payload = m.MarshalCompatiblity(s.compatibilityVersion)
+		payload = m.MarshalCompatiblity(version)
 	}
 	if payload == nil {
 		return
 	}
-	err := s.conn.Write(payload, deflated)
+	var err error
+	if bw, ok := s.conn.(binaryWriter); ok && m.IsBinary() {
+		err = bw.WriteBinary(payload, deflated)
+	} else {
+		err = s.conn.Write(payload, deflated)
+	}
 	if err != nil {
 		s.conn.Close()
+		return
+	}
+	s.delivered(m)
+	s.awaitAck(m)
+	s.limitBandwidth(len(payload))
+}
+
+// protocolVersion returns negotiated protocol version
+func (s *session) protocolVersion() uint8 {
+	s.Lock()
+	defer s.Unlock()
+	return s.protocol
+}
+
+// version returns marshal version for the client.
+// Should be called during s.Lock.
+func (s *session) version() uint8 {
+	if s.compatibilityVersion == amp.CompatibilityVersionDefault {
+		return amp.Compatibility(s.protocol)
 	}
+	return s.compatibilityVersion
 }
 
 func (s *session) log() *log.Agregator {
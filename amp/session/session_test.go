@@ -2,8 +2,11 @@ package session
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -12,8 +15,14 @@ import (
 )
 
 type mockConn struct {
-	in  chan []byte
-	out chan []byte
+	in   chan []byte
+	out  chan []byte
+	meta map[string]string
+}
+
+// versioned returns meta of the client with current protocol version
+func versioned() map[string]string {
+	return map[string]string{amp.VersionKey: strconv.Itoa(int(amp.ProtocolVersion))}
 }
 
 func (c *mockConn) Read() ([]byte, error) {
@@ -33,6 +42,7 @@ func (c *mockConn) Write(payload []byte, deflated bool) error {
 func (c *mockConn) DeflateSupported() bool     { return false }
 func (c *mockConn) Headers() map[string]string { return nil }
 func (c *mockConn) No() uint64                 { return 0 }
+func (c *mockConn) Meta() map[string]string    { return c.meta }
 func (c *mockConn) Close() error {
 	close(c.in)
 	return nil
@@ -42,6 +52,7 @@ type mockBroker struct{}
 
 func (b *mockBroker) Subscribe(amp.Subscriber, map[string]int64) {}
 func (b *mockBroker) Unsubscribe(amp.Subscriber)                 {}
+func (b *mockBroker) Backfill(amp.Subscriber, *amp.Msg)          {}
 func (b *mockBroker) Wait()                                      {}
 
 type mockRequester struct{}
@@ -50,6 +61,14 @@ func (r *mockRequester) Send(amp.Subscriber, *amp.Msg) {}
 func (r *mockRequester) Unsubscribe(amp.Subscriber)    {}
 func (r *mockRequester) Wait()                         {}
 
+// countingRequester counts sent requests
+type countingRequester struct {
+	mockRequester
+	sent int
+}
+
+func (r *countingRequester) Send(amp.Subscriber, *amp.Msg) { r.sent++ }
+
 func testSession(outLen, inLen int) (chan []byte, chan []byte, func(), chan struct{}, func(*amp.Msg)) {
 	out := make(chan []byte, outLen)
 	in := make(chan []byte, inLen)
@@ -124,3 +143,246 @@ func TestPingPong(t *testing.T) {
 	cancel()
 	<-done
 }
+
+func TestFiltered(t *testing.T) {
+	s := &session{conn: &mockConn{}}
+	s.setFilters(map[string]string{"sport": `body.league == "NBA"`, "bad": `body.x ==`})
+	assert.Len(t, s.filters.exprs, 1)
+	f := s.filters
+
+	nba := amp.Parse([]byte("{\"u\":\"sport/1\",\"p\":2}\n{\"league\":\"NBA\"}"))
+	nhl := amp.Parse([]byte("{\"u\":\"sport/2\",\"p\":2}\n{\"league\":\"NHL\"}"))
+	other := amp.Parse([]byte("{\"u\":\"chat\",\"p\":2}\n{\"league\":\"NHL\"}"))
+	assert.Equal(t, []*amp.Msg{nba}, f.apply(nba))
+	assert.Len(t, f.apply(nhl), 0)
+	assert.Equal(t, []*amp.Msg{other}, f.apply(other))
+	alive := amp.NewAlive()
+	assert.Equal(t, []*amp.Msg{alive}, f.apply(alive))
+
+	s.setFilters(nil)
+	assert.Nil(t, s.filters)
+}
+
+func TestFilteredFullDiff(t *testing.T) {
+	s := &session{conn: &mockConn{}}
+	s.setFilters(map[string]string{"sport": `body.league == "NBA" && body.live`})
+	f := s.filters
+	pub := func(ts int64, updateType uint8, body string) *amp.Msg {
+		return amp.NewPublish("sport", "1", ts, updateType, json.RawMessage(body))
+	}
+	body := func(m *amp.Msg) string {
+		return string(m.BodyBytes())
+	}
+
+	// full not matching, diff without matching state
+	assert.Len(t, f.apply(pub(1, amp.Full, `{"league":"NBA","live":false}`)), 0)
+	assert.Len(t, f.apply(pub(2, amp.Diff, `{"score":1}`)), 0)
+
+	// diff which makes state match is sent as full
+	ms := f.apply(pub(3, amp.Diff, `{"live":true}`))
+	assert.Len(t, ms, 1)
+	assert.Equal(t, amp.Full, ms[0].UpdateType)
+	assert.Equal(t, int64(3), ms[0].Ts)
+	assert.Equal(t, "sport/1", ms[0].URI)
+	assert.Equal(t, `{"league":"NBA","live":true,"score":1}`, body(ms[0]))
+
+	// diffs of the matching state are sent as is
+	d := pub(4, amp.Diff, `{"score":2}`)
+	assert.Equal(t, []*amp.Msg{d}, f.apply(d))
+
+	// state stops matching, client gets close
+	ms = f.apply(pub(5, amp.Diff, `{"live":false}`))
+	assert.Len(t, ms, 1)
+	assert.Equal(t, amp.Close, ms[0].UpdateType)
+	assert.Len(t, f.apply(pub(6, amp.Diff, `{"score":3}`)), 0)
+
+	// matching full is sent as is
+	full := pub(7, amp.Full, `{"league":"NBA","live":true}`)
+	assert.Equal(t, []*amp.Msg{full}, f.apply(full))
+	cls := pub(8, amp.Close, ``)
+	assert.Equal(t, []*amp.Msg{cls}, f.apply(cls))
+	assert.Len(t, f.apply(pub(9, amp.Diff, `{"score":4}`)), 0)
+}
+
+func TestSlowConsumer(t *testing.T) {
+	conn := &mockConn{out: make(chan []byte, 4), in: make(chan []byte), meta: versioned()}
+	s := newSession(conn, &mockRequester{}, &mockBroker{}, amp.CompatibilityVersionDefault, options{maxLag: 10 * time.Millisecond})
+	s.started = true
+
+	s.Send(ping(1))
+	l, age := s.lag()
+	assert.Equal(t, 1, l)
+	assert.True(t, age < 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	s.Send(ping(2))
+	assert.True(t, s.closing)
+	s.Send(ping(3))
+	assert.Len(t, s.outQueue, 1)
+
+	done := make(chan struct{})
+	go func() {
+		s.loop(context.Background())
+		close(done)
+	}()
+	<-done
+	m := amp.Parse(<-conn.out)
+	assert.Equal(t, amp.Status, m.Type)
+	assert.Equal(t, amp.TransportError, m.Error.Source)
+	assert.Len(t, conn.out, 0)
+}
+
+func TestKeepalive(t *testing.T) {
+	conn := &mockConn{out: make(chan []byte, 16), in: make(chan []byte, 1)}
+	s := newSession(conn, &mockRequester{}, &mockBroker{}, amp.CompatibilityVersionDefault,
+		options{pingInterval: 5 * time.Millisecond, pongTimeout: 20 * time.Millisecond})
+	done := make(chan struct{})
+	go func() {
+		s.loop(context.Background())
+		close(done)
+	}()
+
+	m := amp.Parse(<-conn.out)
+	assert.Equal(t, amp.Ping, m.Type)
+	conn.in <- amp.NewPong().Marshal()
+	m = amp.Parse(<-conn.out)
+	assert.Equal(t, amp.Ping, m.Type)
+	assert.Equal(t, uint64(2), m.CorrelationID)
+	assert.True(t, s.stats.rtt > 0)
+
+	// no pong, connection is closed
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed")
+	}
+}
+
+func TestProtocolVersion(t *testing.T) {
+	conn := &mockConn{out: make(chan []byte, 4), in: make(chan []byte, 1), meta: map[string]string{amp.VersionKey: "9"}}
+	s := newSession(conn, &mockRequester{}, &mockBroker{}, amp.CompatibilityVersionDefault, options{})
+	done := make(chan struct{})
+	go func() {
+		s.loop(context.Background())
+		close(done)
+	}()
+	<-done
+	m := amp.Parse(<-conn.out)
+	assert.Equal(t, amp.Status, m.Type)
+	assert.Contains(t, m.Error.Message, "unsupported protocol version")
+
+	// old client without version, legacy encoding with meta
+	conn = &mockConn{out: make(chan []byte, 4), in: make(chan []byte, 1)}
+	s = newSession(conn, &mockRequester{}, &mockBroker{}, amp.CompatibilityVersionDefault, options{})
+	assert.Equal(t, amp.ProtocolVersionNone, s.protocol)
+	withMeta := amp.NewPublish("chat", "lobby", 1, amp.Append, "hi")
+	withMeta.Meta = map[string]string{"client": "web"}
+	withMeta.Priority = amp.PriorityLow
+	binary := amp.NewPublishBinary("img", "logo", 1, amp.Full, []byte{0, 1}, "")
+	s.connWrite(withMeta)
+	assert.Equal(t, "{\"u\":\"chat/lobby\",\"s\":1,\"p\":2,\"m\":{\"client\":\"web\"}}\n\"hi\"", string(<-conn.out))
+	s.connWrite(binary)
+	assert.Equal(t, "{\"u\":\"img/logo\",\"s\":1,\"p\":1}\n\x00\x01", string(<-conn.out))
+
+	// chunked full is sent assembled
+	big := amp.NewPublish("big", "m", 2, amp.Full, map[string]string{"a": strings.Repeat("x", 64)})
+	for _, c := range amp.ChunkFull(big, 16) {
+		s.Send(c)
+	}
+	assert.Len(t, s.outQueue, 1)
+	assert.Equal(t, amp.Full, s.outQueue[0].UpdateType)
+	assert.Equal(t, string(big.BodyBytes()), string(s.outQueue[0].BodyBytes()))
+	s.outQueue = nil
+
+	// client announced ProtocolVersion1, no meta and binary bodies
+	conn = &mockConn{out: make(chan []byte, 4), in: make(chan []byte, 1), meta: map[string]string{amp.VersionKey: "1"}}
+	s = newSession(conn, &mockRequester{}, &mockBroker{}, amp.CompatibilityVersionDefault, options{})
+	assert.Equal(t, amp.ProtocolVersion1, s.protocol)
+	s.connWrite(binary)
+	s.connWrite(withMeta)
+	assert.Equal(t, "{\"u\":\"chat/lobby\",\"s\":1,\"p\":2}\n\"hi\"", string(<-conn.out))
+	assert.Len(t, conn.out, 0)
+
+	// version in the first message
+	s.receive(&amp.Msg{Type: amp.Subscribe, Version: amp.ProtocolVersion})
+	assert.Equal(t, amp.ProtocolVersion, s.protocol)
+	s.connWrite(binary)
+	s.connWrite(withMeta)
+	assert.Len(t, conn.out, 2)
+}
+
+func TestMaxPendingRequests(t *testing.T) {
+	conn := &mockConn{out: make(chan []byte, 4), in: make(chan []byte, 1)}
+	req := &countingRequester{}
+	s := newSession(conn, req, &mockBroker{}, amp.CompatibilityVersionDefault, options{maxPending: 1})
+
+	s.receive(&amp.Msg{Type: amp.Request, URI: "math.req/add", CorrelationID: 1})
+	s.receive(&amp.Msg{Type: amp.Request, URI: "math.req/add", CorrelationID: 2})
+	assert.Equal(t, 1, req.sent)
+	assert.Len(t, s.outQueue, 1)
+	rsp := s.outQueue[0]
+	assert.Equal(t, uint64(2), rsp.CorrelationID)
+	assert.Equal(t, amp.TransportError, rsp.Error.Source)
+	assert.Equal(t, ErrTooManyRequests.Error(), rsp.Error.Message)
+
+	// response frees the slot
+	s.Send(&amp.Msg{Type: amp.Response, CorrelationID: 1})
+	s.receive(&amp.Msg{Type: amp.Request, URI: "math.req/add", CorrelationID: 3})
+	assert.Equal(t, 2, req.sent)
+}
+
+func TestMaxPendingRequestsRejections(t *testing.T) {
+	conn := &mockConn{out: make(chan []byte, 4), in: make(chan []byte, 1)}
+	req := &countingRequester{}
+	limit := 3
+	s := newSession(conn, req, &mockBroker{}, amp.CompatibilityVersionDefault, options{maxPending: limit})
+
+	// rejections don't free slots of the pending requests
+	for i := 1; i <= 2*limit; i++ {
+		s.receive(&amp.Msg{Type: amp.Request, URI: "math.req/add", CorrelationID: uint64(i)})
+	}
+	assert.Equal(t, limit, req.sent)
+	assert.Len(t, s.outQueue, limit)
+	assert.Equal(t, limit, s.pending)
+	for _, rsp := range s.outQueue {
+		assert.Equal(t, ErrTooManyRequests.Error(), rsp.Error.Message)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	conn := &mockConn{out: make(chan []byte, 4), in: make(chan []byte, 1)}
+	s := newSession(conn, &mockRequester{}, &mockBroker{}, amp.CompatibilityVersionDefault, options{})
+	assert.Equal(t, amp.ProtocolVersionNone, s.protocol)
+
+	hello := amp.NewHello(amp.Hello{Version: amp.ProtocolVersion, Compressions: []string{amp.CompressionNameDeflate}, Client: "web/2.1.0"})
+	hello.CorrelationID = 1
+	s.receive(amp.Parse(hello.Marshal()))
+	assert.Equal(t, amp.ProtocolVersion, s.protocol)
+	assert.True(t, s.noDeflate) // connection doesn't support deflate
+	assert.Equal(t, "web/2.1.0", s.hello.Client)
+
+	assert.Len(t, s.outQueue, 1)
+	m := s.outQueue[0]
+	assert.True(t, m.IsConnect())
+	assert.Equal(t, uint64(1), m.CorrelationID)
+	var w amp.Welcome
+	assert.Nil(t, json.Unmarshal(m.BodyBytes(), &w))
+	assert.Equal(t, amp.ProtocolVersion, w.Version)
+	assert.Equal(t, amp.CompressionNameNone, w.Compression)
+	assert.NotEmpty(t, w.SessionID)
+	assert.Equal(t, []string{amp.CodecJSON}, w.Codecs)
+
+	// no binary bodies to the json only client
+	s.Send(amp.NewPublishBinary("img", "logo", 1, amp.Full, []byte{0, 1}, ""))
+	assert.Len(t, s.outQueue, 1)
+	rsp := (&amp.Msg{CorrelationID: 2}).Response(nil)
+	rsp.ContentType = amp.ContentTypeBinary
+	s.Send(rsp)
+	assert.Len(t, s.outQueue, 2)
+	assert.Equal(t, uint64(2), s.outQueue[1].CorrelationID)
+	assert.Equal(t, ErrBinaryNotAccepted.Error(), s.outQueue[1].Error.Message)
+	assert.False(t, s.outQueue[1].IsBinary())
+
+	// unsupported version disconnects
+	s.receive(amp.Parse(amp.NewHello(amp.Hello{Version: 99}).Marshal()))
+	assert.True(t, s.closing)
+}
@@ -0,0 +1,95 @@
+package session
+
+import "github.com/minus5/svckit/amp"
+
+type directory interface {
+	Connected(user string, c amp.Subscriber)    // register connection of the user
+	Disconnected(user string, c amp.Subscriber) // unregister connection of the user
+}
+
+// Users registers sessions in the users directory (see amp/users) by the
+// identity from the session meta key, so messages addressed to the user
+// are delivered to all of its sessions. Sessions without the key are not
+// registered. Session is registered again when the identity in the meta
+// changes (response meta of the authentication, resumed session).
+func Users(key string, d directory) func(*Sessions) {
+	return func(s *Sessions) {
+		s.opts.usersKey = key
+		s.opts.users = d
+	}
+}
+
+// updateMeta adds meta set by the backend service in the response to the
+// session meta, e.g. identity of the authenticated user.
+func (s *session) updateMeta(meta map[string]string) {
+	if len(meta) == 0 {
+		return
+	}
+	s.Lock()
+	changed := false
+	for k, v := range meta {
+		if s.meta[k] != v {
+			changed = true
+			break
+		}
+	}
+	if changed {
+		// copied, readers of the previous map are not synchronized
+		m := make(map[string]string, len(s.meta)+len(meta))
+		for k, v := range s.meta {
+			m[k] = v
+		}
+		for k, v := range meta {
+			m[k] = v
+		}
+		s.meta = m
+	}
+	s.Unlock()
+	if changed {
+		s.userChanged()
+	}
+}
+
+// userChanged registers session in the users directory by the current
+// identity in the session meta, unregisters previous identity
+func (s *session) userChanged() {
+	if s.users == nil {
+		return
+	}
+	s.userLock.Lock()
+	defer s.userLock.Unlock()
+	s.Lock()
+	user := s.meta[s.usersKey]
+	if s.userGone {
+		user = ""
+	}
+	prev := s.user
+	s.user = user
+	s.Unlock()
+	if user == prev {
+		return
+	}
+	if prev != "" {
+		s.users.Disconnected(prev, s)
+	}
+	if user != "" {
+		s.users.Connected(user, s)
+	}
+}
+
+// userDisconnected unregisters session from the users directory
+func (s *session) userDisconnected() {
+	if s.users == nil {
+		return
+	}
+	s.userLock.Lock()
+	defer s.userLock.Unlock()
+	s.Lock()
+	user := s.user
+	s.user = ""
+	s.userGone = true
+	s.Unlock()
+	if user != "" {
+		s.users.Disconnected(user, s)
+	}
+}
@@ -0,0 +1,49 @@
+package session
+
+import (
+	"testing"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+// testDirectory counts connections by user
+type testDirectory map[string]int
+
+func (d testDirectory) Connected(user string, c amp.Subscriber)    { d[user]++ }
+func (d testDirectory) Disconnected(user string, c amp.Subscriber) { d[user]-- }
+
+func TestUsers(t *testing.T) {
+	d := testDirectory{}
+	o := options{users: d, usersKey: "user"}
+	s1 := newSession(&mockConn{meta: map[string]string{"user": "u1"}}, &mockRequester{}, &mockBroker{}, amp.CompatibilityVersionDefault, o)
+	s2 := newSession(&mockConn{}, &mockRequester{}, &mockBroker{}, amp.CompatibilityVersionDefault, o)
+	assert.Equal(t, testDirectory{"u1": 1}, d)
+
+	s1.unsubscribe()
+	s2.unsubscribe()
+	assert.Equal(t, testDirectory{"u1": 0}, d)
+}
+
+func TestUsersMetaChanged(t *testing.T) {
+	d := testDirectory{}
+	o := options{users: d, usersKey: "user"}
+	s := newSession(&mockConn{}, &mockRequester{}, &mockBroker{}, amp.CompatibilityVersionDefault, o)
+	assert.Equal(t, testDirectory{}, d)
+
+	// authentication response sets the user identity
+	login := &amp.Msg{Type: amp.Response, Meta: map[string]string{"user": "u1"}}
+	s.Send(login)
+	assert.Equal(t, testDirectory{"u1": 1}, d)
+	assert.Equal(t, "u1", s.Meta()["user"])
+	s.Send(login)
+	assert.Equal(t, testDirectory{"u1": 1}, d)
+
+	s.Send(&amp.Msg{Type: amp.Response, Meta: map[string]string{"user": "u2"}})
+	assert.Equal(t, testDirectory{"u1": 0, "u2": 1}, d)
+
+	s.unsubscribe()
+	assert.Equal(t, testDirectory{"u1": 0, "u2": 0}, d)
+	s.Send(&amp.Msg{Type: amp.Response, Meta: map[string]string{"user": "u3"}})
+	assert.Equal(t, testDirectory{"u1": 0, "u2": 0}, d)
+}
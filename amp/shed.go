@@ -0,0 +1,205 @@
+package amp
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/metric"
+)
+
+// ErrorCodeOverloaded is code of the retryable response error when request
+// is rejected by Shedder.
+const ErrorCodeOverloaded = -130
+
+func init() {
+	RegisterError(ErrorDef{
+		Code:      ErrorCodeOverloaded,
+		Retryable: true,
+		Messages:  map[string]string{"": "service overloaded"},
+	})
+}
+
+// Shedder is adaptive load shedding middleware. It monitors handler
+// latency, number of requests in flight and the responder queue (how long
+// requests wait for the worker and how many are waiting, see
+// QueueFromContext) and when the service is saturated rejects requests by
+// priority (see Msg.Lane), lowest first, with retryable
+// ErrorCodeOverloaded error:
+//
+//   - latency or queue wait above target, in flight or queue depth above
+//     half of the max: low priority requests are rejected
+//   - latency or queue wait above two times target, in flight or queue
+//     depth at max: normal priority requests are also rejected
+//
+// High priority requests are never rejected.
+// Responder workers limit the requests in flight, so the queue shows
+// saturation before the latency does.
+//
+//	s := amp.NewShedder(amp.TargetLatency(100*time.Millisecond), amp.TargetQueueWait(50*time.Millisecond))
+//	r.Use(s.Handler)
+type Shedder struct {
+	target      time.Duration
+	maxInFlight int
+	targetWait  time.Duration
+	maxQueue    int
+	alpha       float64
+	window      time.Duration
+
+	inFlight   int
+	latency    float64 // moving average in nanoseconds
+	lastSample time.Time
+	wait       float64 // moving average of the queue wait in nanoseconds
+	queue      int     // queue depth of the last request
+	lastQueue  time.Time
+	sync.Mutex
+}
+
+// TargetLatency sets handler latency above which service is considered
+// saturated, default 100ms.
+func TargetLatency(d time.Duration) func(*Shedder) {
+	return func(s *Shedder) {
+		s.target = d
+	}
+}
+
+// MaxInFlight sets number of concurrent requests at which service is
+// saturated, default 128.
+func MaxInFlight(n int) func(*Shedder) {
+	return func(s *Shedder) {
+		s.maxInFlight = n
+	}
+}
+
+// TargetQueueWait sets time requests wait for the responder worker above
+// which service is considered saturated, default 100ms.
+func TargetQueueWait(d time.Duration) func(*Shedder) {
+	return func(s *Shedder) {
+		s.targetWait = d
+	}
+}
+
+// MaxQueueDepth sets number of requests waiting for the responder worker at
+// which service is saturated, default 256.
+func MaxQueueDepth(n int) func(*Shedder) {
+	return func(s *Shedder) {
+		s.maxQueue = n
+	}
+}
+
+// NewShedder creates load shedding middleware.
+func NewShedder(opts ...func(*Shedder)) *Shedder {
+	s := &Shedder{
+		target:      100 * time.Millisecond,
+		maxInFlight: 128,
+		targetWait:  100 * time.Millisecond,
+		maxQueue:    256,
+		alpha:       0.1,
+		window:      time.Second,
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
+}
+
+// Handler is middleware which rejects requests when service is saturated.
+func (s *Shedder) Handler(h Handler) Handler {
+	return func(ctx context.Context, m *Msg) (*Msg, error) {
+		lane := m.Lane()
+		q, _ := QueueFromContext(ctx)
+		if !s.admit(lane, q) {
+			metric.Counter("amp.shed." + laneName(lane))
+			return nil, Errf(ErrorCodeOverloaded, "overloaded, %s rejected", m.URI)
+		}
+		start := time.Now()
+		defer s.done(start)
+		return h(ctx, m)
+	}
+}
+
+// admit returns true if request in the lane should be handled
+func (s *Shedder) admit(lane uint8, q Queue) bool {
+	s.Lock()
+	defer s.Unlock()
+	s.queued(q)
+	if lane != PriorityHigh {
+		level := s.level()
+		if level >= 2 || (level == 1 && lane == PriorityLow) {
+			return false
+		}
+	}
+	s.inFlight++
+	return true
+}
+
+// queued updates queue estimate with the queue state of the request.
+// Should be called during s.Lock.
+func (s *Shedder) queued(q Queue) {
+	now := time.Now()
+	if now.Sub(s.lastQueue) > s.window {
+		// no recent samples, start again
+		s.wait = float64(q.Wait)
+	} else {
+		s.wait += s.alpha * (float64(q.Wait) - s.wait)
+	}
+	s.queue = q.Depth
+	s.lastQueue = now
+}
+
+// level of saturation: 0 ok, 1 shed low, 2 shed low and normal.
+// Should be called during s.Lock.
+func (s *Shedder) level() int {
+	latency := time.Duration(s.latency)
+	if time.Since(s.lastSample) > s.window {
+		// no recent samples, estimate is stale
+		latency = 0
+	}
+	wait := time.Duration(s.wait)
+	switch {
+	case s.inFlight >= s.maxInFlight || latency > 2*s.target ||
+		s.queue >= s.maxQueue || wait > 2*s.targetWait:
+		return 2
+	case s.inFlight >= s.maxInFlight/2 || latency > s.target ||
+		s.queue >= s.maxQueue/2 || wait > s.targetWait:
+		return 1
+	}
+	return 0
+}
+
+func (s *Shedder) done(start time.Time) {
+	d := float64(time.Since(start))
+	s.Lock()
+	defer s.Unlock()
+	s.inFlight--
+	if s.lastSample.IsZero() {
+		s.latency = d
+	} else {
+		s.latency += s.alpha * (d - s.latency)
+	}
+	s.lastSample = time.Now()
+}
+
+// Stats returns number of requests in flight and average handler latency.
+func (s *Shedder) Stats() (int, time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	return s.inFlight, time.Duration(s.latency)
+}
+
+// QueueStats returns average queue wait and queue depth of the last request.
+func (s *Shedder) QueueStats() (time.Duration, int) {
+	s.Lock()
+	defer s.Unlock()
+	return time.Duration(s.wait), s.queue
+}
+
+func laneName(lane uint8) string {
+	switch lane {
+	case PriorityHigh:
+		return "high"
+	case PriorityLow:
+		return "low"
+	}
+	return "normal"
+}
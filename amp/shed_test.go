@@ -0,0 +1,125 @@
+package amp
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShedderInFlight(t *testing.T) {
+	s := NewShedder(MaxInFlight(4), TargetLatency(time.Minute))
+	block := make(chan struct{})
+	h := s.Handler(func(ctx context.Context, m *Msg) (*Msg, error) {
+		<-block
+		return nil, nil
+	})
+	req := func(priority uint8) *Msg {
+		m := NewRequest("math.req/add", nil)
+		m.Priority = priority
+		return m
+	}
+
+	var wg sync.WaitGroup
+	call := func(m *Msg) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h(context.Background(), m)
+		}()
+	}
+	wait := func(n int) {
+		for i := 0; i < 100; i++ {
+			if in, _ := s.Stats(); in == n {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("expected %d in flight", n)
+	}
+	call(req(PriorityNormal))
+	call(req(PriorityNormal))
+	wait(2)
+
+	// half of max in flight, low is rejected
+	_, err := h(context.Background(), req(PriorityLow))
+	assert.Equal(t, ErrorCodeOverloaded, errors.Cause(err).(*Error).Code)
+	assert.True(t, IsRetryable(err))
+
+	call(req(PriorityNormal))
+	call(req(PriorityNormal))
+	wait(4)
+	// at max, normal is rejected, high is not
+	_, err = h(context.Background(), req(PriorityNormal))
+	assert.Error(t, err)
+	call(req(PriorityHigh))
+	wait(5)
+
+	close(block)
+	wg.Wait()
+	_, err = h(context.Background(), req(PriorityLow))
+	assert.NoError(t, err)
+}
+
+func TestShedderLatency(t *testing.T) {
+	s := NewShedder(TargetLatency(time.Millisecond))
+	s.window = 50 * time.Millisecond
+	delay := 3 * time.Millisecond
+	h := s.Handler(func(ctx context.Context, m *Msg) (*Msg, error) {
+		time.Sleep(delay)
+		return nil, nil
+	})
+	m := NewRequest("math.req/add", nil)
+	_, err := h(context.Background(), m)
+	assert.NoError(t, err)
+
+	// latency above two times target
+	_, err = h(context.Background(), m)
+	assert.Error(t, err)
+
+	// estimate gets stale without samples
+	time.Sleep(60 * time.Millisecond)
+	delay = 0
+	_, err = h(context.Background(), m)
+	assert.NoError(t, err)
+}
+
+func TestShedderQueue(t *testing.T) {
+	s := NewShedder(TargetQueueWait(10*time.Millisecond), MaxQueueDepth(8))
+	h := s.Handler(func(ctx context.Context, m *Msg) (*Msg, error) {
+		return nil, nil
+	})
+	req := func(priority uint8, q Queue) error {
+		m := NewRequest("math.req/add", nil)
+		m.Priority = priority
+		_, err := h(WithQueue(context.Background(), q), m)
+		return err
+	}
+
+	assert.NoError(t, req(PriorityLow, Queue{Wait: time.Millisecond, Depth: 1}))
+	// queue depth above half of the max
+	assert.Error(t, req(PriorityLow, Queue{Wait: time.Millisecond, Depth: 4}))
+	assert.NoError(t, req(PriorityNormal, Queue{Wait: time.Millisecond, Depth: 4}))
+	// queue at max
+	assert.Error(t, req(PriorityNormal, Queue{Wait: time.Millisecond, Depth: 8}))
+	assert.NoError(t, req(PriorityHigh, Queue{Wait: time.Millisecond, Depth: 8}))
+
+	// average queue wait above target
+	s.lastQueue = time.Time{}
+	assert.Error(t, req(PriorityLow, Queue{Wait: 15 * time.Millisecond}))
+	assert.NoError(t, req(PriorityNormal, Queue{Wait: 15 * time.Millisecond}))
+	// above two times target
+	s.lastQueue = time.Time{}
+	assert.Error(t, req(PriorityNormal, Queue{Wait: 25 * time.Millisecond}))
+	wait, depth := s.QueueStats()
+	assert.Equal(t, 25*time.Millisecond, wait)
+	assert.Equal(t, 0, depth)
+
+	// handler not called from the responder queue
+	s.lastQueue = time.Time{}
+	_, err := h(context.Background(), NewRequest("math.req/add", nil))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,95 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BigQueryURL is base url of the BigQuery api.
+var BigQueryURL = "https://bigquery.googleapis.com/bigquery/v2"
+
+// BigQuery writes rows with BigQuery streaming inserts (tabledata.insertAll).
+type BigQuery struct {
+	project string
+	dataset string
+	token   func() (string, error)
+	client  *http.Client
+}
+
+// NewBigQuery creates BigQuery writer. Token returns OAuth2 access token
+// with bigquery.insertdata scope.
+func NewBigQuery(project, dataset string, token func() (string, error)) *BigQuery {
+	return &BigQuery{
+		project: project,
+		dataset: dataset,
+		token:   token,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Write inserts rows into the table.
+func (b *BigQuery) Write(ctx context.Context, table string, rows []Row) error {
+	type insertRow struct {
+		JSON Row `json:"json"`
+	}
+	req := struct {
+		Rows []insertRow `json:"rows"`
+	}{}
+	for _, r := range rows {
+		req.Rows = append(req.Rows, insertRow{JSON: r})
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	token, err := b.token()
+	if err != nil {
+		return err
+	}
+	u := fmt.Sprintf("%s/projects/%s/datasets/%s/tables/%s/insertAll", BigQueryURL, b.project, b.dataset, table)
+	hr, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	hr = hr.WithContext(ctx)
+	hr.Header.Set("Authorization", "Bearer "+token)
+	hr.Header.Set("Content-Type", "application/json")
+	rsp, err := b.client.Do(hr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer rsp.Body.Close()
+	var res struct {
+		InsertErrors []struct {
+			Index  int `json:"index"`
+			Errors []struct {
+				Reason  string `json:"reason"`
+				Message string `json:"message"`
+			} `json:"errors"`
+		} `json:"insertErrors"`
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(rsp.Body).Decode(&res); err != nil {
+		return errors.Wrapf(err, "bigquery status %d", rsp.StatusCode)
+	}
+	if res.Error != nil {
+		return errors.Errorf("bigquery status %d: %s", rsp.StatusCode, res.Error.Message)
+	}
+	if len(res.InsertErrors) > 0 {
+		e := res.InsertErrors[0]
+		msg := ""
+		if len(e.Errors) > 0 {
+			msg = e.Errors[0].Reason + ": " + e.Errors[0].Message
+		}
+		return errors.Errorf("bigquery %d rows failed, row %d %s", len(res.InsertErrors), e.Index, msg)
+	}
+	return nil
+}
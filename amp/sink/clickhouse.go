@@ -0,0 +1,70 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ClickHouse writes rows through ClickHouse http interface
+// in JSONEachRow format.
+type ClickHouse struct {
+	url      string
+	user     string
+	password string
+	client   *http.Client
+}
+
+// NewClickHouse creates ClickHouse writer, addr is http interface url
+// (e.g. http://clickhouse:8123).
+func NewClickHouse(addr, user, password string) *ClickHouse {
+	return &ClickHouse{
+		url:      strings.TrimSuffix(addr, "/"),
+		user:     user,
+		password: password,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Write inserts rows into the table.
+func (c *ClickHouse) Write(ctx context.Context, table string, rows []Row) error {
+	buf := bytes.NewBuffer(nil)
+	enc := json.NewEncoder(buf)
+	for _, r := range rows {
+		if err := enc.Encode(r); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	q := url.Values{"query": {"INSERT INTO " + table + " FORMAT JSONEachRow"}}
+	req, err := http.NewRequest("POST", c.url+"/?"+q.Encode(), buf)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req = req.WithContext(ctx)
+	if c.user != "" {
+		req.Header.Set("X-ClickHouse-User", c.user)
+		req.Header.Set("X-ClickHouse-Key", c.password)
+	}
+	return do(c.client, req)
+}
+
+func do(client *http.Client, req *http.Request) error {
+	rsp, err := client.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 1024))
+		return errors.Errorf("%s status %d: %s", req.URL.Host, rsp.StatusCode, msg)
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+// Package sink streams amp topics into analytics databases
+// (ClickHouse, BigQuery) so feed history could be queried without
+// touching the services.
+//
+// Mapping selects topics and maps json body fields (see amp.Msg.BodyField)
+// to the table columns. Special fields $uri, $topic, $path and $ts are
+// taken from the message header:
+//
+//	mapping := sink.Mapping{
+//		"odds": {Name: "odds", Columns: []sink.Column{
+//			{Name: "event_id", Field: "eventId"},
+//			{Name: "price", Field: "outcomes.0.price"},
+//			{Name: "ts", Field: "$ts"},
+//		}},
+//	}
+//	s := sink.New(sink.NewClickHouse("http://clickhouse:8123", user, pass), mapping,
+//		sink.DeadLetter(pub.Publish))
+//	s.Consume(ctx, nsq.Subscribe(ctx, mapping.Topics()))
+//
+// Rows are written in batches. Failed batch is retried with exponential
+// backoff, messages of the batch which still fails are sent to the dead
+// letter publisher.
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+	"github.com/minus5/svckit/signal"
+	"github.com/pkg/errors"
+)
+
+// DeadLetterTopic is default topic of the messages which could not be written.
+const DeadLetterTopic = "sink.dead.letter"
+
+// Row is table row, values by column name.
+type Row map[string]json.RawMessage
+
+// Writer writes rows into the database table.
+type Writer interface {
+	Write(ctx context.Context, table string, rows []Row) error
+}
+
+// Column maps body field to the table column.
+type Column struct {
+	Name     string `json:"name"`
+	Field    string `json:"field"`              // body field path or $uri, $topic, $path, $ts
+	Required bool   `json:"required,omitempty"` // message without field is not written
+}
+
+// Table is destination of the topic messages.
+type Table struct {
+	Name    string   `json:"name"`
+	Columns []Column `json:"columns"`
+}
+
+// Mapping is tables by topic.
+type Mapping map[string]Table
+
+// Topics returns mapped topics.
+func (mp Mapping) Topics() []string {
+	topics := make([]string, 0, len(mp))
+	for t := range mp {
+		topics = append(topics, t)
+	}
+	return topics
+}
+
+// Row maps message to the table row.
+func (t Table) Row(m *amp.Msg) (Row, error) {
+	row := make(Row, len(t.Columns))
+	for _, c := range t.Columns {
+		v, ok := field(m, c.Field)
+		if !ok {
+			if c.Required {
+				return nil, errors.Errorf("missing field %s in %s", c.Field, m.URI)
+			}
+			continue
+		}
+		row[c.Name] = v
+	}
+	return row, nil
+}
+
+func field(m *amp.Msg, f string) (json.RawMessage, bool) {
+	str := func(s string) json.RawMessage {
+		b, _ := json.Marshal(s)
+		return b
+	}
+	switch f {
+	case "$uri":
+		return str(m.URI), true
+	case "$topic":
+		return str(m.Topic()), true
+	case "$path":
+		return str(m.Path()), true
+	case "$ts":
+		return json.RawMessage(strconv.FormatInt(m.Ts, 10)), true
+	}
+	return m.BodyField(f)
+}
+
+type options struct {
+	batchSize     int
+	flushInterval time.Duration
+	maxRetry      time.Duration
+	deadLetter    func(*amp.Msg)
+}
+
+// BatchSize sets max number of rows in the batch, default 1000.
+func BatchSize(n int) func(*options) {
+	return func(o *options) {
+		o.batchSize = n
+	}
+}
+
+// FlushInterval sets max time rows wait in the batch, default 5s.
+func FlushInterval(d time.Duration) func(*options) {
+	return func(o *options) {
+		o.flushInterval = d
+	}
+}
+
+// MaxRetry sets how long failed batch is retried, default 1 minute.
+func MaxRetry(d time.Duration) func(*options) {
+	return func(o *options) {
+		o.maxRetry = d
+	}
+}
+
+// DeadLetter publishes messages which could not be written
+// to the DeadLetterTopic. Without dead letter such messages are dropped.
+func DeadLetter(publish func(*amp.Msg)) func(*options) {
+	return func(o *options) {
+		o.deadLetter = publish
+	}
+}
+
+type batch struct {
+	rows []Row
+	msgs []*amp.Msg
+}
+
+// Sink writes mapped topics into the Writer.
+type Sink struct {
+	w       Writer
+	mapping Mapping
+	opts    options
+	batches map[string]*batch // by table
+}
+
+// New creates sink.
+func New(w Writer, mapping Mapping, opts ...func(*options)) *Sink {
+	o := options{
+		batchSize:     1000,
+		flushInterval: 5 * time.Second,
+		maxRetry:      time.Minute,
+	}
+	for _, f := range opts {
+		f(&o)
+	}
+	return &Sink{
+		w:       w,
+		mapping: mapping,
+		opts:    o,
+		batches: make(map[string]*batch),
+	}
+}
+
+// Consume writes messages from in until in is closed or ctx is done.
+// Waiting rows are written on exit.
+func (s *Sink) Consume(ctx context.Context, in <-chan *amp.Msg) {
+	t := time.NewTicker(s.opts.flushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case m, ok := <-in:
+			if !ok {
+				s.Flush(context.Background())
+				return
+			}
+			s.Add(ctx, m)
+		case <-t.C:
+			s.Flush(ctx)
+		case <-ctx.Done():
+			s.Flush(context.Background())
+			return
+		}
+	}
+}
+
+// Add maps message to the row and adds it to the batch of the table.
+// Full batch is written immediately.
+func (s *Sink) Add(ctx context.Context, m *amp.Msg) {
+	t, ok := s.mapping[m.Topic()]
+	if !ok || m.Type != amp.Publish {
+		return
+	}
+	row, err := t.Row(m)
+	if err != nil {
+		log.S("uri", m.URI).Error(err)
+		s.deadLetter([]*amp.Msg{m}, err)
+		return
+	}
+	b, ok := s.batches[t.Name]
+	if !ok {
+		b = &batch{}
+		s.batches[t.Name] = b
+	}
+	b.rows = append(b.rows, row)
+	b.msgs = append(b.msgs, m)
+	if len(b.rows) >= s.opts.batchSize {
+		s.write(ctx, t.Name, b)
+		delete(s.batches, t.Name)
+	}
+}
+
+// Flush writes all waiting batches.
+func (s *Sink) Flush(ctx context.Context) {
+	for table, b := range s.batches {
+		s.write(ctx, table, b)
+	}
+	s.batches = make(map[string]*batch)
+}
+
+func (s *Sink) write(ctx context.Context, table string, b *batch) {
+	err := signal.WithBackoff(ctx, func() error {
+		err := s.w.Write(ctx, table, b.rows)
+		if err != nil {
+			metric.Counter("sink.retry")
+			log.S("table", table).I("rows", len(b.rows)).Error(err)
+		}
+		return err
+	}, s.opts.maxRetry/4, s.opts.maxRetry)
+	if err != nil {
+		s.deadLetter(b.msgs, err)
+		return
+	}
+	metric.Counter("sink.rows", len(b.rows))
+}
+
+func (s *Sink) deadLetter(msgs []*amp.Msg, err error) {
+	metric.Counter("sink.dead", len(msgs))
+	if s.opts.deadLetter == nil {
+		return
+	}
+	for _, m := range msgs {
+		d := amp.NewPublish(DeadLetterTopic, m.Topic(), m.Ts, amp.Append, json.RawMessage(m.BodyBytes()))
+		d.Meta = map[string]string{"error": err.Error(), "uri": m.URI}
+		s.opts.deadLetter(d)
+	}
+}
@@ -0,0 +1,118 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+type testWriter struct {
+	fail   int
+	tables []string
+	rows   []Row
+}
+
+func (w *testWriter) Write(ctx context.Context, table string, rows []Row) error {
+	if w.fail > 0 {
+		w.fail--
+		return errors.New("unavailable")
+	}
+	w.tables = append(w.tables, table)
+	w.rows = append(w.rows, rows...)
+	return nil
+}
+
+type odds struct {
+	EventID int     `json:"eventId"`
+	Price   float64 `json:"price"`
+}
+
+var mapping = Mapping{
+	"odds": {Name: "odds_history", Columns: []Column{
+		{Name: "event_id", Field: "eventId", Required: true},
+		{Name: "price", Field: "price"},
+		{Name: "uri", Field: "$uri"},
+		{Name: "ts", Field: "$ts"},
+	}},
+}
+
+func TestSink(t *testing.T) {
+	w := &testWriter{fail: 1}
+	var dead []*amp.Msg
+	s := New(w, mapping, BatchSize(2), MaxRetry(100*time.Millisecond), DeadLetter(func(m *amp.Msg) { dead = append(dead, m) }))
+	ctx := context.Background()
+
+	s.Add(ctx, amp.NewPublish("odds", "1", 10, amp.Diff, odds{EventID: 1, Price: 1.5}))
+	s.Add(ctx, amp.NewPublish("other", "1", 11, amp.Diff, odds{EventID: 1}))
+	s.Add(ctx, amp.NewPublish("odds", "2", 12, amp.Diff, map[string]int{"price": 2})) // missing required
+	assert.Len(t, dead, 1)
+	assert.Equal(t, "odds/2", dead[0].Meta["uri"])
+	assert.Len(t, w.rows, 0)
+
+	s.Add(ctx, amp.NewPublish("odds", "3", 13, amp.Diff, odds{EventID: 3, Price: 2.5}))
+	// batch is full, written after retry
+	assert.Equal(t, []string{"odds_history"}, w.tables)
+	assert.Len(t, w.rows, 2)
+	assert.Equal(t, `1.5`, string(w.rows[0]["price"]))
+	assert.Equal(t, `"odds/3"`, string(w.rows[1]["uri"]))
+	assert.Equal(t, `13`, string(w.rows[1]["ts"]))
+
+	w.fail = 1000
+	s.Add(ctx, amp.NewPublish("odds", "4", 14, amp.Diff, odds{EventID: 4}))
+	s.Flush(ctx)
+	assert.Len(t, dead, 2)
+	assert.Equal(t, DeadLetterTopic+"/odds", dead[1].URI)
+	assert.Contains(t, dead[1].Meta["error"], "unavailable")
+}
+
+func TestClickHouse(t *testing.T) {
+	var query, body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("query")
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		if r.Header.Get("X-ClickHouse-User") != "user" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+
+	rows := []Row{{"a": []byte("1")}, {"a": []byte("2")}}
+	assert.Nil(t, NewClickHouse(srv.URL, "user", "pass").Write(context.Background(), "t", rows))
+	assert.Equal(t, "INSERT INTO t FORMAT JSONEachRow", query)
+	assert.Equal(t, "{\"a\":1}\n{\"a\":2}\n", body)
+	assert.NotNil(t, NewClickHouse(srv.URL, "", "").Write(context.Background(), "t", rows))
+}
+
+func TestBigQuery(t *testing.T) {
+	var path, body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.Write([]byte(`{"insertErrors":[{"index":0,"errors":[{"reason":"invalid","message":"bad row"}]}]}`))
+			return
+		}
+		w.Write([]byte(`{"kind":"bigquery#tableDataInsertAllResponse"}`))
+	}))
+	defer srv.Close()
+	BigQueryURL = srv.URL
+
+	rows := []Row{{"a": []byte("1")}}
+	b := NewBigQuery("p", "d", func() (string, error) { return "token", nil })
+	assert.Nil(t, b.Write(context.Background(), "t", rows))
+	assert.Equal(t, "/projects/p/datasets/d/tables/t/insertAll", path)
+	assert.Equal(t, `{"rows":[{"json":{"a":1}}]}`, body)
+
+	b = NewBigQuery("p", "d", func() (string, error) { return "", nil })
+	err := b.Write(context.Background(), "t", rows)
+	assert.Contains(t, err.Error(), "bad row")
+}
@@ -0,0 +1,121 @@
+package amp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// Strict parsing errors.
+// Use errors.Cause(err) to compare error returned from ParseStrict.
+var (
+	ErrMalformedHeader = errors.New("malformed header")
+	ErrUnknownType     = errors.New("unknown message type")
+	ErrHeaderTooLarge  = errors.New("header too large")
+	ErrBodyTooLarge    = errors.New("body too large")
+	ErrInvalidURI      = errors.New("invalid uri")
+)
+
+// Limits for the strict parsing.
+type Limits struct {
+	MaxHeader int // max header size in bytes
+	MaxBody   int // max body size in bytes
+	MaxURI    int // max length of the uri
+}
+
+// DefaultLimits are limits used for parsing messages from the clients.
+var DefaultLimits = Limits{
+	MaxHeader: 4 * 1024,
+	MaxBody:   1024 * 1024,
+	MaxURI:    256,
+}
+
+// ParseStrict decodes Msg from []byte like Parse, but returns typed error
+// on bad input instead of logging it. Header must contain only known
+// fields, message and update types must be known, uris valid and
+// header and body sizes are limited.
+// Used by gateways for parsing frames from untrusted clients.
+func ParseStrict(buf []byte, l Limits) (*Msg, error) {
+	if len(buf) == 0 {
+		return nil, errors.Wrap(ErrMalformedHeader, "empty message")
+	}
+	header, body := buf, []byte(nil)
+	if i := bytes.IndexByte(buf, separtor[0]); i >= 0 {
+		header, body = buf[:i], buf[i+1:]
+	}
+	if l.MaxHeader > 0 && len(header) > l.MaxHeader {
+		return nil, errors.Wrap(ErrHeaderTooLarge, fmt.Sprintf("%d bytes", len(header)))
+	}
+	if l.MaxBody > 0 && len(body) > l.MaxBody {
+		return nil, errors.Wrap(ErrBodyTooLarge, fmt.Sprintf("%d bytes", len(body)))
+	}
+
+	m := acquireMsg()
+	dec := json.NewDecoder(bytes.NewReader(header))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(m); err != nil {
+		m.Release()
+		return nil, errors.Wrap(ErrMalformedHeader, err.Error())
+	}
+	if dec.More() {
+		m.Release()
+		return nil, errors.Wrap(ErrMalformedHeader, "trailing data")
+	}
+	if err := m.validate(l); err != nil {
+		m.Release()
+		return nil, err
+	}
+	if len(body) > 0 {
+		m.body = body
+	}
+	return m, nil
+}
+
+func (m *Msg) validate(l Limits) error {
+	if m.Type > Ack {
+		return errors.Wrap(ErrUnknownType, fmt.Sprintf("type %d", m.Type))
+	}
+	if m.UpdateType > FullEnd {
+		return errors.Wrap(ErrUnknownType, fmt.Sprintf("update type %d", m.UpdateType))
+	}
+	switch m.Type {
+	case Publish, Request, Current:
+		if err := validURI(m.URI, l.MaxURI); err != nil {
+			return err
+		}
+	case Subscribe:
+		for uri := range m.Subscriptions {
+			if err := validURI(uri, l.MaxURI); err != nil {
+				return err
+			}
+		}
+		for uri := range m.Filters {
+			if err := validURI(uri, l.MaxURI); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validURI checks that uri has non empty topic and contains only
+// letters, digits and .-_:/ characters
+func validURI(uri string, maxLen int) error {
+	if uri == "" || uri[0] == '/' {
+		return errors.Wrap(ErrInvalidURI, fmt.Sprintf("'%s' without topic", uri))
+	}
+	if maxLen > 0 && len(uri) > maxLen {
+		return errors.Wrap(ErrInvalidURI, fmt.Sprintf("%d characters", len(uri)))
+	}
+	for _, c := range uri {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '-', c == '_', c == ':', c == '/':
+		default:
+			return errors.Wrap(ErrInvalidURI, fmt.Sprintf("'%s' invalid character %q", uri, c))
+		}
+	}
+	return nil
+}
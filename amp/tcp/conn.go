@@ -0,0 +1,116 @@
+package tcp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	maxFrameSize       = 16 * 1024 * 1024
+	tcpDeadline        = 48 * time.Second // 1.5 * session alive interval
+	connectionsCounter uint64
+)
+
+// ErrFrameTooLarge is returned when frame length is over the limit.
+var ErrFrameTooLarge = errors.New("frame too large")
+
+func no() uint64 {
+	return atomic.AddUint64(&connectionsCounter, 1)
+}
+
+// Conn is amp connection over tcp.
+// Each message is sent in frame: 4 bytes big endian payload length
+// followed by payload (amp.Msg.Marshal).
+type Conn struct {
+	tcpConn net.Conn
+	r       *bufio.Reader
+	no      uint64
+	meta    map[string]string
+	wLock   sync.Mutex
+}
+
+func newConn(tc net.Conn) *Conn {
+	return &Conn{
+		tcpConn: tc,
+		r:       bufio.NewReader(tc),
+		no:      no(),
+	}
+}
+
+func setDeadline(c net.Conn) {
+	_ = c.SetDeadline(time.Now().Add(tcpDeadline))
+}
+
+// Write writes payload frame to the connection.
+// Deflate is not supported, payload is never deflated.
+func (c *Conn) Write(payload []byte, deflated bool) error {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(payload)))
+	if _, err := c.tcpConn.Write(header[:]); err != nil {
+		_ = c.Close()
+		return errors.WithStack(err)
+	}
+	if _, err := c.tcpConn.Write(payload); err != nil {
+		_ = c.Close()
+		return errors.WithStack(err)
+	}
+	setDeadline(c.tcpConn)
+	return nil
+}
+
+// Read reads frame payload from the connection.
+func (c *Conn) Read() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		_ = c.Close()
+		return nil, errors.WithStack(err)
+	}
+	l := int(binary.BigEndian.Uint32(header[:]))
+	if l > maxFrameSize {
+		_ = c.Close()
+		return nil, errors.Wrapf(ErrFrameTooLarge, "%d bytes", l)
+	}
+	payload := make([]byte, l)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		_ = c.Close()
+		return nil, errors.WithStack(err)
+	}
+	setDeadline(c.tcpConn)
+	return payload, nil
+}
+
+// No returns connection identificator.
+func (c *Conn) No() uint64 {
+	return c.no
+}
+
+// DeflateSupported always false, tcp frames are not compressed.
+func (c *Conn) DeflateSupported() bool {
+	return false
+}
+
+// Headers are not supported on tcp connection.
+func (c *Conn) Headers() map[string]string {
+	return nil
+}
+
+// Meta returns session metadata.
+// For the tls connections with client certificate it contains certificate
+// common name under the "cn" key.
+func (c *Conn) Meta() map[string]string {
+	return c.meta
+}
+
+// Close closes tcp connection, that will raise error on reading.
+func (c *Conn) Close() error {
+	return c.tcpConn.Close()
+}
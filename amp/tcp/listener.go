@@ -0,0 +1,130 @@
+// Package tcp implements amp connection over plain tcp (or tls)
+// with length prefixed frames.
+//
+// It is alternative to the ws transport for internal consumers.
+// Server side connections are served by session.Sessions same as ws:
+//
+//	ln := tcp.MustOpen(port)
+//	go tcp.Listen(ctx, ln, func(c *tcp.Conn) { sessions.Serve(c) })
+//
+// Client side is in amp/client (client.NewTCP).
+// There is no handshake in tcp transport, client announces protocol
+// version in the Version field of its first message (see amp.NegotiateVersion).
+package tcp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/log"
+	"github.com/pkg/errors"
+)
+
+var keepAlivePeriod = 30 * time.Second
+
+// Open opens new tcp port.
+// If tlsConfig is not nil connections are tls.
+// Returns net.Listener for call to the Listen method below.
+func Open(port int, tlsConfig *tls.Config) (net.Listener, error) {
+	ln, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", port))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	ln = keepAliveListener{ln.(*net.TCPListener)}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	log.I("port", port).Info("tcp listener started")
+	return ln, nil
+}
+
+// MustOpen raises fatal if unsuccessful
+func MustOpen(port int, tlsConfig *tls.Config) net.Listener {
+	ln, err := Open(port, tlsConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return ln
+}
+
+// Listen starts listening for new connections, blocks until ctx closed.
+// Then stops listening for new connections, and waits for current to finish.
+func Listen(ctx context.Context, ln net.Listener, h func(*Conn)) {
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+	var wg sync.WaitGroup
+	for {
+		tc, err := ln.Accept()
+		if err != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := accept(tc)
+			if err != nil {
+				log.Error(err)
+				_ = tc.Close()
+				return
+			}
+			h(c) // blocks until connection is closed
+		}()
+	}
+	wg.Wait()
+}
+
+func accept(tc net.Conn) (*Conn, error) {
+	setDeadline(tc)
+	c := newConn(tc)
+	if t, ok := tc.(*tls.Conn); ok {
+		if err := t.Handshake(); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if certs := t.ConnectionState().PeerCertificates; len(certs) > 0 {
+			c.meta = map[string]string{"cn": certs[0].Subject.CommonName}
+		}
+	}
+	return c, nil
+}
+
+// keepAliveListener turns on tcp keepalive on accepted connections,
+// detects dead peers even when amp keepalive (session.Keepalive) is not used
+type keepAliveListener struct {
+	*net.TCPListener
+}
+
+func (l keepAliveListener) Accept() (net.Conn, error) {
+	tc, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	_ = tc.SetKeepAlive(true)
+	_ = tc.SetKeepAlivePeriod(keepAlivePeriod)
+	return tc, nil
+}
+
+// Dial connects to the amp tcp server.
+// If tlsConfig is not nil connection is tls.
+func Dial(ctx context.Context, addr string, tlsConfig *tls.Config) (*Conn, error) {
+	d := net.Dialer{KeepAlive: keepAlivePeriod}
+	tc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if tlsConfig != nil {
+		t := tls.Client(tc, tlsConfig)
+		if err := t.Handshake(); err != nil {
+			_ = tc.Close()
+			return nil, errors.WithStack(err)
+		}
+		tc = t
+	}
+	setDeadline(tc)
+	return newConn(tc), nil
+}
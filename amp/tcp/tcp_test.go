@@ -0,0 +1,55 @@
+package tcp
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		Listen(ctx, keepAliveListener{ln.(*net.TCPListener)}, func(c *Conn) {
+			for {
+				buf, err := c.Read()
+				if err != nil {
+					return
+				}
+				_ = c.Write(buf, false)
+			}
+		})
+		close(done)
+	}()
+
+	c, err := Dial(ctx, ln.Addr().String(), nil)
+	assert.Nil(t, err)
+	for _, p := range []string{"{\"t\":4}\n", "", "{\"u\":\"math.v1\"}\n{\"x\":1}"} {
+		assert.Nil(t, c.Write([]byte(p), false))
+		buf, err := c.Read()
+		assert.Nil(t, err)
+		assert.Equal(t, p, string(buf))
+	}
+
+	c.Close()
+	cancel()
+	<-done
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	server, client := net.Pipe()
+	c := newConn(server)
+	go func() {
+		var header [4]byte
+		binary.BigEndian.PutUint32(header[:], uint32(maxFrameSize+1))
+		_, _ = client.Write(header[:])
+	}()
+	_, err := c.Read()
+	assert.Equal(t, ErrFrameTooLarge, errors.Cause(err))
+}
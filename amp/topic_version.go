@@ -0,0 +1,128 @@
+package amp
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+)
+
+// TopicVersion splits versioned topic name into base name and version:
+//
+//	math.v2     => math, 2
+//	math.req.v2 => math.req, 2
+//	math        => math, 0
+//
+// Version is last topic segment in form vN. Unversioned topic has version 0.
+func TopicVersion(topic string) (string, int) {
+	p := strings.LastIndex(topic, ".")
+	if p < 0 || len(topic) < p+3 || topic[p+1] != 'v' {
+		return topic, 0
+	}
+	v, err := strconv.Atoi(topic[p+2:])
+	if err != nil || v <= 0 {
+		return topic, 0
+	}
+	return topic[:p], v
+}
+
+// VersionTopic adds version to the base topic name.
+// Version 0 leaves topic unversioned.
+func VersionTopic(base string, version int) string {
+	if version <= 0 {
+		return base
+	}
+	return fmt.Sprintf("%s.v%d", base, version)
+}
+
+// Versions is registry of the topic versions served by the gateway.
+// It negotiates version with the client and warns about usage of
+// deprecated versions.
+type Versions struct {
+	served     map[string][]int // sorted ascending
+	deprecated map[string]bool
+	warned     map[string]bool
+	sync.Mutex
+}
+
+// NewVersions creates empty versions registry.
+func NewVersions() *Versions {
+	return &Versions{
+		served:     make(map[string][]int),
+		deprecated: make(map[string]bool),
+		warned:     make(map[string]bool),
+	}
+}
+
+// Serve registers served versions of the base topic.
+func (v *Versions) Serve(base string, versions ...int) {
+	v.Lock()
+	defer v.Unlock()
+	vs := append(v.served[base], versions...)
+	sort.Ints(vs)
+	v.served[base] = vs
+}
+
+// Deprecate marks version of the base topic as deprecated.
+func (v *Versions) Deprecate(base string, version int) {
+	v.Lock()
+	defer v.Unlock()
+	v.deprecated[VersionTopic(base, version)] = true
+}
+
+// Negotiate returns highest served version of the base topic which is not
+// greater than clientMax, highest client supports. With clientMax 0 highest
+// served version is returned.
+func (v *Versions) Negotiate(base string, clientMax int) (string, error) {
+	v.Lock()
+	defer v.Unlock()
+	vs := v.served[base]
+	for i := len(vs) - 1; i >= 0; i-- {
+		if clientMax <= 0 || vs[i] <= clientMax {
+			topic := VersionTopic(base, vs[i])
+			v.warn(topic)
+			return topic, nil
+		}
+	}
+	return "", fmt.Errorf("no version of %s for client max version %d", base, clientMax)
+}
+
+// Check checks that versioned topic, requested by the client, is served.
+func (v *Versions) Check(topic string) error {
+	base, version := TopicVersion(topic)
+	v.Lock()
+	defer v.Unlock()
+	for _, s := range v.served[base] {
+		if s == version {
+			v.warn(topic)
+			return nil
+		}
+	}
+	return fmt.Errorf("version %d of %s not served", version, base)
+}
+
+// Deprecated returns true if topic version is deprecated.
+func (v *Versions) Deprecated(topic string) bool {
+	v.Lock()
+	defer v.Unlock()
+	return v.deprecated[topic]
+}
+
+// warn logs first usage of deprecated topic version, and counts each usage
+func (v *Versions) warn(topic string) {
+	if !v.deprecated[topic] {
+		return
+	}
+	metric.Counter("amp.deprecated." + topic)
+	if v.warned[topic] {
+		return
+	}
+	v.warned[topic] = true
+	base, _ := TopicVersion(topic)
+	latest := v.served[base][len(v.served[base])-1]
+	log.S("topic", topic).S("latest", VersionTopic(base, latest)).Info("deprecated topic version in use")
+}
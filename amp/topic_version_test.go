@@ -0,0 +1,51 @@
+package amp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopicVersion(t *testing.T) {
+	cases := []struct {
+		topic   string
+		base    string
+		version int
+	}{
+		{"math.v2", "math", 2},
+		{"math.req.v12", "math.req", 12},
+		{"math", "math", 0},
+		{"math.vx", "math.vx", 0},
+		{"math.v", "math.v", 0},
+		{"math.v0", "math.v0", 0},
+	}
+	for _, c := range cases {
+		base, version := TopicVersion(c.topic)
+		assert.Equal(t, c.base, base, c.topic)
+		assert.Equal(t, c.version, version, c.topic)
+	}
+	assert.Equal(t, "math.v3", VersionTopic("math", 3))
+	assert.Equal(t, "math", VersionTopic("math", 0))
+}
+
+func TestVersions(t *testing.T) {
+	v := NewVersions()
+	v.Serve("math", 2, 1, 3)
+	v.Deprecate("math", 1)
+
+	topic, err := v.Negotiate("math", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "math.v3", topic)
+	topic, err = v.Negotiate("math", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "math.v2", topic)
+	topic, err = v.Negotiate("math", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "math.v1", topic)
+	assert.True(t, v.Deprecated(topic))
+	_, err = v.Negotiate("chat", 1)
+	assert.NotNil(t, err)
+
+	assert.Nil(t, v.Check("math.v2"))
+	assert.NotNil(t, v.Check("math.v4"))
+}
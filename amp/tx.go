@@ -0,0 +1,144 @@
+package amp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TxTopic is topic of the transaction commit markers.
+const TxTopic = "system.tx"
+
+// meta keys of the transaction messages
+const (
+	metaTx       = "tx"
+	metaTxCount  = "txCount"
+	metaTxTopics = "txTopics"
+)
+
+// Tx stages messages for several topics which should become visible
+// together. Staged messages are published with transaction id (prepare),
+// followed by commit marker on TxTopic with number of messages by topic.
+// Broker holds prepared messages until commit marker and all prepared
+// messages of the topics it consumes arrive, and then applies them at
+// once. Prepared messages without commit are dropped.
+//
+//	tx := amp.NewTx()
+//	tx.Add(amp.NewPublish("accounts", "1", ts, amp.Diff, a))
+//	tx.Add(amp.NewPublish("ledger", "1", ts, amp.Append, l))
+//	tx.Commit(pub.Publish)
+type Tx struct {
+	id   string
+	msgs []*Msg
+}
+
+// NewTx creates new transaction with random id.
+func NewTx() *Tx {
+	buf := make([]byte, 12)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		panic(err)
+	}
+	return &Tx{id: hex.EncodeToString(buf)}
+}
+
+// ID of the transaction.
+func (t *Tx) ID() string {
+	return t.id
+}
+
+// Add stages message in the transaction.
+func (t *Tx) Add(m *Msg) *Tx {
+	if m.Meta == nil {
+		m.Meta = make(map[string]string)
+	}
+	m.Meta[metaTx] = t.id
+	m.payloads = nil
+	t.msgs = append(t.msgs, m)
+	return t
+}
+
+// Len returns number of staged messages.
+func (t *Tx) Len() int {
+	return len(t.msgs)
+}
+
+// Commit publishes staged messages followed by commit marker.
+func (t *Tx) Commit(publish func(*Msg)) {
+	if len(t.msgs) == 0 {
+		return
+	}
+	counts := make(map[string]int)
+	for _, m := range t.msgs {
+		counts[m.Topic()]++
+		publish(m)
+	}
+	publish(NewTxCommit(t.id, counts))
+	t.msgs = nil
+}
+
+// Rollback discards staged messages.
+func (t *Tx) Rollback() {
+	t.msgs = nil
+}
+
+// NewTxCommit creates commit marker for the transaction with counts
+// messages by topic.
+func NewTxCommit(id string, counts map[string]int) *Msg {
+	count := 0
+	topics := make([]string, 0, len(counts))
+	for topic, n := range counts {
+		count += n
+		topics = append(topics, topic+"="+strconv.Itoa(n))
+	}
+	sort.Strings(topics)
+	return &Msg{
+		Type:     Event,
+		URI:      TxTopic,
+		Ts:       TS(),
+		Priority: PriorityHigh,
+		Meta: map[string]string{
+			metaTx:       id,
+			metaTxCount:  strconv.Itoa(count),
+			metaTxTopics: strings.Join(topics, ","),
+		},
+	}
+}
+
+// TxID returns id of the transaction message is part of,
+// empty for messages outside of transaction.
+func (m *Msg) TxID() string {
+	return m.Meta[metaTx]
+}
+
+// IsTxCommit returns true for transaction commit marker.
+func (m *Msg) IsTxCommit() bool {
+	return m.Type == Event && m.URI == TxTopic && m.TxID() != ""
+}
+
+// TxCount returns number of messages in the transaction of the commit marker.
+func (m *Msg) TxCount() int {
+	n, _ := strconv.Atoi(m.Meta[metaTxCount])
+	return n
+}
+
+// TxCounts returns number of messages in the transaction of the commit
+// marker by topic, nil if marker has no topics.
+func (m *Msg) TxCounts() map[string]int {
+	v := m.Meta[metaTxTopics]
+	if v == "" {
+		return nil
+	}
+	counts := make(map[string]int)
+	for _, tc := range strings.Split(v, ",") {
+		i := strings.LastIndex(tc, "=")
+		if i < 0 {
+			continue
+		}
+		n, _ := strconv.Atoi(tc[i+1:])
+		counts[tc[:i]] += n
+	}
+	return counts
+}
@@ -0,0 +1,65 @@
+package amp
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// ErrorCodeBadRequest is code of the permanent response error when
+// request body can't be unmarshaled.
+const ErrorCodeBadRequest = -134
+
+func init() {
+	RegisterError(ErrorDef{
+		Code:     ErrorCodeBadRequest,
+		Messages: map[string]string{"": "bad request"},
+	})
+}
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Typed creates message handler from the typed function fn with signature:
+//
+//	func(ctx context.Context, req *Req) (*Rsp, error)
+//
+// Request body is unmarshaled into new Req, and returned Rsp is marshaled
+// into response body. Invalid body is rejected with permanent
+// ErrorCodeBadRequest error. Handler ctx is passed to fn, request message is
+// available in it (see FromContext).
+// Panics if fn has wrong signature.
+//
+// Example:
+//
+//	func add(ctx context.Context, p *params) (*rsp, error) {
+//		return &rsp{Z: p.X + p.Y}, nil
+//	}
+//	handler := amp.Typed(add)
+func Typed(fn interface{}) Handler {
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+	if t.Kind() != reflect.Func ||
+		t.NumIn() != 2 || t.In(0) != contextType || t.In(1).Kind() != reflect.Ptr ||
+		t.NumOut() != 2 || t.Out(1) != errorType {
+		panic(fmt.Sprintf("amp.Typed: expected func(context.Context, *Req) (Rsp, error), got %s", t))
+	}
+	reqType := t.In(1).Elem()
+
+	return func(ctx context.Context, m *Msg) (*Msg, error) {
+		ctx = context.WithValue(ctx, ctxKey{}, m)
+		req := reflect.New(reqType)
+		if len(m.body) > 0 {
+			if err := m.Unmarshal(req.Interface()); err != nil {
+				return nil, Permanent(Errf(ErrorCodeBadRequest, "invalid request body: %s", err))
+			}
+		}
+		out := v.Call([]reflect.Value{reflect.ValueOf(ctx), req})
+		if err, _ := out[1].Interface().(error); err != nil {
+			return nil, err
+		}
+		return m.Response(JSONMarshaler(out[0].Interface())), nil
+	}
+}
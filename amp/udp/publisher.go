@@ -0,0 +1,132 @@
+package udp
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+	"github.com/pkg/errors"
+)
+
+// Publisher multicasts messages to the group.
+type Publisher struct {
+	conn     *net.UDPConn // multicast
+	recovery *net.UDPConn // unicast retransmission requests
+	seq      uint64
+	history  [][]byte // sent datagrams, by seq % len
+	drop     func(seq uint64) bool
+	sync.Mutex
+}
+
+// NewPublisher creates publisher to the multicast group (ip:port) which
+// listens for retransmission requests on the recovery address.
+// Publisher is closed when ctx is done.
+func NewPublisher(ctx context.Context, group, recovery string, opts ...func(*options)) (*Publisher, error) {
+	o := defaultOptions().apply(opts...)
+	ga, err := resolve(group)
+	if err != nil {
+		return nil, err
+	}
+	ra, err := resolve(recovery)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, ga)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	rc, err := net.ListenUDP("udp", ra)
+	if err != nil {
+		_ = conn.Close()
+		return nil, errors.WithStack(err)
+	}
+	p := &Publisher{
+		conn:     conn,
+		recovery: rc,
+		history:  make([][]byte, o.history),
+	}
+	go p.serveRecovery()
+	go func() {
+		<-ctx.Done()
+		_ = p.conn.Close()
+		_ = p.recovery.Close()
+	}()
+	return p, nil
+}
+
+// Publish multicasts message.
+func (p *Publisher) Publish(m *amp.Msg) error {
+	p.Lock()
+	defer p.Unlock()
+	buf, err := pack(p.seq+1, m)
+	if err != nil {
+		metric.Counter("udp.tooLarge")
+		return err
+	}
+	p.seq++
+	p.history[p.seq%uint64(len(p.history))] = buf
+	if p.drop != nil && p.drop(p.seq) {
+		return nil
+	}
+	_, err = p.conn.Write(buf)
+	return errors.WithStack(err)
+}
+
+// Pipe multicasts Diff messages from in and passes all messages to the
+// returned chan.
+func (p *Publisher) Pipe(in <-chan *amp.Msg) <-chan *amp.Msg {
+	out := make(chan *amp.Msg)
+	go func() {
+		defer close(out)
+		for m := range in {
+			if m.Type == amp.Publish && m.UpdateType == amp.Diff {
+				if err := p.Publish(m); err != nil {
+					log.S("uri", m.URI).Error(err)
+				}
+			}
+			out <- m
+		}
+	}()
+	return out
+}
+
+// serveRecovery replies to retransmission requests
+func (p *Publisher) serveRecovery() {
+	buf := make([]byte, requestLen)
+	for {
+		n, addr, err := p.recovery.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n != requestLen {
+			continue
+		}
+		from, to := binary.BigEndian.Uint64(buf), binary.BigEndian.Uint64(buf[8:])
+		for _, d := range p.retransmit(from, to) {
+			_, _ = p.recovery.WriteToUDP(d, addr)
+		}
+		metric.Counter("udp.retransmit")
+	}
+}
+
+// retransmit returns datagrams in range [from, to] still in history
+func (p *Publisher) retransmit(from, to uint64) [][]byte {
+	p.Lock()
+	defer p.Unlock()
+	size := uint64(len(p.history))
+	if to > p.seq {
+		to = p.seq
+	}
+	if p.seq >= size && from <= p.seq-size {
+		from = p.seq - size + 1
+	}
+	var ds [][]byte
+	for seq := from; seq <= to && seq > 0; seq++ {
+		ds = append(ds, p.history[seq%size])
+	}
+	return ds
+}
@@ -0,0 +1,185 @@
+package udp
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+	"github.com/pkg/errors"
+)
+
+type datagram struct {
+	seq uint64
+	msg *amp.Msg
+}
+
+type subscriber struct {
+	conn       *net.UDPConn // multicast
+	recovery   *net.UDPConn // unicast, connected to the publisher recovery address
+	gapTimeout time.Duration
+	next       uint64              // expected seq, 0 before first message
+	pending    map[uint64]*amp.Msg // received after the gap
+	gapSince   time.Time           // zero if there is no gap
+	out        chan *amp.Msg
+}
+
+// Subscribe joins multicast group (ip:port) and requests retransmission
+// of the missing messages from the publisher recovery address.
+// Returns channel of messages in the publish order, closed when ctx is done.
+func Subscribe(ctx context.Context, group, recovery string, opts ...func(*options)) (<-chan *amp.Msg, error) {
+	o := defaultOptions().apply(opts...)
+	ga, err := resolve(group)
+	if err != nil {
+		return nil, err
+	}
+	ra, err := resolve(recovery)
+	if err != nil {
+		return nil, err
+	}
+	var conn *net.UDPConn
+	if ga.IP.IsMulticast() {
+		conn, err = net.ListenMulticastUDP("udp", nil, ga)
+	} else {
+		conn, err = net.ListenUDP("udp", ga)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	rc, err := net.DialUDP("udp", nil, ra)
+	if err != nil {
+		_ = conn.Close()
+		return nil, errors.WithStack(err)
+	}
+	s := &subscriber{
+		conn:       conn,
+		recovery:   rc,
+		gapTimeout: o.gapTimeout,
+		pending:    make(map[uint64]*amp.Msg),
+		out:        make(chan *amp.Msg, 16),
+	}
+	in := make(chan datagram, 1024)
+	go read(conn, in)
+	go read(rc, in)
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+		_ = rc.Close()
+	}()
+	go s.loop(ctx, in)
+	return s.out, nil
+}
+
+func read(conn *net.UDPConn, in chan<- datagram) {
+	buf := make([]byte, maxDatagramLen)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		// parsed message keeps slices of the datagram, buf is reused
+		d := make([]byte, n)
+		copy(d, buf[:n])
+		if seq, m := unpack(d); m != nil {
+			in <- datagram{seq: seq, msg: m}
+		}
+	}
+}
+
+func (s *subscriber) loop(ctx context.Context, in <-chan datagram) {
+	defer close(s.out)
+	tick := time.NewTicker(s.gapTimeout / 2)
+	defer tick.Stop()
+	for {
+		select {
+		case d := <-in:
+			s.receive(d.seq, d.msg)
+		case <-tick.C:
+			s.checkGap()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *subscriber) receive(seq uint64, m *amp.Msg) {
+	if s.next == 0 {
+		s.next = seq
+	}
+	switch {
+	case seq < s.next:
+		// duplicate or late retransmission
+		m.Release()
+	case seq == s.next:
+		s.out <- m
+		s.next++
+		s.flush()
+	default:
+		s.pending[seq] = m
+		if s.gapSince.IsZero() {
+			s.gapSince = time.Now()
+			s.request(s.next, seq-1)
+		}
+	}
+}
+
+// flush delivers pending messages after the gap is filled
+func (s *subscriber) flush() {
+	for {
+		m, ok := s.pending[s.next]
+		if !ok {
+			break
+		}
+		delete(s.pending, s.next)
+		s.out <- m
+		s.next++
+	}
+	if len(s.pending) == 0 {
+		s.gapSince = time.Time{}
+	}
+}
+
+// checkGap skips missing messages not recovered within gapTimeout,
+// or repeats retransmission request
+func (s *subscriber) checkGap() {
+	if s.gapSince.IsZero() {
+		return
+	}
+	first := s.firstPending()
+	if time.Since(s.gapSince) < s.gapTimeout {
+		s.request(s.next, first-1)
+		return
+	}
+	log.I("from", int(s.next)).I("to", int(first-1)).Info("udp gap skipped")
+	metric.Counter("udp.gap", int(first-s.next))
+	s.next = first
+	s.gapSince = time.Time{}
+	s.flush()
+	if len(s.pending) > 0 {
+		s.gapSince = time.Now()
+		s.request(s.next, s.firstPending()-1)
+	}
+}
+
+func (s *subscriber) firstPending() uint64 {
+	var first uint64
+	for seq := range s.pending {
+		if first == 0 || seq < first {
+			first = seq
+		}
+	}
+	return first
+}
+
+// request sends retransmission request for the range [from, to]
+func (s *subscriber) request(from, to uint64) {
+	buf := make([]byte, requestLen)
+	binary.BigEndian.PutUint64(buf, from)
+	binary.BigEndian.PutUint64(buf[8:], to)
+	if _, err := s.recovery.Write(buf); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,95 @@
+// Package udp is experimental multicast fan-out of amp messages.
+//
+// Publisher multicasts messages (Diffs by Pipe) on the LAN, each datagram
+// has sequence number:
+//
+//	<8 bytes big endian seq><amp.Msg.Marshal>
+//
+// Subscribers deliver messages in sequence order. On gap subscriber asks
+// publisher for retransmission on unicast recovery address with 16 bytes
+// request <from seq><to seq>, publisher replies with datagrams from its
+// history. Gaps not recovered within GapTimeout are skipped.
+//
+// Intended for same rack fan-out where few milliseconds matter, Fulls and
+// other messages should still go through nsq.
+package udp
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/pkg/errors"
+)
+
+const (
+	headerLen      = 8
+	requestLen     = 16
+	maxDatagramLen = 65507
+)
+
+// ErrTooLarge is returned for messages which don't fit into datagram.
+var ErrTooLarge = errors.New("message too large for datagram")
+
+type options struct {
+	history    int
+	gapTimeout time.Duration
+}
+
+func (o *options) apply(opts ...func(*options)) *options {
+	for _, fn := range opts {
+		fn(o)
+	}
+	return o
+}
+
+// History sets number of the last datagrams publisher keeps for retransmission.
+// Values below 1 are ignored.
+func History(n int) func(*options) {
+	return func(o *options) {
+		if n > 0 {
+			o.history = n
+		}
+	}
+}
+
+// GapTimeout sets how long subscriber waits for retransmission of the
+// missing messages before skipping them. Values below 2ns are ignored.
+func GapTimeout(d time.Duration) func(*options) {
+	return func(o *options) {
+		if d > 1 {
+			o.gapTimeout = d
+		}
+	}
+}
+
+func defaultOptions() *options {
+	return &options{
+		history:    1024,
+		gapTimeout: 100 * time.Millisecond,
+	}
+}
+
+func pack(seq uint64, m *amp.Msg) ([]byte, error) {
+	payload := m.Marshal()
+	if len(payload)+headerLen > maxDatagramLen {
+		return nil, errors.Wrapf(ErrTooLarge, "%d bytes", len(payload))
+	}
+	buf := make([]byte, headerLen+len(payload))
+	binary.BigEndian.PutUint64(buf, seq)
+	copy(buf[headerLen:], payload)
+	return buf, nil
+}
+
+func unpack(buf []byte) (uint64, *amp.Msg) {
+	if len(buf) <= headerLen {
+		return 0, nil
+	}
+	return binary.BigEndian.Uint64(buf), amp.Parse(buf[headerLen:])
+}
+
+func resolve(addr string) (*net.UDPAddr, error) {
+	a, err := net.ResolveUDPAddr("udp", addr)
+	return a, errors.WithStack(err)
+}
@@ -0,0 +1,90 @@
+package udp
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func receive(t *testing.T, msgs <-chan *amp.Msg) *amp.Msg {
+	select {
+	case m := <-msgs:
+		return m
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	return nil
+}
+
+func TestRecovery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	group, recovery := "127.0.0.1:19851", "127.0.0.1:19852"
+	msgs, err := Subscribe(ctx, group, recovery, GapTimeout(time.Second))
+	assert.Nil(t, err)
+	p, err := NewPublisher(ctx, group, recovery, History(4))
+	assert.Nil(t, err)
+	p.drop = func(seq uint64) bool { return seq == 2 || seq == 3 }
+
+	for ts := int64(1); ts <= 4; ts++ {
+		assert.Nil(t, p.Publish(amp.NewPublish("math.v1", "", ts, amp.Diff, nil)))
+	}
+	// 2 and 3 are retransmitted
+	for ts := int64(1); ts <= 4; ts++ {
+		assert.Equal(t, ts, receive(t, msgs).Ts)
+	}
+}
+
+func TestGapSkipped(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	group, recovery := "127.0.0.1:19853", "127.0.0.1:19854"
+	msgs, err := Subscribe(ctx, group, recovery, GapTimeout(20*time.Millisecond))
+	assert.Nil(t, err)
+	p, err := NewPublisher(ctx, group, recovery, History(1))
+	assert.Nil(t, err)
+	p.drop = func(seq uint64) bool { return seq == 2 || seq == 3 }
+
+	for ts := int64(1); ts <= 4; ts++ {
+		assert.Nil(t, p.Publish(amp.NewPublish("math.v1", "", ts, amp.Diff, nil)))
+	}
+	// only 4 is in history
+	assert.Equal(t, int64(1), receive(t, msgs).Ts)
+	assert.Equal(t, int64(4), receive(t, msgs).Ts)
+}
+
+func TestDatagramsNotShared(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	group, recovery := "127.0.0.1:19855", "127.0.0.1:19856"
+	msgs, err := Subscribe(ctx, group, recovery, GapTimeout(0))
+	assert.Nil(t, err)
+	p, err := NewPublisher(ctx, group, recovery, History(0))
+	assert.Nil(t, err)
+
+	for ts := int64(1); ts <= 4; ts++ {
+		assert.Nil(t, p.Publish(amp.NewPublish("math.v1", "", ts, amp.Diff, map[string]int64{"ts": ts})))
+	}
+	// messages waiting in the channel keep their own bodies
+	time.Sleep(50 * time.Millisecond)
+	for ts := int64(1); ts <= 4; ts++ {
+		m := receive(t, msgs)
+		assert.Equal(t, ts, m.Ts)
+		assert.Equal(t, fmt.Sprintf(`{"ts":%d}`, ts), string(m.BodyBytes()))
+	}
+}
+
+func TestRetransmit(t *testing.T) {
+	p := &Publisher{history: make([][]byte, 3)}
+	for i := 0; i < 5; i++ {
+		p.seq++
+		p.history[p.seq%3] = []byte{byte(p.seq)}
+	}
+	assert.Equal(t, [][]byte{{3}, {4}, {5}}, p.retransmit(1, 10))
+	assert.Equal(t, [][]byte{{4}}, p.retransmit(4, 4))
+	assert.Len(t, p.retransmit(6, 10), 0)
+}
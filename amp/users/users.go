@@ -0,0 +1,333 @@
+// Package users addresses messages to the logical user instead of the
+// connection. Service publishes message to the user topic:
+//
+//	pub.Publish(users.NewPublish("u1", "notify", amp.TS(), amp.Append, body)) // uri: user/u1/notify
+//
+// Each gateway keeps directory of the users connected to it (sessions
+// register by identity from the session meta, see session.Users) and
+// delivers user message to all connections of the user, without
+// subscription:
+//
+//	d := users.New(presence.Self(presence.Gateway, version).ID(), pub.Publish)
+//	d.Announce(ctx, 30*time.Second)
+//	sessions := session.Factory(ctx, brk, req, session.Users("user", d))
+//	go d.Consume(ctx, nsq.Subscribe(ctx, []string{users.Topic, users.PresenceTopic}))
+//
+// Gateways announce connected users on the PresenceTopic, so every
+// instance (and any service consuming the topic) knows on which gateways
+// the user is connected. Changes are announced by user (uri
+// user.presence/<user>), periodic announce is one message of the instance
+// with all its users (uri user.presence).
+package users
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+)
+
+// Topics of the user messages and users presence.
+const (
+	Topic         = "user"
+	PresenceTopic = "user.presence"
+)
+
+// Presence is body of the presence message, connections of the user
+// (path of the message uri) on the gateway instance.
+type Presence struct {
+	Instance    string `json:"instance"`
+	Connections int    `json:"connections"`
+}
+
+// Announcement is body of the periodic presence message without path,
+// connections of all users on the gateway instance.
+type Announcement struct {
+	Instance string         `json:"instance"`
+	Users    map[string]int `json:"users"`
+}
+
+// NewPublish creates message for all connections of the user,
+// uri is user/<id>/<path>.
+func NewPublish(user, path string, ts int64, updateType uint8, o interface{}) *amp.Msg {
+	if path != "" {
+		user += "/" + path
+	}
+	return amp.NewPublish(Topic, user, ts, updateType, o)
+}
+
+// UserOf returns user identity from the user topic uri, empty for other uris.
+func UserOf(uri string) string {
+	if !strings.HasPrefix(uri, Topic+"/") {
+		return ""
+	}
+	return strings.SplitN(uri[len(Topic)+1:], "/", 2)[0]
+}
+
+type remote struct {
+	connections int
+	seen        time.Time
+}
+
+// Directory maps user identities to the connections on this gateway and
+// to the gateway instances in the cluster.
+type Directory struct {
+	instance string
+	publish  func(*amp.Msg)
+	local    map[string]map[amp.Subscriber]struct{} // connections by user
+	remote   map[string]map[string]remote           // user connections by instance, by user
+	ttl      time.Duration                          // of the remote presence, set by Announce
+	sync.RWMutex
+}
+
+// New creates directory of the gateway instance. Presence messages are
+// published with publish, nil publish disables announcing.
+func New(instance string, publish func(*amp.Msg)) *Directory {
+	return &Directory{
+		instance: instance,
+		publish:  publish,
+		local:    make(map[string]map[amp.Subscriber]struct{}),
+		remote:   make(map[string]map[string]remote),
+	}
+}
+
+// Connected registers connection of the user.
+func (d *Directory) Connected(user string, c amp.Subscriber) {
+	d.Lock()
+	cs, ok := d.local[user]
+	if !ok {
+		cs = make(map[amp.Subscriber]struct{})
+		d.local[user] = cs
+	}
+	cs[c] = struct{}{}
+	n := len(cs)
+	d.Unlock()
+	d.announce(user, n)
+}
+
+// Disconnected unregisters connection of the user.
+func (d *Directory) Disconnected(user string, c amp.Subscriber) {
+	d.Lock()
+	cs, ok := d.local[user]
+	if !ok {
+		d.Unlock()
+		return
+	}
+	if _, ok := cs[c]; !ok {
+		d.Unlock()
+		return
+	}
+	delete(cs, c)
+	n := len(cs)
+	if n == 0 {
+		delete(d.local, user)
+	}
+	d.Unlock()
+	d.announce(user, n)
+}
+
+func (d *Directory) announce(user string, connections int) {
+	if d.publish == nil {
+		return
+	}
+	d.publish(amp.NewPublish(PresenceTopic, user, amp.TS(), amp.Update, Presence{
+		Instance:    d.instance,
+		Connections: connections,
+	}))
+}
+
+// Announce republishes presence of all connected users every interval in
+// one message, until ctx is done. Presence of other instances not
+// refreshed within three intervals is removed.
+func (d *Directory) Announce(ctx context.Context, interval time.Duration) {
+	d.Lock()
+	d.ttl = 3 * interval
+	d.Unlock()
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+			d.announceAll()
+			d.expire()
+		}
+	}()
+}
+
+// announceAll publishes connections of all local users
+func (d *Directory) announceAll() {
+	if d.publish == nil {
+		return
+	}
+	d.RLock()
+	counts := make(map[string]int, len(d.local))
+	for user, cs := range d.local {
+		counts[user] = len(cs)
+	}
+	d.RUnlock()
+	d.publish(amp.NewPublish(PresenceTopic, "", amp.TS(), amp.Update, Announcement{
+		Instance: d.instance,
+		Users:    counts,
+	}))
+}
+
+// expire removes remote presence not refreshed within ttl
+func (d *Directory) expire() {
+	d.Lock()
+	defer d.Unlock()
+	for user, is := range d.remote {
+		for i, r := range is {
+			if time.Since(r.seen) > d.ttl {
+				delete(is, i)
+			}
+		}
+		if len(is) == 0 {
+			delete(d.remote, user)
+		}
+	}
+}
+
+// Publish delivers user message to all local connections of the user,
+// returns number of connections.
+func (d *Directory) Publish(m *amp.Msg) int {
+	user := UserOf(m.URI)
+	if user == "" {
+		return 0
+	}
+	d.RLock()
+	cs := make([]amp.Subscriber, 0, len(d.local[user]))
+	for c := range d.local[user] {
+		cs = append(cs, c)
+	}
+	d.RUnlock()
+	for _, c := range cs {
+		c.Send(m)
+	}
+	if len(cs) > 0 {
+		metric.Counter("users.delivered", len(cs))
+	}
+	return len(cs)
+}
+
+// Presence adds presence message of the other gateway instance.
+func (d *Directory) Presence(m *amp.Msg) {
+	if m.Topic() != PresenceTopic {
+		return
+	}
+	if m.Path() == "" {
+		d.announcement(m)
+		return
+	}
+	var p Presence
+	if err := json.Unmarshal(m.BodyBytes(), &p); err != nil {
+		log.S("uri", m.URI).Error(err)
+		return
+	}
+	if p.Instance == d.instance {
+		return
+	}
+	user := m.Path()
+	d.Lock()
+	defer d.Unlock()
+	is, ok := d.remote[user]
+	if !ok {
+		is = make(map[string]remote)
+		d.remote[user] = is
+	}
+	if p.Connections <= 0 {
+		delete(is, p.Instance)
+		if len(is) == 0 {
+			delete(d.remote, user)
+		}
+		return
+	}
+	is[p.Instance] = remote{connections: p.Connections, seen: time.Now()}
+}
+
+// announcement replaces presence of the other gateway instance with all
+// users from the announcement
+func (d *Directory) announcement(m *amp.Msg) {
+	var a Announcement
+	if err := json.Unmarshal(m.BodyBytes(), &a); err != nil {
+		log.S("uri", m.URI).Error(err)
+		return
+	}
+	if a.Instance == d.instance || a.Instance == "" {
+		return
+	}
+	now := time.Now()
+	d.Lock()
+	defer d.Unlock()
+	for user, is := range d.remote {
+		if _, ok := a.Users[user]; ok {
+			continue
+		}
+		delete(is, a.Instance)
+		if len(is) == 0 {
+			delete(d.remote, user)
+		}
+	}
+	for user, n := range a.Users {
+		if n <= 0 {
+			continue
+		}
+		is, ok := d.remote[user]
+		if !ok {
+			is = make(map[string]remote)
+			d.remote[user] = is
+		}
+		is[a.Instance] = remote{connections: n, seen: now}
+	}
+}
+
+// Consume delivers user messages and adds presence messages from in,
+// until in is closed or ctx is done.
+func (d *Directory) Consume(ctx context.Context, in <-chan *amp.Msg) {
+	for {
+		select {
+		case m, ok := <-in:
+			if !ok {
+				return
+			}
+			if m.Topic() == PresenceTopic {
+				d.Presence(m)
+				continue
+			}
+			d.Publish(m)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Connections returns number of the user connections by gateway instance,
+// in the whole cluster.
+func (d *Directory) Connections(user string) map[string]int {
+	d.RLock()
+	defer d.RUnlock()
+	cs := make(map[string]int)
+	if n := len(d.local[user]); n > 0 {
+		cs[d.instance] = n
+	}
+	for i, r := range d.remote[user] {
+		if d.ttl > 0 && time.Since(r.seen) > d.ttl {
+			continue
+		}
+		cs[i] = r.connections
+	}
+	return cs
+}
+
+// Online returns true if user is connected to any gateway instance.
+func (d *Directory) Online(user string) bool {
+	return len(d.Connections(user)) > 0
+}
@@ -0,0 +1,122 @@
+package users
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+type testConn struct {
+	msgs []*amp.Msg
+	sync.Mutex
+}
+
+func (c *testConn) Send(m *amp.Msg) {
+	c.Lock()
+	defer c.Unlock()
+	c.msgs = append(c.msgs, m)
+}
+
+func (c *testConn) count() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.msgs)
+}
+
+func TestUserOf(t *testing.T) {
+	m := NewPublish("u1", "notify", 1, amp.Append, nil)
+	assert.Equal(t, "user/u1/notify", m.URI)
+	assert.Equal(t, "u1", UserOf(m.URI))
+	assert.Equal(t, "u1", UserOf("user/u1"))
+	assert.Equal(t, "", UserOf("users/u1"))
+	assert.Equal(t, "", UserOf("user"))
+}
+
+func TestDirectory(t *testing.T) {
+	var announced []*amp.Msg
+	d := New("gw1", func(m *amp.Msg) { announced = append(announced, amp.Parse(m.Marshal())) })
+	c1, c2, c3 := &testConn{}, &testConn{}, &testConn{}
+	d.Connected("u1", c1)
+	d.Connected("u1", c2)
+	d.Connected("u2", c3)
+
+	// fan-out to all connections of the user
+	assert.Equal(t, 2, d.Publish(NewPublish("u1", "notify", 1, amp.Append, nil)))
+	assert.Equal(t, 0, d.Publish(NewPublish("u3", "", 2, amp.Append, nil)))
+	assert.Equal(t, 0, d.Publish(amp.NewPublish("notify", "u1", 3, amp.Append, nil)))
+	assert.Equal(t, 1, c1.count())
+	assert.Equal(t, 1, c2.count())
+	assert.Equal(t, 0, c3.count())
+
+	d.Disconnected("u1", c1)
+	d.Disconnected("u1", c1) // once
+	assert.Len(t, announced, 4)
+	var p Presence
+	assert.Nil(t, announced[3].Unmarshal(&p))
+	assert.Equal(t, Presence{Instance: "gw1", Connections: 1}, p)
+	assert.Equal(t, "user.presence/u1", announced[3].URI)
+
+	// presence of other gateway instance
+	other := New("gw2", nil)
+	for _, m := range announced {
+		other.Presence(m)
+	}
+	assert.Equal(t, map[string]int{"gw1": 1}, other.Connections("u1"))
+	assert.True(t, other.Online("u2"))
+	d.Disconnected("u2", c3)
+	other.Presence(announced[len(announced)-1])
+	assert.False(t, other.Online("u2"))
+
+	// own presence is ignored
+	d.Presence(announced[0])
+	assert.Equal(t, map[string]int{"gw1": 1}, d.Connections("u1"))
+}
+
+func TestConsume(t *testing.T) {
+	d := New("gw1", nil)
+	c := &testConn{}
+	d.Connected("u1", c)
+	in := make(chan *amp.Msg, 2)
+	in <- NewPublish("u1", "notify", 1, amp.Append, nil)
+	in <- amp.NewPublish(PresenceTopic, "u1", 2, amp.Update, Presence{Instance: "gw2", Connections: 3})
+	close(in)
+	d.Consume(context.Background(), in)
+	assert.Equal(t, 1, c.count())
+	assert.Equal(t, map[string]int{"gw1": 1, "gw2": 3}, d.Connections("u1"))
+
+	// stale presence is expired
+	d.ttl = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	d.expire()
+	assert.Equal(t, map[string]int{"gw1": 1}, d.Connections("u1"))
+}
+
+func TestAnnounceAll(t *testing.T) {
+	var announced []*amp.Msg
+	d := New("gw1", func(m *amp.Msg) { announced = append(announced, amp.Parse(m.Marshal())) })
+	c1, c2, c3 := &testConn{}, &testConn{}, &testConn{}
+	d.Connected("u1", c1)
+	d.Connected("u1", c2)
+	d.Connected("u2", c3)
+	announced = nil
+
+	// one message with all users of the instance
+	d.announceAll()
+	assert.Len(t, announced, 1)
+	assert.Equal(t, PresenceTopic, announced[0].URI)
+	other := New("gw2", nil)
+	other.Presence(announced[0])
+	assert.Equal(t, map[string]int{"gw1": 2}, other.Connections("u1"))
+	assert.Equal(t, map[string]int{"gw1": 1}, other.Connections("u2"))
+
+	// users missing from the announcement are removed
+	d.Disconnected("u2", c3)
+	d.announceAll()
+	other.Presence(announced[len(announced)-1])
+	assert.True(t, other.Online("u1"))
+	assert.False(t, other.Online("u2"))
+}
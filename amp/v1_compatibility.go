@@ -73,13 +73,13 @@ func ParseV1Subscriptions(buf []byte) *Msg {
 
 // Marshal packs message for sending on the wire
 func (m *Msg) MarshalV1() []byte {
-	buf, _ := m.marshal(CompressionNone, CompatibilityVersion1)
+	buf, _ := m.marshal(CompressionNone, CompatibilityVersion1, nil)
 	return buf
 }
 
 // MarshalDeflate packs and compress message
 func (m *Msg) MarshalV1Deflate() ([]byte, bool) {
-	return m.marshal(CompressionDeflate, CompatibilityVersion1)
+	return m.marshal(CompressionDeflate, CompatibilityVersion1, nil)
 }
 
 func (m *Msg) marshalV1header() []byte {
@@ -101,15 +101,10 @@ func (m *Msg) marshalV1header() []byte {
 }
 
 func (m *Msg) MarshalCompatiblity(version uint8) []byte {
-	if version == CompatibilityVersion1 {
-		return m.MarshalV1()
-	}
-	return m.Marshal()
+	buf, _ := m.marshal(CompressionNone, version, nil)
+	return buf
 }
 
 func (m *Msg) MarshalDeflateCompatiblity(version uint8) ([]byte, bool) {
-	if version == CompatibilityVersion1 {
-		return m.MarshalV1Deflate()
-	}
-	return m.MarshalDeflate()
+	return m.marshal(CompressionDeflate, version, nil)
 }
@@ -0,0 +1,115 @@
+package amp
+
+import (
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Protocol versions.
+// Client announces version in the connection handshake (ws query string
+// parameter VersionKey) or in the Version field of its first message
+// (tcp). Clients which don't announce version are ProtocolVersionNone,
+// they get messages in the legacy encoding, unchanged from before versions.
+const (
+	ProtocolVersionNone uint8 = iota // not announced, legacy encoding
+	ProtocolVersion1                 // legacy header keys, no meta, no binary bodies
+	ProtocolVersion2                 // current
+
+	ProtocolVersionMin = ProtocolVersion1
+	ProtocolVersion    = ProtocolVersion2 // current version
+)
+
+// VersionKey is the connection metadata key with the client protocol version.
+const VersionKey = "v"
+
+// ErrUnsupportedVersion is returned by NegotiateVersion for versions out of
+// the supported range.
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+// NegotiateVersion returns protocol version for the connection metadata
+// (see VersionKey), ProtocolVersionNone if the client didn't announce it.
+func NegotiateVersion(meta map[string]string) (uint8, error) {
+	v, ok := meta[VersionKey]
+	if !ok {
+		return ProtocolVersionNone, nil
+	}
+	n, err := strconv.ParseUint(v, 10, 8)
+	if err != nil {
+		return 0, errors.Wrapf(ErrUnsupportedVersion, "%q", v)
+	}
+	return CheckVersion(uint8(n))
+}
+
+// CheckVersion returns error if version v is not supported.
+func CheckVersion(v uint8) (uint8, error) {
+	if v < ProtocolVersionMin || v > ProtocolVersion {
+		return 0, errors.Wrapf(ErrUnsupportedVersion, "%d, supported %d-%d",
+			v, ProtocolVersionMin, ProtocolVersion)
+	}
+	return v, nil
+}
+
+// Compatibility returns version for the marshal functions
+// (MarshalCompatiblity...) for the client with protocol version v.
+func Compatibility(v uint8) uint8 {
+	switch {
+	case v == ProtocolVersionNone:
+		return CompatibilityVersionLegacy
+	case v < ProtocolVersion2:
+		return CompatibilityVersionProtocol1
+	}
+	return CompatibilityVersionDefault
+}
+
+// legacyHeader is message header with the keys known to the clients
+// without protocol version, in the same order.
+type legacyHeader struct {
+	Type          uint8             `json:"t,omitempty"`
+	ReplyTo       string            `json:"r,omitempty"`
+	CorrelationID uint64            `json:"i,omitempty"`
+	Error         *legacyError      `json:"e,omitempty"`
+	URI           string            `json:"u,omitempty"`
+	Ts            int64             `json:"s,omitempty"`
+	UpdateType    uint8             `json:"p,omitempty"`
+	Replay        uint8             `json:"l,omitempty"`
+	Subscriptions map[string]int64  `json:"b,omitempty"`
+	CacheDepth    int               `json:"d,omitempty"`
+	Meta          map[string]string `json:"m,omitempty"`
+}
+
+type legacyError struct {
+	Source  uint8  `json:"s,omitempty"`
+	Message string `json:"m,omitempty"`
+	Code    int    `json:"c,omitempty"`
+}
+
+// legacyHeaderOf returns legacy header of the message, meta is set for
+// the clients without protocol version
+func legacyHeaderOf(m *Msg, meta bool) legacyHeader {
+	h := legacyHeader{
+		Type:          m.Type,
+		ReplyTo:       m.ReplyTo,
+		CorrelationID: m.CorrelationID,
+		URI:           m.URI,
+		Ts:            m.Ts,
+		UpdateType:    m.UpdateType,
+		Replay:        m.Replay,
+		Subscriptions: m.Subscriptions,
+		CacheDepth:    m.CacheDepth,
+	}
+	if m.Error != nil {
+		h.Error = &legacyError{Source: m.Error.Source, Message: m.Error.Message, Code: m.Error.Code}
+	}
+	if meta {
+		h.Meta = m.Meta
+	}
+	return h
+}
+
+// isLegacy returns false for the message types added after Event (status,
+// handshake, ack) and chunks, unknown to the clients without protocol
+// version or ProtocolVersion1
+func (m *Msg) isLegacy() bool {
+	return m.Type <= Event && m.UpdateType <= BurstEnd
+}
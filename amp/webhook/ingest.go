@@ -0,0 +1,184 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/httpi"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+	"github.com/pkg/errors"
+)
+
+// IdempotencyHeader is request header with client generated key.
+// Requests with the same key from the source are published only once.
+const IdempotencyHeader = "Idempotency-Key"
+
+// Source is external system allowed to publish into the topic.
+type Source struct {
+	ID         string
+	Secret     string // requests are signed with secret (see SignRequest)
+	Topic      string
+	UpdateType uint8                            // update type of the published messages
+	Validate   func(body json.RawMessage) error // optional body validation
+}
+
+// Ingest is http endpoint where external systems POST json which is
+// published to the topic of the source:
+//
+//	POST /{source}[/{path}]
+//	X-Amp-Signature: t=...,v1=...
+//	Idempotency-Key: optional unique request key
+//
+// Signature (see SignRequest) covers method, url path, idempotency key and
+// body.
+// Published messages get Ts and UpdateType of the source.
+type Ingest struct {
+	publish        func(*amp.Msg)
+	sources        map[string]Source
+	seen           map[string]time.Time // idempotency keys by source/key
+	idempotencyTTL time.Duration
+	maxBody        int64
+	maxAge         time.Duration
+	lastSweep      time.Time
+	sync.Mutex
+}
+
+// IdempotencyTTL sets how long idempotency keys are remembered, default 24h.
+func IdempotencyTTL(d time.Duration) func(*Ingest) {
+	return func(i *Ingest) {
+		i.idempotencyTTL = d
+	}
+}
+
+// MaxBody sets max request body size in bytes, default 1MB.
+func MaxBody(n int64) func(*Ingest) {
+	return func(i *Ingest) {
+		i.maxBody = n
+	}
+}
+
+// MaxAge sets max age of the request signature, default 5 minutes.
+func MaxAge(d time.Duration) func(*Ingest) {
+	return func(i *Ingest) {
+		i.maxAge = d
+	}
+}
+
+// NewIngest creates ingestion endpoint which publishes received messages.
+func NewIngest(publish func(*amp.Msg), opts ...func(*Ingest)) *Ingest {
+	i := &Ingest{
+		publish:        publish,
+		sources:        make(map[string]Source),
+		seen:           make(map[string]time.Time),
+		idempotencyTTL: 24 * time.Hour,
+		maxBody:        1 << 20,
+		maxAge:         5 * time.Minute,
+	}
+	for _, o := range opts {
+		o(i)
+	}
+	return i
+}
+
+// Add registers source, source with the same id is replaced.
+// Source must have secret.
+func (i *Ingest) Add(s Source) error {
+	if s.Secret == "" {
+		return errors.Errorf("source %s without secret", s.ID)
+	}
+	i.Lock()
+	defer i.Unlock()
+	i.sources[s.ID] = s
+	return nil
+}
+
+// Remove unregisters source.
+func (i *Ingest) Remove(id string) {
+	i.Lock()
+	defer i.Unlock()
+	delete(i.sources, id)
+}
+
+// Route registers ingestion endpoint on the router.
+func (i *Ingest) Route(rt *httpi.Router) {
+	rt.RouteVars("/{source}", i.httpPost).Methods("POST")
+	rt.RouteVars("/{source}/{path:.*}", i.httpPost).Methods("POST")
+}
+
+func (i *Ingest) httpPost(w http.ResponseWriter, r *http.Request, vars map[string]string) {
+	i.Lock()
+	s, ok := i.sources[vars["source"]]
+	i.Unlock()
+	if !ok {
+		http.Error(w, "unknown source", http.StatusNotFound)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, i.maxBody+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if int64(len(body)) > i.maxBody {
+		http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	key := r.Header.Get(IdempotencyHeader)
+	sig := r.Header.Get("X-Amp-Signature")
+	if err := VerifyRequest(s.Secret, sig, r.Method, r.URL.Path, key, body, i.maxAge); err != nil {
+		metric.Counter("webhook.ingest." + s.ID + ".unauthorized")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !json.Valid(body) {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if s.Validate != nil {
+		if err := s.Validate(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if key != "" && !i.first(s.ID+"/"+key) {
+		metric.Counter("webhook.ingest." + s.ID + ".duplicate")
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	m := amp.NewPublish(s.Topic, vars["path"], amp.TS(), s.UpdateType, json.RawMessage(body))
+	i.publish(m)
+	metric.Counter("webhook.ingest." + s.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"uri": m.URI, "ts": m.Ts}); err != nil {
+		log.Error(err)
+	}
+}
+
+// first returns true if key is not seen within idempotency ttl
+func (i *Ingest) first(key string) bool {
+	i.Lock()
+	defer i.Unlock()
+	now := time.Now()
+	if now.Sub(i.lastSweep) > i.idempotencyTTL {
+		for k, t := range i.seen {
+			if now.Sub(t) > i.idempotencyTTL {
+				delete(i.seen, k)
+			}
+		}
+		i.lastSweep = now
+	}
+	if t, ok := i.seen[key]; ok && now.Sub(t) <= i.idempotencyTTL {
+		return false
+	}
+	i.seen[key] = now
+	return true
+}
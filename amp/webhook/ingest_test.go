@@ -0,0 +1,72 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/httpi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIngest(t *testing.T) {
+	var msgs []*amp.Msg
+	in := NewIngest(func(m *amp.Msg) { msgs = append(msgs, m) }, MaxBody(64))
+	assert.Error(t, in.Add(Source{ID: "open", Topic: "partner.events"}))
+	assert.NoError(t, in.Add(Source{ID: "partner", Secret: "secret", Topic: "partner.events", UpdateType: amp.Append,
+		Validate: func(body json.RawMessage) error {
+			if bytes.Contains(body, []byte("invalid")) {
+				return errors.New("invalid event")
+			}
+			return nil
+		}}))
+	rt := httpi.NewRouter()
+	in.Route(rt)
+	srv := httptest.NewServer(rt.Handler())
+	defer srv.Close()
+
+	post := func(path, body, secret, key string) int {
+		req, _ := http.NewRequest("POST", srv.URL+path, bytes.NewBufferString(body))
+		req.Header.Set("X-Amp-Signature", SignRequest(secret, time.Now(), "POST", path, key, []byte(body)))
+		if key != "" {
+			req.Header.Set(IdempotencyHeader, key)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusAccepted, post("/partner/1", `{"a":1}`, "secret", "k1"))
+	assert.Equal(t, http.StatusOK, post("/partner/1", `{"a":1}`, "secret", "k1")) // duplicate
+	assert.Equal(t, http.StatusAccepted, post("/partner", `{"a":2}`, "secret", ""))
+	assert.Equal(t, http.StatusUnauthorized, post("/partner", `{"a":3}`, "wrong", ""))
+	assert.Equal(t, http.StatusNotFound, post("/unknown", `{"a":4}`, "secret", ""))
+	assert.Equal(t, http.StatusBadRequest, post("/partner", `{"a":`, "secret", ""))
+	assert.Equal(t, http.StatusBadRequest, post("/partner", `{"a":"invalid"}`, "secret", ""))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post("/partner", `{"a":"`+string(make([]byte, 64))+`"}`, "secret", ""))
+
+	assert.Len(t, msgs, 2)
+	assert.Equal(t, "partner.events/1", msgs[0].URI)
+	assert.Equal(t, amp.Append, msgs[0].UpdateType)
+	assert.True(t, msgs[0].Ts > 0)
+	assert.Equal(t, `{"a":2}`, string(msgs[1].BodyBytes()))
+}
+
+func TestVerifyRequest(t *testing.T) {
+	body := []byte(`{"a":1}`)
+	h := SignRequest("secret", time.Now(), "POST", "/partner/1", "k1", body)
+	assert.Nil(t, VerifyRequest("secret", h, "POST", "/partner/1", "k1", body, time.Minute))
+	// replay to the other path or with the other key
+	assert.Equal(t, ErrSignature, VerifyRequest("secret", h, "POST", "/partner/2", "k1", body, time.Minute))
+	assert.Equal(t, ErrSignature, VerifyRequest("secret", h, "POST", "/partner/1", "k2", body, time.Minute))
+	assert.Equal(t, ErrSignature, VerifyRequest("secret", h, "POST", "/partner/1\nk1", "", body, time.Minute))
+	// timestamp in the future
+	h = SignRequest("secret", time.Now().Add(time.Hour), "POST", "/partner/1", "", body)
+	assert.Equal(t, ErrFuture, VerifyRequest("secret", h, "POST", "/partner/1", "", body, time.Minute))
+}
@@ -0,0 +1,387 @@
+// Package webhook pushes topic updates to the external HTTP endpoints,
+// for partners who can't consume NSQ or WebSocket.
+//
+// Each message is POSTed with json body and headers:
+//
+//	X-Amp-URI:       topic/path of the message
+//	X-Amp-Ts:        message timestamp
+//	X-Amp-Signature: t=<unix seconds>,v1=<hex hmac-sha256 of "t.body">
+//
+// Partners verify signature with the shared endpoint secret (see Verify).
+// Failed requests are retried with exponential backoff. Endpoint which
+// keeps failing is skipped (circuit is open) for the cooldown period.
+//
+//	d := webhook.New()
+//	d.Register(webhook.Endpoint{ID: "partner", URL: url, Secret: secret, Topics: []string{"odds"}})
+//	d.Consume(ctx, nsq.Subscribe(ctx, []string{"odds"}))
+//
+// Ingest is the opposite direction, external systems POST json signed with
+// SignRequest which is published into the topic:
+//
+//	in := webhook.NewIngest(pub.Publish)
+//	in.Add(webhook.Source{ID: "partner", Secret: secret, Topic: "partner.events"})
+//	in.Route(httpi.Subrouter("/ingest"))
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+	"github.com/minus5/svckit/signal"
+	"github.com/pkg/errors"
+)
+
+// Errors
+var (
+	ErrCircuitOpen = errors.New("circuit open")
+	ErrSignature   = errors.New("invalid signature")
+	ErrExpired     = errors.New("signature expired")
+	ErrFuture      = errors.New("signature from the future")
+)
+
+// maxClockSkew is tolerated difference of the signer clock
+const maxClockSkew = 30 * time.Second
+
+// Endpoint is registered external url.
+type Endpoint struct {
+	ID     string   `json:"id"`
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Topics []string `json:"topics"` // all topics if empty
+}
+
+func (e Endpoint) wants(topic string) bool {
+	if len(e.Topics) == 0 {
+		return true
+	}
+	for _, t := range e.Topics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+type options struct {
+	queueSize int
+	timeout   time.Duration
+	maxRetry  time.Duration
+	failures  int
+	cooldown  time.Duration
+}
+
+// QueueSize sets number of messages waiting for the endpoint, default 1024.
+// Messages are dropped when queue is full.
+func QueueSize(n int) func(*options) {
+	return func(o *options) {
+		o.queueSize = n
+	}
+}
+
+// Timeout sets http request timeout, default 10s.
+func Timeout(d time.Duration) func(*options) {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// MaxRetry sets how long failed message is retried, default 1 minute.
+func MaxRetry(d time.Duration) func(*options) {
+	return func(o *options) {
+		o.maxRetry = d
+	}
+}
+
+// Breaker opens endpoint circuit after number of consecutive failures.
+// Messages are dropped while circuit is open, after cooldown one request is
+// tried and circuit is closed on success. Default is 5 failures, 1 minute.
+func Breaker(failures int, cooldown time.Duration) func(*options) {
+	return func(o *options) {
+		o.failures = failures
+		o.cooldown = cooldown
+	}
+}
+
+// Dispatcher sends messages to the registered endpoints.
+type Dispatcher struct {
+	opts      options
+	client    *http.Client
+	endpoints map[string]*endpoint
+	sync.Mutex
+}
+
+// New creates dispatcher.
+func New(opts ...func(*options)) *Dispatcher {
+	o := options{
+		queueSize: 1024,
+		timeout:   10 * time.Second,
+		maxRetry:  time.Minute,
+		failures:  5,
+		cooldown:  time.Minute,
+	}
+	for _, f := range opts {
+		f(&o)
+	}
+	return &Dispatcher{
+		opts:      o,
+		client:    &http.Client{Timeout: o.timeout},
+		endpoints: make(map[string]*endpoint),
+	}
+}
+
+// Register adds endpoint, endpoint with the same id is replaced.
+func (d *Dispatcher) Register(e Endpoint) {
+	d.Lock()
+	defer d.Unlock()
+	if o, ok := d.endpoints[e.ID]; ok {
+		o.stop()
+	}
+	d.endpoints[e.ID] = d.start(e)
+}
+
+// Unregister removes endpoint.
+func (d *Dispatcher) Unregister(id string) {
+	d.Lock()
+	defer d.Unlock()
+	if o, ok := d.endpoints[id]; ok {
+		o.stop()
+		delete(d.endpoints, id)
+	}
+}
+
+// Endpoints returns registered endpoints.
+func (d *Dispatcher) Endpoints() []Endpoint {
+	d.Lock()
+	defer d.Unlock()
+	es := make([]Endpoint, 0, len(d.endpoints))
+	for _, e := range d.endpoints {
+		es = append(es, e.Endpoint)
+	}
+	return es
+}
+
+// Dispatch queues message for all endpoints subscribed to its topic.
+func (d *Dispatcher) Dispatch(m *amp.Msg) {
+	d.Lock()
+	defer d.Unlock()
+	for _, e := range d.endpoints {
+		if !e.wants(m.Topic()) {
+			continue
+		}
+		select {
+		case e.queue <- m:
+		default:
+			metric.Counter("webhook." + e.ID + ".dropped")
+		}
+	}
+}
+
+// Consume dispatches messages from in until in is closed or ctx is done.
+// All endpoints are stopped on exit.
+func (d *Dispatcher) Consume(ctx context.Context, in <-chan *amp.Msg) {
+	defer d.Close()
+	for {
+		select {
+		case m, ok := <-in:
+			if !ok {
+				return
+			}
+			d.Dispatch(m)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close stops all endpoints, waiting messages are dropped.
+func (d *Dispatcher) Close() {
+	d.Lock()
+	defer d.Unlock()
+	for id, e := range d.endpoints {
+		e.stop()
+		delete(d.endpoints, id)
+	}
+}
+
+type endpoint struct {
+	Endpoint
+	queue  chan *amp.Msg
+	ctx    context.Context
+	stop   func()
+	opts   options
+	client *http.Client
+
+	failures  int       // consecutive failures
+	openUntil time.Time // circuit open until
+}
+
+func (d *Dispatcher) start(e Endpoint) *endpoint {
+	ctx, stop := context.WithCancel(context.Background())
+	ep := &endpoint{
+		Endpoint: e,
+		queue:    make(chan *amp.Msg, d.opts.queueSize),
+		ctx:      ctx,
+		stop:     stop,
+		opts:     d.opts,
+		client:   d.client,
+	}
+	go ep.loop()
+	return ep
+}
+
+func (e *endpoint) loop() {
+	for {
+		select {
+		case m := <-e.queue:
+			err := e.deliver(m)
+			if err == ErrCircuitOpen {
+				metric.Counter("webhook." + e.ID + ".skipped")
+				continue
+			}
+			if err != nil {
+				metric.Counter("webhook." + e.ID + ".failed")
+				log.S("endpoint", e.ID).S("uri", m.URI).Error(err)
+			}
+		case <-e.ctx.Done():
+			return
+		}
+	}
+}
+
+// deliver posts message with retries
+func (e *endpoint) deliver(m *amp.Msg) error {
+	body := m.BodyBytes()
+	return signal.WithBackoff(e.ctx, func() error {
+		if time.Now().Before(e.openUntil) {
+			return backoff.Permanent(ErrCircuitOpen)
+		}
+		err := e.post(m, body)
+		if err == nil {
+			e.failures = 0
+			metric.Counter("webhook." + e.ID + ".sent")
+			return nil
+		}
+		if _, ok := err.(*backoff.PermanentError); ok {
+			// endpoint rejected the message, it is not failing
+			return err
+		}
+		e.failures++
+		if e.failures >= e.opts.failures {
+			e.openUntil = time.Now().Add(e.opts.cooldown)
+			e.failures = e.opts.failures - 1 // one failure after cooldown opens again
+			log.S("endpoint", e.ID).Info("circuit open")
+			return backoff.Permanent(err)
+		}
+		return err
+	}, e.opts.maxRetry/4, e.opts.maxRetry)
+}
+
+func (e *endpoint) post(m *amp.Msg, body []byte) error {
+	req, err := http.NewRequest("POST", e.URL, bytes.NewReader(body))
+	if err != nil {
+		return backoff.Permanent(errors.WithStack(err))
+	}
+	req = req.WithContext(e.ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Amp-URI", m.URI)
+	req.Header.Set("X-Amp-Ts", strconv.FormatInt(m.Ts, 10))
+	req.Header.Set("X-Amp-Signature", Sign(e.Secret, time.Now(), body))
+	rsp, err := e.client.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 512))
+		err := errors.Errorf("status %d: %s", rsp.StatusCode, msg)
+		if rsp.StatusCode/100 == 4 && rsp.StatusCode != http.StatusRequestTimeout && rsp.StatusCode != http.StatusTooManyRequests {
+			return backoff.Permanent(err)
+		}
+		return err
+	}
+	return nil
+}
+
+// Sign returns signature header value of the body.
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return fmt.Sprintf("t=%s,v1=%s", ts, signature(secret, ts, body))
+}
+
+// SignRequest returns signature header value of the ingest request.
+// Method, url path and idempotency key are signed with the body, so
+// request can't be replayed to the other path or with the other key.
+func SignRequest(secret string, t time.Time, method, path, key string, body []byte) string {
+	return Sign(secret, t, requestPayload(method, path, key, body))
+}
+
+// VerifyRequest checks signature header of the received ingest request.
+func VerifyRequest(secret, header, method, path, key string, body []byte, maxAge time.Duration) error {
+	return Verify(secret, header, requestPayload(method, path, key, body), maxAge)
+}
+
+// requestPayload returns signed content of the request, parts are
+// separated by new line which is not allowed in method, path and header
+func requestPayload(method, path, key string, body []byte) []byte {
+	buf := make([]byte, 0, len(method)+len(path)+len(key)+len(body)+3)
+	buf = append(append(buf, method...), '\n')
+	buf = append(append(buf, path...), '\n')
+	buf = append(append(buf, key...), '\n')
+	return append(buf, body...)
+}
+
+// Verify checks signature header of the received body.
+// Signatures older than maxAge or from the future are rejected (maxAge 0
+// for no limit).
+func Verify(secret, header string, body []byte, maxAge time.Duration) error {
+	var ts, sig string
+	for _, p := range strings.Split(header, ",") {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			ts = kv[1]
+		case "v1":
+			sig = kv[1]
+		}
+	}
+	if !hmac.Equal([]byte(sig), []byte(signature(secret, ts, body))) {
+		return ErrSignature
+	}
+	if maxAge > 0 {
+		sec, _ := strconv.ParseInt(ts, 10, 64)
+		age := time.Since(time.Unix(sec, 0))
+		if age > maxAge {
+			return ErrExpired
+		}
+		if age < -maxClockSkew {
+			return ErrFuture
+		}
+	}
+	return nil
+}
+
+func signature(secret, ts string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(ts))
+	h.Write([]byte("."))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
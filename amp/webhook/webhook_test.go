@@ -0,0 +1,114 @@
+package webhook
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+type partner struct {
+	fail     int
+	received []string
+	errors   []error
+	sync.Mutex
+}
+
+func (p *partner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.Lock()
+	defer p.Unlock()
+	if p.fail > 0 {
+		p.fail--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := Verify("secret", r.Header.Get("X-Amp-Signature"), body, time.Minute); err != nil {
+		p.errors = append(p.errors, err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	p.received = append(p.received, r.Header.Get("X-Amp-URI"))
+}
+
+func (p *partner) uris() []string {
+	p.Lock()
+	defer p.Unlock()
+	return append([]string(nil), p.received...)
+}
+
+func (p *partner) rejected() []error {
+	p.Lock()
+	defer p.Unlock()
+	return append([]error(nil), p.errors...)
+}
+
+func TestDispatcher(t *testing.T) {
+	p := &partner{fail: 2}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+	bad := &partner{}
+	badSrv := httptest.NewServer(bad)
+	defer badSrv.Close()
+
+	d := New(MaxRetry(time.Second), Breaker(3, 50*time.Millisecond))
+	d.Register(Endpoint{ID: "p", URL: srv.URL, Secret: "secret", Topics: []string{"odds"}})
+	d.Register(Endpoint{ID: "bad", URL: badSrv.URL, Secret: "wrong"})
+	assert.Len(t, d.Endpoints(), 2)
+
+	d.Dispatch(amp.NewPublish("odds", "1", 1, amp.Diff, map[string]int{"a": 1}))
+	d.Dispatch(amp.NewPublish("other", "1", 2, amp.Diff, nil))
+	for i := 0; i < 100 && (len(p.uris()) == 0 || len(bad.rejected()) < 2); i++ {
+		time.Sleep(20 * time.Millisecond) // first retry is after ~500ms
+	}
+	assert.Equal(t, []string{"odds/1"}, p.uris())
+	// wrong secret is rejected, and not retried
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, []error{ErrSignature, ErrSignature}, bad.rejected())
+
+	d.Unregister("bad")
+	assert.Len(t, d.Endpoints(), 1)
+	d.Close()
+	assert.Len(t, d.Endpoints(), 0)
+}
+
+func TestBreaker(t *testing.T) {
+	p := &partner{fail: 100}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	d := New(MaxRetry(time.Second), Breaker(2, time.Hour))
+	d.Register(Endpoint{ID: "p", URL: srv.URL, Secret: "secret"})
+	e := d.endpoints["p"]
+	m := amp.NewPublish("odds", "1", 1, amp.Diff, nil)
+	assert.NotNil(t, e.deliver(m))
+	assert.True(t, e.openUntil.After(time.Now()))
+	p.Lock()
+	assert.Equal(t, 98, p.fail) // two attempts, then circuit is open
+	p.Unlock()
+	assert.Equal(t, ErrCircuitOpen, e.deliver(m))
+
+	// after cooldown
+	e.openUntil = time.Time{}
+	p.Lock()
+	p.fail = 0
+	p.Unlock()
+	assert.Nil(t, e.deliver(m))
+	assert.Equal(t, 0, e.failures)
+	d.Close()
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"a":1}`)
+	h := Sign("secret", time.Now(), body)
+	assert.Nil(t, Verify("secret", h, body, time.Minute))
+	assert.Equal(t, ErrSignature, Verify("secret", h, []byte(`{"a":2}`), time.Minute))
+	h = Sign("secret", time.Now().Add(-time.Hour), body)
+	assert.Equal(t, ErrExpired, Verify("secret", h, body, time.Minute))
+	assert.Nil(t, Verify("secret", h, body, 0))
+}
@@ -5,10 +5,12 @@ import (
 	"compress/flate"
 	"io"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/gobwas/ws"
+	"github.com/minus5/svckit/amp/chaos"
 	"github.com/pkg/errors"
 )
 
@@ -17,6 +19,7 @@ type Conn struct {
 	tcpConn net.Conn
 	cap     connCap
 	no      uint64
+	wlock   sync.Mutex // chaos delayed frames are written from other goroutine
 	//	receive    chan []byte
 	//	receiveErr error
 }
@@ -60,9 +63,29 @@ func (c *Conn) Headers() map[string]string {
 }
 
 // Write writes payload to the websocket connection.
+// Payload is shared between connections (cached in the amp.Msg), it is
+// written as is, never modified.
 func (c *Conn) Write(payload []byte, deflated bool) error {
+	return c.write(ws.OpText, payload, deflated)
+}
+
+// WriteBinary writes payload to the websocket connection in the binary frame.
+// Used for messages with binary body which is not valid utf-8 text.
+func (c *Conn) WriteBinary(payload []byte, deflated bool) error {
+	return c.write(ws.OpBinary, payload, deflated)
+}
+
+func (c *Conn) write(op ws.OpCode, payload []byte, deflated bool) error {
+	return chaos.Get().Send(payload, func(payload []byte) error {
+		return c.writeFrame(op, payload, deflated)
+	})
+}
+
+func (c *Conn) writeFrame(op ws.OpCode, payload []byte, deflated bool) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
 	var header ws.Header
-	header.OpCode = ws.OpText
+	header.OpCode = op
 	header.Length = int64(len(payload))
 	header.Fin = true
 	if deflated {
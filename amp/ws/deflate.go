@@ -0,0 +1,52 @@
+package ws
+
+import (
+	"github.com/gobwas/httphead"
+)
+
+const maxWindowBits = "15"
+
+// negotiateDeflate selects compression extension from the client offers
+// (Sec-WebSocket-Extensions header value).
+//
+// Each message is compressed independently (no context takeover) with the
+// full 32K window. So the deflated payload cached in the amp.Msg is valid on
+// every connection and is compressed once for all subscribers. Offers which
+// need different payload (smaller server window) are declined, connection is
+// then uncompressed. Window size offered by the client is confirmed in the
+// response.
+func negotiateDeflate(field []byte) (httphead.Option, bool) {
+	offers, ok := httphead.ParseOptions(field, nil)
+	if !ok {
+		return httphead.Option{}, false
+	}
+	for _, o := range offers {
+		switch string(o.Name) {
+		case "permessage-deflate":
+			bits, ok := o.Parameters.Get("server_max_window_bits")
+			if ok && string(bits) != maxWindowBits {
+				continue
+			}
+			params := map[string]string{
+				"client_no_context_takeover": "",
+				"server_no_context_takeover": "",
+			}
+			if ok {
+				params["server_max_window_bits"] = maxWindowBits
+			}
+			return httphead.NewOption("permessage-deflate", params), true
+		case "x-webkit-deflate-frame":
+			// iPhone (WebKit) salje po starom standardu
+			bits, ok := o.Parameters.Get("max_window_bits")
+			if ok && string(bits) != maxWindowBits {
+				continue
+			}
+			params := map[string]string{"no_context_takeover": ""}
+			if ok {
+				params["max_window_bits"] = maxWindowBits
+			}
+			return httphead.NewOption("x-webkit-deflate-frame", params), true
+		}
+	}
+	return httphead.Option{}, false
+}
@@ -0,0 +1,61 @@
+package ws
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateDeflate(t *testing.T) {
+	cases := []struct {
+		offer    string
+		accepted string
+	}{
+		{"permessage-deflate; client_max_window_bits", "permessage-deflate"},
+		{"permessage-deflate; server_max_window_bits=15", "permessage-deflate"},
+		{"permessage-deflate; server_max_window_bits=10", ""},
+		{"permessage-deflate; server_max_window_bits=10, permessage-deflate", "permessage-deflate"},
+		{"x-webkit-deflate-frame", "x-webkit-deflate-frame"},
+		{"x-webkit-deflate-frame; max_window_bits=8", ""},
+		{"foo", ""},
+	}
+	for _, c := range cases {
+		o, ok := negotiateDeflate([]byte(c.offer))
+		assert.Equal(t, c.accepted != "", ok, c.offer)
+		assert.Equal(t, c.accepted, string(o.Name), c.offer)
+	}
+	o, _ := negotiateDeflate([]byte("permessage-deflate"))
+	_, ok := o.Parameters.Get("server_no_context_takeover")
+	assert.True(t, ok)
+	_, ok = o.Parameters.Get("server_max_window_bits")
+	assert.False(t, ok)
+
+	// offered window size is confirmed
+	o, _ = negotiateDeflate([]byte("permessage-deflate; server_max_window_bits=15"))
+	bits, ok := o.Parameters.Get("server_max_window_bits")
+	assert.True(t, ok)
+	assert.Equal(t, "15", string(bits))
+	o, _ = negotiateDeflate([]byte("x-webkit-deflate-frame; max_window_bits=15"))
+	bits, _ = o.Parameters.Get("max_window_bits")
+	assert.Equal(t, "15", string(bits))
+}
+
+// TestSharedDeflate deflated payload is created once and is valid on every
+// connection, each message is compressed without context takeover.
+func TestSharedDeflate(t *testing.T) {
+	body := map[string]string{"events": strings.Repeat("event ", 100)}
+	m1 := amp.NewPublish("sport", "all", 1, amp.Full, body)
+	m2 := amp.NewPublish("sport", "all", 2, amp.Diff, body)
+
+	p1, ok := m1.MarshalPolicy(amp.CompatibilityVersionDefault, amp.CompressionPolicy{Mode: amp.CompressAlways})
+	assert.True(t, ok)
+	p2, _ := m1.MarshalPolicy(amp.CompatibilityVersionDefault, amp.CompressionPolicy{Mode: amp.CompressAlways})
+	assert.True(t, &p1[0] == &p2[0], "payload is not shared")
+	assert.Equal(t, m1.Marshal(), undeflate(p1))
+
+	// second message is independent of the first one
+	p3, _ := m2.MarshalPolicy(amp.CompatibilityVersionDefault, amp.CompressionPolicy{Mode: amp.CompressAlways})
+	assert.Equal(t, m2.Marshal(), undeflate(p3))
+}
@@ -0,0 +1,99 @@
+// +build ignore
+
+// This program bundles browser client from amp/sdk/js into client_gen.go.
+// It can be invoked by running:
+// go generate
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	srcDir = "../sdk/js/src"
+	entry  = "./client.js"
+	output = "client_gen.go"
+)
+
+var requireRe = regexp.MustCompile(`require\("(\./[a-z]+\.js)"\)`)
+
+// load reads module and, recursively, all modules it requires
+func load(name string, modules map[string]string) error {
+	if _, ok := modules[name]; ok {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(srcDir, name))
+	if err != nil {
+		return err
+	}
+	src := string(buf)
+	if strings.Contains(src, "`") {
+		return fmt.Errorf("%s: backquote can't be embedded in Go raw string", name)
+	}
+	modules[name] = src
+	for _, m := range requireRe.FindAllStringSubmatch(src, -1) {
+		if err := load(m[1], modules); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func bundle(modules map[string]string) string {
+	var names []string
+	for n := range modules {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	b := &bytes.Buffer{}
+	b.WriteString(`// amp ws client, bundled from amp/sdk/js by amp/ws/gen_client.go
+(function (root, factory) {
+  if (typeof module === "object" && module.exports) {
+    module.exports = factory();
+  } else {
+    root.amp = factory();
+  }
+})(this, function () {
+  "use strict";
+  var modules = {}, cache = {};
+  function require(name) {
+    if (!cache[name]) {
+      var module = cache[name] = { exports: {} };
+      modules[name](module, module.exports, require);
+    }
+    return cache[name].exports;
+  }
+`)
+	for _, n := range names {
+		fmt.Fprintf(b, "\n  modules[%q] = function (module, exports, require) {\n", n)
+		b.WriteString(strings.TrimRight(modules[n], "\n"))
+		b.WriteString("\n  };\n")
+	}
+	fmt.Fprintf(b, "\n  return require(%q);\n});\n", entry)
+	return b.String()
+}
+
+func main() {
+	modules := make(map[string]string)
+	if err := load(entry, modules); err != nil {
+		log.Fatal(err)
+	}
+	b := &bytes.Buffer{}
+	b.WriteString("// Code generated by go run gen_client.go; DO NOT EDIT.\n\n")
+	b.WriteString("package ws\n\n")
+	b.WriteString("// ClientJS is browser client for the ws transport, see ServeClient.\n")
+	b.WriteString("const ClientJS = `")
+	b.WriteString(bundle(modules))
+	b.WriteString("`\n")
+	if err := ioutil.WriteFile(output, b.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
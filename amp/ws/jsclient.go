@@ -0,0 +1,35 @@
+package ws
+
+//go:generate go run gen_client.go
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// ServeClient serves browser JavaScript client for the ws transport.
+// Gateway should register it on its http server:
+//
+//	http.HandleFunc("/amp.js", ws.ServeClient)
+//
+// and web page loads it with <script src="/amp.js"></script>.
+//
+// Client is bundled from amp/sdk/js/src/client.js (see gen_client.go), it
+// exports global amp (or CommonJS module) with:
+//
+//	amp.parse(data), amp.serialize(msg)  wire format
+//	var c = amp.connect("ws://host/api", {onStatus: fn})
+//	var unsubscribe = c.subscribe("math.v1/i", function(msg) {...})
+//	c.request("math.req/add", {x: 1, y: 2}).then(function(body) {...})
+//	c.close()
+//
+// Reconnect hint in the server disconnect message (see amp.ReconnectHint)
+// redirects client to the other address and sets reconnect delay and backoff.
+// Deflate is negotiated as websocket permessage-deflate extension, so
+// browser inflates compressed frames.
+func ServeClient(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(ClientJS)))
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	_, _ = w.Write([]byte(ClientJS))
+}
@@ -90,22 +90,11 @@ func (l *listener) upgrade(tc net.Conn) (connCap, error) {
 	ug := ws.Upgrader{
 		// podrzava li klijent websocket permessage-deflate
 		ExtensionCustom: func(f []byte, os []httphead.Option) ([]httphead.Option, bool) {
-			os = make([]httphead.Option, 0)
-			field := string(f)
-			if strings.Contains(field, "permessage-deflate") && !cc.deflateSupported {
-				params := map[string]string{
-					"client_no_context_takeover": "",
-					"server_no_context_takeover": "",
-				}
-				os = append(os, httphead.NewOption("permessage-deflate", params))
-				cc.deflateSupported = true
+			if cc.deflateSupported {
+				return os, true
 			}
-			// iPhone (WebKit) salje po starom standardu
-			if strings.Contains(field, "x-webkit-deflate-frame") && !cc.deflateSupported {
-				params := map[string]string{
-					"no_context_takeover": "",
-				}
-				os = append(os, httphead.NewOption("x-webkit-deflate-frame", params))
+			if o, ok := negotiateDeflate(f); ok {
+				os = append(os, o)
 				cc.deflateSupported = true
 			}
 			return os, true
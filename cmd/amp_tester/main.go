@@ -65,6 +65,11 @@ func stats(interupt context.Context, sessions *session.Sessions) {
 			ws, pooling := sessions.ConnectionsCount()
 			metric.Gauge("sessions.ws", ws)
 			metric.Gauge("sessions.pooling", pooling)
+			lags := sessions.Lags()
+			metric.Gauge("sessions.lagging", len(lags))
+			if len(lags) > 0 {
+				metric.Gauge("sessions.maxLagMs", int(lags[0].Age/time.Millisecond))
+			}
 		}
 	}
 }
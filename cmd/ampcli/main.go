@@ -0,0 +1,180 @@
+// Command ampcli is debugging tool for amp streams.
+//
+// Usage:
+//
+//	ampcli tail math.v1 chat           # print all messages on the topics
+//	ampcli req math.req/add '{"x":1,"y":2}'  # send request and print response
+//	ampcli replay math.v1/i            # ask producer to replay current state
+//	ampcli control purgeCache topic=math.v1  # send signed control command
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/control"
+	"github.com/minus5/svckit/amp/nsq"
+	"github.com/minus5/svckit/log"
+	svcnsq "github.com/minus5/svckit/nsq"
+	"github.com/minus5/svckit/signal"
+)
+
+var (
+	timeout time.Duration
+	noBody  bool
+	target  string
+)
+
+func init() {
+	flag.DurationVar(&timeout, "timeout", 10*time.Second, "request timeout")
+	flag.BoolVar(&noBody, "no-body", false, "print only message headers")
+	flag.StringVar(&target, "target", "", "app name of the control command target, all if empty")
+	flag.Usage = usage
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: ampcli [flags] command args...
+
+Commands:
+  tail topic...       print all messages on the topics
+  req uri [body]      send request and print response
+  replay uri          ask producer to replay current state of the uri
+  control name [key=value...]
+                      send control command signed with $SVCKIT_CONTROL_SECRET
+                      (reloadConfig, logLevel level=debug, purgeCache topic=t, drain)
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	log.Discard()
+	interupt := signal.InteruptContext()
+
+	switch args[0] {
+	case "tail":
+		tail(interupt, args[1:])
+	case "req":
+		body := "{}"
+		if len(args) > 2 {
+			body = args[2]
+		}
+		req(interupt, args[1], body)
+	case "replay":
+		replay(interupt, args[1])
+	case "control":
+		sendControl(args[1], args[2:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+func tail(ctx context.Context, topics []string) {
+	svcnsq.ChannelEphemeral()
+	for m := range nsq.Subscribe(ctx, topics) {
+		printMsg(m)
+	}
+}
+
+func req(ctx context.Context, uri, body string) {
+	if !json.Valid([]byte(body)) {
+		fatal(fmt.Errorf("body is not valid json: %s", body))
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	requester := nsq.MustRequester(ctx)
+	rsp := &response{msgs: make(chan *amp.Msg, 1)}
+	requester.Send(rsp, amp.NewRequest(uri, json.RawMessage(body)))
+
+	select {
+	case m := <-rsp.msgs:
+		printMsg(m)
+		if m.Error != nil {
+			cancel()
+			requester.Wait()
+			os.Exit(1)
+		}
+	case <-time.After(timeout):
+		fatal(fmt.Errorf("request timeout"))
+	case <-ctx.Done():
+	}
+	cancel()
+	requester.Wait()
+}
+
+func replay(ctx context.Context, uri string) {
+	ctx, cancel := context.WithCancel(ctx)
+	requester := nsq.MustRequester(ctx)
+	requester.Current(uri)
+	cancel()
+	requester.Wait()
+}
+
+func sendControl(name string, kvs []string) {
+	secret, err := control.Secret()
+	if err != nil {
+		fatal(err)
+	}
+	args := make(map[string]string)
+	for _, kv := range kvs {
+		p := strings.SplitN(kv, "=", 2)
+		if len(p) != 2 {
+			fatal(fmt.Errorf("argument %s is not key=value", kv))
+		}
+		args[p[0]] = p[1]
+	}
+	m := control.NewCommand(secret, name, target, args)
+	in := make(chan *amp.Msg, 1)
+	pub := nsq.NewPublisher(in)
+	in <- m
+	close(in)
+	pub.Wait()
+	printMsg(amp.Parse(m.Marshal()))
+}
+
+type response struct {
+	msgs chan *amp.Msg
+}
+
+func (r *response) Send(m *amp.Msg) {
+	r.msgs <- m
+}
+
+// printMsg writes message header and pretty printed body to the stdout
+func printMsg(m *amp.Msg) {
+	header, _ := json.Marshal(m)
+	fmt.Printf("%s %s\n", time.Now().Format("15:04:05.000"), header)
+	if noBody {
+		return
+	}
+	var body json.RawMessage
+	if err := m.Unmarshal(&body); err != nil || len(body) == 0 {
+		return
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, body, "", "  "); err != nil {
+		fmt.Printf("%s\n", body)
+		return
+	}
+	fmt.Printf("%s\n", out.Bytes())
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "%s\n", err)
+	os.Exit(1)
+}
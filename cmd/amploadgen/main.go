@@ -0,0 +1,236 @@
+// Command amploadgen is soak-test load generator for amp brokers and gateways.
+//
+// Producers publish diffs to the nsq topics loadgen.<producer>.<topic>,
+// subscribers receive them over websocket gateway, tcp gateway or directly
+// from nsq, requesters send requests to the uri. Throughput, latency
+// percentiles and drops (gaps in the message Ts) are reported every
+// report interval and at the end.
+//
+// Usage:
+//
+//	amploadgen -producers 4 -rate 100 -size 512 -subscribers 100 -ws ws://localhost:8090/api
+//	amploadgen -requesters 10 -think 100ms -req math.req/add -body '{"x":1,"y":2}'
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/client"
+	"github.com/minus5/svckit/amp/nsq"
+	"github.com/minus5/svckit/log"
+	svcnsq "github.com/minus5/svckit/nsq"
+	"github.com/minus5/svckit/signal"
+)
+
+var (
+	producers   int
+	topics      int
+	rate        int
+	size        int
+	subscribers int
+	requesters  int
+	think       time.Duration
+	reqURI      string
+	reqBody     string
+	wsURL       string
+	tcpAddr     string
+	duration    time.Duration
+	report      time.Duration
+	timeout     time.Duration
+)
+
+func init() {
+	flag.IntVar(&producers, "producers", 1, "number of producers")
+	flag.IntVar(&topics, "topics", 1, "topics per producer")
+	flag.IntVar(&rate, "rate", 10, "messages per second per producer")
+	flag.IntVar(&size, "size", 128, "message body size in bytes")
+	flag.IntVar(&subscribers, "subscribers", 1, "number of subscribers to all producer topics")
+	flag.IntVar(&requesters, "requesters", 0, "number of requesters")
+	flag.DurationVar(&think, "think", time.Second, "requester think time between requests")
+	flag.StringVar(&reqURI, "req", "", "request uri")
+	flag.StringVar(&reqBody, "body", "{}", "request body")
+	flag.StringVar(&wsURL, "ws", "", "websocket gateway url, subscribers use nsq if ws and tcp are empty")
+	flag.StringVar(&tcpAddr, "tcp", "", "tcp gateway address")
+	flag.DurationVar(&duration, "duration", time.Minute, "test duration, 0 until interrupted")
+	flag.DurationVar(&report, "report", 10*time.Second, "report interval")
+	flag.DurationVar(&timeout, "timeout", 10*time.Second, "request timeout")
+}
+
+func main() {
+	flag.Parse()
+	if rate <= 0 || time.Second/time.Duration(rate) <= 0 {
+		fatal(fmt.Errorf("rate must be between 1 and %d messages per second", time.Second))
+	}
+	if report <= 0 {
+		fatal(fmt.Errorf("report interval must be positive"))
+	}
+	if requesters > 0 && reqURI == "" {
+		fatal(fmt.Errorf("requesters need request uri (-req)"))
+	}
+	if !json.Valid([]byte(reqBody)) {
+		fatal(fmt.Errorf("body is not valid json: %s", reqBody))
+	}
+	log.Discard()
+	svcnsq.ChannelEphemeral()
+
+	ctx := signal.InteruptContext()
+	if duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, duration)
+		defer cancel()
+	}
+
+	var uris []string
+	for p := 0; p < producers; p++ {
+		for t := 0; t < topics; t++ {
+			uris = append(uris, fmt.Sprintf("loadgen.%d.%d", p, t))
+		}
+	}
+
+	s := newStats()
+	var wg sync.WaitGroup
+	for i := 0; i < subscribers; i++ {
+		subscribe(ctx, uris, s)
+	}
+	// let subscribers connect before producing
+	time.Sleep(time.Second)
+
+	in := make(chan *amp.Msg, producers)
+	pub := nsq.NewPublisher(in)
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			produce(ctx, uris[p*topics:(p+1)*topics], in, s)
+		}(p)
+	}
+	if requesters > 0 {
+		requester := nsq.MustRequester(ctx, nsq.Timeout(timeout))
+		for i := 0; i < requesters; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				request(ctx, requester, s)
+			}()
+		}
+	}
+
+	go func() {
+		t := time.NewTicker(report)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				s.print(os.Stdout)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(in)
+	pub.Wait()
+	time.Sleep(time.Second) // wait for in flight messages
+	fmt.Println("total:")
+	s.printTotal(os.Stdout)
+}
+
+// body of the produced message, sent time for latency and padding to size
+type body struct {
+	Sent    int64  `json:"t"`
+	Padding string `json:"p,omitempty"`
+}
+
+func produce(ctx context.Context, uris []string, out chan<- *amp.Msg, s *stats) {
+	padding := strings.Repeat("x", size)
+	t := time.NewTicker(time.Second / time.Duration(rate))
+	defer t.Stop()
+	var ts int64
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		ts++
+		for _, uri := range uris {
+			out <- amp.NewPublish(uri, "", ts, amp.Diff, body{Sent: time.Now().UnixNano(), Padding: padding})
+			s.sent()
+		}
+	}
+}
+
+func subscribe(ctx context.Context, uris []string, s *stats) {
+	var c *client.Client
+	switch {
+	case wsURL != "":
+		c = client.NewWS(ctx, wsURL)
+	case tcpAddr != "":
+		c = client.NewTCP(ctx, tcpAddr, nil)
+	default:
+		c = client.NewNSQ(ctx)
+	}
+	var lock sync.Mutex
+	last := make(map[string]int64)
+	for _, uri := range uris {
+		uri := uri
+		c.OnMessage(uri, func(m *amp.Msg) {
+			var b body
+			if err := m.Unmarshal(&b); err != nil {
+				s.error()
+				return
+			}
+			lock.Lock()
+			prev := last[uri]
+			last[uri] = m.Ts
+			lock.Unlock()
+			var dropped int64
+			if prev > 0 && m.Ts > prev+1 {
+				dropped = m.Ts - prev - 1
+			}
+			s.received(time.Duration(time.Now().UnixNano()-b.Sent), dropped)
+		})
+	}
+}
+
+func request(ctx context.Context, r *nsq.Requester, s *stats) {
+	rsp := &response{msgs: make(chan *amp.Msg, 1)}
+	defer r.Unsubscribe(rsp)
+	for {
+		start := time.Now()
+		r.Send(rsp, amp.NewRequest(reqURI, json.RawMessage(reqBody)))
+		select {
+		case m := <-rsp.msgs:
+			s.response(time.Since(start), m.Error != nil)
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case <-time.After(think):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+type response struct {
+	msgs chan *amp.Msg
+}
+
+func (r *response) Send(m *amp.Msg) {
+	r.msgs <- m
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "%s\n", err)
+	os.Exit(1)
+}
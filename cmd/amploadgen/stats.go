@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencies kept for percentiles, after that samples replace random ones
+const maxSamples = 100000
+
+// counters of the one interval, or of the whole test
+type counters struct {
+	start      time.Time
+	sent       int
+	received   int
+	dropped    int64
+	errors     int
+	responses  int
+	rspErrors  int
+	latency    samples
+	rspLatency samples
+}
+
+type samples struct {
+	values []time.Duration
+	n      int
+}
+
+func (s *samples) add(d time.Duration) {
+	s.n++
+	if len(s.values) < maxSamples {
+		s.values = append(s.values, d)
+		return
+	}
+	// reservoir sampling, keeps uniform sample of all values
+	if i := rand.Intn(s.n); i < maxSamples {
+		s.values[i] = d
+	}
+}
+
+// percentiles returns p50, p90, p99 and max
+func (s *samples) percentiles() string {
+	if len(s.values) == 0 {
+		return "-"
+	}
+	v := append([]time.Duration{}, s.values...)
+	sort.Slice(v, func(i, j int) bool { return v[i] < v[j] })
+	p := func(q float64) time.Duration {
+		return v[int(q*float64(len(v)-1))]
+	}
+	return fmt.Sprintf("p50 %v p90 %v p99 %v max %v", p(0.5), p(0.9), p(0.99), v[len(v)-1])
+}
+
+type stats struct {
+	interval counters
+	total    counters
+	sync.Mutex
+}
+
+func newStats() *stats {
+	now := time.Now()
+	return &stats{
+		interval: counters{start: now},
+		total:    counters{start: now},
+	}
+}
+
+func (s *stats) update(fn func(c *counters)) {
+	s.Lock()
+	defer s.Unlock()
+	fn(&s.interval)
+	fn(&s.total)
+}
+
+func (s *stats) sent() {
+	s.update(func(c *counters) { c.sent++ })
+}
+
+func (s *stats) error() {
+	s.update(func(c *counters) { c.errors++ })
+}
+
+func (s *stats) received(latency time.Duration, dropped int64) {
+	s.update(func(c *counters) {
+		c.received++
+		c.dropped += dropped
+		c.latency.add(latency)
+	})
+}
+
+func (s *stats) response(latency time.Duration, failed bool) {
+	s.update(func(c *counters) {
+		c.responses++
+		if failed {
+			c.rspErrors++
+		}
+		c.rspLatency.add(latency)
+	})
+}
+
+// print prints interval counters and starts new interval
+func (s *stats) print(w io.Writer) {
+	s.Lock()
+	c := s.interval
+	s.interval = counters{start: time.Now()}
+	s.Unlock()
+	c.print(w)
+}
+
+func (s *stats) printTotal(w io.Writer) {
+	s.Lock()
+	c := s.total
+	s.Unlock()
+	c.print(w)
+}
+
+func (c *counters) print(w io.Writer) {
+	secs := time.Since(c.start).Seconds()
+	rate := func(n int) float64 { return float64(n) / secs }
+	fmt.Fprintf(w, "%s sent %d (%.0f/s) received %d (%.0f/s) dropped %d errors %d latency %s\n",
+		time.Now().Format("15:04:05"), c.sent, rate(c.sent), c.received, rate(c.received),
+		c.dropped, c.errors, c.latency.percentiles())
+	if c.responses > 0 {
+		fmt.Fprintf(w, "%s responses %d (%.0f/s) errors %d latency %s\n",
+			time.Now().Format("15:04:05"), c.responses, rate(c.responses), c.rspErrors, c.rspLatency.percentiles())
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -60,7 +61,7 @@ func newRouter(replay func(string)) *router {
 	}
 }
 
-func (r *router) entryPoint(m *amp.Msg) (*amp.Msg, error) {
+func (r *router) entryPoint(ctx context.Context, m *amp.Msg) (*amp.Msg, error) {
 	if m.IsCurrent() {
 		r.replay(m.URI)
 		return nil, nil
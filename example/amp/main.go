@@ -4,6 +4,7 @@ import (
 	"context"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	"github.com/minus5/svckit/amp"
 	"github.com/minus5/svckit/amp/broker"
@@ -15,6 +16,7 @@ import (
 	"github.com/minus5/svckit/health"
 	"github.com/minus5/svckit/httpi"
 	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/pkg/access"
 	"github.com/minus5/svckit/signal"
 
 	_ "github.com/minus5/svckit" // adding svckit.stats to expvar
@@ -26,14 +28,17 @@ var (
 	wsPortLabel      = "ws"
 	poolingPortLabel = "pooling"
 	appPortLabel     = "app"
+	accessKey        = "access/gateway" // Consul key with access rules of the public listeners
 )
 
 func main() {
 	log.Debug("starting")
 	defer log.Debug("stopped")
 
-	tcpListener := ws.MustOpen(env.Port(wsPortLabel))
 	interupt := signal.InteruptContext()
+	acl := access.New()
+	acl.WatchConsul(interupt, accessKey, 10*time.Second)
+	tcpListener := acl.Listener(ws.MustOpen(env.Port(wsPortLabel)))
 	requester := nsq.MustRequester(interupt)
 	broker := broker.New(requester.Current)
 	broker.Consume(nsq.Subscribe(interupt, inputTopics))
@@ -41,13 +46,13 @@ func main() {
 	defer sessions.Wait()
 
 	go debugHTTP()
-	go demoServer()
-	go poolingHTTP(interupt, sessions)
+	go demoServer(acl)
+	go poolingHTTP(interupt, sessions, acl)
 	ws.Listen(interupt, tcpListener, func(c *ws.Conn) { sessions.Serve(c) })
 }
 
-func poolingHTTP(interupt context.Context, sessions *session.Sessions) {
-	srv := &http.Server{Addr: env.Address(poolingPortLabel), Handler: &restServer{sessions: sessions}}
+func poolingHTTP(interupt context.Context, sessions *session.Sessions, acl *access.Access) {
+	srv := &http.Server{Addr: env.Address(poolingPortLabel), Handler: acl.Handler(&restServer{sessions: sessions})}
 	go func() {
 		<-interupt.Done()
 		srv.Shutdown(context.Background())
@@ -104,8 +109,9 @@ func debugHTTP() {
 	httpi.Start(env.Address(debugPortLabel))
 }
 
-func demoServer() {
+func demoServer(acl *access.Access) {
 	fs := http.FileServer(http.Dir("./demo/"))
 	http.Handle("/", fs)
-	http.ListenAndServe(env.Address(appPortLabel), nil)
+	http.HandleFunc("/amp.js", ws.ServeClient)
+	http.ListenAndServe(env.Address(appPortLabel), acl.Handler(http.DefaultServeMux))
 }
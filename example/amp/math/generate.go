@@ -0,0 +1,41 @@
+// +build ignore
+
+// This program generates math service client SDK into ./api.
+// It can be invoked by running:
+// go generate
+package main
+
+import (
+	"log"
+
+	"github.com/minus5/svckit/amp/gen"
+)
+
+// request and response types of the service, same as in main.go
+type params struct {
+	X int64 `json:"x,omitempty"`
+	Y int64 `json:"y,omitempty"`
+}
+
+type rsp struct {
+	Z int64 `json:"z"`
+}
+
+func main() {
+	s := gen.Service{
+		Name:    "math",
+		Package: "api",
+		Methods: []gen.Method{
+			{Name: "Add", URI: "math.req/add", Request: params{}, Response: rsp{}},
+		},
+		Topics: []gen.Topic{
+			{Name: "I", URI: "math.v1/i", Body: params{}},
+		},
+	}
+	if err := gen.GoClient(s, "./api/client_gen.go"); err != nil {
+		log.Fatal(err)
+	}
+	if err := gen.TsClient(s, "./api/client_gen.ts"); err != nil {
+		log.Fatal(err)
+	}
+}
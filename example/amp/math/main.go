@@ -7,6 +7,7 @@ import (
 
 	"github.com/minus5/svckit/amp"
 	"github.com/minus5/svckit/amp/broker"
+	"github.com/minus5/svckit/amp/delta"
 	"github.com/minus5/svckit/amp/nsq"
 	"github.com/minus5/svckit/env"
 	"github.com/minus5/svckit/health"
@@ -14,6 +15,8 @@ import (
 	"github.com/minus5/svckit/signal"
 )
 
+//go:generate go run generate.go
+
 const (
 	v1Topic       = "math.v1"
 	methodAdd     = "add"
@@ -33,70 +36,29 @@ type rsp struct {
 	Z int64 `json:"z"`
 }
 
-type msg struct {
-	params *params
-	isFull bool
-}
-
-func updateType(m *msg) uint8 {
-	if m.isFull {
-		return amp.Full
-	}
-	return amp.Diff
-}
-
-func producer(ctx context.Context) chan *msg {
-	out := make(chan *msg, 1)
-
+// producer changes state every second, delta.Producer publishes changes as
+// Diffs and whole state as Full every 30 seconds
+func producer(ctx context.Context) <-chan interface{} {
+	out := make(chan interface{})
 	go func() {
 		defer close(out)
-		// init
 		i := int64(1)
-		x := i
-		y := x
-		// define publish function
-		publish := func() {
-			p := &params{
-				X: x,
-				Y: y,
-			}
-			out <- &msg{
-				params: p,
-				isFull: y != 0,
-			}
-		}
-		publish()
-		// loop and generate full/diffs
-		diff := time.Tick(time.Second)
-		full := time.Tick(30 * time.Second)
+		tick := time.NewTicker(time.Second)
+		defer tick.Stop()
 		for {
 			select {
-			case <-diff:
+			case out <- &params{X: i, Y: 1}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case <-tick.C:
 				i++
-				x = i
-				y = 0
-				publish()
-			case <-full:
-				x = i
-				y = x
-				publish()
 			case <-ctx.Done():
 				return
 			}
 		}
 	}()
-
-	return out
-}
-
-func msg2ampMsg(in <-chan *msg) <-chan *amp.Msg {
-	out := make(chan *amp.Msg, 1)
-	go func() {
-		defer close(out)
-		for m := range in {
-			out <- amp.NewPublish(v1Topic, "i", amp.TS(), updateType(m), m.params)
-		}
-	}()
 	return out
 }
 
@@ -109,9 +71,10 @@ func debugHTTP() {
 
 type requests struct {
 	broker *broker.ReplayBroker
+	router *amp.Router
 }
 
-func (r *requests) handler(m *amp.Msg) (*amp.Msg, error) {
+func (r *requests) handler(ctx context.Context, m *amp.Msg) (*amp.Msg, error) {
 	if m.IsCurrent() {
 		r.broker.Replay(m.URI)
 		return nil, nil
@@ -121,32 +84,33 @@ func (r *requests) handler(m *amp.Msg) (*amp.Msg, error) {
 		return nil, nil
 	}
 
-	switch m.Path() {
-	case methodAdd:
-		p := &params{}
-		if err := m.Unmarshal(p); err != nil {
-			return nil, err
-		}
-		z := p.X + p.Y
-		if z == 42 {
-			// example of the error returned
-			return nil, fmt.Errorf("42 is not the number it is THE ANSWER")
-		}
-		return m.Response(amp.JSONMarshaler(&rsp{Z: z})), nil
-	default:
-		return nil, fmt.Errorf("unknown method %s", m.Path())
+	return r.router.Handler(ctx, m)
+}
+
+func router() *amp.Router {
+	r := amp.NewRouter()
+	r.Handle(methodAdd, amp.Typed(add))
+	return r
+}
+
+func add(ctx context.Context, p *params) (*rsp, error) {
+	z := p.X + p.Y
+	if z == 42 {
+		// example of the error returned
+		return nil, fmt.Errorf("42 is not the number it is THE ANSWER")
 	}
-	return nil, nil
+	return &rsp{Z: z}, nil
 }
 
 func main() {
 	interupt := signal.InteruptContext()
 
 	broker := broker.NewWithReplay()
-	responder := nsq.NewResponder(interupt, (&requests{broker: broker}).handler, reqTopics)
+	responder := nsq.NewResponder(interupt, (&requests{broker: broker, router: router()}).handler, reqTopics)
 	defer responder.Wait()
 
-	pub := nsq.NewPublisher(broker.Pipe(msg2ampMsg(producer(interupt))))
+	states := delta.NewProducer(v1Topic, "i", delta.FullInterval(30*time.Second))
+	pub := nsq.NewPublisher(broker.Pipe(states.Pipe(interupt, producer(interupt))))
 	defer pub.Wait()
 
 	debugHTTP()
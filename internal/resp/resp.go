@@ -0,0 +1,165 @@
+// Package resp is minimal Redis client shared by the svckit packages
+// which keep state in Redis. Implements RESP commands with simple string,
+// error, integer or bulk string reply.
+package resp
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Error is error reply of the server, connection is still usable.
+type Error string
+
+func (e Error) Error() string {
+	return "redis: " + string(e)
+}
+
+// Client sends commands to the Redis server.
+// Connections are opened on demand and kept in the pool.
+type Client struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+	pool     chan *conn
+}
+
+// Password sets Redis AUTH password.
+func Password(p string) func(*Client) {
+	return func(c *Client) {
+		c.password = p
+	}
+}
+
+// DB selects Redis database.
+func DB(db int) func(*Client) {
+	return func(c *Client) {
+		c.db = db
+	}
+}
+
+// Timeout sets dial and command timeout, default 1s.
+func Timeout(d time.Duration) func(*Client) {
+	return func(c *Client) {
+		if d > 0 {
+			c.timeout = d
+		}
+	}
+}
+
+// New creates client for the server on addr (host:port).
+func New(addr string, opts ...func(*Client)) *Client {
+	c := &Client{
+		addr:    addr,
+		timeout: time.Second,
+		pool:    make(chan *conn, 16),
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// Do sends command and returns reply, nil for the null bulk string.
+func (c *Client) Do(args ...string) ([]byte, error) {
+	cn, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := cn.do(c.timeout, args...)
+	if err != nil {
+		if _, ok := err.(Error); !ok {
+			cn.Close()
+			return nil, err
+		}
+	}
+	select {
+	case c.pool <- cn:
+	default:
+		cn.Close()
+	}
+	return rsp, err
+}
+
+func (c *Client) conn() (*conn, error) {
+	select {
+	case cn := <-c.pool:
+		return cn, nil
+	default:
+	}
+	nc, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	cn := &conn{Conn: nc, r: bufio.NewReader(nc)}
+	if c.password != "" {
+		if _, err := cn.do(c.timeout, "AUTH", c.password); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := cn.do(c.timeout, "SELECT", strconv.Itoa(c.db)); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *conn) do(timeout time.Duration, args ...string) ([]byte, error) {
+	c.SetDeadline(time.Now().Add(timeout))
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, a := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(a))+"\r\n"...)
+		buf = append(buf, a...)
+		buf = append(buf, "\r\n"...)
+	}
+	if _, err := c.Write(buf); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return c.reply()
+}
+
+// reply reads simple string, error, integer or bulk string reply
+func (c *conn) reply() ([]byte, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(line) < 3 {
+		return nil, errors.Errorf("redis: malformed reply %q", line)
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, Error(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.Errorf("redis: malformed reply %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return buf[:n], nil
+	}
+	return nil, errors.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,146 @@
+package resp
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Handler handles command args with the server key values, returns raw
+// RESP reply. It is called during server lock.
+type Handler func(kv map[string]string, args []string) string
+
+// Server is fake Redis server for the tests of the packages using Client.
+// Key values are in KV, lock the server while changing them.
+type Server struct {
+	KV map[string]string
+	sync.Mutex
+
+	ln      net.Listener
+	handler Handler
+}
+
+// NewServer starts server on the random local port, commands are handled
+// by h (KV if nil).
+func NewServer(h Handler) (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if h == nil {
+		h = KV
+	}
+	s := &Server{KV: make(map[string]string), ln: ln, handler: h}
+	go s.accept()
+	return s, nil
+}
+
+// Addr returns server address for New.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	return s.ln.Close()
+}
+
+func (s *Server) accept() {
+	for {
+		nc, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.serve(nc)
+	}
+}
+
+func (s *Server) serve(nc net.Conn) {
+	defer nc.Close()
+	r := bufio.NewReader(nc)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		s.Lock()
+		rsp := s.handler(s.KV, args)
+		s.Unlock()
+		if _, err := nc.Write([]byte(rsp)); err != nil {
+			return
+		}
+	}
+}
+
+// readCommand reads array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		l, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		buf := make([]byte, l+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:l])
+	}
+	return args, nil
+}
+
+// KV handles GET and SET (with NX) commands, others get error reply.
+// Expiration of the keys is ignored.
+func KV(kv map[string]string, args []string) string {
+	switch args[0] {
+	case "GET":
+		if v, ok := kv[args[1]]; ok {
+			return BulkReply(v)
+		}
+		return NullReply
+	case "SET":
+		for _, a := range args[3:] {
+			if a != "NX" {
+				continue
+			}
+			if _, ok := kv[args[1]]; ok {
+				return NullReply
+			}
+		}
+		kv[args[1]] = args[2]
+		return OKReply
+	}
+	return ErrorReply("ERR unknown command")
+}
+
+// Raw replies for the Handler.
+const (
+	OKReply   = "+OK\r\n"
+	NullReply = "$-1\r\n"
+)
+
+// BulkReply returns bulk string reply.
+func BulkReply(v string) string {
+	return "$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n"
+}
+
+// IntReply returns integer reply.
+func IntReply(i int) string {
+	return ":" + strconv.Itoa(i) + "\r\n"
+}
+
+// ErrorReply returns error reply.
+func ErrorReply(msg string) string {
+	return "-" + msg + "\r\n"
+}
@@ -0,0 +1,31 @@
+package lock
+
+import (
+	"context"
+
+	"github.com/minus5/svckit/dcy"
+	"github.com/pkg/errors"
+)
+
+// Consul holds locks in Consul KV, lease is Consul session renewed by
+// the Consul client.
+type Consul struct {
+	// Prefix of the lock keys in KV.
+	Prefix string
+}
+
+// Lock acquires lock on the key.
+func (c *Consul) Lock(ctx context.Context, key string) (<-chan struct{}, func() error, error) {
+	l, err := dcy.LockKey(c.Prefix + key)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	lost, err := l.Lock(ctx.Done())
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	if lost == nil { // ctx done before lock is acquired
+		return nil, nil, errors.WithStack(ctx.Err())
+	}
+	return lost, l.Unlock, nil
+}
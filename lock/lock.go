@@ -0,0 +1,123 @@
+// Package lock is distributed lock for the jobs which must not run
+// concurrently in more than one process (for example replay compaction).
+//
+//	err := lock.Do(ctx, "replay-compaction", func(ctx context.Context) error {
+//		return compact(ctx) // ctx is done if the lock is lost
+//	})
+//
+// Lock is held in Consul by default, use Set(NewRedis(addr)) for Redis.
+// Lease is renewed while fn is running. Locks lost while held are
+// reported by Status, to be included in the health check:
+//
+//	health.Set(lock.Status)
+package lock
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/minus5/svckit/health"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+	"github.com/pkg/errors"
+)
+
+// ErrLost is returned by Do when lock is lost while fn is running.
+var ErrLost = errors.New("lock lost")
+
+// Backend holds the locks.
+type Backend interface {
+	// Lock blocks until lock on the key is acquired or ctx is done.
+	// Lost is closed if the lock is lost before unlock.
+	Lock(ctx context.Context, key string) (lost <-chan struct{}, unlock func() error, err error)
+}
+
+var (
+	backend Backend = &Consul{}
+	lost            = make(map[string]struct{}) // keys lost while held
+	mu      sync.Mutex
+)
+
+// Set sets backend for all locks.
+func Set(b Backend) {
+	mu.Lock()
+	defer mu.Unlock()
+	backend = b
+}
+
+// Do waits for the lock on the key and calls fn while holding it.
+// Fn ctx is done when ctx is done or lock is lost, then Do returns ErrLost.
+func Do(ctx context.Context, key string, fn func(context.Context) error) error {
+	mu.Lock()
+	b := backend
+	mu.Unlock()
+
+	lostCh, unlock, err := b.Lock(ctx, key)
+	if err != nil {
+		return errors.Wrapf(err, "lock %s", key)
+	}
+	setLost(key, false)
+
+	fnCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	isLost := make(chan bool, 1)
+	go func() {
+		select {
+		case <-lostCh:
+			log.S("key", key).ErrorS("lock lost")
+			metric.Counter("lock.lost")
+			setLost(key, true)
+			isLost <- true
+			cancel()
+		case <-fnCtx.Done():
+			isLost <- false
+		}
+	}()
+
+	err = fn(fnCtx)
+	cancel()
+	// unlock also when lost, to stop the lease renewal and release the
+	// backend resources; backend doesn't release lock taken by other
+	wasLost := <-isLost
+	if uerr := unlock(); uerr != nil {
+		log.S("key", key).Error(uerr)
+	}
+	if wasLost {
+		return errors.Wrapf(ErrLost, "lock %s", key)
+	}
+	return err
+}
+
+func setLost(key string, l bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	if l {
+		lost[key] = struct{}{}
+		return
+	}
+	delete(lost, key)
+}
+
+// Lost returns keys of the locks lost while held and not acquired again.
+func Lost() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	var keys []string
+	for k := range lost {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Status is health check handler, Warn while there are lost locks.
+func Status() (health.Status, []byte) {
+	keys := Lost()
+	if len(keys) == 0 {
+		return health.Passing, nil
+	}
+	return health.Warn, []byte(fmt.Sprintf("lock lost: %s", strings.Join(keys, ", ")))
+}
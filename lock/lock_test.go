@@ -0,0 +1,143 @@
+package lock
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/health"
+	"github.com/minus5/svckit/internal/resp"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// failRenew key in the fakeRedis map fails renewals with error reply
+const failRenew = "fail-renew"
+
+// fakeRedis serves SET NX and lock scripts
+func fakeRedis(t *testing.T) *resp.Server {
+	srv, err := resp.NewServer(func(kv map[string]string, args []string) string {
+		switch {
+		case args[0] == "EVAL" && kv[args[3]] != args[4]:
+			return resp.IntReply(0)
+		case args[0] == "EVAL" && args[1] == unlockScript:
+			delete(kv, args[3])
+			return resp.IntReply(1)
+		case args[0] == "EVAL" && args[1] == renewScript && kv[failRenew] != "":
+			return resp.ErrorReply("ERR renew failed")
+		case args[0] == "EVAL" && args[1] == renewScript:
+			return resp.IntReply(1)
+		}
+		return resp.KV(kv, args)
+	})
+	assert.NoError(t, err)
+	return srv
+}
+
+func TestDo(t *testing.T) {
+	srv := fakeRedis(t)
+	defer srv.Close()
+	Set(NewRedis(srv.Addr(), TTL(30*time.Millisecond), Retry(time.Millisecond)))
+	defer Set(&Consul{})
+
+	// jobs with the same key don't run concurrently
+	var running, max int
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := Do(context.Background(), "job", func(ctx context.Context) error {
+				lock.Lock()
+				running++
+				if running > max {
+					max = running
+				}
+				lock.Unlock()
+				time.Sleep(20 * time.Millisecond) // longer than renew interval
+				lock.Lock()
+				running--
+				lock.Unlock()
+				return nil
+			})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, max)
+	assert.Len(t, srv.KV, 0)
+
+	// lock lost, key taken by someone else
+	err := Do(context.Background(), "job", func(ctx context.Context) error {
+		srv.Lock()
+		srv.KV["lock:job"] = "other"
+		srv.Unlock()
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	assert.Equal(t, ErrLost, errors.Cause(err))
+	assert.Equal(t, []string{"job"}, Lost())
+	s, note := Status()
+	assert.Equal(t, health.Warn, s)
+	assert.Equal(t, "lock lost: job", string(note))
+
+	// ctx done while waiting for the lock
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	err = Do(ctx, "job", func(ctx context.Context) error { return nil })
+	assert.Error(t, err)
+
+	// acquired again
+	srv.Lock()
+	delete(srv.KV, "lock:job")
+	srv.Unlock()
+	assert.NoError(t, Do(context.Background(), "job", func(ctx context.Context) error { return nil }))
+	s, _ = Status()
+	assert.Equal(t, health.Passing, s)
+}
+
+func TestRedisRenewRetry(t *testing.T) {
+	srv := fakeRedis(t)
+	defer srv.Close()
+	Set(NewRedis(srv.Addr(), TTL(60*time.Millisecond), Retry(5*time.Millisecond)))
+	defer Set(&Consul{})
+	setFail := func(f bool) {
+		srv.Lock()
+		defer srv.Unlock()
+		if f {
+			srv.KV[failRenew] = "1"
+			return
+		}
+		delete(srv.KV, failRenew)
+	}
+
+	// failed renewals are retried, lock is kept if renewed before ttl
+	err := Do(context.Background(), "job", func(ctx context.Context) error {
+		setFail(true)
+		time.Sleep(40 * time.Millisecond)
+		setFail(false)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+			return nil
+		}
+	})
+	assert.NoError(t, err)
+	assert.Len(t, srv.KV, 0)
+
+	// lock is lost when lease expires, not on the first failure
+	start := time.Now()
+	err = Do(context.Background(), "job", func(ctx context.Context) error {
+		setFail(true)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	setFail(false)
+	assert.Equal(t, ErrLost, errors.Cause(err))
+	assert.True(t, time.Since(start) >= 60*time.Millisecond)
+	// unlocked after lost
+	assert.Len(t, srv.KV, 0)
+}
@@ -0,0 +1,171 @@
+package lock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/internal/resp"
+	"github.com/minus5/svckit/log"
+	"github.com/pkg/errors"
+)
+
+// scripts change the key only if it still holds our token
+const (
+	renewScript  = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) else return 0 end`
+	unlockScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`
+)
+
+// Redis holds locks in the Redis server as keys with ttl.
+// Lease is renewed every third of ttl. Failed renewal is retried until
+// the lease expires, lock is lost when it expires or key is taken.
+type Redis struct {
+	password string
+	prefix   string
+	ttl      time.Duration
+	retry    time.Duration
+	client   *resp.Client
+}
+
+// Password sets Redis AUTH password.
+func Password(p string) func(*Redis) {
+	return func(r *Redis) {
+		r.password = p
+	}
+}
+
+// Prefix sets prefix of the Redis keys, default "lock:".
+func Prefix(p string) func(*Redis) {
+	return func(r *Redis) {
+		r.prefix = p
+	}
+}
+
+// TTL sets lease duration, default 15s. Lock held by the crashed process
+// is released after ttl.
+func TTL(d time.Duration) func(*Redis) {
+	return func(r *Redis) {
+		r.ttl = d
+	}
+}
+
+// Retry sets interval of lock attempts while waiting for the lock and of
+// failed renewal attempts, default 1s.
+func Retry(d time.Duration) func(*Redis) {
+	return func(r *Redis) {
+		r.retry = d
+	}
+}
+
+// NewRedis creates Redis backend on the addr (host:port).
+func NewRedis(addr string, opts ...func(*Redis)) *Redis {
+	r := &Redis{
+		prefix: "lock:",
+		ttl:    15 * time.Second,
+		retry:  time.Second,
+	}
+	for _, o := range opts {
+		o(r)
+	}
+	r.client = resp.New(addr, resp.Password(r.password))
+	return r
+}
+
+// Lock acquires lock on the key.
+func (r *Redis) Lock(ctx context.Context, key string) (<-chan struct{}, func() error, error) {
+	key = r.prefix + key
+	token, err := newToken()
+	if err != nil {
+		return nil, nil, err
+	}
+	var acquired time.Time
+	for {
+		acquired = time.Now()
+		ok, err := r.tryLock(key, token)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			break
+		}
+		select {
+		case <-time.After(r.retry):
+		case <-ctx.Done():
+			return nil, nil, errors.WithStack(ctx.Err())
+		}
+	}
+
+	lost := make(chan struct{})
+	stop := make(chan struct{})
+	go r.renew(key, token, acquired, lost, stop)
+	var once sync.Once
+	unlock := func() error {
+		once.Do(func() { close(stop) })
+		_, err := r.client.Do("EVAL", unlockScript, "1", key, token)
+		return err
+	}
+	return lost, unlock, nil
+}
+
+func (r *Redis) tryLock(key, token string) (bool, error) {
+	rsp, err := r.client.Do("SET", key, token, "NX", "PX", r.ms(r.ttl))
+	if err != nil {
+		return false, err
+	}
+	return rsp != nil, nil
+}
+
+// renew extends lease, acquired at, until stop. Failed renewal is retried
+// until the lease expires. Closes lost when lease expires or key is taken.
+func (r *Redis) renew(key, token string, acquired time.Time, lost, stop chan struct{}) {
+	expires := acquired.Add(r.ttl)
+	wait := r.ttl / 3
+	for {
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-stop:
+			t.Stop()
+			return
+		}
+		if !time.Now().Before(expires) {
+			close(lost)
+			return
+		}
+		start := time.Now()
+		rsp, err := r.client.Do("EVAL", renewScript, "1", key, token, r.ms(r.ttl))
+		switch {
+		case err != nil:
+			log.S("key", key).Error(err)
+			wait = r.retry
+			if d := time.Until(expires); d < wait {
+				wait = d
+			}
+		case string(rsp) != "1":
+			close(lost)
+			return
+		default:
+			expires = start.Add(r.ttl)
+			wait = r.ttl / 3
+		}
+	}
+}
+
+func (r *Redis) ms(d time.Duration) string {
+	ms := int64(d / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	return strconv.FormatInt(ms, 10)
+}
+
+func newToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -72,7 +72,9 @@ func NewConsumer(topic string, handler func(*Message) error,
 	}
 
 	co.logger().I("maxInFlight", o.maxInFlight).I("concurrency", o.concurrency).Debug("starting consumer")
-	dcy.Subscribe(LookupdHTTPServiceName, co.onLookupChanges)
+	if !o.staticLookupds {
+		dcy.Subscribe(LookupdHTTPServiceName, co.onLookupChanges)
+	}
 	return co, nil
 }
 
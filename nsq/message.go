@@ -31,6 +31,17 @@ func (m *Message) RequeueWithoutBackoff(delay time.Duration) {
 	m.nsqm.RequeueWithoutBackoff(delay)
 }
 
+// DisableAutoResponse makes message finished or requeued explicitly,
+// not when handler returns.
+func (m *Message) DisableAutoResponse() {
+	m.nsqm.DisableAutoResponse()
+}
+
+// Finish marks message as successfully processed.
+func (m *Message) Finish() {
+	m.nsqm.Finish()
+}
+
 func (m *Message) Touch() {
 	m.nsqm.Touch()
 }
@@ -8,6 +8,8 @@ Primjer:
 package nsq
 
 import (
+	"net"
+	"strconv"
 	"strings"
 
 	"github.com/minus5/svckit/dcy"
@@ -54,6 +56,8 @@ type options struct {
 	logger      *nsqLogger
 	logLevel    gonsq.LogLevel
 	lookupds    dcy.Addresses
+	// lookupds are set by Lookupds option, don't follow changes in Consul
+	staticLookupds bool
 }
 
 func (o *options) clone() *options {
@@ -106,3 +110,33 @@ func Ordered() func(*options) {
 		o.concurrency = 1
 	}
 }
+
+// Nsqd sets nsqd tcp address (host:port) for the producer.
+func Nsqd(addr string) func(*options) {
+	return func(o *options) {
+		o.nsqdTCPAddr = addr
+	}
+}
+
+// Lookupds sets nsqlookupd http addresses (host:port) for the consumer.
+// Used to connect to the nsq cluster which is not registered in local Consul.
+func Lookupds(addrs ...string) func(*options) {
+	return func(o *options) {
+		var as dcy.Addresses
+		for _, addr := range addrs {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				logger().S("addr", addr).Error(err)
+				continue
+			}
+			p, err := strconv.Atoi(port)
+			if err != nil {
+				logger().S("addr", addr).Error(err)
+				continue
+			}
+			as = append(as, dcy.Address{Address: host, Port: p})
+		}
+		o.lookupds = as
+		o.staticLookupds = true
+	}
+}
@@ -0,0 +1,397 @@
+// Package access is network level access control for the public
+// listeners (ws, sse, http): CIDR allow and deny lists and blocking by
+// country using MaxMind GeoIP database.
+//
+//	a := access.New(access.Geo(access.MustLoadGeo(geoFile)))
+//	a.WatchConsul(ctx, "access/gateway", 10*time.Second) // or WatchFile
+//	ln := a.Listener(ws.MustOpen(port))                  // ws
+//	httpi.Handle("/sse", a.Handler(sse))                 // http, sse
+//
+// Rules are json:
+//
+//	{"allow": ["212.92.192.0/19"], "deny": ["1.2.3.4"], "countries": ["HR"]}
+//
+// Address in deny list is always denied, address in allow list is always
+// allowed. When country rules are set address must be from the allowed
+// (and not from the denied) country. Without country rules and with
+// allow list only addresses from the allow list are allowed.
+// Private and loopback addresses are not checked by country.
+package access
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/dcy"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+	"github.com/nranchev/go-libGeoIP"
+	"github.com/pkg/errors"
+)
+
+// Rules are access rules.
+type Rules struct {
+	Allow         []string `json:"allow,omitempty"`         // CIDRs or addresses
+	Deny          []string `json:"deny,omitempty"`          // CIDRs or addresses
+	Countries     []string `json:"countries,omitempty"`     // allowed country codes
+	DenyCountries []string `json:"denyCountries,omitempty"` // denied country codes
+}
+
+// Locator finds country code of the address, empty if unknown.
+type Locator interface {
+	Country(ip net.IP) string
+}
+
+// Access checks addresses by the rules.
+type Access struct {
+	allow          []*net.IPNet
+	deny           []*net.IPNet
+	countries      map[string]bool
+	denyCountries  map[string]bool
+	geo            Locator
+	trustedProxies int // number of proxies appending to X-Forwarded-For
+	sync.RWMutex
+}
+
+// Geo sets locator for the country rules.
+// Without locator country rules deny all public addresses.
+func Geo(l Locator) func(*Access) {
+	return func(a *Access) {
+		a.geo = l
+	}
+}
+
+// TrustForwarded makes Handler check the client address from the
+// X-Forwarded-For header, use it only behind the trusted proxies.
+// Proxies is number of the trusted proxies in front of the handler, each
+// appends address it received request from. Client address is the one
+// appended by the outermost trusted proxy, entries left of it are sent by
+// the client and can be spoofed.
+func TrustForwarded(proxies int) func(*Access) {
+	return func(a *Access) {
+		a.trustedProxies = proxies
+	}
+}
+
+// New creates access without rules, all addresses are allowed.
+func New(opts ...func(*Access)) *Access {
+	a := &Access{}
+	for _, o := range opts {
+		o(a)
+	}
+	return a
+}
+
+// Set replaces rules.
+func (a *Access) Set(r Rules) error {
+	allow, err := parseNets(r.Allow)
+	if err != nil {
+		return errors.Wrap(err, "allow")
+	}
+	deny, err := parseNets(r.Deny)
+	if err != nil {
+		return errors.Wrap(err, "deny")
+	}
+	a.Lock()
+	defer a.Unlock()
+	a.allow = allow
+	a.deny = deny
+	a.countries = codes(r.Countries)
+	a.denyCountries = codes(r.DenyCountries)
+	return nil
+}
+
+func parseNets(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, errors.Errorf("wrong address %q", c)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func codes(cs []string) map[string]bool {
+	if len(cs) == 0 {
+		return nil
+	}
+	m := make(map[string]bool)
+	for _, c := range cs {
+		m[strings.ToUpper(strings.TrimSpace(c))] = true
+	}
+	return m
+}
+
+// Allowed returns true if address is allowed by the rules.
+func (a *Access) Allowed(ip net.IP) bool {
+	return a.check(ip) == ""
+}
+
+// check returns reason of denying address, empty if allowed
+func (a *Access) check(ip net.IP) string {
+	if ip == nil {
+		return "address"
+	}
+	a.RLock()
+	defer a.RUnlock()
+	if contains(a.deny, ip) {
+		return "deny"
+	}
+	if contains(a.allow, ip) {
+		return ""
+	}
+	if a.countries != nil || a.denyCountries != nil {
+		if isPrivate(ip) {
+			return ""
+		}
+		c := a.country(ip)
+		if a.denyCountries[c] || (a.countries != nil && !a.countries[c]) {
+			return "country"
+		}
+		return ""
+	}
+	if len(a.allow) > 0 {
+		return "allow"
+	}
+	return ""
+}
+
+func (a *Access) country(ip net.IP) string {
+	if a.geo == nil {
+		return ""
+	}
+	return a.geo.Country(ip)
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+var privateNets, _ = parseNets([]string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "127.0.0.0/8", "::1/128", "fc00::/7"})
+
+func isPrivate(ip net.IP) bool {
+	return contains(privateNets, ip)
+}
+
+// deny counts and logs denied address
+func deny(ip, reason string) {
+	metric.Counter("access.denied")
+	metric.Counter("access.denied." + reason)
+	log.S("ip", ip).S("reason", reason).Debug("access denied")
+}
+
+// Listener wraps listener, connections from the denied addresses are
+// closed after accept.
+func (a *Access) Listener(ln net.Listener) net.Listener {
+	return &listener{Listener: ln, a: a}
+}
+
+type listener struct {
+	net.Listener
+	a *Access
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip := addrIP(c.RemoteAddr())
+		if reason := l.a.check(ip); reason != "" {
+			deny(ip.String(), reason)
+			_ = c.Close()
+			continue
+		}
+		return c, nil
+	}
+}
+
+func addrIP(addr net.Addr) net.IP {
+	if ta, ok := addr.(*net.TCPAddr); ok {
+		return ta.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// Handler wraps http handler, requests from the denied addresses get 403.
+func (a *Access) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr := a.remoteAddr(r)
+		if reason := a.check(net.ParseIP(addr)); reason != "" {
+			deny(addr, reason)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// remoteAddr returns client address of the request
+func (a *Access) remoteAddr(r *http.Request) string {
+	if a.trustedProxies > 0 {
+		var hops []string
+		for _, h := range r.Header["X-Forwarded-For"] {
+			for _, hop := range strings.Split(h, ",") {
+				if hop = strings.TrimSpace(hop); hop != "" {
+					hops = append(hops, hop)
+				}
+			}
+		}
+		if len(hops) > 0 {
+			i := len(hops) - a.trustedProxies
+			if i < 0 {
+				i = 0
+			}
+			return hops[i]
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// LoadConsul sets rules from the json value of the Consul KV key.
+// Missing key removes all rules.
+func (a *Access) LoadConsul(key string) error {
+	v, err := dcy.KV(key)
+	if err == dcy.ErrKeyNotFound {
+		return a.Set(Rules{})
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return a.load([]byte(v), key)
+}
+
+// LoadFile sets rules from the json file.
+func (a *Access) LoadFile(path string) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return a.load(buf, path)
+}
+
+func (a *Access) load(buf []byte, source string) error {
+	var r Rules
+	if err := json.Unmarshal(buf, &r); err != nil {
+		return errors.Wrapf(err, "access rules %s", source)
+	}
+	return errors.Wrapf(a.Set(r), "access rules %s", source)
+}
+
+// WatchConsul reloads rules from Consul KV every interval until ctx is done.
+func (a *Access) WatchConsul(ctx context.Context, key string, interval time.Duration) {
+	a.watch(ctx, interval, func() error { return a.LoadConsul(key) }, log.S("key", key))
+}
+
+// WatchFile reloads rules from the file when it is changed, checks every
+// interval until ctx is done.
+func (a *Access) WatchFile(ctx context.Context, path string, interval time.Duration) {
+	var modified time.Time
+	load := func() error {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if fi.ModTime().Equal(modified) {
+			return nil
+		}
+		if err := a.LoadFile(path); err != nil {
+			return err
+		}
+		modified = fi.ModTime()
+		return nil
+	}
+	a.watch(ctx, interval, load, log.S("path", path))
+}
+
+func (a *Access) watch(ctx context.Context, interval time.Duration, load func() error, l *log.Agregator) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			if err := load(); err != nil {
+				l.Error(err)
+			}
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// geoIP is Locator using MaxMind GeoIP (legacy, .dat) database
+type geoIP struct {
+	db *libgeo.GeoIP
+}
+
+// LoadGeo loads MaxMind GeoIP country database.
+func LoadGeo(file string) (Locator, error) {
+	db, err := libgeo.Load(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "geo ip %s", file)
+	}
+	return &geoIP{db: db}, nil
+}
+
+// MustLoadGeo loads GeoIP database, raises fatal on error.
+func MustLoadGeo(file string) Locator {
+	l, err := LoadGeo(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return l
+}
+
+// Country returns country code of the IPv4 address.
+func (g *geoIP) Country(ip net.IP) (code string) {
+	defer func() {
+		if r := recover(); r != nil {
+			code = ""
+		}
+	}()
+	if ip.To4() == nil {
+		return ""
+	}
+	if loc := g.db.GetLocationByIP(ip.String()); loc != nil {
+		return loc.CountryCode
+	}
+	return ""
+}
@@ -0,0 +1,97 @@
+package access
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRules(t *testing.T) {
+	a := New()
+	assert.True(t, a.Allowed(net.ParseIP("1.2.3.4")))
+
+	assert.Nil(t, a.Set(Rules{Allow: []string{"10.0.0.0/8", "1.2.3.4"}, Deny: []string{"10.1.0.0/16"}}))
+	assert.True(t, a.Allowed(net.ParseIP("1.2.3.4")))
+	assert.True(t, a.Allowed(net.ParseIP("10.2.0.1")))
+	assert.False(t, a.Allowed(net.ParseIP("10.1.0.1")))
+	assert.False(t, a.Allowed(net.ParseIP("1.2.3.5")))
+	assert.False(t, a.Allowed(nil))
+
+	assert.NotNil(t, a.Set(Rules{Deny: []string{"1.2.3"}}))
+}
+
+func TestGeo(t *testing.T) {
+	g, err := LoadGeo("../geo/testGeoIP.dat")
+	assert.Nil(t, err)
+	assert.Equal(t, "HR", g.Country(net.ParseIP("212.92.207.181")))
+
+	a := New(Geo(g))
+	assert.Nil(t, a.Set(Rules{Countries: []string{"hr"}, Allow: []string{"208.117.229.0/24"}}))
+	assert.True(t, a.Allowed(net.ParseIP("212.92.207.181")))
+	assert.True(t, a.Allowed(net.ParseIP("208.117.229.99")))  // allow list
+	assert.False(t, a.Allowed(net.ParseIP("208.117.228.99"))) // other country
+	assert.True(t, a.Allowed(net.ParseIP("192.168.1.1")))     // private
+
+	assert.Nil(t, a.Set(Rules{DenyCountries: []string{"HR"}}))
+	assert.False(t, a.Allowed(net.ParseIP("212.92.207.181")))
+	assert.True(t, a.Allowed(net.ParseIP("208.117.228.99")))
+}
+
+func TestHandler(t *testing.T) {
+	a := New(TrustForwarded(1))
+	assert.Nil(t, a.Set(Rules{Deny: []string{"1.2.3.4"}}))
+	h := a.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	r.Header.Set("X-Forwarded-For", "10.0.0.1, 1.2.3.4")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// client can't hide behind spoofed address
+	r.Header.Set("X-Forwarded-For", "10.0.0.1")
+	r.Header.Add("X-Forwarded-For", "1.2.3.4")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestRemoteAddr(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Forwarded-For", "6.6.6.6, 1.2.3.4, 10.0.0.2")
+	assert.Equal(t, "192.0.2.1", New().remoteAddr(r))
+	assert.Equal(t, "10.0.0.2", New(TrustForwarded(1)).remoteAddr(r))
+	assert.Equal(t, "1.2.3.4", New(TrustForwarded(2)).remoteAddr(r))
+	assert.Equal(t, "6.6.6.6", New(TrustForwarded(5)).remoteAddr(r))
+}
+
+func TestListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	a := New()
+	assert.Nil(t, a.Set(Rules{Deny: []string{"127.0.0.0/8"}}))
+	ln = a.Listener(ln)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err)
+	// denied connection is closed by the server
+	_, err = c.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+	c.Close()
+	assert.Len(t, accepted, 0)
+}
@@ -3,22 +3,27 @@ package broker
 import (
 	"sync"
 	"time"
+
+	"github.com/minus5/svckit/log"
 )
 
 var (
-	brokers     map[string]*Broker
-	brokersLock sync.RWMutex
+	brokers                   = newRegistry(registryShards)
 	ttl         time.Duration = time.Hour
 	defaultSize int           = 100
+	slowTimeout time.Duration // 0 - ceka subscribera neograniceno
 )
 
-// SetTTL postavlja TTL za sve brokere
+// SetTTL postavlja TTL za sve brokere, vidi i SetTopicTTL
 func SetTTL(newTTL time.Duration) {
 	ttl = newTTL
 }
 
-func init() {
-	brokers = make(map[string]*Broker)
+// SetSlowTimeout postavlja koliko najduze broker ceka subscribera
+// da preuzme poruku. Spori subscriber se odspaja (zatvara mu se channel),
+// inace bi blokirao isporuku svim ostalim subscriberima.
+func SetSlowTimeout(timeout time.Duration) {
+	slowTimeout = timeout
 }
 
 // Message poruka full/diff brokera
@@ -35,10 +40,22 @@ func NewMessage(event string, data []byte) *Message {
 	}
 }
 
+// Reason razlog zbog kojeg je broker odspojio subscribera
+type Reason string
+
+// Razlozi odspajanja subscribera
+const (
+	ReasonUnsubscribed Reason = "unsubscribed" // subscriber je sam pozvao Unsubscribe
+	ReasonExpired      Reason = "expired"      // broker nije dobio update unutar ttl (CleanUpBrokers)
+	ReasonOverflow     Reason = "overflow"     // subscriber prespor, vidi SetSlowTimeout
+	ReasonClosed       Reason = "topic-closed" // broker je zatvoren (Close, CloseBroker)
+)
+
 type state interface {
 	put(*Message)
 	get() *Message
 	emit(chan *Message)
+	values() []*Message
 	waitTouch()
 }
 
@@ -47,15 +64,27 @@ type Broker struct {
 	topic       string
 	state       state
 	subscribers map[chan *Message]bool
+	onDone      map[chan *Message]func(Reason)
 	sync.RWMutex
 	removeLock sync.RWMutex
 	updated    time.Time
+	stats      Stats
+	statsLock  sync.Mutex
+}
+
+// Stats statistika isporuke poruka subscriberima
+type Stats struct {
+	Subscribers  int           // broj subscribera
+	SlowRemoved  int           // broj odspojenih sporih subscribera
+	MaxSendWait  time.Duration // najduze cekanje subscribera od proslog poziva Stats
+	LastSendWait time.Duration // cekanje na najsporijeg subscribera u zadnjem diff-u
 }
 
 func newBroker(topic string) *Broker {
 	return &Broker{
 		topic:       topic,
 		subscribers: make(map[chan *Message]bool),
+		onDone:      make(map[chan *Message]func(Reason)),
 		updated:     time.Now(),
 	}
 }
@@ -93,34 +122,45 @@ func (b *Broker) activeSubscribers() map[chan *Message]bool {
 }
 
 // removeSubscribers mice sve subscribere sa brokera
-func (b *Broker) removeSubscribers() {
+func (b *Broker) removeSubscribers(reason Reason) {
 	subs := b.activeSubscribers()
 	b.removeLock.Lock()
 	defer b.removeLock.Unlock()
 	for ch := range subs {
-		b.Unsubscribe(ch)
+		b.remove(ch, reason)
 	}
 }
 
-func (b *Broker) setSubscriber(ch chan *Message, sentFull bool) {
+func (b *Broker) setSubscriber(ch chan *Message, sentFull bool, onDone func(Reason)) {
 	b.Lock()
 	defer b.Unlock()
 	b.subscribers[ch] = sentFull
+	if onDone != nil {
+		b.onDone[ch] = onDone
+	}
 }
 
 // Subscribe dodaje subscribera na brokera
 // - vraca channel za poruke
 // - salje full prije nego doda subscribera u listu za primanje diff-ova
 func (b *Broker) Subscribe() chan *Message {
+	return b.SubscribeNotify(nil)
+}
+
+// SubscribeNotify kao Subscribe, onDone se poziva s razlogom
+// kada broker odspoji subscribera, prije zatvaranja channela.
+// Gateway tako moze klijentu javiti zasto je stream zavrsio.
+// onDone ne smije blokirati niti zvati metode brokera.
+func (b *Broker) SubscribeNotify(onDone func(Reason)) chan *Message {
 	// log.S("topic", b.topic).Debug("subscribe")
 	ch := make(chan *Message)
 	if b.state != nil {
 		go func() {
 			b.removeLock.RLock()
 			defer b.removeLock.RUnlock()
-			b.state.waitTouch()       // ceka barem jednu poruku u bufferu
-			b.state.emit(ch)          // salje sve poruke u bufferu (fullove)
-			b.setSubscriber(ch, true) // sad subscriber moze primati diffove
+			b.state.waitTouch()               // ceka barem jednu poruku u bufferu
+			b.state.emit(ch)                  // salje sve poruke u bufferu (fullove)
+			b.setSubscriber(ch, true, onDone) // sad subscriber moze primati diffove
 		}()
 	}
 	return ch
@@ -128,12 +168,28 @@ func (b *Broker) Subscribe() chan *Message {
 
 // Unsubscribe mice subscribera iz liste subscribera ako postoji
 func (b *Broker) Unsubscribe(ch chan *Message) {
+	b.remove(ch, ReasonUnsubscribed)
+}
+
+// remove mice subscribera, javlja mu razlog i zatvara channel
+func (b *Broker) remove(ch chan *Message, reason Reason) {
 	b.Lock()
 	defer b.Unlock()
-	if _, ok := b.subscribers[ch]; ok {
-		delete(b.subscribers, ch)
-		close(ch)
+	if _, ok := b.subscribers[ch]; !ok {
+		return
 	}
+	delete(b.subscribers, ch)
+	if onDone, ok := b.onDone[ch]; ok {
+		delete(b.onDone, ch)
+		onDone(reason)
+	}
+	close(ch)
+}
+
+// Close odspaja sve subscribere s razlogom ReasonClosed.
+// Broker ostaje u registru, za micanje vidi CloseBroker.
+func (b *Broker) Close() {
+	b.removeSubscribers(ReasonClosed)
 }
 
 func (b *Broker) full(msg *Message) {
@@ -144,19 +200,81 @@ func (b *Broker) full(msg *Message) {
 }
 
 func (b *Broker) diff(msg *Message) {
+	var slow []chan *Message
+	var wait time.Duration
 	b.RLock()
-	defer b.RUnlock()
 	for c, sentFull := range b.subscribers {
-		if sentFull {
-			c <- msg
+		if !sentFull {
+			continue
+		}
+		d, ok := send(c, msg)
+		if !ok {
+			slow = append(slow, c)
 		}
+		if d > wait {
+			wait = d
+		}
+	}
+	b.RUnlock()
+
+	for _, c := range slow {
+		log.S("topic", b.topic).Info("slow subscriber removed")
+		b.remove(c, ReasonOverflow)
+	}
+	b.statsLock.Lock()
+	defer b.statsLock.Unlock()
+	b.stats.SlowRemoved += len(slow)
+	b.stats.LastSendWait = wait
+	if wait > b.stats.MaxSendWait {
+		b.stats.MaxSendWait = wait
+	}
+}
+
+// send salje poruku subscriberu, vraca koliko je cekao i false ako je
+// subscriber spor
+func send(c chan *Message, msg *Message) (time.Duration, bool) {
+	start := time.Now()
+	if slowTimeout == 0 {
+		c <- msg
+		return time.Since(start), true
+	}
+	select {
+	case c <- msg:
+		return time.Since(start), true
+	default:
+	}
+	t := time.NewTimer(slowTimeout)
+	defer t.Stop()
+	select {
+	case c <- msg:
+		return time.Since(start), true
+	case <-t.C:
+		return time.Since(start), false
 	}
 }
 
+// subscribersLen vraca broj subscribera koji primaju diffove
+func (b *Broker) subscribersLen() int {
+	b.RLock()
+	defer b.RUnlock()
+	return len(b.subscribers)
+}
+
+// Stats vraca statistiku isporuke, MaxSendWait se resetira
+func (b *Broker) Stats() Stats {
+	subscribers := b.subscribersLen()
+	b.statsLock.Lock()
+	defer b.statsLock.Unlock()
+	s := b.stats
+	s.Subscribers = subscribers
+	b.stats.MaxSendWait = 0
+	return s
+}
+
 func (b *Broker) expired() bool {
 	b.RLock()
 	defer b.RUnlock()
-	return b.updated.Before(time.Now().Add(-ttl))
+	return b.updated.Before(time.Now().Add(-topicTTL(b.topic)))
 }
 
 // Full sprema full podatke za topic
@@ -183,55 +301,37 @@ func Stream(topic, event string, data []byte) {
 
 // FindBroker pronalazi brokera za topic
 func FindBroker(topic string) (*Broker, bool) {
-	brokersLock.RLock()
-	brokersLock.RUnlock()
-	b, ok := brokers[topic]
-	return b, ok
+	return brokers.find(topic)
 }
 
-func createFullDiffBroker(topic string) *Broker {
-	brokersLock.Lock()
-	defer brokersLock.Unlock()
-	b := NewFullDiffBroker(topic)
-	brokers[topic] = b
-	return b
-}
-
-func createBufferedBroker(topic string, size int) *Broker {
-	brokersLock.Lock()
-	defer brokersLock.Unlock()
-	b := NewBufferedBroker(topic, size)
-	brokers[topic] = b
-	return b
+func newBufferedBroker(topic string) *Broker {
+	return NewBufferedBroker(topic, defaultSize)
 }
 
 // GetFullDiffBroker dohvaca postojeceg ili kreira novi full/diff broker
 func GetFullDiffBroker(topic string) *Broker {
-	b, ok := FindBroker(topic)
-	if !ok {
-		return createFullDiffBroker(topic)
-	}
-	return b
+	return brokers.getOrCreate(topic, NewFullDiffBroker)
 }
 
 // GetBufferedBroker dohvaca postojeceg ili kreira novi buffered broker
 func GetBufferedBroker(topic string) *Broker {
-	b, ok := FindBroker(topic)
-	if !ok {
-		return createBufferedBroker(topic, defaultSize)
+	return brokers.getOrCreate(topic, newBufferedBroker)
+}
+
+// CloseBroker mice brokera za topic iz registra i odspaja mu subscribere
+// s razlogom ReasonClosed. Vraca false ako broker ne postoji.
+func CloseBroker(topic string) bool {
+	b, ok := brokers.remove(topic)
+	if ok {
+		b.Close()
 	}
-	return b
+	return ok
 }
 
 // CleanUpBrokers clisti listu brokera koji nisu dobili update
-// - namjena periodicki pozivati da se ne gomilaju brokeri koji nista ne rade
-func CleanUpBrokers() {
-	brokersLock.Lock()
-	defer brokersLock.Unlock()
-	for topic, b := range brokers {
-		if b.expired() {
-			delete(brokers, topic) // obrisi brokera za topic
-			b.removeSubscribers()  // makni njegove subscribere
-		}
-	}
+// - namjena periodicki pozivati da se ne gomilaju brokeri koji nista ne rade,
+// ili pokrenuti StartJanitor
+// - vraca broj obrisanih brokera
+func CleanUpBrokers() int {
+	return brokers.cleanUp()
 }
@@ -51,7 +51,9 @@ func TestFullDiff(t *testing.T) {
 }
 
 func TestBuffered(t *testing.T) {
-	createBufferedBroker("teststream", 10)
+	brokers.getOrCreate("teststream", func(topic string) *Broker {
+		return NewBufferedBroker(topic, 10)
+	})
 	Stream("teststream", "testevent", []byte("1"))
 	Stream("teststream", "testevent", []byte("2"))
 	Stream("teststream", "testevent", []byte("3"))
@@ -150,7 +152,7 @@ func TestCleanup(t *testing.T) {
 	SetTTL(time.Nanosecond)
 	time.Sleep(2 * time.Nanosecond) // Cekaj TTL
 	CleanUpBrokers()
-	assert.Len(t, brokers, 0)
+	assert.Equal(t, 0, brokers.len())
 
 	// Novi TTL da mogu testirati sa subscriberima
 	SetTTL(10 * time.Millisecond)
@@ -158,40 +160,39 @@ func TestCleanup(t *testing.T) {
 	Stream("teststream", "testevent", []byte("1"))
 	b := GetBufferedBroker("teststream") // dohvati brokera
 	assert.NotNil(t, b)
-	assert.Len(t, brokers, 1)
+	assert.Equal(t, 1, brokers.len())
 
 	// Subscribe i citanje prva 2 eventa
 	msgCh := b.Subscribe()
-	assert.Len(t, b.subscribers, 0) // Subscriber nije dodan nije dobio full
+	assert.Equal(t, 0, b.subscribersLen()) // Subscriber nije dodan nije dobio full
 	m := <-msgCh
 	assert.Equal(t, "1", string(m.Data))
 
 	time.Sleep(5 * time.Millisecond) // cekaj pola vremena do expire
 	CleanUpBrokers()
-	assert.Len(t, brokers, 1)       // broker ziv (nije expired)
-	assert.Len(t, b.subscribers, 1) // subscriber dobio sve fullove
+	assert.Equal(t, 1, brokers.len())      // broker ziv (nije expired)
+	assert.Equal(t, 1, b.subscribersLen()) // subscriber dobio sve fullove
 
 	time.Sleep(11 * time.Millisecond) // Cekaj TTL
 	CleanUpBrokers()
-	assert.Len(t, brokers, 0)       // nema brokera
-	assert.Len(t, b.subscribers, 0) // nema subscribera
+	assert.Equal(t, 0, brokers.len())      // nema brokera
+	assert.Equal(t, 0, b.subscribersLen()) // nema subscribera
 
 	m = <-msgCh
 	assert.Nil(t, m) // potvrdi da je closan channel
 }
 
-//
 func TestUnsubscribeBuffered(t *testing.T) {
 	topic := "unsubscribe_test"
 	b := GetBufferedBroker(topic)
 	assert.NotNil(t, b)
-	assert.Len(t, b.subscribers, 0) // nema subscribera
-	gr := runtime.NumGoroutine()    // sacuvaj broj gorutina
+	assert.Equal(t, 0, b.subscribersLen()) // nema subscribera
+	gr := runtime.NumGoroutine()           // sacuvaj broj gorutina
 
 	msgChan := b.Subscribe()
 	// nema subscribera jer nema poruka i nije zavrsio subscribe
 	assert.NotNil(t, msgChan)
-	assert.Len(t, b.subscribers, 0)
+	assert.Equal(t, 0, b.subscribersLen())
 	assert.Equal(t, gr+1, runtime.NumGoroutine())
 
 	// unsubscribe prije bilo koje poruke nece napraviti nista
@@ -200,10 +201,83 @@ func TestUnsubscribeBuffered(t *testing.T) {
 	// Poslana i procitana poruka dodaju subscribera
 	Stream(topic, "testevent", []byte("1"))
 	<-msgChan
-	assert.Len(t, b.subscribers, 1)
+	assert.Equal(t, 1, b.subscribersLen())
 	assert.Equal(t, gr, runtime.NumGoroutine()) // zavrsio subscribe
 
 	// Unsubscribe drugi puta mice subscribera
 	b.Unsubscribe(msgChan)
-	assert.Len(t, b.subscribers, 0)
+	assert.Equal(t, 0, b.subscribersLen())
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	SetSlowTimeout(10 * time.Millisecond)
+	defer SetSlowTimeout(0)
+
+	b := NewFullDiffBroker("slow")
+	b.full(NewMessage("full", []byte("1")))
+	fast := b.Subscribe()
+	slow := b.Subscribe()
+	<-fast
+	<-slow
+	time.Sleep(10 * time.Millisecond)
+
+	var buf []byte
+	done := concatenate(fast, &buf)
+	b.diff(NewMessage("diff", []byte("2")))
+	s := b.Stats()
+	assert.Equal(t, 1, s.SlowRemoved)
+	assert.Equal(t, 1, s.Subscribers)
+	assert.True(t, s.MaxSendWait >= 10*time.Millisecond)
+	assert.Equal(t, time.Duration(0), b.Stats().MaxSendWait)
+
+	_, ok := <-slow
+	assert.False(t, ok)
+	b.Unsubscribe(fast)
+	<-done
+}
+
+func TestDropReason(t *testing.T) {
+	subscribe := func(b *Broker) (chan *Message, chan Reason) {
+		reasons := make(chan Reason, 1)
+		ch := b.SubscribeNotify(func(r Reason) { reasons <- r })
+		<-ch // full
+		for b.subscribersLen() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		return ch, reasons
+	}
+
+	// unsubscribe
+	b := NewFullDiffBroker("reason")
+	b.full(NewMessage("full", []byte("1")))
+	ch, reasons := subscribe(b)
+	b.Unsubscribe(ch)
+	assert.Equal(t, ReasonUnsubscribed, <-reasons)
+
+	// spori subscriber
+	SetSlowTimeout(time.Millisecond)
+	_, reasons = subscribe(b)
+	b.diff(NewMessage("diff", []byte("2")))
+	assert.Equal(t, ReasonOverflow, <-reasons)
+	SetSlowTimeout(0)
+
+	// zatvoren topic
+	Full("reason_closed", "full", []byte("1"))
+	b, _ = FindBroker("reason_closed")
+	ch, reasons = subscribe(b)
+	assert.True(t, CloseBroker("reason_closed"))
+	assert.False(t, CloseBroker("reason_closed"))
+	assert.Equal(t, ReasonClosed, <-reasons)
+	_, ok := <-ch
+	assert.False(t, ok)
+
+	// expired
+	defer SetTTL(time.Hour)
+	SetTTL(time.Millisecond)
+	Full("reason_expired", "full", []byte("1"))
+	b, _ = FindBroker("reason_expired")
+	_, reasons = subscribe(b)
+	time.Sleep(2 * time.Millisecond)
+	CleanUpBrokers()
+	assert.Equal(t, ReasonExpired, <-reasons)
 }
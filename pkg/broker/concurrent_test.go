@@ -0,0 +1,62 @@
+package broker
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// runConcurrent paralelno kreira brokere, salje full/diff, subscribea,
+// odspaja i cisti registry. Smisleno samo s -race.
+func runConcurrent(t *testing.T, workers int, duration time.Duration) {
+	const topics = 16
+	prevTTL := ttl
+	SetTTL(5 * time.Millisecond)
+	defer SetTTL(prevTTL)
+
+	deadline := time.Now().Add(duration)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(w)))
+			for i := 0; time.Now().Before(deadline); i++ {
+				topic := fmt.Sprintf("concurrent%d", r.Intn(topics))
+				data := []byte(fmt.Sprintf("%d-%d", w, i))
+				// full prije subscribe, inace subscribe ceka prvu poruku
+				Full(topic, "full", data)
+				b := GetFullDiffBroker(topic)
+				ch := b.Subscribe()
+				go func() {
+					for range ch {
+					}
+				}()
+				Diff(topic, "diff", data)
+				Stream(topic+"stream", "line", data)
+				if _, ok := FindBroker(topic); ok && r.Intn(2) == 0 {
+					b.Unsubscribe(ch)
+				}
+				b.Stats()
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for time.Now().Before(deadline) {
+			CleanUpBrokers()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	wg.Wait()
+	assert.True(t, brokers.len() <= 2*topics)
+}
+
+func TestConcurrent(t *testing.T) {
+	runConcurrent(t, 8, 200*time.Millisecond)
+}
@@ -25,7 +25,8 @@ func StreamingSSE(w http.ResponseWriter, r *http.Request, b *Broker, closeSignal
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
-	msgsCh := b.Subscribe()
+	var reason Reason // postavlja se prije zatvaranja msgsCh
+	msgsCh := b.SubscribeNotify(func(r Reason) { reason = r })
 
 	// dozvoljavamo da client posalje svoj id, sluzi za bug tracking
 	clientID := r.FormValue("clientid")
@@ -97,6 +98,10 @@ func StreamingSSE(w http.ResponseWriter, r *http.Request, b *Broker, closeSignal
 			unsubscribe()
 		case m := <-msgsCh:
 			if m == nil {
+				if reason != ReasonUnsubscribed && !closing {
+					// broker nas je odspojio, javi klijentu zasto
+					sendToCh(NewMessage("status", []byte(reason)))
+				}
 				close(sendChan) //msgsCh closan, nema sto za slati
 				return
 			}
@@ -124,7 +124,7 @@ func TestStreamingSSE(t *testing.T) {
 	topic := "httpi_test"
 	b := GetBufferedBroker(topic)
 	assert.NotNil(t, b)
-	assert.Len(t, b.subscribers, 0) // nema subascribera
+	assert.Equal(t, 0, b.subscribersLen()) // nema subascribera
 
 	// Postavi podatke u brokera
 	Stream(topic, "event-q", []byte("1"))
@@ -142,7 +142,7 @@ func TestStreamingSSE(t *testing.T) {
 	msg = <-msgCh
 	assert.Equal(t, "event-q", msg.Event)
 	assert.Equal(t, []byte("1"), msg.Data)
-	assert.Len(t, b.subscribers, 1) // ima 1 subscriber jer smo primili 1 poruku
+	assert.Equal(t, 1, b.subscribersLen()) // ima 1 subscriber jer smo primili 1 poruku
 
 	msg = <-msgCh
 	assert.Equal(t, "event-q", msg.Event)
@@ -151,7 +151,7 @@ func TestStreamingSSE(t *testing.T) {
 	close(doneCh)    // Prestani slusati SSE
 	close(closeHTTP) // Stop HTTP SSE server
 
-	wg.Wait()                          // pricekaj se se server i klijent zagase
-	time.Sleep(100 * time.Millisecond) // pricekaj malo da se ociste konekcije
-	assert.Len(t, b.subscribers, 0)    // nema subscribera client se odspojio
+	wg.Wait()                              // pricekaj se se server i klijent zagase
+	time.Sleep(100 * time.Millisecond)     // pricekaj malo da se ociste konekcije
+	assert.Equal(t, 0, b.subscribersLen()) // nema subscribera client se odspojio
 }
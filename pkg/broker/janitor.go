@@ -0,0 +1,54 @@
+package broker
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/metric"
+)
+
+var (
+	topicTTLs     = make(map[string]time.Duration) // ttl po topicu, ima prednost pred SetTTL
+	topicTTLsLock sync.RWMutex
+)
+
+// SetTopicTTL postavlja TTL za brokera topica, 0 vraca na TTL za sve brokere
+func SetTopicTTL(topic string, ttl time.Duration) {
+	topicTTLsLock.Lock()
+	defer topicTTLsLock.Unlock()
+	if ttl == 0 {
+		delete(topicTTLs, topic)
+		return
+	}
+	topicTTLs[topic] = ttl
+}
+
+// topicTTL vraca TTL brokera za topic
+func topicTTL(topic string) time.Duration {
+	topicTTLsLock.RLock()
+	defer topicTTLsLock.RUnlock()
+	if t, ok := topicTTLs[topic]; ok {
+		return t
+	}
+	return ttl
+}
+
+// StartJanitor periodicki (svaki interval) cisti brokere koji nisu
+// dobili update unutar svog TTL-a, dok se ne zatvori ctx.
+// Salje metrike broker.reaped (broj obrisanih u prolazu) i broker.count.
+func StartJanitor(ctx context.Context, interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				metric.Counter("broker.reaped", CleanUpBrokers())
+				metric.Gauge("broker.count", brokers.len())
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
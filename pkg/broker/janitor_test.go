@@ -0,0 +1,35 @@
+package broker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJanitor(t *testing.T) {
+	defer SetTTL(time.Hour)
+	SetTTL(time.Hour)
+	SetTopicTTL("janitor_short", 5*time.Millisecond)
+	defer SetTopicTTL("janitor_short", 0)
+
+	Full("janitor_short", "full", []byte("1"))
+	Full("janitor_long", "full", []byte("1"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	StartJanitor(ctx, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	time.Sleep(5 * time.Millisecond) // janitor zavrsava
+
+	_, ok := FindBroker("janitor_short")
+	assert.False(t, ok) // obrisan nakon svog ttl-a
+	_, ok = FindBroker("janitor_long")
+	assert.True(t, ok) // ima ttl za sve brokere
+
+	SetTopicTTL("janitor_long", time.Nanosecond)
+	defer SetTopicTTL("janitor_long", 0)
+	time.Sleep(time.Millisecond)
+	assert.Equal(t, 1, CleanUpBrokers())
+}
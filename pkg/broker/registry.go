@@ -0,0 +1,118 @@
+package broker
+
+import "sync"
+
+// broj shardova registra brokera
+const registryShards = 32
+
+// registry brokera po topicu.
+// Podijeljen je na shardove po hashu topica, svaki shard ima svoj lock,
+// da se s tisucama topica ne natjecu svi za isti lock.
+type registry struct {
+	shards []*registryShard
+}
+
+type registryShard struct {
+	brokers map[string]*Broker
+	sync.RWMutex
+}
+
+func newRegistry(n int) *registry {
+	r := &registry{}
+	for i := 0; i < n; i++ {
+		r.shards = append(r.shards, &registryShard{brokers: make(map[string]*Broker)})
+	}
+	return r
+}
+
+// shard vraca shard topica (fnv-1a hash)
+func (r *registry) shard(topic string) *registryShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(topic); i++ {
+		h ^= uint32(topic[i])
+		h *= 16777619
+	}
+	return r.shards[h%uint32(len(r.shards))]
+}
+
+func (r *registry) find(topic string) (*Broker, bool) {
+	s := r.shard(topic)
+	s.RLock()
+	defer s.RUnlock()
+	b, ok := s.brokers[topic]
+	return b, ok
+}
+
+// getOrCreate vraca postojeceg brokera ili kreira novog s create.
+// Provjera i upis su pod istim lockom, da dva paralelna poziva
+// ne kreiraju dva brokera za isti topic.
+func (r *registry) getOrCreate(topic string, create func(string) *Broker) *Broker {
+	if b, ok := r.find(topic); ok {
+		return b
+	}
+	s := r.shard(topic)
+	s.Lock()
+	defer s.Unlock()
+	if b, ok := s.brokers[topic]; ok {
+		return b
+	}
+	b := create(topic)
+	s.brokers[topic] = b
+	return b
+}
+
+// remove brise brokera za topic iz registra
+func (r *registry) remove(topic string) (*Broker, bool) {
+	s := r.shard(topic)
+	s.Lock()
+	defer s.Unlock()
+	b, ok := s.brokers[topic]
+	if ok {
+		delete(s.brokers, topic)
+	}
+	return b, ok
+}
+
+// all vraca sve brokere po topicu
+func (r *registry) all() map[string]*Broker {
+	all := make(map[string]*Broker)
+	for _, s := range r.shards {
+		s.RLock()
+		for topic, b := range s.brokers {
+			all[topic] = b
+		}
+		s.RUnlock()
+	}
+	return all
+}
+
+// len vraca ukupni broj brokera
+func (r *registry) len() int {
+	n := 0
+	for _, s := range r.shards {
+		s.RLock()
+		n += len(s.brokers)
+		s.RUnlock()
+	}
+	return n
+}
+
+// cleanUp brise brokere koji nisu dobili update unutar ttl, vraca broj obrisanih.
+// Subscriberi se micu izvan locka shard-a, da ga ne drze dok se zatvaraju.
+func (r *registry) cleanUp() int {
+	var expired []*Broker
+	for _, s := range r.shards {
+		s.Lock()
+		for topic, b := range s.brokers {
+			if b.expired() {
+				delete(s.brokers, topic) // obrisi brokera za topic
+				expired = append(expired, b)
+			}
+		}
+		s.Unlock()
+	}
+	for _, b := range expired {
+		b.removeSubscribers(ReasonExpired) // makni njegove subscribere
+	}
+	return len(expired)
+}
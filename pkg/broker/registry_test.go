@@ -0,0 +1,54 @@
+package broker
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	r := newRegistry(4)
+	for i := 0; i < 100; i++ {
+		topic := fmt.Sprintf("t%d", i)
+		r.getOrCreate(topic, newBroker)
+	}
+	assert.Equal(t, 100, r.len())
+	assert.Equal(t, r.getOrCreate("t1", newBroker), r.getOrCreate("t1", newBroker))
+	b, ok := r.find("t42")
+	assert.True(t, ok)
+	assert.Equal(t, "t42", b.topic)
+	_, ok = r.find("t100")
+	assert.False(t, ok)
+	// svaki shard ima dio topica
+	for _, s := range r.shards {
+		assert.NotEmpty(t, s.brokers)
+	}
+}
+
+// benchmarkRegistry paralelno dohvaca brokere za 10k topica
+func benchmarkRegistry(b *testing.B, shards int) {
+	const topics = 10000
+	r := newRegistry(shards)
+	names := make([]string, topics)
+	for i := range names {
+		names[i] = fmt.Sprintf("topic%d", i)
+		r.getOrCreate(names[i], newBroker)
+	}
+	var no uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddUint64(&no, 1)
+			r.getOrCreate(names[i%topics], newBroker)
+		}
+	})
+}
+
+// BenchmarkRegistry usporeduje jedan lock sa shardovima,
+// razlika se vidi s GOMAXPROCS > 1 (go test -bench Registry -cpu 1,4,16).
+func BenchmarkRegistry(b *testing.B) {
+	b.Run("single", func(b *testing.B) { benchmarkRegistry(b, 1) })
+	b.Run("sharded", func(b *testing.B) { benchmarkRegistry(b, registryShards) })
+}
@@ -0,0 +1,60 @@
+package broker
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// topicSnapshot stanje jednog brokera
+type topicSnapshot struct {
+	Topic    string     `json:"topic"`
+	Size     int        `json:"size"` // velicina buffera, 1 za full/diff brokera
+	Messages []*Message `json:"messages"`
+}
+
+// Export serijalizira stanje svih brokera (fullove i buffere).
+// Namjena je spremiti stanje na gasenju servisa i vratiti ga s Import
+// na startu, da se nakon deploya svi topici ne traze ispocetka.
+func Export() ([]byte, error) {
+	var snaps []topicSnapshot
+	for topic, b := range brokers.all() {
+		if b.state == nil {
+			continue
+		}
+		values := b.state.values()
+		snap := topicSnapshot{Topic: topic, Size: len(values)}
+		for _, m := range values {
+			if m != nil {
+				snap.Messages = append(snap.Messages, m)
+			}
+		}
+		snaps = append(snaps, snap)
+	}
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].Topic < snaps[j].Topic })
+	buf, err := json.Marshal(snaps)
+	return buf, errors.WithStack(err)
+}
+
+// Import vraca stanje brokera spremljeno s Export.
+// Brokeri koji ne postoje se kreiraju, u postojece se dodaju poruke.
+func Import(buf []byte) error {
+	var snaps []topicSnapshot
+	if err := json.Unmarshal(buf, &snaps); err != nil {
+		return errors.Wrap(err, "broker snapshot")
+	}
+	for _, snap := range snaps {
+		size := snap.Size
+		if size < 1 {
+			size = 1
+		}
+		b := brokers.getOrCreate(snap.Topic, func(topic string) *Broker {
+			return NewBufferedBroker(topic, size)
+		})
+		for _, m := range snap.Messages {
+			b.full(m)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	Full("snapshot_full", "full", []byte("1"))
+	Full("snapshot_full", "full", []byte("2"))
+	Stream("snapshot_stream", "line", []byte("a"))
+	Stream("snapshot_stream", "line", []byte("b"))
+
+	buf, err := Export()
+	assert.NoError(t, err)
+
+	CloseBroker("snapshot_full")
+	CloseBroker("snapshot_stream")
+	assert.NoError(t, Import(buf))
+
+	b, ok := FindBroker("snapshot_full")
+	assert.True(t, ok)
+	assert.Equal(t, "2", string(b.State().Data))
+	assert.Len(t, b.state.values(), 1)
+
+	b, ok = FindBroker("snapshot_stream")
+	assert.True(t, ok)
+	assert.Len(t, b.state.values(), defaultSize)
+	var data []byte
+	ch := b.Subscribe()
+	for i := 0; i < 2; i++ {
+		data = append(data, (<-ch).Data...)
+	}
+	assert.Equal(t, "ab", string(data))
+	b.Unsubscribe(ch)
+
+	assert.Error(t, Import([]byte("{")))
+}
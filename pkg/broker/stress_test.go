@@ -0,0 +1,14 @@
+// +build stress
+
+package broker
+
+import (
+	"testing"
+	"time"
+)
+
+// TestStress dugo paralelno opterecenje registry-a i brokera,
+// pokrece se s: make stress
+func TestStress(t *testing.T) {
+	runConcurrent(t, 64, 30*time.Second)
+}